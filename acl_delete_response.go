@@ -36,6 +36,9 @@ func (d *DeleteAclsResponse) decode(pd packetDecoder, version int16) (err error)
 	if err != nil {
 		return err
 	}
+	if n < 0 {
+		return errInvalidArrayLength
+	}
 	d.FilterResponses = make([]*FilterResponse, n)
 
 	for i := 0; i < n; i++ {
@@ -117,6 +120,9 @@ func (f *FilterResponse) decode(pd packetDecoder, version int16) (err error) {
 	if err != nil {
 		return err
 	}
+	if n < 0 {
+		return errInvalidArrayLength
+	}
 	f.MatchingAcls = make([]*MatchingAcl, n)
 	for i := 0; i < n; i++ {
 		f.MatchingAcls[i] = new(MatchingAcl)
@@ -3,7 +3,6 @@ package sarama
 import (
 	"errors"
 	"fmt"
-	"math/rand"
 	"strconv"
 	"sync"
 	"time"
@@ -99,8 +98,18 @@ type ClusterAdmin interface {
 	// This operation is supported by brokers with version 0.11.0.0 or higher.
 	DeleteACL(filter AclFilter, validateOnly bool) ([]MatchingAcl, error)
 
-	// List the consumer groups available in the cluster.
-	ListConsumerGroups() (map[string]string, error)
+	// List the consumer groups available in the cluster, mapped to their
+	// protocol type. Every broker is queried, as each only knows the groups
+	// it coordinates. If states are given only groups in one of them are
+	// returned.
+	ListConsumerGroups(states ...ConsumerGroupState) (map[string]string, error)
+
+	// List the consumer groups available in the cluster along with their
+	// protocol type and, on Kafka 2.6 or higher, their state. If states are
+	// given only groups in one of them are returned: the filter is applied
+	// by the brokers on Kafka 2.6 or higher, and otherwise by describing the
+	// groups to learn their state.
+	ListConsumerGroupListings(states ...ConsumerGroupState) (map[string]ConsumerGroupListing, error)
 
 	// Describe the given consumer groups.
 	DescribeConsumerGroups(groups []string) ([]*GroupDescription, error)
@@ -111,6 +120,34 @@ type ClusterAdmin interface {
 	// Deletes a consumer group offset
 	DeleteConsumerGroupOffset(group string, topic string, partition int32) error
 
+	// Deletes the committed offsets of a consumer group for the given topic
+	// partitions, leaving its other offsets in place. Partitions that could not
+	// be deleted are reported in an error wrapping ErrDeleteConsumerGroupOffsets.
+	// The offsets are deleted from Consumer.Offsets.Store if one is set.
+	// Otherwise this operation is supported by brokers with version 2.4.0.0 or
+	// higher.
+	DeleteConsumerGroupOffsets(group string, topicPartitions map[string][]int32) error
+
+	// Export the committed offsets of a consumer group, e.g. to migrate the
+	// group to another cluster with ImportConsumerGroupOffsets. This operation
+	// is supported by brokers with version 0.10.2.0 or higher.
+	ExportConsumerGroupOffsets(group string) (OffsetSnapshot, error)
+
+	// Import the offsets of a snapshot by committing them for the given group,
+	// which should not have any active members. Offsets of topics or partitions
+	// that do not exist in this cluster are skipped, the skipped and failed
+	// partitions are reported in an error wrapping ErrImportConsumerGroupOffsets
+	// while all other offsets are committed.
+	ImportConsumerGroupOffsets(group string, snap OffsetSnapshot) error
+
+	// Reset the committed offsets of a consumer group on all partitions of a
+	// topic to the earliest offsets whose timestamps are at or after t, or to
+	// the end of the log if there are none. The group must not have any active
+	// members, otherwise an error wrapping ErrNonEmptyGroup is returned. It
+	// returns the offsets the partitions were reset to. This operation is
+	// supported by brokers with version 0.10.1.0 or higher.
+	ResetConsumerGroupOffsetsToTime(group, topic string, t time.Time) (map[int32]int64, error)
+
 	// Delete a consumer group.
 	DeleteConsumerGroup(group string) error
 
@@ -129,13 +166,23 @@ type ClusterAdmin interface {
 	// Upsert SCRAM users
 	UpsertUserScramCredentials(upsert []AlterUserScramCredentialsUpsert) ([]*AlterUserScramCredentialsResult, error)
 
+	// Creates or updates the SCRAM credential of a user for the given mechanism.
+	// A random salt is generated and the password is salted locally, so it is never sent to the broker.
+	// If iterations is 0, the minimum accepted by the broker (4096) is used.
+	// This operation is supported by brokers with version 2.7.0.0 or higher.
+	UpsertUserScramCredential(user string, mechanism ScramMechanismType, iterations int32, password []byte) error
+
+	// Deletes the SCRAM credential of a user for the given mechanism.
+	// This operation is supported by brokers with version 2.7.0.0 or higher.
+	DeleteUserScramCredential(user string, mechanism ScramMechanismType) error
+
 	// Get client quota configurations corresponding to the specified filter.
 	// This operation is supported by brokers with version 2.6.0.0 or higher.
 	DescribeClientQuotas(components []QuotaFilterComponent, strict bool) ([]DescribeClientQuotasEntry, error)
 
-	// Alters client quota configurations with the specified alterations.
+	// Alters client quota configurations of the given entity with the specified alterations.
 	// This operation is supported by brokers with version 2.6.0.0 or higher.
-	AlterClientQuotas(entity []QuotaEntityComponent, op ClientQuotasOp, validateOnly bool) error
+	AlterClientQuotas(entity []QuotaEntityComponent, ops []ClientQuotasOp, validateOnly bool) error
 
 	// Controller returns the cluster controller broker. It will return a
 	// locally cached value if it's available.
@@ -216,7 +263,7 @@ func (ca *clusterAdmin) retryOnError(retryable func(error) bool, fn func() error
 		Logger.Printf(
 			"admin/request retrying after %dms... (%d attempts remaining)\n",
 			ca.conf.Admin.Retry.Backoff/time.Millisecond, attemptsRemaining)
-		time.Sleep(ca.conf.Admin.Retry.Backoff)
+		ca.conf.getClock().Sleep(ca.conf.Admin.Retry.Backoff)
 	}
 }
 
@@ -228,6 +275,7 @@ func (ca *clusterAdmin) CreateTopic(topic string, detail *TopicDetail, validateO
 	if detail == nil {
 		return errors.New("you must specify topic details")
 	}
+	topic = ca.conf.physicalTopic(topic)
 
 	topicDetails := make(map[string]*TopicDetail)
 	topicDetails[topic] = detail
@@ -283,7 +331,7 @@ func (ca *clusterAdmin) DescribeTopics(topics []string) (metadata []*TopicMetada
 		if err != nil {
 			return err
 		}
-		request := NewMetadataRequest(ca.conf.Version, topics)
+		request := NewMetadataRequest(ca.conf.Version, ca.conf.physicalTopics(topics))
 		response, err = controller.GetMetadata(request)
 		if isErrNotController(err) {
 			_, _ = ca.refreshController()
@@ -293,7 +341,16 @@ func (ca *clusterAdmin) DescribeTopics(topics []string) (metadata []*TopicMetada
 	if err != nil {
 		return nil, err
 	}
-	return response.Topics, nil
+	if ca.conf.TopicPrefix == "" {
+		return response.Topics, nil
+	}
+	for _, topic := range response.Topics {
+		var ok bool
+		if topic.Name, ok = ca.conf.logicalTopic(topic.Name); ok {
+			metadata = append(metadata, topic)
+		}
+	}
+	return metadata, nil
 }
 
 func (ca *clusterAdmin) DescribeCluster() (brokers []*Broker, controllerID int32, err error) {
@@ -329,10 +386,8 @@ func (ca *clusterAdmin) findBroker(id int32) (*Broker, error) {
 }
 
 func (ca *clusterAdmin) findAnyBroker() (*Broker, error) {
-	brokers := ca.client.Brokers()
-	if len(brokers) > 0 {
-		index := rand.Intn(len(brokers))
-		return brokers[index], nil
+	if broker := ca.client.LeastLoadedBroker(); broker != nil {
+		return broker, nil
 	}
 	return nil, errors.New("no available broker")
 }
@@ -361,6 +416,9 @@ func (ca *clusterAdmin) ListTopics() (map[string]TopicDetail, error) {
 	var describeConfigsResources []*ConfigResource
 
 	for _, topic := range metadataResp.Topics {
+		if _, ok := ca.conf.logicalTopic(topic.Name); !ok {
+			continue
+		}
 		topicDetails := TopicDetail{
 			NumPartitions: int32(len(topic.Partitions)),
 		}
@@ -416,7 +474,15 @@ func (ca *clusterAdmin) ListTopics() (map[string]TopicDetail, error) {
 		topicsDetailsMap[resource.Name] = topicDetails
 	}
 
-	return topicsDetailsMap, nil
+	if ca.conf.TopicPrefix == "" {
+		return topicsDetailsMap, nil
+	}
+	logicalDetailsMap := make(map[string]TopicDetail, len(topicsDetailsMap))
+	for topic, topicDetails := range topicsDetailsMap {
+		topic, _ = ca.conf.logicalTopic(topic)
+		logicalDetailsMap[topic] = topicDetails
+	}
+	return logicalDetailsMap, nil
 }
 
 func (ca *clusterAdmin) DeleteTopic(topic string) error {
@@ -424,6 +490,8 @@ func (ca *clusterAdmin) DeleteTopic(topic string) error {
 		return ErrInvalidTopic
 	}
 
+	topic = ca.conf.physicalTopic(topic)
+
 	request := &DeleteTopicsRequest{
 		Topics:  []string{topic},
 		Timeout: ca.conf.Admin.Timeout,
@@ -470,6 +538,8 @@ func (ca *clusterAdmin) CreatePartitions(topic string, count int32, assignment [
 		return ErrInvalidTopic
 	}
 
+	topic = ca.conf.physicalTopic(topic)
+
 	topicPartitions := make(map[string]*TopicPartition)
 	topicPartitions[topic] = &TopicPartition{Count: count, Assignment: assignment}
 
@@ -514,6 +584,8 @@ func (ca *clusterAdmin) AlterPartitionReassignments(topic string, assignment [][
 		return ErrInvalidTopic
 	}
 
+	topic = ca.conf.physicalTopic(topic)
+
 	request := &AlterPartitionReassignmentsRequest{
 		TimeoutMs: int32(60000),
 		Version:   int16(0),
@@ -567,7 +639,7 @@ func (ca *clusterAdmin) ListPartitionReassignments(topic string, partitions []in
 		Version:   int16(0),
 	}
 
-	request.AddBlock(topic, partitions)
+	request.AddBlock(ca.conf.physicalTopic(topic), partitions)
 
 	var rsp *ListPartitionReassignmentsResponse
 	err = ca.retryOnError(isErrNotController, func() error {
@@ -585,7 +657,12 @@ func (ca *clusterAdmin) ListPartitionReassignments(topic string, partitions []in
 	})
 
 	if err == nil && rsp != nil {
-		return rsp.TopicStatus, nil
+		topicStatus = make(map[string]map[int32]*PartitionReplicaReassignmentsStatus, len(rsp.TopicStatus))
+		for topic, status := range rsp.TopicStatus {
+			topic, _ = ca.conf.logicalTopic(topic)
+			topicStatus[topic] = status
+		}
+		return topicStatus, nil
 	} else {
 		return nil, err
 	}
@@ -595,6 +672,7 @@ func (ca *clusterAdmin) DeleteRecords(topic string, partitionOffsets map[int32]i
 	if topic == "" {
 		return ErrInvalidTopic
 	}
+	topic = ca.conf.physicalTopic(topic)
 	errs := make([]error, 0)
 	partitionPerBroker := make(map[*Broker][]int32)
 	for partition := range partitionOffsets {
@@ -656,6 +734,9 @@ func dependsOnSpecificNode(resource ConfigResource) bool {
 }
 
 func (ca *clusterAdmin) DescribeConfig(resource ConfigResource) ([]ConfigEntry, error) {
+	if resource.Type == TopicResource {
+		resource.Name = ca.conf.physicalTopic(resource.Name)
+	}
 	var entries []ConfigEntry
 	var resources []*ConfigResource
 	resources = append(resources, &resource)
@@ -712,6 +793,9 @@ func (ca *clusterAdmin) DescribeConfig(resource ConfigResource) ([]ConfigEntry,
 }
 
 func (ca *clusterAdmin) AlterConfig(resourceType ConfigResourceType, name string, entries map[string]*string, validateOnly bool) error {
+	if resourceType == TopicResource {
+		name = ca.conf.physicalTopic(name)
+	}
 	var resources []*AlterConfigsResource
 	resources = append(resources, &AlterConfigsResource{
 		Type:          resourceType,
@@ -764,6 +848,9 @@ func (ca *clusterAdmin) AlterConfig(resourceType ConfigResourceType, name string
 }
 
 func (ca *clusterAdmin) IncrementalAlterConfig(resourceType ConfigResourceType, name string, entries map[string]IncrementalAlterConfigsEntry, validateOnly bool) error {
+	if resourceType == TopicResource {
+		name = ca.conf.physicalTopic(name)
+	}
 	var resources []*IncrementalAlterConfigsResource
 	resources = append(resources, &IncrementalAlterConfigsResource{
 		Type:          resourceType,
@@ -946,25 +1033,38 @@ func (ca *clusterAdmin) DescribeConsumerGroups(groups []string) (result []*Group
 	return result, nil
 }
 
-func (ca *clusterAdmin) ListConsumerGroups() (allGroups map[string]string, err error) {
-	allGroups = make(map[string]string)
+func (ca *clusterAdmin) ListConsumerGroups(states ...ConsumerGroupState) (map[string]string, error) {
+	listings, err := ca.ListConsumerGroupListings(states...)
+	allGroups := make(map[string]string, len(listings))
+	for group, listing := range listings {
+		allGroups[group] = listing.ProtocolType
+	}
+	return allGroups, err
+}
+
+func (ca *clusterAdmin) ListConsumerGroupListings(states ...ConsumerGroupState) (allGroups map[string]ConsumerGroupListing, err error) {
+	allGroups = make(map[string]ConsumerGroupListing)
 
 	// Query brokers in parallel, since we have to query *all* brokers
 	brokers := ca.client.Brokers()
-	groupMaps := make(chan map[string]string, len(brokers))
+	groupMaps := make(chan map[string]ConsumerGroupListing, len(brokers))
 	errChan := make(chan error, len(brokers))
 	wg := sync.WaitGroup{}
 
 	for _, b := range brokers {
 		wg.Add(1)
-		go func(b *Broker, conf *Config) {
+		b := b
+		goWithRecover(ca.conf.MetricRegistry, func() {
 			defer wg.Done()
-			_ = b.Open(conf) // Ensure that broker is opened
+			_ = b.Open(ca.conf) // Ensure that broker is opened
 
 			request := &ListGroupsRequest{}
 			if ca.conf.Version.IsAtLeast(V2_6_0_0) {
 				// Version 4 adds the StatesFilter field (KIP-518).
 				request.Version = 4
+				for _, state := range states {
+					request.StatesFilter = append(request.StatesFilter, string(state))
+				}
 			} else if ca.conf.Version.IsAtLeast(V2_4_0_0) {
 				// Version 3 is the first flexible version.
 				request.Version = 3
@@ -981,40 +1081,102 @@ func (ca *clusterAdmin) ListConsumerGroups() (allGroups map[string]string, err e
 				errChan <- err
 				return
 			}
+			if !errors.Is(response.Err, ErrNoError) {
+				errChan <- response.Err
+				return
+			}
 
-			groups := make(map[string]string)
+			groups := make(map[string]ConsumerGroupListing, len(response.Groups))
 			for group, typ := range response.Groups {
-				groups[group] = typ
+				groups[group] = ConsumerGroupListing{
+					ProtocolType: typ,
+					State:        ConsumerGroupState(response.GroupsData[group].GroupState),
+				}
 			}
 
 			groupMaps <- groups
-		}(b, ca.conf)
+		})
 	}
 
 	wg.Wait()
 	close(groupMaps)
 	close(errChan)
 
+	// deduplicate groups reported by more than one broker
 	for groupMap := range groupMaps {
-		for group, protocolType := range groupMap {
-			allGroups[group] = protocolType
+		for group, listing := range groupMap {
+			allGroups[group] = listing
 		}
 	}
 
 	// Intentionally return only the first error for simplicity
 	err = <-errChan
+
+	if len(states) > 0 && len(allGroups) > 0 {
+		if !ca.conf.Version.IsAtLeast(V2_6_0_0) {
+			// the brokers could not filter or report states, so look them up
+			if describeErr := ca.describeConsumerGroupStates(allGroups); describeErr != nil && err == nil {
+				err = describeErr
+			}
+		}
+		for group, listing := range allGroups {
+			if !containsConsumerGroupState(states, listing.State) {
+				delete(allGroups, group)
+			}
+		}
+	}
 	return
 }
 
+// describeConsumerGroupStates sets the State of each listed group from its
+// group description.
+func (ca *clusterAdmin) describeConsumerGroupStates(listings map[string]ConsumerGroupListing) error {
+	groups := make([]string, 0, len(listings))
+	for group := range listings {
+		groups = append(groups, group)
+	}
+	descriptions, err := ca.DescribeConsumerGroups(groups)
+	if err != nil {
+		return err
+	}
+	for _, description := range descriptions {
+		if listing, ok := listings[description.GroupId]; ok {
+			listing.State = ConsumerGroupState(description.State)
+			listings[description.GroupId] = listing
+		}
+	}
+	return nil
+}
+
+func containsConsumerGroupState(states []ConsumerGroupState, state ConsumerGroupState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
 func (ca *clusterAdmin) ListConsumerGroupOffsets(group string, topicPartitions map[string][]int32) (*OffsetFetchResponse, error) {
 	coordinator, err := ca.client.Coordinator(group)
 	if err != nil {
 		return nil, err
 	}
 
-	request := NewOffsetFetchRequest(ca.conf.Version, group, topicPartitions)
+	request := NewOffsetFetchRequest(ca.conf.Version, group, ca.conf.physicalTopicPartitions(topicPartitions))
 
-	return coordinator.FetchOffset(request)
+	resp, err := coordinator.FetchOffset(request)
+	if err != nil || ca.conf.TopicPrefix == "" {
+		return resp, err
+	}
+	blocks := make(map[string]map[int32]*OffsetFetchResponseBlock, len(resp.Blocks))
+	for topic, partitions := range resp.Blocks {
+		if topic, ok := ca.conf.logicalTopic(topic); ok {
+			blocks[topic] = partitions
+		}
+	}
+	resp.Blocks = blocks
+	return resp, nil
 }
 
 func (ca *clusterAdmin) DeleteConsumerGroupOffset(group string, topic string, partition int32) error {
@@ -1023,6 +1185,7 @@ func (ca *clusterAdmin) DeleteConsumerGroupOffset(group string, topic string, pa
 		return err
 	}
 
+	topic = ca.conf.physicalTopic(topic)
 	request := &DeleteOffsetsRequest{
 		Group: group,
 		partitions: map[string][]int32{
@@ -1045,6 +1208,189 @@ func (ca *clusterAdmin) DeleteConsumerGroupOffset(group string, topic string, pa
 	return nil
 }
 
+func (ca *clusterAdmin) DeleteConsumerGroupOffsets(group string, topicPartitions map[string][]int32) error {
+	return offsetStore(ca.client, nil).DeleteOffsets(group, ca.conf.physicalTopicPartitions(topicPartitions))
+}
+
+func (ca *clusterAdmin) ExportConsumerGroupOffsets(group string) (OffsetSnapshot, error) {
+	snap := OffsetSnapshot{Group: group}
+
+	resp, err := ca.ListConsumerGroupOffsets(group, nil)
+	if err != nil {
+		return snap, err
+	}
+	if !errors.Is(resp.Err, ErrNoError) {
+		return snap, resp.Err
+	}
+
+	for topic, partitions := range resp.Blocks {
+		for partition, block := range partitions {
+			if !errors.Is(block.Err, ErrNoError) {
+				return snap, fmt.Errorf("[%s-%d]: %w", topic, partition, block.Err)
+			}
+			if block.Offset < 0 {
+				// nothing committed
+				continue
+			}
+			snap.AddOffset(topic, partition, block.Offset, block.Metadata)
+		}
+	}
+	return snap, nil
+}
+
+func (ca *clusterAdmin) ImportConsumerGroupOffsets(group string, snap OffsetSnapshot) error {
+	var errs []error
+	offsets := make(map[string]map[int32]SnapshotOffset, len(snap.Offsets))
+	for topic, partitionOffsets := range snap.Offsets {
+		physicalTopic := ca.conf.physicalTopic(topic)
+		partitions, err := ca.client.Partitions(physicalTopic)
+		if errors.Is(err, ErrUnknownTopicOrPartition) {
+			for partition := range partitionOffsets {
+				errs = append(errs, fmt.Errorf("[%s-%d]: skipped: %w", topic, partition, err))
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		exists := make(map[int32]bool, len(partitions))
+		for _, partition := range partitions {
+			exists[partition] = true
+		}
+		for partition, offset := range partitionOffsets {
+			if !exists[partition] {
+				errs = append(errs, fmt.Errorf("[%s-%d]: skipped: %w", topic, partition, ErrUnknownTopicOrPartition))
+				continue
+			}
+			if offsets[physicalTopic] == nil {
+				offsets[physicalTopic] = make(map[int32]SnapshotOffset)
+			}
+			offsets[physicalTopic][partition] = offset
+		}
+	}
+
+	commitErrs, err := ca.commitConsumerGroupOffsets(group, offsets)
+	if err != nil {
+		return err
+	}
+	errs = append(errs, commitErrs...)
+
+	if len(errs) > 0 {
+		return Wrap(ErrImportConsumerGroupOffsets, errs...)
+	}
+	return nil
+}
+
+func (ca *clusterAdmin) ResetConsumerGroupOffsetsToTime(group, topic string, t time.Time) (map[int32]int64, error) {
+	groups, err := ca.DescribeConsumerGroups([]string{group})
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) != 1 {
+		return nil, ErrIncompleteResponse
+	}
+	if !errors.Is(groups[0].Err, ErrNoError) {
+		return nil, groups[0].Err
+	}
+	switch ConsumerGroupState(groups[0].State) {
+	case ConsumerGroupStateEmpty, ConsumerGroupStateDead:
+	default:
+		return nil, fmt.Errorf("group %s is in state %s: %w", group, groups[0].State, ErrNonEmptyGroup)
+	}
+
+	topic = ca.conf.physicalTopic(topic)
+	partitions, err := ca.client.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := make(map[int32]int64, len(partitions))
+	offsets := map[string]map[int32]SnapshotOffset{topic: {}}
+	for _, partition := range partitions {
+		offset, err := ca.client.GetOffset(topic, partition, t.UnixMilli())
+		if err != nil {
+			return nil, err
+		}
+		if offset < 0 {
+			// no record at or after the time, start from the end of the log
+			if offset, err = ca.client.GetOffset(topic, partition, OffsetNewest); err != nil {
+				return nil, err
+			}
+		}
+		resolved[partition] = offset
+		offsets[topic][partition] = SnapshotOffset{Offset: offset}
+	}
+
+	errs, err := ca.commitConsumerGroupOffsets(group, offsets)
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, Wrap(ErrResetConsumerGroupOffsets, errs...)
+	}
+	return resolved, nil
+}
+
+// commitConsumerGroupOffsets commits offsets on behalf of a group without
+// active members. It returns the errors of the partitions that failed.
+func (ca *clusterAdmin) commitConsumerGroupOffsets(group string, offsets map[string]map[int32]SnapshotOffset) ([]error, error) {
+	request := &OffsetCommitRequest{
+		Version:                 1,
+		ConsumerGroup:           group,
+		ConsumerGroupGeneration: GroupGenerationUndefined,
+	}
+	if ca.conf.Version.IsAtLeast(V2_3_0_0) {
+		request.Version = 7
+	} else if ca.conf.Version.IsAtLeast(V2_1_0_0) {
+		request.Version = 6
+	} else if ca.conf.Version.IsAtLeast(V2_0_0_0) {
+		request.Version = 4
+	} else if ca.conf.Version.IsAtLeast(V0_11_0_0) {
+		request.Version = 3
+	} else if ca.conf.Version.IsAtLeast(V0_9_0_0) {
+		request.Version = 2
+	}
+	if request.Version >= 2 && request.Version < 5 {
+		// use the retention time of the broker
+		request.RetentionTime = -1
+	}
+	var commitTimestamp int64
+	if request.Version == 1 {
+		commitTimestamp = ReceiveTime
+	}
+
+	for topic, partitions := range offsets {
+		for partition, offset := range partitions {
+			request.AddBlockWithLeaderEpoch(topic, partition, offset.Offset, -1, commitTimestamp, offset.Metadata)
+		}
+	}
+	if len(request.blocks) == 0 {
+		return nil, nil
+	}
+
+	coordinator, err := ca.client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := coordinator.CommitOffset(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for topic, partitions := range request.blocks {
+		for partition := range partitions {
+			partitionErr, ok := resp.Errors[topic][partition]
+			if !ok {
+				errs = append(errs, fmt.Errorf("[%s-%d]: %w", topic, partition, ErrIncompleteResponse))
+			} else if !errors.Is(partitionErr, ErrNoError) {
+				errs = append(errs, fmt.Errorf("[%s-%d]: %w", topic, partition, partitionErr))
+			}
+		}
+	}
+	return errs, nil
+}
+
 func (ca *clusterAdmin) DeleteConsumerGroup(group string) error {
 	coordinator, err := ca.client.Coordinator(group)
 	if err != nil {
@@ -1090,23 +1436,23 @@ func (ca *clusterAdmin) DescribeLogDirs(brokerIds []int32) (allLogDirs map[int32
 			continue
 		}
 		wg.Add(1)
-		go func(b *Broker, conf *Config) {
+		goWithRecover(ca.conf.MetricRegistry, func() {
 			defer wg.Done()
-			_ = b.Open(conf) // Ensure that broker is opened
+			_ = broker.Open(ca.conf) // Ensure that broker is opened
 
 			request := &DescribeLogDirsRequest{}
 			if ca.conf.Version.IsAtLeast(V2_0_0_0) {
 				request.Version = 1
 			}
-			response, err := b.DescribeLogDirs(request)
+			response, err := broker.DescribeLogDirs(request)
 			if err != nil {
 				errChan <- err
 				return
 			}
 			logDirs := make(map[int32][]DescribeLogDirsResponseDirMetadata)
-			logDirs[b.ID()] = response.LogDirs
+			logDirs[broker.ID()] = response.LogDirs
 			logDirsMaps <- logDirs
-		}(broker, ca.conf)
+		})
 	}
 
 	wg.Wait()
@@ -1142,9 +1488,70 @@ func (ca *clusterAdmin) DescribeUserScramCredentials(users []string) ([]*Describ
 		return nil, err
 	}
 
+	if !errors.Is(rsp.ErrorCode, ErrNoError) {
+		return nil, rsp.ErrorCode
+	}
+
 	return rsp.Results, nil
 }
 
+func (ca *clusterAdmin) UpsertUserScramCredential(user string, mechanism ScramMechanismType, iterations int32, password []byte) error {
+	if iterations == 0 {
+		iterations = scramMinIterations
+	}
+
+	formatter := scramFormatter{mechanism: mechanism}
+	if !formatter.validIterations(iterations) {
+		return ErrInvalidScramIterations
+	}
+
+	salt, err := formatter.salt()
+	if err != nil {
+		return err
+	}
+
+	res, err := ca.UpsertUserScramCredentials([]AlterUserScramCredentialsUpsert{{
+		Name:       user,
+		Mechanism:  mechanism,
+		Iterations: iterations,
+		Salt:       salt,
+		Password:   password,
+	}})
+	if err != nil {
+		return err
+	}
+
+	return userScramCredentialResultError(user, res)
+}
+
+func (ca *clusterAdmin) DeleteUserScramCredential(user string, mechanism ScramMechanismType) error {
+	res, err := ca.DeleteUserScramCredentials([]AlterUserScramCredentialsDelete{{
+		Name:      user,
+		Mechanism: mechanism,
+	}})
+	if err != nil {
+		return err
+	}
+
+	return userScramCredentialResultError(user, res)
+}
+
+func userScramCredentialResultError(user string, results []*AlterUserScramCredentialsResult) error {
+	for _, r := range results {
+		if r.User != user {
+			continue
+		}
+		if !errors.Is(r.ErrorCode, ErrNoError) {
+			if r.ErrorMessage != nil && len(*r.ErrorMessage) > 0 {
+				return fmt.Errorf("%w: %s", r.ErrorCode, *r.ErrorMessage)
+			}
+			return r.ErrorCode
+		}
+		return nil
+	}
+	return ErrIncompleteResponse
+}
+
 func (ca *clusterAdmin) UpsertUserScramCredentials(upsert []AlterUserScramCredentialsUpsert) ([]*AlterUserScramCredentialsResult, error) {
 	res, err := ca.AlterUserScramCredentials(upsert, nil)
 	if err != nil {
@@ -1215,10 +1622,10 @@ func (ca *clusterAdmin) DescribeClientQuotas(components []QuotaFilterComponent,
 	return rsp.Entries, nil
 }
 
-func (ca *clusterAdmin) AlterClientQuotas(entity []QuotaEntityComponent, op ClientQuotasOp, validateOnly bool) error {
+func (ca *clusterAdmin) AlterClientQuotas(entity []QuotaEntityComponent, ops []ClientQuotasOp, validateOnly bool) error {
 	entry := AlterClientQuotasEntry{
 		Entity: entity,
-		Ops:    []ClientQuotasOp{op},
+		Ops:    ops,
 	}
 
 	request := &AlterClientQuotasRequest{
@@ -1,8 +1,12 @@
 package sarama
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -1553,6 +1557,139 @@ func TestListConsumerGroupsMultiBroker(t *testing.T) {
 	}
 }
 
+func TestListConsumerGroupListingsMultiBroker(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	secondBroker := NewMockBroker(t, 2)
+	defer secondBroker.Close()
+
+	metadata := NewMockMetadataResponse(t).
+		SetController(seedBroker.BrokerID()).
+		SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+		SetBroker(secondBroker.Addr(), secondBroker.BrokerID())
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest":    metadata,
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"ListGroupsRequest": NewMockListGroupsResponse(t).
+			AddGroupWithState("first", "consumer", "Stable").
+			AddGroupWithState("shared", "consumer", "Empty"),
+	})
+	secondBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest":    metadata,
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"ListGroupsRequest": NewMockListGroupsResponse(t).
+			AddGroupWithState("second", "connect", "PreparingRebalance").
+			AddGroupWithState("shared", "consumer", "Empty"),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_6_0_0
+
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	groups, err := admin.ListConsumerGroupListings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]ConsumerGroupListing{
+		"first":  {ProtocolType: "consumer", State: "Stable"},
+		"second": {ProtocolType: "connect", State: "PreparingRebalance"},
+		"shared": {ProtocolType: "consumer", State: "Empty"},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected groups %v, got %v", expected, groups)
+	}
+}
+
+func TestListConsumerGroupsFilteredByState(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetController(seedBroker.BrokerID()).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()),
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"ListGroupsRequest": NewMockListGroupsResponse(t).
+			AddGroupWithState("stable", "consumer", "Stable").
+			AddGroupWithState("empty", "consumer", "Empty").
+			AddGroupWithState("dead", "consumer", "Dead"),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_6_0_0
+
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	groups, err := admin.ListConsumerGroupListings(ConsumerGroupStateStable, ConsumerGroupStateEmpty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]ConsumerGroupListing{
+		"stable": {ProtocolType: "consumer", State: ConsumerGroupStateStable},
+		"empty":  {ProtocolType: "consumer", State: ConsumerGroupStateEmpty},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected groups %v, got %v", expected, groups)
+	}
+
+	for _, req := range seedBroker.History() {
+		if listGroups, ok := req.Request.(*ListGroupsRequest); ok {
+			if !reflect.DeepEqual(listGroups.StatesFilter, []string{"Stable", "Empty"}) {
+				t.Errorf("expected the states filter to be sent to the broker, got %v", listGroups.StatesFilter)
+			}
+		}
+	}
+}
+
+func TestListConsumerGroupsFilteredByStateFallback(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetController(seedBroker.BrokerID()).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()),
+		"ListGroupsRequest": NewMockListGroupsResponse(t).
+			AddGroup("stable", "consumer").
+			AddGroup("dead", "consumer"),
+		"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+			SetCoordinator(CoordinatorGroup, "stable", seedBroker).
+			SetCoordinator(CoordinatorGroup, "dead", seedBroker),
+		"DescribeGroupsRequest": NewMockDescribeGroupsResponse(t).
+			AddGroupDescription("stable", &GroupDescription{GroupId: "stable", State: "Stable"}).
+			AddGroupDescription("dead", &GroupDescription{GroupId: "dead", State: "Dead"}),
+	})
+
+	config := NewTestConfig()
+	config.Version = V1_0_0_0
+
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	groups, err := admin.ListConsumerGroups(ConsumerGroupStateStable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"stable": "consumer"}; !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected groups %v, got %v", expected, groups)
+	}
+}
+
 func TestListConsumerGroupOffsets(t *testing.T) {
 	seedBroker := NewMockBroker(t, 1)
 	defer seedBroker.Close()
@@ -1681,6 +1818,372 @@ func TestDeleteOffset(t *testing.T) {
 	}
 }
 
+func TestDeleteConsumerGroupOffsets(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	group := "group-delete-offsets"
+	metadata := NewMockMetadataResponse(t).
+		SetController(seedBroker.BrokerID()).
+		SetBroker(seedBroker.Addr(), seedBroker.BrokerID())
+	coordinator := NewMockFindCoordinatorResponse(t).SetCoordinator(CoordinatorGroup, group, seedBroker)
+	apiVersions := NewMockApiVersionsResponse(t)
+
+	// the committed offsets of the group, as held by its coordinator
+	committed := map[string]map[int32]int64{
+		"orders":   {0: 10, 1: 20},
+		"payments": {0: 5},
+	}
+	var lock sync.Mutex
+	seedBroker.SetHandlerFuncByMap(map[string]requestHandlerFunc{
+		"ApiVersionsRequest": func(req *request) encoderWithHeader {
+			return apiVersions.For(req.body)
+		},
+		"MetadataRequest": func(req *request) encoderWithHeader {
+			return metadata.For(req.body)
+		},
+		"FindCoordinatorRequest": func(req *request) encoderWithHeader {
+			return coordinator.For(req.body)
+		},
+		"DeleteOffsetsRequest": func(req *request) encoderWithHeader {
+			lock.Lock()
+			defer lock.Unlock()
+			request := req.body.(*DeleteOffsetsRequest)
+			response := &DeleteOffsetsResponse{Version: request.Version}
+			for topic, partitions := range request.partitions {
+				for _, partition := range partitions {
+					delete(committed[topic], partition)
+					response.AddError(topic, partition, ErrNoError)
+				}
+			}
+			return response
+		},
+		"OffsetFetchRequest": func(req *request) encoderWithHeader {
+			lock.Lock()
+			defer lock.Unlock()
+			request := req.body.(*OffsetFetchRequest)
+			response := &OffsetFetchResponse{Version: request.Version}
+			for topic, partitions := range committed {
+				for partition, offset := range partitions {
+					response.AddBlock(topic, partition, &OffsetFetchResponseBlock{Offset: offset, Err: ErrNoError})
+				}
+			}
+			return response
+		},
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_4_0_0
+
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	if err := admin.DeleteConsumerGroupOffsets(group, map[string][]int32{"orders": {1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	offsets, err := admin.ListConsumerGroupOffsets(group, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := make(map[string]map[int32]int64)
+	for topic, partitions := range offsets.Blocks {
+		remaining[topic] = make(map[int32]int64)
+		for partition, block := range partitions {
+			remaining[topic][partition] = block.Offset
+		}
+	}
+	expected := map[string]map[int32]int64{
+		"orders":   {0: 10},
+		"payments": {0: 5},
+	}
+	if !reflect.DeepEqual(remaining, expected) {
+		t.Errorf("expected remaining offsets %v, got %v", expected, remaining)
+	}
+}
+
+func TestConsumerGroupOffsetsExportImport(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	group := "group-migrate"
+	metadata := NewMockMetadataResponse(t).
+		SetController(seedBroker.BrokerID()).
+		SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+		SetLeader("orders", 0, seedBroker.BrokerID())
+	coordinator := NewMockFindCoordinatorResponse(t).SetCoordinator(CoordinatorGroup, group, seedBroker)
+	apiVersions := NewMockApiVersionsResponse(t)
+	fetch := NewMockOffsetFetchResponse(t).
+		SetOffset(group, "orders", 0, 10, "meta", ErrNoError).
+		SetOffset(group, "orders", 1, 20, "", ErrNoError).
+		SetOffset(group, "payments", 0, 5, "", ErrNoError).
+		SetOffset(group, "payments", 1, -1, "", ErrNoError).
+		SetError(ErrNoError)
+
+	var lock sync.Mutex
+	var committed *OffsetCommitRequest
+	seedBroker.SetHandlerFuncByMap(map[string]requestHandlerFunc{
+		"ApiVersionsRequest": func(req *request) encoderWithHeader {
+			return apiVersions.For(req.body)
+		},
+		"MetadataRequest": func(req *request) encoderWithHeader {
+			return metadata.For(req.body)
+		},
+		"FindCoordinatorRequest": func(req *request) encoderWithHeader {
+			return coordinator.For(req.body)
+		},
+		"OffsetFetchRequest": func(req *request) encoderWithHeader {
+			return fetch.For(req.body)
+		},
+		"OffsetCommitRequest": func(req *request) encoderWithHeader {
+			lock.Lock()
+			defer lock.Unlock()
+			committed = req.body.(*OffsetCommitRequest)
+			response := &OffsetCommitResponse{Version: committed.Version}
+			for topic, partitions := range committed.blocks {
+				for partition := range partitions {
+					response.AddError(topic, partition, ErrNoError)
+				}
+			}
+			return response
+		},
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_4_0_0
+	config.Metadata.Retry.Max = 0
+
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	snap, err := admin.ExportConsumerGroupOffsets(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := OffsetSnapshot{
+		Group: group,
+		Offsets: map[string]map[int32]SnapshotOffset{
+			"orders":   {0: {Offset: 10, Metadata: "meta"}, 1: {Offset: 20}},
+			"payments": {0: {Offset: 5}},
+		},
+	}
+	if !reflect.DeepEqual(snap, expected) {
+		t.Fatalf("expected snapshot %+v, got %+v", expected, snap)
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded OffsetSnapshot
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	// only orders/0 exists in the target cluster
+	err = admin.ImportConsumerGroupOffsets(group, decoded)
+	if !errors.Is(err, ErrImportConsumerGroupOffsets) || !errors.Is(err, ErrUnknownTopicOrPartition) {
+		t.Fatalf("expected an error wrapping %v and %v, got %v", ErrImportConsumerGroupOffsets, ErrUnknownTopicOrPartition, err)
+	}
+	for _, skipped := range []string{"[orders-1]", "[payments-0]"} {
+		if !strings.Contains(err.Error(), skipped) {
+			t.Errorf("expected %s to be reported as skipped, got %v", skipped, err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if committed == nil {
+		t.Fatal("expected the offsets to be committed")
+	}
+	if len(committed.blocks) != 1 || len(committed.blocks["orders"]) != 1 {
+		t.Fatalf("expected only orders/0 to be committed, got %v", committed.blocks)
+	}
+	if offset, meta, err := committed.Offset("orders", 0); err != nil || offset != 10 || meta != "meta" {
+		t.Errorf("expected orders/0 to be committed at 10 with metadata, got %d %q %v", offset, meta, err)
+	}
+	if committed.ConsumerGroupGeneration != GroupGenerationUndefined {
+		t.Errorf("expected an undefined generation, got %d", committed.ConsumerGroupGeneration)
+	}
+}
+
+func TestResetConsumerGroupOffsetsToTime(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	group := "group-reset"
+	ts := time.Unix(1700000000, 0)
+	metadata := NewMockMetadataResponse(t).
+		SetController(seedBroker.BrokerID()).
+		SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+		SetLeader("orders", 0, seedBroker.BrokerID()).
+		SetLeader("orders", 1, seedBroker.BrokerID())
+	coordinator := NewMockFindCoordinatorResponse(t).SetCoordinator(CoordinatorGroup, group, seedBroker)
+	apiVersions := NewMockApiVersionsResponse(t)
+	offsets := NewMockOffsetResponse(t).
+		SetOffset("orders", 0, ts.UnixMilli(), 42).
+		SetOffset("orders", 1, ts.UnixMilli(), -1).
+		SetOffset("orders", 1, OffsetNewest, 99)
+
+	var lock sync.Mutex
+	state := ConsumerGroupStateStable
+	var committed *OffsetCommitRequest
+	seedBroker.SetHandlerFuncByMap(map[string]requestHandlerFunc{
+		"ApiVersionsRequest": func(req *request) encoderWithHeader {
+			return apiVersions.For(req.body)
+		},
+		"MetadataRequest": func(req *request) encoderWithHeader {
+			return metadata.For(req.body)
+		},
+		"FindCoordinatorRequest": func(req *request) encoderWithHeader {
+			return coordinator.For(req.body)
+		},
+		"DescribeGroupsRequest": func(req *request) encoderWithHeader {
+			lock.Lock()
+			defer lock.Unlock()
+			return NewMockDescribeGroupsResponse(t).
+				AddGroupDescription(group, &GroupDescription{GroupId: group, State: string(state)}).
+				For(req.body)
+		},
+		"OffsetRequest": func(req *request) encoderWithHeader {
+			return offsets.For(req.body)
+		},
+		"OffsetCommitRequest": func(req *request) encoderWithHeader {
+			lock.Lock()
+			defer lock.Unlock()
+			committed = req.body.(*OffsetCommitRequest)
+			response := &OffsetCommitResponse{Version: committed.Version}
+			for topic, partitions := range committed.blocks {
+				for partition := range partitions {
+					response.AddError(topic, partition, ErrNoError)
+				}
+			}
+			return response
+		},
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_4_0_0
+
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	if _, err := admin.ResetConsumerGroupOffsetsToTime(group, "orders", ts); !errors.Is(err, ErrNonEmptyGroup) {
+		t.Fatalf("expected an active group to be rejected with %v, got %v", ErrNonEmptyGroup, err)
+	}
+	lock.Lock()
+	if committed != nil {
+		t.Error("expected no offsets to be committed for an active group")
+	}
+	state = ConsumerGroupStateEmpty
+	lock.Unlock()
+
+	resolved, err := admin.ResetConsumerGroupOffsetsToTime(group, "orders", ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int32]int64{0: 42, 1: 99}
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Errorf("expected offsets %v, got %v", expected, resolved)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if committed == nil {
+		t.Fatal("expected the offsets to be committed")
+	}
+	for partition, offset := range expected {
+		if got, _, err := committed.Offset("orders", partition); err != nil || got != offset {
+			t.Errorf("expected orders/%d to be committed at %d, got %d %v", partition, offset, got, err)
+		}
+	}
+}
+
+func TestDeleteConsumerGroupOffsetsPartitionError(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	group := "group-delete-offsets"
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetController(seedBroker.BrokerID()).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()),
+		"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).SetCoordinator(CoordinatorGroup, group, seedBroker),
+		"DeleteOffsetsRequest": NewMockDeleteOffsetRequest(t).
+			SetDeletedOffset(ErrNoError, "orders", 1, ErrGroupSubscribedToTopic),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_4_0_0
+
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	err = admin.DeleteConsumerGroupOffsets(group, map[string][]int32{"orders": {0, 1}})
+	if !errors.Is(err, ErrDeleteConsumerGroupOffsets) || !errors.Is(err, ErrGroupSubscribedToTopic) {
+		t.Fatalf("expected a partition error wrapped in ErrDeleteConsumerGroupOffsets, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "[orders-1]") || strings.Contains(err.Error(), "[orders-0]") {
+		t.Errorf("expected only partition orders-1 to be reported, got %v", err)
+	}
+}
+
+func TestDeleteConsumerGroupOffsetsStore(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetController(seedBroker.BrokerID()).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()),
+	})
+
+	store := newMemoryOffsetStore()
+	commit := &OffsetCommit{Group: "my-group"}
+	commit.add("orders", 0, StoredOffset{Offset: 5, LeaderEpoch: -1})
+	commit.add("orders", 1, StoredOffset{Offset: 7, LeaderEpoch: -1})
+	if _, err := store.CommitOffsets(commit); err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewTestConfig()
+	config.Version = V2_4_0_0
+	config.Consumer.Offsets.Store = store
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	if err := admin.DeleteConsumerGroupOffsets("my-group", map[string][]int32{"orders": {1}}); err != nil {
+		t.Fatal(err)
+	}
+	if offset := store.committed("my-group", "orders", 0); offset.Offset != 5 {
+		t.Errorf("expected orders/0 to stay committed at 5, got %d", offset.Offset)
+	}
+	if offset := store.committed("my-group", "orders", 1); offset.Offset != 0 {
+		t.Errorf("expected orders/1 to be deleted from the store, got %d", offset.Offset)
+	}
+	for _, rr := range seedBroker.History() {
+		if _, ok := rr.Request.(*DeleteOffsetsRequest); ok {
+			t.Error("expected the offsets not to be deleted from Kafka")
+		}
+	}
+}
+
 // TestRefreshMetaDataWithDifferentController ensures that the cached
 // controller can be forcibly updated from Metadata by the admin client
 func TestRefreshMetaDataWithDifferentController(t *testing.T) {
@@ -1897,3 +2400,237 @@ func Test_retryOnError(t *testing.T) {
 		}
 	})
 }
+
+func TestClusterAdminUpsertUserScramCredential(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetController(seedBroker.BrokerID()).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()),
+		"ApiVersionsRequest":               NewMockApiVersionsResponse(t),
+		"AlterUserScramCredentialsRequest": NewMockAlterUserScramCredentialsResponse(t),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_7_0_0
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	password := []byte("secret")
+	err = admin.UpsertUserScramCredential("alice", SCRAM_MECHANISM_SHA_512, 0, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req *AlterUserScramCredentialsRequest
+	for _, rr := range seedBroker.History() {
+		if r, ok := rr.Request.(*AlterUserScramCredentialsRequest); ok {
+			req = r
+		}
+	}
+	if req == nil || len(req.Upsertions) != 1 {
+		t.Fatalf("expected a single upsertion to be sent, got %+v", req)
+	}
+
+	u := req.Upsertions[0]
+	if u.Name != "alice" || u.Mechanism != SCRAM_MECHANISM_SHA_512 {
+		t.Errorf("unexpected upsertion %+v", u)
+	}
+	if u.Iterations != scramMinIterations {
+		t.Errorf("expected default iterations %d, got %d", scramMinIterations, u.Iterations)
+	}
+	if len(u.Salt) != 64 {
+		t.Errorf("expected a 64 byte salt for SHA-512, got %d bytes", len(u.Salt))
+	}
+	formatter := scramFormatter{mechanism: SCRAM_MECHANISM_SHA_512}
+	expected, err := formatter.saltedPassword(password, u.Salt, int(u.Iterations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(u.saltedPassword, expected) {
+		t.Error("broker did not receive the expected salted password")
+	}
+
+	err = admin.UpsertUserScramCredential("alice", SCRAM_MECHANISM_SHA_256, 100, password)
+	if !errors.Is(err, ErrInvalidScramIterations) {
+		t.Errorf("expected ErrInvalidScramIterations, got %v", err)
+	}
+
+	err = admin.UpsertUserScramCredential("alice", SCRAM_MECHANISM_UNKNOWN, 4096, password)
+	if !errors.Is(err, ErrUnknownScramMechanism) {
+		t.Errorf("expected ErrUnknownScramMechanism, got %v", err)
+	}
+}
+
+func TestClusterAdminDeleteUserScramCredential(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetController(seedBroker.BrokerID()).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()),
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"AlterUserScramCredentialsRequest": NewMockAlterUserScramCredentialsResponse(t).
+			SetError("bob", ErrInvalidRequest),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_7_0_0
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	if err := admin.DeleteUserScramCredential("alice", SCRAM_MECHANISM_SHA_256); err != nil {
+		t.Fatal(err)
+	}
+
+	err = admin.DeleteUserScramCredential("bob", SCRAM_MECHANISM_SHA_256)
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected ErrInvalidRequest, got %v", err)
+	}
+}
+
+func TestClusterAdminDescribeUserScramCredentials(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetController(seedBroker.BrokerID()).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()),
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"DescribeUserScramCredentialsRequest": NewMockDescribeUserScramCredentialsResponse(t).
+			SetCredential("alice", SCRAM_MECHANISM_SHA_256, 8192).
+			SetCredential("alice", SCRAM_MECHANISM_SHA_512, 4096),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_7_0_0
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	results, err := admin.DescribeUserScramCredentials([]string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].User != "alice" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+
+	infos := results[0].CredentialInfos
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 credentials, got %d", len(infos))
+	}
+	if infos[0].Mechanism != SCRAM_MECHANISM_SHA_256 || infos[0].Iterations != 8192 {
+		t.Errorf("unexpected credential %+v", infos[0])
+	}
+	if infos[1].Mechanism != SCRAM_MECHANISM_SHA_512 || infos[1].Iterations != 4096 {
+		t.Errorf("unexpected credential %+v", infos[1])
+	}
+}
+
+func TestClusterAdminAlterAndDescribeClientQuotas(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	user := []QuotaEntityComponent{{
+		EntityType: QuotaEntityUser,
+		MatchType:  QuotaMatchExact,
+		Name:       "sarama",
+	}}
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetController(seedBroker.BrokerID()).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()),
+		"AlterClientQuotasRequest": NewMockAlterClientQuotasResponse(t),
+		"DescribeClientQuotasRequest": NewMockDescribeClientQuotasResponse(t).
+			SetQuota(user, "producer_byte_rate", 1024000),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_6_0_0
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	ops := []ClientQuotasOp{
+		{Key: "producer_byte_rate", Value: 1024000},
+		{Key: "consumer_byte_rate", Remove: true},
+	}
+	if err := admin.AlterClientQuotas(user, ops, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var req *AlterClientQuotasRequest
+	for _, rr := range seedBroker.History() {
+		if r, ok := rr.Request.(*AlterClientQuotasRequest); ok {
+			req = r
+		}
+	}
+	if req == nil || len(req.Entries) != 1 {
+		t.Fatalf("expected a single quota entry to be sent, got %+v", req)
+	}
+	if !reflect.DeepEqual(req.Entries[0].Ops, ops) {
+		t.Errorf("expected ops %+v, got %+v", ops, req.Entries[0].Ops)
+	}
+
+	quotas, err := admin.DescribeClientQuotas([]QuotaFilterComponent{{
+		EntityType: QuotaEntityUser,
+		MatchType:  QuotaMatchExact,
+		Match:      "sarama",
+	}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quotas) != 1 {
+		t.Fatalf("expected one quota entry, found: %v", quotas)
+	}
+	if quotas[0].Entity[0].Name != "sarama" {
+		t.Errorf("unexpected quota entity %+v", quotas[0].Entity)
+	}
+	if quotas[0].Values["producer_byte_rate"] != 1024000 {
+		t.Errorf("expected producer_byte_rate to be 1024000, found: %v", quotas[0].Values["producer_byte_rate"])
+	}
+}
+
+func TestClusterAdminAlterClientQuotasError(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetController(seedBroker.BrokerID()).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()),
+		"AlterClientQuotasRequest": NewMockAlterClientQuotasResponse(t).SetError(ErrInvalidRequest),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_6_0_0
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	entity := []QuotaEntityComponent{{EntityType: QuotaEntityClientID, MatchType: QuotaMatchDefault}}
+	err = admin.AlterClientQuotas(entity, []ClientQuotasOp{{Key: "consumer_byte_rate", Value: 1}}, true)
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected ErrInvalidRequest, got %v", err)
+	}
+}
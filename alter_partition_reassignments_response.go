@@ -32,11 +32,12 @@ func (b *alterPartitionReassignmentsErrorBlock) decode(pd packetDecoder) (err er
 }
 
 type AlterPartitionReassignmentsResponse struct {
-	Version        int16
-	ThrottleTimeMs int32
-	ErrorCode      KError
-	ErrorMessage   *string
-	Errors         map[string]map[int32]*alterPartitionReassignmentsErrorBlock
+	Version             int16
+	ThrottleTimeMs      int32
+	ErrorCode           KError
+	ErrorMessage        *string
+	Errors              map[string]map[int32]*alterPartitionReassignmentsErrorBlock
+	unknownTaggedFields taggedFields
 }
 
 func (r *AlterPartitionReassignmentsResponse) AddError(topic string, partition int32, kerror KError, message *string) {
@@ -75,7 +76,9 @@ func (r *AlterPartitionReassignmentsResponse) encode(pe packetEncoder) error {
 		pe.putEmptyTaggedFieldArray()
 	}
 
-	pe.putEmptyTaggedFieldArray()
+	if err := pe.putTaggedFieldArray(r.unknownTaggedFields); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -135,7 +138,7 @@ func (r *AlterPartitionReassignmentsResponse) decode(pd packetDecoder, version i
 		}
 	}
 
-	if _, err = pd.getEmptyTaggedFieldArray(); err != nil {
+	if r.unknownTaggedFields, err = pd.getTaggedFieldArray(); err != nil {
 		return err
 	}
 
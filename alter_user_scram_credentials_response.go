@@ -7,7 +7,8 @@ type AlterUserScramCredentialsResponse struct {
 
 	ThrottleTime time.Duration
 
-	Results []*AlterUserScramCredentialsResult
+	Results             []*AlterUserScramCredentialsResult
+	unknownTaggedFields taggedFields
 }
 
 type AlterUserScramCredentialsResult struct {
@@ -32,7 +33,9 @@ func (r *AlterUserScramCredentialsResponse) encode(pe packetEncoder) error {
 		pe.putEmptyTaggedFieldArray()
 	}
 
-	pe.putEmptyTaggedFieldArray()
+	if err := pe.putTaggedFieldArray(r.unknownTaggedFields); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -71,7 +74,7 @@ func (r *AlterUserScramCredentialsResponse) decode(pd packetDecoder, version int
 		}
 	}
 
-	if _, err := pd.getEmptyTaggedFieldArray(); err != nil {
+	if r.unknownTaggedFields, err = pd.getTaggedFieldArray(); err != nil {
 		return err
 	}
 	return nil
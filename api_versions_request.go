@@ -2,6 +2,8 @@ package sarama
 
 const defaultClientSoftwareName = "sarama"
 
+const apiKeyApiVersions = 18
+
 type ApiVersionsRequest struct {
 	// Version defines the protocol version to use for encode and decode
 	Version int16
@@ -43,7 +45,7 @@ func (r *ApiVersionsRequest) decode(pd packetDecoder, version int16) (err error)
 }
 
 func (r *ApiVersionsRequest) key() int16 {
-	return 18
+	return apiKeyApiVersions
 }
 
 func (r *ApiVersionsRequest) version() int16 {
@@ -60,7 +60,8 @@ type ApiVersionsResponse struct {
 	// ApiKeys contains the APIs supported by the broker.
 	ApiKeys []ApiVersionsResponseKey
 	// ThrottleTimeMs contains the duration in milliseconds for which the request was throttled due to a quota violation, or zero if the request did not violate any quota.
-	ThrottleTimeMs int32
+	ThrottleTimeMs      int32
+	unknownTaggedFields taggedFields
 }
 
 func (r *ApiVersionsResponse) encode(pe packetEncoder) (err error) {
@@ -84,7 +85,9 @@ func (r *ApiVersionsResponse) encode(pe packetEncoder) (err error) {
 	}
 
 	if r.Version >= 3 {
-		pe.putEmptyTaggedFieldArray()
+		if err := pe.putTaggedFieldArray(r.unknownTaggedFields); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -107,6 +110,9 @@ func (r *ApiVersionsResponse) decode(pd packetDecoder, version int16) (err error
 		if err != nil {
 			return err
 		}
+		if numApiKeys < 0 {
+			return errInvalidArrayLength
+		}
 	}
 	r.ApiKeys = make([]ApiVersionsResponseKey, numApiKeys)
 	for i := 0; i < numApiKeys; i++ {
@@ -124,7 +130,7 @@ func (r *ApiVersionsResponse) decode(pd packetDecoder, version int16) (err error
 	}
 
 	if r.Version >= 3 {
-		if _, err = pd.getEmptyTaggedFieldArray(); err != nil {
+		if r.unknownTaggedFields, err = pd.getTaggedFieldArray(); err != nil {
 			return err
 		}
 	}
@@ -133,7 +139,7 @@ func (r *ApiVersionsResponse) decode(pd packetDecoder, version int16) (err error
 }
 
 func (r *ApiVersionsResponse) key() int16 {
-	return 18
+	return apiKeyApiVersions
 }
 
 func (r *ApiVersionsResponse) version() int16 {
@@ -1,11 +1,15 @@
 package sarama
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
+	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eapache/go-resiliency/breaker"
@@ -37,6 +41,12 @@ type AsyncProducer interface {
 	// wish to send.
 	Input() chan<- *ProducerMessage
 
+	// Enqueue sends a message like writing it to Input does, but returns a Future
+	// that resolves once the message has been delivered or has failed. The result
+	// of an enqueued message is only reported through its Future and never on the
+	// Successes or Errors channels, regardless of Producer.Return settings.
+	Enqueue(msg *ProducerMessage) Future
+
 	// Successes is the success output channel back to the user when Return.Successes is
 	// enabled. If Return.Successes is true, you MUST read from this channel or the
 	// Producer will deadlock. It is suggested that you send and read messages
@@ -69,6 +79,17 @@ type AsyncProducer interface {
 
 	// AddMessageToTxn add message offsets to current transaction.
 	AddMessageToTxn(msg *ConsumerMessage, groupId string, metadata *string) error
+
+	// Reconfigure changes the settings of the producer while it runs. fn is
+	// called with a copy of its configuration, and may change
+	// Producer.RequiredAcks, Producer.Compression, Producer.CompressionLevel
+	// and Producer.Flush, which apply to the batches created from then on,
+	// the messages already batched or in flight being sent as they were. The
+	// changes to the other settings are ignored, except for those to
+	// Producer.Idempotent, Producer.Transaction.ID, Producer.TopicFlush and
+	// Producer.TopicPriorities which, like an invalid configuration, are
+	// rejected with an error, leaving the settings as they were.
+	Reconfigure(fn func(*Config)) error
 }
 
 type asyncProducer struct {
@@ -86,9 +107,22 @@ type asyncProducer struct {
 	txnmgr *transactionManager
 	txLock sync.Mutex
 
+	// settings override those of conf once reconfigured, see Reconfigure
+	settings        atomic.Pointer[producerSettings]
+	reconfigureLock sync.Mutex
+
 	metricsRegistry metrics.Registry
 }
 
+// producerSettings are the settings of Config.Producer which can change while
+// the producer runs.
+type producerSettings struct {
+	requiredAcks     RequiredAcks
+	compression      CompressionCodec
+	compressionLevel int
+	flush            FlushConfig
+}
+
 // NewAsyncProducer creates a new AsyncProducer using the given broker addresses and configuration.
 func NewAsyncProducer(addrs []string, conf *Config) (AsyncProducer, error) {
 	client, err := NewClient(addrs, conf)
@@ -118,6 +152,12 @@ func newAsyncProducer(client Client) (AsyncProducer, error) {
 		return nil, err
 	}
 
+	if conf := client.Config(); conf.Net.MaxOpenRequests > 1 && conf.Producer.Retry.Max > 0 &&
+		!conf.Producer.Idempotent && !conf.Producer.StrictOrdering {
+		Logger.Println("producer/ordering retries may reorder the messages of a partition with Net.MaxOpenRequests > 1; " +
+			"enable Producer.Idempotent or Producer.StrictOrdering to preserve it")
+	}
+
 	p := &asyncProducer{
 		client:          client,
 		conf:            client.Config(),
@@ -132,8 +172,8 @@ func newAsyncProducer(client Client) (AsyncProducer, error) {
 	}
 
 	// launch our singleton dispatchers
-	go withRecover(p.dispatcher)
-	go withRecover(p.retryHandler)
+	goWithRecover(p.conf.MetricRegistry, p.dispatcher)
+	goWithRecover(p.conf.MetricRegistry, p.retryHandler)
 
 	return p, nil
 }
@@ -159,6 +199,11 @@ type ProducerMessage struct {
 	// StringEncoder and ByteEncoder.
 	Value Encoder
 
+	// TypedKey and TypedValue are the key and message in their application
+	// representation. When set, they are serialized with Producer.KeySerializer
+	// and Producer.ValueSerializer respectively, replacing Key and Value.
+	TypedKey, TypedValue interface{}
+
 	// The headers are key-value pairs that are transparently passed
 	// by Kafka between producers and consumers.
 	Headers []RecordHeader
@@ -169,6 +214,23 @@ type ProducerMessage struct {
 	// pass-through data.
 	Metadata interface{}
 
+	// Context carries request-scoped values, such as the trace context of the
+	// operation producing the message, to the producer interceptors and the
+	// Config.Tracer, e.g. to inject trace headers or to log per message. It
+	// is ignored if nil, and never used to cancel or time out the send.
+	Context context.Context
+
+	// PartitionFunc, if set, chooses the partition of the message in place of
+	// the configured Producer.Partitioner, e.g. to route it by runtime state
+	// the partitioner does not have. It is called once, before the message is
+	// first sent, with the number of partitions of the topic, or of those
+	// allowed by Producer.AllowedPartitions, and returns the index of the
+	// chosen one: with all the partitions of the topic, the index is the
+	// partition itself. Messages whose index is out of range fail with
+	// ErrInvalidPartition. The Partition field is ignored, even with the
+	// manual partitioner.
+	PartitionFunc func(numPartitions int32) int32
+
 	// Below this point are filled in by the producer as the message is processed
 
 	// Offset is the offset of the message stored on the broker. This is only
@@ -184,19 +246,33 @@ type ProducerMessage struct {
 	//
 	// When configured to CreateTime, the timestamp is specified by the producer
 	// either by explicitly setting this field, or when the message is added
-	// to a produce set.
+	// to a produce set. Messages are always sent with the CreateTime timestamp
+	// type, consumers can tell it apart via ConsumerMessage.TimestampType.
 	//
 	// When configured to LogAppendTime, the timestamp assigned to the message
 	// by the broker. This is only guaranteed to be defined if the message was
 	// successfully delivered and RequiredAcks is not NoResponse.
 	Timestamp time.Time
+	// LogStartOffset is the earliest offset still stored in the partition
+	// when the message was appended, or -1 if the broker does not report it
+	// (produce request version 5, Kafka 1.0, and later do), e.g. when
+	// RequiredAcks is NoResponse or for a duplicate of a message already
+	// appended. This is only guaranteed to be defined if the message was
+	// successfully delivered.
+	//
+	// Kafka does not report how many replicas acknowledged the message: a
+	// success with RequiredAcks set to WaitForAll means that it was appended
+	// to at least min.insync.replicas replicas.
+	LogStartOffset int64
 
 	retries        int
 	flags          flagSet
 	expectation    chan *ProducerError
+	future         *producerFuture
 	sequenceNumber int32
 	producerEpoch  int16
 	hasSequence    bool
+	span           Span
 }
 
 const producerMessageOverhead = 26 // the metadata overhead of CRC, flags, etc.
@@ -228,6 +304,52 @@ func (m *ProducerMessage) clear() {
 	m.hasSequence = false
 }
 
+// Future is the pending result of a message sent with AsyncProducer.Enqueue.
+type Future interface {
+	// Done returns a channel that is closed once the message has been delivered
+	// or has failed, for use in select statements.
+	Done() <-chan struct{}
+
+	// Result blocks until the message has been delivered or has failed. It
+	// returns the partition and offset of the produced message, or the error
+	// it failed with.
+	Result() (partition int32, offset int64, err error)
+}
+
+type producerFuture struct {
+	msg       *ProducerMessage
+	partition int32
+	offset    int64
+	err       error
+	done      chan struct{}
+}
+
+// resolveFuture resolves the future of msg, detaching it so that the message
+// can be sent again.
+func (m *ProducerMessage) resolveFuture(err error) {
+	f := m.future
+	m.future = nil
+	f.resolve(err)
+}
+
+func (f *producerFuture) resolve(err error) {
+	// the message may be sent again once resolved
+	f.partition, f.offset, f.err = f.msg.Partition, f.msg.Offset, err
+	close(f.done)
+}
+
+func (f *producerFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *producerFuture) Result() (partition int32, offset int64, err error) {
+	<-f.done
+	if f.err != nil {
+		return -1, -1, f.err
+	}
+	return f.partition, f.offset, nil
+}
+
 // ProducerError is the type of error generated when the producer fails to deliver a message.
 // It contains the original ProducerMessage as well as the actual error value.
 type ProducerError struct {
@@ -281,6 +403,64 @@ func (p *asyncProducer) AddOffsetsToTxn(offsets map[string][]*PartitionOffsetMet
 	return p.txnmgr.addOffsetsToTxn(offsets, groupId)
 }
 
+func (p *asyncProducer) Reconfigure(fn func(*Config)) error {
+	p.reconfigureLock.Lock()
+	defer p.reconfigureLock.Unlock()
+
+	conf := *p.conf
+	// copy the maps too, so that fn cannot change those of the running
+	// producer, which are only compared to reject the changes
+	conf.Producer.TopicPriorities = make(map[string]int, len(p.conf.Producer.TopicPriorities))
+	for topic, priority := range p.conf.Producer.TopicPriorities {
+		conf.Producer.TopicPriorities[topic] = priority
+	}
+	conf.Producer.TopicFlush = make(map[string]FlushConfig, len(p.conf.Producer.TopicFlush))
+	for topic, flush := range p.conf.Producer.TopicFlush {
+		conf.Producer.TopicFlush[topic] = flush
+	}
+	if settings := p.settings.Load(); settings != nil {
+		conf.Producer.RequiredAcks = settings.requiredAcks
+		conf.Producer.Compression = settings.compression
+		conf.Producer.CompressionLevel = settings.compressionLevel
+		conf.Producer.Flush = settings.flush
+	}
+	fn(&conf)
+
+	switch {
+	case conf.Producer.Idempotent != p.conf.Producer.Idempotent:
+		return ConfigurationError("Producer.Idempotent cannot be reconfigured")
+	case conf.Producer.Transaction.ID != p.conf.Producer.Transaction.ID:
+		return ConfigurationError("Producer.Transaction.ID cannot be reconfigured")
+	case len(conf.Producer.TopicFlush)+len(p.conf.Producer.TopicFlush) > 0 &&
+		!reflect.DeepEqual(conf.Producer.TopicFlush, p.conf.Producer.TopicFlush):
+		return ConfigurationError("Producer.TopicFlush cannot be reconfigured")
+	case len(conf.Producer.TopicPriorities)+len(p.conf.Producer.TopicPriorities) > 0 &&
+		!reflect.DeepEqual(conf.Producer.TopicPriorities, p.conf.Producer.TopicPriorities):
+		return ConfigurationError("Producer.TopicPriorities cannot be reconfigured")
+	}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	p.settings.Store(&producerSettings{
+		requiredAcks:     conf.Producer.RequiredAcks,
+		compression:      conf.Producer.Compression,
+		compressionLevel: conf.Producer.CompressionLevel,
+		flush:            conf.Producer.Flush,
+	})
+	Logger.Printf("producer reconfigured with acks %d, compression %s (level %d) and flush %+v\n",
+		conf.Producer.RequiredAcks, conf.Producer.Compression, conf.Producer.CompressionLevel, conf.Producer.Flush)
+	return nil
+}
+
+// flushConfig returns the Producer.Flush of the producer, as reconfigured.
+func (p *asyncProducer) flushConfig() FlushConfig {
+	if settings := p.settings.Load(); settings != nil {
+		return settings.flush
+	}
+	return p.conf.Producer.Flush
+}
+
 func (p *asyncProducer) TxnStatus() ProducerTxnStatusFlag {
 	return p.txnmgr.currentTxnStatus()
 }
@@ -355,11 +535,18 @@ func (p *asyncProducer) Input() chan<- *ProducerMessage {
 	return p.input
 }
 
+func (p *asyncProducer) Enqueue(msg *ProducerMessage) Future {
+	future := &producerFuture{msg: msg, done: make(chan struct{})}
+	msg.future = future
+	p.input <- msg
+	return future
+}
+
 func (p *asyncProducer) Close() error {
 	p.AsyncClose()
 
 	if p.conf.Producer.Return.Successes {
-		go withRecover(func() {
+		goWithRecover(p.conf.MetricRegistry, func() {
 			for range p.successes {
 			}
 		})
@@ -381,7 +568,7 @@ func (p *asyncProducer) Close() error {
 }
 
 func (p *asyncProducer) AsyncClose() {
-	go withRecover(p.shutdown)
+	goWithRecover(p.conf.MetricRegistry, p.shutdown)
 }
 
 // singleton
@@ -421,7 +608,9 @@ func (p *asyncProducer) dispatcher() {
 				// we can't just call returnError here because that decrements the wait group,
 				// which hasn't been incremented yet for this message, and shouldn't be
 				pErr := &ProducerError{Msg: msg, Err: ErrShuttingDown}
-				if p.conf.Producer.Return.Errors {
+				if msg.future != nil {
+					msg.resolveFuture(ErrShuttingDown)
+				} else if p.conf.Producer.Return.Errors {
 					p.errors <- pErr
 				} else {
 					Logger.Println(pErr)
@@ -429,6 +618,9 @@ func (p *asyncProducer) dispatcher() {
 				continue
 			}
 			p.inFlight.Add(1)
+			msg.startSpan(p.conf)
+			msg.Topic = p.conf.physicalTopic(msg.Topic)
+			msg.LogStartOffset = -1
 			// Ignore retried msg, there are already in txn.
 			// Can't produce new record when transaction is not started.
 			if p.IsTransactional() && p.txnmgr.currentTxnStatus()&ProducerTxnFlagInTransaction == 0 {
@@ -442,6 +634,13 @@ func (p *asyncProducer) dispatcher() {
 			msg.safelyApplyInterceptor(interceptor)
 		}
 
+		if msg.retries == 0 {
+			if err := msg.serialize(p.conf); err != nil {
+				p.returnError(msg, err)
+				continue
+			}
+		}
+
 		version := 1
 		if p.conf.Version.IsAtLeast(V0_11_0_0) {
 			version = 2
@@ -450,6 +649,11 @@ func (p *asyncProducer) dispatcher() {
 			continue
 		}
 
+		if err := p.checkHeaders(msg); err != nil {
+			p.returnError(msg, err)
+			continue
+		}
+
 		size := msg.ByteSize(version)
 		if size > p.conf.Producer.MaxMessageBytes {
 			p.returnError(msg, ConfigurationError(fmt.Sprintf("Attempt to produce message larger than configured Producer.MaxMessageBytes: %d > %d", size, p.conf.Producer.MaxMessageBytes)))
@@ -470,6 +674,30 @@ func (p *asyncProducer) dispatcher() {
 	}
 }
 
+// checkHeaders validates the headers of msg against Producer.MaxHeaders and
+// Producer.MaxHeaderBytes, naming the first header that exceeds a limit.
+func (p *asyncProducer) checkHeaders(msg *ProducerMessage) error {
+	maxHeaders := p.conf.Producer.MaxHeaders
+	if maxHeaders > 0 && len(msg.Headers) > maxHeaders {
+		return ConfigurationError(fmt.Sprintf("Attempt to produce message with header %q exceeding configured Producer.MaxHeaders: %d > %d",
+			msg.Headers[maxHeaders].Key, len(msg.Headers), maxHeaders))
+	}
+
+	maxHeaderBytes := p.conf.Producer.MaxHeaderBytes
+	if maxHeaderBytes > 0 {
+		size := 0
+		for _, h := range msg.Headers {
+			size += len(h.Key) + len(h.Value)
+			if size > maxHeaderBytes {
+				return ConfigurationError(fmt.Sprintf("Attempt to produce message with header %q exceeding configured Producer.MaxHeaderBytes: %d > %d",
+					h.Key, size, maxHeaderBytes))
+			}
+		}
+	}
+
+	return nil
+}
+
 // one per topic
 // partitions messages, then dispatches them by partition
 type topicProducer struct {
@@ -492,7 +720,7 @@ func (p *asyncProducer) newTopicProducer(topic string) chan<- *ProducerMessage {
 		handlers:    make(map[int32]chan<- *ProducerMessage),
 		partitioner: p.conf.Producer.Partitioner(topic),
 	}
-	go withRecover(tp.dispatch)
+	goWithRecover(p.conf.MetricRegistry, tp.dispatch)
 	return input
 }
 
@@ -522,15 +750,15 @@ func (tp *topicProducer) dispatch() {
 func (tp *topicProducer) partitionMessage(msg *ProducerMessage) error {
 	var partitions []int32
 
-	err := tp.breaker.Run(func() (err error) {
-		requiresConsistency := false
-		if ep, ok := tp.partitioner.(DynamicConsistencyPartitioner); ok {
-			requiresConsistency = ep.MessageRequiresConsistency(msg)
-		} else {
-			requiresConsistency = tp.partitioner.RequiresConsistency()
-		}
+	// a PartitionFunc takes the place of the partitioner, choosing among all
+	// the partitions so that its choice is the same whatever their state
+	partitioner := tp.partitioner
+	if msg.PartitionFunc != nil {
+		partitioner = nil
+	}
 
-		if requiresConsistency {
+	err := tp.breaker.Run(func() (err error) {
+		if messageRequiresConsistency(partitioner, msg) {
 			partitions, err = tp.parent.client.Partitions(msg.Topic)
 		} else {
 			partitions, err = tp.parent.client.WritablePartitions(msg.Topic)
@@ -541,23 +769,80 @@ func (tp *topicProducer) partitionMessage(msg *ProducerMessage) error {
 		return err
 	}
 
+	partition, err := choosePartition(tp.parent.conf, partitioner, msg, partitions)
+	if err != nil {
+		return err
+	}
+	msg.Partition = partition
+
+	return nil
+}
+
+// messageRequiresConsistency reports whether partitioner must choose the
+// partition of msg among all the partitions of its topic, rather than only
+// the writable ones. A nil partitioner stands for msg.PartitionFunc.
+func messageRequiresConsistency(partitioner Partitioner, msg *ProducerMessage) bool {
+	if partitioner == nil {
+		return true
+	}
+	if ep, ok := partitioner.(DynamicConsistencyPartitioner); ok {
+		return ep.MessageRequiresConsistency(msg)
+	}
+	return partitioner.RequiresConsistency()
+}
+
+// choosePartition returns the partition partitioner, or msg.PartitionFunc if
+// it is nil, chooses for msg among partitions, once narrowed down by
+// Producer.AllowedPartitions.
+func choosePartition(conf *Config, partitioner Partitioner, msg *ProducerMessage, partitions []int32) (int32, error) {
+	var err error
+	if allowed := conf.Producer.AllowedPartitions; allowed != nil {
+		if partitions, err = allowedPartitions(partitioner, msg, partitions, allowed(msg.Topic)); err != nil {
+			return -1, err
+		}
+	}
+
 	numPartitions := int32(len(partitions))
 
 	if numPartitions == 0 {
-		return ErrLeaderNotAvailable
+		return -1, ErrLeaderNotAvailable
 	}
 
-	choice, err := tp.partitioner.Partition(msg, numPartitions)
+	var choice int32
+	if partitioner == nil {
+		choice = msg.PartitionFunc(numPartitions)
+	} else if choice, err = partitioner.Partition(msg, numPartitions); err != nil {
+		return -1, err
+	}
+	if choice < 0 || choice >= numPartitions {
+		return -1, ErrInvalidPartition
+	}
+	return partitions[choice], nil
+}
 
-	if err != nil {
-		return err
-	} else if choice < 0 || choice >= numPartitions {
-		return ErrInvalidPartition
+// allowedPartitions narrows partitions down to the allowed ones, preserving
+// their order. Messages for the manual partitioner must name an allowed
+// partition instead.
+func allowedPartitions(partitioner Partitioner, msg *ProducerMessage, partitions, allowed []int32) ([]int32, error) {
+	isAllowed := make(map[int32]bool, len(allowed))
+	for _, partition := range allowed {
+		isAllowed[partition] = true
 	}
 
-	msg.Partition = partitions[choice]
+	if _, ok := partitioner.(*manualPartitioner); ok {
+		if !isAllowed[msg.Partition] {
+			return nil, ConfigurationError(fmt.Sprintf("partition %d of topic %s is not allowed by Producer.AllowedPartitions", msg.Partition, msg.Topic))
+		}
+		return partitions, nil
+	}
 
-	return nil
+	filtered := make([]int32, 0, len(allowed))
+	for _, partition := range partitions {
+		if isAllowed[partition] {
+			filtered = append(filtered, partition)
+		}
+	}
+	return filtered, nil
 }
 
 // one per partition per topic
@@ -569,9 +854,16 @@ type partitionProducer struct {
 	partition int32
 	input     <-chan *ProducerMessage
 
-	leader         *Broker
-	breaker        *breaker.Breaker
-	brokerProducer *brokerProducer
+	leader      *Broker
+	leaderEpoch int32 // the epoch of leader, or invalidLeaderEpoch if unknown
+	// staleLeaderEpochs counts the consecutive leader updates that only found
+	// metadata older than leaderEpoch. The epoch is never sent to the brokers,
+	// it only lets the producer skip stale metadata, so after
+	// maxStaleLeaderEpochs such updates the older epoch is trusted: the topic
+	// was most likely deleted and recreated, restarting its epochs.
+	staleLeaderEpochs int
+	breaker           *breaker.Breaker
+	brokerProducer    *brokerProducer
 
 	// highWatermark tracks the "current" retry level, which is the only one where we actually let messages through,
 	// all other messages get buffered in retryState[msg.retries].buf to preserve ordering
@@ -586,6 +878,11 @@ type partitionRetryState struct {
 	expectChaser bool
 }
 
+// maxStaleLeaderEpochs is the number of consecutive leader updates finding only
+// metadata older than the known leader epoch after which a partitionProducer
+// trusts it anyway.
+const maxStaleLeaderEpochs = 3
+
 func (p *asyncProducer) newPartitionProducer(topic string, partition int32) chan<- *ProducerMessage {
 	input := make(chan *ProducerMessage, p.conf.ChannelBufferSize)
 	pp := &partitionProducer{
@@ -594,10 +891,11 @@ func (p *asyncProducer) newPartitionProducer(topic string, partition int32) chan
 		partition: partition,
 		input:     input,
 
-		breaker:    breaker.New(3, 1, 10*time.Second),
-		retryState: make([]partitionRetryState, p.conf.Producer.Retry.Max+1),
+		leaderEpoch: invalidLeaderEpoch,
+		breaker:     breaker.New(3, 1, 10*time.Second),
+		retryState:  make([]partitionRetryState, p.conf.Producer.Retry.Max+1),
 	}
-	go withRecover(pp.dispatch)
+	goWithRecover(p.conf.MetricRegistry, pp.dispatch)
 	return input
 }
 
@@ -610,7 +908,7 @@ func (pp *partitionProducer) backoff(retries int) {
 		backoff = pp.parent.conf.Producer.Retry.Backoff
 	}
 	if backoff > 0 {
-		time.Sleep(backoff)
+		pp.parent.conf.getClock().Sleep(backoff)
 	}
 }
 
@@ -629,7 +927,7 @@ func (pp *partitionProducer) updateLeaderIfBrokerProducerIsNil(msg *ProducerMess
 func (pp *partitionProducer) dispatch() {
 	// try to prefetch the leader; if this doesn't work, we'll do a proper call to `updateLeader`
 	// on the first message
-	pp.leader, _ = pp.parent.client.Leader(pp.topic, pp.partition)
+	pp.leader, pp.leaderEpoch, _ = pp.parent.client.LeaderAndEpoch(pp.topic, pp.partition)
 	if pp.leader != nil {
 		pp.brokerProducer = pp.parent.getBrokerProducer(pp.leader)
 		pp.parent.inFlight.Add(1) // we're generating a syn message; track it so we don't shut down while it's still inflight
@@ -650,7 +948,7 @@ func (pp *partitionProducer) dispatch() {
 				Logger.Printf("producer/leader/%s/%d abandoning broker %d\n", pp.topic, pp.partition, pp.leader.ID())
 				pp.parent.unrefBrokerProducer(pp.leader, pp.brokerProducer)
 				pp.brokerProducer = nil
-				time.Sleep(pp.parent.conf.Producer.Retry.Backoff)
+				pp.parent.conf.getClock().Sleep(pp.parent.conf.Producer.Retry.Backoff)
 			default:
 				// producer connection is still open.
 			}
@@ -758,9 +1056,32 @@ func (pp *partitionProducer) updateLeader() error {
 			return err
 		}
 
-		if pp.leader, err = pp.parent.client.Leader(pp.topic, pp.partition); err != nil {
+		leader, epoch, err := pp.parent.client.LeaderAndEpoch(pp.topic, pp.partition)
+		if err != nil {
 			return err
 		}
+		if epoch != invalidLeaderEpoch && epoch < pp.leaderEpoch {
+			// the metadata predates the leader we produced to, and would send
+			// us back to a fenced one: give another broker a chance to answer
+			Logger.Printf("producer/leader/%s/%d ignoring stale metadata with leader epoch %d < %d\n",
+				pp.topic, pp.partition, epoch, pp.leaderEpoch)
+			if err = pp.parent.client.RefreshMetadata(pp.topic); err != nil {
+				return err
+			}
+			if leader, epoch, err = pp.parent.client.LeaderAndEpoch(pp.topic, pp.partition); err != nil {
+				return err
+			}
+			if epoch != invalidLeaderEpoch && epoch < pp.leaderEpoch {
+				pp.staleLeaderEpochs++
+				if pp.staleLeaderEpochs < maxStaleLeaderEpochs {
+					// still stale, retry later rather than go back to an older leader
+					return ErrLeaderNotAvailable
+				}
+				Logger.Printf("producer/leader/%s/%d accepting leader epoch %d < %d after %d stale metadata refreshes\n",
+					pp.topic, pp.partition, epoch, pp.leaderEpoch, pp.staleLeaderEpochs)
+			}
+		}
+		pp.leader, pp.leaderEpoch, pp.staleLeaderEpochs = leader, epoch, 0
 
 		pp.brokerProducer = pp.parent.getBrokerProducer(pp.leader)
 		pp.parent.inFlight.Add(1) // we're generating a syn message; track it so we don't shut down while it's still inflight
@@ -785,13 +1106,12 @@ func (p *asyncProducer) newBrokerProducer(broker *Broker) *brokerProducer {
 		input:          input,
 		output:         bridge,
 		responses:      responses,
-		buffer:         newProduceSet(p),
 		currentRetries: make(map[string]map[int32]error),
 	}
-	go withRecover(bp.run)
+	goWithRecover(p.conf.MetricRegistry, bp.run)
 
 	// minimal bridge to make the network response `select`able
-	go withRecover(func() {
+	goWithRecover(p.conf.MetricRegistry, func() {
 		// Use a wait group to know if we still have in flight requests
 		var wg sync.WaitGroup
 
@@ -833,7 +1153,7 @@ func (p *asyncProducer) newBrokerProducer(broker *Broker) *brokerProducer {
 				continue
 			}
 			// Callback is not called when using NoResponse
-			if p.conf.Producer.RequiredAcks == NoResponse {
+			if set.requiredAcks() == NoResponse {
 				// Provide the expected nil response
 				sendResponse(nil, nil)
 			}
@@ -847,7 +1167,7 @@ func (p *asyncProducer) newBrokerProducer(broker *Broker) *brokerProducer {
 	// we use an intermediate channel to buffer and send pending responses in order
 	// This is because the AsyncProduce callback inside the bridge is invoked from the broker
 	// responseReceiver goroutine and closing the broker requires such goroutine to be finished
-	go withRecover(func() {
+	goWithRecover(p.conf.MetricRegistry, func() {
 		buf := queue.New()
 		for {
 			if buf.Length() == 0 {
@@ -900,20 +1220,55 @@ type brokerProducer struct {
 	responses <-chan *brokerProducerResponse
 	abandoned chan struct{}
 
-	buffer     *produceSet
-	timer      *time.Timer
-	timerFired bool
+	// maxVersion is the highest produce request version of the broker, see
+	// maxProduceVersion
+	maxVersion int16
+	// buffers accumulate messages by the priority of their topic, the highest
+	// first, see Producer.TopicPriorities, and apart for each topic of
+	// Producer.TopicFlush
+	buffers []*produceSet
+	// flushGroups track the Flush.Frequency of the buffers by the topic of
+	// Producer.TopicFlush they batch, "" for the others
+	flushGroups map[string]*flushGroup
+	timer       clockTimer
 
 	closing        error
 	currentRetries map[string]map[int32]error
+
+	// inFlight counts the requests awaiting a response by partition, with
+	// Producer.StrictOrdering
+	inFlight map[topicPartition]int
+}
+
+// flushGroup is the state of the buffers sharing a FlushConfig.
+type flushGroup struct {
+	conf    FlushConfig
+	linger  time.Time // when the buffers are flushed by Frequency, if set
+	expired bool      // whether Frequency elapsed since the first message
 }
 
 func (bp *brokerProducer) run() {
 	var output chan<- *produceSet
+	var flushing *produceSet // the buffer to send to output
 	var timerChan <-chan time.Time
 	Logger.Printf("producer/broker/%d starting up\n", bp.broker.ID())
 
+	bp.maxVersion = bp.parent.maxProduceVersion(bp.broker)
+	bp.flushGroups = map[string]*flushGroup{"": {conf: bp.parent.flushConfig()}}
+	bp.buffers = []*produceSet{bp.newBuffer(0, "")}
+
 	for {
+		if flushing = bp.nextBuffer(); flushing != nil {
+			output = bp.output
+		} else {
+			output = nil
+		}
+		if bp.timer != nil {
+			timerChan = bp.timer.C()
+		} else {
+			timerChan = nil
+		}
+
 		select {
 		case msg, ok := <-bp.input:
 			if !ok {
@@ -958,7 +1313,7 @@ func (bp *brokerProducer) run() {
 				continue
 			}
 
-			if bp.buffer.wouldOverflow(msg) {
+			if bp.bufferFor(msg.Topic).wouldOverflow(msg) {
 				Logger.Printf("producer/broker/%d maximum request accumulated, waiting for space\n", bp.broker.ID())
 				if err := bp.waitForSpace(msg, false); err != nil {
 					bp.parent.retryMessage(msg, err)
@@ -966,7 +1321,7 @@ func (bp *brokerProducer) run() {
 				}
 			}
 
-			if bp.parent.txnmgr.producerID != noProducerID && bp.buffer.producerEpoch != msg.producerEpoch {
+			if bp.parent.txnmgr.producerID != noProducerID && bp.bufferFor(msg.Topic).producerEpoch != msg.producerEpoch {
 				// The epoch was reset, need to roll the buffer over
 				Logger.Printf("producer/broker/%d detected epoch rollover, waiting for new buffer\n", bp.broker.ID())
 				if err := bp.waitForSpace(msg, true); err != nil {
@@ -974,41 +1329,38 @@ func (bp *brokerProducer) run() {
 					continue
 				}
 			}
-			if err := bp.buffer.add(msg); err != nil {
+			set := bp.bufferFor(msg.Topic)
+			if err := set.add(msg); err != nil {
 				bp.parent.returnError(msg, err)
 				continue
 			}
-
-			if bp.parent.conf.Producer.Flush.Frequency > 0 && bp.timer == nil {
-				bp.timer = time.NewTimer(bp.parent.conf.Producer.Flush.Frequency)
-				timerChan = bp.timer.C
-			}
+			bp.startLinger(set.flushTopic)
 		case <-timerChan:
-			bp.timerFired = true
-		case output <- bp.buffer:
-			bp.rollOver()
-			timerChan = nil
+			bp.timer = nil
+			bp.expireLingers()
+		case output <- flushing:
+			bp.markInFlight(flushing)
+			bp.rollOver(flushing)
 		case response, ok := <-bp.responses:
 			if ok {
 				bp.handleResponse(response)
 			}
 		}
-
-		if bp.timerFired || bp.buffer.readyToFlush() {
-			output = bp.output
-		} else {
-			output = nil
-		}
 	}
 }
 
 func (bp *brokerProducer) shutdown() {
-	for !bp.buffer.empty() {
+	for set := bp.nonEmptyBuffer(); set != nil; set = bp.nonEmptyBuffer() {
+		output := bp.output
+		if bp.awaitsInFlight(set) {
+			output = nil
+		}
 		select {
 		case response := <-bp.responses:
 			bp.handleResponse(response)
-		case bp.output <- bp.buffer:
-			bp.rollOver()
+		case output <- set:
+			bp.markInFlight(set)
+			bp.rollOver(set)
 		}
 	}
 	close(bp.output)
@@ -1030,40 +1382,235 @@ func (bp *brokerProducer) needsRetry(msg *ProducerMessage) error {
 
 func (bp *brokerProducer) waitForSpace(msg *ProducerMessage, forceRollover bool) error {
 	for {
+		// handling a response can roll the buffer over, so look it up every time
+		set := bp.bufferFor(msg.Topic)
+		output := bp.output
+		if bp.awaitsInFlight(set) {
+			output = nil
+		}
 		select {
 		case response := <-bp.responses:
 			bp.handleResponse(response)
 			// handling a response can change our state, so re-check some things
 			if reason := bp.needsRetry(msg); reason != nil {
 				return reason
-			} else if !bp.buffer.wouldOverflow(msg) && !forceRollover {
+			} else if !bp.bufferFor(msg.Topic).wouldOverflow(msg) && !forceRollover {
 				return nil
 			}
-		case bp.output <- bp.buffer:
-			bp.rollOver()
+		case output <- set:
+			bp.markInFlight(set)
+			bp.rollOver(set)
 			return nil
 		}
 	}
 }
 
-func (bp *brokerProducer) rollOver() {
+// bufferFor returns the buffer of the priority of the topic, or of the topic
+// itself if it is in Producer.TopicFlush, creating it if needed.
+func (bp *brokerProducer) bufferFor(topic string) *produceSet {
+	logical, _ := bp.parent.conf.logicalTopic(topic)
+	priority := bp.parent.conf.Producer.TopicPriorities[logical]
+	flushTopic := ""
+	if _, ok := bp.parent.conf.Producer.TopicFlush[logical]; ok {
+		flushTopic = logical
+	}
+
+	i := sort.Search(len(bp.buffers), func(i int) bool { return bp.buffers[i].priority <= priority })
+	for ; i < len(bp.buffers) && bp.buffers[i].priority == priority; i++ {
+		if bp.buffers[i].flushTopic == flushTopic {
+			return bp.buffers[i]
+		}
+	}
+
+	set := bp.newBuffer(priority, flushTopic)
+	bp.buffers = append(bp.buffers, nil)
+	copy(bp.buffers[i+1:], bp.buffers[i:])
+	bp.buffers[i] = set
+	return set
+}
+
+func (bp *brokerProducer) newBuffer(priority int, flushTopic string) *produceSet {
+	group := bp.flushGroups[flushTopic]
+	if group == nil {
+		group = &flushGroup{conf: bp.parent.conf.Producer.TopicFlush[flushTopic]}
+		bp.flushGroups[flushTopic] = group
+	}
+
+	set := newProduceSet(bp.parent)
+	set.priority = priority
+	set.maxVersion = bp.maxVersion
+	set.flush = &group.conf
+	set.flushTopic = flushTopic
+	return set
+}
+
+// startLinger starts waiting for the Frequency of the flush group, unless it
+// already is.
+func (bp *brokerProducer) startLinger(flushTopic string) {
+	group := bp.flushGroups[flushTopic]
+	if group.conf.Frequency <= 0 || group.expired || !group.linger.IsZero() {
+		return
+	}
+	group.linger = bp.parent.conf.getClock().Now().Add(group.conf.Frequency)
+	bp.resetTimer()
+}
+
+// expireLingers marks the flush groups whose Frequency elapsed as ready to
+// flush.
+func (bp *brokerProducer) expireLingers() {
+	now := bp.parent.conf.getClock().Now()
+	for _, group := range bp.flushGroups {
+		if !group.linger.IsZero() && !group.linger.After(now) {
+			group.linger = time.Time{}
+			group.expired = true
+		}
+	}
+	bp.resetTimer()
+}
+
+// resetTimer sets the timer to fire when the earliest flush group lingered
+// long enough.
+func (bp *brokerProducer) resetTimer() {
+	var earliest time.Time
+	for _, group := range bp.flushGroups {
+		if !group.linger.IsZero() && (earliest.IsZero() || group.linger.Before(earliest)) {
+			earliest = group.linger
+		}
+	}
 	if bp.timer != nil {
 		bp.timer.Stop()
+		bp.timer = nil
+	}
+	if !earliest.IsZero() {
+		clock := bp.parent.conf.getClock()
+		bp.timer = clock.NewTimer(earliest.Sub(clock.Now()))
+	}
+}
+
+// maxProduceVersion returns the highest produce request version advertised
+// by broker, or -1 if unknown. The produce requests sent to it are capped to
+// it, so that it is never sent a record format it cannot parse.
+func (p *asyncProducer) maxProduceVersion(broker *Broker) int16 {
+	max, ok := broker.maxApiVersion((&ProduceRequest{}).key())
+	if !ok {
+		return -1
+	}
+	if version := produceRequestVersion(p.conf.Version); max < version {
+		Logger.Printf("producer/broker/%d supports produce requests up to v%d, downgrading from v%d\n",
+			broker.ID(), max, version)
+	}
+	return max
+}
+
+// nonEmptyBuffer returns the non-empty buffer of the highest priority, or nil.
+func (bp *brokerProducer) nonEmptyBuffer() *produceSet {
+	for _, set := range bp.buffers {
+		if !set.empty() {
+			return set
+		}
+	}
+	return nil
+}
+
+// nextBuffer returns the buffer to flush, the non-empty one of the highest
+// priority among the ready ones, or nil. The buffers of the topics outside of
+// Producer.TopicFlush are all ready once any of them is; the others only by
+// their own FlushConfig.
+func (bp *brokerProducer) nextBuffer() *produceSet {
+	ready := bp.flushGroups[""].expired
+	for _, set := range bp.buffers {
+		if set.flushTopic == "" {
+			ready = ready || set.readyToFlush()
+		}
+	}
+	for _, set := range bp.buffers {
+		if set.empty() || bp.awaitsInFlight(set) {
+			continue
+		}
+		if set.flushTopic == "" && ready ||
+			set.flushTopic != "" && (set.readyToFlush() || bp.flushGroups[set.flushTopic].expired) {
+			return set
+		}
+	}
+	return nil
+}
+
+func (bp *brokerProducer) strictOrdering() bool {
+	return bp.parent.conf.Producer.StrictOrdering && !bp.parent.conf.Producer.Idempotent
+}
+
+// awaitsInFlight reports whether set must be held back because a request to
+// one of its partitions awaits a response, with Producer.StrictOrdering.
+func (bp *brokerProducer) awaitsInFlight(set *produceSet) bool {
+	if len(bp.inFlight) == 0 {
+		return false
+	}
+	awaits := false
+	set.eachPartition(func(topic string, partition int32, _ *partitionSet) {
+		if bp.inFlight[topicPartition{topic, partition}] > 0 {
+			awaits = true
+		}
+	})
+	return awaits
+}
+
+// markInFlight records the partitions of set sent, with Producer.StrictOrdering.
+func (bp *brokerProducer) markInFlight(set *produceSet) {
+	if !bp.strictOrdering() {
+		return
+	}
+	if bp.inFlight == nil {
+		bp.inFlight = make(map[topicPartition]int)
+	}
+	set.eachPartition(func(topic string, partition int32, _ *partitionSet) {
+		bp.inFlight[topicPartition{topic, partition}]++
+	})
+}
+
+func (bp *brokerProducer) rollOver(set *produceSet) {
+	for i := range bp.buffers {
+		if bp.buffers[i] == set {
+			bp.buffers[i] = bp.newBuffer(set.priority, set.flushTopic)
+		}
+	}
+	for _, other := range bp.buffers {
+		if other.flushTopic == set.flushTopic && !other.empty() {
+			// the other buffers of the group still wait for the timer, if any
+			return
+		}
+	}
+	group := bp.flushGroups[set.flushTopic]
+	group.expired = false
+	if set.flushTopic == "" {
+		// pick up the changes of Reconfigure
+		group.conf = bp.parent.flushConfig()
+	}
+	if !group.linger.IsZero() {
+		group.linger = time.Time{}
+		bp.resetTimer()
 	}
-	bp.timer = nil
-	bp.timerFired = false
-	bp.buffer = newProduceSet(bp.parent)
 }
 
 func (bp *brokerProducer) handleResponse(response *brokerProducerResponse) {
+	if bp.strictOrdering() {
+		response.set.eachPartition(func(topic string, partition int32, _ *partitionSet) {
+			tp := topicPartition{topic, partition}
+			if bp.inFlight[tp]--; bp.inFlight[tp] <= 0 {
+				delete(bp.inFlight, tp)
+			}
+		})
+	}
+
 	if response.err != nil {
 		bp.handleError(response.set, response.err)
 	} else {
 		bp.handleSuccess(response.set, response.res)
 	}
 
-	if bp.buffer.empty() {
-		bp.rollOver() // this can happen if the response invalidated our buffer
+	for _, set := range bp.buffers {
+		if set.empty() {
+			bp.rollOver(set) // this can happen if the response invalidated our buffer
+		}
 	}
 }
 
@@ -1092,8 +1639,13 @@ func (bp *brokerProducer) handleSuccess(sent *produceSet, response *ProduceRespo
 					msg.Timestamp = block.Timestamp
 				}
 			}
+			logStartOffset := int64(-1)
+			if response.Version >= 5 {
+				logStartOffset = block.StartOffset
+			}
 			for i, msg := range pSet.msgs {
 				msg.Offset = block.Offset + int64(i)
+				msg.LogStartOffset = logStartOffset
 			}
 			bp.parent.returnSuccesses(pSet.msgs)
 		// Duplicate
@@ -1101,7 +1653,8 @@ func (bp *brokerProducer) handleSuccess(sent *produceSet, response *ProduceRespo
 			bp.parent.returnSuccesses(pSet.msgs)
 		// Retriable errors
 		case ErrInvalidMessage, ErrUnknownTopicOrPartition, ErrLeaderNotAvailable, ErrNotLeaderForPartition,
-			ErrRequestTimedOut, ErrNotEnoughReplicas, ErrNotEnoughReplicasAfterAppend:
+			ErrRequestTimedOut, ErrNotEnoughReplicas, ErrNotEnoughReplicasAfterAppend,
+			ErrFencedLeaderEpoch, ErrUnknownLeaderEpoch:
 			if bp.parent.conf.Producer.Retry.Max <= 0 {
 				bp.parent.abandonBrokerConnection(bp.broker)
 				bp.parent.returnErrors(pSet.msgs, block.Err)
@@ -1134,7 +1687,8 @@ func (bp *brokerProducer) handleSuccess(sent *produceSet, response *ProduceRespo
 
 			switch block.Err {
 			case ErrInvalidMessage, ErrUnknownTopicOrPartition, ErrLeaderNotAvailable, ErrNotLeaderForPartition,
-				ErrRequestTimedOut, ErrNotEnoughReplicas, ErrNotEnoughReplicasAfterAppend:
+				ErrRequestTimedOut, ErrNotEnoughReplicas, ErrNotEnoughReplicasAfterAppend,
+				ErrFencedLeaderEpoch, ErrUnknownLeaderEpoch:
 				Logger.Printf("producer/broker/%d state change to [retrying] on %s/%d because %v\n",
 					bp.broker.ID(), topic, partition, block.Err)
 				if bp.currentRetries[topic] == nil {
@@ -1147,7 +1701,7 @@ func (bp *brokerProducer) handleSuccess(sent *produceSet, response *ProduceRespo
 					bp.parent.retryMessages(pSet.msgs, block.Err)
 				}
 				// dropping the following messages has the side effect of incrementing their retry count
-				bp.parent.retryMessages(bp.buffer.dropPartition(topic, partition), block.Err)
+				bp.parent.retryMessages(bp.bufferFor(topic).dropPartition(topic, partition), block.Err)
 			}
 		})
 	}
@@ -1196,10 +1750,12 @@ func (bp *brokerProducer) handleError(sent *produceSet, err error) {
 		sent.eachPartition(func(topic string, partition int32, pSet *partitionSet) {
 			bp.parent.retryMessages(pSet.msgs, err)
 		})
-		bp.buffer.eachPartition(func(topic string, partition int32, pSet *partitionSet) {
-			bp.parent.retryMessages(pSet.msgs, err)
-		})
-		bp.rollOver()
+		for _, set := range bp.buffers {
+			set.eachPartition(func(topic string, partition int32, pSet *partitionSet) {
+				bp.parent.retryMessages(pSet.msgs, err)
+			})
+			bp.rollOver(set)
+		}
 	}
 }
 
@@ -1293,8 +1849,12 @@ func (p *asyncProducer) returnError(msg *ProducerMessage, err error) {
 	}
 
 	msg.clear()
+	msg.Topic, _ = p.conf.logicalTopic(msg.Topic)
+	msg.endSpan(err)
 	pErr := &ProducerError{Msg: msg, Err: err}
-	if p.conf.Producer.Return.Errors {
+	if msg.future != nil {
+		msg.resolveFuture(err)
+	} else if p.conf.Producer.Return.Errors {
 		p.errors <- pErr
 	} else {
 		Logger.Println(pErr)
@@ -1310,7 +1870,12 @@ func (p *asyncProducer) returnErrors(batch []*ProducerMessage, err error) {
 
 func (p *asyncProducer) returnSuccesses(batch []*ProducerMessage) {
 	for _, msg := range batch {
-		if p.conf.Producer.Return.Successes {
+		msg.Topic, _ = p.conf.logicalTopic(msg.Topic)
+		msg.endSpan(nil)
+		if msg.future != nil {
+			msg.clear()
+			msg.resolveFuture(nil)
+		} else if p.conf.Producer.Return.Successes {
 			msg.clear()
 			p.successes <- msg
 		}
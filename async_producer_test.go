@@ -1,12 +1,15 @@
 package sarama
 
 import (
+	"context"
 	"errors"
 	"log"
 	"math"
 	"os"
 	"os/signal"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -187,6 +190,192 @@ done:
 	seedBroker.Close()
 }
 
+func TestAsyncProducerLogAppendTime(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+
+	logAppendTime := time.Unix(1700000000, 123*int64(time.Millisecond))
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("my_topic", 0, broker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t).
+			SetLogAppendTime("my_topic", 0, logAppendTime),
+	})
+
+	config := NewTestConfig()
+	config.Version = V0_10_0_0
+	config.Producer.Return.Successes = true
+	producer, err := NewAsyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createTime := logAppendTime.Add(-time.Hour)
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage), Timestamp: createTime}
+	select {
+	case msg := <-producer.Errors():
+		t.Error(msg.Err)
+	case msg := <-producer.Successes():
+		if !msg.Timestamp.Equal(logAppendTime) {
+			t.Errorf("Expected the broker assigned timestamp %s, got %s", logAppendTime, msg.Timestamp)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timeout waiting for msg")
+	}
+
+	closeProducer(t, producer)
+}
+
+func TestAsyncProducerLogStartOffset(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		version  KafkaVersion
+		acks     RequiredAcks
+		expected int64
+	}{
+		{"0.11", V0_11_0_0, WaitForLocal, -1},
+		{"1.0", V1_0_0_0, WaitForLocal, 50},
+		{"NoResponse", V1_0_0_0, NoResponse, -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			broker := NewMockBroker(t, 1)
+			defer broker.Close()
+
+			broker.SetHandlerByMap(map[string]MockResponse{
+				"MetadataRequest": NewMockMetadataResponse(t).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetLeader("my_topic", 0, broker.BrokerID()),
+				"ProduceRequest": NewMockProduceResponse(t).
+					SetLogStartOffset("my_topic", 0, 50),
+			})
+
+			config := NewTestConfig()
+			config.Version = tc.version
+			config.Producer.RequiredAcks = tc.acks
+			config.Producer.Return.Successes = true
+			producer, err := NewAsyncProducer([]string{broker.Addr()}, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
+			select {
+			case msg := <-producer.Errors():
+				t.Error(msg.Err)
+			case msg := <-producer.Successes():
+				if msg.LogStartOffset != tc.expected {
+					t.Errorf("Expected the log start offset %d, got %d", tc.expected, msg.LogStartOffset)
+				}
+			case <-time.After(time.Second):
+				t.Error("Timeout waiting for msg")
+			}
+
+			closeProducer(t, producer)
+		})
+	}
+}
+
+func TestAsyncProducerEnqueue(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	leader := NewMockBroker(t, 2)
+
+	metadataResponse := new(MetadataResponse)
+	metadataResponse.AddBroker(leader.Addr(), leader.BrokerID())
+	metadataResponse.AddTopicPartition("my_topic", 0, leader.BrokerID(), nil, nil, nil, ErrNoError)
+	metadataResponse.AddTopicPartition("my_topic", 1, leader.BrokerID(), nil, nil, nil, ErrNoError)
+	seedBroker.Returns(metadataResponse)
+
+	prodResponse := new(ProduceResponse)
+	prodResponse.AddTopicPartition("my_topic", 0, ErrNoError)
+	prodResponse.Blocks["my_topic"][0].Offset = 42
+	prodResponse.AddTopicPartition("my_topic", 1, ErrMessageSizeTooLarge)
+	leader.Returns(prodResponse)
+
+	// futures report results even though neither channel is enabled
+	config := NewTestConfig()
+	config.Producer.Flush.Messages = 2
+	config.Producer.Return.Errors = false
+	config.Producer.Partitioner = NewManualPartitioner
+	producer, err := NewAsyncProducer([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	succeeding := producer.Enqueue(&ProducerMessage{Topic: "my_topic", Partition: 0, Value: StringEncoder(TestMessage)})
+	failing := producer.Enqueue(&ProducerMessage{Topic: "my_topic", Partition: 1, Value: StringEncoder(TestMessage)})
+
+	select {
+	case <-succeeding.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the future to resolve")
+	}
+	partition, offset, err := succeeding.Result()
+	if err != nil || partition != 0 || offset != 42 {
+		t.Errorf("expected delivery to my_topic/0 at offset 42, got %d/%d: %v", partition, offset, err)
+	}
+	if _, _, err := failing.Result(); !errors.Is(err, ErrMessageSizeTooLarge) {
+		t.Errorf("expected ErrMessageSizeTooLarge, got %v", err)
+	}
+
+	closeProducer(t, producer)
+	leader.Close()
+	seedBroker.Close()
+}
+
+func TestAsyncProducerEnqueueThenInput(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	leader := NewMockBroker(t, 2)
+
+	metadataResponse := new(MetadataResponse)
+	metadataResponse.AddBroker(leader.Addr(), leader.BrokerID())
+	metadataResponse.AddTopicPartition("my_topic", 0, leader.BrokerID(), nil, nil, nil, ErrNoError)
+	seedBroker.Returns(metadataResponse)
+
+	for _, offset := range []int64{42, 43} {
+		prodResponse := new(ProduceResponse)
+		prodResponse.AddTopicPartition("my_topic", 0, ErrNoError)
+		prodResponse.Blocks["my_topic"][0].Offset = offset
+		leader.Returns(prodResponse)
+	}
+
+	config := NewTestConfig()
+	config.Producer.Flush.Messages = 1
+	config.Producer.Return.Successes = true
+	config.Producer.Partitioner = NewManualPartitioner
+	producer, err := NewAsyncProducer([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &ProducerMessage{Topic: "my_topic", Partition: 0, Value: StringEncoder(TestMessage)}
+	future := producer.Enqueue(msg)
+	if _, _, err := future.Result(); err != nil {
+		t.Fatal(err)
+	}
+
+	// sending the message again must neither resolve its former future again
+	// nor bypass the Successes channel
+	producer.Input() <- msg
+	select {
+	case success := <-producer.Successes():
+		if success != msg || success.Offset != 43 {
+			t.Errorf("expected the message to be delivered again at offset 43, got %d", success.Offset)
+		}
+	case err := <-producer.Errors():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message sent again")
+	}
+	if _, offset, err := future.Result(); err != nil || offset != 42 {
+		t.Errorf("expected the future to keep its result at offset 42, got %d: %v", offset, err)
+	}
+
+	closeProducer(t, producer)
+	leader.Close()
+	seedBroker.Close()
+}
+
 func TestAsyncProducerMultipleFlushes(t *testing.T) {
 	seedBroker := NewMockBroker(t, 1)
 	leader := NewMockBroker(t, 2)
@@ -474,6 +663,198 @@ func TestAsyncProducerEncoderFailures(t *testing.T) {
 	seedBroker.Close()
 }
 
+func TestAsyncProducerAllowedPartitions(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	metadata := NewMockMetadataResponse(t).SetBroker(seedBroker.Addr(), seedBroker.BrokerID())
+	produce := NewMockProduceResponse(t)
+	for partition := int32(0); partition < 4; partition++ {
+		metadata.SetLeader("my_topic", partition, seedBroker.BrokerID())
+		produce.SetError("my_topic", partition, ErrNoError)
+	}
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": metadata,
+		"ProduceRequest":  produce,
+	})
+
+	config := NewTestConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Partitioner = NewRoundRobinPartitioner
+	config.Producer.AllowedPartitions = func(topic string) []int32 {
+		return []int32{3, 1}
+	}
+	producer, err := NewAsyncProducer([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int32{1, 3, 1, 3}
+	for i, partition := range expected {
+		producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
+		select {
+		case msg := <-producer.Successes():
+			if msg.Partition != partition {
+				t.Errorf("message %d: expected partition %d, got %d", i, partition, msg.Partition)
+			}
+		case perr := <-producer.Errors():
+			t.Fatal(perr)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a success")
+		}
+	}
+
+	closeProducer(t, producer)
+}
+
+func TestAsyncProducerAllowedPartitionsManual(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+			SetLeader("my_topic", 0, seedBroker.BrokerID()).
+			SetLeader("my_topic", 1, seedBroker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t).
+			SetError("my_topic", 1, ErrNoError),
+	})
+
+	config := NewTestConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.Partitioner = NewManualPartitioner
+	config.Producer.AllowedPartitions = func(topic string) []int32 {
+		return []int32{1}
+	}
+	producer, err := NewAsyncProducer([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Partition: 0, Value: StringEncoder(TestMessage)}
+	select {
+	case perr := <-producer.Errors():
+		var cerr ConfigurationError
+		if !errors.As(perr.Err, &cerr) || !strings.Contains(perr.Err.Error(), "partition 0") {
+			t.Errorf("expected a ConfigurationError naming partition 0, got %v", perr.Err)
+		}
+	case <-producer.Successes():
+		t.Fatal("expected the message to a disallowed partition to fail")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an error")
+	}
+
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Partition: 1, Value: StringEncoder(TestMessage)}
+	select {
+	case msg := <-producer.Successes():
+		if msg.Partition != 1 {
+			t.Errorf("expected partition 1, got %d", msg.Partition)
+		}
+	case perr := <-producer.Errors():
+		t.Fatal(perr)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a success")
+	}
+
+	closeProducer(t, producer)
+}
+
+func TestAsyncProducerManualPartitionOutOfRange(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+			SetLeader("my_topic", 0, seedBroker.BrokerID()).
+			SetLeader("my_topic", 1, seedBroker.BrokerID()),
+	})
+
+	config := NewTestConfig()
+	config.Producer.Partitioner = NewManualPartitioner
+	producer, err := NewAsyncProducer([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Partition: 2, Value: StringEncoder(TestMessage)}
+	select {
+	case perr := <-producer.Errors():
+		if !errors.Is(perr.Err, ErrInvalidPartition) {
+			t.Errorf("expected ErrInvalidPartition, got %v", perr.Err)
+		}
+		if msg := perr.Err.Error(); !strings.Contains(msg, "partition 2 of topic my_topic") || !strings.Contains(msg, "2 partitions") {
+			t.Errorf("expected the error to name the partition and partition count, got %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an error")
+	}
+
+	closeProducer(t, producer)
+}
+
+func TestAsyncProducerHeaderLimits(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+			SetLeader("my_topic", 0, seedBroker.BrokerID()),
+	})
+
+	config := NewTestConfig()
+	config.Version = V0_11_0_0
+	config.Producer.MaxHeaders = 2
+	config.Producer.MaxHeaderBytes = 16
+	producer, err := NewAsyncProducer([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		headers []RecordHeader
+		limit   string
+		key     string
+	}{
+		{
+			headers: []RecordHeader{
+				{Key: []byte("a"), Value: []byte("1")},
+				{Key: []byte("b"), Value: []byte("2")},
+				{Key: []byte("c"), Value: []byte("3")},
+			},
+			limit: "Producer.MaxHeaders",
+			key:   `"c"`,
+		},
+		{
+			headers: []RecordHeader{
+				{Key: []byte("trace"), Value: []byte("0123")},
+				{Key: []byte("payload"), Value: []byte("0123456789")},
+			},
+			limit: "Producer.MaxHeaderBytes",
+			key:   `"payload"`,
+		},
+	}
+	for _, tt := range tests {
+		producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage), Headers: tt.headers}
+		select {
+		case perr := <-producer.Errors():
+			var cerr ConfigurationError
+			if !errors.As(perr.Err, &cerr) {
+				t.Fatalf("expected a ConfigurationError, got %v", perr.Err)
+			}
+			if msg := perr.Err.Error(); !strings.Contains(msg, tt.limit) || !strings.Contains(msg, tt.key) {
+				t.Errorf("expected error naming %s and header %s, got %q", tt.limit, tt.key, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the header limit error")
+		}
+	}
+
+	closeProducer(t, producer)
+}
+
 // If a Kafka broker becomes unavailable and then returns back in service, then
 // producer reconnects to it and continues sending messages.
 func TestAsyncProducerBrokerBounce(t *testing.T) {
@@ -616,74 +997,243 @@ func TestAsyncProducerMultipleRetries(t *testing.T) {
 	closeProducer(t, producer)
 }
 
-func TestAsyncProducerMultipleRetriesWithBackoffFunc(t *testing.T) {
+func TestAsyncProducerFencedLeaderEpoch(t *testing.T) {
 	seedBroker := NewMockBroker(t, 1)
 	leader1 := NewMockBroker(t, 2)
 	leader2 := NewMockBroker(t, 3)
+	defer seedBroker.Close()
+	defer leader1.Close()
+	defer leader2.Close()
 
-	metadataLeader1 := new(MetadataResponse)
-	metadataLeader1.AddBroker(leader1.Addr(), leader1.BrokerID())
-	metadataLeader1.AddTopicPartition("my_topic", 0, leader1.BrokerID(), nil, nil, nil, ErrNoError)
-	seedBroker.Returns(metadataLeader1)
+	metadata := func(leader *MockBroker, epoch int32) *MetadataResponse {
+		res := &MetadataResponse{Version: 7}
+		res.AddBroker(leader1.Addr(), leader1.BrokerID())
+		res.AddBroker(leader2.Addr(), leader2.BrokerID())
+		res.AddTopicPartition("my_topic", 0, leader.BrokerID(), nil, nil, nil, ErrNoError)
+		res.Topics[0].Partitions[0].LeaderEpoch = epoch
+		return res
+	}
+	seedBroker.Returns(metadata(leader1, 5))
 
 	config := NewTestConfig()
-	config.Producer.Flush.Messages = 1
+	config.Version = V2_1_0_0
+	config.ApiVersionsRequest = false
 	config.Producer.Return.Successes = true
-	config.Producer.Retry.Max = 4
-
-	backoffCalled := make([]int32, config.Producer.Retry.Max+1)
-	config.Producer.Retry.BackoffFunc = func(retries, maxRetries int) time.Duration {
-		atomic.AddInt32(&backoffCalled[retries-1], 1)
-		return 0
-	}
+	config.Producer.Retry.Max = 1
+	config.Producer.Retry.Backoff = 0
 	producer, err := NewAsyncProducer([]string{seedBroker.Addr()}, config)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	producer.Input() <- &ProducerMessage{Topic: "my_topic", Key: nil, Value: StringEncoder(TestMessage)}
-	prodNotLeader := new(ProduceResponse)
-	prodNotLeader.AddTopicPartition("my_topic", 0, ErrNotLeaderForPartition)
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
 
-	prodSuccess := new(ProduceResponse)
+	prodFenced := &ProduceResponse{Version: 7}
+	prodFenced.AddTopicPartition("my_topic", 0, ErrFencedLeaderEpoch)
+	leader1.Returns(prodFenced)
+	// the first refresh is answered with stale metadata, which is ignored
+	leader1.Returns(metadata(leader1, 4))
+	leader1.Returns(metadata(leader2, 6))
+
+	prodSuccess := &ProduceResponse{Version: 7}
 	prodSuccess.AddTopicPartition("my_topic", 0, ErrNoError)
+	leader2.Returns(prodSuccess)
+	expectResults(t, producer, 1, 0)
 
-	metadataLeader2 := new(MetadataResponse)
-	metadataLeader2.AddBroker(leader2.Addr(), leader2.BrokerID())
-	metadataLeader2.AddTopicPartition("my_topic", 0, leader2.BrokerID(), nil, nil, nil, ErrNoError)
+	closeProducer(t, producer)
+}
 
-	leader1.Returns(prodNotLeader)
-	leader1.Returns(metadataLeader2)
-	leader2.Returns(prodNotLeader)
-	leader2.Returns(metadataLeader1)
-	leader1.Returns(prodNotLeader)
-	leader1.Returns(metadataLeader1)
-	leader1.Returns(prodNotLeader)
-	leader1.Returns(metadataLeader2)
-	leader2.Returns(prodSuccess)
+func TestAsyncProducerFencedLeaderEpochStaleMetadata(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	leader1 := NewMockBroker(t, 2)
+	defer seedBroker.Close()
+	defer leader1.Close()
 
-	expectResults(t, producer, 1, 0)
+	metadata := func(epoch int32) *MetadataResponse {
+		res := &MetadataResponse{Version: 7}
+		res.AddBroker(leader1.Addr(), leader1.BrokerID())
+		res.AddTopicPartition("my_topic", 0, leader1.BrokerID(), nil, nil, nil, ErrNoError)
+		res.Topics[0].Partitions[0].LeaderEpoch = epoch
+		return res
+	}
+	seedBroker.Returns(metadata(5))
 
-	producer.Input() <- &ProducerMessage{Topic: "my_topic", Key: nil, Value: StringEncoder(TestMessage)}
-	leader2.Returns(prodSuccess)
-	expectResults(t, producer, 1, 0)
+	config := NewTestConfig()
+	config.Version = V2_1_0_0
+	config.ApiVersionsRequest = false
+	config.Producer.Return.Successes = true
+	config.Producer.Retry.Max = 1
+	config.Producer.Retry.Backoff = 0
+	producer, err := NewAsyncProducer([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	seedBroker.Close()
-	leader1.Close()
-	leader2.Close()
-	closeProducer(t, producer)
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
 
-	for i := 0; i < config.Producer.Retry.Max; i++ {
-		if atomic.LoadInt32(&backoffCalled[i]) != 1 {
-			t.Errorf("expected one retry attempt #%d", i)
+	prodFenced := &ProduceResponse{Version: 7}
+	prodFenced.AddTopicPartition("my_topic", 0, ErrFencedLeaderEpoch)
+	// every refresh is answered with stale metadata, so the message is not
+	// sent back to the fenced leader
+	leader1.SetHandlerByMap(map[string]MockResponse{
+		"ProduceRequest":  NewMockWrapper(prodFenced),
+		"MetadataRequest": NewMockWrapper(metadata(4)),
+	})
+
+	select {
+	case msg := <-producer.Successes():
+		t.Fatalf("expected the message not to be produced with stale metadata, got offset %d", msg.Offset)
+	case pErr := <-producer.Errors():
+		if !errors.Is(pErr.Err, ErrLeaderNotAvailable) {
+			t.Errorf("expected ErrLeaderNotAvailable, got %v", pErr.Err)
 		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the message to fail")
 	}
-	if atomic.LoadInt32(&backoffCalled[config.Producer.Retry.Max]) != 0 {
-		t.Errorf("expected no retry attempt #%d", config.Producer.Retry.Max)
-	}
+
+	closeProducer(t, producer)
 }
 
-// https://github.com/IBM/sarama/issues/2129
+func TestAsyncProducerRecreatedTopicLeaderEpoch(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	leader1 := NewMockBroker(t, 2)
+	defer seedBroker.Close()
+	defer leader1.Close()
+
+	metadata := func(epoch int32) *MetadataResponse {
+		res := &MetadataResponse{Version: 7}
+		res.AddBroker(leader1.Addr(), leader1.BrokerID())
+		res.AddTopicPartition("my_topic", 0, leader1.BrokerID(), nil, nil, nil, ErrNoError)
+		res.Topics[0].Partitions[0].LeaderEpoch = epoch
+		return res
+	}
+	seedBroker.Returns(metadata(5))
+
+	config := NewTestConfig()
+	config.Version = V2_1_0_0
+	config.ApiVersionsRequest = false
+	config.Producer.Return.Successes = true
+	config.Producer.Retry.Max = 1
+	config.Producer.Retry.Backoff = 0
+	producer, err := NewAsyncProducer([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prodFenced := &ProduceResponse{Version: 7}
+	prodFenced.AddTopicPartition("my_topic", 0, ErrFencedLeaderEpoch)
+	prodSuccess := &ProduceResponse{Version: 7}
+	prodSuccess.AddTopicPartition("my_topic", 0, ErrNoError)
+	// the topic was recreated, restarting its leader epochs: every refresh
+	// answers with an epoch older than the one the producer knows
+	var produced int32
+	leader1.setHandler(func(req *request) (res encoderWithHeader) {
+		switch req.body.(type) {
+		case *MetadataRequest:
+			return metadata(0)
+		case *ProduceRequest:
+			if atomic.AddInt32(&produced, 1) == 1 {
+				return prodFenced
+			}
+			return prodSuccess
+		}
+		return nil
+	})
+
+	// the first message is not sent back with stale metadata, but the older
+	// epoch is eventually trusted
+	for i := 1; ; i++ {
+		producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
+		select {
+		case msg := <-producer.Successes():
+			if i == 1 {
+				t.Fatalf("expected the first message to fail with stale metadata, got offset %d", msg.Offset)
+			}
+		case pErr := <-producer.Errors():
+			if !errors.Is(pErr.Err, ErrLeaderNotAvailable) {
+				t.Fatalf("expected ErrLeaderNotAvailable, got %v", pErr.Err)
+			}
+			if i == maxStaleLeaderEpochs {
+				t.Fatal("expected the older leader epoch to be trusted")
+			}
+			continue
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for message %d", i)
+		}
+		break
+	}
+
+	closeProducer(t, producer)
+}
+
+func TestAsyncProducerMultipleRetriesWithBackoffFunc(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	leader1 := NewMockBroker(t, 2)
+	leader2 := NewMockBroker(t, 3)
+
+	metadataLeader1 := new(MetadataResponse)
+	metadataLeader1.AddBroker(leader1.Addr(), leader1.BrokerID())
+	metadataLeader1.AddTopicPartition("my_topic", 0, leader1.BrokerID(), nil, nil, nil, ErrNoError)
+	seedBroker.Returns(metadataLeader1)
+
+	config := NewTestConfig()
+	config.Producer.Flush.Messages = 1
+	config.Producer.Return.Successes = true
+	config.Producer.Retry.Max = 4
+
+	backoffCalled := make([]int32, config.Producer.Retry.Max+1)
+	config.Producer.Retry.BackoffFunc = func(retries, maxRetries int) time.Duration {
+		atomic.AddInt32(&backoffCalled[retries-1], 1)
+		return 0
+	}
+	producer, err := NewAsyncProducer([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Key: nil, Value: StringEncoder(TestMessage)}
+	prodNotLeader := new(ProduceResponse)
+	prodNotLeader.AddTopicPartition("my_topic", 0, ErrNotLeaderForPartition)
+
+	prodSuccess := new(ProduceResponse)
+	prodSuccess.AddTopicPartition("my_topic", 0, ErrNoError)
+
+	metadataLeader2 := new(MetadataResponse)
+	metadataLeader2.AddBroker(leader2.Addr(), leader2.BrokerID())
+	metadataLeader2.AddTopicPartition("my_topic", 0, leader2.BrokerID(), nil, nil, nil, ErrNoError)
+
+	leader1.Returns(prodNotLeader)
+	leader1.Returns(metadataLeader2)
+	leader2.Returns(prodNotLeader)
+	leader2.Returns(metadataLeader1)
+	leader1.Returns(prodNotLeader)
+	leader1.Returns(metadataLeader1)
+	leader1.Returns(prodNotLeader)
+	leader1.Returns(metadataLeader2)
+	leader2.Returns(prodSuccess)
+
+	expectResults(t, producer, 1, 0)
+
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Key: nil, Value: StringEncoder(TestMessage)}
+	leader2.Returns(prodSuccess)
+	expectResults(t, producer, 1, 0)
+
+	seedBroker.Close()
+	leader1.Close()
+	leader2.Close()
+	closeProducer(t, producer)
+
+	for i := 0; i < config.Producer.Retry.Max; i++ {
+		if atomic.LoadInt32(&backoffCalled[i]) != 1 {
+			t.Errorf("expected one retry attempt #%d", i)
+		}
+	}
+	if atomic.LoadInt32(&backoffCalled[config.Producer.Retry.Max]) != 0 {
+		t.Errorf("expected no retry attempt #%d", config.Producer.Retry.Max)
+	}
+}
+
+// https://github.com/IBM/sarama/issues/2129
 func TestAsyncProducerMultipleRetriesWithConcurrentRequests(t *testing.T) {
 	// Logger = log.New(os.Stdout, "[sarama] ", log.LstdFlags)
 	seedBroker := NewMockBroker(t, 1)
@@ -1735,6 +2285,539 @@ func TestAsyncProducerInterceptors(t *testing.T) {
 	}
 }
 
+type traceIDKey struct{}
+
+// traceInterceptor injects the trace ID carried by the context of the
+// messages in their headers.
+type traceInterceptor struct{}
+
+func (traceInterceptor) OnSend(msg *ProducerMessage) {
+	if msg.Context == nil {
+		return
+	}
+	if traceID, ok := msg.Context.Value(traceIDKey{}).(string); ok {
+		msg.Headers = append(msg.Headers, RecordHeader{Key: []byte("trace-id"), Value: []byte(traceID)})
+	}
+}
+
+func TestAsyncProducerInterceptorContext(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("my_topic", 0, broker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t),
+	})
+
+	config := NewTestConfig()
+	config.Version = V0_11_0_0
+	config.Producer.Return.Successes = true
+	config.Producer.Interceptors = []ProducerInterceptor{traceInterceptor{}}
+	producer, err := NewSyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, producer)
+
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "4bf92f3577b34da6")
+	msg := &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage), Context: ctx}
+	if _, _, err := producer.SendMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Headers) != 1 || string(msg.Headers[0].Value) != "4bf92f3577b34da6" {
+		t.Errorf("expected the interceptor to inject the trace ID of the context, got %v", msg.Headers)
+	}
+	if msg.Context != ctx {
+		t.Error("expected the context to be kept on the delivered message")
+	}
+
+	// messages without context are left alone
+	msg = &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
+	if _, _, err := producer.SendMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Headers) != 0 {
+		t.Errorf("expected no headers, got %v", msg.Headers)
+	}
+}
+
+func TestAsyncProducerTopicPriorities(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("bulk", 0, broker.BrokerID()).
+			SetLeader("urgent", 0, broker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t),
+	})
+	// the slow responses keep the only in-flight request busy, so that the
+	// bulk messages queue up behind it
+	broker.SetLatency(300 * time.Millisecond)
+
+	config := NewTestConfig()
+	config.Net.MaxOpenRequests = 1
+	config.Producer.Flush.Messages = 1
+	config.Producer.Return.Successes = true
+	config.Producer.TopicPriorities = map[string]int{"urgent": 1}
+	producer, err := NewAsyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first bulk message is in flight and the second waits for the
+	// response to be sent, while the next ones are buffered
+	for i := 0; i < 4; i++ {
+		producer.Input() <- &ProducerMessage{Topic: "bulk", Value: StringEncoder(TestMessage)}
+		time.Sleep(20 * time.Millisecond)
+	}
+	producer.Input() <- &ProducerMessage{Topic: "urgent", Value: StringEncoder(TestMessage)}
+	expectResults(t, producer, 5, 0)
+	closeProducer(t, producer)
+
+	var requests [][]string
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*ProduceRequest); ok {
+			var topics []string
+			for topic := range req.records {
+				topics = append(topics, topic)
+			}
+			requests = append(requests, topics)
+		}
+	}
+	expected := [][]string{{"bulk"}, {"bulk"}, {"urgent"}, {"bulk"}}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected the urgent message to be sent before the queued bulk ones, got %v", requests)
+	}
+}
+
+func TestAsyncProducerTopicFlush(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("bulk", 0, broker.BrokerID()).
+			SetLeader("urgent", 0, broker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t),
+	})
+
+	// the bulk messages linger while the urgent ones are sent right away
+	clock := newFakeClock()
+	config := NewTestConfig()
+	config.clock = clock
+	config.Metadata.RefreshFrequency = 0
+	config.Producer.Flush.Frequency = time.Hour
+	config.Producer.Flush.Messages = 100
+	config.Producer.Return.Successes = true
+	config.Producer.TopicFlush = map[string]FlushConfig{"urgent": {}}
+	producer, err := NewAsyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer.Input() <- &ProducerMessage{Topic: "bulk", Value: StringEncoder(TestMessage)}
+	clock.BlockUntil(t, 1)
+	for i := 0; i < 2; i++ {
+		producer.Input() <- &ProducerMessage{Topic: "urgent", Value: StringEncoder(TestMessage)}
+		select {
+		case msg := <-producer.Successes():
+			if msg.Topic != "urgent" {
+				t.Fatalf("expected only the urgent messages to be flushed, got %s", msg.Topic)
+			}
+		case err := <-producer.Errors():
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the urgent message to be flushed right away")
+		}
+	}
+
+	clock.Advance(time.Hour)
+	select {
+	case msg := <-producer.Successes():
+		if msg.Topic != "bulk" {
+			t.Errorf("expected the bulk message to be flushed, got %s", msg.Topic)
+		}
+	case err := <-producer.Errors():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the bulk message to be flushed once Frequency elapsed")
+	}
+	closeProducer(t, producer)
+
+	var topics []string
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*ProduceRequest); ok {
+			for topic := range req.records {
+				topics = append(topics, topic)
+			}
+		}
+	}
+	if !reflect.DeepEqual(topics, []string{"urgent", "urgent", "bulk"}) {
+		t.Errorf("expected the topics to be flushed apart, got %v", topics)
+	}
+}
+
+func TestAsyncProducerReconfigure(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("my_topic", 0, broker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t),
+	})
+
+	config := NewTestConfig()
+	config.Version = V0_11_0_0
+	config.Producer.Flush.Messages = 2
+	config.Producer.Flush.Frequency = time.Hour
+	config.Producer.Return.Successes = true
+	config.Producer.TopicPriorities = map[string]int{"other_topic": 1}
+	producer, err := NewAsyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := producer.Reconfigure(func(conf *Config) { conf.Producer.Idempotent = true }); err == nil {
+		t.Error("expected Producer.Idempotent not to be reconfigured")
+	}
+	// fn is handed a copy of the maps of the configuration, which cannot
+	// change at runtime
+	if err := producer.Reconfigure(func(conf *Config) { conf.Producer.TopicPriorities["my_topic"] = 2 }); err == nil {
+		t.Error("expected Producer.TopicPriorities not to be reconfigured")
+	}
+	if !reflect.DeepEqual(config.Producer.TopicPriorities, map[string]int{"other_topic": 1}) {
+		t.Errorf("expected Producer.TopicPriorities not to be changed, got %v", config.Producer.TopicPriorities)
+	}
+	if err := producer.Reconfigure(func(conf *Config) { conf.Producer.TopicFlush["my_topic"] = FlushConfig{Messages: 1} }); err == nil {
+		t.Error("expected Producer.TopicFlush not to be reconfigured")
+	}
+	if err := producer.Reconfigure(func(conf *Config) { conf.Producer.Compression = CompressionZSTD }); err == nil {
+		t.Error("expected an invalid configuration to be rejected")
+	}
+
+	// the message batched before the change is sent as it was
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
+	time.Sleep(50 * time.Millisecond)
+	if err := producer.Reconfigure(func(conf *Config) { conf.Producer.Compression = CompressionGZIP }); err != nil {
+		t.Fatal(err)
+	}
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
+	expectResults(t, producer, 2, 0)
+	for i := 0; i < 2; i++ {
+		producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
+	}
+	expectResults(t, producer, 2, 0)
+	closeProducer(t, producer)
+
+	var codecs []CompressionCodec
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*ProduceRequest); ok {
+			codecs = append(codecs, req.records["my_topic"][0].RecordBatch.Codec)
+		}
+	}
+	if !reflect.DeepEqual(codecs, []CompressionCodec{CompressionNone, CompressionGZIP}) {
+		t.Errorf("expected the compression to change from the second batch, got %v", codecs)
+	}
+}
+
+func TestAsyncProducerPartitionFunc(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("my_topic", 0, broker.BrokerID()).
+			SetLeader("my_topic", 1, broker.BrokerID()).
+			SetLeader("my_topic", 2, broker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t),
+	})
+
+	config := NewTestConfig()
+	config.Producer.Partitioner = NewManualPartitioner
+	config.Producer.Return.Successes = true
+	producer, err := NewAsyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeProducer(t, producer)
+
+	// the function takes precedence over the Partition field
+	var numPartitions int32
+	producer.Input() <- &ProducerMessage{
+		Topic:     "my_topic",
+		Value:     StringEncoder(TestMessage),
+		Partition: 0,
+		PartitionFunc: func(n int32) int32 {
+			numPartitions = n
+			return 2
+		},
+	}
+	select {
+	case msg := <-producer.Successes():
+		if msg.Partition != 2 {
+			t.Errorf("expected the message to be sent to partition 2, got %d", msg.Partition)
+		}
+		if numPartitions != 3 {
+			t.Errorf("expected the function to be called with 3 partitions, got %d", numPartitions)
+		}
+	case err := <-producer.Errors():
+		t.Fatal(err)
+	}
+
+	producer.Input() <- &ProducerMessage{
+		Topic:         "my_topic",
+		Value:         StringEncoder(TestMessage),
+		PartitionFunc: func(n int32) int32 { return n },
+	}
+	select {
+	case msg := <-producer.Successes():
+		t.Errorf("expected an out of range partition to fail, got partition %d", msg.Partition)
+	case err := <-producer.Errors():
+		if !errors.Is(err, ErrInvalidPartition) {
+			t.Errorf("expected %v, got %v", ErrInvalidPartition, err)
+		}
+	}
+}
+
+func TestAsyncProducerBrokerMaxProduceVersion(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t).SetApiKeys([]ApiVersionsResponseKey{
+			{ApiKey: 0, MinVersion: 0, MaxVersion: 2},
+			{ApiKey: 3, MinVersion: 0, MaxVersion: 9},
+		}),
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("my_topic", 0, broker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_4_0_0
+	config.Producer.Return.Successes = true
+	producer, err := NewSyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, producer)
+
+	if _, _, err := producer.SendMessage(&ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}); err != nil {
+		t.Fatal(err)
+	}
+
+	produced := false
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*ProduceRequest); ok {
+			produced = true
+			if req.Version != 2 {
+				t.Errorf("expected the produce request to be downgraded to v2, got v%d", req.Version)
+			}
+			if records := req.records["my_topic"][0]; records.recordsType != legacyRecords || records.MsgSet.Messages[0].Msg.Version != 1 {
+				t.Errorf("expected a v1 message set, got %+v", records)
+			}
+		}
+	}
+	if !produced {
+		t.Error("expected a produce request")
+	}
+}
+
+func TestAsyncProducerBrokerMaxProduceVersionRequiresRecordBatches(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		idempotent bool
+		headers    []RecordHeader
+	}{
+		{name: "headers", headers: []RecordHeader{{Key: []byte("k"), Value: []byte("v")}}},
+		{name: "idempotent", idempotent: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			broker := NewMockBroker(t, 1)
+			defer broker.Close()
+			broker.SetHandlerByMap(map[string]MockResponse{
+				"ApiVersionsRequest": NewMockApiVersionsResponse(t).SetApiKeys([]ApiVersionsResponseKey{
+					{ApiKey: 0, MinVersion: 0, MaxVersion: 2},
+					{ApiKey: 3, MinVersion: 0, MaxVersion: 9},
+					{ApiKey: 22, MinVersion: 0, MaxVersion: 1},
+				}),
+				"MetadataRequest": NewMockMetadataResponse(t).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetLeader("my_topic", 0, broker.BrokerID()),
+				"InitProducerIDRequest": NewMockInitProducerIDResponse(t).SetProducerID(1000),
+				"ProduceRequest":        NewMockProduceResponse(t),
+			})
+
+			config := NewTestConfig()
+			config.Version = V2_4_0_0
+			config.Producer.Return.Successes = true
+			if test.idempotent {
+				config.Producer.Idempotent = true
+				config.Producer.RequiredAcks = WaitForAll
+				config.Net.MaxOpenRequests = 1
+			}
+			producer, err := NewSyncProducer([]string{broker.Addr()}, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer safeClose(t, producer)
+
+			_, _, err = producer.SendMessage(&ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage), Headers: test.headers})
+			if !errors.Is(err, ErrUnsupportedVersion) {
+				t.Errorf("expected the message to fail with %v rather than losing its record batch fields, got %v", ErrUnsupportedVersion, err)
+			}
+			for _, rr := range broker.History() {
+				if _, ok := rr.Request.(*ProduceRequest); ok {
+					t.Error("expected no produce request")
+				}
+			}
+		})
+	}
+}
+
+func TestAsyncProducerStrictOrdering(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetLatency(50 * time.Millisecond)
+
+	// the first produce request fails, the others are written in order
+	var lock sync.Mutex
+	var written []string
+	failed := false
+	broker.setHandler(func(req *request) (res encoderWithHeader) {
+		switch body := req.body.(type) {
+		case *MetadataRequest:
+			metadata := &MetadataResponse{Version: body.Version}
+			metadata.AddBroker(broker.Addr(), broker.BrokerID())
+			metadata.AddTopicPartition("my_topic", 0, broker.BrokerID(), nil, nil, nil, ErrNoError)
+			return metadata
+		case *ProduceRequest:
+			lock.Lock()
+			defer lock.Unlock()
+			res := &ProduceResponse{Version: body.version()}
+			if !failed {
+				failed = true
+				res.AddTopicPartition("my_topic", 0, ErrNotLeaderForPartition)
+				return res
+			}
+			for _, rec := range body.records["my_topic"][0].RecordBatch.Records {
+				written = append(written, string(rec.Value))
+			}
+			res.AddTopicPartition("my_topic", 0, ErrNoError)
+			return res
+		}
+		return nil
+	})
+
+	config := NewTestConfig()
+	config.Version = V0_11_0_0
+	config.Producer.Flush.MaxMessages = 1
+	config.Producer.Return.Successes = true
+	config.Producer.Retry.Backoff = 10 * time.Millisecond
+	config.Producer.StrictOrdering = true
+	producer, err := NewAsyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(strconv.Itoa(i))}
+	}
+	expectResults(t, producer, 5, 0)
+	closeProducer(t, producer)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(written, []string{"0", "1", "2", "3", "4"}) {
+		t.Errorf("expected the records to be written in order, got %v", written)
+	}
+}
+
+func TestAsyncProducerOlderBrokerMaxProduceVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		version  KafkaVersion
+		apiKeys  []ApiVersionsResponseKey
+		expected int16
+	}{
+		{
+			name:    "2.0 broker",
+			version: V3_0_0_0,
+			apiKeys: []ApiVersionsResponseKey{
+				{ApiKey: 0, MinVersion: 0, MaxVersion: 6},
+				{ApiKey: 1, MinVersion: 0, MaxVersion: 8},
+				{ApiKey: 3, MinVersion: 0, MaxVersion: 6},
+				{ApiKey: 18, MinVersion: 0, MaxVersion: 2},
+			},
+			expected: 6,
+		},
+		{
+			name:    "0.11 broker",
+			version: V2_1_0_0,
+			apiKeys: []ApiVersionsResponseKey{
+				{ApiKey: 0, MinVersion: 0, MaxVersion: 3},
+				{ApiKey: 1, MinVersion: 0, MaxVersion: 5},
+				{ApiKey: 3, MinVersion: 0, MaxVersion: 4},
+				{ApiKey: 18, MinVersion: 0, MaxVersion: 1},
+			},
+			expected: 3,
+		},
+		{
+			name:    "0.10.2 broker",
+			version: V1_0_0_0,
+			apiKeys: []ApiVersionsResponseKey{
+				{ApiKey: 0, MinVersion: 0, MaxVersion: 2},
+				{ApiKey: 1, MinVersion: 0, MaxVersion: 3},
+				{ApiKey: 3, MinVersion: 0, MaxVersion: 2},
+				{ApiKey: 18, MinVersion: 0, MaxVersion: 0},
+			},
+			expected: 2,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			broker := NewMockBroker(t, 1)
+			defer broker.Close()
+			broker.SetHandlerByMap(map[string]MockResponse{
+				"ApiVersionsRequest": NewMockApiVersionsResponse(t).SetApiKeys(tc.apiKeys),
+				"MetadataRequest": NewMockMetadataResponse(t).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetLeader("my_topic", 0, broker.BrokerID()),
+				"ProduceRequest": NewMockProduceResponse(t),
+			})
+
+			config := NewTestConfig()
+			config.Version = tc.version
+			config.Producer.Return.Successes = true
+			producer, err := NewSyncProducer([]string{broker.Addr()}, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer safeClose(t, producer)
+
+			if _, _, err := producer.SendMessage(&ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}); err != nil {
+				t.Fatal(err)
+			}
+
+			produced := false
+			for _, rr := range broker.History() {
+				if req, ok := rr.Request.(*ProduceRequest); ok {
+					produced = true
+					if req.Version != tc.expected {
+						t.Errorf("expected the produce request to be downgraded to v%d, got v%d", tc.expected, req.Version)
+					}
+				}
+			}
+			if !produced {
+				t.Error("expected a produce request")
+			}
+		})
+	}
+}
+
 func TestProducerError(t *testing.T) {
 	t.Parallel()
 	err := ProducerError{Err: ErrOutOfBrokers}
@@ -2066,6 +3149,125 @@ func TestTxnProduceBatchAddPartition(t *testing.T) {
 	require.Contains(t, addpartitionRequest.TopicPartitions["test-topic"], int32(2))
 }
 
+func TestTxnProduceBatchAddPartitionAcrossTopics(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+
+	config := NewTestConfig()
+	config.Producer.Idempotent = true
+	config.Producer.Transaction.ID = "test"
+	config.Version = V0_11_0_0
+	config.Producer.RequiredAcks = WaitForAll
+	config.Net.MaxOpenRequests = 1
+
+	config.Producer.Retry.Max = 1
+	config.Producer.Flush.Messages = 3
+	config.Producer.Flush.Frequency = 30 * time.Second
+	config.Producer.Flush.Bytes = 1 << 12
+	config.Producer.Partitioner = NewManualPartitioner
+
+	metadataLeader := new(MetadataResponse)
+	metadataLeader.Version = 4
+	metadataLeader.ControllerID = broker.brokerID
+	metadataLeader.AddBroker(broker.Addr(), broker.BrokerID())
+	metadataLeader.AddTopic("test-topic", ErrNoError)
+	metadataLeader.AddTopicPartition("test-topic", 0, broker.BrokerID(), nil, nil, nil, ErrNoError)
+	metadataLeader.AddTopicPartition("test-topic", 1, broker.BrokerID(), nil, nil, nil, ErrNoError)
+	metadataLeader.AddTopic("other-topic", ErrNoError)
+	metadataLeader.AddTopicPartition("other-topic", 0, broker.BrokerID(), nil, nil, nil, ErrNoError)
+	broker.Returns(metadataLeader)
+
+	client, err := NewClient([]string{broker.Addr()}, config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	findCoordinatorResponse := FindCoordinatorResponse{
+		Coordinator: client.Brokers()[0],
+		Err:         ErrNoError,
+		Version:     1,
+	}
+	broker.Returns(&findCoordinatorResponse)
+
+	producerIdResponse := &InitProducerIDResponse{
+		Err:           ErrNoError,
+		ProducerID:    1,
+		ProducerEpoch: 0,
+	}
+	broker.Returns(producerIdResponse)
+
+	ap, err := NewAsyncProducerFromClient(client)
+	producer := ap.(*asyncProducer)
+	require.NoError(t, err)
+	defer ap.Close()
+
+	go func() {
+		for err := range producer.Errors() {
+			require.NoError(t, err)
+		}
+	}()
+
+	broker.Returns(&AddPartitionsToTxnResponse{
+		Errors: map[string][]*PartitionError{
+			"test-topic": {
+				{
+					Partition: 0,
+					Err:       ErrNoError,
+				},
+				{
+					Partition: 1,
+					Err:       ErrNoError,
+				},
+			},
+			"other-topic": {
+				{
+					Partition: 0,
+					Err:       ErrNoError,
+				},
+			},
+		},
+	})
+
+	produceResponse := new(ProduceResponse)
+	produceResponse.Version = 3
+	produceResponse.AddTopicPartition("test-topic", 0, ErrNoError)
+	produceResponse.AddTopicPartition("test-topic", 1, ErrNoError)
+	produceResponse.AddTopicPartition("other-topic", 0, ErrNoError)
+	broker.Returns(produceResponse)
+
+	endTxnResponse := &EndTxnResponse{
+		Err: ErrNoError,
+	}
+	broker.Returns(endTxnResponse)
+
+	require.Equal(t, ProducerTxnFlagReady, producer.txnmgr.status)
+
+	err = producer.BeginTxn()
+	require.NoError(t, err)
+	require.Equal(t, ProducerTxnFlagInTransaction, producer.txnmgr.status)
+
+	producer.Input() <- &ProducerMessage{Topic: "test-topic", Partition: 0, Key: nil, Value: StringEncoder("partition-0")}
+	producer.Input() <- &ProducerMessage{Topic: "test-topic", Partition: 1, Key: nil, Value: StringEncoder("partition-1")}
+	producer.Input() <- &ProducerMessage{Topic: "other-topic", Partition: 0, Key: nil, Value: StringEncoder("partition-0")}
+
+	err = producer.CommitTxn()
+	require.NoError(t, err)
+	require.Equal(t, ProducerTxnFlagReady, producer.txnmgr.status)
+
+	var addPartitionRequests []*AddPartitionsToTxnRequest
+	for _, exchange := range broker.History() {
+		if request, ok := exchange.Request.(*AddPartitionsToTxnRequest); ok {
+			addPartitionRequests = append(addPartitionRequests, request)
+		}
+	}
+	require.Len(t, addPartitionRequests, 1)
+	require.ElementsMatch(t, []int32{0, 1}, addPartitionRequests[0].TopicPartitions["test-topic"])
+	require.ElementsMatch(t, []int32{0}, addPartitionRequests[0].TopicPartitions["other-topic"])
+
+	produceRequest := broker.History()[len(broker.History())-2].Request.(*ProduceRequest)
+	require.Equal(t, 2, len(produceRequest.records["test-topic"]))
+	require.Equal(t, 1, len(produceRequest.records["other-topic"]))
+}
+
 func TestTxnProduceRecordWithAbort(t *testing.T) {
 	broker := NewMockBroker(t, 1)
 	defer broker.Close()
@@ -19,6 +19,9 @@ const (
 	// StickyBalanceStrategyName identifies strategies that use the sticky-partition assignment strategy
 	StickyBalanceStrategyName = "sticky"
 
+	// WeightedBalanceStrategyName identifies strategies that use the weighted partition assignment strategy
+	WeightedBalanceStrategyName = "weighted"
+
 	defaultGeneration = -1
 )
 
@@ -41,7 +44,23 @@ func (p BalanceStrategyPlan) Add(memberID, topic string, partitions ...int32) {
 // --------------------------------------------------------------------
 
 // BalanceStrategy is used to balance topics and partitions
-// across members of a consumer group
+// across members of a consumer group.
+//
+// Custom strategies can exchange opaque, application-defined bytes with every
+// member through the user data of the group protocol:
+//
+//   - each member joins with the UserData of its ConsumerGroupMemberMetadata
+//     set to Consumer.Group.Member.UserData, or to the bytes AssignmentData
+//     returned for it in the previous generation if those were non-nil;
+//   - the leader passes every member's UserData, unmodified, to Plan;
+//   - the bytes returned by AssignmentData are sent to that member alongside
+//     its partitions, and it rejoins with them on the next rebalance.
+//
+// The encoding of the bytes is entirely up to the strategy, but as members
+// of a group may run different application versions it should be
+// versioned. A strategy that only consumes static per-member data (such as
+// processing capacity) should return nil from AssignmentData so that members
+// keep advertising their configured Consumer.Group.Member.UserData.
 type BalanceStrategy interface {
 	// Name uniquely identifies the strategy.
 	Name() string
@@ -51,10 +70,80 @@ type BalanceStrategy interface {
 	Plan(members map[string]ConsumerGroupMemberMetadata, topics map[string][]int32) (BalanceStrategyPlan, error)
 
 	// AssignmentData returns the serialized assignment data for the specified
-	// memberID
+	// memberID, which becomes its UserData on the next rebalance
 	AssignmentData(memberID string, topics map[string][]int32, generationID int32) ([]byte, error)
 }
 
+// PlanAssignment returns the plan strategy produces for members over the
+// topic/partition layout topics, the way the leader of a consumer group does
+// but without joining one, to try out strategies in tests and planning tools.
+//
+// As the leader, it plans the topics the members subscribe to, every one of
+// which must be in topics. The plan is then checked to assign every
+// partition of those topics exactly once, to a member subscribing to its
+// topic, or ErrInvalidBalanceStrategyPlan is returned with the plan.
+func PlanAssignment(strategy BalanceStrategy, members map[string]ConsumerGroupMemberMetadata, topics map[string][]int32) (BalanceStrategyPlan, error) {
+	subscribed := make(map[string][]int32)
+	for memberID, meta := range members {
+		for _, topic := range meta.Topics {
+			partitions, ok := topics[topic]
+			if !ok {
+				return nil, fmt.Errorf("topic %s subscribed by member %s: %w", topic, memberID, ErrUnknownTopicOrPartition)
+			}
+			subscribed[topic] = partitions
+		}
+	}
+
+	plan, err := strategy.Plan(members, subscribed)
+	if err != nil {
+		return nil, err
+	}
+	return plan, validatePlan(plan, members, subscribed)
+}
+
+func validatePlan(plan BalanceStrategyPlan, members map[string]ConsumerGroupMemberMetadata, topics map[string][]int32) error {
+	owners := make(map[topicAndPartition]string)
+	for topic, partitions := range topics {
+		for _, partition := range partitions {
+			owners[topicAndPartition{topic, partition}] = ""
+		}
+	}
+
+	for memberID, assignment := range plan {
+		meta, ok := members[memberID]
+		if !ok {
+			return fmt.Errorf("%w: partitions assigned to unknown member %s", ErrInvalidBalanceStrategyPlan, memberID)
+		}
+		for topic, partitions := range assignment {
+			subscribed := false
+			for _, t := range meta.Topics {
+				subscribed = subscribed || t == topic
+			}
+			if !subscribed {
+				return fmt.Errorf("%w: topic %s assigned to member %s which does not subscribe to it", ErrInvalidBalanceStrategyPlan, topic, memberID)
+			}
+			for _, partition := range partitions {
+				tp := topicAndPartition{topic, partition}
+				owner, ok := owners[tp]
+				switch {
+				case !ok:
+					return fmt.Errorf("%w: unknown partition %s/%d assigned to member %s", ErrInvalidBalanceStrategyPlan, topic, partition, memberID)
+				case owner != "":
+					return fmt.Errorf("%w: partition %s/%d assigned to both members %s and %s", ErrInvalidBalanceStrategyPlan, topic, partition, owner, memberID)
+				}
+				owners[tp] = memberID
+			}
+		}
+	}
+
+	for tp, owner := range owners {
+		if owner == "" {
+			return fmt.Errorf("%w: partition %s/%d not assigned", ErrInvalidBalanceStrategyPlan, tp.topic, tp.partition)
+		}
+	}
+	return nil
+}
+
 // --------------------------------------------------------------------
 
 // NewBalanceStrategyRange returns a range balance strategy,
@@ -104,6 +193,11 @@ var BalanceStrategyRange = NewBalanceStrategyRange()
 //	M1: {T: [0, 2]}
 //	M2: {T: [1, 3]}
 //	M3: {T: [4, 5]}
+//
+// The previous assignment of each member is taken from the user data returned
+// by AssignmentData or, when that is absent, from the OwnedPartitions in its
+// ConsumerGroupMemberMetadata. When members leave, only the partitions they
+// owned are moved, without requiring a cooperative rebalance.
 func NewBalanceStrategySticky() BalanceStrategy {
 	return &stickyBalanceStrategy{}
 }
@@ -416,6 +510,112 @@ func (b *roundRobinBalancer) AssignmentData(memberID string, topics map[string][
 	return nil, nil // do nothing for now
 }
 
+// NewBalanceStrategyWeighted returns a weighted balance strategy, which
+// balances the total weight of the partitions assigned to members rather
+// than their number, weight giving the weight of every partition, e.g. its
+// throughput. Only the group leader calls weight, but every member must use
+// the strategy for the group to select it.
+//
+// Partitions are assigned from the heaviest, each to the subscribed member
+// with the lowest total weight so far. Negative weights count as 0.
+// Example with topic T with four partitions of weights 6, 1, 1 and 4 and two
+// members (M1, M2):
+//
+//	M1: {T: [0]}
+//	M2: {T: [1, 2, 3]}
+func NewBalanceStrategyWeighted(weight func(topic string, partition int32) int64) BalanceStrategy {
+	return &weightedBalancer{weight: weight}
+}
+
+type weightedBalancer struct {
+	weight func(topic string, partition int32) int64
+}
+
+func (b *weightedBalancer) Name() string {
+	return WeightedBalanceStrategyName
+}
+
+func (b *weightedBalancer) Plan(memberAndMetadata map[string]ConsumerGroupMemberMetadata, topics map[string][]int32) (BalanceStrategyPlan, error) {
+	if len(memberAndMetadata) == 0 || len(topics) == 0 {
+		return nil, errors.New("members and topics are not provided")
+	}
+
+	// sort partitions from the heaviest
+	type weightedPartition struct {
+		topicAndPartition
+		weight int64
+	}
+	var partitions []weightedPartition
+	for topic, ps := range topics {
+		for _, partition := range ps {
+			weight := b.weight(topic, partition)
+			if weight < 0 {
+				weight = 0
+			}
+			partitions = append(partitions, weightedPartition{topicAndPartition{topic: topic, partition: partition}, weight})
+		}
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		pi, pj := partitions[i], partitions[j]
+		if pi.weight != pj.weight {
+			return pi.weight > pj.weight
+		}
+		if pi.topic != pj.topic {
+			return pi.topic < pj.topic
+		}
+		return pi.partition < pj.partition
+	})
+
+	// sort members
+	members := make([]memberAndTopic, 0, len(memberAndMetadata))
+	for memberID, meta := range memberAndMetadata {
+		m := memberAndTopic{
+			memberID: memberID,
+			topics:   make(map[string]struct{}),
+		}
+		for _, t := range meta.Topics {
+			m.topics[t] = struct{}{}
+		}
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].memberID < members[j].memberID
+	})
+
+	// assign every partition to the least loaded subscribed member, by
+	// weight then by number of partitions
+	plan := make(BalanceStrategyPlan, len(members))
+	weights := make([]int64, len(members))
+	counts := make([]int, len(members))
+	for _, p := range partitions {
+		best := -1
+		for i, m := range members {
+			if !m.hasTopic(p.topic) {
+				continue
+			}
+			if best < 0 || weights[i] < weights[best] || (weights[i] == weights[best] && counts[i] < counts[best]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		plan.Add(members[best].memberID, p.topic, p.partition)
+		weights[best] += p.weight
+		counts[best]++
+	}
+	for _, assignment := range plan {
+		for _, partitions := range assignment {
+			sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+		}
+	}
+	return plan, nil
+}
+
+func (b *weightedBalancer) AssignmentData(memberID string, topics map[string][]int32, generationID int32) ([]byte, error) {
+	return nil, nil
+}
+
 type topicAndPartition struct {
 	topic     string
 	partition int32
@@ -631,6 +831,26 @@ func deserializeTopicPartitionAssignment(userDataBytes []byte) (StickyAssignorUs
 	return userDataV1, nil
 }
 
+// memberPreviousAssignment returns the partitions a member owned before the
+// current rebalance. The sticky assignor's own user data takes precedence;
+// members that do not carry it (e.g. non-sarama clients) are assumed to report
+// their assignment via the OwnedPartitions of their subscription instead, with
+// its GenerationID from v2 onwards.
+func memberPreviousAssignment(meta ConsumerGroupMemberMetadata) (StickyAssignorUserData, error) {
+	if len(meta.UserData) > 0 || len(meta.OwnedPartitions) == 0 {
+		return deserializeTopicPartitionAssignment(meta.UserData)
+	}
+
+	topics := make(map[string][]int32, len(meta.OwnedPartitions))
+	for _, owned := range meta.OwnedPartitions {
+		topics[owned.Topic] = append(topics[owned.Topic], owned.Partitions...)
+	}
+	if meta.Version < 2 {
+		return &StickyAssignorUserDataV0{Topics: topics, topicPartitions: populateTopicPartitions(topics)}, nil
+	}
+	return &StickyAssignorUserDataV1{Topics: topics, Generation: meta.GenerationID, topicPartitions: populateTopicPartitions(topics)}, nil
+}
+
 // filterAssignedPartitions returns a map of consumer group members to their list of previously-assigned topic partitions, limited
 // to those topic partitions currently reported by the Kafka cluster.
 func filterAssignedPartitions(currentAssignment map[string][]topicPartitionAssignment, partition2AllPotentialConsumers map[topicPartitionAssignment][]string) map[string][]topicPartitionAssignment {
@@ -839,7 +1059,7 @@ func prepopulateCurrentAssignments(members map[string]ConsumerGroupMemberMetadat
 	// for each partition we create a sorted map of its consumers by generation
 	sortedPartitionConsumersByGeneration := make(map[topicPartitionAssignment]map[int]string)
 	for memberID, meta := range members {
-		consumerUserData, err := deserializeTopicPartitionAssignment(meta.UserData)
+		consumerUserData, err := memberPreviousAssignment(meta)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -2,6 +2,8 @@ package sarama
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
@@ -1632,6 +1634,50 @@ func Test_stickyBalanceStrategy_Plan_ReassignmentAfterOneConsumerLeaves(t *testi
 	verifyPlanIsBalancedAndSticky(t, s, members, plan2, err)
 }
 
+func Test_stickyBalanceStrategy_Plan_ScaleDownWithOwnedPartitions(t *testing.T) {
+	s := &stickyBalanceStrategy{}
+
+	partitions := make([]int32, 12)
+	for i := range partitions {
+		partitions[i] = int32(i)
+	}
+	topics := map[string][]int32{"topic1": partitions}
+
+	members := make(map[string]ConsumerGroupMemberMetadata, 4)
+	for i := 0; i < 4; i++ {
+		members[fmt.Sprintf("consumer%d", i)] = ConsumerGroupMemberMetadata{Topics: []string{"topic1"}}
+	}
+	plan1, err := s.Plan(members, topics)
+	verifyPlanIsBalancedAndSticky(t, s, members, plan1, err)
+
+	// the remaining members report their assignment only via OwnedPartitions,
+	// as clients using the v1+ subscription schema do
+	delete(members, "consumer3")
+	for memberID := range members {
+		members[memberID] = ConsumerGroupMemberMetadata{
+			Version:         2,
+			Topics:          []string{"topic1"},
+			OwnedPartitions: []*OwnedPartition{{Topic: "topic1", Partitions: plan1[memberID]["topic1"]}},
+			GenerationID:    1,
+		}
+	}
+	plan2, err := s.Plan(members, topics)
+	verifyPlanIsBalancedAndSticky(t, s, members, plan2, err)
+
+	// only the partitions of the departed member may move
+	for memberID := range members {
+		kept := make(map[int32]bool)
+		for _, partition := range plan2[memberID]["topic1"] {
+			kept[partition] = true
+		}
+		for _, partition := range plan1[memberID]["topic1"] {
+			if !kept[partition] {
+				t.Errorf("partition %d moved away from %s", partition, memberID)
+			}
+		}
+	}
+}
+
 func Test_stickyBalanceStrategy_Plan_ReassignmentAfterOneConsumerAdded(t *testing.T) {
 	s := &stickyBalanceStrategy{}
 
@@ -2464,3 +2510,185 @@ func Test_sortPartitionsByPotentialConsumerAssignments(t *testing.T) {
 		})
 	}
 }
+
+// capacityBalanceStrategy assigns partitions in proportion to the processing
+// capacity each member advertises as a big-endian uint32 in its user data.
+type capacityBalanceStrategy struct{}
+
+func (capacityBalanceStrategy) Name() string { return "capacity" }
+
+func (capacityBalanceStrategy) Plan(members map[string]ConsumerGroupMemberMetadata, topics map[string][]int32) (BalanceStrategyPlan, error) {
+	capacities := make(map[string]uint32, len(members))
+	for memberID, meta := range members {
+		capacities[memberID] = 1
+		if len(meta.UserData) == 4 {
+			capacities[memberID] = binary.BigEndian.Uint32(meta.UserData)
+		}
+	}
+
+	plan := make(BalanceStrategyPlan, len(members))
+	assigned := make(map[string]int, len(members))
+	for topic, partitions := range topics {
+		var memberIDs []string
+		for memberID, meta := range members {
+			if strsContains(meta.Topics, topic) && capacities[memberID] > 0 {
+				memberIDs = append(memberIDs, memberID)
+			}
+		}
+		sort.Strings(memberIDs)
+		if len(memberIDs) == 0 {
+			continue
+		}
+
+		// give each partition to the member with the lowest load relative to its capacity
+		for _, partition := range partitions {
+			best := memberIDs[0]
+			for _, memberID := range memberIDs[1:] {
+				if uint64(assigned[memberID])*uint64(capacities[best]) < uint64(assigned[best])*uint64(capacities[memberID]) {
+					best = memberID
+				}
+			}
+			plan.Add(best, topic, partition)
+			assigned[best]++
+		}
+	}
+	return plan, nil
+}
+
+// AssignmentData returns nil so that members keep sending their configured
+// Consumer.Group.Member.UserData on every rebalance.
+func (capacityBalanceStrategy) AssignmentData(memberID string, topics map[string][]int32, generationID int32) ([]byte, error) {
+	return nil, nil
+}
+
+// This example shows a custom BalanceStrategy that is driven by per-member
+// user data: every member advertises its capacity when joining the group and
+// the group leader assigns partitions accordingly.
+func ExampleBalanceStrategy_capacity() {
+	capacity := func(n uint32) []byte {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, n)
+		return data
+	}
+
+	// each consumer advertises its own capacity
+	config := NewConfig()
+	config.Consumer.Group.Member.UserData = capacity(2)
+	config.Consumer.Group.Rebalance.GroupStrategies = []BalanceStrategy{capacityBalanceStrategy{}}
+
+	// which the leader receives as the UserData of every member
+	members := map[string]ConsumerGroupMemberMetadata{
+		"small": {Topics: []string{"events"}, UserData: capacity(1)},
+		"large": {Topics: []string{"events"}, UserData: config.Consumer.Group.Member.UserData},
+	}
+	plan, err := capacityBalanceStrategy{}.Plan(members, map[string][]int32{"events": {0, 1, 2, 3, 4, 5}})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("large:", plan["large"]["events"])
+	fmt.Println("small:", plan["small"]["events"])
+	// Output:
+	// large: [0 2 3 5]
+	// small: [1 4]
+}
+
+// fixedBalanceStrategy plans the same assignment whatever the members.
+type fixedBalanceStrategy BalanceStrategyPlan
+
+func (s fixedBalanceStrategy) Name() string { return "fixed" }
+
+func (s fixedBalanceStrategy) Plan(members map[string]ConsumerGroupMemberMetadata, topics map[string][]int32) (BalanceStrategyPlan, error) {
+	return BalanceStrategyPlan(s), nil
+}
+
+func (s fixedBalanceStrategy) AssignmentData(memberID string, topics map[string][]int32, generationID int32) ([]byte, error) {
+	return nil, nil
+}
+
+func TestPlanAssignment(t *testing.T) {
+	members := map[string]ConsumerGroupMemberMetadata{
+		"m1": {Topics: []string{"t1"}},
+		"m2": {Topics: []string{"t1", "t2"}},
+	}
+	topics := map[string][]int32{"t1": {0, 1}, "t2": {0}, "unsubscribed": {0}}
+
+	plan, err := PlanAssignment(NewBalanceStrategyRoundRobin(), members, topics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan["m1"]["t1"])+len(plan["m2"]["t1"]) != 2 || len(plan["m2"]["t2"]) != 1 || plan["m1"]["unsubscribed"] != nil {
+		t.Errorf("unexpected plan %v", plan)
+	}
+
+	if _, err := PlanAssignment(NewBalanceStrategyRange(), members, map[string][]int32{"t1": {0}}); !errors.Is(err, ErrUnknownTopicOrPartition) {
+		t.Errorf("expected a missing subscribed topic to fail, got %v", err)
+	}
+
+	for name, invalid := range map[string]BalanceStrategyPlan{
+		"unknown member":     {"m1": {"t1": {0}}, "m2": {"t1": {1}, "t2": {0}}, "m3": {"t1": {}}},
+		"unsubscribed topic": {"m1": {"t1": {0}, "t2": {0}}, "m2": {"t1": {1}}},
+		"unknown partition":  {"m1": {"t1": {0, 2}}, "m2": {"t1": {1}, "t2": {0}}},
+		"assigned twice":     {"m1": {"t1": {0, 1}}, "m2": {"t1": {1}, "t2": {0}}},
+		"unassigned":         {"m1": {"t1": {0}}, "m2": {"t1": {1}}},
+	} {
+		if _, err := PlanAssignment(fixedBalanceStrategy(invalid), members, topics); !errors.Is(err, ErrInvalidBalanceStrategyPlan) {
+			t.Errorf("%s: expected ErrInvalidBalanceStrategyPlan, got %v", name, err)
+		}
+	}
+}
+
+// This example plans, without joining a group, how a strategy would assign
+// the 12 partitions of a topic to 3 members.
+func ExamplePlanAssignment() {
+	members := map[string]ConsumerGroupMemberMetadata{
+		"consumer-1": {Topics: []string{"events"}},
+		"consumer-2": {Topics: []string{"events"}},
+		"consumer-3": {Topics: []string{"events"}},
+	}
+	topics := map[string][]int32{"events": {0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}}
+
+	plan, err := PlanAssignment(NewBalanceStrategyRange(), members, topics)
+	if err != nil {
+		panic(err)
+	}
+	for _, memberID := range []string{"consumer-1", "consumer-2", "consumer-3"} {
+		fmt.Println(memberID+":", plan[memberID]["events"])
+	}
+	// Output:
+	// consumer-1: [0 1 2 3]
+	// consumer-2: [4 5 6 7]
+	// consumer-3: [8 9 10 11]
+}
+
+func TestBalanceStrategyWeighted(t *testing.T) {
+	weights := map[string][]int64{
+		"hot":  {9, 3, 3, 3},
+		"cold": {1, 1, 1, 1},
+	}
+	strategy := NewBalanceStrategyWeighted(func(topic string, partition int32) int64 {
+		return weights[topic][partition]
+	})
+	if strategy.Name() != WeightedBalanceStrategyName {
+		t.Errorf("unexpected name %s", strategy.Name())
+	}
+
+	members := map[string]ConsumerGroupMemberMetadata{
+		"m1": {Topics: []string{"hot", "cold"}},
+		"m2": {Topics: []string{"hot", "cold"}},
+		"m3": {Topics: []string{"cold"}},
+	}
+	topics := map[string][]int32{"hot": {0, 1, 2, 3}, "cold": {0, 1, 2, 3}}
+	plan, err := PlanAssignment(strategy, members, topics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := BalanceStrategyPlan{
+		"m1": {"hot": {0}},
+		"m2": {"hot": {1, 2, 3}},
+		"m3": {"cold": {0, 1, 2, 3}},
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("expected the total weight to be balanced with %v, got %v", expected, plan)
+	}
+}
@@ -0,0 +1,102 @@
+package sarama
+
+import "time"
+
+// BatchConsumerGroupHandler handles the messages of the claims of a consumer
+// group session in batches, see NewBatchConsumerGroupHandler.
+type BatchConsumerGroupHandler interface {
+	// Setup is run at the beginning of a new session, before ConsumeClaimBatch.
+	Setup(ConsumerGroupSession) error
+
+	// Cleanup is run at the end of a session, once all the batches have been
+	// handled but before the offsets are committed for the very last time.
+	Cleanup(ConsumerGroupSession) error
+
+	// ConsumeClaimBatch handles a batch of consecutive messages of the claim.
+	// It returns how many of them, from the start of the batch, were handled:
+	// the offset of the claim is marked past the last of those once it
+	// returns, so that all the offsets of a batch advance together. An error
+	// ends the consumption of the claim for the rest of the session, like an
+	// error returned by ConsumerGroupHandler.ConsumeClaim, and its unhandled
+	// messages are consumed again by the next session. Handling fewer
+	// messages than the batch without an error is treated the same, with
+	// ErrBatchNotHandled. Batches of the different claims are handled
+	// concurrently.
+	ConsumeClaimBatch(sess ConsumerGroupSession, claim ConsumerGroupClaim, messages []*ConsumerMessage) (handled int, err error)
+}
+
+// NewBatchConsumerGroupHandler returns a ConsumerGroupHandler handing the
+// messages of each claim to handler in batches of up to maxSize messages.
+// A batch is handed over once it is full, or maxWait after its first message
+// was received, whichever comes first, and when the claim ends.
+func NewBatchConsumerGroupHandler(handler BatchConsumerGroupHandler, maxSize int, maxWait time.Duration) ConsumerGroupHandler {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	return &batchHandler{handler: handler, maxSize: maxSize, maxWait: maxWait}
+}
+
+type batchHandler struct {
+	handler BatchConsumerGroupHandler
+	maxSize int
+	maxWait time.Duration
+}
+
+func (h *batchHandler) Setup(sess ConsumerGroupSession) error {
+	return h.handler.Setup(sess)
+}
+
+func (h *batchHandler) Cleanup(sess ConsumerGroupSession) error {
+	return h.handler.Cleanup(sess)
+}
+
+func (h *batchHandler) ConsumeClaim(sess ConsumerGroupSession, claim ConsumerGroupClaim) error {
+	clock := sessionClock(sess)
+	for {
+		batch, more := h.nextBatch(clock, claim)
+		if len(batch) > 0 {
+			handled, err := h.handler.ConsumeClaimBatch(sess, claim, batch)
+			if handled > len(batch) {
+				handled = len(batch)
+			}
+			if handled > 0 {
+				sess.MarkMessage(batch[handled-1], "")
+			}
+			if err != nil {
+				return err
+			}
+			if handled < len(batch) {
+				return ErrBatchNotHandled
+			}
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// nextBatch collects the next batch of messages of the claim, and reports
+// whether the claim may have more.
+func (h *batchHandler) nextBatch(clock clock, claim ConsumerGroupClaim) ([]*ConsumerMessage, bool) {
+	first, ok := <-claim.Messages()
+	if !ok {
+		return nil, false
+	}
+	batch := make([]*ConsumerMessage, 1, h.maxSize)
+	batch[0] = first
+
+	timer := clock.NewTimer(h.maxWait)
+	defer timer.Stop()
+	for len(batch) < h.maxSize {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, msg)
+		case <-timer.C():
+			return batch, true
+		}
+	}
+	return batch, true
+}
@@ -0,0 +1,152 @@
+package sarama
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingBatchHandler struct {
+	lock    sync.Mutex
+	batches [][]int64 // the offsets of each batch
+	failAt  int64     // the offset failing its batch, if > 0
+	failErr error     // the error failing the batch at failAt
+}
+
+func (h *recordingBatchHandler) Setup(ConsumerGroupSession) error   { return nil }
+func (h *recordingBatchHandler) Cleanup(ConsumerGroupSession) error { return nil }
+
+func (h *recordingBatchHandler) ConsumeClaimBatch(_ ConsumerGroupSession, _ ConsumerGroupClaim, messages []*ConsumerMessage) (int, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	offsets := make([]int64, 0, len(messages))
+	for i, msg := range messages {
+		if h.failAt > 0 && msg.Offset == h.failAt {
+			h.batches = append(h.batches, offsets)
+			return i, h.failErr
+		}
+		offsets = append(offsets, msg.Offset)
+	}
+	h.batches = append(h.batches, offsets)
+	return len(messages), nil
+}
+
+func TestBatchConsumerGroupHandlerBatchesBySize(t *testing.T) {
+	recorder := &recordingBatchHandler{}
+	claims := newFakeGroupClaims(1)
+	handler := NewBatchConsumerGroupHandler(recorder, 3, time.Hour)
+
+	sess, errs := runFakeGroupSession(t, handler, claims, func() {
+		for offset := 0; offset < 7; offset++ {
+			claims[0].send(int64(offset), "a", offset)
+		}
+	})
+
+	if errs[0] != nil {
+		t.Error(errs[0])
+	}
+	// the last batch is handed over when the claim ends
+	expected := [][]int64{{0, 1, 2}, {3, 4, 5}, {6}}
+	if !reflect.DeepEqual(recorder.batches, expected) {
+		t.Errorf("expected the batches %v, got %v", expected, recorder.batches)
+	}
+	if sess.marked[0] != 7 {
+		t.Errorf("expected the offset to be marked at 7, got %d", sess.marked[0])
+	}
+}
+
+func TestBatchConsumerGroupHandlerBatchesByTime(t *testing.T) {
+	recorder := &recordingBatchHandler{}
+	claims := newFakeGroupClaims(1)
+	handler := NewBatchConsumerGroupHandler(recorder, 100, 50*time.Millisecond)
+
+	runFakeGroupSession(t, handler, claims, func() {
+		claims[0].send(0, "a", 0)
+		claims[0].send(1, "a", 1)
+		time.Sleep(200 * time.Millisecond)
+		claims[0].send(2, "a", 2)
+		time.Sleep(200 * time.Millisecond)
+	})
+
+	expected := [][]int64{{0, 1}, {2}}
+	if !reflect.DeepEqual(recorder.batches, expected) {
+		t.Errorf("expected the batches %v, got %v", expected, recorder.batches)
+	}
+}
+
+func TestBatchConsumerGroupHandlerMaxWaitFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	recorder := &recordingBatchHandler{}
+	claims := newFakeGroupClaims(1)
+	handler := NewBatchConsumerGroupHandler(recorder, 100, time.Hour)
+
+	sess := &fakeGroupSession{clock: clock}
+	consumed := make(chan error)
+	go func() { consumed <- handler.ConsumeClaim(sess, claims[0]) }()
+
+	claims[0].send(0, "a", 0)
+	claims[0].send(1, "a", 1)
+	clock.BlockUntil(t, 1)
+	time.Sleep(20 * time.Millisecond)
+	clock.Advance(time.Hour)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		recorder.lock.Lock()
+		batches := len(recorder.batches)
+		recorder.lock.Unlock()
+		if batches > 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected the batch to be handled once maxWait elapsed")
+		}
+	}
+
+	close(claims[0].messages)
+	if err := <-consumed; err != nil {
+		t.Error(err)
+	}
+	expected := [][]int64{{0, 1}}
+	if !reflect.DeepEqual(recorder.batches, expected) {
+		t.Errorf("expected the batches %v, got %v", expected, recorder.batches)
+	}
+}
+
+func TestBatchConsumerGroupHandlerPartialFailure(t *testing.T) {
+	errSink := errors.New("sink failed")
+	for _, tc := range []struct {
+		name        string
+		err         error
+		expectedErr error
+	}{
+		{"error", errSink, errSink},
+		// a short count without an error still ends the claim
+		{"short count", nil, ErrBatchNotHandled},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := &recordingBatchHandler{failAt: 4, failErr: tc.err}
+			claims := newFakeGroupClaims(1)
+			handler := NewBatchConsumerGroupHandler(recorder, 3, time.Hour)
+
+			sess, errs := runFakeGroupSession(t, handler, claims, func() {
+				for offset := 0; offset < 6; offset++ {
+					claims[0].send(int64(offset), "a", offset)
+				}
+			})
+
+			if !errors.Is(errs[0], tc.expectedErr) {
+				t.Errorf("expected the batch to end the claim with %v, got %v", tc.expectedErr, errs[0])
+			}
+			expected := [][]int64{{0, 1, 2}, {3}}
+			if !reflect.DeepEqual(recorder.batches, expected) {
+				t.Errorf("expected the batches %v, got %v", expected, recorder.batches)
+			}
+			// the offset advances past the handled messages of the failed batch only
+			if sess.marked[0] != 4 {
+				t.Errorf("expected the offset to be marked at 4, got %d", sess.marked[0])
+			}
+		})
+	}
+}
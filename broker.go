@@ -1,6 +1,7 @@
 package sarama
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
@@ -20,9 +21,19 @@ import (
 
 // Broker represents a single Kafka broker connection. All operations on this object are entirely concurrency-safe.
 type Broker struct {
+	// inFlight counts the requests awaiting a response on this connection.
+	// Note: this accessed atomically so must be the first word in the struct
+	// as per golang/go#41970
+	inFlight int64
+
 	conf *Config
 	rack *string
 
+	// pending counts the requests which were sent or are waiting to be, which
+	// must not exceed pendingLimit unless it is 0 (both accessed atomically)
+	pending      int32
+	pendingLimit int32
+
 	id            int32
 	addr          string
 	correlationID int32
@@ -44,6 +55,10 @@ type Broker struct {
 	responseSize               metrics.Histogram
 	requestsInFlight           metrics.Counter
 	protocolRequestsRate       map[int16]metrics.Meter
+	saslReauthTotal            metrics.Counter
+	saslReauthFailed           metrics.Counter
+	saslTokenRefreshTotal      metrics.Counter
+	saslTokenRefreshFailed     metrics.Counter
 	brokerIncomingByteRate     metrics.Meter
 	brokerRequestRate          metrics.Meter
 	brokerFetchRate            metrics.Meter
@@ -56,12 +71,39 @@ type Broker struct {
 	brokerThrottleTime         metrics.Histogram
 	brokerProtocolRequestsRate map[int16]metrics.Meter
 
+	connectedAt time.Time // when the current connection was established
+
 	kerberosAuthenticator               GSSAPIKerberosAuth
+	authCtx                             context.Context // cancels the GSSAPI authentication, set by the owning client
 	clientSessionReauthenticationTimeMs int64
 
-	throttleTimer *time.Timer
+	throttleTimer clockTimer
+
+	circuit circuitBreaker
+
+	// responders are the Net.Interceptors which may answer requests
+	// themselves, see requestResponder
+	responders []requestResponder
+
+	apiVersionsLock sync.Mutex
+	apiVersions     map[int16]int16 // the highest version of each API key advertised by the broker
 }
 
+// InFlightOverflowPolicy decides what happens to requests sent to a Broker which
+// already has Net.MaxOpenRequests outstanding requests.
+type InFlightOverflowPolicy int
+
+const (
+	// InFlightBlock makes requests wait until an outstanding request completes.
+	InFlightBlock InFlightOverflowPolicy = iota
+	// InFlightFailFast fails requests with ErrTooManyInFlight.
+	InFlightFailFast
+	// InFlightQueue makes up to Net.InFlightQueueSize requests wait until an
+	// outstanding request completes, and fails any further ones with
+	// ErrTooManyInFlight.
+	InFlightQueue
+)
+
 // SASLMechanism specifies the SASL mechanism the client uses to authenticate with the broker
 type SASLMechanism string
 
@@ -127,8 +169,14 @@ type SCRAMClient interface {
 
 type responsePromise struct {
 	requestTime   time.Time
+	apiKey        int16
+	apiVersion    int16
+	readTimeout   time.Duration
 	correlationID int32
 	headerVersion int16
+	delay         time.Duration // added by an interceptor, see requestResponder
+	response      []byte        // set when answered by an interceptor, see requestResponder
+	responseErr   error         // set when failed by an interceptor, see requestResponder
 	handler       func([]byte, error)
 	packets       chan []byte
 	errors        chan error
@@ -175,13 +223,30 @@ func (b *Broker) Open(conf *Config) error {
 
 	usingApiVersionsRequests := conf.Version.IsAtLeast(V2_4_0_0) && conf.ApiVersionsRequest
 
+	pendingLimit := 0
+	switch conf.Net.InFlightOverflowPolicy {
+	case InFlightFailFast:
+		pendingLimit = conf.Net.MaxOpenRequests
+	case InFlightQueue:
+		pendingLimit = conf.Net.MaxOpenRequests + conf.Net.InFlightQueueSize
+	}
+	atomic.StoreInt32(&b.pendingLimit, int32(pendingLimit))
+
+	var onCircuitChange func(CircuitState)
+	if onStateChange := conf.Net.CircuitBreaker.OnStateChange; onStateChange != nil {
+		onCircuitChange = func(state CircuitState) {
+			onStateChange(b.ID(), b.addr, state)
+		}
+	}
+	b.circuit.configure(conf, onCircuitChange)
+
 	b.lock.Lock()
 
 	if b.metricRegistry == nil {
 		b.metricRegistry = newCleanupRegistry(conf.MetricRegistry)
 	}
 
-	go withRecover(func() {
+	goWithRecover(conf.MetricRegistry, func() {
 		defer func() {
 			b.lock.Unlock()
 
@@ -189,30 +254,27 @@ func (b *Broker) Open(conf *Config) error {
 			// Ideally Sarama would use the response to control protocol versions,
 			// but for now just fire-and-forget just to send
 			if usingApiVersionsRequests {
-				_, err = b.ApiVersions(&ApiVersionsRequest{
-					Version:               3,
-					ClientSoftwareName:    defaultClientSoftwareName,
-					ClientSoftwareVersion: version(),
-				})
-				if err != nil {
-					Logger.Printf("Error while sending ApiVersionsRequest to broker %s: %s\n", b.addr, err)
-				}
+				b.probeApiVersions(conf)
 			}
 		}()
-		dialer := conf.getDialer()
-		b.conn, b.connErr = dialer.Dial("tcp", b.addr)
+		if b.connErr = b.circuit.allow(); b.connErr != nil {
+			atomic.StoreInt32(&b.opened, 0)
+			return
+		}
+		b.conn, b.connErr = b.dial(conf)
 		if b.connErr != nil {
 			Logger.Printf("Failed to connect to broker %s: %s\n", b.addr, b.connErr)
-			b.conn = nil
+			b.circuit.record(b.connErr)
 			atomic.StoreInt32(&b.opened, 0)
 			return
 		}
-		if conf.Net.TLS.Enable {
-			b.conn = tls.Client(b.conn, validServerNameTLS(b.addr, conf.Net.TLS.Config))
-		}
-
-		b.conn = newBufConn(b.conn)
 		b.conf = conf
+		b.responders = nil
+		for _, interceptor := range conf.Net.Interceptors {
+			if responder, ok := interceptor.(requestResponder); ok {
+				b.responders = append(b.responders, responder)
+			}
+		}
 
 		// Create or reuse the global metrics shared between brokers
 		b.incomingByteRate = metrics.GetOrRegisterMeter("incoming-byte-rate", b.metricRegistry)
@@ -225,6 +287,13 @@ func (b *Broker) Open(conf *Config) error {
 		b.responseSize = getOrRegisterHistogram("response-size", b.metricRegistry)
 		b.requestsInFlight = metrics.GetOrRegisterCounter("requests-in-flight", b.metricRegistry)
 		b.protocolRequestsRate = map[int16]metrics.Meter{}
+		if conf.Net.SASL.Enable {
+			mechanism := conf.Net.SASL.Mechanism
+			b.saslReauthTotal = metrics.GetOrRegisterCounter(fmt.Sprintf("sasl-reauthentication-total-%s", mechanism), b.metricRegistry)
+			b.saslReauthFailed = metrics.GetOrRegisterCounter(fmt.Sprintf("sasl-reauthentication-failed-%s", mechanism), b.metricRegistry)
+			b.saslTokenRefreshTotal = metrics.GetOrRegisterCounter(fmt.Sprintf("sasl-token-refresh-total-%s", mechanism), b.metricRegistry)
+			b.saslTokenRefreshFailed = metrics.GetOrRegisterCounter(fmt.Sprintf("sasl-token-refresh-failed-%s", mechanism), b.metricRegistry)
+		}
 		// Do not gather metrics for seeded broker (only used during bootstrap) because they share
 		// the same id (-1) and are already exposed through the global metrics above
 		if b.id >= 0 && !metrics.UseNilMetrics {
@@ -235,42 +304,11 @@ func (b *Broker) Open(conf *Config) error {
 			conf.Net.SASL.Version = SASLHandshakeV1
 		}
 
-		useSaslV0 := conf.Net.SASL.Version == SASLHandshakeV0 || conf.Net.SASL.Mechanism == SASLTypeGSSAPI
-		if conf.Net.SASL.Enable && useSaslV0 {
-			b.connErr = b.authenticateViaSASLv0()
-
-			if b.connErr != nil {
-				err = b.conn.Close()
-				if err == nil {
-					DebugLogger.Printf("Closed connection to broker %s\n", b.addr)
-				} else {
-					Logger.Printf("Error while closing connection to broker %s: %s\n", b.addr, err)
-				}
-				b.conn = nil
-				atomic.StoreInt32(&b.opened, 0)
-				return
-			}
-		}
-
-		b.done = make(chan bool)
-		b.responses = make(chan *responsePromise, b.conf.Net.MaxOpenRequests-1)
-
-		go withRecover(b.responseReceiver)
-		if conf.Net.SASL.Enable && !useSaslV0 {
-			b.connErr = b.authenticateViaSASLv1()
-			if b.connErr != nil {
-				close(b.responses)
-				<-b.done
-				err = b.conn.Close()
-				if err == nil {
-					DebugLogger.Printf("Closed connection to broker %s\n", b.addr)
-				} else {
-					Logger.Printf("Error while closing connection to broker %s: %s\n", b.addr, err)
-				}
-				b.conn = nil
-				atomic.StoreInt32(&b.opened, 0)
-				return
-			}
+		b.connErr = b.startConnection()
+		if b.connErr != nil {
+			b.circuit.record(b.connErr)
+			atomic.StoreInt32(&b.opened, 0)
+			return
 		}
 		if b.id >= 0 {
 			DebugLogger.Printf("Connected to broker at %s (registered as #%d)\n", b.addr, b.id)
@@ -282,6 +320,111 @@ func (b *Broker) Open(conf *Config) error {
 	return nil
 }
 
+// dial opens a new network connection to the broker, wrapped in TLS when
+// enabled.
+func (b *Broker) dial(conf *Config) (net.Conn, error) {
+	dialer := conf.getDialer()
+	conn, err := dialer.Dial("tcp", b.addr)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Net.TLS.Enable {
+		conn = tls.Client(conn, validServerNameTLS(b.addr, conf.Net.TLS.Config))
+	}
+	return newBufConn(conn), nil
+}
+
+// startConnection authenticates a freshly dialed b.conn and starts the
+// response receiver for it, dialing again after Metadata.Retry.Backoff when
+// the Kerberos service ticket is rejected because of clock skew, up to
+// Net.SASL.GSSAPI.ClockSkewRetries times. On failure the connection is closed
+// and b.conn is reset. b.lock must be held by caller.
+func (b *Broker) startConnection() error {
+	err := b.authenticateConnection()
+	for retries := b.conf.Net.SASL.GSSAPI.ClockSkewRetries; retries > 0 && errors.Is(err, ErrKerberosClockSkew); retries-- {
+		Logger.Printf("GSSAPI Kerberos Authentication with %s failed because of clock skew, reconnecting in %s to retry with a fresh service ticket (%d attempts remaining): %s\n", b.addr, b.conf.Metadata.Retry.Backoff, retries, err)
+		b.conf.getClock().Sleep(b.conf.Metadata.Retry.Backoff)
+		// the broker closes the connection once the authentication failed
+		if b.conn, err = b.dial(b.conf); err != nil {
+			return err
+		}
+		err = b.authenticateConnection()
+	}
+	return err
+}
+
+// authenticateConnection authenticates b.conn and starts the response
+// receiver for it, see startConnection.
+func (b *Broker) authenticateConnection() error {
+	// GSS-API tokens are exchanged in SaslAuthenticate requests with v1 of the
+	// handshake, which brokers older than 1.0.0 don't support
+	useSaslV0 := b.conf.Net.SASL.Version == SASLHandshakeV0 ||
+		(b.conf.Net.SASL.Mechanism == SASLTypeGSSAPI && !b.conf.Version.IsAtLeast(V1_0_0_0))
+	if b.conf.Net.SASL.Enable && useSaslV0 {
+		if err := b.authenticateViaSASLv0(); err != nil {
+			b.closeConn()
+			return err
+		}
+	}
+
+	if !b.conf.acquireConnectionGoroutine() {
+		b.closeConn()
+		return ErrMaxConnectionGoroutines
+	}
+	b.done = make(chan bool)
+	b.responses = make(chan *responsePromise, b.conf.Net.MaxOpenRequests-1)
+
+	goWithRecover(b.conf.MetricRegistry, b.responseReceiver)
+	if b.conf.Net.SASL.Enable && !useSaslV0 {
+		if err := b.authenticateViaSASLv1(); err != nil {
+			close(b.responses)
+			<-b.done
+			b.closeConn()
+			return err
+		}
+	}
+
+	b.connectedAt = b.conf.getClock().Now()
+	return nil
+}
+
+// closeConn closes b.conn and resets it. b.lock must be held by caller.
+func (b *Broker) closeConn() {
+	err := b.conn.Close()
+	if err == nil {
+		DebugLogger.Printf("Closed connection to broker %s\n", b.addr)
+	} else {
+		Logger.Printf("Error while closing connection to broker %s: %s\n", b.addr, err)
+	}
+	b.conn = nil
+}
+
+// reconnect waits for the requests in flight on the current connection to
+// complete, then replaces it with a newly dialed and authenticated one.
+// b.lock must be held by caller.
+func (b *Broker) reconnect() error {
+	DebugLogger.Printf("Connection to broker %s is older than %s, reconnecting\n", b.addr, b.conf.Net.ConnectionMaxAge)
+
+	close(b.responses)
+	<-b.done
+	b.closeConn()
+	b.done = nil
+	b.responses = nil
+	b.clientSessionReauthenticationTimeMs = 0
+
+	b.conn, b.connErr = b.dial(b.conf)
+	if b.connErr == nil {
+		b.connErr = b.startConnection()
+	}
+	if b.connErr != nil {
+		Logger.Printf("Failed to reconnect to broker %s: %s\n", b.addr, b.connErr)
+		b.conn = nil
+		atomic.StoreInt32(&b.opened, 0)
+		return b.connErr
+	}
+	return nil
+}
+
 func (b *Broker) ResponseSize() int {
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -289,6 +432,12 @@ func (b *Broker) ResponseSize() int {
 	return len(b.responses)
 }
 
+// inFlightRequests returns the number of requests sent to the broker that
+// are still waiting for a response.
+func (b *Broker) inFlightRequests() int64 {
+	return atomic.LoadInt64(&b.inFlight)
+}
+
 // Connected returns true if the broker is connected and false otherwise. If the broker is not
 // connected but it had tried to connect, the error from that connection attempt is also returned.
 func (b *Broker) Connected() (bool, error) {
@@ -298,11 +447,29 @@ func (b *Broker) Connected() (bool, error) {
 	return b.conn != nil, b.connErr
 }
 
+// Connection returns the local and remote addresses of the broker's network
+// connection, e.g. to diagnose source address based ACLs or NAT. It returns
+// ErrNotConnected if the broker is not connected.
+func (b *Broker) Connection() (local, remote net.Addr, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.conn == nil {
+		return nil, nil, ErrNotConnected
+	}
+	return b.conn.LocalAddr(), b.conn.RemoteAddr(), nil
+}
+
 // TLSConnectionState returns the client's TLS connection state. The second return value is false if this is not a tls connection or the connection has not yet been established.
 func (b *Broker) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
+	return b.tlsConnectionState()
+}
+
+// b.lock must be held by caller
+func (b *Broker) tlsConnectionState() (state tls.ConnectionState, ok bool) {
 	if b.conn == nil {
 		return state, false
 	}
@@ -335,6 +502,10 @@ func (b *Broker) Close() error {
 	b.done = nil
 	b.responses = nil
 
+	b.apiVersionsLock.Lock()
+	b.apiVersions = nil
+	b.apiVersionsLock.Unlock()
+
 	b.metricRegistry.UnregisterAll()
 
 	if err == nil {
@@ -435,6 +606,13 @@ type ProduceCallback func(*ProduceResponse, error)
 //
 // Make sure not to Close the broker in the callback as it will lead to a deadlock.
 func (b *Broker) AsyncProduce(request *ProduceRequest, cb ProduceCallback) error {
+	if err := b.circuit.allow(); err != nil {
+		return err
+	}
+	if err := b.acquirePending(); err != nil {
+		return err
+	}
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -451,6 +629,7 @@ func (b *Broker) AsyncProduce(request *ProduceRequest, cb ProduceCallback) error
 			headerVersion: res.headerVersion(),
 			// Packets will be converted to a ProduceResponse in the responseReceiver goroutine
 			handler: func(packets []byte, err error) {
+				b.releasePending()
 				if err != nil {
 					// Failed request
 					cb(nil, err)
@@ -470,7 +649,11 @@ func (b *Broker) AsyncProduce(request *ProduceRequest, cb ProduceCallback) error
 		}
 	}
 
-	return b.sendWithPromise(request, promise)
+	err := b.sendWithPromise(request, promise)
+	if err != nil || promise == nil {
+		b.releasePending()
+	}
+	return err
 }
 
 // Produce returns a produce response or error
@@ -505,7 +688,10 @@ func (b *Broker) Fetch(request *FetchRequest) (*FetchResponse, error) {
 		}
 	}()
 
-	response := new(FetchResponse)
+	response := &FetchResponse{
+		skipCorruptBatches: request.skipCorruptBatches,
+		skipCRCValidation:  request.skipCRCValidation,
+	}
 
 	err := b.sendAndReceive(request, response)
 	if err != nil {
@@ -625,6 +811,109 @@ func (b *Broker) ApiVersions(request *ApiVersionsRequest) (*ApiVersionsResponse,
 	return response, nil
 }
 
+// storeApiVersions keeps the API versions advertised by the broker for
+// maxApiVersion, unless the response is an error.
+func (b *Broker) storeApiVersions(res *ApiVersionsResponse) map[int16]int16 {
+	if res.ErrorCode != int16(ErrNoError) {
+		return nil
+	}
+	versions := make(map[int16]int16, len(res.ApiKeys))
+	for _, key := range res.ApiKeys {
+		versions[key.ApiKey] = key.MaxVersion
+	}
+
+	b.apiVersionsLock.Lock()
+	defer b.apiVersionsLock.Unlock()
+	b.apiVersions = versions
+	return versions
+}
+
+// probeApiVersions asks the broker for the API versions it supports and keeps
+// them for maxApiVersion. From V2_4_0_0 it sends a v3 request identifying the
+// client (KIP-511); brokers older than 2.4 reject it with UNSUPPORTED_VERSION
+// in the v0 format, which may not even decode as v3, so a failed request is
+// retried as v0, which every broker since 0.10 understands.
+func (b *Broker) probeApiVersions(conf *Config) map[int16]int16 {
+	if conf.Version.IsAtLeast(V2_4_0_0) {
+		res, err := b.ApiVersions(&ApiVersionsRequest{
+			Version:               3,
+			ClientSoftwareName:    defaultClientSoftwareName,
+			ClientSoftwareVersion: version(),
+		})
+		if err == nil && res.ErrorCode == int16(ErrNoError) {
+			return b.storeApiVersions(res)
+		}
+		if err == nil {
+			err = KError(res.ErrorCode)
+		}
+		Logger.Printf("Error while sending ApiVersionsRequest v3 to broker %s, retrying with v0: %s\n", b.addr, err)
+	}
+
+	res, err := b.ApiVersions(&ApiVersionsRequest{Version: 0})
+	if err != nil {
+		Logger.Printf("Error while sending ApiVersionsRequest to broker %s: %s\n", b.addr, err)
+		return nil
+	}
+	return b.storeApiVersions(res)
+}
+
+// maxApiVersion returns the highest version of the API key advertised by the
+// broker, sending an ApiVersionsRequest if it did not answer one yet. It
+// returns false if the broker did not advertise the key, or if ApiVersions
+// requests are disabled or unsupported by the configured Version.
+func (b *Broker) maxApiVersion(key int16) (int16, bool) {
+	b.lock.Lock()
+	conf := b.conf
+	b.lock.Unlock()
+	if conf == nil || !conf.ApiVersionsRequest || !conf.Version.IsAtLeast(V0_10_0_0) {
+		return 0, false
+	}
+
+	b.apiVersionsLock.Lock()
+	versions := b.apiVersions
+	b.apiVersionsLock.Unlock()
+	if versions == nil {
+		versions = b.probeApiVersions(conf)
+	}
+
+	max, ok := versions[key]
+	return max, ok
+}
+
+// Ping sends a lightweight ApiVersions request to the broker and returns its
+// round-trip latency. The broker must have been opened; Ping waits for a
+// pending connection attempt and is bounded by Net.DialTimeout and
+// Net.ReadTimeout. Requires Kafka 0.10 or higher.
+func (b *Broker) Ping() (time.Duration, error) {
+	b.lock.Lock()
+	conf := b.conf
+	b.lock.Unlock()
+	if conf == nil {
+		if _, err := b.Connected(); err != nil {
+			return 0, err
+		}
+		return 0, ErrNotConnected
+	}
+
+	request := &ApiVersionsRequest{}
+	if conf.Version.IsAtLeast(V2_4_0_0) {
+		request.Version = 3
+		request.ClientSoftwareName = defaultClientSoftwareName
+		request.ClientSoftwareVersion = version()
+	}
+
+	start := time.Now()
+	response, err := b.ApiVersions(request)
+	latency := time.Since(start)
+	if err != nil {
+		return 0, err
+	}
+	if kerr := KError(response.ErrorCode); !errors.Is(kerr, ErrNoError) {
+		return 0, kerr
+	}
+	return latency, nil
+}
+
 // CreateTopics send a create topic request and returns create topic response
 func (b *Broker) CreateTopics(request *CreateTopicsRequest) (*CreateTopicsResponse, error) {
 	response := new(CreateTopicsResponse)
@@ -871,6 +1160,18 @@ func (b *Broker) DeleteOffsets(request *DeleteOffsetsRequest) (*DeleteOffsetsRes
 	return response, nil
 }
 
+// OffsetForLeaderEpoch sends a request to find the end offsets of leader
+// epochs and returns a response or error
+func (b *Broker) OffsetForLeaderEpoch(request *OffsetForLeaderEpochRequest) (*OffsetForLeaderEpochResponse, error) {
+	response := new(OffsetForLeaderEpochResponse)
+
+	if err := b.sendAndReceive(request, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
 // DescribeLogDirs sends a request to get the broker's log dir paths and sizes
 func (b *Broker) DescribeLogDirs(request *DescribeLogDirsRequest) (*DescribeLogDirsResponse, error) {
 	response := new(DescribeLogDirsResponse)
@@ -933,13 +1234,26 @@ func (b *Broker) AlterClientQuotas(request *AlterClientQuotasRequest) (*AlterCli
 // readFull ensures the conn ReadDeadline has been setup before making a
 // call to io.ReadFull
 func (b *Broker) readFull(buf []byte) (n int, err error) {
-	if err := b.conn.SetReadDeadline(time.Now().Add(b.conf.Net.ReadTimeout)); err != nil {
+	return b.readFullWithTimeout(buf, b.conf.Net.ReadTimeout)
+}
+
+func (b *Broker) readFullWithTimeout(buf []byte, timeout time.Duration) (n int, err error) {
+	if err := b.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
 		return 0, err
 	}
 
 	return io.ReadFull(b.conn, buf)
 }
 
+// readTimeout returns how long to wait for the response to a request with the
+// given API key, honouring Net.RequestTimeouts.
+func (b *Broker) readTimeout(key int16) time.Duration {
+	if timeout, ok := b.conf.Net.RequestTimeouts[key]; ok {
+		return timeout
+	}
+	return b.conf.Net.ReadTimeout
+}
+
 // write  ensures the conn WriteDeadline has been setup before making a
 // call to conn.Write
 func (b *Broker) write(buf []byte) (n int, err error) {
@@ -984,9 +1298,17 @@ func (b *Broker) sendWithPromise(rb protocolBody, promise *responsePromise) erro
 		return ErrNotConnected
 	}
 
+	if maxAge := b.conf.Net.ConnectionMaxAge; maxAge > 0 && b.conf.getClock().Since(b.connectedAt) > maxAge {
+		if err := b.reconnect(); err != nil {
+			return err
+		}
+	}
+
 	if b.clientSessionReauthenticationTimeMs > 0 && currentUnixMilli() > b.clientSessionReauthenticationTimeMs {
 		err := b.authenticateViaSASLv1()
+		b.saslReauthTotal.Inc(1)
 		if err != nil {
+			b.saslReauthFailed.Inc(1)
 			return err
 		}
 	}
@@ -1009,6 +1331,22 @@ func (b *Broker) sendInternal(rb protocolBody, promise *responsePromise) error {
 	// check and wait if throttled
 	b.waitIfThrottled()
 
+	for _, interceptor := range b.conf.Net.Interceptors {
+		b.safelyApplyBeforeRequest(interceptor, rb.key(), rb.version())
+	}
+	var delay time.Duration
+	for _, responder := range b.responders {
+		res, resDelay, err := responder.respond(b, rb)
+		delay += resDelay
+		if err != nil && promise == nil {
+			b.afterResponse(rb.key(), rb.version(), err, time.Now())
+			return err
+		}
+		if err != nil || res != nil {
+			return b.respondInternal(rb, res, err, delay, promise)
+		}
+	}
+
 	requestTime := time.Now()
 	// Will be decremented in responseReceiver (except error or request with NoResponse)
 	b.addRequestInFlightMetrics(1)
@@ -1017,6 +1355,8 @@ func (b *Broker) sendInternal(rb protocolBody, promise *responsePromise) error {
 	b.updateProtocolMetrics(rb)
 	if err != nil {
 		b.addRequestInFlightMetrics(-1)
+		b.circuit.record(err)
+		b.afterResponse(rb.key(), rb.version(), err, requestTime)
 		return err
 	}
 	b.correlationID++
@@ -1024,17 +1364,80 @@ func (b *Broker) sendInternal(rb protocolBody, promise *responsePromise) error {
 	if promise == nil {
 		// Record request latency without the response
 		b.updateRequestLatencyAndInFlightMetrics(time.Since(requestTime))
+		b.afterResponse(rb.key(), rb.version(), nil, requestTime)
 		return nil
 	}
 
 	promise.requestTime = requestTime
+	promise.apiKey = rb.key()
+	promise.apiVersion = rb.version()
+	promise.readTimeout = b.readTimeout(rb.key())
 	promise.correlationID = req.correlationID
+	promise.delay = delay
+	b.responses <- promise
+
+	return nil
+}
+
+// respondInternal hands res, or resErr, over to the promise of rb after delay
+// as if the broker had sent it, in order with the responses to the requests
+// sent before.
+// b.lock must be held by caller
+func (b *Broker) respondInternal(rb protocolBody, res protocolBody, resErr error, delay time.Duration, promise *responsePromise) error {
+	requestTime := time.Now()
+	if promise == nil {
+		b.afterResponse(rb.key(), rb.version(), nil, requestTime)
+		return nil
+	}
+
+	var buf []byte
+	if resErr == nil {
+		var err error
+		if buf, err = encode(res, b.metricRegistry); err != nil {
+			b.afterResponse(rb.key(), rb.version(), err, requestTime)
+			return err
+		}
+	}
+
+	// Will be decremented in responseReceiver
+	b.addRequestInFlightMetrics(1)
+	promise.requestTime = requestTime
+	promise.apiKey = rb.key()
+	promise.apiVersion = rb.version()
+	promise.delay = delay
+	promise.response = buf
+	promise.responseErr = resErr
 	b.responses <- promise
 
 	return nil
 }
 
+// acquirePending accounts for a request about to be sent, failing with
+// ErrTooManyInFlight if Net.InFlightOverflowPolicy does not allow it to wait
+// for the outstanding ones. Every successful call must be followed by a call
+// to releasePending once the request completed.
+func (b *Broker) acquirePending() error {
+	pending := atomic.AddInt32(&b.pending, 1)
+	if limit := atomic.LoadInt32(&b.pendingLimit); limit > 0 && pending > limit {
+		b.releasePending()
+		return ErrTooManyInFlight
+	}
+	return nil
+}
+
+func (b *Broker) releasePending() {
+	atomic.AddInt32(&b.pending, -1)
+}
+
 func (b *Broker) sendAndReceive(req protocolBody, res protocolBody) error {
+	if err := b.circuit.allow(); err != nil {
+		return err
+	}
+	if err := b.acquirePending(); err != nil {
+		return err
+	}
+	defer b.releasePending()
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
 	responseHeaderVersion := int16(-1)
@@ -1165,19 +1568,31 @@ func (b *Broker) responseReceiver() {
 			// This was previously incremented in send() and
 			// we are not calling updateIncomingCommunicationMetrics()
 			b.addRequestInFlightMetrics(-1)
-			response.handle(nil, dead)
+			b.handleResponse(response, nil, dead)
+			continue
+		}
+
+		if response.delay > 0 {
+			b.conf.getClock().Sleep(response.delay)
+		}
+
+		if response.response != nil || response.responseErr != nil {
+			// answered by an interceptor, nothing to read
+			b.updateRequestLatencyAndInFlightMetrics(time.Since(response.requestTime))
+			b.handleResponse(response, response.response, response.responseErr)
 			continue
 		}
 
 		headerLength := getHeaderLength(response.headerVersion)
 		header := make([]byte, headerLength)
 
-		bytesReadHeader, err := b.readFull(header)
+		bytesReadHeader, err := b.readFullWithTimeout(header, response.readTimeout)
 		requestLatency := time.Since(response.requestTime)
 		if err != nil {
 			b.updateIncomingCommunicationMetrics(bytesReadHeader, requestLatency)
 			dead = err
-			response.handle(nil, err)
+			b.circuit.record(err)
+			b.handleResponse(response, nil, err)
 			continue
 		}
 
@@ -1186,7 +1601,14 @@ func (b *Broker) responseReceiver() {
 		if err != nil {
 			b.updateIncomingCommunicationMetrics(bytesReadHeader, requestLatency)
 			dead = err
-			response.handle(nil, err)
+			b.circuit.record(err)
+			b.handleResponse(response, nil, err)
+			continue
+		}
+		if maxSize := b.maxResponseSize(); decodedHeader.length > maxSize {
+			b.updateIncomingCommunicationMetrics(bytesReadHeader, requestLatency)
+			dead = PacketDecodingError{fmt.Sprintf("response of length %d exceeds Net.MaxResponseSize %d", decodedHeader.length, maxSize)}
+			b.handleResponse(response, nil, dead)
 			continue
 		}
 		if decodedHeader.correlationID != response.correlationID {
@@ -1194,24 +1616,54 @@ func (b *Broker) responseReceiver() {
 			// TODO if decoded ID < cur ID, discard until we catch up
 			// TODO if decoded ID > cur ID, save it so when cur ID catches up we have a response
 			dead = PacketDecodingError{fmt.Sprintf("correlation ID didn't match, wanted %d, got %d", response.correlationID, decodedHeader.correlationID)}
-			response.handle(nil, dead)
+			b.handleResponse(response, nil, dead)
 			continue
 		}
 
 		buf := make([]byte, decodedHeader.length-int32(headerLength)+4)
-		bytesReadBody, err := b.readFull(buf)
+		bytesReadBody, err := b.readFullWithTimeout(buf, response.readTimeout)
 		b.updateIncomingCommunicationMetrics(bytesReadHeader+bytesReadBody, requestLatency)
 		if err != nil {
 			dead = err
-			response.handle(nil, err)
+			b.circuit.record(err)
+			b.handleResponse(response, nil, err)
 			continue
 		}
 
-		response.handle(buf, nil)
+		b.circuit.record(nil)
+		b.handleResponse(response, buf, nil)
 	}
+	b.conf.releaseConnectionGoroutine()
 	close(b.done)
 }
 
+// handleResponse hands the response, or the error reading it, to the promise
+// after calling the interceptors.
+func (b *Broker) handleResponse(response *responsePromise, packets []byte, err error) {
+	b.afterResponse(response.apiKey, response.apiVersion, err, response.requestTime)
+	response.handle(packets, err)
+}
+
+// afterResponse calls the AfterResponse hook of the interceptors, if any.
+func (b *Broker) afterResponse(apiKey, version int16, err error, requestTime time.Time) {
+	if b.conf == nil || len(b.conf.Net.Interceptors) == 0 {
+		return
+	}
+	latency := time.Since(requestTime)
+	for _, interceptor := range b.conf.Net.Interceptors {
+		b.safelyApplyAfterResponse(interceptor, apiKey, version, err, latency)
+	}
+}
+
+// maxResponseSize returns the largest response length the broker will read,
+// honouring Net.MaxResponseSize when it is stricter than MaxResponseSize.
+func (b *Broker) maxResponseSize() int32 {
+	if b.conf != nil && b.conf.Net.MaxResponseSize > 0 && b.conf.Net.MaxResponseSize < MaxResponseSize {
+		return b.conf.Net.MaxResponseSize
+	}
+	return MaxResponseSize
+}
+
 func getHeaderLength(headerVersion int16) int8 {
 	if headerVersion < 1 {
 		return 8
@@ -1288,17 +1740,38 @@ func (b *Broker) authenticateViaSASLv1() error {
 		return b.sendAndReceiveSASLOAuth(authSendReceiver, provider)
 	case SASLTypeSCRAMSHA256, SASLTypeSCRAMSHA512:
 		return b.sendAndReceiveSASLSCRAMv1(authSendReceiver, b.conf.Net.SASL.SCRAMClientGeneratorFunc())
+	case SASLTypeGSSAPI:
+		b.initKerberosAuthenticator()
+		return b.kerberosAuthenticator.AuthorizeV2Context(b.authContext(), b, authSendReceiver)
 	default:
+		if factory := registeredSASLMechanism(b.conf.Net.SASL.Mechanism); factory != nil {
+			return b.sendAndReceiveSASLCustom(authSendReceiver, factory(b.conf))
+		}
 		return b.sendAndReceiveSASLPlainAuthV1(authSendReceiver)
 	}
 }
 
 func (b *Broker) sendAndReceiveKerberos() error {
+	b.initKerberosAuthenticator()
+	return b.kerberosAuthenticator.AuthorizeContext(b.authContext(), b)
+}
+
+// authContext returns the context cancelling the GSSAPI authentication.
+func (b *Broker) authContext() context.Context {
+	if b.authCtx == nil {
+		return context.Background()
+	}
+	return b.authCtx
+}
+
+func (b *Broker) initKerberosAuthenticator() {
 	b.kerberosAuthenticator.Config = &b.conf.Net.SASL.GSSAPI
+	if b.kerberosAuthenticator.NewKerberosClientFunc == nil {
+		b.kerberosAuthenticator.NewKerberosClientFunc = b.conf.Net.SASL.GSSAPI.NewKerberosClientFunc
+	}
 	if b.kerberosAuthenticator.NewKerberosClientFunc == nil {
 		b.kerberosAuthenticator.NewKerberosClientFunc = NewKerberosClient
 	}
-	return b.kerberosAuthenticator.Authorize(b)
 }
 
 func (b *Broker) sendAndReceiveSASLHandshake(saslType SASLMechanism, version int16) error {
@@ -1331,6 +1804,12 @@ func (b *Broker) sendAndReceiveSASLHandshake(saslType SASLMechanism, version int
 	}
 
 	length := binary.BigEndian.Uint32(header[:4])
+	if length <= 4 || length > uint32(b.maxResponseSize()) {
+		b.addRequestInFlightMetrics(-1)
+		err = PacketDecodingError{fmt.Sprintf("SASL handshake response of length %d too large or too small", length)}
+		Logger.Printf("Failed to read SASL handshake payload : %s\n", err.Error())
+		return err
+	}
 	payload := make([]byte, length-4)
 	n, err := b.readFull(payload)
 	if err != nil {
@@ -1439,7 +1918,9 @@ func currentUnixMilli() int64 {
 // https://cwiki.apache.org/confluence/pages/viewpage.action?pageId=75968876
 func (b *Broker) sendAndReceiveSASLOAuth(authSendReceiver func(authBytes []byte) (*SaslAuthenticateResponse, error), provider AccessTokenProvider) error {
 	token, err := provider.Token()
+	b.saslTokenRefreshTotal.Inc(1)
 	if err != nil {
+		b.saslTokenRefreshFailed.Inc(1)
 		return err
 	}
 
@@ -1499,7 +1980,14 @@ func (b *Broker) sendAndReceiveSASLSCRAMv0() error {
 			Logger.Printf("Failed to read response header while authenticating with SASL to broker %s: %s\n", b.addr, err.Error())
 			return err
 		}
-		payload := make([]byte, int32(binary.BigEndian.Uint32(header)))
+		payloadLength := int32(binary.BigEndian.Uint32(header))
+		if payloadLength < 0 || payloadLength > b.maxResponseSize() {
+			b.addRequestInFlightMetrics(-1)
+			err = PacketDecodingError{fmt.Sprintf("SASL response of length %d too large or too small", payloadLength)}
+			Logger.Printf("Failed to read response payload while authenticating with SASL to broker %s: %s\n", b.addr, err.Error())
+			return err
+		}
+		payload := make([]byte, payloadLength)
 		n, err := b.readFull(payload)
 		if err != nil {
 			b.addRequestInFlightMetrics(-1)
@@ -1546,6 +2034,36 @@ func (b *Broker) sendAndReceiveSASLSCRAMv1(authSendReceiver func(authBytes []byt
 	return nil
 }
 
+// sendAndReceiveSASLCustom authenticates with a mechanism registered with
+// RegisterSASLMechanism.
+func (b *Broker) sendAndReceiveSASLCustom(authSendReceiver func(authBytes []byte) (*SaslAuthenticateResponse, error), client SASLClient) error {
+	msg, err := client.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start the %s exchange: %w", b.conf.Net.SASL.Mechanism, err)
+	}
+
+	for {
+		res, err := authSendReceiver(msg)
+		if err != nil {
+			return err
+		}
+
+		var done bool
+		msg, done, err = client.Step(res.SaslAuthBytes)
+		if err != nil {
+			Logger.Println("SASL authentication failed", err)
+			return err
+		}
+		if done {
+			break
+		}
+	}
+
+	DebugLogger.Println("SASL authentication succeeded")
+
+	return nil
+}
+
 func (b *Broker) createSaslAuthenticateRequest(msg []byte) *SaslAuthenticateRequest {
 	authenticateRequest := SaslAuthenticateRequest{SaslAuthBytes: msg}
 	if b.conf.Version.IsAtLeast(V2_2_0_0) {
@@ -1635,6 +2153,7 @@ func (b *Broker) updateRequestLatencyAndInFlightMetrics(requestLatency time.Dura
 }
 
 func (b *Broker) addRequestInFlightMetrics(i int64) {
+	atomic.AddInt64(&b.inFlight, i)
 	b.requestsInFlight.Inc(i)
 	if b.brokerRequestsInFlight != nil {
 		b.brokerRequestsInFlight.Inc(i)
@@ -1659,6 +2178,20 @@ func (b *Broker) updateOutgoingCommunicationMetrics(bytes int) {
 	}
 }
 
+// updateGSSAPIHandshakeMetrics records the number of GSS-API tokens sent and
+// the bytes of the tokens exchanged to authenticate.
+func (b *Broker) updateGSSAPIHandshakeMetrics(roundTrips, bytes int) {
+	if b.metricRegistry == nil {
+		return
+	}
+	getOrRegisterHistogram("gssapi-handshake-round-trips", b.metricRegistry).Update(int64(roundTrips))
+	getOrRegisterHistogram("gssapi-handshake-bytes", b.metricRegistry).Update(int64(bytes))
+	if b.id >= 0 && !metrics.UseNilMetrics {
+		b.registerHistogram("gssapi-handshake-round-trips").Update(int64(roundTrips))
+		b.registerHistogram("gssapi-handshake-bytes").Update(int64(bytes))
+	}
+}
+
 func (b *Broker) updateProtocolMetrics(rb protocolBody) {
 	protocolRequestsRate := b.protocolRequestsRate[rb.key()]
 	if protocolRequestsRate == nil {
@@ -1700,16 +2233,16 @@ func (b *Broker) setThrottle(throttleTime time.Duration) {
 	if b.throttleTimer != nil {
 		// if there is an existing timer stop/clear it
 		if !b.throttleTimer.Stop() {
-			<-b.throttleTimer.C
+			<-b.throttleTimer.C()
 		}
 	}
-	b.throttleTimer = time.NewTimer(throttleTime)
+	b.throttleTimer = b.conf.getClock().NewTimer(throttleTime)
 }
 
 func (b *Broker) waitIfThrottled() {
 	if b.throttleTimer != nil {
 		DebugLogger.Printf("broker/%d waiting for throttle timer\n", b.ID())
-		<-b.throttleTimer.C
+		<-b.throttleTimer.C()
 		b.throttleTimer = nil
 	}
 }
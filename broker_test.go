@@ -2,14 +2,20 @@ package sarama
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/max444ks1m777/gokrb5/v8/iana/etypeID"
 	"github.com/max444ks1m777/gokrb5/v8/krberror"
+	"github.com/max444ks1m777/gokrb5/v8/types"
 	"github.com/rcrowley/go-metrics"
 )
 
@@ -223,6 +229,7 @@ func TestSASLOAuthBearer(t *testing.T) {
 		expectClientErr           bool         // Expect an internal client-side error
 		expectedBrokerError       KError       // Expected Kafka error returned by client
 		tokProvider               *TokenProvider
+		tokenRefreshes            int64 // Expected calls to the token provider
 	}{
 		{
 			name: "SASL/OAUTHBEARER OK server response",
@@ -232,6 +239,7 @@ func TestSASLOAuthBearer(t *testing.T) {
 			expectClientErr:      false,
 			expectedBrokerError:  ErrNoError,
 			tokProvider:          newTokenProvider(&AccessToken{Token: "access-token-123"}, nil),
+			tokenRefreshes:       1,
 		},
 		{
 			name: "SASL/OAUTHBEARER authentication failure response",
@@ -250,6 +258,7 @@ func TestSASLOAuthBearer(t *testing.T) {
 			expectClientErr:     true,
 			expectedBrokerError: ErrSASLAuthenticationFailed,
 			tokProvider:         newTokenProvider(&AccessToken{Token: "access-token-123"}, nil),
+			tokenRefreshes:      1,
 		},
 		{
 			name: "SASL/OAUTHBEARER handshake failure response",
@@ -260,6 +269,7 @@ func TestSASLOAuthBearer(t *testing.T) {
 			expectClientErr:      true,
 			expectedBrokerError:  ErrSASLAuthenticationFailed,
 			tokProvider:          newTokenProvider(&AccessToken{Token: "access-token-123"}, nil),
+			tokenRefreshes:       0,
 		},
 		{
 			name: "SASL/OAUTHBEARER token generation error",
@@ -269,6 +279,7 @@ func TestSASLOAuthBearer(t *testing.T) {
 			expectClientErr:      true,
 			expectedBrokerError:  ErrNoError,
 			tokProvider:          newTokenProvider(&AccessToken{Token: "access-token-123"}, ErrTokenFailure),
+			tokenRefreshes:       1,
 		},
 		{
 			name: "SASL/OAUTHBEARER invalid extension",
@@ -281,6 +292,7 @@ func TestSASLOAuthBearer(t *testing.T) {
 				Token:      "access-token-123",
 				Extensions: map[string]string{"auth": "auth-value"},
 			}, nil),
+			tokenRefreshes: 1,
 		},
 	}
 
@@ -329,6 +341,17 @@ func TestSASLOAuthBearer(t *testing.T) {
 				t.Errorf("[%d]:[%s] Unexpected error, got %s\n", i, test.name, err)
 			}
 
+			var expectedRefreshFailures int64
+			if test.tokProvider.err != nil {
+				expectedRefreshFailures = 1
+			}
+			if refreshes := conf.MetricRegistry.Get("sasl-token-refresh-total-OAUTHBEARER").(metrics.Counter).Count(); refreshes != test.tokenRefreshes {
+				t.Errorf("[%d]:[%s] Expected %d token refreshes, got %d\n", i, test.name, test.tokenRefreshes, refreshes)
+			}
+			if failures := conf.MetricRegistry.Get("sasl-token-refresh-failed-OAUTHBEARER").(metrics.Counter).Count(); failures != expectedRefreshFailures {
+				t.Errorf("[%d]:[%s] Expected %d token refresh failures, got %d\n", i, test.name, expectedRefreshFailures, failures)
+			}
+
 			mockBroker.Close()
 		})
 	}
@@ -645,6 +668,9 @@ func TestGSSAPIKerberosAuth_Authorize(t *testing.T) {
 		errorStage         string
 		badResponse        bool
 		badKeyChecksum     bool
+		clockSkewErrors    int
+		clockSkewRetries   int
+		errorKind          error
 	}{
 		{
 			name:               "Kerberos authentication success",
@@ -658,6 +684,7 @@ func TestGSSAPIKerberosAuth_Authorize(t *testing.T) {
 				"cation information was invalid - PREAUTH_FAILED"),
 			mockKerberosClient: true,
 			errorStage:         "login",
+			errorKind:          ErrKerberosLogin,
 		},
 		{
 			name: "Kerberos service ticket fails",
@@ -666,16 +693,19 @@ func TestGSSAPIKerberosAuth_Authorize(t *testing.T) {
 				"cation information was invalid - PREAUTH_FAILED"),
 			mockKerberosClient: true,
 			errorStage:         "service_ticket",
+			errorKind:          ErrKerberosServiceTicket,
 		},
 		{
-			name:  "Kerberos client creation fails",
-			error: errors.New("configuration file could not be opened: krb5.conf open krb5.conf: no such file or directory"),
+			name:      "Kerberos client creation fails",
+			error:     errors.New("configuration file could not be opened: krb5.conf open krb5.conf: no such file or directory"),
+			errorKind: ErrKerberosLogin,
 		},
 		{
 			name:               "Bad server response, unmarshall key error",
 			error:              errors.New("bytes shorter than header length"),
 			badResponse:        true,
 			mockKerberosClient: true,
+			errorKind:          ErrGSSAPIHandshake,
 		},
 		{
 			name:               "Bad token checksum",
@@ -683,77 +713,340 @@ func TestGSSAPIKerberosAuth_Authorize(t *testing.T) {
 			badResponse:        false,
 			badKeyChecksum:     true,
 			mockKerberosClient: true,
+			errorKind:          ErrGSSAPIHandshake,
+		},
+		{
+			name:               "Clock skew retried with a fresh service ticket",
+			error:              nil,
+			mockKerberosClient: true,
+			clockSkewErrors:    2,
+			clockSkewRetries:   2,
+		},
+		{
+			name:               "Clock skew retries exhausted",
+			error:              errors.New("KRB Error: (37) KRB_AP_ERR_SKEW Clock skew too great - clock skew too great"),
+			mockKerberosClient: true,
+			clockSkewErrors:    2,
+			clockSkewRetries:   1,
+			errorKind:          ErrKerberosClockSkew,
+		},
+		{
+			name:               "Bad token checksum not retried",
+			error:              errors.New("checksum mismatch. Computed: 39feb88ac2459f2b77738493, Contained in token: ffffffffffffffff00000000"),
+			badKeyChecksum:     true,
+			mockKerberosClient: true,
+			clockSkewRetries:   1,
+			errorKind:          ErrGSSAPIHandshake,
 		},
 	}
-	for i, test := range testTable {
+	for _, saslVersion := range []int16{SASLHandshakeV0, SASLHandshakeV1} {
+		saslVersion := saslVersion
+		for i, test := range testTable {
+			test := test
+			t.Run(fmt.Sprintf("%s (SASL handshake v%d)", test.name, saslVersion), func(t *testing.T) {
+				mockBroker := NewMockBroker(t, 0)
+				// broker executes SASL requests against mockBroker
+
+				mockBroker.SetGSSAPIHandler(func(bytes []byte) []byte {
+					return nil
+				})
+				broker := NewBroker(mockBroker.Addr())
+				broker.requestRate = metrics.NilMeter{}
+				broker.outgoingByteRate = metrics.NilMeter{}
+				broker.incomingByteRate = metrics.NilMeter{}
+				broker.requestSize = metrics.NilHistogram{}
+				broker.responseSize = metrics.NilHistogram{}
+				broker.responseRate = metrics.NilMeter{}
+				broker.requestLatency = metrics.NilHistogram{}
+				broker.requestsInFlight = metrics.NilCounter{}
+
+				conf := NewTestConfig()
+				conf.Net.SASL.Mechanism = SASLTypeGSSAPI
+				conf.Net.SASL.Enable = true
+				conf.Net.SASL.GSSAPI.ServiceName = "kafka"
+				conf.Net.SASL.GSSAPI.KerberosConfigPath = "krb5.conf"
+				conf.Net.SASL.GSSAPI.Realm = "EXAMPLE.COM"
+				conf.Net.SASL.GSSAPI.Username = "kafka"
+				conf.Net.SASL.GSSAPI.Password = "kafka"
+				conf.Net.SASL.GSSAPI.KeyTabPath = "kafka.keytab"
+				conf.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+				conf.Net.SASL.GSSAPI.ClockSkewRetries = test.clockSkewRetries
+				conf.Net.SASL.Version = saslVersion
+				conf.Version = V1_0_0_0
+
+				gssapiHandler := KafkaGSSAPIHandler{
+					client:          &MockKerberosClient{},
+					badResponse:     test.badResponse,
+					badKeyChecksum:  test.badKeyChecksum,
+					clockSkewErrors: test.clockSkewErrors,
+				}
+				if saslVersion == SASLHandshakeV0 {
+					// the tokens are sent as raw packets
+					mockBroker.SetGSSAPIHandler(gssapiHandler.MockKafkaGSSAPI)
+				} else {
+					mockBroker.SetHandlerByMap(map[string]MockResponse{
+						"SaslHandshakeRequest": NewMockSaslHandshakeResponse(t).
+							SetEnabledMechanisms([]string{SASLTypeGSSAPI}),
+						"SaslAuthenticateRequest": NewMockSaslAuthenticateResponse(t).
+							SetGSSAPIHandler(gssapiHandler.MockKafkaGSSAPI),
+					})
+				}
+				if test.mockKerberosClient {
+					broker.kerberosAuthenticator.NewKerberosClientFunc = func(config *GSSAPIConfig) (KerberosClient, error) {
+						return &MockKerberosClient{
+							mockError:  test.error,
+							errorStage: test.errorStage,
+						}, nil
+					}
+				} else {
+					broker.kerberosAuthenticator.NewKerberosClientFunc = nil
+				}
+
+				err := broker.Open(conf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { _ = broker.Close() })
+
+				_, err = broker.Connected()
+
+				if err != nil && test.error != nil {
+					if test.error.Error() != err.Error() {
+						t.Errorf("[%d] Expected error:%s, got:%s.", i, test.error, err)
+					}
+				} else if (err == nil && test.error != nil) || (err != nil && test.error == nil) {
+					t.Errorf("[%d] Expected error:%s, got:%s.", i, test.error, err)
+				}
+				if test.errorKind != nil {
+					var gssapiErr GSSAPIError
+					if !errors.Is(err, test.errorKind) {
+						t.Errorf("[%d] Expected error kind:%s, got:%s.", i, test.errorKind, err)
+					} else if !errors.As(err, &gssapiErr) || gssapiErr.Addr != mockBroker.Addr() {
+						t.Errorf("[%d] Expected a GSSAPIError for broker %s, got:%#v.", i, mockBroker.Addr(), err)
+					}
+				}
+
+				mockBroker.Close()
+			})
+		}
+	}
+}
+
+func TestGSSAPIKerberosClockSkewBackoff(t *testing.T) {
+	gssapiHandler := KafkaGSSAPIHandler{client: &MockKerberosClient{}, clockSkewErrors: 2}
+	var lock sync.Mutex
+	var attempts []time.Time // the times of the AP_REQ
+	mockBroker := NewMockBroker(t, 0)
+	defer mockBroker.Close()
+	mockBroker.SetHandlerByMap(map[string]MockResponse{
+		"SaslHandshakeRequest": NewMockSaslHandshakeResponse(t).
+			SetEnabledMechanisms([]string{SASLTypeGSSAPI}),
+		"SaslAuthenticateRequest": NewMockSaslAuthenticateResponse(t).
+			SetGSSAPIHandler(func(buffer []byte) []byte {
+				if buffer[4] == GSS_API_GENERIC_TAG {
+					lock.Lock()
+					attempts = append(attempts, time.Now())
+					lock.Unlock()
+				}
+				return gssapiHandler.MockKafkaGSSAPI(buffer)
+			}),
+	})
+
+	conf := NewTestConfig()
+	conf.Version = V1_0_0_0
+	conf.Metadata.Retry.Backoff = 100 * time.Millisecond
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.Mechanism = SASLTypeGSSAPI
+	conf.Net.SASL.Version = SASLHandshakeV1
+	conf.Net.SASL.GSSAPI.ServiceName = "kafka"
+	conf.Net.SASL.GSSAPI.KerberosConfigPath = "krb5.conf"
+	conf.Net.SASL.GSSAPI.Realm = "EXAMPLE.COM"
+	conf.Net.SASL.GSSAPI.Username = "kafka"
+	conf.Net.SASL.GSSAPI.Password = "kafka"
+	conf.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+	conf.Net.SASL.GSSAPI.ClockSkewRetries = 2
+	broker := NewBroker(mockBroker.Addr())
+	broker.kerberosAuthenticator.NewKerberosClientFunc = func(config *GSSAPIConfig) (KerberosClient, error) {
+		return &MockKerberosClient{}, nil
+	}
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, broker)
+
+	if _, err := broker.Connected(); err != nil {
+		t.Fatalf("expected the handshake to succeed once retried, got %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(attempts))
+	}
+	for i := 1; i < len(attempts); i++ {
+		if gap := attempts[i].Sub(attempts[i-1]); gap < conf.Metadata.Retry.Backoff {
+			t.Errorf("expected attempt %d to wait for the backoff, it came %v after the previous one", i+1, gap)
+		}
+	}
+}
+
+func TestGSSAPIMockKerberosClient(t *testing.T) {
+	issuer := NewMockKerberosClient()
+	if err := issuer.Login(); err != nil {
+		t.Fatal(err)
+	}
+	ticket := issuer.ASRep.Ticket
+	key := types.EncryptionKey{KeyType: etypeID.AES256_CTS_HMAC_SHA1_96, KeyValue: bytes.Repeat([]byte{0x2a}, 32)}
+
+	testTable := []struct {
+		name      string
+		client    *MockKerberosClient
+		acceptor  *MockKerberosClient
+		errorKind error
+	}{
+		{
+			name:   "Default service ticket",
+			client: NewMockKerberosClient(),
+		},
+		{
+			name:   "Canned service ticket",
+			client: NewMockKerberosClient().SetServiceTicket(ticket, key),
+		},
+		{
+			name:      "Canned service ticket unknown to the broker",
+			client:    NewMockKerberosClient().SetServiceTicket(ticket, key),
+			acceptor:  NewMockKerberosClient(),
+			errorKind: ErrGSSAPIHandshake,
+		},
+		{
+			name:      "Login error",
+			client:    NewMockKerberosClient().SetLoginError(errors.New("login failed")),
+			acceptor:  NewMockKerberosClient(),
+			errorKind: ErrKerberosLogin,
+		},
+		{
+			name:      "Service ticket error",
+			client:    NewMockKerberosClient().SetServiceTicketError(errors.New("no service ticket")),
+			acceptor:  NewMockKerberosClient(),
+			errorKind: ErrKerberosServiceTicket,
+		},
+	}
+	for _, test := range testTable {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
+			acceptor := test.acceptor
+			if acceptor == nil {
+				acceptor = test.client
+			}
 			mockBroker := NewMockBroker(t, 0)
-			// broker executes SASL requests against mockBroker
-
-			mockBroker.SetGSSAPIHandler(func(bytes []byte) []byte {
-				return nil
-			})
-			broker := NewBroker(mockBroker.Addr())
-			broker.requestRate = metrics.NilMeter{}
-			broker.outgoingByteRate = metrics.NilMeter{}
-			broker.incomingByteRate = metrics.NilMeter{}
-			broker.requestSize = metrics.NilHistogram{}
-			broker.responseSize = metrics.NilHistogram{}
-			broker.responseRate = metrics.NilMeter{}
-			broker.requestLatency = metrics.NilHistogram{}
-			broker.requestsInFlight = metrics.NilCounter{}
+			defer mockBroker.Close()
+			mockBroker.SetGSSAPIHandler(NewMockGSSAPIHandler(acceptor))
 
 			conf := NewTestConfig()
 			conf.Net.SASL.Mechanism = SASLTypeGSSAPI
 			conf.Net.SASL.Enable = true
 			conf.Net.SASL.GSSAPI.ServiceName = "kafka"
-			conf.Net.SASL.GSSAPI.KerberosConfigPath = "krb5.conf"
 			conf.Net.SASL.GSSAPI.Realm = "EXAMPLE.COM"
 			conf.Net.SASL.GSSAPI.Username = "kafka"
 			conf.Net.SASL.GSSAPI.Password = "kafka"
-			conf.Net.SASL.GSSAPI.KeyTabPath = "kafka.keytab"
 			conf.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
-			conf.Version = V1_0_0_0
-
-			gssapiHandler := KafkaGSSAPIHandler{
-				client:         &MockKerberosClient{},
-				badResponse:    test.badResponse,
-				badKeyChecksum: test.badKeyChecksum,
-			}
-			mockBroker.SetGSSAPIHandler(gssapiHandler.MockKafkaGSSAPI)
-			if test.mockKerberosClient {
-				broker.kerberosAuthenticator.NewKerberosClientFunc = func(config *GSSAPIConfig) (KerberosClient, error) {
-					return &MockKerberosClient{
-						mockError:  test.error,
-						errorStage: test.errorStage,
-					}, nil
-				}
-			} else {
-				broker.kerberosAuthenticator.NewKerberosClientFunc = nil
+			conf.Net.SASL.GSSAPI.NewKerberosClientFunc = func(config *GSSAPIConfig) (KerberosClient, error) {
+				return test.client, nil
 			}
+			conf.Net.SASL.Version = SASLHandshakeV0
+			conf.Version = V1_0_0_0
 
-			err := broker.Open(conf)
-			if err != nil {
+			broker := NewBroker(mockBroker.Addr())
+			if err := broker.Open(conf); err != nil {
 				t.Fatal(err)
 			}
 			t.Cleanup(func() { _ = broker.Close() })
 
-			_, err = broker.Connected()
-
-			if err != nil && test.error != nil {
-				if test.error.Error() != err.Error() {
-					t.Errorf("[%d] Expected error:%s, got:%s.", i, test.error, err)
-				}
-			} else if (err == nil && test.error != nil) || (err != nil && test.error == nil) {
-				t.Errorf("[%d] Expected error:%s, got:%s.", i, test.error, err)
+			_, err := broker.Connected()
+			if test.errorKind == nil && err != nil {
+				t.Errorf("expected to authenticate, got %s", err)
+			} else if !errors.Is(err, test.errorKind) {
+				t.Errorf("expected error kind %s, got %v", test.errorKind, err)
 			}
-
-			mockBroker.Close()
 		})
 	}
 }
 
+func TestGSSAPIRawTokensBeforeKafka1_0(t *testing.T) {
+	client := NewMockKerberosClient()
+	mockBroker := NewMockBroker(t, 0)
+	defer mockBroker.Close()
+	mockBroker.SetGSSAPIHandler(NewMockGSSAPIHandler(client))
+
+	conf := NewTestConfig()
+	conf.Net.SASL.Mechanism = SASLTypeGSSAPI
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.GSSAPI.ServiceName = "kafka"
+	conf.Net.SASL.GSSAPI.Realm = "EXAMPLE.COM"
+	conf.Net.SASL.GSSAPI.Username = "kafka"
+	conf.Net.SASL.GSSAPI.Password = "kafka"
+	conf.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+	conf.Net.SASL.GSSAPI.NewKerberosClientFunc = func(config *GSSAPIConfig) (KerberosClient, error) {
+		return client, nil
+	}
+	// SaslAuthenticate requests are not supported before Kafka 1.0.0
+	conf.Net.SASL.Version = SASLHandshakeV1
+	conf.Version = V0_11_0_0
+
+	broker := NewBroker(mockBroker.Addr())
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = broker.Close() })
+
+	if connected, err := broker.Connected(); err != nil || !connected {
+		t.Fatalf("expected to authenticate with raw tokens, got %v", err)
+	}
+}
+
+func TestGSSAPIHandshakeMetrics(t *testing.T) {
+	client := NewMockKerberosClient()
+	mockBroker := NewMockBroker(t, 1)
+	defer mockBroker.Close()
+	mockBroker.SetGSSAPIHandler(NewMockGSSAPIHandler(client))
+
+	conf := NewTestConfig()
+	conf.Net.SASL.Mechanism = SASLTypeGSSAPI
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.Version = SASLHandshakeV0
+	conf.Net.SASL.GSSAPI.ServiceName = "kafka"
+	conf.Net.SASL.GSSAPI.Realm = "EXAMPLE.COM"
+	conf.Net.SASL.GSSAPI.Username = "kafka"
+	conf.Net.SASL.GSSAPI.Password = "kafka"
+	conf.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+	conf.Net.SASL.GSSAPI.NewKerberosClientFunc = func(config *GSSAPIConfig) (KerberosClient, error) {
+		return client, nil
+	}
+	conf.Version = V1_0_0_0
+
+	broker := NewBroker(mockBroker.Addr())
+	broker.id = 1
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = broker.Close() })
+	if connected, err := broker.Connected(); err != nil || !connected {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"gssapi-handshake-round-trips", "gssapi-handshake-round-trips-for-broker-1"} {
+		roundTrips := conf.MetricRegistry.Get(name).(metrics.Histogram)
+		// the AP_REQ and the final wrap token
+		if roundTrips.Count() != 1 || roundTrips.Max() != 2 {
+			t.Errorf("expected one authentication with 2 round-trips in %s, got %d with %d", name, roundTrips.Count(), roundTrips.Max())
+		}
+	}
+	for _, name := range []string{"gssapi-handshake-bytes", "gssapi-handshake-bytes-for-broker-1"} {
+		if tokenBytes := conf.MetricRegistry.Get(name).(metrics.Histogram); tokenBytes.Count() != 1 || tokenBytes.Max() <= 0 {
+			t.Errorf("expected the token bytes of one authentication in %s, got %d with %d", name, tokenBytes.Count(), tokenBytes.Max())
+		}
+	}
+}
+
 func TestBuildClientFirstMessage(t *testing.T) {
 	testTable := []struct {
 		name        string
@@ -888,6 +1181,12 @@ loop:
 	if actualSaslAuthRequests < 2 {
 		t.Fatalf("sasl reauth has not occurred within expected timeframe")
 	}
+	if reauths := conf.MetricRegistry.Get("sasl-reauthentication-total-PLAIN").(metrics.Counter).Count(); reauths != int64(actualSaslAuthRequests-1) {
+		t.Errorf("expected %d re-authentications to be counted, got %d", actualSaslAuthRequests-1, reauths)
+	}
+	if failures := conf.MetricRegistry.Get("sasl-reauthentication-failed-PLAIN").(metrics.Counter).Count(); failures != 0 {
+		t.Errorf("expected no re-authentication failures, got %d", failures)
+	}
 
 	mockBroker.Close()
 }
@@ -963,10 +1262,103 @@ loop:
 	if !errors.Is(apiVersionError, ErrSASLAuthenticationFailed) {
 		t.Fatalf("sasl reauth has not failed in the expected way %v", apiVersionError)
 	}
+	if failures := conf.MetricRegistry.Get("sasl-reauthentication-failed-PLAIN").(metrics.Counter).Count(); failures != 1 {
+		t.Errorf("expected 1 re-authentication failure, got %d", failures)
+	}
 
 	mockBroker.Close()
 }
 
+func TestKip368ReAuthenticationGSSAPI(t *testing.T) {
+	sessionLifetimeMs := int64(100)
+
+	mockBroker := NewMockBroker(t, 0)
+	defer mockBroker.Close()
+
+	countSaslAuthRequests := func() (count int) {
+		for _, rr := range mockBroker.History() {
+			if _, ok := rr.Request.(*SaslAuthenticateRequest); ok {
+				count++
+			}
+		}
+		return
+	}
+
+	gssapiHandler := KafkaGSSAPIHandler{client: &MockKerberosClient{}}
+	mockBroker.SetHandlerFuncByMap(map[string]requestHandlerFunc{
+		"SaslHandshakeRequest": func(req *request) encoderWithHeader {
+			return &SaslHandshakeResponse{EnabledMechanisms: []string{SASLTypeGSSAPI}}
+		},
+		"SaslAuthenticateRequest": func(req *request) encoderWithHeader {
+			authReq := req.body.(*SaslAuthenticateRequest)
+			res := &SaslAuthenticateResponse{Version: authReq.Version}
+			if authReq.SaslAuthBytes[0] == GSS_API_GENERIC_TAG {
+				// reply to the AP_REQ with a wrap token, without the length prefix
+				res.SaslAuthBytes = gssapiHandler.MockKafkaGSSAPI(authReq.SaslAuthBytes)[4:]
+			} else {
+				res.SessionLifetimeMs = sessionLifetimeMs
+			}
+			return res
+		},
+		"ApiVersionsRequest": func(req *request) encoderWithHeader {
+			return NewMockApiVersionsResponse(t).For(req.body)
+		},
+	})
+
+	broker := NewBroker(mockBroker.Addr())
+	broker.kerberosAuthenticator.NewKerberosClientFunc = func(config *GSSAPIConfig) (KerberosClient, error) {
+		return &MockKerberosClient{}, nil
+	}
+
+	conf := NewTestConfig()
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.Mechanism = SASLTypeGSSAPI
+	conf.Net.SASL.Version = SASLHandshakeV1
+	conf.Net.SASL.GSSAPI.ServiceName = "kafka"
+	conf.Net.SASL.GSSAPI.KerberosConfigPath = "krb5.conf"
+	conf.Net.SASL.GSSAPI.Realm = "EXAMPLE.COM"
+	conf.Net.SASL.GSSAPI.Username = "kafka"
+	conf.Net.SASL.GSSAPI.Password = "kafka"
+	conf.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+	conf.Version = V2_2_0_0
+
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = broker.Close() })
+
+	if connected, err := broker.Connected(); err != nil || !connected {
+		t.Fatal(err)
+	}
+
+	// the AP_REQ and the final wrap token
+	actualSaslAuthRequests := countSaslAuthRequests()
+	if actualSaslAuthRequests != 2 {
+		t.Fatalf("unexpected number of SaslAuthRequests during initial authentication: %d", actualSaslAuthRequests)
+	}
+
+	timeout := time.After(time.Duration(sessionLifetimeMs) * time.Millisecond * 5)
+
+loop:
+	for actualSaslAuthRequests < 4 {
+		select {
+		case <-timeout:
+			break loop
+		default:
+			time.Sleep(10 * time.Millisecond)
+			// put some traffic on the wire
+			if _, err := broker.ApiVersions(&ApiVersionsRequest{}); err != nil {
+				t.Fatal(err)
+			}
+			actualSaslAuthRequests = countSaslAuthRequests()
+		}
+	}
+
+	if actualSaslAuthRequests < 4 {
+		t.Fatalf("sasl reauth has not occurred within expected timeframe")
+	}
+}
+
 // We're not testing encoding/decoding here, so most of the requests/responses will be empty for simplicity's sake
 var brokerTestTable = []struct {
 	version  KafkaVersion
@@ -1438,6 +1830,386 @@ func BenchmarkBroker_No_Metrics_Open(b *testing.B) {
 	}
 }
 
+func TestBrokerMaxResponseSize(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var length [4]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		// advertise a 64MiB response for correlation ID 0 but never send it
+		header := []byte{0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+		_, _ = conn.Write(header)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	conf := NewTestConfig()
+	conf.ApiVersionsRequest = false
+	conf.Net.MaxResponseSize = 1024 * 1024
+	broker := NewBroker(ln.Addr().String())
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	_, err = broker.GetMetadata(&MetadataRequest{})
+	var decodingErr PacketDecodingError
+	if !errors.As(err, &decodingErr) {
+		t.Fatalf("expected PacketDecodingError for an oversized response, got %v", err)
+	}
+}
+
+func TestBrokerConnectionMaxAge(t *testing.T) {
+	mb := NewMockBroker(t, 0)
+	defer mb.Close()
+	mb.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).SetBroker(mb.Addr(), mb.BrokerID()),
+	})
+
+	conf := NewTestConfig()
+	conf.ApiVersionsRequest = false
+	conf.Net.ConnectionMaxAge = time.Hour
+	broker := NewBroker(mb.Addr())
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	if _, err := broker.GetMetadata(&MetadataRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	broker.lock.Lock()
+	conn := broker.conn
+	broker.lock.Unlock()
+
+	// a young connection is reused
+	if _, err := broker.GetMetadata(&MetadataRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	broker.lock.Lock()
+	if broker.conn != conn {
+		t.Error("expected the connection to be reused before it reached Net.ConnectionMaxAge")
+	}
+	// pretend the connection was opened long enough ago to be recycled
+	broker.connectedAt = time.Now().Add(-2 * conf.Net.ConnectionMaxAge)
+	broker.lock.Unlock()
+
+	if _, err := broker.GetMetadata(&MetadataRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	if broker.conn == conn {
+		t.Error("expected a connection older than Net.ConnectionMaxAge to be replaced")
+	}
+	if time.Since(broker.connectedAt) > time.Minute {
+		t.Error("expected the connection time to be reset on reconnect")
+	}
+}
+
+type recordingBrokerInterceptor struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (r *recordingBrokerInterceptor) BeforeRequest(apiKey, version int16, broker *Broker) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls = append(r.calls, fmt.Sprintf("before %d v%d %s", apiKey, version, broker.Addr()))
+}
+
+func (r *recordingBrokerInterceptor) AfterResponse(apiKey, version int16, broker *Broker, err error, latency time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if latency < 0 {
+		err = fmt.Errorf("negative latency %v", latency)
+	}
+	r.calls = append(r.calls, fmt.Sprintf("after %d v%d %s %v", apiKey, version, broker.Addr(), err))
+}
+
+type panickyBrokerInterceptor struct{}
+
+func (panickyBrokerInterceptor) BeforeRequest(int16, int16, *Broker) { panic("before") }
+
+func (panickyBrokerInterceptor) AfterResponse(int16, int16, *Broker, error, time.Duration) {
+	panic("after")
+}
+
+func TestBrokerInterceptors(t *testing.T) {
+	mb := NewMockBroker(t, 0)
+	defer mb.Close()
+	mb.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).SetBroker(mb.Addr(), mb.BrokerID()),
+	})
+
+	recorder := &recordingBrokerInterceptor{}
+	conf := NewTestConfig()
+	conf.ApiVersionsRequest = false
+	conf.Net.Interceptors = []BrokerInterceptor{panickyBrokerInterceptor{}, recorder}
+	broker := NewBroker(mb.Addr())
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	request := &MetadataRequest{}
+	if _, err := broker.GetMetadata(request); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		fmt.Sprintf("before 3 v%d %s", request.version(), mb.Addr()),
+		fmt.Sprintf("after 3 v%d %s <nil>", request.version(), mb.Addr()),
+	}
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if !reflect.DeepEqual(recorder.calls, expected) {
+		t.Errorf("expected the interceptors to be called with %q, got %q", expected, recorder.calls)
+	}
+}
+
+func TestBrokerGoroutinesMetric(t *testing.T) {
+	conf := NewTestConfig()
+	conf.ApiVersionsRequest = false
+	goroutines := metrics.GetOrRegisterCounter("goroutines", conf.MetricRegistry)
+	expectGoroutines := func(expected int64) {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			if goroutines.Count() == expected {
+				return
+			}
+		}
+		t.Errorf("expected %d goroutines, got %d", expected, goroutines.Count())
+	}
+
+	var brokers []*Broker
+	for i := int32(0); i < 2; i++ {
+		mb := NewMockBroker(t, i)
+		defer mb.Close()
+		broker := NewBroker(mb.Addr())
+		if err := broker.Open(conf); err != nil {
+			t.Fatal(err)
+		}
+		if connected, err := broker.Connected(); !connected {
+			t.Fatal(err)
+		}
+		brokers = append(brokers, broker)
+	}
+	// a response receiver per connection
+	expectGoroutines(2)
+
+	safeClose(t, brokers[0])
+	expectGoroutines(1)
+	safeClose(t, brokers[1])
+	expectGoroutines(0)
+}
+
+func TestBrokerMaxConnectionGoroutines(t *testing.T) {
+	conf := NewTestConfig()
+	conf.ApiVersionsRequest = false
+	conf.Net.MaxConnectionGoroutines = 1
+
+	mb0 := NewMockBroker(t, 0)
+	defer mb0.Close()
+	mb1 := NewMockBroker(t, 1)
+	defer mb1.Close()
+
+	broker0 := NewBroker(mb0.Addr())
+	if err := broker0.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	if connected, err := broker0.Connected(); !connected {
+		t.Fatal(err)
+	}
+
+	broker1 := NewBroker(mb1.Addr())
+	if err := broker1.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker1.Connected(); !errors.Is(err, ErrMaxConnectionGoroutines) {
+		t.Fatalf("expected ErrMaxConnectionGoroutines beyond the limit, got %v", err)
+	}
+
+	// closing a connection frees its goroutine for another one
+	safeClose(t, broker0)
+	if err := broker1.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	if connected, err := broker1.Connected(); !connected {
+		t.Fatal(err)
+	}
+	safeClose(t, broker1)
+}
+
+func TestBrokerInFlightOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    InFlightOverflowPolicy
+		queueSize int
+		// the outcome of each of three concurrent requests, the first of which
+		// is outstanding while the others are sent
+		expected []error
+	}{
+		{name: "block", policy: InFlightBlock, expected: []error{nil, nil, nil}},
+		{name: "fail fast", policy: InFlightFailFast, expected: []error{nil, ErrTooManyInFlight, ErrTooManyInFlight}},
+		{name: "queue", policy: InFlightQueue, queueSize: 1, expected: []error{nil, nil, ErrTooManyInFlight}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb := NewMockBroker(t, 0)
+			defer mb.Close()
+			mb.SetLatency(100 * time.Millisecond)
+			mb.SetHandlerByMap(map[string]MockResponse{
+				"ProduceRequest": NewMockProduceResponse(t),
+			})
+
+			conf := NewTestConfig()
+			conf.ApiVersionsRequest = false
+			conf.Net.MaxOpenRequests = 1
+			conf.Net.InFlightOverflowPolicy = tt.policy
+			conf.Net.InFlightQueueSize = tt.queueSize
+			broker := NewBroker(mb.Addr())
+			if err := broker.Open(conf); err != nil {
+				t.Fatal(err)
+			}
+			defer broker.Close()
+
+			results := make(chan error, len(tt.expected))
+			produce := func() error {
+				request := &ProduceRequest{RequiredAcks: WaitForLocal}
+				return broker.AsyncProduce(request, func(_ *ProduceResponse, err error) {
+					results <- err
+				})
+			}
+
+			sendErrs := make([]chan error, len(tt.expected))
+			for i := range tt.expected {
+				sendErrs[i] = make(chan error, 1)
+				go func(i int) {
+					sendErrs[i] <- produce()
+				}(i)
+				// wait for the request to be accounted for, unless it failed
+				for atomic.LoadInt32(&broker.pending) <= int32(i) && len(sendErrs[i]) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+
+			succeeded := 0
+			for i, expected := range tt.expected {
+				select {
+				case err := <-sendErrs[i]:
+					if !errors.Is(err, expected) {
+						t.Errorf("request %d: expected %v, got %v", i, expected, err)
+					}
+					if err == nil {
+						succeeded++
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("request %d: timed out", i)
+				}
+			}
+			for i := 0; i < succeeded; i++ {
+				select {
+				case err := <-results:
+					if err != nil {
+						t.Error(err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for a response")
+				}
+			}
+		})
+	}
+}
+
+func TestBrokerRequestTimeouts(t *testing.T) {
+	mb := NewMockBroker(t, 0)
+	defer mb.Close()
+	mb.SetLatency(200 * time.Millisecond)
+	mb.SetHandlerByMap(map[string]MockResponse{
+		"FetchRequest":    NewMockFetchResponse(t, 1),
+		"MetadataRequest": NewMockMetadataResponse(t).SetBroker(mb.Addr(), mb.BrokerID()),
+	})
+
+	conf := NewTestConfig()
+	conf.ApiVersionsRequest = false
+	conf.Net.ReadTimeout = 50 * time.Millisecond
+	conf.Net.RequestTimeouts = map[int16]time.Duration{
+		1: time.Second, // fetch
+	}
+	broker := NewBroker(mb.Addr())
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	// the fetch is allowed to take longer than Net.ReadTimeout
+	if _, err := broker.Fetch(&FetchRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// whereas the metadata request is not
+	_, err := broker.GetMetadata(&MetadataRequest{})
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Errorf("expected the metadata request to time out, got %v", err)
+	}
+}
+
+func TestBrokerPingNotConnected(t *testing.T) {
+	broker := NewBroker("localhost:0")
+	if _, err := broker.Ping(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected pinging an unopened broker, got %v", err)
+	}
+}
+
+func TestBrokerConnection(t *testing.T) {
+	mb := NewMockBroker(t, 0)
+	defer mb.Close()
+
+	broker := NewBroker(mb.Addr())
+	if _, _, err := broker.Connection(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected before opening the broker, got %v", err)
+	}
+
+	if err := broker.Open(NewTestConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Connected(); err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote, err := broker.Connection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.String() != mb.Addr() {
+		t.Errorf("expected remote address %s, got %s", mb.Addr(), remote)
+	}
+	if local == nil || local.String() == remote.String() {
+		t.Errorf("unexpected local address %v", local)
+	}
+
+	safeClose(t, broker)
+	if _, _, err := broker.Connection(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected after closing the broker, got %v", err)
+	}
+}
+
 func Test_handleThrottledResponse(t *testing.T) {
 	mb := NewMockBroker(nil, 0)
 	defer mb.Close()
@@ -0,0 +1,127 @@
+package sarama
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit breaker of a Broker, see
+// Config.Net.CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets requests through, the broker being healthy.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails requests with ErrBrokerCircuitOpen, the broker having
+	// failed Net.CircuitBreaker.Failures times in a row.
+	CircuitOpen
+	// CircuitHalfOpen lets requests through to probe the broker once the
+	// cooldown elapsed. The next success closes the circuit, the next failure
+	// opens it again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker counts the consecutive connection and request failures of a
+// broker, opening its circuit beyond the configured threshold.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	failures  int // the threshold, 0 if disabled
+	cooldown  time.Duration
+	clock     clock
+	onChange  func(CircuitState)
+	failed    int       // consecutive failures
+	openUntil time.Time // zero while closed
+	halfOpen  bool
+}
+
+// configure sets the thresholds, once the broker is opened.
+func (cb *circuitBreaker) configure(conf *Config, onChange func(CircuitState)) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.failures = conf.Net.CircuitBreaker.Failures
+	cb.cooldown = conf.Net.CircuitBreaker.Cooldown
+	cb.clock = conf.getClock()
+	cb.onChange = onChange
+}
+
+// state returns the state of the circuit, half-opening it once the cooldown
+// elapsed.
+func (cb *circuitBreaker) state() CircuitState {
+	cb.lock.Lock()
+	state, changed := cb.stateLocked()
+	onChange := cb.onChange
+	cb.lock.Unlock()
+
+	if changed && onChange != nil {
+		onChange(state)
+	}
+	return state
+}
+
+func (cb *circuitBreaker) stateLocked() (state CircuitState, changed bool) {
+	switch {
+	case cb.openUntil.IsZero():
+		return CircuitClosed, false
+	case cb.halfOpen:
+		return CircuitHalfOpen, false
+	case cb.clock.Now().Before(cb.openUntil):
+		return CircuitOpen, false
+	default:
+		cb.halfOpen = true
+		return CircuitHalfOpen, true
+	}
+}
+
+// allow returns ErrBrokerCircuitOpen while the circuit is open.
+func (cb *circuitBreaker) allow() error {
+	if cb.state() == CircuitOpen {
+		return ErrBrokerCircuitOpen
+	}
+	return nil
+}
+
+// record records the outcome of a connection attempt or request, err being
+// nil on success.
+func (cb *circuitBreaker) record(err error) {
+	cb.lock.Lock()
+	if cb.failures <= 0 {
+		cb.lock.Unlock()
+		return
+	}
+
+	var state CircuitState
+	changed := false
+	if err == nil {
+		cb.failed = 0
+		if !cb.openUntil.IsZero() {
+			cb.openUntil, cb.halfOpen = time.Time{}, false
+			state, changed = CircuitClosed, true
+		}
+	} else {
+		cb.failed++
+		current, _ := cb.stateLocked()
+		if current == CircuitHalfOpen || (current == CircuitClosed && cb.failed >= cb.failures) {
+			cb.openUntil, cb.halfOpen = cb.clock.Now().Add(cb.cooldown), false
+			state, changed = CircuitOpen, true
+		}
+	}
+	onChange := cb.onChange
+	cb.lock.Unlock()
+
+	if changed && onChange != nil {
+		onChange(state)
+	}
+}
@@ -0,0 +1,89 @@
+package sarama
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var states []CircuitState
+	clock := newFakeClock()
+	conf := NewTestConfig()
+	conf.clock = clock
+	conf.Net.CircuitBreaker.Failures = 2
+	conf.Net.CircuitBreaker.Cooldown = time.Minute
+	var cb circuitBreaker
+	cb.configure(conf, func(state CircuitState) { states = append(states, state) })
+
+	failure := errors.New("failure")
+	cb.record(failure)
+	cb.record(nil)
+	cb.record(failure)
+	if err := cb.allow(); err != nil {
+		t.Fatalf("expected the failures to be consecutive to open the circuit, got %v", err)
+	}
+	cb.record(failure)
+	if err := cb.allow(); !errors.Is(err, ErrBrokerCircuitOpen) {
+		t.Fatalf("expected the circuit to open, got %v", err)
+	}
+
+	// a failed probe opens the circuit again, a successful one closes it
+	clock.Advance(time.Minute)
+	if err := cb.allow(); err != nil {
+		t.Fatalf("expected the circuit to half-open after the cooldown, got %v", err)
+	}
+	cb.record(failure)
+	if state := cb.state(); state != CircuitOpen {
+		t.Fatalf("expected the failed probe to open the circuit, got %s", state)
+	}
+	clock.Advance(time.Minute)
+	cb.record(nil)
+	if state := cb.state(); state != CircuitClosed {
+		t.Fatalf("expected the successful probe to close the circuit, got %s", state)
+	}
+
+	expected := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitClosed}
+	if !reflect.DeepEqual(states, expected) {
+		t.Errorf("expected the state changes %v, got %v", expected, states)
+	}
+}
+
+func TestBrokerCircuitBreaker(t *testing.T) {
+	mb := NewMockBroker(t, 1)
+	addr := mb.Addr()
+	mb.Close()
+
+	conf := NewTestConfig()
+	conf.Net.DialTimeout = 100 * time.Millisecond
+	conf.Net.CircuitBreaker.Failures = 2
+	broker := NewBroker(addr)
+	for i := 0; i < 2; i++ {
+		if err := broker.Open(conf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := broker.Connected(); err == nil || errors.Is(err, ErrBrokerCircuitOpen) {
+			t.Fatalf("expected attempt %d to fail to connect, got %v", i, err)
+		}
+	}
+
+	// the open circuit fails fast, without dialing
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Connected(); !errors.Is(err, ErrBrokerCircuitOpen) {
+		t.Errorf("expected ErrBrokerCircuitOpen, got %v", err)
+	}
+	if _, err := broker.GetMetadata(&MetadataRequest{}); !errors.Is(err, ErrBrokerCircuitOpen) {
+		t.Errorf("expected ErrBrokerCircuitOpen, got %v", err)
+	}
+
+	// brokers whose circuit is open are picked last
+	healthy := NewBroker("localhost:0")
+	for i := 0; i < 10; i++ {
+		if best := leastLoadedBroker(map[int32]*Broker{1: broker, 2: healthy}); best != healthy {
+			t.Fatalf("expected the healthy broker to be picked, got %s", best.Addr())
+		}
+	}
+}
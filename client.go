@@ -3,7 +3,6 @@ package sarama
 import (
 	"context"
 	"errors"
-	"math"
 	"math/rand"
 	"net"
 	"sort"
@@ -37,9 +36,20 @@ type Client interface {
 	// Brokers returns the current set of active brokers as retrieved from cluster metadata.
 	Brokers() []*Broker
 
+	// BrokerStates returns the state of the current set of active brokers,
+	// sorted by broker ID, showing which of them the client is connected to.
+	// It returns nil once the client has been closed.
+	BrokerStates() []BrokerState
+
 	// Broker returns the active Broker if available for the broker ID.
 	Broker(brokerID int32) (*Broker, error)
 
+	// Ping checks that the broker with the given ID is reachable by sending it
+	// an ApiVersions request, opening the connection first if needed. It
+	// returns the round-trip latency of the request. Requires Kafka 0.10 or
+	// higher.
+	Ping(brokerID int32) (time.Duration, error)
+
 	// Topics returns the set of available topics as retrieved from cluster metadata.
 	Topics() ([]string, error)
 
@@ -59,6 +69,13 @@ type Client interface {
 	// topic/partition, as determined by querying the cluster metadata.
 	LeaderAndEpoch(topic string, partitionID int32) (*Broker, int32, error)
 
+	// LeaderForKey returns the partition a message with the given key would be
+	// produced to by a producer with the same configuration, chosen by the
+	// Producer.Partitioner from the current metadata, along with the leader of
+	// that partition. The answer is only stable for partitioners mapping keys
+	// consistently, like the default hash partitioner with a non-nil key.
+	LeaderForKey(topic string, key []byte) (partition int32, broker *Broker, err error)
+
 	// Replicas returns the set of all replica IDs for the given partition.
 	Replicas(topic string, partitionID int32) ([]int32, error)
 
@@ -81,12 +98,38 @@ type Client interface {
 	// metadata for all topics.
 	RefreshMetadata(topics ...string) error
 
+	// RegisterTopics adds topics to the set whose metadata is kept up to date by
+	// the periodic metadata refresh and fetches their metadata right away, so
+	// that their first use does not have to wait for it.
+	RegisterTopics(topics ...string) error
+
+	// UnregisterTopics removes topics from the set whose metadata is kept up to
+	// date by the periodic metadata refresh and drops their cached metadata.
+	// A topic is tracked again as soon as its metadata is requested.
+	UnregisterTopics(topics ...string) error
+
 	// GetOffset queries the cluster to get the most recent available offset at the
 	// given time (in milliseconds) on the topic/partition combination.
 	// Time should be OffsetOldest for the earliest available offset,
 	// OffsetNewest for the offset of the message that will be produced next, or a time.
 	GetOffset(topic string, partitionID int32, time int64) (int64, error)
 
+	// GetOffsets queries the cluster, like GetOffset, for the offsets at the
+	// given time of all the partitions of the topic, batching the partitions
+	// led by the same broker in one request and querying the leaders in
+	// parallel.
+	GetOffsets(topic string, time int64) (map[int32]int64, error)
+
+	// OffsetForLeaderEpoch queries the leader of the topic/partition for the end
+	// offset of the given leader epoch, i.e. the offset the next epoch started at.
+	// It returns the end offset along with the epoch it belongs to, which is the
+	// largest known epoch not greater than leaderEpoch. Both are -1 if the epoch
+	// is older than the log. A consumer whose position lies beyond the end offset
+	// of the epoch of the last record it consumed knows that the log was truncated,
+	// e.g. after an unclean leader election. This function only works on
+	// Kafka 0.11 and higher.
+	OffsetForLeaderEpoch(topic string, partitionID int32, leaderEpoch int32) (endOffset int64, epoch int32, err error)
+
 	// Coordinator returns the coordinating broker for a consumer group. It will
 	// return a locally cached value if it's available. You can call
 	// RefreshCoordinator to update the cached value. This function only works on
@@ -110,7 +153,11 @@ type Client interface {
 	// InitProducerID retrieves information required for Idempotent Producer
 	InitProducerID() (*InitProducerIDResponse, error)
 
-	// LeastLoadedBroker retrieves broker that has the least responses pending
+	// LeastLoadedBroker retrieves the broker that has the fewest requests in
+	// flight, preferring brokers that are already connected. It is used for
+	// metadata and admin requests so they are spread across the cluster
+	// rather than all going to the same broker. It returns nil once the client
+	// has been closed.
 	LeastLoadedBroker() *Broker
 
 	// Close shuts down all broker connections managed by this client. It is required
@@ -119,7 +166,8 @@ type Client interface {
 	// before you close the client.
 	Close() error
 
-	// Closed returns true if the client has already had Close called on it
+	// Closed returns true if the client has already had Close called on it.
+	// Once closed, all methods that return an error return ErrClosedClient.
 	Closed() bool
 }
 
@@ -144,6 +192,12 @@ type client struct {
 
 	conf           *Config
 	closer, closed chan none // for shutting down background metadata updater
+	// connecting is done once connectBrokers returns, so that Close does not
+	// close the brokers while they are being opened
+	connecting sync.WaitGroup
+	// ctx is cancelled on Close, interrupting the authentication with the brokers
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	// the broker addresses given to us through the constructor are not guaranteed to be returned in
 	// the cluster metadata (I *think* it only returns brokers who are currently leading partitions?)
@@ -162,7 +216,20 @@ type client struct {
 	// so the result is cached.  It is important to update this value whenever metadata is changed
 	cachedPartitionsResults map[string][maxPartitionIndex][]int32
 
+	// registeredTopics are the topics registered through RegisterTopics, whose
+	// metadata is never evicted. The metadata of the other topics is evicted
+	// beyond Metadata.MaxCachedTopics, in the order of topicLRU (nil if
+	// unbounded), and fetched again on demand.
+	registeredTopics map[string]none
+	topicLRU         *topicLRU
+
 	lock sync.RWMutex // protects access to the maps that hold cluster state.
+
+	refreshLock    sync.Mutex            // protects pendingRefresh
+	pendingRefresh *metadataRefreshBatch // collects the RefreshMetadata calls to coalesce, if any
+
+	// brokerSelected, if set, is called with each broker chosen by LeastLoadedBroker.
+	brokerSelected func(*Broker)
 }
 
 // NewClient creates a new Client. It connects to one of the given broker addresses
@@ -198,14 +265,20 @@ func NewClient(addrs []string, conf *Config) (Client, error) {
 		metadata:                make(map[string]map[int32]*PartitionMetadata),
 		metadataTopics:          make(map[string]none),
 		cachedPartitionsResults: make(map[string][maxPartitionIndex][]int32),
+		registeredTopics:        make(map[string]none),
 		coordinators:            make(map[string]int32),
 		transactionCoordinators: make(map[string]int32),
 	}
+	if conf.Metadata.MaxCachedTopics > 0 {
+		client.topicLRU = newTopicLRU(conf.Metadata.MaxCachedTopics)
+	}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
 
 	if conf.Net.ResolveCanonicalBootstrapServers {
 		var err error
 		addrs, err = client.resolveCanonicalNames(addrs)
 		if err != nil {
+			client.cancel()
 			return nil, err
 		}
 	}
@@ -225,7 +298,14 @@ func NewClient(addrs []string, conf *Config) (Client, error) {
 			return nil, err
 		}
 	}
-	go withRecover(client.backgroundMetadataUpdater)
+	goWithRecover(conf.MetricRegistry, client.backgroundMetadataUpdater)
+	if conf.Net.MaxConcurrentConnects > 0 {
+		client.connecting.Add(1)
+		goWithRecover(conf.MetricRegistry, func() {
+			defer client.connecting.Done()
+			client.connectBrokers()
+		})
+	}
 
 	DebugLogger.Println("Successfully initialized new client")
 
@@ -246,9 +326,46 @@ func (client *client) Brokers() []*Broker {
 	return brokers
 }
 
+// BrokerState describes a broker known to a client.
+type BrokerState struct {
+	ID   int32
+	Addr string
+	// Connected is true if the client has an open connection to the broker.
+	Connected bool
+	// Err is the error of the last attempt to connect to the broker, if any.
+	Err error
+	// Circuit is the state of the circuit breaker of the broker, always
+	// CircuitClosed unless Net.CircuitBreaker is enabled.
+	Circuit CircuitState
+}
+
+func (client *client) BrokerStates() []BrokerState {
+	brokers := client.Brokers()
+	if len(brokers) == 0 {
+		return nil
+	}
+
+	states := make([]BrokerState, 0, len(brokers))
+	for _, broker := range brokers {
+		connected, err := broker.Connected()
+		states = append(states, BrokerState{
+			ID:        broker.ID(),
+			Addr:      broker.Addr(),
+			Connected: connected,
+			Err:       err,
+			Circuit:   broker.circuit.state(),
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states
+}
+
 func (client *client) Broker(brokerID int32) (*Broker, error) {
 	client.lock.RLock()
 	defer client.lock.RUnlock()
+	if client.brokers == nil {
+		return nil, ErrClosedClient
+	}
 	broker, ok := client.brokers[brokerID]
 	if !ok {
 		return nil, ErrBrokerNotFound
@@ -257,8 +374,24 @@ func (client *client) Broker(brokerID int32) (*Broker, error) {
 	return broker, nil
 }
 
+func (client *client) Ping(brokerID int32) (time.Duration, error) {
+	if client.Closed() {
+		return 0, ErrClosedClient
+	}
+
+	broker, err := client.Broker(brokerID)
+	if err != nil {
+		return 0, err
+	}
+	return broker.Ping()
+}
+
 func (client *client) InitProducerID() (*InitProducerIDResponse, error) {
 	// FIXME: this InitProducerID seems to only be called from client_test.go (TestInitProducerIDConnectionRefused) and has been superceded by transaction_manager.go?
+	if client.Closed() {
+		return nil, ErrClosedClient
+	}
+
 	brokerErrors := make([]error, 0)
 	for broker := client.LeastLoadedBroker(); broker != nil; broker = client.LeastLoadedBroker() {
 		request := &InitProducerIDRequest{}
@@ -301,19 +434,21 @@ func (client *client) Close() error {
 	}
 
 	// shutdown and wait for the background thread before we take the lock, to avoid races
+	client.cancel()
 	close(client.closer)
 	<-client.closed
+	client.connecting.Wait()
 
 	client.lock.Lock()
 	defer client.lock.Unlock()
 	DebugLogger.Println("Closing Client")
 
 	for _, broker := range client.brokers {
-		safeAsyncClose(broker)
+		safeAsyncClose(broker, client.conf.MetricRegistry)
 	}
 
 	for _, broker := range client.seedBrokers {
-		safeAsyncClose(broker)
+		safeAsyncClose(broker, client.conf.MetricRegistry)
 	}
 
 	client.brokers = nil
@@ -362,6 +497,44 @@ func (client *client) MetadataTopics() ([]string, error) {
 	return ret, nil
 }
 
+func (client *client) RegisterTopics(topics ...string) error {
+	client.lock.Lock()
+	if client.brokers == nil {
+		client.lock.Unlock()
+		return ErrClosedClient
+	}
+	for _, topic := range topics {
+		client.metadataTopics[topic] = none{}
+		client.registeredTopics[topic] = none{}
+		client.topicLRU.remove(topic)
+	}
+	client.lock.Unlock()
+
+	if len(topics) == 0 {
+		return nil
+	}
+
+	return client.RefreshMetadata(topics...)
+}
+
+func (client *client) UnregisterTopics(topics ...string) error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if client.brokers == nil {
+		return ErrClosedClient
+	}
+
+	for _, topic := range topics {
+		delete(client.metadataTopics, topic)
+		delete(client.registeredTopics, topic)
+		delete(client.metadata, topic)
+		delete(client.cachedPartitionsResults, topic)
+		client.topicLRU.remove(topic)
+	}
+	return nil
+}
+
 func (client *client) Partitions(topic string) ([]int32, error) {
 	if client.Closed() {
 		return nil, ErrClosedClient
@@ -510,6 +683,39 @@ func (client *client) LeaderAndEpoch(topic string, partitionID int32) (*Broker,
 	return leader, epoch, err
 }
 
+func (client *client) LeaderForKey(topic string, key []byte) (int32, *Broker, error) {
+	if client.Closed() {
+		return -1, nil, ErrClosedClient
+	}
+
+	msg := &ProducerMessage{Topic: topic}
+	if key != nil {
+		msg.Key = ByteEncoder(key)
+	}
+
+	partitioner := client.conf.Producer.Partitioner(topic)
+	var partitions []int32
+	var err error
+	if messageRequiresConsistency(partitioner, msg) {
+		partitions, err = client.Partitions(topic)
+	} else {
+		partitions, err = client.WritablePartitions(topic)
+	}
+	if err != nil {
+		return -1, nil, err
+	}
+
+	partition, err := choosePartition(client.conf, partitioner, msg, partitions)
+	if err != nil {
+		return -1, nil, err
+	}
+	leader, err := client.Leader(topic, partition)
+	if err != nil {
+		return -1, nil, err
+	}
+	return partition, leader, nil
+}
+
 func (client *client) RefreshBrokers(addrs []string) error {
 	if client.Closed() {
 		return ErrClosedClient
@@ -519,16 +725,16 @@ func (client *client) RefreshBrokers(addrs []string) error {
 	defer client.lock.Unlock()
 
 	for _, broker := range client.brokers {
-		safeAsyncClose(broker)
+		safeAsyncClose(broker, client.conf.MetricRegistry)
 	}
 	client.brokers = make(map[int32]*Broker)
 
 	for _, broker := range client.seedBrokers {
-		safeAsyncClose(broker)
+		safeAsyncClose(broker, client.conf.MetricRegistry)
 	}
 
 	for _, broker := range client.deadSeeds {
-		safeAsyncClose(broker)
+		safeAsyncClose(broker, client.conf.MetricRegistry)
 	}
 
 	client.seedBrokers = nil
@@ -555,11 +761,65 @@ func (client *client) RefreshMetadata(topics ...string) error {
 
 	deadline := time.Time{}
 	if client.conf.Metadata.Timeout > 0 {
-		deadline = time.Now().Add(client.conf.Metadata.Timeout)
+		deadline = client.conf.getClock().Now().Add(client.conf.Metadata.Timeout)
+	}
+	if client.conf.Metadata.RefreshCoalesceWindow > 0 {
+		return client.coalesceRefreshMetadata(topics, deadline)
 	}
 	return client.tryRefreshMetadata(topics, client.conf.Metadata.Retry.Max, deadline)
 }
 
+// metadataRefreshBatch is a metadata refresh shared by the RefreshMetadata
+// calls made within Metadata.RefreshCoalesceWindow of each other.
+type metadataRefreshBatch struct {
+	topics    map[string]none
+	allTopics bool
+	done      chan none
+	err       error // only set once done is closed
+}
+
+// coalesceRefreshMetadata joins the pending metadata refresh batch, or starts
+// a new one which it refreshes once the window elapsed, and returns its result.
+func (client *client) coalesceRefreshMetadata(topics []string, deadline time.Time) error {
+	client.refreshLock.Lock()
+	batch := client.pendingRefresh
+	leader := batch == nil
+	if leader {
+		batch = &metadataRefreshBatch{topics: make(map[string]none), done: make(chan none)}
+		client.pendingRefresh = batch
+	}
+	if len(topics) == 0 {
+		batch.allTopics = true
+	}
+	for _, topic := range topics {
+		batch.topics[topic] = none{}
+	}
+	client.refreshLock.Unlock()
+
+	if !leader {
+		<-batch.done
+		return batch.err
+	}
+
+	client.conf.getClock().Sleep(client.conf.Metadata.RefreshCoalesceWindow)
+
+	// calls made from now on need a refresh of their own
+	client.refreshLock.Lock()
+	client.pendingRefresh = nil
+	client.refreshLock.Unlock()
+
+	var batchTopics []string
+	if !batch.allTopics {
+		batchTopics = make([]string, 0, len(batch.topics))
+		for topic := range batch.topics {
+			batchTopics = append(batchTopics, topic)
+		}
+	}
+	batch.err = client.tryRefreshMetadata(batchTopics, client.conf.Metadata.Retry.Max, deadline)
+	close(batch.done)
+	return batch.err
+}
+
 func (client *client) GetOffset(topic string, partitionID int32, timestamp int64) (int64, error) {
 	if client.Closed() {
 		return -1, ErrClosedClient
@@ -576,6 +836,42 @@ func (client *client) GetOffset(topic string, partitionID int32, timestamp int64
 	return offset, err
 }
 
+func (client *client) GetOffsets(topic string, timestamp int64) (map[int32]int64, error) {
+	if client.Closed() {
+		return nil, ErrClosedClient
+	}
+
+	offsets, err := client.getOffsets(topic, timestamp)
+	if err != nil {
+		if err := client.RefreshMetadata(topic); err != nil {
+			return nil, err
+		}
+		return client.getOffsets(topic, timestamp)
+	}
+
+	return offsets, err
+}
+
+func (client *client) OffsetForLeaderEpoch(topic string, partitionID int32, leaderEpoch int32) (int64, int32, error) {
+	if client.Closed() {
+		return -1, -1, ErrClosedClient
+	}
+
+	if !client.conf.Version.IsAtLeast(V0_11_0_0) {
+		return -1, -1, ErrUnsupportedVersion
+	}
+
+	endOffset, epoch, err := client.offsetForLeaderEpoch(topic, partitionID, leaderEpoch)
+	if err != nil {
+		if err := client.RefreshMetadata(topic); err != nil {
+			return -1, -1, err
+		}
+		return client.offsetForLeaderEpoch(topic, partitionID, leaderEpoch)
+	}
+
+	return endOffset, epoch, nil
+}
+
 func (client *client) Controller() (*Broker, error) {
 	if client.Closed() {
 		return nil, ErrClosedClient
@@ -716,7 +1012,9 @@ func (client *client) RefreshTransactionCoordinator(transactionID string) error
 func (client *client) randomizeSeedBrokers(addrs []string) {
 	random := rand.New(rand.NewSource(time.Now().UnixNano()))
 	for _, index := range random.Perm(len(addrs)) {
-		client.seedBrokers = append(client.seedBrokers, NewBroker(addrs[index]))
+		broker := NewBroker(addrs[index])
+		broker.authCtx = client.ctx
+		client.seedBrokers = append(client.seedBrokers, broker)
 	}
 }
 
@@ -726,10 +1024,12 @@ func (client *client) updateBroker(brokers []*Broker) {
 	for _, broker := range brokers {
 		currentBroker[broker.ID()] = broker
 		if client.brokers[broker.ID()] == nil { // add new broker
+			broker.authCtx = client.ctx
 			client.brokers[broker.ID()] = broker
 			DebugLogger.Printf("client/brokers registered new broker #%d at %s", broker.ID(), broker.Addr())
 		} else if broker.Addr() != client.brokers[broker.ID()].Addr() { // replace broker with new address
-			safeAsyncClose(client.brokers[broker.ID()])
+			safeAsyncClose(client.brokers[broker.ID()], client.conf.MetricRegistry)
+			broker.authCtx = client.ctx
 			client.brokers[broker.ID()] = broker
 			Logger.Printf("client/brokers replaced registered broker #%d with %s", broker.ID(), broker.Addr())
 		}
@@ -737,7 +1037,7 @@ func (client *client) updateBroker(brokers []*Broker) {
 
 	for id, broker := range client.brokers {
 		if _, exist := currentBroker[id]; !exist { // remove old broker
-			safeAsyncClose(broker)
+			safeAsyncClose(broker, client.conf.MetricRegistry)
 			delete(client.brokers, id)
 			Logger.Printf("client/broker remove invalid broker #%d with %s", broker.ID(), broker.Addr())
 		}
@@ -754,10 +1054,12 @@ func (client *client) registerBroker(broker *Broker) {
 	}
 
 	if client.brokers[broker.ID()] == nil {
+		broker.authCtx = client.ctx
 		client.brokers[broker.ID()] = broker
 		DebugLogger.Printf("client/brokers registered new broker #%d at %s", broker.ID(), broker.Addr())
 	} else if broker.Addr() != client.brokers[broker.ID()].Addr() {
-		safeAsyncClose(client.brokers[broker.ID()])
+		safeAsyncClose(client.brokers[broker.ID()], client.conf.MetricRegistry)
+		broker.authCtx = client.ctx
 		client.brokers[broker.ID()] = broker
 		Logger.Printf("client/brokers replaced registered broker #%d with %s", broker.ID(), broker.Addr())
 	}
@@ -794,27 +1096,49 @@ func (client *client) resurrectDeadBrokers() {
 // Firstly, choose the broker from cached broker list. If the broker list is empty, choose from seed brokers.
 func (client *client) LeastLoadedBroker() *Broker {
 	client.lock.RLock()
-	defer client.lock.RUnlock()
-
-	var leastLoadedBroker *Broker
-	pendingRequests := math.MaxInt
-	for _, broker := range client.brokers {
-		if pendingRequests > broker.ResponseSize() {
-			pendingRequests = broker.ResponseSize()
-			leastLoadedBroker = broker
-		}
+	if client.brokers == nil {
+		// closed
+		client.lock.RUnlock()
+		return nil
 	}
-	if leastLoadedBroker != nil {
-		_ = leastLoadedBroker.Open(client.conf)
-		return leastLoadedBroker
+	broker := leastLoadedBroker(client.brokers)
+	if broker == nil && len(client.seedBrokers) > 0 {
+		broker = client.seedBrokers[0]
 	}
+	client.lock.RUnlock()
 
-	if len(client.seedBrokers) > 0 {
-		_ = client.seedBrokers[0].Open(client.conf)
-		return client.seedBrokers[0]
+	if broker == nil {
+		return nil
+	}
+	_ = broker.Open(client.conf)
+	if client.brokerSelected != nil {
+		client.brokerSelected(broker)
 	}
+	return broker
+}
 
-	return leastLoadedBroker
+// leastLoadedBroker picks the broker with the fewest in-flight requests,
+// considering connected brokers first so that a request does not have to
+// wait on a new connection while an established one is idle, and brokers
+// whose circuit is open last. Ties are broken by map iteration order, which
+// spreads requests across equally loaded brokers.
+func leastLoadedBroker(brokers map[int32]*Broker) *Broker {
+	var best *Broker
+	var bestHealthy, bestConnected bool
+	var bestInFlight int64
+	for _, broker := range brokers {
+		healthy := broker.circuit.state() != CircuitOpen
+		connected, _ := broker.Connected()
+		inFlight := broker.inFlightRequests()
+		switch {
+		case best == nil,
+			healthy && !bestHealthy,
+			healthy == bestHealthy && connected && !bestConnected,
+			healthy == bestHealthy && connected == bestConnected && inFlight < bestInFlight:
+			best, bestHealthy, bestConnected, bestInFlight = broker, healthy, connected, inFlight
+		}
+	}
+	return best
 }
 
 // private caching/lazy metadata helpers
@@ -836,6 +1160,7 @@ func (client *client) cachedMetadata(topic string, partitionID int32) *Partition
 
 	partitions := client.metadata[topic]
 	if partitions != nil {
+		client.topicLRU.touch(topic)
 		return partitions[partitionID]
 	}
 
@@ -851,6 +1176,7 @@ func (client *client) cachedPartitions(topic string, partitionSet partitionType)
 	if !exists {
 		return nil
 	}
+	client.topicLRU.touch(topic)
 	return partitions[partitionSet]
 }
 
@@ -879,6 +1205,7 @@ func (client *client) cachedLeader(topic string, partitionID int32) (*Broker, in
 
 	partitions := client.metadata[topic]
 	if partitions != nil {
+		client.topicLRU.touch(topic)
 		metadata, ok := partitions[partitionID]
 		if ok {
 			if errors.Is(metadata.Err, ErrLeaderNotAvailable) {
@@ -902,6 +1229,80 @@ func (client *client) getOffset(topic string, partitionID int32, timestamp int64
 		return -1, err
 	}
 
+	request := client.newOffsetRequest()
+	request.AddBlock(topic, partitionID, timestamp, 1)
+
+	response, err := broker.GetAvailableOffsets(request)
+	if err != nil {
+		_ = broker.Close()
+		return -1, err
+	}
+
+	return offsetFromResponse(broker, response, topic, partitionID)
+}
+
+func (client *client) getOffsets(topic string, timestamp int64) (map[int32]int64, error) {
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make(map[*Broker]*OffsetRequest)
+	for _, partitionID := range partitions {
+		broker, err := client.Leader(topic, partitionID)
+		if err != nil {
+			return nil, err
+		}
+		request := requests[broker]
+		if request == nil {
+			request = client.newOffsetRequest()
+			requests[broker] = request
+		}
+		request.AddBlock(topic, partitionID, timestamp, 1)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		firstErr error
+	)
+	offsets := make(map[int32]int64, len(partitions))
+	for broker, request := range requests {
+		wg.Add(1)
+		broker, request := broker, request
+		goWithRecover(client.conf.MetricRegistry, func() {
+			defer wg.Done()
+			response, err := broker.GetAvailableOffsets(request)
+			if err != nil {
+				_ = broker.Close()
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			for partitionID := range request.blocks[topic] {
+				var offset int64
+				if err == nil {
+					offset, err = offsetFromResponse(broker, response, topic, partitionID)
+				}
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					return
+				}
+				offsets[partitionID] = offset
+			}
+		})
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return offsets, nil
+}
+
+func (client *client) newOffsetRequest() *OffsetRequest {
 	request := &OffsetRequest{}
 	if client.conf.Version.IsAtLeast(V2_1_0_0) {
 		// Version 4 adds the current leader epoch, which is used for fencing.
@@ -917,15 +1318,10 @@ func (client *client) getOffset(topic string, partitionID int32, timestamp int64
 		// offset can be returned.
 		request.Version = 1
 	}
+	return request
+}
 
-	request.AddBlock(topic, partitionID, timestamp, 1)
-
-	response, err := broker.GetAvailableOffsets(request)
-	if err != nil {
-		_ = broker.Close()
-		return -1, err
-	}
-
+func offsetFromResponse(broker *Broker, response *OffsetResponse, topic string, partitionID int32) (int64, error) {
 	block := response.GetBlock(topic, partitionID)
 	if block == nil {
 		_ = broker.Close()
@@ -941,6 +1337,79 @@ func (client *client) getOffset(topic string, partitionID int32, timestamp int64
 	return block.Offsets[0], nil
 }
 
+func (client *client) offsetForLeaderEpoch(topic string, partitionID int32, leaderEpoch int32) (int64, int32, error) {
+	broker, currentLeaderEpoch, err := client.LeaderAndEpoch(topic, partitionID)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	request := &OffsetForLeaderEpochRequest{}
+	if client.conf.Version.IsAtLeast(V2_3_0_0) {
+		// Version 3 adds the replica ID, which is always -1 for clients.
+		request.Version = 3
+	} else if client.conf.Version.IsAtLeast(V2_1_0_0) {
+		// Version 2 adds the current leader epoch, which is used for fencing.
+		request.Version = 2
+	} else if client.conf.Version.IsAtLeast(V2_0_0_0) {
+		// Version 1 returns the epoch the end offset belongs to.
+		request.Version = 1
+	}
+
+	request.AddBlock(topic, partitionID, currentLeaderEpoch, leaderEpoch)
+
+	response, err := broker.OffsetForLeaderEpoch(request)
+	if err != nil {
+		_ = broker.Close()
+		return -1, -1, err
+	}
+
+	block := response.GetBlock(topic, partitionID)
+	if block == nil {
+		_ = broker.Close()
+		return -1, -1, ErrIncompleteResponse
+	}
+	if !errors.Is(block.Err, ErrNoError) {
+		return -1, -1, block.Err
+	}
+
+	return block.EndOffset, block.LeaderEpoch, nil
+}
+
+// connectBrokers opens the registered brokers, at most
+// Net.MaxConcurrentConnects at a time, waiting for each to be connected (and
+// authenticated) before opening the next.
+func (client *client) connectBrokers() {
+	brokers := client.Brokers()
+	sem := make(chan none, client.conf.Net.MaxConcurrentConnects)
+	var wg sync.WaitGroup
+	for _, broker := range brokers {
+		select {
+		case sem <- none{}:
+		case <-client.closer:
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		broker := broker
+		goWithRecover(client.conf.MetricRegistry, func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			select {
+			case <-client.closer:
+				return
+			default:
+			}
+			_ = broker.Open(client.conf)
+			if _, err := broker.Connected(); err != nil {
+				Logger.Printf("client/brokers failed to connect to broker #%d at %s: %v", broker.ID(), broker.Addr(), err)
+			}
+		})
+	}
+	wg.Wait()
+}
+
 // core metadata update logic
 
 func (client *client) backgroundMetadataUpdater() {
@@ -950,12 +1419,12 @@ func (client *client) backgroundMetadataUpdater() {
 		return
 	}
 
-	ticker := time.NewTicker(client.conf.Metadata.RefreshFrequency)
+	ticker := client.conf.getClock().NewTicker(client.conf.Metadata.RefreshFrequency)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			if err := client.refreshMetadata(); err != nil {
 				Logger.Println("Client background metadata update:", err)
 			}
@@ -986,26 +1455,30 @@ func (client *client) refreshMetadata() error {
 }
 
 func (client *client) tryRefreshMetadata(topics []string, attemptsRemaining int, deadline time.Time) error {
+	clock := client.conf.getClock()
 	pastDeadline := func(backoff time.Duration) bool {
-		if !deadline.IsZero() && time.Now().Add(backoff).After(deadline) {
+		if !deadline.IsZero() && clock.Now().Add(backoff).After(deadline) {
 			// we are past the deadline
 			return true
 		}
 		return false
 	}
-	retry := func(err error) error {
+	retry := func(err error, leaderless bool) error {
 		if attemptsRemaining > 0 {
 			backoff := client.computeBackoff(attemptsRemaining)
+			if leaderless && client.conf.Metadata.Retry.LeaderBackoff > 0 {
+				backoff = client.conf.Metadata.Retry.LeaderBackoff
+			}
 			if pastDeadline(backoff) {
 				Logger.Println("client/metadata skipping last retries as we would go past the metadata timeout")
 				return err
 			}
 			if backoff > 0 {
-				time.Sleep(backoff)
+				clock.Sleep(backoff)
 			}
 
 			t := atomic.LoadInt64(&client.updateMetadataMs)
-			if time.Since(time.UnixMilli(t)) < backoff {
+			if clock.Since(time.UnixMilli(t)) < backoff {
 				return err
 			}
 			attemptsRemaining--
@@ -1029,7 +1502,7 @@ func (client *client) tryRefreshMetadata(topics []string, attemptsRemaining int,
 
 		req := NewMetadataRequest(client.conf.Version, topics)
 		req.AllowAutoTopicCreation = allowAutoTopicCreation
-		atomic.StoreInt64(&client.updateMetadataMs, time.Now().UnixMilli())
+		atomic.StoreInt64(&client.updateMetadataMs, clock.Now().UnixMilli())
 
 		response, err := broker.GetMetadata(req)
 		var kerror KError
@@ -1047,7 +1520,7 @@ func (client *client) tryRefreshMetadata(topics []string, attemptsRemaining int,
 			shouldRetry, err := client.updateMetadata(response, allKnownMetaData)
 			if shouldRetry {
 				Logger.Println("client/metadata found some partitions to be leaderless")
-				return retry(err) // note: err can be nil
+				return retry(err, true) // note: err can be nil
 			}
 			return err
 		} else if errors.As(err, &packetEncodingError) {
@@ -1080,12 +1553,12 @@ func (client *client) tryRefreshMetadata(topics []string, attemptsRemaining int,
 	error := Wrap(ErrOutOfBrokers, brokerErrors...)
 	if broker != nil {
 		Logger.Printf("client/metadata not fetching metadata from broker %s as we would go past the metadata timeout\n", broker.addr)
-		return retry(error)
+		return retry(error, false)
 	}
 
 	Logger.Println("client/metadata no available broker to send metadata request to")
 	client.resurrectDeadBrokers()
-	return retry(error)
+	return retry(error, false)
 }
 
 // if no fatal error, returns a list of topics that need retrying due to ErrLeaderNotAvailable
@@ -1151,6 +1624,22 @@ func (client *client) updateMetadata(data *MetadataResponse, allKnownMetaData bo
 		partitionCache[allPartitions] = client.setPartitionCache(topic.Name, allPartitions)
 		partitionCache[writablePartitions] = client.setPartitionCache(topic.Name, writablePartitions)
 		client.cachedPartitionsResults[topic.Name] = partitionCache
+		if _, registered := client.registeredTopics[topic.Name]; !registered {
+			client.topicLRU.add(topic.Name)
+		}
+	}
+
+	// refreshed topics keep their recency, only those whose metadata is no
+	// longer cached are untracked
+	client.topicLRU.retain(func(topic string) bool {
+		_, ok := client.metadata[topic]
+		return ok
+	})
+	// stop refreshing the evicted topics too, they are fetched again on demand
+	for _, topic := range client.topicLRU.evict() {
+		delete(client.metadataTopics, topic)
+		delete(client.metadata, topic)
+		delete(client.cachedPartitionsResults, topic)
 	}
 
 	return
@@ -1196,7 +1685,7 @@ func (client *client) findCoordinator(coordinatorKey string, coordinatorType Coo
 			backoff := client.computeBackoff(attemptsRemaining)
 			attemptsRemaining--
 			Logger.Printf("client/coordinator retrying after %dms... (%d attempts remaining)\n", backoff/time.Millisecond, attemptsRemaining)
-			time.Sleep(backoff)
+			client.conf.getClock().Sleep(backoff)
 			return client.findCoordinator(coordinatorKey, coordinatorType, attemptsRemaining)
 		}
 		return nil, err
@@ -1245,12 +1734,12 @@ func (client *client) findCoordinator(coordinatorKey string, coordinatorType Coo
 			// The number of partitions not configurable, but partition 0 should always exist.
 			if _, err := client.Leader("__consumer_offsets", 0); err != nil {
 				Logger.Printf("client/coordinator the __consumer_offsets topic is not initialized completely yet. Waiting 2 seconds...\n")
-				time.Sleep(2 * time.Second)
+				client.conf.getClock().Sleep(2 * time.Second)
 			}
 			if coordinatorType == CoordinatorTransaction {
 				if _, err := client.Leader("__transaction_state", 0); err != nil {
 					Logger.Printf("client/coordinator the __transaction_state topic is not initialized completely yet. Waiting 2 seconds...\n")
-					time.Sleep(2 * time.Second)
+					client.conf.getClock().Sleep(2 * time.Second)
 				}
 			}
 
@@ -3,6 +3,8 @@ package sarama
 import (
 	"errors"
 	"io"
+	"reflect"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -36,6 +38,172 @@ func TestSimpleClient(t *testing.T) {
 	safeClose(t, client)
 }
 
+func TestClientLeastLoadedBroker(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+	broker2 := NewMockBroker(t, 2)
+	defer broker2.Close()
+	broker3 := NewMockBroker(t, 3)
+	defer broker3.Close()
+
+	metadataResponse := new(MetadataResponse)
+	metadataResponse.AddBroker(broker2.Addr(), broker2.BrokerID())
+	metadataResponse.AddBroker(broker3.Addr(), broker3.BrokerID())
+	seedBroker.Returns(metadataResponse)
+
+	config := NewTestConfig()
+	config.Metadata.Retry.Max = 0
+	c, err := NewClient([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, c)
+	client := c.(*client)
+
+	var selected []int32
+	client.brokerSelected = func(broker *Broker) {
+		selected = append(selected, broker.ID())
+	}
+
+	b2, b3 := client.brokers[2], client.brokers[3]
+	atomic.StoreInt64(&b2.inFlight, 5)
+	if broker := client.LeastLoadedBroker(); broker != b3 {
+		t.Fatalf("expected broker 3 with no requests in flight, got #%d", broker.ID())
+	}
+
+	// broker 3 is now connected so it is preferred over broker 2 even when busier
+	atomic.StoreInt64(&b3.inFlight, 10)
+	if broker := client.LeastLoadedBroker(); broker != b3 {
+		t.Fatalf("expected connected broker 3, got #%d", broker.ID())
+	}
+
+	// once both are connected the one with fewer requests in flight wins
+	_ = b2.Open(config)
+	if connected, err := b2.Connected(); !connected {
+		t.Fatal(err)
+	}
+	if broker := client.LeastLoadedBroker(); broker != b2 {
+		t.Fatalf("expected broker 2 with fewer requests in flight, got #%d", broker.ID())
+	}
+
+	if want := []int32{3, 3, 2}; !reflect.DeepEqual(selected, want) {
+		t.Errorf("expected brokers %v to be selected, got %v", want, selected)
+	}
+	atomic.StoreInt64(&b2.inFlight, 0)
+	atomic.StoreInt64(&b3.inFlight, 0)
+}
+
+// slowLoginKerberosClient records how many handshakes log in concurrently.
+type slowLoginKerberosClient struct {
+	*MockKerberosClient
+	active, maxActive *int32
+}
+
+func (c slowLoginKerberosClient) Login() error {
+	active := atomic.AddInt32(c.active, 1)
+	defer atomic.AddInt32(c.active, -1)
+	for {
+		max := atomic.LoadInt32(c.maxActive)
+		if active <= max || atomic.CompareAndSwapInt32(c.maxActive, max, active) {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	return c.MockKerberosClient.Login()
+}
+
+func TestClientMaxConcurrentConnects(t *testing.T) {
+	kerberosClient := NewMockKerberosClient()
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+	seedBroker.SetGSSAPIHandler(NewMockGSSAPIHandler(kerberosClient))
+	metadataResponse := NewMockMetadataResponse(t)
+	seedBroker.SetHandlerByMap(map[string]MockResponse{"MetadataRequest": metadataResponse})
+	for id := int32(2); id <= 4; id++ {
+		broker := NewMockBroker(t, id)
+		defer broker.Close()
+		broker.SetGSSAPIHandler(NewMockGSSAPIHandler(kerberosClient))
+		metadataResponse.SetBroker(broker.Addr(), id)
+	}
+
+	var active, maxActive int32
+	config := NewTestConfig()
+	config.Version = V1_0_0_0
+	config.Net.MaxConcurrentConnects = 2
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Mechanism = SASLTypeGSSAPI
+	config.Net.SASL.Version = SASLHandshakeV0
+	config.Net.SASL.GSSAPI.ServiceName = "kafka"
+	config.Net.SASL.GSSAPI.Realm = "EXAMPLE.COM"
+	config.Net.SASL.GSSAPI.Username = "kafka"
+	config.Net.SASL.GSSAPI.Password = "kafka"
+	config.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+	config.Net.SASL.GSSAPI.NewKerberosClientFunc = func(*GSSAPIConfig) (KerberosClient, error) {
+		return slowLoginKerberosClient{kerberosClient, &active, &maxActive}, nil
+	}
+	client, err := NewClient([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, client)
+
+	// the seed broker is connected to before the brokers are
+	atomic.StoreInt32(&maxActive, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for _, broker := range client.Brokers() {
+		for {
+			if connected, _ := broker.Connected(); connected {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected broker #%d to be connected in the background", broker.ID())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if max := atomic.LoadInt32(&maxActive); max != 2 {
+		t.Errorf("expected 2 brokers to authenticate concurrently, got %d", max)
+	}
+}
+
+func TestClientPing(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+	leader := NewMockBroker(t, 2)
+	defer leader.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(leader.Addr(), leader.BrokerID()),
+	})
+	leader.SetHandlerByMap(map[string]MockResponse{
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+	})
+
+	config := NewTestConfig()
+	config.Version = V0_10_0_0
+	client, err := NewClient([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, client)
+
+	latency, err := client.Ping(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency <= 0 {
+		t.Errorf("expected a positive round-trip latency, got %s", latency)
+	}
+	if len(leader.History()) != 1 {
+		t.Errorf("expected one request to broker 2, got %d", len(leader.History()))
+	}
+
+	if _, err := client.Ping(3); !errors.Is(err, ErrBrokerNotFound) {
+		t.Errorf("expected ErrBrokerNotFound for an unknown broker, got %v", err)
+	}
+}
+
 func TestCachedPartitions(t *testing.T) {
 	seedBroker := NewMockBroker(t, 1)
 
@@ -358,6 +526,145 @@ func TestClientGetOffset(t *testing.T) {
 	safeClose(t, client)
 }
 
+func TestClientGetOffsets(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	leader1 := NewMockBroker(t, 2)
+	leader2 := NewMockBroker(t, 3)
+	defer seedBroker.Close()
+	defer leader1.Close()
+	defer leader2.Close()
+
+	metadata := NewMockMetadataResponse(t).
+		SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+		SetBroker(leader1.Addr(), leader1.BrokerID()).
+		SetBroker(leader2.Addr(), leader2.BrokerID()).
+		SetLeader("foo", 0, leader1.BrokerID()).
+		SetLeader("foo", 1, leader2.BrokerID()).
+		SetLeader("foo", 2, leader1.BrokerID()).
+		SetLeader("foo", 3, leader2.BrokerID())
+	seedBroker.SetHandlerByMap(map[string]MockResponse{"MetadataRequest": metadata})
+	offsets := NewMockOffsetResponse(t).
+		SetOffset("foo", 0, OffsetNewest, 100).
+		SetOffset("foo", 1, OffsetNewest, 101).
+		SetOffset("foo", 2, OffsetNewest, 102).
+		SetOffset("foo", 3, OffsetNewest, 103)
+	leader1.SetHandlerByMap(map[string]MockResponse{"OffsetRequest": offsets})
+	leader2.SetHandlerByMap(map[string]MockResponse{"OffsetRequest": offsets})
+
+	client, err := NewClient([]string{seedBroker.Addr()}, NewTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, client)
+
+	got, err := client.GetOffsets("foo", OffsetNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int32]int64{0: 100, 1: 101, 2: 102, 3: 103}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected offsets %v, got %v", want, got)
+	}
+
+	// one request per leader, for both of its partitions
+	for _, leader := range []*MockBroker{leader1, leader2} {
+		history := leader.History()
+		if len(history) != 1 {
+			t.Fatalf("expected 1 request to broker %d, got %d", leader.BrokerID(), len(history))
+		}
+		request := history[0].Request.(*OffsetRequest)
+		if len(request.blocks["foo"]) != 2 {
+			t.Errorf("expected 2 partitions in the request to broker %d, got %d", leader.BrokerID(), len(request.blocks["foo"]))
+		}
+	}
+}
+
+func TestClientOffsetForLeaderEpoch(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+			SetLeader("foo", 0, seedBroker.BrokerID()),
+		"OffsetForLeaderEpochRequest": NewMockOffsetForLeaderEpochResponse(t).
+			SetEndOffset("foo", 0, 3, 120, 2),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_1_0_0
+	client, err := NewClient([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, client)
+
+	endOffset, epoch, err := client.OffsetForLeaderEpoch("foo", 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endOffset != 120 || epoch != 2 {
+		t.Errorf("expected end offset 120 of epoch 2, got %d of epoch %d", endOffset, epoch)
+	}
+
+	old, err := NewClient([]string{seedBroker.Addr()}, NewTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, old)
+	if _, _, err := old.OffsetForLeaderEpoch("foo", 0, 3); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion before Kafka 0.11, got %v", err)
+	}
+}
+
+func TestClientLeaderForKey(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+	leader := NewMockBroker(t, 2)
+	defer leader.Close()
+
+	metadata := NewMockMetadataResponse(t).
+		SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+		SetBroker(leader.Addr(), leader.BrokerID())
+	leaders := map[int32]int32{0: seedBroker.BrokerID(), 1: leader.BrokerID(), 2: seedBroker.BrokerID(), 3: leader.BrokerID()}
+	for partition, id := range leaders {
+		metadata.SetLeader("my_topic", partition, id)
+	}
+	seedBroker.SetHandlerByMap(map[string]MockResponse{"MetadataRequest": metadata})
+	leader.SetHandlerByMap(map[string]MockResponse{"MetadataRequest": metadata})
+
+	config := NewTestConfig()
+	config.Metadata.Retry.Max = 0
+	client, err := NewClient([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, client)
+
+	partitioner := NewHashPartitioner("my_topic")
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		expected, err := partitioner.Partition(&ProducerMessage{Key: StringEncoder(key)}, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partition, broker, err := client.LeaderForKey("my_topic", []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if partition != expected {
+			t.Errorf("expected key %q to map to partition %d, got %d", key, expected, partition)
+		}
+		if broker.ID() != leaders[partition] {
+			t.Errorf("expected partition %d to be led by broker %d, got %d", partition, leaders[partition], broker.ID())
+		}
+	}
+
+	if _, _, err := client.LeaderForKey("unknown_topic", []byte("a")); !errors.Is(err, ErrUnknownTopicOrPartition) {
+		t.Errorf("expected ErrUnknownTopicOrPartition, got %v", err)
+	}
+}
+
 func TestClientReceivingUnknownTopicWithBackoffFunc(t *testing.T) {
 	seedBroker := NewMockBroker(t, 1)
 
@@ -489,6 +796,55 @@ func TestClientReceivingPartialMetadata(t *testing.T) {
 	leader.Close()
 }
 
+func TestClientLeaderBackoff(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	leader := NewMockBroker(t, 5)
+	defer seedBroker.Close()
+	defer leader.Close()
+
+	metadataResponse1 := new(MetadataResponse)
+	metadataResponse1.AddBroker(leader.Addr(), leader.BrokerID())
+	seedBroker.Returns(metadataResponse1)
+
+	config := NewTestConfig()
+	config.Metadata.Retry.Max = 5
+	config.Metadata.Retry.Backoff = time.Hour
+	config.Metadata.Retry.LeaderBackoff = 50 * time.Millisecond
+	client, err := NewClient([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, client)
+
+	replicas := []int32{leader.BrokerID()}
+
+	// the partition is leaderless for two refreshes, then elects its leader
+	leaderless := new(MetadataResponse)
+	leaderless.AddBroker(leader.Addr(), leader.BrokerID())
+	leaderless.AddTopicPartition("my_topic", 0, -1, replicas, []int32{}, []int32{}, ErrLeaderNotAvailable)
+	elected := new(MetadataResponse)
+	elected.AddBroker(leader.Addr(), leader.BrokerID())
+	elected.AddTopicPartition("my_topic", 0, leader.BrokerID(), replicas, replicas, []int32{}, ErrNoError)
+	leader.Returns(leaderless)
+	leader.Returns(leaderless)
+	leader.Returns(elected)
+
+	start := time.Now()
+	broker, err := client.Leader("my_topic", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broker.Addr() != leader.Addr() {
+		t.Error("Unexpected leader returned", broker.Addr())
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("expected two retries after LeaderBackoff, took %v", elapsed)
+	}
+	if n := len(leader.History()); n != 3 {
+		t.Errorf("expected 3 metadata requests, got %d", n)
+	}
+}
+
 func TestClientRefreshBehaviourWhenEmptyMetadataResponse(t *testing.T) {
 	seedBroker := NewMockBroker(t, 1)
 	broker := NewMockBroker(t, 2)
@@ -573,6 +929,192 @@ func TestClientRefreshBehaviour(t *testing.T) {
 	safeClose(t, client)
 }
 
+func TestClientRefreshMetadataCoalesced(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	metadata := NewMockMetadataResponse(t).
+		SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+		SetLeader("foo", 0, seedBroker.BrokerID()).
+		SetLeader("bar", 0, seedBroker.BrokerID())
+	var requests, requestedTopics int32
+	seedBroker.SetHandlerFuncByMap(map[string]requestHandlerFunc{
+		"MetadataRequest": func(req *request) encoderWithHeader {
+			atomic.AddInt32(&requests, 1)
+			atomic.StoreInt32(&requestedTopics, int32(len(req.body.(*MetadataRequest).Topics)))
+			return metadata.For(req.body)
+		},
+	})
+
+	config := NewTestConfig()
+	config.Metadata.RefreshCoalesceWindow = 100 * time.Millisecond
+	client, err := NewClient([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, client)
+	atomic.StoreInt32(&requests, 0)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		topic := "foo"
+		if i%2 == 0 {
+			topic = "bar"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- client.RefreshMetadata(topic)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected the refreshes to share a single metadata request, got %d", n)
+	}
+	if n := atomic.LoadInt32(&requestedTopics); n != 2 {
+		t.Errorf("expected the shared request to cover both topics, got %d", n)
+	}
+}
+
+func TestClientRegisterTopics(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+			SetLeader("foo", 0, seedBroker.BrokerID()).
+			SetLeader("bar", 0, seedBroker.BrokerID()),
+	})
+
+	config := NewTestConfig()
+	config.Metadata.Full = false
+	c, err := NewClient([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, c)
+	client := c.(*client)
+
+	if err := client.RegisterTopics("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	topics, err := client.MetadataTopics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(topics)
+	if !reflect.DeepEqual(topics, []string{"bar", "foo"}) {
+		t.Errorf("Expected registered topics [bar foo], got %v", topics)
+	}
+	if partitions := client.cachedPartitions("foo", allPartitions); len(partitions) != 1 {
+		t.Errorf("Expected metadata of foo to be cached, got %v", partitions)
+	}
+
+	if err := client.UnregisterTopics("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if partitions := client.cachedPartitions("foo", allPartitions); len(partitions) != 0 {
+		t.Errorf("Expected metadata of foo to be dropped, got %v", partitions)
+	}
+
+	if err := client.refreshMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	history := seedBroker.History()
+	req, ok := history[len(history)-1].Request.(*MetadataRequest)
+	if !ok {
+		t.Fatalf("Expected a metadata request, got %T", history[len(history)-1].Request)
+	}
+	if !reflect.DeepEqual(req.Topics, []string{"bar"}) {
+		t.Errorf("Expected periodic refresh of [bar], got %v", req.Topics)
+	}
+}
+
+func TestClientMaxCachedTopics(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+			SetLeader("pinned", 0, seedBroker.BrokerID()).
+			SetLeader("a", 0, seedBroker.BrokerID()).
+			SetLeader("b", 0, seedBroker.BrokerID()).
+			SetLeader("c", 0, seedBroker.BrokerID()),
+	})
+
+	config := NewTestConfig()
+	config.Metadata.Full = false
+	config.Metadata.MaxCachedTopics = 2
+	c, err := NewClient([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, c)
+	client := c.(*client)
+
+	if err := client.RegisterTopics("pinned"); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"a", "b", "a", "c"} {
+		if _, err := client.Partitions(topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b is the least recently accessed topic, pinned is exempt
+	topics, err := client.MetadataTopics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(topics)
+	if !reflect.DeepEqual(topics, []string{"a", "c", "pinned"}) {
+		t.Errorf("Expected the metadata of b to be evicted, got %v", topics)
+	}
+
+	// the evicted topic is fetched again on demand, evicting a
+	requests := len(seedBroker.History())
+	if _, err := client.Leader("b", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(seedBroker.History()) != requests+1 {
+		t.Errorf("Expected the metadata of b to be fetched again")
+	}
+	topics, err = client.Topics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(topics)
+	if !reflect.DeepEqual(topics, []string{"b", "c", "pinned"}) {
+		t.Errorf("Expected the metadata of a to be evicted, got %v", topics)
+	}
+
+	// a background refresh, returning b before c, is not an access
+	if err := client.RefreshMetadata("pinned", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Partitions("a"); err != nil {
+		t.Fatal(err)
+	}
+	topics, err = client.Topics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(topics)
+	if !reflect.DeepEqual(topics, []string{"a", "b", "pinned"}) {
+		t.Errorf("Expected the metadata of c to be evicted, got %v", topics)
+	}
+}
+
 func TestClientRefreshBrokers(t *testing.T) {
 	initialSeed := NewMockBroker(t, 0)
 	defer initialSeed.Close()
@@ -686,6 +1228,65 @@ func TestClientGetBroker(t *testing.T) {
 	}
 }
 
+func TestClientBrokerStates(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+	leader := NewMockBroker(t, 5)
+	defer leader.Close()
+
+	metadataResponse := new(MetadataResponse)
+	metadataResponse.AddBroker(leader.Addr(), leader.BrokerID())
+	metadataResponse.AddBroker(seedBroker.Addr(), seedBroker.BrokerID())
+	seedBroker.Returns(metadataResponse)
+
+	client, err := NewClient([]string{seedBroker.Addr()}, NewTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Broker(leader.BrokerID()); err != nil {
+		t.Fatal(err)
+	}
+
+	states := client.BrokerStates()
+	if len(states) != 2 {
+		t.Fatalf("Expected 2 broker states, got %d", len(states))
+	}
+	if states[0].ID != seedBroker.BrokerID() || states[0].Connected {
+		t.Errorf("Expected broker %d not to be connected, got %+v", seedBroker.BrokerID(), states[0])
+	}
+	if states[1].ID != leader.BrokerID() || states[1].Addr != leader.Addr() || !states[1].Connected {
+		t.Errorf("Expected broker %d to be connected, got %+v", leader.BrokerID(), states[1])
+	}
+
+	safeClose(t, client)
+
+	if !client.Closed() {
+		t.Error("Expected client to be closed")
+	}
+	if states := client.BrokerStates(); states != nil {
+		t.Errorf("Expected no broker states after close, got %+v", states)
+	}
+	if broker := client.LeastLoadedBroker(); broker != nil {
+		t.Errorf("Expected no least loaded broker after close, got %d", broker.ID())
+	}
+	if _, err := client.Broker(leader.BrokerID()); !errors.Is(err, ErrClosedClient) {
+		t.Errorf("Expected Broker to return %v, got %v", ErrClosedClient, err)
+	}
+	if _, err := client.InitProducerID(); !errors.Is(err, ErrClosedClient) {
+		t.Errorf("Expected InitProducerID to return %v, got %v", ErrClosedClient, err)
+	}
+	if _, err := client.Topics(); !errors.Is(err, ErrClosedClient) {
+		t.Errorf("Expected Topics to return %v, got %v", ErrClosedClient, err)
+	}
+	if err := client.RefreshMetadata(); !errors.Is(err, ErrClosedClient) {
+		t.Errorf("Expected RefreshMetadata to return %v, got %v", ErrClosedClient, err)
+	}
+	if err := client.Close(); !errors.Is(err, ErrClosedClient) {
+		t.Errorf("Expected Close to return %v, got %v", ErrClosedClient, err)
+	}
+}
+
 func TestClientResurrectDeadSeeds(t *testing.T) {
 	initialSeed := NewMockBroker(t, 0)
 	metadataResponse := new(MetadataResponse)
@@ -0,0 +1,69 @@
+package sarama
+
+import "time"
+
+// clock is the source of time of the retry, timeout and scheduling code, so
+// that tests can control it with a fake implementation. Latency metrics and
+// socket deadlines always use the real time.
+type clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) clockTimer
+	NewTicker(d time.Duration) clockTicker
+}
+
+// clockTimer is the subset of time.Timer used by sarama.
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// clockTicker is the subset of time.Ticker used by sarama.
+type clockTicker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock of the time package, the default.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) clockTicker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// getClock returns the clock set by tests, or the real one.
+func (c *Config) getClock() clock {
+	if c == nil || c.clock == nil {
+		return realClock{}
+	}
+	return c.clock
+}
+
+// sessionClock returns the clock of the consumer group running sess, or the
+// real one for sessions implemented outside of sarama.
+func sessionClock(sess ConsumerGroupSession) clock {
+	if s, ok := sess.(interface{ getClock() clock }); ok {
+		return s.getClock()
+	}
+	return realClock{}
+}
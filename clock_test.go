@@ -0,0 +1,171 @@
+package sarama
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves on Advance, firing the timers
+// and tickers that are due.
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	clock    *fakeClock
+	deadline time.Time
+	period   time.Duration // 0 for timers
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1600000000, 0)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Since(t time.Time) time.Duration { return f.Now().Sub(t) }
+
+func (f *fakeClock) Sleep(d time.Duration) { <-f.After(d) }
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time { return f.NewTimer(d).C() }
+
+func (f *fakeClock) NewTimer(d time.Duration) clockTimer { return f.wait(d, 0) }
+
+func (f *fakeClock) NewTicker(d time.Duration) clockTicker { return fakeTicker{f.wait(d, d)} }
+
+func (f *fakeClock) wait(d, period time.Duration) *fakeWaiter {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	w := &fakeWaiter{clock: f, deadline: f.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	f.waiters = append(f.waiters, w)
+	return w
+}
+
+// Advance moves the time forward by d, firing the waiters that are due.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = f.now.Add(d)
+	waiters := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.deadline.After(f.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		select {
+		case w.c <- f.now:
+		default: // like tickers, drop the ticks that are not received
+		}
+		if w.period > 0 {
+			for !w.deadline.After(f.now) {
+				w.deadline = w.deadline.Add(w.period)
+			}
+			waiters = append(waiters, w)
+		}
+	}
+	f.waiters = waiters
+}
+
+// BlockUntil waits for n timers or tickers to be pending.
+func (f *fakeClock) BlockUntil(t *testing.T, n int) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		f.lock.Lock()
+		pending := len(f.waiters)
+		f.lock.Unlock()
+		if pending >= n {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %d pending timers", n)
+}
+
+func (w *fakeWaiter) C() <-chan time.Time { return w.c }
+
+func (w *fakeWaiter) Stop() bool {
+	w.clock.lock.Lock()
+	defer w.clock.lock.Unlock()
+	for i, other := range w.clock.waiters {
+		if other == w {
+			w.clock.waiters = append(w.clock.waiters[:i], w.clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (w *fakeWaiter) Reset(d time.Duration) bool {
+	active := w.Stop()
+	w.clock.lock.Lock()
+	defer w.clock.lock.Unlock()
+	w.deadline = w.clock.now.Add(d)
+	w.clock.waiters = append(w.clock.waiters, w)
+	return active
+}
+
+type fakeTicker struct{ *fakeWaiter }
+
+func (t fakeTicker) Stop() { t.fakeWaiter.Stop() }
+
+func TestCircuitBreakerFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	conf := NewTestConfig()
+	conf.clock = clock
+	conf.Net.CircuitBreaker.Failures = 1
+	conf.Net.CircuitBreaker.Cooldown = time.Minute
+	var cb circuitBreaker
+	cb.configure(conf, nil)
+
+	cb.record(ErrOutOfBrokers)
+	clock.Advance(time.Minute - time.Nanosecond)
+	if state := cb.state(); state != CircuitOpen {
+		t.Fatalf("expected the circuit to stay open during the cooldown, got %s", state)
+	}
+	clock.Advance(time.Nanosecond)
+	if state := cb.state(); state != CircuitHalfOpen {
+		t.Errorf("expected the circuit to half-open after the cooldown, got %s", state)
+	}
+}
+
+func TestAsyncProducerFlushFrequencyFakeClock(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("my_topic", 0, broker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t),
+	})
+
+	clock := newFakeClock()
+	config := NewTestConfig()
+	config.clock = clock
+	config.Metadata.RefreshFrequency = 0
+	config.Producer.Flush.Frequency = time.Hour
+	config.Producer.Flush.Messages = 100
+	config.Producer.Return.Successes = true
+	producer, err := NewAsyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
+	clock.BlockUntil(t, 1)
+	select {
+	case msg := <-producer.Successes():
+		t.Fatalf("expected the message to wait for the flush, got %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(time.Hour)
+	expectResults(t, producer, 1, 0)
+	closeProducer(t, producer)
+}
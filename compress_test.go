@@ -0,0 +1,138 @@
+package sarama
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("sarama compression round trip "), 1024)
+
+	for _, tc := range []struct {
+		codec CompressionCodec
+		level int
+	}{
+		{CompressionGZIP, CompressionLevelDefault},
+		{CompressionGZIP, 0},
+		{CompressionGZIP, 1},
+		{CompressionGZIP, 9},
+		{CompressionLZ4, CompressionLevelDefault},
+		{CompressionSnappy, CompressionLevelDefault},
+		{CompressionZSTD, CompressionLevelDefault},
+	} {
+		tc := tc
+		t.Run(fmt.Sprintf("%s/level=%d", tc.codec, tc.level), func(t *testing.T) {
+			// compress twice so that pooled writers and buffers get reused
+			first, err := compress(tc.codec, tc.level, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := compress(tc.codec, tc.level, data[:len(data)/2])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range []struct {
+				compressed, expected []byte
+			}{
+				{first, data},
+				{second, data[:len(data)/2]},
+			} {
+				decompressed, err := decompress(tc.codec, c.compressed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decompressed, c.expected) {
+					t.Errorf("round trip mismatch, got %d bytes, expected %d", len(decompressed), len(c.expected))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte((i / 256) + (i * 257))
+	}
+
+	for _, bc := range []struct {
+		codec CompressionCodec
+		level int
+	}{
+		{CompressionGZIP, CompressionLevelDefault},
+		{CompressionGZIP, 1},
+		{CompressionGZIP, 9},
+		{CompressionLZ4, CompressionLevelDefault},
+		{CompressionSnappy, CompressionLevelDefault},
+		{CompressionZSTD, CompressionLevelDefault},
+	} {
+		b.Run(fmt.Sprintf("%s/level=%d", bc.codec, bc.level), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := compress(bc.codec, bc.level, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func compressedRecordBatch(tb testing.TB, codec CompressionCodec, value byte) []byte {
+	tb.Helper()
+	batch := &RecordBatch{
+		Version: 2,
+		Codec:   codec,
+	}
+	for i := 0; i < 100; i++ {
+		batch.addRecord(&Record{
+			OffsetDelta: int64(i),
+			Value:       bytes.Repeat([]byte{value}, 1024),
+		})
+	}
+	buf, err := encode(batch, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return buf
+}
+
+func TestDecompressedRecordsDoNotAliasPooledMemory(t *testing.T) {
+	for _, codec := range []CompressionCodec{CompressionGZIP, CompressionSnappy, CompressionLZ4, CompressionZSTD} {
+		codec := codec
+		t.Run(codec.String(), func(t *testing.T) {
+			first := &RecordBatch{}
+			if err := decode(compressedRecordBatch(t, codec, 'a'), first, nil); err != nil {
+				t.Fatal(err)
+			}
+			// decoding another batch reuses the pooled scratch space
+			second := &RecordBatch{}
+			if err := decode(compressedRecordBatch(t, codec, 'b'), second, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := bytes.Repeat([]byte{'a'}, 1024)
+			for _, r := range first.Records {
+				if !bytes.Equal(r.Value, expected) {
+					t.Fatalf("record at offset delta %d was overwritten", r.OffsetDelta)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeCompressedRecordBatch(b *testing.B) {
+	for _, codec := range []CompressionCodec{CompressionGZIP, CompressionSnappy, CompressionLZ4, CompressionZSTD} {
+		buf := compressedRecordBatch(b, codec, 'a')
+		b.Run(codec.String(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := decode(buf, &RecordBatch{}, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"io"
 	"net"
 	"regexp"
+	"sync/atomic"
 	"time"
 
 	"github.com/klauspost/compress/gzip"
+	"github.com/max444ks1m777/gokrb5/v8/gssapi"
+	"github.com/max444ks1m777/gokrb5/v8/iana/etypeID"
 	"github.com/rcrowley/go-metrics"
 	"golang.org/x/net/proxy"
 )
@@ -45,6 +48,31 @@ type Config struct {
 		// https://kafka.apache.org/28/documentation.html#producerconfigs_max.in.flight.requests.per.connection
 		MaxOpenRequests int
 
+		// What to do with requests once a connection has MaxOpenRequests
+		// outstanding requests (defaults to InFlightBlock, waiting for a
+		// response). Latency sensitive callers can use InFlightFailFast to fail
+		// such requests with ErrTooManyInFlight instead, or InFlightQueue to
+		// let up to InFlightQueueSize requests wait before failing.
+		InFlightOverflowPolicy InFlightOverflowPolicy
+		// The number of requests allowed to wait for an outstanding request
+		// to complete with the InFlightQueue policy (defaults to 0).
+		InFlightQueueSize int
+
+		// The number of brokers the client connects to and authenticates
+		// with concurrently, in the background, once it has fetched the
+		// initial metadata. This saves serializing the SASL handshakes (which
+		// are slow with Kerberos) as the brokers get used. Defaults to 0,
+		// connecting to each broker when it is first used.
+		MaxConcurrentConnects int
+
+		// The number of broker connections the clients sharing this Config
+		// may have open at once, each running one goroutine that handles the
+		// responses to all of its requests. Connecting beyond it fails with
+		// ErrMaxConnectionGoroutines until a connection is closed. Defaults
+		// to 0, not limiting the connections. The running goroutines are
+		// counted by the goroutines metric.
+		MaxConnectionGoroutines int
+
 		// All three of the below configurations are similar to the
 		// `socket.timeout.ms` setting in JVM kafka. All of them default
 		// to 30 seconds.
@@ -52,6 +80,54 @@ type Config struct {
 		ReadTimeout  time.Duration // How long to wait for a response.
 		WriteTimeout time.Duration // How long to wait for a transmit.
 
+		// RequestTimeouts overrides ReadTimeout for the requests with the given
+		// API keys, e.g. to allow long-poll fetches (key 1) to take longer than
+		// metadata requests (key 3). Requests not listed use ReadTimeout.
+		RequestTimeouts map[int16]time.Duration
+
+		// MaxResponseSize is the largest response (in bytes) that will be read
+		// from a broker. The length prefix of every response is checked against
+		// it before the body is allocated, so a corrupt or malicious length
+		// fails with a PacketDecodingError rather than exhausting memory.
+		// Defaults to 0, meaning only the global `sarama.MaxResponseSize`
+		// applies; a non-zero value can only lower that limit.
+		MaxResponseSize int32
+
+		// ConnectionMaxAge is how long a broker connection may be used before
+		// it is closed and re-established, re-running SASL authentication.
+		// This stops long-lived connections being pinned behind a load
+		// balancer or to a draining broker. The age is checked before each
+		// request, and requests in flight on the old connection complete
+		// before it is closed. Defaults to 0 (connections are kept open).
+		ConnectionMaxAge time.Duration
+
+		// CircuitBreaker stops a flapping broker from making requests time out
+		// over and over again.
+		CircuitBreaker struct {
+			// The number of consecutive failed connection attempts or requests
+			// after which the circuit of a broker opens (defaults to 0,
+			// disabled). While open, connecting and sending requests to the
+			// broker fail fast with ErrBrokerCircuitOpen, and clients route
+			// metadata requests and fetches to other brokers where possible.
+			Failures int
+			// How long the circuit stays open (defaults to 30s). It then
+			// half-opens to probe the broker: the next success closes it, the
+			// next failure opens it again.
+			Cooldown time.Duration
+			// OnStateChange, if set, is called whenever the circuit of a
+			// broker changes state. It is called synchronously, from the
+			// goroutines using the broker, so it must not block nor call the
+			// broker.
+			OnStateChange func(brokerID int32, addr string, state CircuitState)
+		}
+
+		// Interceptors to be called before every protocol request is sent to
+		// a broker and after its response is received, in order. The SASL v0
+		// authentication, which is not framed as Kafka requests, is not
+		// intercepted. Interceptors must be cheap: they run on the path of
+		// every request.
+		Interceptors []BrokerInterceptor
+
 		// ResolveCanonicalBootstrapServers turns each bootstrap broker address
 		// into a set of IPs, then does a reverse lookup on each one to get its
 		// canonical hostname. This list of hostnames then replaces the
@@ -144,6 +220,11 @@ type Config struct {
 			// more sophisticated backoff strategies. This takes precedence over
 			// `Backoff` if set.
 			BackoffFunc func(retries, maxRetries int) time.Duration
+			// LeaderBackoff, if set, replaces Backoff and BackoffFunc between
+			// the metadata refreshes retried because a partition has no leader
+			// or is unknown yet, so that leader elections can complete without
+			// hammering the controller (defaults to 0, disabled).
+			LeaderBackoff time.Duration
 		}
 		// How frequently to refresh the cluster metadata in the background.
 		// Defaults to 10 minutes. Set to 0 to disable. Similar to
@@ -156,6 +237,14 @@ type Config struct {
 		// memory if you have many topics and partitions. Defaults to true.
 		Full bool
 
+		// The maximum number of topics whose metadata is cached (defaults to 0,
+		// unbounded). Beyond it, the metadata of the least recently accessed
+		// topics is evicted, and no longer refreshed, until they are accessed
+		// again. Topics registered through Client.RegisterTopics are never
+		// evicted nor counted. Useful for gateways touching many topics
+		// transiently. Requires Full to be disabled.
+		MaxCachedTopics int
+
 		// How long to wait for a successful metadata response.
 		// Disabled by default which means a metadata request against an unreachable
 		// cluster (all brokers are unreachable or unresponsive) can take up to
@@ -163,6 +252,13 @@ type Config struct {
 		// to fail.
 		Timeout time.Duration
 
+		// How long RefreshMetadata waits for concurrent calls to join it before
+		// refreshing (defaults to 0, refreshing immediately). All the calls made
+		// within the window share a single metadata request for the union of
+		// their topics, and all receive its result. This avoids refresh storms,
+		// e.g. when many partition consumers are redispatched during a rebalance.
+		RefreshCoalesceWindow time.Duration
+
 		// Whether to allow auto-create topics in metadata refresh. If set to true,
 		// the broker may auto-create topics that we requested which do not already exist,
 		// if it is configured to do so (`auto.create.topics.enable` is true). Defaults to true.
@@ -175,6 +271,14 @@ type Config struct {
 		// The maximum permitted size of a message (defaults to 1000000). Should be
 		// set equal to or smaller than the broker's `message.max.bytes`.
 		MaxMessageBytes int
+		// The maximum number of headers permitted on a single message (defaults
+		// to 0 for unlimited). Messages with more headers are rejected by the
+		// producer before being sent.
+		MaxHeaders int
+		// The maximum combined size in bytes of the keys and values of all
+		// headers on a single message (defaults to 0 for unlimited). Messages
+		// exceeding it are rejected by the producer before being sent.
+		MaxHeaderBytes int
 		// The level of acknowledgement reliability needed from the broker (defaults
 		// to WaitForLocal). Equivalent to the `request.required.acks` setting of the
 		// JVM producer.
@@ -196,9 +300,23 @@ type Config struct {
 		// (defaults to hashing the message key). Similar to the `partitioner.class`
 		// setting for the JVM producer.
 		Partitioner PartitionerConstructor
+		// AllowedPartitions, if set, returns the partitions of a topic that
+		// messages may be produced to, e.g. to pin canary writes to a few
+		// partitions. The partitioner then only chooses among those of them
+		// that are available, and messages produced with the manual partitioner
+		// must name one of them. A nil result disallows every partition.
+		AllowedPartitions func(topic string) []int32
 		// If enabled, the producer will ensure that exactly one copy of each message is
 		// written.
 		Idempotent bool
+		// If enabled, the producer sends at most one request at a time to each
+		// partition, so that retries never reorder its messages even though
+		// Idempotent is disabled and Net.MaxOpenRequests is above 1 (default
+		// disabled). This lowers the throughput: a batch is held back while
+		// any of its partitions awaits a response, which in practice limits
+		// each broker to one request in flight for the busy partitions. It has
+		// no effect on idempotent producers, which already preserve ordering.
+		StrictOrdering bool
 		// Transaction specify
 		Transaction struct {
 			// Used in transactions to identify an instance of a producer through restarts
@@ -241,21 +359,21 @@ type Config struct {
 		// sent to the broker. By default, messages are sent as fast as possible, and
 		// all messages received while the current batch is in-flight are placed
 		// into the subsequent batch.
-		Flush struct {
-			// The best-effort number of bytes needed to trigger a flush. Use the
-			// global sarama.MaxRequestSize to set a hard upper limit.
-			Bytes int
-			// The best-effort number of messages needed to trigger a flush. Use
-			// `MaxMessages` to set a hard upper limit.
-			Messages int
-			// The best-effort frequency of flushes. Equivalent to
-			// `queue.buffering.max.ms` setting of JVM producer.
-			Frequency time.Duration
-			// The maximum number of messages the producer will send in a single
-			// broker request. Defaults to 0 for unlimited. Similar to
-			// `queue.buffering.max.messages` in the JVM producer.
-			MaxMessages int
-		}
+		Flush FlushConfig
+
+		// TopicFlush overrides Flush for the topics it lists, e.g. so that
+		// the messages of a latency-critical topic are sent right away while
+		// those of a bulk topic linger to form larger batches. The messages of
+		// such a topic are batched apart from the others, and flushed only as
+		// decided by its own FlushConfig, which replaces Flush as a whole.
+		TopicFlush map[string]FlushConfig
+
+		// The priorities of the topics, the others having priority 0. Each
+		// broker batches the messages of every priority separately and, once
+		// any batch is ready to flush, sends the batch of the highest priority
+		// first, so that the messages of high priority topics jump the queue of
+		// requests limited by Net.MaxOpenRequests.
+		TopicPriorities map[string]int
 
 		Retry struct {
 			// The total number of times to retry sending a message (default 3).
@@ -278,6 +396,11 @@ type Config struct {
 		// OnSend() is passed to the second interceptor OnSend(), and so on in
 		// the interceptor chain.
 		Interceptors []ProducerInterceptor
+
+		// KeySerializer and ValueSerializer are used to serialize the TypedKey
+		// and TypedValue of produced messages (default nil, only raw Key and
+		// Value Encoders are supported).
+		KeySerializer, ValueSerializer Serializer
 	}
 
 	// Consumer is the namespace for configuration related to consuming messages,
@@ -300,7 +423,9 @@ type Config struct {
 				// to facilitate rebalancing when new consumers join or leave the group.
 				// The value must be set lower than Consumer.Group.Session.Timeout, but typically should be set no
 				// higher than 1/3 of that value.
-				// It can be adjusted even lower to control the expected time for normal rebalances (default 3s)
+				// It can be adjusted even lower to control the expected time for normal rebalances (default 3s).
+				// Heartbeats are sent from a dedicated goroutine, so a busy ConsumerGroupHandler does not delay
+				// them; see Consumer.Group.MaxProcessingTime to bound how long a handler may block instead.
 				Interval time.Duration
 			}
 			Rebalance struct {
@@ -331,10 +456,49 @@ type Config struct {
 					Backoff time.Duration
 				}
 			}
+			// MaxProcessingTime is the maximum time a ConsumerGroupHandler may take
+			// between taking two messages from a claim while more messages are
+			// waiting, similar to `max.poll.interval.ms` in the Java client. A
+			// warning is logged and counted once 80% of it has elapsed, and an
+			// error wrapping ErrMaxProcessingTimeExceeded is reported once it has
+			// passed. It should be lower than Rebalance.Timeout, so that a slow
+			// handler is noticed before the member is removed from the group. Set
+			// to 0 to disable the watchdog (default 0).
+			MaxProcessingTime time.Duration
+			// LeaveOnMaxProcessingTime makes a member whose handler exceeded
+			// MaxProcessingTime leave the group right away and end its session,
+			// handing its claims over to the other members instead of holding up
+			// the next rebalance until it is fenced (default false).
+			LeaveOnMaxProcessingTime bool
+
+			Leave struct {
+				// How long Close waits for the member to leave the group once its
+				// session has been released, including looking up the coordinator.
+				// A member that could not leave in time is only removed from the
+				// group, and its partitions reassigned, once Session.Timeout has
+				// elapsed (default 5s). Static members (InstanceId) do not leave.
+				Timeout time.Duration
+			}
+
+			Coordinator struct {
+				Retry struct {
+					// How long to keep retrying group and offset fetch requests while the
+					// group coordinator is loading its state (COORDINATOR_LOAD_IN_PROGRESS)
+					// or is not available (COORDINATOR_NOT_AVAILABLE), e.g. after a
+					// failover. These retries do not count against Rebalance.Retry.Max or
+					// Metadata.Retry.Max; once the timeout has elapsed those limits apply
+					// again before the error is returned (default 30s).
+					Timeout time.Duration
+					// Backoff time between retries while the coordinator is loading
+					// (default 500ms).
+					Backoff time.Duration
+				}
+			}
 			Member struct {
 				// Custom metadata to include when joining the group. The user data for all joined members
 				// can be retrieved by sending a DescribeGroupRequest to the broker that is the
-				// coordinator for the group.
+				// coordinator for the group. It is also passed to the Plan method of the
+				// BalanceStrategy, see the BalanceStrategy documentation for details.
 				UserData []byte
 			}
 
@@ -381,6 +545,28 @@ type Config struct {
 			// (no limit). Similar to the JVM's `fetch.message.max.bytes`. The
 			// global `sarama.MaxResponseSize` still applies.
 			Max int32
+			// The maximum number of message bytes to fetch from a broker in a
+			// single request, shared among the partitions consumed from it.
+			// When set, the fetch size of each partition adapts to the fill
+			// ratio of its previous fetch: a partition that filled it has it
+			// doubled, up to Max, the others go back to Default. The sizes are
+			// then capped so that they add up to ResponseMax, each partition
+			// getting at least an equal share when they all ask for more, so
+			// that a hot partition cannot starve the others. A partition whose
+			// share was too small for its next batch is given its full fetch
+			// size in the next request, which may then exceed ResponseMax.
+			// Requires Kafka 0.10.1 or later to be enforced by the broker.
+			// Defaults to 0 (fixed fetch sizes, limited in total by the global
+			// `sarama.MaxResponseSize`). Similar to the JVM's `fetch.max.bytes`.
+			ResponseMax int32
+			// The number of fetch responses per partition that may be fetched
+			// ahead of the messages being read from the Messages channel. When
+			// set, the next fetch request is issued as soon as a response has
+			// been parsed rather than once all its messages have been handed
+			// over, which hides the fetch latency behind processing at the cost
+			// of buffering up to PrefetchCount responses in memory per
+			// partition. Defaults to 0 (no prefetching).
+			PrefetchCount int
 		}
 		// The maximum amount of time the broker will wait for Consumer.Fetch.Min
 		// bytes to become available before it returns fewer than that anyways. The
@@ -415,6 +601,14 @@ type Config struct {
 			// If enabled, any errors that occurred while consuming are returned on
 			// the Errors channel (default disabled).
 			Errors bool
+			// If enabled, records that fail to decode with the KeyDeserializer
+			// or ValueDeserializer are skipped and returned on the DecodeErrors
+			// channel of the PartitionConsumer or ConsumerGroupClaim (default
+			// disabled, such records are delivered raw). A skipped record is
+			// never marked for you: a consumer group handler should mark it
+			// once it has been dealt with, otherwise it is consumed again after
+			// a rebalance unless a later offset of the partition was marked.
+			DecodeErrors bool
 		}
 
 		// Offsets specifies configuration for how and when to commit consumed
@@ -450,9 +644,32 @@ type Config struct {
 
 			Retry struct {
 				// The total number of times to retry failing commit
-				// requests during OffsetManager shutdown (default 3).
+				// requests, e.g. while the coordinator moves, before
+				// giving up until the next commit (default 3). This also
+				// bounds the retries of the last commit during
+				// OffsetManager shutdown.
 				Max int
+				// How long to wait before retrying a failing commit
+				// request (default 250ms).
+				Backoff time.Duration
 			}
+
+			// OnCommitError, if set, is called with the error of a commit
+			// which still fails once retries are exhausted, e.g. so that
+			// the application pauses processing until the offsets advance
+			// again. The error is also returned on the Errors channel of
+			// the PartitionOffsetManagers, or of the consumer group, if
+			// Consumer.Return.Errors is enabled. It is called from the
+			// goroutine committing the offsets, which is blocked until it
+			// returns (default nil).
+			OnCommitError func(err error)
+
+			// Store, if set, stores and fetches the offsets committed by
+			// OffsetManagers and consumer groups instead of Kafka, e.g. in a
+			// database, and deletes those of
+			// ClusterAdmin.DeleteConsumerGroupOffsets (default nil, storing
+			// them in Kafka).
+			Store OffsetStore
 		}
 
 		// IsolationLevel support 2 mode:
@@ -460,6 +677,31 @@ type Config struct {
 		//	- use `ReadCommitted` to hide messages that are part of an aborted transaction
 		IsolationLevel IsolationLevel
 
+		// IncludeControlRecords delivers the control records marking the
+		// commit or abort of transactions on the messages channel, with
+		// ConsumerMessage.Control set, rather than hiding them (default
+		// false). Meant for tooling auditing transactions.
+		IncludeControlRecords bool
+
+		// SkipCorruptBatches skips the record batches failing their CRC
+		// check or decompression, e.g. after a disk corruption on the broker,
+		// rather than failing their fetch response and retrying it forever
+		// (default false). The messages of a skipped batch are lost: it is
+		// logged and counted by the consumer-skipped-corrupt-batches metric,
+		// and the partition consumer resumes after its last offset. Only
+		// applies to the record batches of Kafka 0.11 and later.
+		SkipCorruptBatches bool
+
+		// SkipCRCValidation decodes the fetched record batches without
+		// checking their CRC, saving the CPU it takes (default false). Only
+		// consider it on a trusted network to brokers with reliable storage:
+		// a batch corrupted on the broker's disk or on the wire is then no
+		// longer detected, and its records may be delivered with garbled
+		// keys, values or headers, or fail to decode altogether. Only applies
+		// to the record batches of Kafka 0.11 and later, and never to the
+		// CRC computed for the produced batches.
+		SkipCRCValidation bool
+
 		// Interceptors to be called just before the record is sent to the
 		// messages channel. Interceptors allows to intercept and possible
 		// mutate the message before they are returned to the client.
@@ -467,6 +709,11 @@ type Config struct {
 		// passed to the second interceptor OnConsume(), and so on in the
 		// interceptor chain.
 		Interceptors []ConsumerInterceptor
+
+		// KeyDeserializer and ValueDeserializer are used to fill in the TypedKey
+		// and TypedValue of consumed messages (default nil, only the raw Key and
+		// Value are returned). They are applied before the Interceptors.
+		KeyDeserializer, ValueDeserializer Deserializer
 	}
 
 	// A user-provided string sent with every request to the brokers for logging,
@@ -485,7 +732,10 @@ type Config struct {
 	// ApiVersionsRequest determines whether Sarama should send an
 	// ApiVersionsRequest message to each broker as part of its initial
 	// connection. This defaults to `true` to match the official Java client
-	// and most 3rdparty ones.
+	// and most 3rdparty ones. The producer then never sends a broker produce
+	// requests, and so record formats, newer than it advertised; brokers
+	// connected with a Version older than 2.4.0 are asked on the first produce
+	// request, with an ApiVersionsRequest v0 that Kafka 0.10 and later answer.
 	ApiVersionsRequest bool
 	// The version of Kafka that Sarama will assume it is running against.
 	// Defaults to the oldest supported stable version. Since Kafka provides
@@ -500,6 +750,59 @@ type Config struct {
 	// prior to starting Sarama.
 	// See Examples on how to use the metrics registry
 	MetricRegistry metrics.Registry
+	// Tracer, if set, starts spans tracing the records produced and consumed,
+	// propagating their trace context in the TraceParentHeader of the records
+	// (default nil).
+	Tracer Tracer
+	// TopicPrefix, if set, namespaces the topics, e.g. per tenant (default "").
+	// The producers, consumers, consumer groups and cluster admins take and
+	// return logical topic names, which are mapped to the physical topics
+	// named with the prefix prepended, and list only the topics in the
+	// namespace. The Client, OffsetManager, Broker, producer interceptors,
+	// partitioners and balance strategies work on physical names, as do ACLs
+	// and the member assignments of DescribeConsumerGroups.
+	TopicPrefix string
+
+	// clock is replaced by a fake one in tests, see getClock.
+	clock clock
+	// connectionGoroutines counts the response receivers of the brokers
+	// connected with this Config, see Net.MaxConnectionGoroutines.
+	connectionGoroutines int32
+}
+
+// FlushConfig decides when the producer sends the messages it batched for a
+// broker, see Config.Producer.Flush. The producer flushes as fast as possible
+// if Bytes, Messages and Frequency are all 0.
+type FlushConfig struct {
+	// The best-effort number of bytes needed to trigger a flush. Use the
+	// global sarama.MaxRequestSize to set a hard upper limit.
+	Bytes int
+	// The best-effort number of messages needed to trigger a flush. Use
+	// `MaxMessages` to set a hard upper limit.
+	Messages int
+	// The best-effort frequency of flushes. Equivalent to
+	// `queue.buffering.max.ms` setting of JVM producer.
+	Frequency time.Duration
+	// The maximum number of messages the producer will send in a single
+	// broker request. Defaults to 0 for unlimited. Similar to
+	// `queue.buffering.max.messages` in the JVM producer.
+	MaxMessages int
+}
+
+func (f *FlushConfig) validate(name string) error {
+	switch {
+	case f.Bytes < 0:
+		return ConfigurationError(name + ".Bytes must be >= 0")
+	case f.Messages < 0:
+		return ConfigurationError(name + ".Messages must be >= 0")
+	case f.Frequency < 0:
+		return ConfigurationError(name + ".Frequency must be >= 0")
+	case f.MaxMessages < 0:
+		return ConfigurationError(name + ".MaxMessages must be >= 0")
+	case f.MaxMessages > 0 && f.MaxMessages < f.Messages:
+		return ConfigurationError(name + ".MaxMessages must be >= " + name + ".Messages when set")
+	}
+	return nil
 }
 
 // NewConfig returns a new configuration instance with sane defaults.
@@ -514,6 +817,7 @@ func NewConfig() *Config {
 	c.Net.DialTimeout = 30 * time.Second
 	c.Net.ReadTimeout = 30 * time.Second
 	c.Net.WriteTimeout = 30 * time.Second
+	c.Net.CircuitBreaker.Cooldown = 30 * time.Second
 	c.Net.SASL.Handshake = true
 	c.Net.SASL.Version = SASLHandshakeV1
 
@@ -546,13 +850,17 @@ func NewConfig() *Config {
 	c.Consumer.Offsets.AutoCommit.Interval = 1 * time.Second
 	c.Consumer.Offsets.Initial = OffsetNewest
 	c.Consumer.Offsets.Retry.Max = 3
+	c.Consumer.Offsets.Retry.Backoff = 250 * time.Millisecond
 
 	c.Consumer.Group.Session.Timeout = 10 * time.Second
 	c.Consumer.Group.Heartbeat.Interval = 3 * time.Second
+	c.Consumer.Group.Leave.Timeout = 5 * time.Second
 	c.Consumer.Group.Rebalance.GroupStrategies = []BalanceStrategy{NewBalanceStrategyRange()}
 	c.Consumer.Group.Rebalance.Timeout = 60 * time.Second
 	c.Consumer.Group.Rebalance.Retry.Max = 4
 	c.Consumer.Group.Rebalance.Retry.Backoff = 2 * time.Second
+	c.Consumer.Group.Coordinator.Retry.Timeout = 30 * time.Second
+	c.Consumer.Group.Coordinator.Retry.Backoff = 500 * time.Millisecond
 	c.Consumer.Group.ResetInvalidOffsets = true
 
 	c.ClientID = defaultClientID
@@ -608,6 +916,9 @@ func (c *Config) Validate() error {
 	if c.Consumer.Group.Session.Timeout%time.Millisecond != 0 {
 		Logger.Println("Consumer.Group.Session.Timeout only supports millisecond precision; nanoseconds will be truncated.")
 	}
+	if c.Consumer.Group.Session.Timeout < 6*time.Second {
+		Logger.Println("Consumer.Group.Session.Timeout is below the default broker group.min.session.timeout.ms (6s); joining the group will fail unless the broker allows it.")
+	}
 	if c.Consumer.Group.Heartbeat.Interval%time.Millisecond != 0 {
 		Logger.Println("Consumer.Group.Heartbeat.Interval only supports millisecond precision; nanoseconds will be truncated.")
 	}
@@ -622,12 +933,28 @@ func (c *Config) Validate() error {
 	switch {
 	case c.Net.MaxOpenRequests <= 0:
 		return ConfigurationError("Net.MaxOpenRequests must be > 0")
+	case c.Net.InFlightOverflowPolicy < InFlightBlock || c.Net.InFlightOverflowPolicy > InFlightQueue:
+		return ConfigurationError("Net.InFlightOverflowPolicy must be InFlightBlock, InFlightFailFast or InFlightQueue")
+	case c.Net.InFlightQueueSize < 0:
+		return ConfigurationError("Net.InFlightQueueSize must be >= 0")
+	case c.Net.MaxConcurrentConnects < 0:
+		return ConfigurationError("Net.MaxConcurrentConnects must be >= 0")
+	case c.Net.MaxConnectionGoroutines < 0:
+		return ConfigurationError("Net.MaxConnectionGoroutines must be >= 0")
 	case c.Net.DialTimeout <= 0:
 		return ConfigurationError("Net.DialTimeout must be > 0")
 	case c.Net.ReadTimeout <= 0:
 		return ConfigurationError("Net.ReadTimeout must be > 0")
 	case c.Net.WriteTimeout <= 0:
 		return ConfigurationError("Net.WriteTimeout must be > 0")
+	case c.Net.MaxResponseSize < 0:
+		return ConfigurationError("Net.MaxResponseSize must be >= 0")
+	case c.Net.ConnectionMaxAge < 0:
+		return ConfigurationError("Net.ConnectionMaxAge must be >= 0")
+	case c.Net.CircuitBreaker.Failures < 0:
+		return ConfigurationError("Net.CircuitBreaker.Failures must be >= 0")
+	case c.Net.CircuitBreaker.Failures > 0 && c.Net.CircuitBreaker.Cooldown <= 0:
+		return ConfigurationError("Net.CircuitBreaker.Cooldown must be > 0")
 	case c.Net.SASL.Enable:
 		if c.Net.SASL.Mechanism == "" {
 			c.Net.SASL.Mechanism = SASLTypePlaintext
@@ -679,9 +1006,22 @@ func (c *Config) Validate() error {
 			default:
 				return ConfigurationError("Net.SASL.GSSAPI.AuthType is invalid. Possible values are KRB5_USER_AUTH, KRB5_KEYTAB_AUTH, and KRB5_CCACHE_AUTH")
 			}
+			for _, authType := range c.Net.SASL.GSSAPI.FallbackAuthTypes {
+				switch {
+				case authType == KRB5_USER_AUTH && c.Net.SASL.GSSAPI.Password == "":
+					return ConfigurationError("Net.SASL.GSSAPI.Password must not be empty when Net.SASL.GSSAPI.FallbackAuthTypes contains KRB5_USER_AUTH")
+				case authType == KRB5_KEYTAB_AUTH && c.Net.SASL.GSSAPI.KeyTabPath == "":
+					return ConfigurationError("Net.SASL.GSSAPI.KeyTabPath must not be empty when Net.SASL.GSSAPI.FallbackAuthTypes contains KRB5_KEYTAB_AUTH")
+				case authType == KRB5_CCACHE_AUTH && c.Net.SASL.GSSAPI.CCachePath == "":
+					return ConfigurationError("Net.SASL.GSSAPI.CCachePath must not be empty when Net.SASL.GSSAPI.FallbackAuthTypes contains KRB5_CCACHE_AUTH")
+				case authType < KRB5_USER_AUTH || authType > KRB5_CCACHE_AUTH:
+					return ConfigurationError("Net.SASL.GSSAPI.FallbackAuthTypes is invalid. Possible values are KRB5_USER_AUTH, KRB5_KEYTAB_AUTH, and KRB5_CCACHE_AUTH")
+				}
+			}
 
-			if c.Net.SASL.GSSAPI.KerberosConfigPath == "" {
-				return ConfigurationError("Net.SASL.GSSAPI.KerberosConfigPath must not be empty when GSS-API mechanism is used")
+			if c.Net.SASL.GSSAPI.KerberosConfigPath == "" && c.Net.SASL.GSSAPI.KerberosConfig == nil &&
+				c.Net.SASL.GSSAPI.NewKerberosClientFunc == nil {
+				return ConfigurationError("Net.SASL.GSSAPI.KerberosConfigPath or Net.SASL.GSSAPI.KerberosConfig must be set when GSS-API mechanism is used")
 			}
 			if c.Net.SASL.GSSAPI.Username == "" {
 				return ConfigurationError("Net.SASL.GSSAPI.Username must not be empty when GSS-API mechanism is used")
@@ -689,13 +1029,41 @@ func (c *Config) Validate() error {
 			if c.Net.SASL.GSSAPI.Realm == "" {
 				return ConfigurationError("Net.SASL.GSSAPI.Realm must not be empty when GSS-API mechanism is used")
 			}
+			if c.Net.SASL.GSSAPI.ClockSkewRetries < 0 {
+				return ConfigurationError("Net.SASL.GSSAPI.ClockSkewRetries must be >= 0")
+			}
+			for _, flag := range c.Net.SASL.GSSAPI.ContextFlags {
+				switch flag {
+				case gssapi.ContextFlagDeleg, gssapi.ContextFlagMutual, gssapi.ContextFlagReplay, gssapi.ContextFlagSequence,
+					gssapi.ContextFlagConf, gssapi.ContextFlagInteg, gssapi.ContextFlagAnon:
+				default:
+					return ConfigurationError(fmt.Sprintf("Net.SASL.GSSAPI.ContextFlags contains the unknown context flag %d", flag))
+				}
+			}
+			for _, name := range c.Net.SASL.GSSAPI.PermittedEncTypes {
+				if etypeID.ETypesByName[name] == 0 {
+					return ConfigurationError(fmt.Sprintf("Net.SASL.GSSAPI.PermittedEncTypes contains the unknown encryption type %q", name))
+				}
+			}
 		default:
+			if registeredSASLMechanism(c.Net.SASL.Mechanism) != nil {
+				if c.Net.SASL.Version != SASLHandshakeV1 {
+					return ConfigurationError("Net.SASL.Version must be SASLHandshakeV1 when a custom SASL mechanism is used")
+				}
+				break
+			}
 			msg := fmt.Sprintf("The SASL mechanism configuration is invalid. Possible values are `%s`, `%s`, `%s`, `%s` and `%s`",
 				SASLTypeOAuth, SASLTypePlaintext, SASLTypeSCRAMSHA256, SASLTypeSCRAMSHA512, SASLTypeGSSAPI)
 			return ConfigurationError(msg)
 		}
 	}
 
+	for key, timeout := range c.Net.RequestTimeouts {
+		if timeout <= 0 {
+			return ConfigurationError(fmt.Sprintf("Net.RequestTimeouts[%d] must be > 0", key))
+		}
+	}
+
 	// validate the Admin values
 	switch {
 	case c.Admin.Timeout <= 0:
@@ -708,36 +1076,47 @@ func (c *Config) Validate() error {
 		return ConfigurationError("Metadata.Retry.Max must be >= 0")
 	case c.Metadata.Retry.Backoff < 0:
 		return ConfigurationError("Metadata.Retry.Backoff must be >= 0")
+	case c.Metadata.Retry.LeaderBackoff < 0:
+		return ConfigurationError("Metadata.Retry.LeaderBackoff must be >= 0")
 	case c.Metadata.RefreshFrequency < 0:
 		return ConfigurationError("Metadata.RefreshFrequency must be >= 0")
+	case c.Metadata.RefreshCoalesceWindow < 0:
+		return ConfigurationError("Metadata.RefreshCoalesceWindow must be >= 0")
+	case c.Metadata.MaxCachedTopics < 0:
+		return ConfigurationError("Metadata.MaxCachedTopics must be >= 0")
+	case c.Metadata.MaxCachedTopics > 0 && c.Metadata.Full:
+		return ConfigurationError("Metadata.MaxCachedTopics requires Metadata.Full to be disabled")
 	}
 
 	// validate the Producer values
 	switch {
 	case c.Producer.MaxMessageBytes <= 0:
 		return ConfigurationError("Producer.MaxMessageBytes must be > 0")
+	case c.Producer.MaxHeaders < 0:
+		return ConfigurationError("Producer.MaxHeaders must be >= 0")
+	case c.Producer.MaxHeaderBytes < 0:
+		return ConfigurationError("Producer.MaxHeaderBytes must be >= 0")
 	case c.Producer.RequiredAcks < -1:
 		return ConfigurationError("Producer.RequiredAcks must be >= -1")
 	case c.Producer.Timeout <= 0:
 		return ConfigurationError("Producer.Timeout must be > 0")
 	case c.Producer.Partitioner == nil:
 		return ConfigurationError("Producer.Partitioner must not be nil")
-	case c.Producer.Flush.Bytes < 0:
-		return ConfigurationError("Producer.Flush.Bytes must be >= 0")
-	case c.Producer.Flush.Messages < 0:
-		return ConfigurationError("Producer.Flush.Messages must be >= 0")
-	case c.Producer.Flush.Frequency < 0:
-		return ConfigurationError("Producer.Flush.Frequency must be >= 0")
-	case c.Producer.Flush.MaxMessages < 0:
-		return ConfigurationError("Producer.Flush.MaxMessages must be >= 0")
-	case c.Producer.Flush.MaxMessages > 0 && c.Producer.Flush.MaxMessages < c.Producer.Flush.Messages:
-		return ConfigurationError("Producer.Flush.MaxMessages must be >= Producer.Flush.Messages when set")
 	case c.Producer.Retry.Max < 0:
 		return ConfigurationError("Producer.Retry.Max must be >= 0")
 	case c.Producer.Retry.Backoff < 0:
 		return ConfigurationError("Producer.Retry.Backoff must be >= 0")
 	}
 
+	if err := c.Producer.Flush.validate("Producer.Flush"); err != nil {
+		return err
+	}
+	for topic, flush := range c.Producer.TopicFlush {
+		if err := flush.validate(fmt.Sprintf("Producer.TopicFlush[%q]", topic)); err != nil {
+			return err
+		}
+	}
+
 	if c.Producer.Compression == CompressionLZ4 && !c.Version.IsAtLeast(V0_10_0_0) {
 		return ConfigurationError("lz4 compression requires Version >= V0_10_0_0")
 	}
@@ -781,6 +1160,10 @@ func (c *Config) Validate() error {
 		return ConfigurationError("Consumer.Fetch.Default must be > 0")
 	case c.Consumer.Fetch.Max < 0:
 		return ConfigurationError("Consumer.Fetch.Max must be >= 0")
+	case c.Consumer.Fetch.ResponseMax < 0:
+		return ConfigurationError("Consumer.Fetch.ResponseMax must be >= 0")
+	case c.Consumer.Fetch.PrefetchCount < 0:
+		return ConfigurationError("Consumer.Fetch.PrefetchCount must be >= 0")
 	case c.Consumer.MaxWaitTime < 1*time.Millisecond:
 		return ConfigurationError("Consumer.MaxWaitTime must be >= 1ms")
 	case c.Consumer.MaxProcessingTime <= 0:
@@ -793,6 +1176,8 @@ func (c *Config) Validate() error {
 		return ConfigurationError("Consumer.Offsets.Initial must be OffsetOldest or OffsetNewest")
 	case c.Consumer.Offsets.Retry.Max < 0:
 		return ConfigurationError("Consumer.Offsets.Retry.Max must be >= 0")
+	case c.Consumer.Offsets.Retry.Backoff < 0:
+		return ConfigurationError("Consumer.Offsets.Retry.Backoff must be >= 0")
 	case c.Consumer.IsolationLevel != ReadUncommitted && c.Consumer.IsolationLevel != ReadCommitted:
 		return ConfigurationError("Consumer.IsolationLevel must be ReadUncommitted or ReadCommitted")
 	}
@@ -827,6 +1212,14 @@ func (c *Config) Validate() error {
 		return ConfigurationError("Consumer.Group.Rebalance.Retry.Max must be >= 0")
 	case c.Consumer.Group.Rebalance.Retry.Backoff < 0:
 		return ConfigurationError("Consumer.Group.Rebalance.Retry.Backoff must be >= 0")
+	case c.Consumer.Group.MaxProcessingTime < 0:
+		return ConfigurationError("Consumer.Group.MaxProcessingTime must be >= 0")
+	case c.Consumer.Group.Leave.Timeout <= 0:
+		return ConfigurationError("Consumer.Group.Leave.Timeout must be > 0")
+	case c.Consumer.Group.Coordinator.Retry.Timeout < 0:
+		return ConfigurationError("Consumer.Group.Coordinator.Retry.Timeout must be >= 0")
+	case c.Consumer.Group.Coordinator.Retry.Backoff < 0:
+		return ConfigurationError("Consumer.Group.Coordinator.Retry.Backoff must be >= 0")
 	}
 
 	for _, strategy := range c.Consumer.Group.Rebalance.GroupStrategies {
@@ -871,6 +1264,22 @@ func (c *Config) getDialer() proxy.Dialer {
 	}
 }
 
+// acquireConnectionGoroutine reserves the goroutine of a broker connection,
+// returning false when Net.MaxConnectionGoroutines are already running.
+func (c *Config) acquireConnectionGoroutine() bool {
+	if atomic.AddInt32(&c.connectionGoroutines, 1) <= int32(c.Net.MaxConnectionGoroutines) || c.Net.MaxConnectionGoroutines == 0 {
+		return true
+	}
+	atomic.AddInt32(&c.connectionGoroutines, -1)
+	return false
+}
+
+// releaseConnectionGoroutine releases a goroutine reserved by
+// acquireConnectionGoroutine once it stops.
+func (c *Config) releaseConnectionGoroutine() {
+	atomic.AddInt32(&c.connectionGoroutines, -1)
+}
+
 const MAX_GROUP_INSTANCE_ID_LENGTH = 249
 
 var GROUP_INSTANCE_ID_REGEXP = regexp.MustCompile(`^[0-9a-zA-Z\._\-]+$`)
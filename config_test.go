@@ -6,7 +6,9 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/max444ks1m777/gokrb5/v8/gssapi"
 	"github.com/rcrowley/go-metrics"
 	assert "github.com/stretchr/testify/require"
 )
@@ -18,6 +20,8 @@ func NewTestConfig() *Config {
 	config := NewConfig()
 	config.Consumer.Retry.Backoff = 0
 	config.Producer.Retry.Backoff = 0
+	config.Consumer.Group.Coordinator.Retry.Backoff = 0
+	config.Consumer.Offsets.Retry.Backoff = 0
 	config.Version = MinVersion
 	return config
 }
@@ -71,6 +75,34 @@ func TestNetConfigValidates(t *testing.T) {
 			},
 			"Net.MaxOpenRequests must be > 0",
 		},
+		{
+			"InFlightOverflowPolicy",
+			func(cfg *Config) {
+				cfg.Net.InFlightOverflowPolicy = InFlightQueue + 1
+			},
+			"Net.InFlightOverflowPolicy must be InFlightBlock, InFlightFailFast or InFlightQueue",
+		},
+		{
+			"InFlightQueueSize",
+			func(cfg *Config) {
+				cfg.Net.InFlightQueueSize = -1
+			},
+			"Net.InFlightQueueSize must be >= 0",
+		},
+		{
+			"MaxConcurrentConnects",
+			func(cfg *Config) {
+				cfg.Net.MaxConcurrentConnects = -1
+			},
+			"Net.MaxConcurrentConnects must be >= 0",
+		},
+		{
+			"RequestTimeouts",
+			func(cfg *Config) {
+				cfg.Net.RequestTimeouts = map[int16]time.Duration{1: 0}
+			},
+			"Net.RequestTimeouts[1] must be > 0",
+		},
 		{
 			"DialTimeout",
 			func(cfg *Config) {
@@ -92,6 +124,35 @@ func TestNetConfigValidates(t *testing.T) {
 			},
 			"Net.WriteTimeout must be > 0",
 		},
+		{
+			"MaxResponseSize",
+			func(cfg *Config) {
+				cfg.Net.MaxResponseSize = -1
+			},
+			"Net.MaxResponseSize must be >= 0",
+		},
+		{
+			"ConnectionMaxAge",
+			func(cfg *Config) {
+				cfg.Net.ConnectionMaxAge = -1
+			},
+			"Net.ConnectionMaxAge must be >= 0",
+		},
+		{
+			"CircuitBreaker.Failures",
+			func(cfg *Config) {
+				cfg.Net.CircuitBreaker.Failures = -1
+			},
+			"Net.CircuitBreaker.Failures must be >= 0",
+		},
+		{
+			"CircuitBreaker.Cooldown",
+			func(cfg *Config) {
+				cfg.Net.CircuitBreaker.Failures = 3
+				cfg.Net.CircuitBreaker.Cooldown = 0
+			},
+			"Net.CircuitBreaker.Cooldown must be > 0",
+		},
 		{
 			"SASL.User",
 			func(cfg *Config) {
@@ -177,6 +238,36 @@ func TestNetConfigValidates(t *testing.T) {
 			"Net.SASL.GSSAPI.KeyTabPath must not be empty when GSS-API mechanism is used" +
 				" and Net.SASL.GSSAPI.AuthType = KRB5_KEYTAB_AUTH",
 		},
+		{
+			"SASL.Mechanism GSSAPI (Kerberos) - Fallback to ccache, Missing CCachePath field",
+			func(cfg *Config) {
+				cfg.Net.SASL.Enable = true
+				cfg.Net.SASL.Mechanism = SASLTypeGSSAPI
+				cfg.Net.SASL.GSSAPI.AuthType = KRB5_KEYTAB_AUTH
+				cfg.Net.SASL.GSSAPI.FallbackAuthTypes = []int{KRB5_CCACHE_AUTH}
+				cfg.Net.SASL.GSSAPI.KeyTabPath = "/etc/security/kafka.keytab"
+				cfg.Net.SASL.GSSAPI.Username = "sarama"
+				cfg.Net.SASL.GSSAPI.ServiceName = "kafka"
+				cfg.Net.SASL.GSSAPI.Realm = "kafka"
+				cfg.Net.SASL.GSSAPI.KerberosConfigPath = "/etc/krb5.conf"
+			},
+			"Net.SASL.GSSAPI.CCachePath must not be empty when Net.SASL.GSSAPI.FallbackAuthTypes contains KRB5_CCACHE_AUTH",
+		},
+		{
+			"SASL.Mechanism GSSAPI (Kerberos) - Invalid fallback",
+			func(cfg *Config) {
+				cfg.Net.SASL.Enable = true
+				cfg.Net.SASL.Mechanism = SASLTypeGSSAPI
+				cfg.Net.SASL.GSSAPI.AuthType = KRB5_KEYTAB_AUTH
+				cfg.Net.SASL.GSSAPI.FallbackAuthTypes = []int{4}
+				cfg.Net.SASL.GSSAPI.KeyTabPath = "/etc/security/kafka.keytab"
+				cfg.Net.SASL.GSSAPI.Username = "sarama"
+				cfg.Net.SASL.GSSAPI.ServiceName = "kafka"
+				cfg.Net.SASL.GSSAPI.Realm = "kafka"
+				cfg.Net.SASL.GSSAPI.KerberosConfigPath = "/etc/krb5.conf"
+			},
+			"Net.SASL.GSSAPI.FallbackAuthTypes is invalid. Possible values are KRB5_USER_AUTH, KRB5_KEYTAB_AUTH, and KRB5_CCACHE_AUTH",
+		},
 		{
 			"SASL.Mechanism GSSAPI (Kerberos) - Missing username",
 			func(cfg *Config) {
@@ -227,7 +318,7 @@ func TestNetConfigValidates(t *testing.T) {
 				cfg.Net.SASL.GSSAPI.Password = "sarama"
 				cfg.Net.SASL.GSSAPI.Realm = "kafka"
 			},
-			"Net.SASL.GSSAPI.KerberosConfigPath must not be empty when GSS-API mechanism is used",
+			"Net.SASL.GSSAPI.KerberosConfigPath or Net.SASL.GSSAPI.KerberosConfig must be set when GSS-API mechanism is used",
 		},
 		{
 			"SASL.Mechanism GSSAPI (Kerberos) - Missing Realm",
@@ -242,6 +333,51 @@ func TestNetConfigValidates(t *testing.T) {
 			},
 			"Net.SASL.GSSAPI.Realm must not be empty when GSS-API mechanism is used",
 		},
+		{
+			"SASL.Mechanism GSSAPI (Kerberos) - Negative ClockSkewRetries",
+			func(cfg *Config) {
+				cfg.Net.SASL.Enable = true
+				cfg.Net.SASL.GSSAPI.ServiceName = "kafka"
+				cfg.Net.SASL.Mechanism = SASLTypeGSSAPI
+				cfg.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+				cfg.Net.SASL.GSSAPI.Username = "sarama"
+				cfg.Net.SASL.GSSAPI.Password = "sarama"
+				cfg.Net.SASL.GSSAPI.KerberosConfigPath = "/etc/krb5.conf"
+				cfg.Net.SASL.GSSAPI.Realm = "kafka"
+				cfg.Net.SASL.GSSAPI.ClockSkewRetries = -1
+			},
+			"Net.SASL.GSSAPI.ClockSkewRetries must be >= 0",
+		},
+		{
+			"SASL.Mechanism GSSAPI (Kerberos) - Unknown PermittedEncTypes",
+			func(cfg *Config) {
+				cfg.Net.SASL.Enable = true
+				cfg.Net.SASL.GSSAPI.ServiceName = "kafka"
+				cfg.Net.SASL.Mechanism = SASLTypeGSSAPI
+				cfg.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+				cfg.Net.SASL.GSSAPI.Username = "sarama"
+				cfg.Net.SASL.GSSAPI.Password = "sarama"
+				cfg.Net.SASL.GSSAPI.KerberosConfigPath = "/etc/krb5.conf"
+				cfg.Net.SASL.GSSAPI.Realm = "kafka"
+				cfg.Net.SASL.GSSAPI.PermittedEncTypes = []string{"aes256-cts-hmac-sha1-96", "rot13"}
+			},
+			`Net.SASL.GSSAPI.PermittedEncTypes contains the unknown encryption type "rot13"`,
+		},
+		{
+			"SASL.Mechanism GSSAPI (Kerberos) - Unknown ContextFlags",
+			func(cfg *Config) {
+				cfg.Net.SASL.Enable = true
+				cfg.Net.SASL.GSSAPI.ServiceName = "kafka"
+				cfg.Net.SASL.Mechanism = SASLTypeGSSAPI
+				cfg.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+				cfg.Net.SASL.GSSAPI.Username = "sarama"
+				cfg.Net.SASL.GSSAPI.Password = "sarama"
+				cfg.Net.SASL.GSSAPI.KerberosConfigPath = "/etc/krb5.conf"
+				cfg.Net.SASL.GSSAPI.Realm = "kafka"
+				cfg.Net.SASL.GSSAPI.ContextFlags = []int{gssapi.ContextFlagMutual, 3}
+			},
+			"Net.SASL.GSSAPI.ContextFlags contains the unknown context flag 3",
+		},
 		{
 			"SASL.Mechanism GSSAPI (Kerberos) - Using Credentials Cache, Missing CCachePath field",
 			func(cfg *Config) {
@@ -287,6 +423,13 @@ func TestMetadataConfigValidates(t *testing.T) {
 			},
 			"Metadata.Retry.Backoff must be >= 0",
 		},
+		{
+			"Retry.LeaderBackoff",
+			func(cfg *Config) {
+				cfg.Metadata.Retry.LeaderBackoff = -1
+			},
+			"Metadata.Retry.LeaderBackoff must be >= 0",
+		},
 		{
 			"RefreshFrequency",
 			func(cfg *Config) {
@@ -294,6 +437,28 @@ func TestMetadataConfigValidates(t *testing.T) {
 			},
 			"Metadata.RefreshFrequency must be >= 0",
 		},
+		{
+			"RefreshCoalesceWindow",
+			func(cfg *Config) {
+				cfg.Metadata.RefreshCoalesceWindow = -1
+			},
+			"Metadata.RefreshCoalesceWindow must be >= 0",
+		},
+		{
+			"MaxCachedTopics",
+			func(cfg *Config) {
+				cfg.Metadata.Full = false
+				cfg.Metadata.MaxCachedTopics = -1
+			},
+			"Metadata.MaxCachedTopics must be >= 0",
+		},
+		{
+			"MaxCachedTopics with Full",
+			func(cfg *Config) {
+				cfg.Metadata.MaxCachedTopics = 10
+			},
+			"Metadata.MaxCachedTopics requires Metadata.Full to be disabled",
+		},
 	}
 
 	for i, test := range tests {
@@ -346,6 +511,20 @@ func TestProducerConfigValidates(t *testing.T) {
 			},
 			"Producer.MaxMessageBytes must be > 0",
 		},
+		{
+			"MaxHeaders",
+			func(cfg *Config) {
+				cfg.Producer.MaxHeaders = -1
+			},
+			"Producer.MaxHeaders must be >= 0",
+		},
+		{
+			"MaxHeaderBytes",
+			func(cfg *Config) {
+				cfg.Producer.MaxHeaderBytes = -1
+			},
+			"Producer.MaxHeaderBytes must be >= 0",
+		},
 		{
 			"RequiredAcks",
 			func(cfg *Config) {
@@ -403,6 +582,13 @@ func TestProducerConfigValidates(t *testing.T) {
 			},
 			"Producer.Flush.MaxMessages must be >= Producer.Flush.Messages when set",
 		},
+		{
+			"TopicFlush.Frequency",
+			func(cfg *Config) {
+				cfg.Producer.TopicFlush = map[string]FlushConfig{"bulk": {Frequency: -1}}
+			},
+			`Producer.TopicFlush["bulk"].Frequency must be >= 0`,
+		},
 		{
 			"Flush.Retry.Max",
 			func(cfg *Config) {
@@ -486,6 +672,20 @@ func TestConsumerConfigValidates(t *testing.T) {
 			},
 			"Consumer.IsolationLevel must be ReadUncommitted or ReadCommitted",
 		},
+		{
+			"Group MaxProcessingTime",
+			func(cfg *Config) {
+				cfg.Consumer.Group.MaxProcessingTime = -1
+			},
+			"Consumer.Group.MaxProcessingTime must be >= 0",
+		},
+		{
+			"Coordinator retry timeout",
+			func(cfg *Config) {
+				cfg.Consumer.Group.Coordinator.Retry.Timeout = -1
+			},
+			"Consumer.Group.Coordinator.Retry.Timeout must be >= 0",
+		},
 	}
 
 	for i, test := range tests {
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,15 +13,35 @@ import (
 )
 
 // ConsumerMessage encapsulates a Kafka message returned by the consumer.
+//
+// Key and Value are not copied out of the fetch response: they reference the
+// buffer the response was read into (or the decompressed batch for compressed
+// topics). Sarama never reuses that buffer, so the slices stay valid for as
+// long as the message is referenced and can be processed in place without
+// copying.
 type ConsumerMessage struct {
 	Headers        []*RecordHeader // only set if kafka is version 0.11+
 	Timestamp      time.Time       // only set if kafka is version 0.10+, inner message timestamp
 	BlockTimestamp time.Time       // only set if kafka is version 0.10+, outer (compressed) block timestamp
+	TimestampType  TimestampType   // whether Timestamp is a CreateTime or a LogAppendTime, TimestampTypeNone before kafka 0.10
 
 	Key, Value []byte
 	Topic      string
 	Partition  int32
 	Offset     int64
+
+	// TypedKey and TypedValue hold the Key and Value decoded by the configured
+	// Consumer.KeyDeserializer and Consumer.ValueDeserializer, nil otherwise.
+	TypedKey, TypedValue interface{}
+
+	// Control is the transaction marker of a control record, only delivered
+	// with Consumer.IncludeControlRecords, nil otherwise.
+	Control *ControlRecord
+	// ProducerID is the ID of the producer whose transaction a control
+	// record marks, only set along Control.
+	ProducerID int64
+
+	span Span
 }
 
 // ConsumerError is what is provided to the user when an error occurs.
@@ -29,6 +50,10 @@ type ConsumerError struct {
 	Topic     string
 	Partition int32
 	Err       error
+
+	// Message is the record that failed to decode, with its raw Key and
+	// Value, for the errors returned on DecodeErrors, nil otherwise.
+	Message *ConsumerMessage
 }
 
 func (ce ConsumerError) Error() string {
@@ -67,6 +92,14 @@ type Consumer interface {
 	// or OffsetOldest
 	ConsumePartition(topic string, partition int32, offset int64) (PartitionConsumer, error)
 
+	// ConsumePartitionRange creates a PartitionConsumer on the given topic/partition
+	// that consumes the offsets from start (inclusive) to end (exclusive) and then
+	// shuts itself down, closing the Messages channel. Start can be a literal offset
+	// or OffsetOldest. If end is beyond the high water mark at the time of the call,
+	// the range ends at the high water mark instead. Offsets missing from the log,
+	// e.g. due to compaction, are skipped, so the last message may be below end-1.
+	ConsumePartitionRange(topic string, partition int32, start, end int64) (PartitionConsumer, error)
+
 	// HighWaterMarks returns the current high water marks for each topic and partition.
 	// Consistency between partitions is not guaranteed since high water marks are updated separately.
 	HighWaterMarks() map[string]map[int32]int64
@@ -149,32 +182,65 @@ func (c *consumer) Close() error {
 }
 
 func (c *consumer) Topics() ([]string, error) {
-	return c.client.Topics()
+	topics, err := c.client.Topics()
+	if err != nil {
+		return nil, err
+	}
+	return c.conf.logicalTopics(topics), nil
 }
 
 func (c *consumer) Partitions(topic string) ([]int32, error) {
-	return c.client.Partitions(topic)
+	return c.client.Partitions(c.conf.physicalTopic(topic))
 }
 
 func (c *consumer) ConsumePartition(topic string, partition int32, offset int64) (PartitionConsumer, error) {
+	return c.consumePartition(topic, partition, offset, unboundedOffset)
+}
+
+func (c *consumer) ConsumePartitionRange(topic string, partition int32, start, end int64) (PartitionConsumer, error) {
+	if start == OffsetNewest {
+		return nil, ConfigurationError("ConsumePartitionRange does not accept OffsetNewest as start offset")
+	}
+	if end < 0 || (start >= 0 && end < start) {
+		return nil, ConfigurationError("ConsumePartitionRange end offset must not be lower than the start offset")
+	}
+	return c.consumePartition(topic, partition, start, end)
+}
+
+func (c *consumer) consumePartition(topic string, partition int32, offset, endOffset int64) (PartitionConsumer, error) {
 	child := &partitionConsumer{
 		consumer:             c,
 		conf:                 c.conf,
-		topic:                topic,
+		topic:                c.conf.physicalTopic(topic),
+		logicalTopic:         topic,
 		partition:            partition,
 		messages:             make(chan *ConsumerMessage, c.conf.ChannelBufferSize),
 		errors:               make(chan *ConsumerError, c.conf.ChannelBufferSize),
+		decodeErrors:         make(chan *ConsumerError, c.conf.ChannelBufferSize),
 		feeder:               make(chan *FetchResponse, 1),
 		leaderEpoch:          invalidLeaderEpoch,
+		lastFetchedEpoch:     invalidLeaderEpoch,
 		preferredReadReplica: invalidPreferredReplicaID,
 		trigger:              make(chan none, 1),
 		dying:                make(chan none),
 		fetchSize:            c.conf.Consumer.Fetch.Default,
+		endOffset:            endOffset,
+	}
+	if c.conf.Consumer.Fetch.PrefetchCount > 0 {
+		child.prefetched = make(chan *prefetchedMessages, c.conf.Consumer.Fetch.PrefetchCount)
 	}
 
 	if err := child.chooseStartingOffset(offset); err != nil {
 		return nil, err
 	}
+	child.startingOffset = child.offset
+	if child.endOffset != unboundedOffset && child.endOffset > child.highWaterMarkOffset {
+		child.endOffset = child.highWaterMarkOffset
+	}
+	if child.reachedEnd(child.offset) {
+		// the range is empty, the subscription is dropped straight away
+		child.AsyncClose()
+	}
 
 	leader, epoch, err := c.client.LeaderAndEpoch(child.topic, child.partition)
 	if err != nil {
@@ -185,8 +251,11 @@ func (c *consumer) ConsumePartition(topic string, partition int32, offset int64)
 		return nil, err
 	}
 
-	go withRecover(child.dispatcher)
-	go withRecover(child.responseFeeder)
+	goWithRecover(c.conf.MetricRegistry, child.dispatcher)
+	goWithRecover(c.conf.MetricRegistry, child.responseFeeder)
+	if child.prefetched != nil {
+		goWithRecover(c.conf.MetricRegistry, child.prefetchDeliverer)
+	}
 
 	child.leaderEpoch = epoch
 	child.broker = c.refBrokerConsumer(leader)
@@ -205,6 +274,7 @@ func (c *consumer) HighWaterMarks() map[string]map[int32]int64 {
 		for partition, pc := range p {
 			hwm[partition] = pc.HighWaterMarkOffset()
 		}
+		topic, _ = c.conf.logicalTopic(topic)
 		hwms[topic] = hwm
 	}
 
@@ -279,7 +349,7 @@ func (c *consumer) Pause(topicPartitions map[string][]int32) {
 
 	for topic, partitions := range topicPartitions {
 		for _, partition := range partitions {
-			if topicConsumers, ok := c.children[topic]; ok {
+			if topicConsumers, ok := c.children[c.conf.physicalTopic(topic)]; ok {
 				if partitionConsumer, ok := topicConsumers[partition]; ok {
 					partitionConsumer.Pause()
 				}
@@ -295,7 +365,7 @@ func (c *consumer) Resume(topicPartitions map[string][]int32) {
 
 	for topic, partitions := range topicPartitions {
 		for _, partition := range partitions {
-			if topicConsumers, ok := c.children[topic]; ok {
+			if topicConsumers, ok := c.children[c.conf.physicalTopic(topic)]; ok {
 				if partitionConsumer, ok := topicConsumers[partition]; ok {
 					partitionConsumer.Resume()
 				}
@@ -371,11 +441,25 @@ type PartitionConsumer interface {
 	// Consumer.Return.Errors setting to true, and read from this channel.
 	Errors() <-chan *ConsumerError
 
+	// DecodeErrors returns a read channel of the records that failed to
+	// decode, if Consumer.Return.DecodeErrors is enabled, so that they can be
+	// routed to a dead letter queue. Such records are skipped rather than
+	// delivered on Messages. A record left unread for longer than
+	// Consumer.MaxProcessingTime is returned over the Errors channel instead,
+	// or logged. By default they are delivered raw and their errors returned
+	// over the Errors channel.
+	DecodeErrors() <-chan *ConsumerError
+
 	// HighWaterMarkOffset returns the high water mark offset of the partition,
 	// i.e. the offset that will be used for the next message that will be produced.
 	// You can use this to determine how far behind the processing is.
 	HighWaterMarkOffset() int64
 
+	// Lag returns the number of messages between the high water mark offset of the
+	// partition and the offset of the next message to be returned over the Messages
+	// channel, as of the latest fetch response. It is 0 when the consumer is caught up.
+	Lag() int64
+
 	// Pause suspends fetching from this partition. Future calls to the broker will not return
 	// any records from these partition until it have been resumed using Resume().
 	// Note that this method does not affect partition subscription.
@@ -393,6 +477,7 @@ type PartitionConsumer interface {
 
 type partitionConsumer struct {
 	highWaterMarkOffset int64 // must be at the top of the struct because https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	deliveredOffset     int64 // offset following the last message sent to the messages channel, accessed atomically
 
 	consumer *consumer
 	conf     *Config
@@ -401,16 +486,31 @@ type partitionConsumer struct {
 	errors   chan *ConsumerError
 	feeder   chan *FetchResponse
 
+	decodeErrors chan *ConsumerError
+
+	// only set when Consumer.Fetch.PrefetchCount > 0
+	prefetched chan *prefetchedMessages
+
 	leaderEpoch          int32
 	preferredReadReplica int32
 
+	// lastFetchedEpoch is the leader epoch of the last record consumed, which is
+	// used to validate the position when the leader epoch was fenced
+	lastFetchedEpoch int32
+	epochFenced      bool
+
 	trigger, dying chan none
 	closeOnce      sync.Once
-	topic          string
+	topic          string // the physical topic
+	logicalTopic   string // topic without Config.TopicPrefix, as delivered
 	partition      int32
 	responseResult error
 	fetchSize      int32
+	requestedSize  int32 // the fetch size of the last request, see Consumer.Fetch.ResponseMax
+	starving       bool  // whether the last request was too small for the next batch
 	offset         int64
+	startingOffset int64 // the resolved offset consumption started at, immutable
+	endOffset      int64 // the offset to stop consuming at, or unboundedOffset
 	retries        int32
 
 	paused int32
@@ -418,9 +518,20 @@ type partitionConsumer struct {
 
 var errTimedOut = errors.New("timed out feeding messages to the user") // not user-facing
 
+// unboundedOffset is the endOffset of partition consumers not created by
+// ConsumePartitionRange.
+const unboundedOffset int64 = -1
+
+// prefetchedMessages are the messages parsed from a single fetch response, queued
+// for delivery to the user along with the offset to fetch next.
+type prefetchedMessages struct {
+	messages []*ConsumerMessage
+	offset   int64
+}
+
 func (child *partitionConsumer) sendError(err error) {
 	cErr := &ConsumerError{
-		Topic:     child.topic,
+		Topic:     child.logicalTopic,
 		Partition: child.partition,
 		Err:       err,
 	}
@@ -445,7 +556,7 @@ func (child *partitionConsumer) dispatcher() {
 		select {
 		case <-child.dying:
 			close(child.trigger)
-		case <-time.After(child.computeBackoff()):
+		case <-child.conf.getClock().After(child.computeBackoff()):
 			if child.broker != nil {
 				child.consumer.unrefBrokerConsumer(child.broker)
 				child.broker = nil
@@ -468,6 +579,14 @@ func (child *partitionConsumer) dispatcher() {
 func (child *partitionConsumer) preferredBroker() (*Broker, int32, error) {
 	if child.preferredReadReplica >= 0 {
 		broker, err := child.consumer.client.Broker(child.preferredReadReplica)
+		if err == nil && broker.circuit.state() == CircuitOpen {
+			// fetch from the leader until the replica recovers, the next
+			// fetch response tells which replica to use again
+			Logger.Printf("consumer/%s/%d circuit of preferred read replica %d is open - will fallback to leader\n",
+				child.topic, child.partition, child.preferredReadReplica)
+			child.preferredReadReplica = invalidPreferredReplicaID
+			return child.consumer.client.LeaderAndEpoch(child.topic, child.partition)
+		}
 		if err == nil {
 			return broker, child.leaderEpoch, nil
 		}
@@ -495,6 +614,13 @@ func (child *partitionConsumer) dispatch() error {
 		return err
 	}
 
+	if child.epochFenced {
+		if err := child.validatePosition(); err != nil {
+			return err
+		}
+		child.epochFenced = false
+	}
+
 	child.leaderEpoch = epoch
 	child.broker = child.consumer.refBrokerConsumer(broker)
 	child.broker.input <- child
@@ -502,6 +628,29 @@ func (child *partitionConsumer) dispatch() error {
 	return nil
 }
 
+// validatePosition checks that the last record consumed is still part of the
+// log of the new leader, as described in KIP-320. If the log was truncated
+// beyond it (e.g. after an unclean leader election) the position is moved back
+// to the end offset of the epoch of that record, so that consumption resumes
+// with the records replacing the truncated ones.
+func (child *partitionConsumer) validatePosition() error {
+	if child.lastFetchedEpoch == invalidLeaderEpoch {
+		return nil
+	}
+
+	endOffset, epoch, err := child.consumer.client.OffsetForLeaderEpoch(child.topic, child.partition, child.lastFetchedEpoch)
+	if err != nil {
+		return err
+	}
+
+	if endOffset >= 0 && endOffset < child.offset {
+		Logger.Printf("consumer/%s/%d detected log truncation at offset %d (epoch %d), resetting position from offset %d\n",
+			child.topic, child.partition, endOffset, epoch, child.offset)
+		child.offset = endOffset
+	}
+	return nil
+}
+
 func (child *partitionConsumer) chooseStartingOffset(offset int64) error {
 	newestOffset, err := child.consumer.client.GetOffset(child.topic, child.partition, OffsetNewest)
 	if err != nil {
@@ -526,6 +675,8 @@ func (child *partitionConsumer) chooseStartingOffset(offset int64) error {
 		return ErrOffsetOutOfRange
 	}
 
+	child.deliveredOffset = child.offset
+
 	return nil
 }
 
@@ -537,6 +688,10 @@ func (child *partitionConsumer) Errors() <-chan *ConsumerError {
 	return child.errors
 }
 
+func (child *partitionConsumer) DecodeErrors() <-chan *ConsumerError {
+	return child.decodeErrors
+}
+
 func (child *partitionConsumer) AsyncClose() {
 	// this triggers whatever broker owns this child to abandon it and close its trigger channel, which causes
 	// the dispatcher to exit its loop, which removes it from the consumer then closes its 'messages' and
@@ -554,6 +709,9 @@ func (child *partitionConsumer) Close() error {
 	for err := range child.errors {
 		consumerErrors = append(consumerErrors, err)
 	}
+	for err := range child.decodeErrors {
+		consumerErrors = append(consumerErrors, err)
+	}
 
 	if len(consumerErrors) > 0 {
 		return consumerErrors
@@ -565,9 +723,24 @@ func (child *partitionConsumer) HighWaterMarkOffset() int64 {
 	return atomic.LoadInt64(&child.highWaterMarkOffset)
 }
 
+func (child *partitionConsumer) Lag() int64 {
+	// messages still buffered in the channel have not been received by the user yet
+	lag := atomic.LoadInt64(&child.highWaterMarkOffset) - atomic.LoadInt64(&child.deliveredOffset) + int64(len(child.messages))
+	if lag < 0 {
+		return 0
+	}
+	return lag
+}
+
+// reachedEnd reports whether a partition consumer created by
+// ConsumePartitionRange has consumed its range once it is at offset.
+func (child *partitionConsumer) reachedEnd(offset int64) bool {
+	return child.endOffset != unboundedOffset && offset >= child.endOffset
+}
+
 func (child *partitionConsumer) responseFeeder() {
 	var msgs []*ConsumerMessage
-	expiryTicker := time.NewTicker(child.conf.Consumer.MaxProcessingTime)
+	expiryTicker := child.conf.getClock().NewTicker(child.conf.Consumer.MaxProcessingTime)
 	firstAttempt := true
 
 feederLoop:
@@ -578,25 +751,44 @@ feederLoop:
 			atomic.StoreInt32(&child.retries, 0)
 		}
 
+		if child.prefetched != nil {
+			child.prefetch(msgs, expiryTicker)
+			continue
+		}
+
 		for i, msg := range msgs {
-			child.interceptors(msg)
+			if !child.prepareMessage(msg) {
+				continue
+			}
+			span := msg.detachSpan()
 		messageSelect:
 			select {
 			case <-child.dying:
+				endConsumerSpan(span, false)
 				child.broker.acks.Done()
 				continue feederLoop
 			case child.messages <- msg:
+				endConsumerSpan(span, true)
+				atomic.StoreInt64(&child.deliveredOffset, msg.Offset+1)
 				firstAttempt = true
-			case <-expiryTicker.C:
+			case <-expiryTicker.C():
 				if !firstAttempt {
 					child.responseResult = errTimedOut
 					child.broker.acks.Done()
+					// msg was not sent, so it keeps its span when prepared again
+					msg.span = span
 				remainingLoop:
 					for _, msg = range msgs[i:] {
-						child.interceptors(msg)
+						if !child.prepareMessage(msg) {
+							continue
+						}
+						span := msg.detachSpan()
 						select {
 						case child.messages <- msg:
+							endConsumerSpan(span, true)
+							atomic.StoreInt64(&child.deliveredOffset, msg.Offset+1)
 						case <-child.dying:
+							endConsumerSpan(span, false)
 							break remainingLoop
 						}
 					}
@@ -611,12 +803,97 @@ feederLoop:
 			}
 		}
 
+		// all messages of the response were returned, account for any skipped
+		// offsets such as control records or aborted transactions
+		if child.responseResult == nil {
+			atomic.StoreInt64(&child.deliveredOffset, child.offset)
+			if child.reachedEnd(child.offset) {
+				child.AsyncClose()
+			}
+		}
+
 		child.broker.acks.Done()
 	}
 
 	expiryTicker.Stop()
+	if child.prefetched != nil {
+		// the prefetchDeliverer closes the channels once it has drained the queue
+		close(child.prefetched)
+		return
+	}
+	close(child.messages)
+	close(child.errors)
+	close(child.decodeErrors)
+}
+
+// prefetch queues the messages parsed from a response for the prefetchDeliverer and
+// acknowledges the response straight away, so that the broker consumer can issue the
+// next fetch while the user is still processing. If the queue stays full for longer
+// than MaxProcessingTime the subscription is abandoned, just like when writing to the
+// Messages channel takes too long.
+func (child *partitionConsumer) prefetch(msgs []*ConsumerMessage, expiryTicker clockTicker) {
+	batch := &prefetchedMessages{messages: msgs, offset: child.offset}
+	firstAttempt := true
+
+	for {
+		select {
+		case <-child.dying:
+			child.broker.acks.Done()
+			return
+		case child.prefetched <- batch:
+			child.broker.acks.Done()
+			return
+		case <-expiryTicker.C():
+			if firstAttempt {
+				firstAttempt = false
+				continue
+			}
+			child.responseResult = errTimedOut
+			child.broker.acks.Done()
+			select {
+			case child.prefetched <- batch:
+			case <-child.dying:
+				return
+			}
+			child.broker.input <- child
+			return
+		}
+	}
+}
+
+// prefetchDeliverer hands the prefetched messages over to the user in order.
+func (child *partitionConsumer) prefetchDeliverer() {
+	for batch := range child.prefetched {
+		delivered := true
+	batchLoop:
+		for _, msg := range batch.messages {
+			if !child.prepareMessage(msg) {
+				continue
+			}
+			span := msg.detachSpan()
+			select {
+			case child.messages <- msg:
+				endConsumerSpan(span, true)
+				atomic.StoreInt64(&child.deliveredOffset, msg.Offset+1)
+			case <-child.dying:
+				endConsumerSpan(span, false)
+				delivered = false
+				break batchLoop
+			}
+		}
+
+		// account for any skipped offsets such as control records or aborted transactions
+		if delivered {
+			atomic.StoreInt64(&child.deliveredOffset, batch.offset)
+			if child.reachedEnd(batch.offset) {
+				child.AsyncClose()
+			}
+		}
+	}
+
 	close(child.messages)
 	close(child.errors)
+	close(child.decodeErrors)
 }
 
 func (child *partitionConsumer) parseMessages(msgSet *MessageSet) ([]*ConsumerMessage, error) {
@@ -625,24 +902,28 @@ func (child *partitionConsumer) parseMessages(msgSet *MessageSet) ([]*ConsumerMe
 		for _, msg := range msgBlock.Messages() {
 			offset := msg.Offset
 			timestamp := msg.Msg.Timestamp
+			timestampType := TimestampTypeNone
 			if msg.Msg.Version >= 1 {
 				baseOffset := msgBlock.Offset - msgBlock.Messages()[len(msgBlock.Messages())-1].Offset
 				offset += baseOffset
+				timestampType = TimestampTypeCreateTime
 				if msg.Msg.LogAppendTime {
 					timestamp = msgBlock.Msg.Timestamp
+					timestampType = TimestampTypeLogAppendTime
 				}
 			}
 			if offset < child.offset {
 				continue
 			}
 			messages = append(messages, &ConsumerMessage{
-				Topic:          child.topic,
+				Topic:          child.logicalTopic,
 				Partition:      child.partition,
 				Key:            msg.Msg.Key,
 				Value:          msg.Msg.Value,
 				Offset:         offset,
 				Timestamp:      timestamp,
 				BlockTimestamp: msgBlock.Msg.Timestamp,
+				TimestampType:  timestampType,
 			})
 			child.offset = offset + 1
 		}
@@ -662,19 +943,23 @@ func (child *partitionConsumer) parseRecords(batch *RecordBatch) ([]*ConsumerMes
 			continue
 		}
 		timestamp := batch.FirstTimestamp.Add(rec.TimestampDelta)
+		timestampType := TimestampTypeCreateTime
 		if batch.LogAppendTime {
 			timestamp = batch.MaxTimestamp
+			timestampType = TimestampTypeLogAppendTime
 		}
 		messages = append(messages, &ConsumerMessage{
-			Topic:     child.topic,
-			Partition: child.partition,
-			Key:       rec.Key,
-			Value:     rec.Value,
-			Offset:    offset,
-			Timestamp: timestamp,
-			Headers:   rec.Headers,
+			Topic:         child.logicalTopic,
+			Partition:     child.partition,
+			Key:           rec.Key,
+			Value:         rec.Value,
+			Offset:        offset,
+			Timestamp:     timestamp,
+			TimestampType: timestampType,
+			Headers:       rec.Headers,
 		})
 		child.offset = offset + 1
+		child.lastFetchedEpoch = batch.PartitionLeaderEpoch
 	}
 	if len(messages) == 0 {
 		child.offset++
@@ -682,6 +967,19 @@ func (child *partitionConsumer) parseRecords(batch *RecordBatch) ([]*ConsumerMes
 	return messages, nil
 }
 
+// growFetchSize doubles the fetch size, without exceeding max if set.
+func growFetchSize(size, max int32) int32 {
+	size *= 2
+	// check int32 overflow
+	if size < 0 {
+		size = math.MaxInt32
+	}
+	if max > 0 && size > max {
+		size = max
+	}
+	return size
+}
+
 func (child *partitionConsumer) parseResponse(response *FetchResponse) ([]*ConsumerMessage, error) {
 	var consumerBatchSizeMetric metrics.Histogram
 	if child.consumer != nil && child.consumer.metricRegistry != nil {
@@ -705,6 +1003,11 @@ func (child *partitionConsumer) parseResponse(response *FetchResponse) ([]*Consu
 		return nil, block.Err
 	}
 
+	if len(block.corruptBatches) > 0 {
+		// only once the batches around them are parsed
+		defer child.skipCorruptBatches(block)
+	}
+
 	nRecs, err := block.numRecords()
 	if err != nil {
 		return nil, err
@@ -723,22 +1026,28 @@ func (child *partitionConsumer) parseResponse(response *FetchResponse) ([]*Consu
 		if err != nil {
 			return nil, err
 		}
+		requestedSize := child.requestedSize
+		if requestedSize == 0 {
+			requestedSize = child.fetchSize
+		}
+		// With Consumer.Fetch.ResponseMax the request may have asked for less than the
+		// fetch size, in which case brokers return either a partial trailing message or,
+		// from v3 on, no records at all although more are available: ask for the full
+		// fetch size next time.
+		child.starving = requestedSize < child.fetchSize &&
+			(partialTrailingMessage || block.HighWaterMarkOffset > child.offset)
 		// We got no messages. If we got a trailing one then we need to ask for more data.
 		// Otherwise we just poll again and wait for one to be produced...
+		if child.starving {
+			return nil, nil
+		}
 		if partialTrailingMessage {
-			if child.conf.Consumer.Fetch.Max > 0 && child.fetchSize == child.conf.Consumer.Fetch.Max {
+			if child.conf.Consumer.Fetch.Max > 0 && requestedSize >= child.conf.Consumer.Fetch.Max {
 				// we can't ask for more data, we've hit the configured limit
 				child.sendError(ErrMessageTooLarge)
 				child.offset++ // skip this one so we can keep processing future messages
 			} else {
-				child.fetchSize *= 2
-				// check int32 overflow
-				if child.fetchSize < 0 {
-					child.fetchSize = math.MaxInt32
-				}
-				if child.conf.Consumer.Fetch.Max > 0 && child.fetchSize > child.conf.Consumer.Fetch.Max {
-					child.fetchSize = child.conf.Consumer.Fetch.Max
-				}
+				child.fetchSize = growFetchSize(child.fetchSize, child.conf.Consumer.Fetch.Max)
 			}
 		} else if block.LastRecordsBatchOffset != nil && *block.LastRecordsBatchOffset < block.HighWaterMarkOffset {
 			// check last record offset to avoid stuck if high watermark was not reached
@@ -751,6 +1060,11 @@ func (child *partitionConsumer) parseResponse(response *FetchResponse) ([]*Consu
 
 	// we got messages, reset our fetch size in case it was increased for a previous request
 	child.fetchSize = child.conf.Consumer.Fetch.Default
+	child.starving = false
+	if child.conf.Consumer.Fetch.ResponseMax > 0 && child.requestedSize > 0 && block.recordsSize >= child.requestedSize {
+		// the partition filled its share of the response, ask for more next time
+		child.fetchSize = growFetchSize(child.requestedSize, child.conf.Consumer.Fetch.Max)
+	}
 	atomic.StoreInt64(&child.highWaterMarkOffset, block.HighWaterMarkOffset)
 
 	// abortedProducerIDs contains producerID which message should be ignored as uncommitted
@@ -809,6 +1123,13 @@ func (child *partitionConsumer) parseResponse(response *FetchResponse) ([]*Consu
 				if controlRecord.Type == ControlRecordAbort {
 					delete(abortedProducerIDs, records.RecordBatch.ProducerID)
 				}
+				if child.conf.Consumer.IncludeControlRecords {
+					for _, msg := range recordBatchMessages {
+						msg.Control = &controlRecord
+						msg.ProducerID = records.RecordBatch.ProducerID
+					}
+					messages = append(messages, recordBatchMessages...)
+				}
 				continue
 			}
 
@@ -826,9 +1147,95 @@ func (child *partitionConsumer) parseResponse(response *FetchResponse) ([]*Consu
 		}
 	}
 
+	if child.endOffset != unboundedOffset {
+		// drop the messages beyond the range of ConsumePartitionRange
+		for i, msg := range messages {
+			if msg.Offset >= child.endOffset {
+				messages = messages[:i]
+				break
+			}
+		}
+	}
+
 	return messages, nil
 }
 
+// skipCorruptBatches advances the offset past the corrupt record batches of
+// block, see Consumer.SkipCorruptBatches.
+func (child *partitionConsumer) skipCorruptBatches(block *FetchResponseBlock) {
+	for _, corrupt := range block.corruptBatches {
+		// the offsets of the batch may be corrupted too, don't skip beyond
+		// the high water mark
+		first, last := corrupt.batch.FirstOffset, corrupt.batch.LastOffset()
+		if last < first {
+			last = first
+		}
+		if last >= block.HighWaterMarkOffset && block.HighWaterMarkOffset > first {
+			last = block.HighWaterMarkOffset - 1
+		}
+
+		Logger.Printf("consumer/%s/%d skipped the corrupt record batch of offsets %d to %d: %v\n",
+			child.topic, child.partition, first, last, corrupt.err)
+		if child.consumer != nil && child.consumer.metricRegistry != nil {
+			metrics.GetOrRegisterCounter("consumer-skipped-corrupt-batches", child.consumer.metricRegistry).Inc(1)
+		}
+		if last >= child.offset {
+			child.offset = last + 1
+		}
+	}
+}
+
+// prepareMessage deserializes msg and applies the interceptors before it is
+// delivered, returning false if msg is to be skipped. A message that fails to
+// deserialize is skipped and reported on the DecodeErrors channel with
+// Consumer.Return.DecodeErrors, otherwise it is still delivered with its raw
+// Key and Value, the failure being reported on the Errors channel. Control
+// records are neither deserialized nor traced.
+func (child *partitionConsumer) prepareMessage(msg *ConsumerMessage) bool {
+	if msg.Control != nil {
+		child.interceptors(msg)
+		return true
+	}
+	if err := msg.deserialize(child.conf); err != nil {
+		if child.conf.Consumer.Return.DecodeErrors {
+			child.sendDecodeError(msg, err)
+			return false
+		}
+		child.sendError(err)
+	}
+	child.interceptors(msg)
+	msg.startSpan(child.conf.Tracer)
+	return true
+}
+
+// sendDecodeError reports msg on the DecodeErrors channel, unless the
+// partition consumer is closing. If nobody reads it within
+// Consumer.MaxProcessingTime the error, raw record included, is handed to
+// the Errors channel instead, or logged, so that an unread DecodeErrors
+// channel cannot stall the partition.
+func (child *partitionConsumer) sendDecodeError(msg *ConsumerMessage, err error) {
+	cErr := &ConsumerError{
+		Topic:     child.logicalTopic,
+		Partition: child.partition,
+		Err:       err,
+		Message:   msg,
+	}
+
+	timer := child.conf.getClock().NewTimer(child.conf.Consumer.MaxProcessingTime)
+	defer timer.Stop()
+
+	select {
+	case child.decodeErrors <- cErr:
+	case <-child.dying:
+	case <-timer.C():
+		if child.conf.Consumer.Return.Errors {
+			child.errors <- cErr
+		} else {
+			Logger.Println(cErr)
+		}
+	}
+}
+
 func (child *partitionConsumer) interceptors(msg *ConsumerMessage) {
 	for _, interceptor := range child.conf.Consumer.Interceptors {
 		msg.safelyApplyInterceptor(interceptor)
@@ -870,8 +1277,8 @@ func (c *consumer) newBrokerConsumer(broker *Broker) *brokerConsumer {
 		refs:             0,
 	}
 
-	go withRecover(bc.subscriptionManager)
-	go withRecover(bc.subscriptionConsumer)
+	goWithRecover(c.conf.MetricRegistry, bc.subscriptionManager)
+	goWithRecover(c.conf.MetricRegistry, bc.subscriptionConsumer)
 
 	return bc
 }
@@ -900,12 +1307,12 @@ func (bc *brokerConsumer) subscriptionManager() {
 		}
 
 		// drain input of any further incoming subscriptions
-		timer := time.NewTimer(partitionConsumersBatchTimeout)
+		timer := bc.consumer.conf.getClock().NewTimer(partitionConsumersBatchTimeout)
 		for batchComplete := false; !batchComplete; {
 			select {
 			case pc := <-bc.input:
 				partitionConsumers = append(partitionConsumers, pc)
-			case <-timer.C:
+			case <-timer.C():
 				batchComplete = true
 			}
 		}
@@ -928,7 +1335,7 @@ func (bc *brokerConsumer) subscriptionConsumer() {
 		if len(bc.subscriptions) == 0 {
 			// We're about to be shut down or we're about to receive more subscriptions.
 			// Take a small nap to avoid burning the CPU.
-			time.Sleep(partitionConsumersBatchTimeout)
+			bc.consumer.conf.getClock().Sleep(partitionConsumersBatchTimeout)
 			continue
 		}
 
@@ -942,7 +1349,7 @@ func (bc *brokerConsumer) subscriptionConsumer() {
 		// if there isn't response, it means that not fetch was made
 		// so we don't need to handle any response
 		if response == nil {
-			time.Sleep(partitionConsumersBatchTimeout)
+			bc.consumer.conf.getClock().Sleep(partitionConsumersBatchTimeout)
 			continue
 		}
 
@@ -1024,6 +1431,10 @@ func (bc *brokerConsumer) handleResponses() {
 			errors.Is(result, ErrFencedLeaderEpoch) ||
 			errors.Is(result, ErrUnknownLeaderEpoch) {
 			// not an error, but does need redispatching
+			if errors.Is(result, ErrFencedLeaderEpoch) {
+				// the leader changed, so its log may have been truncated
+				child.epochFenced = true
+			}
 			Logger.Printf("consumer/broker/%d abandoned subscription to %s/%d because %s\n",
 				bc.broker.ID(), child.topic, child.partition, result)
 			child.trigger <- none{}
@@ -1051,7 +1462,7 @@ func (bc *brokerConsumer) abort(err error) {
 	for newSubscriptions := range bc.newSubscriptions {
 		if len(newSubscriptions) == 0 {
 			// Take a small nap to avoid burning the CPU.
-			time.Sleep(partitionConsumersBatchTimeout)
+			bc.consumer.conf.getClock().Sleep(partitionConsumersBatchTimeout)
 			continue
 		}
 		for _, child := range newSubscriptions {
@@ -1061,12 +1472,41 @@ func (bc *brokerConsumer) abort(err error) {
 	}
 }
 
+// fairFetchSizes caps the fetch sizes so that they add up to at most budget,
+// granting the smallest ones in full and splitting what is left equally among
+// the others (max-min fairness).
+func fairFetchSizes(sizes []int32, budget int32) []int32 {
+	order := make([]int, len(sizes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return sizes[order[i]] < sizes[order[j]] })
+
+	capped := make([]int32, len(sizes))
+	remaining := int64(budget)
+	for k, i := range order {
+		share := remaining / int64(len(order)-k)
+		if share < 1 {
+			share = 1
+		}
+		size := int64(sizes[i])
+		if size > share {
+			size = share
+		}
+		capped[i] = int32(size)
+		remaining -= size
+	}
+	return capped
+}
+
 // fetchResponse can be nil if no fetch is made, it can occur when
 // all partitions are paused
 func (bc *brokerConsumer) fetchNewMessages() (*FetchResponse, error) {
 	request := &FetchRequest{
-		MinBytes:    bc.consumer.conf.Consumer.Fetch.Min,
-		MaxWaitTime: int32(bc.consumer.conf.Consumer.MaxWaitTime / time.Millisecond),
+		MinBytes:           bc.consumer.conf.Consumer.Fetch.Min,
+		MaxWaitTime:        int32(bc.consumer.conf.Consumer.MaxWaitTime / time.Millisecond),
+		skipCorruptBatches: bc.consumer.conf.Consumer.SkipCorruptBatches,
+		skipCRCValidation:  bc.consumer.conf.Consumer.SkipCRCValidation,
 	}
 	// Version 1 is the same as version 0.
 	if bc.consumer.conf.Version.IsAtLeast(V0_9_0_0) {
@@ -1121,12 +1561,61 @@ func (bc *brokerConsumer) fetchNewMessages() (*FetchResponse, error) {
 		request.RackID = bc.consumer.conf.RackID
 	}
 
+	var children []*partitionConsumer
 	for child := range bc.subscriptions {
 		if !child.IsPaused() {
-			request.AddBlock(child.topic, child.partition, child.offset, child.fetchSize, child.leaderEpoch)
+			children = append(children, child)
 		}
 	}
 
+	sizes := make([]int32, len(children))
+	for i, child := range children {
+		sizes[i] = child.fetchSize
+	}
+	if responseMax := bc.consumer.conf.Consumer.Fetch.ResponseMax; responseMax > 0 {
+		// partitions whose share was too small for their next batch get their
+		// full fetch size, the others share what is left
+		budget := int64(responseMax)
+		var sharing []int
+		for i, child := range children {
+			if child.starving {
+				budget -= int64(sizes[i])
+			} else {
+				sharing = append(sharing, i)
+			}
+		}
+		if budget < 0 {
+			budget = 0
+		}
+		shared := make([]int32, len(sharing))
+		for k, i := range sharing {
+			shared[k] = sizes[i]
+		}
+		shared = fairFetchSizes(shared, int32(budget))
+		for k, i := range sharing {
+			sizes[i] = shared[k]
+		}
+		if request.Version >= 3 {
+			// the starving partitions must not be left out of the response
+			total := int64(0)
+			for _, size := range sizes {
+				total += int64(size)
+			}
+			switch {
+			case total > math.MaxInt32:
+				request.MaxBytes = math.MaxInt32
+			case total > int64(responseMax):
+				request.MaxBytes = int32(total)
+			default:
+				request.MaxBytes = responseMax
+			}
+		}
+	}
+	for i, child := range children {
+		child.requestedSize = sizes[i]
+		request.AddBlock(child.topic, child.partition, child.offset, sizes[i], child.leaderEpoch)
+	}
+
 	// avoid to fetch when there is no block
 	if len(request.blocks) == 0 {
 		return nil, nil
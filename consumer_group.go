@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -14,6 +15,10 @@ import (
 // ErrClosedConsumerGroup is the error returned when a method is called on a consumer group that has been closed.
 var ErrClosedConsumerGroup = errors.New("kafka: tried to use a consumer group that was closed")
 
+// ErrLeaveGroupTimeout is returned by ConsumerGroup.Close when the member could
+// not leave the group within Consumer.Group.Leave.Timeout.
+var ErrLeaveGroupTimeout = errors.New("kafka: timed out leaving the consumer group")
+
 // ConsumerGroup is responsible for dividing up processing of topics and partitions
 // over a collection of processes (the members of the consumer group).
 type ConsumerGroup interface {
@@ -28,7 +33,8 @@ type ConsumerGroup interface {
 	//    of the claims and allow any necessary preparation or alteration of state.
 	// 3. For each of the assigned claims the handler's ConsumeClaim() function is then called
 	//    in a separate goroutine which requires it to be thread-safe. Any state must be carefully protected
-	//    from concurrent reads/writes.
+	//    from concurrent reads/writes. If the handler implements ConsumerGroupPartitionAssignedHandler,
+	//    its OnPartitionAssigned() hook is called in that goroutine first, once the starting offset is known.
 	// 4. The session will persist until one of the ConsumeClaim() functions exits. This can be either when the
 	//    parent context is canceled or when a server-side rebalance cycle is initiated.
 	// 5. Once all the ConsumeClaim() loops have exited, the handler's Cleanup() hook is called
@@ -93,6 +99,10 @@ type consumerGroup struct {
 
 	userData []byte
 
+	// coordinatorLoadDeadline bounds the retries of a join while the
+	// coordinator is loading or unavailable, it is reset by every Consume.
+	coordinatorLoadDeadline time.Time
+
 	metricRegistry metrics.Registry
 }
 
@@ -160,14 +170,15 @@ func (c *consumerGroup) Close() (err error) {
 
 		// leave group
 		if e := c.leave(); e != nil {
+			Logger.Printf("consumergroup/%s failed to leave the group, its partitions are reassigned once its session times out: %v\n", c.groupID, e)
 			err = e
 		}
 
-		go func() {
+		goWithRecover(c.config.MetricRegistry, func() {
 			c.errorsLock.Lock()
 			defer c.errorsLock.Unlock()
 			close(c.errors)
-		}()
+		})
 
 		// drain errors
 		for e := range c.errors {
@@ -199,6 +210,7 @@ func (c *consumerGroup) Consume(ctx context.Context, topics []string, handler Co
 	if len(topics) == 0 {
 		return fmt.Errorf("no topics provided")
 	}
+	topics = c.config.physicalTopics(topics)
 
 	// Refresh metadata for requested topics
 	if err := c.client.RefreshMetadata(topics...); err != nil {
@@ -206,6 +218,7 @@ func (c *consumerGroup) Consume(ctx context.Context, topics []string, handler Co
 	}
 
 	// Init session
+	c.coordinatorLoadDeadline = time.Time{}
 	sess, err := c.newSession(ctx, topics, handler, c.config.Consumer.Group.Rebalance.Retry.Max)
 	if errors.Is(err, ErrClosedClient) {
 		return ErrClosedConsumerGroup
@@ -249,7 +262,7 @@ func (c *consumerGroup) retryNewSession(ctx context.Context, topics []string, ha
 		return nil, ctx.Err()
 	case <-c.closed:
 		return nil, ErrClosedConsumerGroup
-	case <-time.After(c.config.Consumer.Group.Rebalance.Retry.Backoff):
+	case <-c.config.getClock().After(c.config.Consumer.Group.Rebalance.Retry.Backoff):
 	}
 
 	if refreshCoordinator {
@@ -265,6 +278,38 @@ func (c *consumerGroup) retryNewSession(ctx context.Context, topics []string, ha
 	return c.newSession(ctx, topics, handler, retries-1)
 }
 
+// retryCoordinatorLoad retries a join that failed because the coordinator is
+// loading or not available. It backs off for Coordinator.Retry.Backoff without
+// using up any of the rebalance retries until Coordinator.Retry.Timeout has
+// elapsed since the first such failure.
+func (c *consumerGroup) retryCoordinatorLoad(ctx context.Context, topics []string, handler ConsumerGroupHandler, retries int, kerr KError) (*consumerGroupSession, error) {
+	conf := c.config.Consumer.Group.Coordinator.Retry
+	if c.coordinatorLoadDeadline.IsZero() {
+		c.coordinatorLoadDeadline = c.config.getClock().Now().Add(conf.Timeout)
+	}
+	if !c.config.getClock().Now().Before(c.coordinatorLoadDeadline) {
+		if retries <= 0 {
+			return nil, kerr
+		}
+		return c.retryNewSession(ctx, topics, handler, retries, true)
+	}
+
+	Logger.Printf("consumergroup/%s coordinator not ready (%s), retrying in %s\n", c.groupID, kerr, conf.Backoff)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.closed:
+		return nil, ErrClosedConsumerGroup
+	case <-c.config.getClock().After(conf.Backoff):
+	}
+
+	if errors.Is(kerr, ErrConsumerCoordinatorNotAvailable) {
+		// the coordinator may have moved, a failed refresh is retried on the next round
+		_ = c.client.RefreshCoordinator(c.groupID)
+	}
+	return c.newSession(ctx, topics, handler, retries)
+}
+
 func (c *consumerGroup) newSession(ctx context.Context, topics []string, handler ConsumerGroupHandler, retries int) (*consumerGroupSession, error) {
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
@@ -317,7 +362,9 @@ func (c *consumerGroup) newSession(ctx context.Context, topics []string, handler
 		// reset member ID and retry immediately
 		c.memberID = ""
 		return c.newSession(ctx, topics, handler, retries)
-	case ErrNotCoordinatorForConsumer, ErrRebalanceInProgress, ErrOffsetsLoadInProgress:
+	case ErrOffsetsLoadInProgress, ErrConsumerCoordinatorNotAvailable:
+		return c.retryCoordinatorLoad(ctx, topics, handler, retries, join.Err)
+	case ErrNotCoordinatorForConsumer, ErrRebalanceInProgress:
 		// retry after backoff
 		if retries <= 0 {
 			return nil, join.Err
@@ -335,6 +382,8 @@ func (c *consumerGroup) newSession(ctx context.Context, topics []string, handler
 			Logger.Printf("JoinGroup failed: group instance id %s has been fenced\n", *c.groupInstanceId)
 		}
 		return nil, join.Err
+	case ErrInvalidSessionTimeout:
+		return nil, c.invalidSessionTimeoutError(coordinator)
 	default:
 		return nil, join.Err
 	}
@@ -391,7 +440,9 @@ func (c *consumerGroup) newSession(ctx context.Context, topics []string, handler
 		// reset member ID and retry immediately
 		c.memberID = ""
 		return c.newSession(ctx, topics, handler, retries)
-	case ErrNotCoordinatorForConsumer, ErrRebalanceInProgress, ErrOffsetsLoadInProgress:
+	case ErrOffsetsLoadInProgress, ErrConsumerCoordinatorNotAvailable:
+		return c.retryCoordinatorLoad(ctx, topics, handler, retries, syncGroupResponse.Err)
+	case ErrNotCoordinatorForConsumer, ErrRebalanceInProgress:
 		// retry after backoff
 		if retries <= 0 {
 			return nil, syncGroupResponse.Err
@@ -494,6 +545,66 @@ func (c *consumerGroup) joinGroupRequest(coordinator *Broker, topics []string) (
 	return coordinator.JoinGroup(req)
 }
 
+// invalidSessionTimeoutError explains a JoinGroup rejected with
+// ErrInvalidSessionTimeout, naming the bounds enforced by the coordinator when
+// they can be retrieved from its configuration.
+func (c *consumerGroup) invalidSessionTimeoutError(coordinator *Broker) error {
+	timeout := c.config.Consumer.Group.Session.Timeout
+	lower, upper, err := c.sessionTimeoutBounds(coordinator)
+	if err != nil {
+		Logger.Printf("consumer/group/%s failed to describe the session timeout bounds of broker %d: %v\n", c.groupID, coordinator.ID(), err)
+		return fmt.Errorf("%w: Consumer.Group.Session.Timeout %s is outside the bounds set by the broker's group.min.session.timeout.ms and group.max.session.timeout.ms",
+			ErrInvalidSessionTimeout, timeout)
+	}
+	return fmt.Errorf("%w: Consumer.Group.Session.Timeout %s must be between %s (group.min.session.timeout.ms) and %s (group.max.session.timeout.ms) of broker %d",
+		ErrInvalidSessionTimeout, timeout, lower, upper, coordinator.ID())
+}
+
+// sessionTimeoutBounds describes the group.min.session.timeout.ms and
+// group.max.session.timeout.ms configuration of the coordinator.
+func (c *consumerGroup) sessionTimeoutBounds(coordinator *Broker) (lower, upper time.Duration, err error) {
+	if !c.config.Version.IsAtLeast(V0_11_0_0) {
+		return 0, 0, ErrUnsupportedVersion
+	}
+
+	request := &DescribeConfigsRequest{
+		Resources: []*ConfigResource{{
+			Type:        BrokerResource,
+			Name:        strconv.Itoa(int(coordinator.ID())),
+			ConfigNames: []string{"group.min.session.timeout.ms", "group.max.session.timeout.ms"},
+		}},
+	}
+	response, err := coordinator.DescribeConfigs(request)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var found int
+	for _, resource := range response.Resources {
+		if resource.ErrorCode != 0 {
+			return 0, 0, KError(resource.ErrorCode)
+		}
+		for _, entry := range resource.Configs {
+			ms, err := strconv.ParseInt(entry.Value, 10, 64)
+			if err != nil {
+				return 0, 0, err
+			}
+			switch entry.Name {
+			case "group.min.session.timeout.ms":
+				lower = time.Duration(ms) * time.Millisecond
+				found++
+			case "group.max.session.timeout.ms":
+				upper = time.Duration(ms) * time.Millisecond
+				found++
+			}
+		}
+	}
+	if found != 2 {
+		return 0, 0, ErrIncompleteResponse
+	}
+	return lower, upper, nil
+}
+
 // findStrategy returns the BalanceStrategy with the specified protocolName
 // from the slice provided.
 func (c *consumerGroup) findStrategy(name string, groupStrategies []BalanceStrategy) (BalanceStrategy, bool) {
@@ -608,7 +719,8 @@ func (c *consumerGroup) balance(strategy BalanceStrategy, members map[string]Con
 	return topicPartitions, allSubscribedTopics, plan, err
 }
 
-// Leaves the cluster, called by Close.
+// Leaves the cluster, called by Close. The coordinator lookup and the
+// LeaveGroup request are bounded by Consumer.Group.Leave.Timeout.
 func (c *consumerGroup) leave() error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -616,19 +728,54 @@ func (c *consumerGroup) leave() error {
 		return nil
 	}
 
-	coordinator, err := c.client.Coordinator(c.groupID)
-	if err != nil {
-		return err
-	}
-
 	// as per KIP-345 if groupInstanceId is set, i.e. static membership is in action, then do not leave group when consumer closed, just clear memberID
 	if c.groupInstanceId != nil {
 		c.memberID = ""
 		return nil
 	}
+
+	memberID := c.memberID
+	// clear the memberID
+	c.memberID = ""
+
+	type result struct {
+		resp *LeaveGroupResponse
+		err  error
+	}
+	done := make(chan result, 1)
+	goWithRecover(c.config.MetricRegistry, func() {
+		coordinator, err := c.client.Coordinator(c.groupID)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		resp, err := c.leaveGroupRequest(coordinator, memberID)
+		done <- result{resp: resp, err: err}
+	})
+
+	var res result
+	select {
+	case res = <-done:
+	case <-c.config.getClock().After(c.config.Consumer.Group.Leave.Timeout):
+		return fmt.Errorf("timed out after %s: %w", c.config.Consumer.Group.Leave.Timeout, ErrLeaveGroupTimeout)
+	}
+	if res.err != nil {
+		return res.err
+	}
+
+	switch res.resp.Err {
+	case ErrRebalanceInProgress, ErrUnknownMemberId, ErrNoError:
+		return nil
+	default:
+		return res.resp.Err
+	}
+}
+
+// leaveGroupRequest asks the coordinator to remove the member from the group.
+func (c *consumerGroup) leaveGroupRequest(coordinator *Broker, memberID string) (*LeaveGroupResponse, error) {
 	req := &LeaveGroupRequest{
 		GroupId:  c.groupID,
-		MemberId: c.memberID,
+		MemberId: memberID,
 	}
 	if c.config.Version.IsAtLeast(V0_11_0_0) {
 		req.Version = 1
@@ -639,25 +786,16 @@ func (c *consumerGroup) leave() error {
 	if c.config.Version.IsAtLeast(V2_4_0_0) {
 		req.Version = 3
 		req.Members = append(req.Members, MemberIdentity{
-			MemberId: c.memberID,
+			MemberId: memberID,
 		})
 	}
 
 	resp, err := coordinator.LeaveGroup(req)
 	if err != nil {
 		_ = coordinator.Close()
-		return err
-	}
-
-	// clear the memberID
-	c.memberID = ""
-
-	switch resp.Err {
-	case ErrRebalanceInProgress, ErrUnknownMemberId, ErrNoError:
-		return nil
-	default:
-		return resp.Err
+		return nil, err
 	}
+	return resp, nil
 }
 
 func (c *consumerGroup) handleError(err error, topic string, partition int32) {
@@ -703,7 +841,7 @@ func (c *consumerGroup) loopCheckPartitionNumbers(allSubscribedTopicPartitions m
 		oldTopicToPartitionNum[topic] = len(partitions)
 	}
 
-	pause := time.NewTicker(c.config.Metadata.RefreshFrequency)
+	pause := c.config.getClock().NewTicker(c.config.Metadata.RefreshFrequency)
 	defer pause.Stop()
 	for {
 		if newTopicToPartitionNum, err := c.topicToPartitionNumbers(topics); err != nil {
@@ -719,7 +857,7 @@ func (c *consumerGroup) loopCheckPartitionNumbers(allSubscribedTopicPartitions m
 			}
 		}
 		select {
-		case <-pause.C:
+		case <-pause.C():
 		case <-session.ctx.Done():
 			Logger.Printf(
 				"consumergroup/%s loop check partition number goroutine will exit, topics %s\n",
@@ -754,10 +892,18 @@ type ConsumerGroupSession interface {
 	// Claims returns information about the claimed partitions by topic.
 	Claims() map[string][]int32
 
-	// MemberID returns the cluster member ID.
+	// MemberID returns the cluster member ID, as assigned by the coordinator
+	// when the member joined the group for this session. It does not change
+	// during the session, but a new session, after a rebalance, may be
+	// given a new one.
 	MemberID() string
 
-	// GenerationID returns the current generation ID.
+	// GenerationID returns the generation of the group this session belongs
+	// to. It does not change during the session: every rebalance starts a
+	// new session with a new, greater, generation, so writes tagged with it
+	// let downstream systems fence out members of older generations. Offset
+	// commits from a session whose generation is outdated are rejected by the
+	// coordinator.
 	GenerationID() int32
 
 	// MarkOffset marks the provided offset, alongside a metadata string
@@ -792,6 +938,10 @@ type ConsumerGroupSession interface {
 
 	// Context returns the session context.
 	Context() context.Context
+
+	// Lag returns the lag of each claimed partition that is currently being
+	// consumed by topic and partition, as reported by PartitionConsumer.Lag.
+	Lag() map[string]map[int32]int64
 }
 
 type consumerGroupSession struct {
@@ -805,8 +955,12 @@ type consumerGroupSession struct {
 	ctx     context.Context
 	cancel  func()
 
+	consumers     map[string]map[int32]PartitionConsumer
+	consumersLock sync.RWMutex
+
 	waitGroup       sync.WaitGroup
 	releaseOnce     sync.Once
+	leaveOnce       sync.Once
 	hbDying, hbDead chan none
 }
 
@@ -820,6 +974,9 @@ func newConsumerGroupSession(ctx context.Context, parent *consumerGroup, claims
 		return nil, err
 	}
 
+	// the session works on logical topics, the offset manager on physical ones
+	claims = parent.config.logicalTopicPartitions(claims)
+
 	// init session
 	sess := &consumerGroupSession{
 		parent:       parent,
@@ -830,6 +987,7 @@ func newConsumerGroupSession(ctx context.Context, parent *consumerGroup, claims
 		claims:       claims,
 		ctx:          ctx,
 		cancel:       cancel,
+		consumers:    make(map[string]map[int32]PartitionConsumer),
 		hbDying:      make(chan none),
 		hbDead:       make(chan none),
 	}
@@ -840,18 +998,19 @@ func newConsumerGroupSession(ctx context.Context, parent *consumerGroup, claims
 	// create a POM for each claim
 	for topic, partitions := range claims {
 		for _, partition := range partitions {
-			pom, err := offsets.ManagePartition(topic, partition)
+			pom, err := offsets.ManagePartition(parent.config.physicalTopic(topic), partition)
 			if err != nil {
 				_ = sess.release(false)
 				return nil, err
 			}
 
 			// handle POM errors
-			go func(topic string, partition int32) {
+			topic, partition, pom := topic, partition, pom
+			goWithRecover(parent.config.MetricRegistry, func() {
 				for err := range pom.Errors() {
 					sess.parent.handleError(err, topic, partition)
 				}
-			}(topic, partition)
+			})
 		}
 	}
 
@@ -866,7 +1025,8 @@ func newConsumerGroupSession(ctx context.Context, parent *consumerGroup, claims
 		for _, partition := range partitions {
 			sess.waitGroup.Add(1)
 
-			go func(topic string, partition int32) {
+			topic, partition := topic, partition
+			goWithRecover(parent.config.MetricRegistry, func() {
 				defer sess.waitGroup.Done()
 
 				// cancel the as session as soon as the first
@@ -875,7 +1035,7 @@ func newConsumerGroupSession(ctx context.Context, parent *consumerGroup, claims
 
 				// consume a single topic/partition, blocking
 				sess.consume(topic, partition)
-			}(topic, partition)
+			})
 		}
 	}
 	return sess, nil
@@ -885,8 +1045,18 @@ func (s *consumerGroupSession) Claims() map[string][]int32 { return s.claims }
 func (s *consumerGroupSession) MemberID() string           { return s.memberID }
 func (s *consumerGroupSession) GenerationID() int32        { return s.generationID }
 
+// getClock returns the clock of the consumer group, for the handlers timing
+// the messages of the session.
+func (s *consumerGroupSession) getClock() clock { return s.parent.config.getClock() }
+
+// getMetricRegistry returns the metric registry of the consumer group, for
+// the handlers counting the goroutines they run.
+func (s *consumerGroupSession) getMetricRegistry() metrics.Registry {
+	return s.parent.config.MetricRegistry
+}
+
 func (s *consumerGroupSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
-	if pom := s.offsets.findPOM(topic, partition); pom != nil {
+	if pom := s.offsets.findPOM(s.parent.config.physicalTopic(topic), partition); pom != nil {
 		pom.MarkOffset(offset, metadata)
 	}
 }
@@ -896,7 +1066,7 @@ func (s *consumerGroupSession) Commit() {
 }
 
 func (s *consumerGroupSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
-	if pom := s.offsets.findPOM(topic, partition); pom != nil {
+	if pom := s.offsets.findPOM(s.parent.config.physicalTopic(topic), partition); pom != nil {
 		pom.ResetOffset(offset, metadata)
 	}
 }
@@ -909,6 +1079,77 @@ func (s *consumerGroupSession) Context() context.Context {
 	return s.ctx
 }
 
+func (s *consumerGroupSession) Lag() map[string]map[int32]int64 {
+	s.consumersLock.RLock()
+	defer s.consumersLock.RUnlock()
+
+	lag := make(map[string]map[int32]int64, len(s.consumers))
+	for topic, partitions := range s.consumers {
+		lag[topic] = make(map[int32]int64, len(partitions))
+		for partition, pc := range partitions {
+			lag[topic][partition] = pc.Lag()
+		}
+	}
+	return lag
+}
+
+// processingTimeExceeded is called by the watchdog of a claim whose handler
+// took longer than Consumer.Group.MaxProcessingTime to take the next message.
+func (s *consumerGroupSession) processingTimeExceeded(topic string, partition int32, elapsed time.Duration) {
+	s.parent.handleError(fmt.Errorf("%w: no message taken for %s", ErrMaxProcessingTimeExceeded, elapsed), topic, partition)
+	if !s.parent.config.Consumer.Group.LeaveOnMaxProcessingTime {
+		return
+	}
+
+	s.leaveOnce.Do(func() {
+		defer s.cancel()
+
+		// as per KIP-345 static members do not leave the group, they are
+		// expected to rejoin within the session timeout
+		if s.parent.groupInstanceId != nil {
+			return
+		}
+
+		Logger.Printf("consumergroup/session/%s/%d leaving the group after exceeding Consumer.Group.MaxProcessingTime\n",
+			s.memberID, s.generationID)
+		coordinator, err := s.parent.client.Coordinator(s.parent.groupID)
+		if err != nil {
+			s.parent.handleError(err, "", -1)
+			return
+		}
+		resp, err := s.parent.leaveGroupRequest(coordinator, s.memberID)
+		if err != nil {
+			s.parent.handleError(err, "", -1)
+			return
+		}
+		switch resp.Err {
+		case ErrRebalanceInProgress, ErrUnknownMemberId, ErrNoError:
+		default:
+			s.parent.handleError(resp.Err, "", -1)
+		}
+	})
+}
+
+func (s *consumerGroupSession) trackConsumer(topic string, partition int32, pc PartitionConsumer) {
+	s.consumersLock.Lock()
+	defer s.consumersLock.Unlock()
+
+	if s.consumers[topic] == nil {
+		s.consumers[topic] = make(map[int32]PartitionConsumer)
+	}
+	s.consumers[topic][partition] = pc
+}
+
+func (s *consumerGroupSession) untrackConsumer(topic string, partition int32) {
+	s.consumersLock.Lock()
+	defer s.consumersLock.Unlock()
+
+	delete(s.consumers[topic], partition)
+	if len(s.consumers[topic]) == 0 {
+		delete(s.consumers, topic)
+	}
+}
+
 func (s *consumerGroupSession) consume(topic string, partition int32) {
 	// quick exit if rebalance is due
 	select {
@@ -921,7 +1162,7 @@ func (s *consumerGroupSession) consume(topic string, partition int32) {
 
 	// get next offset
 	offset := s.parent.config.Consumer.Offsets.Initial
-	if pom := s.offsets.findPOM(topic, partition); pom != nil {
+	if pom := s.offsets.findPOM(s.parent.config.physicalTopic(topic), partition); pom != nil {
 		offset, _ = pom.NextOffset()
 	}
 
@@ -932,21 +1173,29 @@ func (s *consumerGroupSession) consume(topic string, partition int32) {
 		return
 	}
 
+	s.trackConsumer(topic, partition, claim.PartitionConsumer)
+	defer s.untrackConsumer(topic, partition)
+
+	// give the handler a chance to initialise the partition before consuming it
+	if assigned, ok := s.handler.(ConsumerGroupPartitionAssignedHandler); ok {
+		assigned.OnPartitionAssigned(topic, partition, claim.startingOffset)
+	}
+
 	// handle errors
-	go func() {
+	goWithRecover(s.parent.config.MetricRegistry, func() {
 		for err := range claim.Errors() {
 			s.parent.handleError(err, topic, partition)
 		}
-	}()
+	})
 
 	// trigger close when session is done
-	go func() {
+	goWithRecover(s.parent.config.MetricRegistry, func() {
 		select {
 		case <-s.ctx.Done():
 		case <-s.parent.closed:
 		}
 		claim.AsyncClose()
-	}()
+	})
 
 	// start processing
 	if err := s.handler.ConsumeClaim(s, claim); err != nil {
@@ -955,7 +1204,7 @@ func (s *consumerGroupSession) consume(topic string, partition int32) {
 
 	// ensure consumer is closed & drained
 	claim.AsyncClose()
-	for _, err := range claim.waitClosed() {
+	for _, err := range claim.waitClosed(s.parent.config.MetricRegistry) {
 		s.parent.handleError(err, topic, partition)
 	}
 }
@@ -1000,16 +1249,19 @@ func (s *consumerGroupSession) heartbeatLoop() {
 			s.MemberID(), s.GenerationID())
 	}()
 
-	pause := time.NewTicker(s.parent.config.Consumer.Group.Heartbeat.Interval)
+	clock := s.parent.config.getClock()
+	pause := clock.NewTicker(s.parent.config.Consumer.Group.Heartbeat.Interval)
 	defer pause.Stop()
 
-	retryBackoff := time.NewTimer(s.parent.config.Metadata.Retry.Backoff)
+	retryBackoff := clock.NewTimer(s.parent.config.Metadata.Retry.Backoff)
 	defer retryBackoff.Stop()
 
 	retries := s.parent.config.Metadata.Retry.Max
+	var loadDeadline time.Time
 	for {
 		coordinator, err := s.parent.client.Coordinator(s.parent.groupID)
 		if err != nil {
+			s.heartbeatFailed(err)
 			if retries <= 0 {
 				s.parent.handleError(err, "", -1)
 				return
@@ -1018,7 +1270,7 @@ func (s *consumerGroupSession) heartbeatLoop() {
 			select {
 			case <-s.hbDying:
 				return
-			case <-retryBackoff.C:
+			case <-retryBackoff.C():
 				retries--
 			}
 			continue
@@ -1027,6 +1279,7 @@ func (s *consumerGroupSession) heartbeatLoop() {
 		resp, err := s.parent.heartbeatRequest(coordinator, s.memberID, s.generationID)
 		if err != nil {
 			_ = coordinator.Close()
+			s.heartbeatFailed(err)
 
 			if retries <= 0 {
 				s.parent.handleError(err, "", -1)
@@ -1037,9 +1290,36 @@ func (s *consumerGroupSession) heartbeatLoop() {
 			continue
 		}
 
+		if !errors.Is(resp.Err, ErrOffsetsLoadInProgress) && !errors.Is(resp.Err, ErrConsumerCoordinatorNotAvailable) {
+			loadDeadline = time.Time{}
+		}
+		if !errors.Is(resp.Err, ErrNoError) && !errors.Is(resp.Err, ErrRebalanceInProgress) {
+			s.heartbeatFailed(resp.Err)
+		}
+
 		switch resp.Err {
 		case ErrNoError:
 			retries = s.parent.config.Metadata.Retry.Max
+		case ErrOffsetsLoadInProgress, ErrConsumerCoordinatorNotAvailable:
+			// the coordinator is failing over, keep the session alive for as
+			// long as Coordinator.Retry.Timeout allows
+			if loadDeadline.IsZero() {
+				loadDeadline = clock.Now().Add(s.parent.config.Consumer.Group.Coordinator.Retry.Timeout)
+			}
+			if !clock.Now().Before(loadDeadline) {
+				s.parent.handleError(resp.Err, "", -1)
+				return
+			}
+			if errors.Is(resp.Err, ErrConsumerCoordinatorNotAvailable) {
+				_ = s.parent.client.RefreshCoordinator(s.parent.groupID)
+			}
+			retryBackoff.Reset(s.parent.config.Consumer.Group.Coordinator.Retry.Backoff)
+			select {
+			case <-s.hbDying:
+				return
+			case <-retryBackoff.C():
+			}
+			continue
 		case ErrRebalanceInProgress:
 			retries = s.parent.config.Metadata.Retry.Max
 			s.cancel()
@@ -1057,13 +1337,21 @@ func (s *consumerGroupSession) heartbeatLoop() {
 		}
 
 		select {
-		case <-pause.C:
+		case <-pause.C():
 		case <-s.hbDying:
 			return
 		}
 	}
 }
 
+// heartbeatFailed tells the handler about a failed heartbeat if it implements
+// ConsumerGroupHeartbeatErrorHandler.
+func (s *consumerGroupSession) heartbeatFailed(err error) {
+	if h, ok := s.handler.(ConsumerGroupHeartbeatErrorHandler); ok {
+		h.OnHeartbeatError(err)
+	}
+}
+
 // --------------------------------------------------------------------
 
 // ConsumerGroupHandler instances are used to handle individual topic/partition claims.
@@ -1086,6 +1374,27 @@ type ConsumerGroupHandler interface {
 	ConsumeClaim(ConsumerGroupSession, ConsumerGroupClaim) error
 }
 
+// ConsumerGroupPartitionAssignedHandler can optionally be implemented by a
+// ConsumerGroupHandler to be notified of every partition claimed in a session.
+type ConsumerGroupPartitionAssignedHandler interface {
+	// OnPartitionAssigned is called for each claim once its starting offset
+	// has been resolved (so OffsetNewest and OffsetOldest are replaced by the
+	// actual offset) and before ConsumeClaim is run for it. It is called from
+	// the claim's own goroutine, so it must be safe for concurrent use.
+	OnPartitionAssigned(topic string, partition int32, initialOffset int64)
+}
+
+// ConsumerGroupHeartbeatErrorHandler can optionally be implemented by a
+// ConsumerGroupHandler to be notified of failed heartbeats.
+type ConsumerGroupHeartbeatErrorHandler interface {
+	// OnHeartbeatError is called for every heartbeat of a session that failed,
+	// whether it is retried or ends the session, e.g. because the member was
+	// removed from the group. Rebalances are not reported. It is called from the
+	// heartbeat goroutine of the session, which runs independently of
+	// ConsumeClaim, so it must be safe for concurrent use and return quickly.
+	OnHeartbeatError(err error)
+}
+
 // ConsumerGroupClaim processes Kafka messages from a given topic and partition within a consumer group.
 type ConsumerGroupClaim interface {
 	// Topic returns the consumed topic name.
@@ -1102,19 +1411,35 @@ type ConsumerGroupClaim interface {
 	// You can use this to determine how far behind the processing is.
 	HighWaterMarkOffset() int64
 
+	// Lag returns the number of messages between the high watermark offset of the
+	// partition and the next message to be returned over the Messages channel.
+	Lag() int64
+
 	// Messages returns the read channel for the messages that are returned by
 	// the broker. The messages channel will be closed when a new rebalance cycle
 	// is due. You must finish processing and mark offsets within
 	// Config.Consumer.Group.Session.Timeout before the topic/partition is eventually
 	// re-assigned to another group member.
 	Messages() <-chan *ConsumerMessage
+
+	// DecodeErrors returns the read channel of the records that failed to
+	// decode when Consumer.Return.DecodeErrors is enabled, with their raw Key
+	// and Value. These records are not delivered on Messages, so mark them
+	// with MarkMessage once they have been handled. Records left unread for
+	// longer than Consumer.MaxProcessingTime are reported as errors instead.
+	DecodeErrors() <-chan *ConsumerError
 }
 
 type consumerGroupClaim struct {
-	topic     string
-	partition int32
-	offset    int64
+	topic          string
+	partition      int32
+	offset         int64
+	startingOffset int64
 	PartitionConsumer
+
+	// messages relays the messages of the PartitionConsumer to the handler
+	// when Consumer.Group.MaxProcessingTime is set
+	messages chan *ConsumerMessage
 }
 
 func newConsumerGroupClaim(sess *consumerGroupSession, topic string, partition int32, offset int64) (*consumerGroupClaim, error) {
@@ -1128,33 +1453,118 @@ func newConsumerGroupClaim(sess *consumerGroupSession, topic string, partition i
 		return nil, err
 	}
 
-	go func() {
+	goWithRecover(sess.parent.config.MetricRegistry, func() {
 		for err := range pcm.Errors() {
 			sess.parent.handleError(err, topic, partition)
 		}
-	}()
+	})
 
-	return &consumerGroupClaim{
+	startingOffset := offset
+	if child, ok := pcm.(*partitionConsumer); ok {
+		startingOffset = child.startingOffset
+	}
+
+	claim := &consumerGroupClaim{
 		topic:             topic,
 		partition:         partition,
 		offset:            offset,
+		startingOffset:    startingOffset,
 		PartitionConsumer: pcm,
-	}, nil
+	}
+	if limit := sess.parent.config.Consumer.Group.MaxProcessingTime; limit > 0 {
+		claim.messages = make(chan *ConsumerMessage)
+		goWithRecover(sess.parent.config.MetricRegistry, func() { claim.watchProcessingTime(sess, limit) })
+	}
+	return claim, nil
 }
 
 func (c *consumerGroupClaim) Topic() string        { return c.topic }
 func (c *consumerGroupClaim) Partition() int32     { return c.partition }
 func (c *consumerGroupClaim) InitialOffset() int64 { return c.offset }
 
-// Drains messages and errors, ensures the claim is fully closed.
-func (c *consumerGroupClaim) waitClosed() (errs ConsumerErrors) {
-	go func() {
+func (c *consumerGroupClaim) Messages() <-chan *ConsumerMessage {
+	if c.messages != nil {
+		return c.messages
+	}
+	return c.PartitionConsumer.Messages()
+}
+
+// watchProcessingTime relays the messages of the claim to the handler one at a
+// time and keeps track of how long the handler has not taken a message since
+// the next one is waiting, i.e. how long it has been processing the previous
+// one. The time the handler idles with no message to take is not counted. It
+// warns when 80% of limit has elapsed and reports once it is exceeded.
+func (c *consumerGroupClaim) watchProcessingTime(sess *consumerGroupSession, limit time.Duration) {
+	defer close(c.messages)
+
+	var warnings, exceeded metrics.Counter
+	if registry := sess.parent.metricRegistry; registry != nil {
+		warnings = metrics.GetOrRegisterCounter(fmt.Sprintf("consumer-group-processing-time-warnings-%s", sess.parent.groupID), registry)
+		exceeded = metrics.GetOrRegisterCounter(fmt.Sprintf("consumer-group-processing-time-exceeded-%s", sess.parent.groupID), registry)
+	}
+
+	clock := sess.parent.config.getClock()
+	ticker := clock.NewTicker(limit / 10)
+	defer ticker.Stop()
+
+	for msg := range c.PartitionConsumer.Messages() {
+		// the clock starts once a message is pending, which is never before
+		// the previous one was taken, and the ticks received while idle are
+		// stale
+		pendingSince := clock.Now()
+		select {
+		case <-ticker.C():
+		default:
+		}
+
+		warned, reported := false, false
+	deliver:
+		for {
+			select {
+			case c.messages <- msg:
+				break deliver
+			case <-ticker.C():
+				// the handler may be ready as well, which is no delay
+				select {
+				case c.messages <- msg:
+					break deliver
+				default:
+				}
+
+				elapsed := clock.Since(pendingSince)
+				switch {
+				case elapsed >= limit && !reported:
+					reported = true
+					if exceeded != nil {
+						exceeded.Inc(1)
+					}
+					sess.processingTimeExceeded(c.topic, c.partition, elapsed)
+				case elapsed >= limit*4/5 && !warned:
+					warned = true
+					if warnings != nil {
+						warnings.Inc(1)
+					}
+					Logger.Printf("consumergroup/%s handler of %s/%d has not taken a message for %s, Consumer.Group.MaxProcessingTime is %s\n",
+						sess.parent.groupID, c.topic, c.partition, elapsed, limit)
+				}
+			}
+		}
+	}
+}
+
+// Drains messages and errors, ensures the claim is fully closed. Decode
+// errors the handler left unread are returned along the errors.
+func (c *consumerGroupClaim) waitClosed(registry metrics.Registry) (errs ConsumerErrors) {
+	goWithRecover(registry, func() {
 		for range c.Messages() {
 		}
-	}()
+	})
 
 	for err := range c.Errors() {
 		errs = append(errs, err)
 	}
+	for err := range c.DecodeErrors() {
+		errs = append(errs, err)
+	}
 	return
 }
@@ -163,6 +163,9 @@ func (m *ConsumerGroupMemberAssignment) decode(pd packetDecoder) (err error) {
 	if topicLen, err = pd.getArrayLength(); err != nil {
 		return
 	}
+	if topicLen < 0 {
+		return errInvalidArrayLength
+	}
 
 	m.Topics = make(map[string][]int32, topicLen)
 	for i := 0; i < topicLen; i++ {
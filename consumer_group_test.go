@@ -3,6 +3,7 @@ package sarama
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"testing"
 	"time"
@@ -108,6 +109,341 @@ func TestConsumerGroupNewSessionDuringOffsetLoad(t *testing.T) {
 	wg.Wait()
 }
 
+// TestConsumerGroupNewSessionDuringCoordinatorLoad ensures that the consumer
+// group waits for a loading coordinator within Coordinator.Retry.Timeout
+// instead of failing once the rebalance retries are used up.
+func TestConsumerGroupNewSessionDuringCoordinatorLoad(t *testing.T) {
+	config := NewTestConfig()
+	config.ClientID = t.Name()
+	config.Version = V2_0_0_0
+	config.Consumer.Return.Errors = true
+	config.Consumer.Group.Rebalance.Retry.Max = 0
+	config.Consumer.Offsets.AutoCommit.Enable = false
+
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my-topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my-topic", 0, OffsetOldest, 0).
+			SetOffset("my-topic", 0, OffsetNewest, 1),
+		"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+			SetCoordinator(CoordinatorGroup, "my-group", broker0),
+		"HeartbeatRequest": NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": NewMockSequence(
+			NewMockJoinGroupResponse(t).SetError(ErrOffsetsLoadInProgress),
+			NewMockJoinGroupResponse(t).SetError(ErrOffsetsLoadInProgress),
+			NewMockJoinGroupResponse(t).SetGroupProtocol(RangeBalanceStrategyName),
+		),
+		"SyncGroupRequest": NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&ConsumerGroupMemberAssignment{
+				Version: 0,
+				Topics: map[string][]int32{
+					"my-topic": {0},
+				},
+			}),
+		"OffsetFetchRequest": NewMockOffsetFetchResponse(t).SetOffset(
+			"my-group", "my-topic", 0, 0, "", ErrNoError,
+		).SetError(ErrNoError),
+		"FetchRequest": NewMockSequence(
+			NewMockFetchResponse(t, 1).
+				SetMessage("my-topic", 0, 0, StringEncoder("foo")).
+				SetMessage("my-topic", 0, 1, StringEncoder("bar")),
+			NewMockFetchResponse(t, 1),
+		),
+	})
+
+	group, err := NewConsumerGroup([]string{broker0.Addr()}, "my-group", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = group.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &handler{t, cancel}
+
+	if err := group.Consume(ctx, []string{"my-topic"}, h); err != nil {
+		t.Error(err)
+	}
+}
+
+type slowHandler struct {
+	taken chan *ConsumerMessage
+}
+
+func (h *slowHandler) Setup(s ConsumerGroupSession) error   { return nil }
+func (h *slowHandler) Cleanup(s ConsumerGroupSession) error { return nil }
+func (h *slowHandler) ConsumeClaim(sess ConsumerGroupSession, claim ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		h.taken <- msg
+		// block on the first message until the session ends
+		<-sess.Context().Done()
+		return nil
+	}
+	return nil
+}
+
+// TestConsumerGroupMaxProcessingTime ensures that a handler that blocks on a
+// message longer than Consumer.Group.MaxProcessingTime is reported and makes
+// the member leave the group when LeaveOnMaxProcessingTime is set.
+func TestConsumerGroupMaxProcessingTime(t *testing.T) {
+	config := NewTestConfig()
+	config.ClientID = t.Name()
+	config.Version = V2_0_0_0
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	config.Consumer.Group.MaxProcessingTime = 100 * time.Millisecond
+	config.Consumer.Group.LeaveOnMaxProcessingTime = true
+
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my-topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my-topic", 0, OffsetOldest, 0).
+			SetOffset("my-topic", 0, OffsetNewest, 2),
+		"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+			SetCoordinator(CoordinatorGroup, "my-group", broker0),
+		"HeartbeatRequest": NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": NewMockJoinGroupResponse(t).SetGroupProtocol(RangeBalanceStrategyName),
+		"SyncGroupRequest": NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&ConsumerGroupMemberAssignment{
+				Version: 0,
+				Topics: map[string][]int32{
+					"my-topic": {0},
+				},
+			}),
+		"LeaveGroupRequest": NewMockLeaveGroupResponse(t),
+		"OffsetFetchRequest": NewMockOffsetFetchResponse(t).SetOffset(
+			"my-group", "my-topic", 0, 0, "", ErrNoError,
+		).SetError(ErrNoError),
+		"FetchRequest": NewMockFetchResponse(t, 1).
+			SetMessage("my-topic", 0, 0, StringEncoder("foo")).
+			SetMessage("my-topic", 0, 1, StringEncoder("bar")),
+	})
+
+	group, err := NewConsumerGroup([]string{broker0.Addr()}, "my-group", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = group.Close() }()
+
+	h := &slowHandler{taken: make(chan *ConsumerMessage, 2)}
+	done := make(chan error, 1)
+	go func() {
+		done <- group.Consume(context.Background(), []string{"my-topic"}, h)
+	}()
+
+	select {
+	case err := <-group.Errors():
+		if !errors.Is(err, ErrMaxProcessingTimeExceeded) {
+			t.Errorf("expected an error wrapping %v, got %v", ErrMaxProcessingTimeExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the watchdog")
+	}
+
+	// leaving the group ends the session
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the session to end")
+	}
+	if len(h.taken) != 1 {
+		t.Errorf("expected the handler to take a single message, took %d", len(h.taken))
+	}
+
+	left := false
+	for _, rr := range broker0.History() {
+		if _, ok := rr.Request.(*LeaveGroupRequest); ok {
+			left = true
+		}
+	}
+	if !left {
+		t.Error("expected the member to leave the group")
+	}
+}
+
+// idlePartitionConsumer is a PartitionConsumer whose messages are fed by
+// the test.
+type idlePartitionConsumer struct {
+	PartitionConsumer
+	messages chan *ConsumerMessage
+}
+
+func (c *idlePartitionConsumer) Messages() <-chan *ConsumerMessage { return c.messages }
+
+// TestConsumerGroupMaxProcessingTimeIdle ensures that the time a handler
+// idles with no message to take does not count as processing time.
+func TestConsumerGroupMaxProcessingTimeIdle(t *testing.T) {
+	clock := newFakeClock()
+	config := NewTestConfig()
+	config.clock = clock
+	config.Consumer.Return.Errors = true
+	sess := &consumerGroupSession{parent: &consumerGroup{
+		config:  config,
+		groupID: "my-group",
+		errors:  make(chan error, 1),
+		closed:  make(chan none),
+	}}
+	pc := &idlePartitionConsumer{messages: make(chan *ConsumerMessage)}
+	claim := &consumerGroupClaim{topic: "my-topic", PartitionConsumer: pc, messages: make(chan *ConsumerMessage)}
+	go claim.watchProcessingTime(sess, 100*time.Millisecond)
+	defer close(pc.messages)
+
+	// idle for longer than the limit, the ticks are left pending
+	clock.BlockUntil(t, 1)
+	for i := 0; i < 20; i++ {
+		clock.Advance(10 * time.Millisecond)
+	}
+
+	pc.messages <- &ConsumerMessage{Topic: "my-topic"}
+	clock.Advance(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond) // let the watchdog see the tick
+	<-claim.messages
+
+	select {
+	case err := <-sess.parent.errors:
+		t.Errorf("expected a handler taking a message in time not to be reported, got %v", err)
+	default:
+	}
+}
+
+type blockedHandler struct {
+	taken         chan *ConsumerMessage
+	heartbeatErrs chan error
+}
+
+func (h *blockedHandler) Setup(s ConsumerGroupSession) error   { return nil }
+func (h *blockedHandler) Cleanup(s ConsumerGroupSession) error { return nil }
+func (h *blockedHandler) ConsumeClaim(sess ConsumerGroupSession, claim ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		h.taken <- msg
+		<-sess.Context().Done()
+		return nil
+	}
+	return nil
+}
+
+func (h *blockedHandler) OnHeartbeatError(err error) {
+	// only the first error is recorded, a retry may report it again
+	select {
+	case h.heartbeatErrs <- err:
+	default:
+	}
+}
+
+// TestConsumerGroupHeartbeatsDuringBlockedHandler ensures that heartbeats are
+// sent independently of a blocked handler and that heartbeat failures are
+// reported to a ConsumerGroupHeartbeatErrorHandler.
+func TestConsumerGroupHeartbeatsDuringBlockedHandler(t *testing.T) {
+	config := NewTestConfig()
+	config.ClientID = t.Name()
+	config.Version = V2_0_0_0
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	config.Consumer.Group.Heartbeat.Interval = 20 * time.Millisecond
+	config.Consumer.Group.MaxProcessingTime = 5 * time.Second
+
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	handlers := map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my-topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my-topic", 0, OffsetOldest, 0).
+			SetOffset("my-topic", 0, OffsetNewest, 2),
+		"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+			SetCoordinator(CoordinatorGroup, "my-group", broker0),
+		"HeartbeatRequest": NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": NewMockJoinGroupResponse(t).SetGroupProtocol(RangeBalanceStrategyName),
+		"SyncGroupRequest": NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&ConsumerGroupMemberAssignment{
+				Version: 0,
+				Topics: map[string][]int32{
+					"my-topic": {0},
+				},
+			}),
+		"OffsetFetchRequest": NewMockOffsetFetchResponse(t).SetOffset(
+			"my-group", "my-topic", 0, 0, "", ErrNoError,
+		).SetError(ErrNoError),
+		"FetchRequest": NewMockFetchResponse(t, 1).
+			SetMessage("my-topic", 0, 0, StringEncoder("foo")).
+			SetMessage("my-topic", 0, 1, StringEncoder("bar")),
+	}
+	broker0.SetHandlerByMap(handlers)
+
+	group, err := NewConsumerGroup([]string{broker0.Addr()}, "my-group", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = group.Close() }()
+
+	h := &blockedHandler{
+		taken:         make(chan *ConsumerMessage, 2),
+		heartbeatErrs: make(chan error, 1),
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- group.Consume(context.Background(), []string{"my-topic"}, h)
+	}()
+
+	var taken *ConsumerMessage
+	select {
+	case taken = <-h.taken:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the first message")
+	}
+
+	// keep heartbeating while the handler is blocked, then fail
+	time.Sleep(5 * config.Consumer.Group.Heartbeat.Interval)
+	handlers["HeartbeatRequest"] = NewMockHeartbeatResponse(t).SetError(ErrUnknownMemberId)
+	broker0.SetHandlerByMap(handlers)
+
+	select {
+	case err := <-h.heartbeatErrs:
+		if !errors.Is(err, ErrUnknownMemberId) {
+			t.Errorf("expected heartbeat error %v, got %v", ErrUnknownMemberId, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the heartbeat error")
+	}
+
+	// the session ends once the member is no longer known
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the session to end")
+	}
+
+	if string(taken.Value) != "foo" || len(h.taken) != 0 {
+		t.Fatalf("expected the handler to block on the first message, took %d more", len(h.taken))
+	}
+	heartbeats := 0
+	for _, rr := range broker0.History() {
+		if _, ok := rr.Request.(*HeartbeatRequest); ok {
+			heartbeats++
+		}
+	}
+	if heartbeats < 6 {
+		t.Errorf("expected heartbeats to continue while the handler was blocked, got %d", heartbeats)
+	}
+}
+
 func TestConsume_RaceTest(t *testing.T) {
 	const (
 		groupID     = "test-group"
@@ -233,6 +569,62 @@ func TestConsumerGroupSessionDoesNotRetryForever(t *testing.T) {
 	wg.Wait()
 }
 
+func TestConsumerGroupInvalidSessionTimeout(t *testing.T) {
+	config := NewTestConfig()
+	config.ClientID = t.Name()
+	config.Version = V2_0_0_0
+	config.Consumer.Group.Session.Timeout = 3 * time.Second
+	config.Consumer.Group.Heartbeat.Interval = time.Second
+	config.Consumer.Group.Rebalance.Retry.Max = 0
+
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	broker0.SetHandlerFuncByMap(map[string]requestHandlerFunc{
+		"MetadataRequest": func(req *request) encoderWithHeader {
+			return NewMockMetadataResponse(t).
+				SetBroker(broker0.Addr(), broker0.BrokerID()).
+				SetLeader("my-topic", 0, broker0.BrokerID()).
+				For(req.body)
+		},
+		"FindCoordinatorRequest": func(req *request) encoderWithHeader {
+			return NewMockFindCoordinatorResponse(t).
+				SetCoordinator(CoordinatorGroup, "my-group", broker0).
+				For(req.body)
+		},
+		"JoinGroupRequest": func(req *request) encoderWithHeader {
+			return NewMockJoinGroupResponse(t).SetError(ErrInvalidSessionTimeout).For(req.body)
+		},
+		"DescribeConfigsRequest": func(req *request) encoderWithHeader {
+			return &DescribeConfigsResponse{
+				Version: req.body.version(),
+				Resources: []*ResourceResponse{{
+					Type: BrokerResource,
+					Name: "0",
+					Configs: []*ConfigEntry{
+						{Name: "group.min.session.timeout.ms", Value: "6000"},
+						{Name: "group.max.session.timeout.ms", Value: "1800000"},
+					},
+				}},
+			}
+		},
+	})
+
+	group, err := NewConsumerGroup([]string{broker0.Addr()}, "my-group", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = group.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = group.Consume(ctx, []string{"my-topic"}, &handler{t, cancel})
+	if !errors.Is(err, ErrInvalidSessionTimeout) {
+		t.Fatalf("expected ErrInvalidSessionTimeout, got %v", err)
+	}
+	assert.Contains(t, err.Error(), "must be between 6s (group.min.session.timeout.ms) and 30m0s (group.max.session.timeout.ms)")
+}
+
 func TestConsumerShouldNotRetrySessionIfContextCancelled(t *testing.T) {
 	c := &consumerGroup{
 		config: NewTestConfig(),
@@ -244,3 +636,428 @@ func TestConsumerShouldNotRetrySessionIfContextCancelled(t *testing.T) {
 	_, err = c.retryNewSession(ctx, nil, nil, 1024, true)
 	assert.Equal(t, context.Canceled, err)
 }
+
+type lagHandler struct {
+	*testing.T
+	cancel context.CancelFunc
+	lag    map[string]map[int32]int64
+}
+
+func (h *lagHandler) Setup(s ConsumerGroupSession) error   { return nil }
+func (h *lagHandler) Cleanup(s ConsumerGroupSession) error { return nil }
+func (h *lagHandler) ConsumeClaim(sess ConsumerGroupSession, claim ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		sess.MarkMessage(msg, "")
+		if msg.Offset == 1 {
+			deadline := time.Now().Add(time.Second)
+			for claim.Lag() != 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			h.lag = sess.Lag()
+			h.cancel()
+			break
+		}
+	}
+	return nil
+}
+
+func TestConsumerGroupSessionLag(t *testing.T) {
+	config := NewTestConfig()
+	config.ClientID = t.Name()
+	config.Version = V2_0_0_0
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.AutoCommit.Enable = false
+
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my-topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my-topic", 0, OffsetOldest, 0).
+			SetOffset("my-topic", 0, OffsetNewest, 2),
+		"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+			SetCoordinator(CoordinatorGroup, "my-group", broker0),
+		"HeartbeatRequest": NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": NewMockJoinGroupResponse(t).SetGroupProtocol(RangeBalanceStrategyName),
+		"SyncGroupRequest": NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&ConsumerGroupMemberAssignment{
+				Version: 0,
+				Topics: map[string][]int32{
+					"my-topic": {0},
+				},
+			}),
+		"OffsetFetchRequest": NewMockOffsetFetchResponse(t).SetOffset(
+			"my-group", "my-topic", 0, 0, "", ErrNoError,
+		).SetError(ErrNoError),
+		"FetchRequest": NewMockFetchResponse(t, 2).
+			SetMessage("my-topic", 0, 0, StringEncoder("foo")).
+			SetMessage("my-topic", 0, 1, StringEncoder("bar")).
+			SetHighWaterMark("my-topic", 0, 2),
+	})
+
+	group, err := NewConsumerGroup([]string{broker0.Addr()}, "my-group", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = group.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &lagHandler{T: t, cancel: cancel}
+
+	if err := group.Consume(ctx, []string{"my-topic"}, h); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]map[int32]int64{"my-topic": {0: 0}}, h.lag)
+}
+
+type assignedHandler struct {
+	*testing.T
+	cancel   context.CancelFunc
+	lock     sync.Mutex
+	assigned map[string]map[int32]int64
+	first    int64
+}
+
+func (h *assignedHandler) Setup(s ConsumerGroupSession) error   { return nil }
+func (h *assignedHandler) Cleanup(s ConsumerGroupSession) error { return nil }
+func (h *assignedHandler) OnPartitionAssigned(topic string, partition int32, initialOffset int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.assigned[topic] == nil {
+		h.assigned[topic] = make(map[int32]int64)
+	}
+	h.assigned[topic][partition] = initialOffset
+}
+
+func (h *assignedHandler) ConsumeClaim(sess ConsumerGroupSession, claim ConsumerGroupClaim) error {
+	h.lock.Lock()
+	_, ok := h.assigned[claim.Topic()][claim.Partition()]
+	h.lock.Unlock()
+	if !ok {
+		h.Errorf("ConsumeClaim called before OnPartitionAssigned for %s/%d", claim.Topic(), claim.Partition())
+	}
+	for msg := range claim.Messages() {
+		h.first = msg.Offset
+		h.cancel()
+		break
+	}
+	return nil
+}
+
+func TestConsumerGroupOnPartitionAssigned(t *testing.T) {
+	config := NewTestConfig()
+	config.ClientID = t.Name()
+	config.Version = V2_0_0_0
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.Initial = OffsetOldest
+	config.Consumer.Offsets.AutoCommit.Enable = false
+
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my-topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my-topic", 0, OffsetOldest, 5).
+			SetOffset("my-topic", 0, OffsetNewest, 7),
+		"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+			SetCoordinator(CoordinatorGroup, "my-group", broker0),
+		"HeartbeatRequest": NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": NewMockJoinGroupResponse(t).SetGroupProtocol(RangeBalanceStrategyName),
+		"SyncGroupRequest": NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&ConsumerGroupMemberAssignment{
+				Version: 0,
+				Topics: map[string][]int32{
+					"my-topic": {0},
+				},
+			}),
+		"OffsetFetchRequest": NewMockOffsetFetchResponse(t).SetOffset(
+			"my-group", "my-topic", 0, -1, "", ErrNoError,
+		).SetError(ErrNoError),
+		"FetchRequest": NewMockFetchResponse(t, 2).
+			SetMessage("my-topic", 0, 5, StringEncoder("foo")).
+			SetMessage("my-topic", 0, 6, StringEncoder("bar")).
+			SetHighWaterMark("my-topic", 0, 7),
+	})
+
+	group, err := NewConsumerGroup([]string{broker0.Addr()}, "my-group", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = group.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &assignedHandler{T: t, cancel: cancel, assigned: make(map[string]map[int32]int64)}
+
+	if err := group.Consume(ctx, []string{"my-topic"}, h); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]map[int32]int64{"my-topic": {0: 5}}, h.assigned)
+	assert.Equal(t, int64(5), h.first)
+}
+
+type cancelHandler struct {
+	cancel context.CancelFunc
+}
+
+func (h *cancelHandler) Setup(s ConsumerGroupSession) error   { return nil }
+func (h *cancelHandler) Cleanup(s ConsumerGroupSession) error { return nil }
+func (h *cancelHandler) ConsumeClaim(sess ConsumerGroupSession, claim ConsumerGroupClaim) error {
+	for range claim.Messages() {
+		h.cancel()
+		break
+	}
+	return nil
+}
+
+// TestConsumerGroupCloseLeavesGroup ensures that closing the group sends a
+// LeaveGroup request, and gives up waiting for it after Leave.Timeout.
+func TestConsumerGroupCloseLeavesGroup(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		respond  bool
+		expected error
+	}{
+		{"left", true, nil},
+		{"timed out", false, ErrLeaveGroupTimeout},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := NewTestConfig()
+			config.ClientID = t.Name()
+			config.Version = V2_0_0_0
+			config.Consumer.Offsets.AutoCommit.Enable = false
+			config.Consumer.Group.Leave.Timeout = 100 * time.Millisecond
+
+			broker0 := NewMockBroker(t, 0)
+			defer broker0.Close()
+
+			handlers := map[string]MockResponse{
+				"MetadataRequest": NewMockMetadataResponse(t).
+					SetBroker(broker0.Addr(), broker0.BrokerID()).
+					SetLeader("my-topic", 0, broker0.BrokerID()),
+				"OffsetRequest": NewMockOffsetResponse(t).
+					SetOffset("my-topic", 0, OffsetOldest, 0).
+					SetOffset("my-topic", 0, OffsetNewest, 1),
+				"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+					SetCoordinator(CoordinatorGroup, "my-group", broker0),
+				"HeartbeatRequest": NewMockHeartbeatResponse(t),
+				"JoinGroupRequest": NewMockJoinGroupResponse(t).
+					SetGroupProtocol(RangeBalanceStrategyName).
+					SetMemberId("my-member"),
+				"SyncGroupRequest": NewMockSyncGroupResponse(t).SetMemberAssignment(
+					&ConsumerGroupMemberAssignment{
+						Version: 0,
+						Topics: map[string][]int32{
+							"my-topic": {0},
+						},
+					}),
+				"OffsetFetchRequest": NewMockOffsetFetchResponse(t).SetOffset(
+					"my-group", "my-topic", 0, 0, "", ErrNoError,
+				).SetError(ErrNoError),
+				"FetchRequest": NewMockFetchResponse(t, 1).
+					SetMessage("my-topic", 0, 0, StringEncoder("foo")),
+			}
+			if tc.respond {
+				handlers["LeaveGroupRequest"] = NewMockLeaveGroupResponse(t)
+			}
+			broker0.SetHandlerByMap(handlers)
+
+			group, err := NewConsumerGroup([]string{broker0.Addr()}, "my-group", config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if err := group.Consume(ctx, []string{"my-topic"}, &cancelHandler{cancel: cancel}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := group.Close(); !errors.Is(err, tc.expected) {
+				t.Errorf("expected Close to return %v, got %v", tc.expected, err)
+			}
+
+			var left *LeaveGroupRequest
+			for _, rr := range broker0.History() {
+				if req, ok := rr.Request.(*LeaveGroupRequest); ok {
+					left = req
+				}
+			}
+			if tc.respond && (left == nil || left.MemberId != "my-member") {
+				t.Errorf("expected my-member to leave the group, got %+v", left)
+			}
+		})
+	}
+}
+
+type sessionIDsHandler struct {
+	cancel context.CancelFunc
+	lock   sync.Mutex
+	seen   []string
+}
+
+func (h *sessionIDsHandler) record(s ConsumerGroupSession) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.seen = append(h.seen, fmt.Sprintf("%s/%d", s.MemberID(), s.GenerationID()))
+}
+
+func (h *sessionIDsHandler) Setup(s ConsumerGroupSession) error {
+	h.record(s)
+	return nil
+}
+
+func (h *sessionIDsHandler) Cleanup(s ConsumerGroupSession) error {
+	h.record(s)
+	return nil
+}
+
+func (h *sessionIDsHandler) ConsumeClaim(sess ConsumerGroupSession, claim ConsumerGroupClaim) error {
+	for range claim.Messages() {
+		h.record(sess)
+		h.cancel()
+		break
+	}
+	return nil
+}
+
+// TestConsumerGroupSessionIDs ensures that the handler sees the member ID and
+// generation assigned by the coordinator throughout the session.
+func TestConsumerGroupSessionIDs(t *testing.T) {
+	config := NewTestConfig()
+	config.ClientID = t.Name()
+	config.Version = V2_0_0_0
+	config.Consumer.Offsets.AutoCommit.Enable = false
+
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my-topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my-topic", 0, OffsetOldest, 0).
+			SetOffset("my-topic", 0, OffsetNewest, 1),
+		"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+			SetCoordinator(CoordinatorGroup, "my-group", broker0),
+		"HeartbeatRequest": NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": NewMockJoinGroupResponse(t).
+			SetGroupProtocol(RangeBalanceStrategyName).
+			SetMemberId("my-member").
+			SetGenerationId(7),
+		"SyncGroupRequest": NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&ConsumerGroupMemberAssignment{
+				Version: 0,
+				Topics: map[string][]int32{
+					"my-topic": {0},
+				},
+			}),
+		"LeaveGroupRequest": NewMockLeaveGroupResponse(t),
+		"OffsetFetchRequest": NewMockOffsetFetchResponse(t).SetOffset(
+			"my-group", "my-topic", 0, 0, "", ErrNoError,
+		).SetError(ErrNoError),
+		"FetchRequest": NewMockFetchResponse(t, 1).
+			SetMessage("my-topic", 0, 0, StringEncoder("foo")),
+	})
+
+	group, err := NewConsumerGroup([]string{broker0.Addr()}, "my-group", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = group.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &sessionIDsHandler{cancel: cancel}
+	if err := group.Consume(ctx, []string{"my-topic"}, h); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"my-member/7", "my-member/7", "my-member/7"}, h.seen)
+}
+
+type decodeErrorsHandler struct {
+	cancel  context.CancelFunc
+	decoded *ConsumerError
+	next    *ConsumerMessage
+}
+
+func (h *decodeErrorsHandler) Setup(s ConsumerGroupSession) error   { return nil }
+func (h *decodeErrorsHandler) Cleanup(s ConsumerGroupSession) error { return nil }
+func (h *decodeErrorsHandler) ConsumeClaim(sess ConsumerGroupSession, claim ConsumerGroupClaim) error {
+	defer h.cancel()
+	select {
+	case h.decoded = <-claim.DecodeErrors():
+		sess.MarkMessage(h.decoded.Message, "")
+	case <-time.After(5 * time.Second):
+		return nil
+	}
+	h.next = <-claim.Messages()
+	sess.MarkMessage(h.next, "")
+	return nil
+}
+
+func TestConsumerGroupClaimDecodeErrors(t *testing.T) {
+	config := NewTestConfig()
+	config.ClientID = t.Name()
+	config.Version = V2_0_0_0
+	config.Consumer.Return.DecodeErrors = true
+	config.Consumer.MaxProcessingTime = time.Minute
+	config.Consumer.ValueDeserializer = jsonSerde{}
+	config.Consumer.Offsets.AutoCommit.Enable = false
+
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my-topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my-topic", 0, OffsetOldest, 0).
+			SetOffset("my-topic", 0, OffsetNewest, 2),
+		"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+			SetCoordinator(CoordinatorGroup, "my-group", broker0),
+		"HeartbeatRequest": NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": NewMockJoinGroupResponse(t).SetGroupProtocol(RangeBalanceStrategyName),
+		"SyncGroupRequest": NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&ConsumerGroupMemberAssignment{
+				Version: 0,
+				Topics: map[string][]int32{
+					"my-topic": {0},
+				},
+			}),
+		"OffsetFetchRequest": NewMockOffsetFetchResponse(t).SetOffset(
+			"my-group", "my-topic", 0, 0, "", ErrNoError,
+		).SetError(ErrNoError),
+		"FetchRequest": NewMockFetchResponse(t, 1).
+			SetMessage("my-topic", 0, 0, StringEncoder("not json")).
+			SetMessage("my-topic", 0, 1, StringEncoder(`{"id":3,"name":"deleted"}`)),
+	})
+
+	group, err := NewConsumerGroup([]string{broker0.Addr()}, "my-group", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = group.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &decodeErrorsHandler{cancel: cancel}
+
+	if err := group.Consume(ctx, []string{"my-topic"}, h); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.decoded == nil || h.decoded.Message == nil || string(h.decoded.Message.Value) != "not json" {
+		t.Fatalf("expected the raw record on the claim's DecodeErrors, got %+v", h.decoded)
+	}
+	if h.next == nil || h.next.Offset != 1 {
+		t.Errorf("expected the next record at offset 1, got %+v", h.next)
+	}
+}
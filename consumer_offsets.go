@@ -0,0 +1,284 @@
+package sarama
+
+import "fmt"
+
+// ConsumerOffsetsTopic is the internal topic where the group coordinators store
+// the offsets committed by consumer groups and their metadata.
+const ConsumerOffsetsTopic = "__consumer_offsets"
+
+// OffsetCommitRecord is an offset committed by a consumer group, as stored in
+// the __consumer_offsets topic.
+// https://github.com/apache/kafka/blob/trunk/group-coordinator/src/main/resources/common/message/OffsetCommitValue.json
+type OffsetCommitRecord struct {
+	// KeyVersion and Version are the schema versions of the key and value.
+	KeyVersion int16
+	Version    int16
+
+	Group     string
+	Topic     string
+	Partition int32
+
+	// Deleted is set for the tombstones deleting the offset, which only have
+	// a key.
+	Deleted bool
+
+	Offset          int64
+	LeaderEpoch     int32 // -1 before version 3
+	Metadata        string
+	CommitTimestamp int64 // in milliseconds
+	ExpireTimestamp int64 // in milliseconds, -1 unless version 1
+}
+
+// GroupMetadataRecord is the metadata of a consumer group, as stored in the
+// __consumer_offsets topic.
+// https://github.com/apache/kafka/blob/trunk/group-coordinator/src/main/resources/common/message/GroupMetadataValue.json
+type GroupMetadataRecord struct {
+	// KeyVersion and Version are the schema versions of the key and value.
+	KeyVersion int16
+	Version    int16
+
+	Group string
+
+	// Deleted is set for the tombstones deleting the group, which only have a
+	// key.
+	Deleted bool
+
+	ProtocolType          string
+	Generation            int32
+	Protocol              *string
+	Leader                *string
+	CurrentStateTimestamp int64 // in milliseconds, -1 before version 2
+	Members               []*GroupMetadataMember
+}
+
+// GroupMetadataMember is a member of a GroupMetadataRecord. For consumer
+// groups, Subscription and Assignment decode into a ConsumerGroupMemberMetadata
+// and a ConsumerGroupMemberAssignment.
+type GroupMetadataMember struct {
+	MemberID         string
+	GroupInstanceID  *string // nil before version 3
+	ClientID         string
+	ClientHost       string
+	RebalanceTimeout int32 // -1 before version 1
+	SessionTimeout   int32
+	Subscription     []byte
+	Assignment       []byte
+}
+
+// DecodeConsumerOffsetsRecord decodes the key and value of a record consumed
+// from the __consumer_offsets topic into an *OffsetCommitRecord or a
+// *GroupMetadataRecord, a nil value being a tombstone. It is meant to debug
+// consumer groups: the format of the topic is internal to Kafka, and newer
+// brokers may write records of other types, which fail to decode.
+func DecodeConsumerOffsetsRecord(key, value []byte) (interface{}, error) {
+	k := &consumerOffsetsKey{}
+	if err := decode(key, k, nil); err != nil {
+		return nil, err
+	}
+
+	switch k.version {
+	case 0, 1:
+		record := &OffsetCommitRecord{KeyVersion: k.version, Group: k.group, Topic: k.topic, Partition: k.partition}
+		if value == nil {
+			record.Deleted = true
+			return record, nil
+		}
+		if err := decode(value, record, nil); err != nil {
+			return nil, err
+		}
+		return record, nil
+	case 2:
+		record := &GroupMetadataRecord{KeyVersion: k.version, Group: k.group}
+		if value == nil {
+			record.Deleted = true
+			return record, nil
+		}
+		if err := decode(value, record, nil); err != nil {
+			return nil, err
+		}
+		return record, nil
+	default:
+		return nil, PacketDecodingError{fmt.Sprintf("unknown __consumer_offsets key version %d", k.version)}
+	}
+}
+
+// consumerOffsetsKey is the key of OffsetCommitRecord (versions 0 and 1) and
+// GroupMetadataRecord (version 2).
+type consumerOffsetsKey struct {
+	version   int16
+	group     string
+	topic     string
+	partition int32
+}
+
+func (k *consumerOffsetsKey) decode(pd packetDecoder) (err error) {
+	if k.version, err = pd.getInt16(); err != nil {
+		return err
+	}
+	if k.version < 0 || k.version > 2 {
+		// skip the rest of the key, the caller reports the unknown version
+		_, err = pd.getRawBytes(pd.remaining())
+		return err
+	}
+	if k.group, err = pd.getString(); err != nil {
+		return err
+	}
+	if k.version == 2 {
+		return nil
+	}
+	if k.topic, err = pd.getString(); err != nil {
+		return err
+	}
+	k.partition, err = pd.getInt32()
+	return err
+}
+
+func (r *OffsetCommitRecord) decode(pd packetDecoder) (err error) {
+	if r.Version, err = pd.getInt16(); err != nil {
+		return err
+	}
+	if r.Version < 0 || r.Version > 4 {
+		return PacketDecodingError{fmt.Sprintf("unknown offset commit value version %d", r.Version)}
+	}
+	flexible := r.Version >= 4
+
+	if r.Offset, err = pd.getInt64(); err != nil {
+		return err
+	}
+	r.LeaderEpoch = -1
+	if r.Version >= 3 {
+		if r.LeaderEpoch, err = pd.getInt32(); err != nil {
+			return err
+		}
+	}
+	if flexible {
+		r.Metadata, err = pd.getCompactString()
+	} else {
+		r.Metadata, err = pd.getString()
+	}
+	if err != nil {
+		return err
+	}
+	if r.CommitTimestamp, err = pd.getInt64(); err != nil {
+		return err
+	}
+	r.ExpireTimestamp = -1
+	if r.Version == 1 {
+		if r.ExpireTimestamp, err = pd.getInt64(); err != nil {
+			return err
+		}
+	}
+
+	if flexible {
+		_, err = pd.getTaggedFieldArray()
+	}
+	return err
+}
+
+func (r *GroupMetadataRecord) decode(pd packetDecoder) (err error) {
+	if r.Version, err = pd.getInt16(); err != nil {
+		return err
+	}
+	if r.Version < 0 || r.Version > 4 {
+		return PacketDecodingError{fmt.Sprintf("unknown group metadata value version %d", r.Version)}
+	}
+	flexible := r.Version >= 4
+
+	if flexible {
+		r.ProtocolType, err = pd.getCompactString()
+	} else {
+		r.ProtocolType, err = pd.getString()
+	}
+	if err != nil {
+		return err
+	}
+	if r.Generation, err = pd.getInt32(); err != nil {
+		return err
+	}
+	if r.Protocol, err = getNullableStringFlexible(pd, flexible); err != nil {
+		return err
+	}
+	if r.Leader, err = getNullableStringFlexible(pd, flexible); err != nil {
+		return err
+	}
+	r.CurrentStateTimestamp = -1
+	if r.Version >= 2 {
+		if r.CurrentStateTimestamp, err = pd.getInt64(); err != nil {
+			return err
+		}
+	}
+
+	var n int
+	if flexible {
+		n, err = pd.getCompactArrayLength()
+	} else {
+		n, err = pd.getArrayLength()
+	}
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		r.Members = make([]*GroupMetadataMember, n)
+		for i := range r.Members {
+			r.Members[i] = &GroupMetadataMember{}
+			if err := r.Members[i].decode(pd, r.Version); err != nil {
+				return err
+			}
+		}
+	}
+
+	if flexible {
+		_, err = pd.getTaggedFieldArray()
+	}
+	return err
+}
+
+func (m *GroupMetadataMember) decode(pd packetDecoder, version int16) (err error) {
+	flexible := version >= 4
+	getString, getBytes := pd.getString, pd.getBytes
+	if flexible {
+		getString, getBytes = pd.getCompactString, pd.getCompactBytes
+	}
+
+	if m.MemberID, err = getString(); err != nil {
+		return err
+	}
+	if version >= 3 {
+		if m.GroupInstanceID, err = getNullableStringFlexible(pd, flexible); err != nil {
+			return err
+		}
+	}
+	if m.ClientID, err = getString(); err != nil {
+		return err
+	}
+	if m.ClientHost, err = getString(); err != nil {
+		return err
+	}
+	m.RebalanceTimeout = -1
+	if version >= 1 {
+		if m.RebalanceTimeout, err = pd.getInt32(); err != nil {
+			return err
+		}
+	}
+	if m.SessionTimeout, err = pd.getInt32(); err != nil {
+		return err
+	}
+	if m.Subscription, err = getBytes(); err != nil {
+		return err
+	}
+	if m.Assignment, err = getBytes(); err != nil {
+		return err
+	}
+
+	if flexible {
+		_, err = pd.getTaggedFieldArray()
+	}
+	return err
+}
+
+func getNullableStringFlexible(pd packetDecoder, flexible bool) (*string, error) {
+	if flexible {
+		return pd.getCompactNullableString()
+	}
+	return pd.getNullableString()
+}
@@ -0,0 +1,294 @@
+package sarama
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// The records below are encoded following the key and value schemas of the
+// __consumer_offsets topic of Kafka, for every version.
+var (
+	offsetCommitKeyV0 = []byte{
+		0x00, 0x00, // version
+		0x00, 0x08, 'm', 'y', '-', 'g', 'r', 'o', 'u', 'p',
+		0x00, 0x08, 'm', 'y', '-', 't', 'o', 'p', 'i', 'c',
+		0x00, 0x00, 0x00, 0x03, // partition
+	}
+
+	offsetCommitKeyV1 = []byte{
+		0x00, 0x01, // version
+		0x00, 0x08, 'm', 'y', '-', 'g', 'r', 'o', 'u', 'p',
+		0x00, 0x08, 'm', 'y', '-', 't', 'o', 'p', 'i', 'c',
+		0x00, 0x00, 0x00, 0x03, // partition
+	}
+
+	groupMetadataKeyV2 = []byte{
+		0x00, 0x02, // version
+		0x00, 0x08, 'm', 'y', '-', 'g', 'r', 'o', 'u', 'p',
+	}
+
+	offsetCommitValueV0 = []byte{
+		0x00, 0x00, // version
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2A, // offset
+		0x00, 0x04, 'm', 'e', 't', 'a',
+		0x00, 0x00, 0x01, 0x74, 0x87, 0x6E, 0x80, 0x00, // commit timestamp
+	}
+
+	offsetCommitValueV1 = []byte{
+		0x00, 0x01, // version
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2A, // offset
+		0x00, 0x04, 'm', 'e', 't', 'a',
+		0x00, 0x00, 0x01, 0x74, 0x87, 0x6E, 0x80, 0x00, // commit timestamp
+		0x00, 0x00, 0x01, 0x74, 0x8C, 0x94, 0xDC, 0x00, // expire timestamp
+	}
+
+	offsetCommitValueV2 = []byte{
+		0x00, 0x02, // version
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2A, // offset
+		0x00, 0x04, 'm', 'e', 't', 'a',
+		0x00, 0x00, 0x01, 0x74, 0x87, 0x6E, 0x80, 0x00, // commit timestamp
+	}
+
+	offsetCommitValueV3 = []byte{
+		0x00, 0x03, // version
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2A, // offset
+		0x00, 0x00, 0x00, 0x05, // leader epoch
+		0x00, 0x04, 'm', 'e', 't', 'a',
+		0x00, 0x00, 0x01, 0x74, 0x87, 0x6E, 0x80, 0x00, // commit timestamp
+	}
+
+	offsetCommitValueV4 = []byte{
+		0x00, 0x04, // version
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2A, // offset
+		0x00, 0x00, 0x00, 0x05, // leader epoch
+		0x05, 'm', 'e', 't', 'a',
+		0x00, 0x00, 0x01, 0x74, 0x87, 0x6E, 0x80, 0x00, // commit timestamp
+		0x00, // tagged fields
+	}
+
+	groupMetadataValueV0 = []byte{
+		0x00, 0x00, // version
+		0x00, 0x08, 'c', 'o', 'n', 's', 'u', 'm', 'e', 'r',
+		0x00, 0x00, 0x00, 0x07, // generation
+		0x00, 0x05, 'r', 'a', 'n', 'g', 'e',
+		0x00, 0x08, 'm', 'e', 'm', 'b', 'e', 'r', '-', '1',
+		0x00, 0x00, 0x00, 0x01, // members
+		0x00, 0x08, 'm', 'e', 'm', 'b', 'e', 'r', '-', '1',
+		0x00, 0x08, 'c', 'l', 'i', 'e', 'n', 't', '-', '1',
+		0x00, 0x0A, '/', '1', '2', '7', '.', '0', '.', '0', '.', '1',
+		0x00, 0x00, 0x27, 0x10, // session timeout
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x01, // subscription
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x02, // assignment
+	}
+
+	groupMetadataValueV1 = []byte{
+		0x00, 0x01, // version
+		0x00, 0x08, 'c', 'o', 'n', 's', 'u', 'm', 'e', 'r',
+		0x00, 0x00, 0x00, 0x07, // generation
+		0x00, 0x05, 'r', 'a', 'n', 'g', 'e',
+		0x00, 0x08, 'm', 'e', 'm', 'b', 'e', 'r', '-', '1',
+		0x00, 0x00, 0x00, 0x01, // members
+		0x00, 0x08, 'm', 'e', 'm', 'b', 'e', 'r', '-', '1',
+		0x00, 0x08, 'c', 'l', 'i', 'e', 'n', 't', '-', '1',
+		0x00, 0x0A, '/', '1', '2', '7', '.', '0', '.', '0', '.', '1',
+		0x00, 0x00, 0xEA, 0x60, // rebalance timeout
+		0x00, 0x00, 0x27, 0x10, // session timeout
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x01, // subscription
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x02, // assignment
+	}
+
+	groupMetadataValueV2 = []byte{
+		0x00, 0x02, // version
+		0x00, 0x08, 'c', 'o', 'n', 's', 'u', 'm', 'e', 'r',
+		0x00, 0x00, 0x00, 0x07, // generation
+		0x00, 0x05, 'r', 'a', 'n', 'g', 'e',
+		0x00, 0x08, 'm', 'e', 'm', 'b', 'e', 'r', '-', '1',
+		0x00, 0x00, 0x01, 0x74, 0x87, 0x6E, 0x58, 0xF0, // current state timestamp
+		0x00, 0x00, 0x00, 0x01, // members
+		0x00, 0x08, 'm', 'e', 'm', 'b', 'e', 'r', '-', '1',
+		0x00, 0x08, 'c', 'l', 'i', 'e', 'n', 't', '-', '1',
+		0x00, 0x0A, '/', '1', '2', '7', '.', '0', '.', '0', '.', '1',
+		0x00, 0x00, 0xEA, 0x60, // rebalance timeout
+		0x00, 0x00, 0x27, 0x10, // session timeout
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x01, // subscription
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x02, // assignment
+	}
+
+	groupMetadataValueV3 = []byte{
+		0x00, 0x03, // version
+		0x00, 0x08, 'c', 'o', 'n', 's', 'u', 'm', 'e', 'r',
+		0x00, 0x00, 0x00, 0x07, // generation
+		0x00, 0x05, 'r', 'a', 'n', 'g', 'e',
+		0x00, 0x08, 'm', 'e', 'm', 'b', 'e', 'r', '-', '1',
+		0x00, 0x00, 0x01, 0x74, 0x87, 0x6E, 0x58, 0xF0, // current state timestamp
+		0x00, 0x00, 0x00, 0x01, // members
+		0x00, 0x08, 'm', 'e', 'm', 'b', 'e', 'r', '-', '1',
+		0x00, 0x0A, 'i', 'n', 's', 't', 'a', 'n', 'c', 'e', '-', '1',
+		0x00, 0x08, 'c', 'l', 'i', 'e', 'n', 't', '-', '1',
+		0x00, 0x0A, '/', '1', '2', '7', '.', '0', '.', '0', '.', '1',
+		0x00, 0x00, 0xEA, 0x60, // rebalance timeout
+		0x00, 0x00, 0x27, 0x10, // session timeout
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x01, // subscription
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x02, // assignment
+	}
+
+	groupMetadataValueV4 = []byte{
+		0x00, 0x04, // version
+		0x09, 'c', 'o', 'n', 's', 'u', 'm', 'e', 'r',
+		0x00, 0x00, 0x00, 0x07, // generation
+		0x06, 'r', 'a', 'n', 'g', 'e',
+		0x09, 'm', 'e', 'm', 'b', 'e', 'r', '-', '1',
+		0x00, 0x00, 0x01, 0x74, 0x87, 0x6E, 0x58, 0xF0, // current state timestamp
+		0x02, // members
+		0x09, 'm', 'e', 'm', 'b', 'e', 'r', '-', '1',
+		0x0B, 'i', 'n', 's', 't', 'a', 'n', 'c', 'e', '-', '1',
+		0x09, 'c', 'l', 'i', 'e', 'n', 't', '-', '1',
+		0x0B, '/', '1', '2', '7', '.', '0', '.', '0', '.', '1',
+		0x00, 0x00, 0xEA, 0x60, // rebalance timeout
+		0x00, 0x00, 0x27, 0x10, // session timeout
+		0x03, 0x00, 0x01, // subscription
+		0x03, 0x00, 0x02, // assignment
+		0x00, // member tagged fields
+		0x00, // tagged fields
+	}
+
+	// the group metadata of an Empty group, once all its members left, has
+	// neither a protocol nor a leader
+	emptyGroupMetadataValueV3 = []byte{
+		0x00, 0x03, // version
+		0x00, 0x08, 'c', 'o', 'n', 's', 'u', 'm', 'e', 'r',
+		0x00, 0x00, 0x00, 0x08, // generation
+		0xFF, 0xFF, // protocol
+		0xFF, 0xFF, // leader
+		0x00, 0x00, 0x01, 0x74, 0x87, 0x6E, 0x80, 0x00, // current state timestamp
+		0x00, 0x00, 0x00, 0x00, // members
+	}
+
+	emptyGroupMetadataValueV4 = []byte{
+		0x00, 0x04, // version
+		0x09, 'c', 'o', 'n', 's', 'u', 'm', 'e', 'r',
+		0x00, 0x00, 0x00, 0x08, // generation
+		0x00,                                           // protocol
+		0x00,                                           // leader
+		0x00, 0x00, 0x01, 0x74, 0x87, 0x6E, 0x80, 0x00, // current state timestamp
+		0x01, // members
+		0x00, // tagged fields
+	}
+)
+
+func TestDecodeConsumerOffsetsRecordOffsetCommit(t *testing.T) {
+	offsetCommit := func(keyVersion, version int16, leaderEpoch int32, expireTimestamp int64) *OffsetCommitRecord {
+		return &OffsetCommitRecord{
+			KeyVersion:      keyVersion,
+			Version:         version,
+			Group:           "my-group",
+			Topic:           "my-topic",
+			Partition:       3,
+			Offset:          42,
+			LeaderEpoch:     leaderEpoch,
+			Metadata:        "meta",
+			CommitTimestamp: 1600000000000,
+			ExpireTimestamp: expireTimestamp,
+		}
+	}
+
+	for _, tc := range []struct {
+		name       string
+		key, value []byte
+		expected   *OffsetCommitRecord
+	}{
+		{"key v0 value v0", offsetCommitKeyV0, offsetCommitValueV0, offsetCommit(0, 0, -1, -1)},
+		{"key v1 value v1", offsetCommitKeyV1, offsetCommitValueV1, offsetCommit(1, 1, -1, 1600086400000)},
+		{"key v1 value v2", offsetCommitKeyV1, offsetCommitValueV2, offsetCommit(1, 2, -1, -1)},
+		{"key v1 value v3", offsetCommitKeyV1, offsetCommitValueV3, offsetCommit(1, 3, 5, -1)},
+		{"key v1 value v4", offsetCommitKeyV1, offsetCommitValueV4, offsetCommit(1, 4, 5, -1)},
+		{"tombstone", offsetCommitKeyV1, nil, &OffsetCommitRecord{
+			KeyVersion: 1, Group: "my-group", Topic: "my-topic", Partition: 3, Deleted: true,
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			record, err := DecodeConsumerOffsetsRecord(tc.key, tc.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(record, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, record)
+			}
+		})
+	}
+}
+
+func TestDecodeConsumerOffsetsRecordGroupMetadata(t *testing.T) {
+	protocol, leader, instance := "range", "member-1", "instance-1"
+	groupMetadata := func(version int16, currentStateTimestamp int64, rebalanceTimeout int32, groupInstanceID *string) *GroupMetadataRecord {
+		return &GroupMetadataRecord{
+			KeyVersion:            2,
+			Version:               version,
+			Group:                 "my-group",
+			ProtocolType:          "consumer",
+			Generation:            7,
+			Protocol:              &protocol,
+			Leader:                &leader,
+			CurrentStateTimestamp: currentStateTimestamp,
+			Members: []*GroupMetadataMember{{
+				MemberID:         "member-1",
+				GroupInstanceID:  groupInstanceID,
+				ClientID:         "client-1",
+				ClientHost:       "/127.0.0.1",
+				RebalanceTimeout: rebalanceTimeout,
+				SessionTimeout:   10000,
+				Subscription:     []byte{0x00, 0x01},
+				Assignment:       []byte{0x00, 0x02},
+			}},
+		}
+	}
+	emptyGroupMetadata := func(version int16) *GroupMetadataRecord {
+		return &GroupMetadataRecord{
+			KeyVersion:            2,
+			Version:               version,
+			Group:                 "my-group",
+			ProtocolType:          "consumer",
+			Generation:            8,
+			CurrentStateTimestamp: 1600000000000,
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		value    []byte
+		expected *GroupMetadataRecord
+	}{
+		{"v0", groupMetadataValueV0, groupMetadata(0, -1, -1, nil)},
+		{"v1", groupMetadataValueV1, groupMetadata(1, -1, 60000, nil)},
+		{"v2", groupMetadataValueV2, groupMetadata(2, 1599999990000, 60000, nil)},
+		{"v3", groupMetadataValueV3, groupMetadata(3, 1599999990000, 60000, &instance)},
+		{"v4", groupMetadataValueV4, groupMetadata(4, 1599999990000, 60000, &instance)},
+		{"v3 empty", emptyGroupMetadataValueV3, emptyGroupMetadata(3)},
+		{"v4 empty", emptyGroupMetadataValueV4, emptyGroupMetadata(4)},
+		{"tombstone", nil, &GroupMetadataRecord{KeyVersion: 2, Group: "my-group", Deleted: true}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			record, err := DecodeConsumerOffsetsRecord(groupMetadataKeyV2, tc.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(record, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, record)
+			}
+		})
+	}
+}
+
+func TestDecodeConsumerOffsetsRecordUnknownVersion(t *testing.T) {
+	var target PacketDecodingError
+	if _, err := DecodeConsumerOffsetsRecord([]byte{0x00, 0x03, 0x00, 0x00}, nil); !errors.As(err, &target) {
+		t.Errorf("expected a PacketDecodingError for an unknown key version, got %v", err)
+	}
+	value := append([]byte{0x00, 0x05}, offsetCommitValueV0[2:]...)
+	if _, err := DecodeConsumerOffsetsRecord(offsetCommitKeyV1, value); !errors.As(err, &target) {
+		t.Errorf("expected a PacketDecodingError for an unknown value version, got %v", err)
+	}
+}
@@ -3,14 +3,20 @@ package sarama
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"log"
+	"math"
 	"os"
 	"os/signal"
 	"reflect"
+	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/rcrowley/go-metrics"
 )
 
 var (
@@ -695,6 +701,279 @@ func TestConsumerExtraOffsets(t *testing.T) {
 	}
 }
 
+func TestFairFetchSizes(t *testing.T) {
+	for _, tc := range []struct {
+		sizes    []int32
+		budget   int32
+		expected []int32
+	}{
+		{[]int32{100, 100}, 1000, []int32{100, 100}},
+		{[]int32{800, 100, 100}, 600, []int32{400, 100, 100}},
+		{[]int32{800, 900, 100}, 600, []int32{250, 250, 100}},
+		{[]int32{800, 800}, 1, []int32{1, 1}},
+	} {
+		if actual := fairFetchSizes(tc.sizes, tc.budget); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("expected %v sharing %d to be capped to %v, got %v", tc.sizes, tc.budget, tc.expected, actual)
+		}
+	}
+}
+
+// fairnessFetchResponse emulates a broker serving a hot partition with an
+// endless backlog before cold ones with a few records each, honouring the
+// per-partition and per-request max bytes of the fetch requests.
+type fairnessFetchResponse struct {
+	hot       int32
+	cold      int64
+	valueSize int
+
+	lock    sync.Mutex
+	maxSize map[int32]int32 // the largest fetch size requested per partition
+	overrun bool            // whether a request asked for more than its max bytes
+}
+
+func (f *fairnessFetchResponse) For(reqBody versionedDecoder) encoderWithHeader {
+	request := reqBody.(*FetchRequest)
+	res := &FetchResponse{Version: request.Version}
+	value := ByteEncoder(make([]byte, f.valueSize))
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	partitions := request.blocks["my_topic"]
+	ids := make([]int32, 0, len(partitions))
+	total := int32(0)
+	for id, block := range partitions {
+		ids = append(ids, id)
+		total += block.maxBytes
+		if block.maxBytes > f.maxSize[id] {
+			f.maxSize[id] = block.maxBytes
+		}
+	}
+	if total > request.MaxBytes {
+		f.overrun = true
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	remaining := int(request.MaxBytes)
+	for _, id := range ids {
+		block := partitions[id]
+		end := f.cold
+		if id == f.hot {
+			end = math.MaxInt64
+		}
+		offset := block.fetchOffset
+		for size := 0; size < int(block.maxBytes) && remaining > 0 && offset < end; size += f.valueSize {
+			res.AddRecord("my_topic", id, nil, value, offset)
+			remaining -= f.valueSize
+			offset++
+		}
+		if offset == block.fetchOffset {
+			res.AddError("my_topic", id, ErrNoError)
+		}
+		res.GetBlock("my_topic", id).HighWaterMarkOffset = offset
+	}
+	return res
+}
+
+func TestConsumerFetchResponseMaxSharesFairly(t *testing.T) {
+	fetch := &fairnessFetchResponse{hot: 0, cold: 5, valueSize: 256, maxSize: make(map[int32]int32)}
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+	metadata := NewMockMetadataResponse(t).SetBroker(broker0.Addr(), broker0.BrokerID())
+	offsets := NewMockOffsetResponse(t)
+	for partition := int32(0); partition < 4; partition++ {
+		metadata.SetLeader("my_topic", partition, broker0.BrokerID())
+		offsets.SetOffset("my_topic", partition, OffsetOldest, 0).SetOffset("my_topic", partition, OffsetNewest, 0)
+	}
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": metadata,
+		"OffsetRequest":   offsets,
+		"FetchRequest":    fetch,
+	})
+
+	cfg := NewTestConfig()
+	cfg.Version = V0_11_0_0
+	cfg.Consumer.Fetch.Default = 1024
+	cfg.Consumer.Fetch.ResponseMax = 16 * 1024
+	master, err := NewConsumer([]string{broker0.Addr()}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, master)
+
+	consumers := make([]PartitionConsumer, 4)
+	for partition := range consumers {
+		if consumers[partition], err = master.ConsumePartition("my_topic", int32(partition), OffsetOldest); err != nil {
+			t.Fatal(err)
+		}
+		defer safeClose(t, consumers[partition])
+	}
+
+	// the hot partition keeps on being served...
+	for i := 0; i < 200; i++ {
+		select {
+		case <-consumers[0].Messages():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the hot partition after %d messages", i)
+		}
+	}
+	// ...while the cold ones still make progress
+	for partition := 1; partition < 4; partition++ {
+		for i := 0; i < 4; i++ {
+			select {
+			case msg := <-consumers[partition].Messages():
+				assertMessageOffset(t, msg, int64(i))
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for cold partition %d", partition)
+			}
+		}
+	}
+
+	fetch.lock.Lock()
+	defer fetch.lock.Unlock()
+	if fetch.overrun {
+		t.Error("expected the partition fetch sizes to add up to at most Consumer.Fetch.ResponseMax")
+	}
+	if fetch.maxSize[0] <= cfg.Consumer.Fetch.Default {
+		t.Errorf("expected the fetch size of the hot partition to grow beyond %d, got %d", cfg.Consumer.Fetch.Default, fetch.maxSize[0])
+	}
+}
+
+// batchFetchResponse emulates a v3+ broker serving partitions with records of
+// a given size, leaving out the records that do not fit in the max bytes of
+// their partition, except for the first one of the response.
+type batchFetchResponse struct {
+	valueSizes map[int32]int
+	ends       map[int32]int64
+}
+
+func (f *batchFetchResponse) For(reqBody versionedDecoder) encoderWithHeader {
+	request := reqBody.(*FetchRequest)
+	res := &FetchResponse{Version: request.Version}
+
+	partitions := request.blocks["my_topic"]
+	ids := make([]int32, 0, len(partitions))
+	for id := range partitions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	remaining := int(request.MaxBytes)
+	first := true
+	for _, id := range ids {
+		block := partitions[id]
+		recordSize := f.valueSizes[id] + 100 // with the batch overhead
+		value := ByteEncoder(make([]byte, f.valueSizes[id]))
+		offset := block.fetchOffset
+		for size := recordSize; offset < f.ends[id]; size += recordSize {
+			if !first && (size > int(block.maxBytes) || size > remaining) {
+				break
+			}
+			first = false
+			res.AddRecord("my_topic", id, nil, value, offset)
+			remaining -= recordSize
+			offset++
+		}
+		if offset == block.fetchOffset {
+			res.AddError("my_topic", id, ErrNoError)
+		}
+		res.GetBlock("my_topic", id).HighWaterMarkOffset = f.ends[id]
+	}
+	return res
+}
+
+func TestConsumerFetchResponseMaxShareBelowBatch(t *testing.T) {
+	// the share of the second partition is smaller than its records
+	fetch := &batchFetchResponse{
+		valueSizes: map[int32]int{0: 100, 1: 3000},
+		ends:       map[int32]int64{0: math.MaxInt64, 1: 1},
+	}
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()).
+			SetLeader("my_topic", 1, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my_topic", 0, OffsetOldest, 0).
+			SetOffset("my_topic", 0, OffsetNewest, 0).
+			SetOffset("my_topic", 1, OffsetOldest, 0).
+			SetOffset("my_topic", 1, OffsetNewest, 1),
+		"FetchRequest": fetch,
+	})
+
+	cfg := NewTestConfig()
+	cfg.Version = V0_11_0_0
+	cfg.Consumer.Fetch.Default = 4096
+	cfg.Consumer.Fetch.ResponseMax = 4096
+	master, err := NewConsumer([]string{broker0.Addr()}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, master)
+
+	hot, err := master.ConsumePartition("my_topic", 0, OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, hot)
+	cold, err := master.ConsumePartition("my_topic", 1, OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, cold)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-hot.Messages():
+			continue
+		case msg := <-cold.Messages():
+			assertMessageOffset(t, msg, 0)
+		case <-timeout:
+			t.Fatal("timed out waiting for the partition whose share is smaller than its record")
+		}
+		break
+	}
+}
+
+func Test_partitionConsumer_parseResponsePartialShare(t *testing.T) {
+	conf := NewTestConfig()
+	conf.Consumer.Return.Errors = true
+	conf.Consumer.Fetch.Max = 4096
+	conf.Consumer.Fetch.ResponseMax = 3000
+	child := &partitionConsumer{
+		broker:        &brokerConsumer{broker: &Broker{}},
+		conf:          conf,
+		errors:        make(chan *ConsumerError, 1),
+		topic:         "my_topic",
+		fetchSize:     4096,
+		requestedSize: 1500,
+		offset:        5,
+	}
+	response := &FetchResponse{
+		Blocks: map[string]map[int32]*FetchResponseBlock{"my_topic": {0: {Partial: true, HighWaterMarkOffset: 10}}},
+	}
+
+	// the share of the partition was smaller than its next record
+	if _, err := child.parseResponse(response); err != nil {
+		t.Fatal(err)
+	}
+	if len(child.errors) != 0 || child.offset != 5 || !child.starving {
+		t.Fatalf("expected the record to be fetched again with the full fetch size, got offset %d", child.offset)
+	}
+
+	// the full Fetch.Max was requested
+	child.requestedSize = 4096
+	if _, err := child.parseResponse(response); err != nil {
+		t.Fatal(err)
+	}
+	if len(child.errors) != 1 || child.offset != 6 {
+		t.Errorf("expected the record to be skipped as too large, got offset %d", child.offset)
+	}
+}
+
 // In some situations broker may return a block containing only
 // messages older then requested, even though there would be
 // more messages if higher offset was requested.
@@ -787,6 +1066,138 @@ func TestConsumeMessageWithNewerFetchAPIVersion(t *testing.T) {
 	broker0.Close()
 }
 
+// rawResponse is a response sent as encoded, e.g. corrupted on purpose.
+type rawResponse []byte
+
+func (r rawResponse) encode(pe packetEncoder) error { return pe.putRawBytes(r) }
+func (r rawResponse) headerVersion() int16          { return 0 }
+
+func TestConsumerSkipCorruptBatches(t *testing.T) {
+	// Given
+	fetchResponse1 := &FetchResponse{Version: 5}
+	fetchResponse1.AddRecordBatch("my_topic", 0, nil, testMsg, 1, 0, false)
+	fetchResponse1.AddRecordBatch("my_topic", 0, nil, StringEncoder("corrupted"), 2, 0, false)
+	fetchResponse1.Blocks["my_topic"][0].HighWaterMarkOffset = 4
+	raw, err := encode(fetchResponse1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip a byte of the value of the second batch so that its CRC fails
+	raw[bytes.Index(raw, []byte("corrupted"))] ^= 0xff
+	if err := versionedDecode(raw, new(FetchResponse), 5, nil); err == nil {
+		t.Fatal("expected the corrupt batch to fail the decoding of the response")
+	}
+
+	fetchResponse2 := &FetchResponse{Version: 5}
+	fetchResponse2.AddRecordBatch("my_topic", 0, nil, testMsg, 3, 0, false)
+	fetchResponse3 := &FetchResponse{Version: 5}
+	fetchResponse3.AddError("my_topic", 0, ErrNoError)
+
+	cfg := NewTestConfig()
+	cfg.Version = V0_11_0_0
+	cfg.Consumer.SkipCorruptBatches = true
+
+	broker0 := NewMockBroker(t, 0)
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my_topic", 0, OffsetNewest, 4).
+			SetOffset("my_topic", 0, OffsetOldest, 0),
+		"FetchRequest": NewMockSequence(rawResponse(raw), fetchResponse2, fetchResponse3),
+	})
+
+	master, err := NewConsumer([]string{broker0.Addr()}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// When
+	consumer, err := master.ConsumePartition("my_topic", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then: the corrupt batch is skipped and the consumer goes on after it
+	assertMessageOffset(t, <-consumer.Messages(), 1)
+	assertMessageOffset(t, <-consumer.Messages(), 3)
+
+	var offsets []int64
+	for _, rr := range broker0.History() {
+		if req, ok := rr.Request.(*FetchRequest); ok {
+			offsets = append(offsets, req.blocks["my_topic"][0].fetchOffset)
+		}
+	}
+	if len(offsets) < 2 || offsets[0] != 1 || offsets[1] != 3 {
+		t.Errorf("expected the second fetch to resume at offset 3, got the offsets %v", offsets)
+	}
+	if skipped := cfg.MetricRegistry.Get("consumer-skipped-corrupt-batches"); skipped == nil || skipped.(metrics.Counter).Count() != 1 {
+		t.Errorf("expected one corrupt batch to be counted, got %v", skipped)
+	}
+
+	safeClose(t, consumer)
+	safeClose(t, master)
+	broker0.Close()
+}
+
+func TestConsumerSkipCRCValidation(t *testing.T) {
+	// Given
+	fetchResponse1 := &FetchResponse{Version: 5}
+	fetchResponse1.AddRecordBatch("my_topic", 0, nil, StringEncoder("corrupted"), 1, 0, false)
+	raw, err := encode(fetchResponse1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[bytes.Index(raw, []byte("corrupted"))] = 'C'
+
+	fetchResponse2 := &FetchResponse{Version: 5}
+	fetchResponse2.AddError("my_topic", 0, ErrNoError)
+
+	cfg := NewTestConfig()
+	cfg.Version = V0_11_0_0
+	cfg.Consumer.SkipCRCValidation = true
+
+	broker0 := NewMockBroker(t, 0)
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my_topic", 0, OffsetNewest, 2).
+			SetOffset("my_topic", 0, OffsetOldest, 0),
+		"FetchRequest": NewMockSequence(rawResponse(raw), fetchResponse2),
+	})
+
+	master, err := NewConsumer([]string{broker0.Addr()}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// When
+	consumer, err := master.ConsumePartition("my_topic", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then: the corruption goes unnoticed
+	select {
+	case msg := <-consumer.Messages():
+		assertMessageOffset(t, msg, 1)
+		if string(msg.Value) != "Corrupted" {
+			t.Errorf("expected the corrupted value to be delivered, got %q", msg.Value)
+		}
+	case err := <-consumer.Errors():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the corrupted record to be delivered")
+	}
+
+	safeClose(t, consumer)
+	safeClose(t, master)
+	broker0.Close()
+}
+
 func TestConsumeMessageWithSessionIDs(t *testing.T) {
 	// Given
 	fetchResponse1 := &FetchResponse{Version: 7}
@@ -1275,6 +1686,99 @@ func TestConsumerNonSequentialOffsets(t *testing.T) {
 	}
 }
 
+// ConsumePartitionRange delivers exactly the messages of the range, skipping
+// compacted offsets, and closes the Messages channel once the range is done.
+func TestConsumerPartitionRange(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		start, end int64
+		expected   []int64
+	}{
+		{"exact", 3, 6, []int64{3, 4, 5}},
+		{"compacted end", 2, 8, []int64{2, 3, 4, 5}},
+		{"beyond log", 4, 100, []int64{4, 5, 8, 9}},
+		{"empty", 5, 5, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given: offsets 6 and 7 were compacted away
+			fetchResponse := NewMockFetchResponse(t, 10)
+			for _, offset := range []int64{2, 3, 4, 5, 8, 9} {
+				fetchResponse.SetMessage("my_topic", 0, offset, testMsg)
+			}
+			fetchResponse.SetHighWaterMark("my_topic", 0, 10)
+
+			cfg := NewTestConfig()
+			broker0 := NewMockBroker(t, 0)
+			defer broker0.Close()
+			broker0.SetHandlerByMap(map[string]MockResponse{
+				"MetadataRequest": NewMockMetadataResponse(t).
+					SetBroker(broker0.Addr(), broker0.BrokerID()).
+					SetLeader("my_topic", 0, broker0.BrokerID()),
+				"OffsetRequest": NewMockOffsetResponse(t).
+					SetOffset("my_topic", 0, OffsetNewest, 10).
+					SetOffset("my_topic", 0, OffsetOldest, 2),
+				"FetchRequest": fetchResponse,
+			})
+
+			master, err := NewConsumer([]string{broker0.Addr()}, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer safeClose(t, master)
+
+			// When
+			consumer, err := master.ConsumePartitionRange("my_topic", 0, tc.start, tc.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			var offsets []int64
+			timeout := time.After(5 * time.Second)
+		consumeLoop:
+			for {
+				select {
+				case msg, ok := <-consumer.Messages():
+					if !ok {
+						break consumeLoop
+					}
+					offsets = append(offsets, msg.Offset)
+				case <-timeout:
+					t.Fatalf("timeout waiting for the Messages channel to close, got offsets %v", offsets)
+				}
+			}
+			if !reflect.DeepEqual(offsets, tc.expected) {
+				t.Errorf("expected offsets %v, got %v", tc.expected, offsets)
+			}
+			safeClose(t, consumer)
+		})
+	}
+}
+
+func TestConsumerPartitionRangeInvalid(t *testing.T) {
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+	})
+
+	master, err := NewConsumer([]string{broker0.Addr()}, NewTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, master)
+
+	var target ConfigurationError
+	if _, err := master.ConsumePartitionRange("my_topic", 0, 5, 4); !errors.As(err, &target) {
+		t.Errorf("expected a ConfigurationError for end < start, got %v", err)
+	}
+	if _, err := master.ConsumePartitionRange("my_topic", 0, OffsetNewest, 4); !errors.As(err, &target) {
+		t.Errorf("expected a ConfigurationError for an OffsetNewest start, got %v", err)
+	}
+}
+
 // If leadership for a partition is changing then consumer resolves the new
 // leader and switches to it.
 func TestConsumerRebalancingMultiplePartitions(t *testing.T) {
@@ -1659,6 +2163,71 @@ func TestConsumerOffsetOutOfRange(t *testing.T) {
 	broker0.Close()
 }
 
+// If the leader epoch is fenced, e.g. after an unclean leader election, the
+// consumer validates its position against the log of the new leader and
+// resumes from the end offset of the epoch of the last consumed record.
+func TestConsumerTruncatesPositionAfterFencedEpoch(t *testing.T) {
+	// Given
+	fetchResponse1 := &FetchResponse{Version: 10}
+	for offset := int64(0); offset < 5; offset++ {
+		fetchResponse1.AddRecord("my_topic", 0, nil, testMsg, offset)
+	}
+	fetchResponse1.SetLastOffsetDelta("my_topic", 0, 4)
+	fetchResponse1.Blocks["my_topic"][0].RecordsSet[0].RecordBatch.PartitionLeaderEpoch = 4
+	fetchResponse2 := &FetchResponse{Version: 10}
+	fetchResponse2.AddError("my_topic", 0, ErrFencedLeaderEpoch)
+	fetchResponse3 := &FetchResponse{Version: 10}
+	fetchResponse3.AddRecord("my_topic", 0, nil, testMsg, 3)
+	fetchResponse3.Blocks["my_topic"][0].RecordsSet[0].RecordBatch.PartitionLeaderEpoch = 5
+	fetchResponse4 := &FetchResponse{Version: 10}
+	fetchResponse4.AddError("my_topic", 0, ErrNoError)
+
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my_topic", 0, OffsetNewest, 5).
+			SetOffset("my_topic", 0, OffsetOldest, 0),
+		"FetchRequest": NewMockSequence(fetchResponse1, fetchResponse2, fetchResponse3, fetchResponse4),
+		// offsets 3 and 4 of epoch 4 were lost
+		"OffsetForLeaderEpochRequest": NewMockOffsetForLeaderEpochResponse(t).
+			SetEndOffset("my_topic", 0, 4, 3, 4),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_1_0_0
+	config.Consumer.Return.Errors = true
+	config.Consumer.Retry.Backoff = 10 * time.Millisecond
+	master, err := NewConsumer([]string{broker0.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, master)
+
+	// When
+	consumer, err := master.ConsumePartition("my_topic", 0, OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, consumer)
+
+	// Then: offset 3 is consumed again, from the log of the new leader
+	for _, expected := range []int64{0, 1, 2, 3, 4, 3} {
+		select {
+		case msg := <-consumer.Messages():
+			assertMessageOffset(t, msg, expected)
+		case err := <-consumer.Errors():
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for offset %d", expected)
+		}
+	}
+}
+
 func TestConsumerExpiryTicker(t *testing.T) {
 	// Given
 	broker0 := NewMockBroker(t, 0)
@@ -1713,35 +2282,36 @@ func TestConsumerTimestamps(t *testing.T) {
 		logAppendTime     bool
 		messages          []testMessage
 		expectedTimestamp []time.Time
+		expectedType      TimestampType
 	}{
 		{MinVersion, false, []testMessage{
 			{testMsg, 1, now},
 			{testMsg, 2, now},
-		}, []time.Time{{}, {}}},
+		}, []time.Time{{}, {}}, TimestampTypeNone},
 		{V0_9_0_0, false, []testMessage{
 			{testMsg, 1, now},
 			{testMsg, 2, now},
-		}, []time.Time{{}, {}}},
+		}, []time.Time{{}, {}}, TimestampTypeNone},
 		{V0_10_0_0, false, []testMessage{
 			{testMsg, 1, now},
 			{testMsg, 2, now},
-		}, []time.Time{{}, {}}},
+		}, []time.Time{{}, {}}, TimestampTypeNone},
 		{V0_10_2_1, false, []testMessage{
 			{testMsg, 1, now.Add(time.Second)},
 			{testMsg, 2, now.Add(2 * time.Second)},
-		}, []time.Time{now.Add(time.Second), now.Add(2 * time.Second)}},
+		}, []time.Time{now.Add(time.Second), now.Add(2 * time.Second)}, TimestampTypeCreateTime},
 		{V0_10_2_1, true, []testMessage{
 			{testMsg, 1, now.Add(time.Second)},
 			{testMsg, 2, now.Add(2 * time.Second)},
-		}, []time.Time{now, now}},
+		}, []time.Time{now, now}, TimestampTypeLogAppendTime},
 		{V0_11_0_0, false, []testMessage{
 			{testMsg, 1, now.Add(time.Second)},
 			{testMsg, 2, now.Add(2 * time.Second)},
-		}, []time.Time{now.Add(time.Second), now.Add(2 * time.Second)}},
+		}, []time.Time{now.Add(time.Second), now.Add(2 * time.Second)}, TimestampTypeCreateTime},
 		{V0_11_0_0, true, []testMessage{
 			{testMsg, 1, now.Add(time.Second)},
 			{testMsg, 2, now.Add(2 * time.Second)},
-		}, []time.Time{now, now}},
+		}, []time.Time{now, now}, TimestampTypeLogAppendTime},
 	} {
 		var fr *FetchResponse
 		cfg := NewTestConfig()
@@ -1802,6 +2372,10 @@ func TestConsumerTimestamps(t *testing.T) {
 					t.Errorf("Wrong timestamp (kversion:%v, logAppendTime:%v): got: %v, want: %v",
 						d.kversion, d.logAppendTime, msg.Timestamp, ts)
 				}
+				if msg.TimestampType != d.expectedType {
+					t.Errorf("Wrong timestamp type (kversion:%v, logAppendTime:%v): got: %v, want: %v",
+						d.kversion, d.logAppendTime, msg.TimestampType, d.expectedType)
+				}
 			case err := <-consumer.Errors():
 				t.Fatal(err)
 			}
@@ -1875,6 +2449,65 @@ func TestExcludeUncommitted(t *testing.T) {
 	broker0.Close()
 }
 
+// With IncludeControlRecords, the transaction markers are delivered
+func TestConsumerIncludeControlRecords(t *testing.T) {
+	broker0 := NewMockBroker(t, 0)
+
+	fetchResponse := &FetchResponse{Version: 5}
+	fetchResponse.AddRecordBatch("my_topic", 0, nil, testMsg, 1234, 7, true)
+	fetchResponse.AddControlRecord("my_topic", 0, 1235, 7, ControlRecordCommit)
+	fetchResponse.AddRecordBatch("my_topic", 0, nil, testMsg, 1236, 7, false)
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my_topic", 0, OffsetOldest, 0).
+			SetOffset("my_topic", 0, OffsetNewest, 1237),
+		"FetchRequest": NewMockWrapper(fetchResponse),
+	})
+
+	cfg := NewTestConfig()
+	cfg.Consumer.Return.Errors = true
+	cfg.Version = V0_11_0_0
+	cfg.Consumer.IncludeControlRecords = true
+
+	master, err := NewConsumer([]string{broker0.Addr()}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, err := master.ConsumePartition("my_topic", 0, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, offset := range []int64{1234, 1235, 1236} {
+		select {
+		case msg := <-consumer.Messages():
+			assertMessageOffset(t, msg, offset)
+			if i != 1 {
+				if msg.Control != nil {
+					t.Errorf("expected no control record at offset %d", offset)
+				}
+				continue
+			}
+			if msg.Control == nil || msg.Control.Type != ControlRecordCommit {
+				t.Fatalf("expected the commit marker at offset %d, got %+v", offset, msg.Control)
+			}
+			if msg.ProducerID != 7 {
+				t.Errorf("expected the producer ID 7, got %d", msg.ProducerID)
+			}
+		case err := <-consumer.Errors():
+			t.Fatal(err)
+		}
+	}
+
+	safeClose(t, consumer)
+	safeClose(t, master)
+	broker0.Close()
+}
+
 func assertMessageKey(t *testing.T, msg *ConsumerMessage, expectedKey Encoder) {
 	t.Helper()
 
@@ -2143,3 +2776,264 @@ func TestConsumerError(t *testing.T) {
 		t.Error("unexpected errors.Is")
 	}
 }
+
+func TestConsumerLag(t *testing.T) {
+	// Given
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	mockFetchResponse := NewMockFetchResponse(t, 1)
+	for i := int64(0); i < 10; i++ {
+		mockFetchResponse.SetMessage("my_topic", 0, i, testMsg)
+	}
+	mockFetchResponse.SetHighWaterMark("my_topic", 0, 10)
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my_topic", 0, OffsetOldest, 0).
+			SetOffset("my_topic", 0, OffsetNewest, 10),
+		"FetchRequest": mockFetchResponse,
+	})
+
+	master, err := NewConsumer([]string{broker0.Addr()}, NewTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, master)
+
+	// When
+	consumer, err := master.ConsumePartition("my_topic", 0, OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, consumer)
+
+	// Then
+	if lag := consumer.Lag(); lag != 10 {
+		t.Errorf("Expected lag of 10 before consuming, found %d", lag)
+	}
+
+	// the delivered offset is recorded right after a message is handed over
+	// to the messages channel, so allow the feeder to catch up
+	waitForLag := func(expected int64) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for consumer.Lag() != expected && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if lag := consumer.Lag(); lag != expected {
+			t.Errorf("Expected lag of %d, found %d", expected, lag)
+		}
+	}
+
+	for i := int64(0); i < 5; i++ {
+		assertMessageOffset(t, <-consumer.Messages(), i)
+	}
+	waitForLag(5)
+
+	for i := int64(5); i < 10; i++ {
+		assertMessageOffset(t, <-consumer.Messages(), i)
+	}
+	waitForLag(0)
+}
+
+func TestConsumerPrefetch(t *testing.T) {
+	// Given
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	mockFetchResponse := NewMockFetchResponse(t, 3)
+	for i := int64(0); i < 20; i++ {
+		mockFetchResponse.SetMessage("my_topic", 0, i, testMsg)
+	}
+	mockFetchResponse.SetHighWaterMark("my_topic", 0, 20)
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my_topic", 0, OffsetOldest, 0).
+			SetOffset("my_topic", 0, OffsetNewest, 20),
+		"FetchRequest": mockFetchResponse,
+	})
+
+	config := NewTestConfig()
+	config.ChannelBufferSize = 1
+	config.Consumer.Fetch.PrefetchCount = 2
+	master, err := NewConsumer([]string{broker0.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, master)
+
+	// When
+	consumer, err := master.ConsumePartition("my_topic", 0, OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then: offsets stay consistent across pipelined fetches
+	for i := int64(0); i < 20; i++ {
+		select {
+		case message := <-consumer.Messages():
+			assertMessageOffset(t, message, i)
+		case err := <-consumer.Errors():
+			t.Fatal(err)
+		}
+	}
+
+	safeClose(t, consumer)
+}
+
+// BenchmarkConsumerPrefetch consumes from a broker with a high latency while
+// spending some time processing each message, which is where fetching ahead of
+// processing pays off.
+func BenchmarkConsumerPrefetch(b *testing.B) {
+	for _, prefetch := range []int{0, 4} {
+		b.Run(fmt.Sprintf("prefetch=%d", prefetch), func(b *testing.B) {
+			benchmarkConsumerPrefetch(b, prefetch)
+		})
+	}
+}
+
+func benchmarkConsumerPrefetch(b *testing.B, prefetch int) {
+	const batchSize = 50
+
+	broker0 := NewMockBroker(b, 0)
+	defer broker0.Close()
+	broker0.SetLatency(5 * time.Millisecond)
+
+	mockFetchResponse := NewMockFetchResponse(b, batchSize)
+	for i := 0; i < b.N; i++ {
+		mockFetchResponse.SetMessage("my_topic", 0, int64(i), testMsg)
+	}
+	mockFetchResponse.SetHighWaterMark("my_topic", 0, int64(b.N))
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(b).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(b).
+			SetOffset("my_topic", 0, OffsetOldest, 0).
+			SetOffset("my_topic", 0, OffsetNewest, int64(b.N)),
+		"FetchRequest": mockFetchResponse,
+	})
+
+	config := NewTestConfig()
+	config.ChannelBufferSize = 1
+	config.Consumer.MaxProcessingTime = time.Second
+	config.Consumer.Fetch.PrefetchCount = prefetch
+	master, err := NewConsumer([]string{broker0.Addr()}, config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer safeClose(b, master)
+
+	consumer, err := master.ConsumePartition("my_topic", 0, OffsetOldest)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer safeClose(b, consumer)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		<-consumer.Messages()
+		// simulate processing in chunks as time.Sleep is too coarse for a
+		// single message
+		if i%10 == 9 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// BenchmarkConsumerCRCValidation contrasts decoding fetched record batches
+// with and without Consumer.SkipCRCValidation.
+func BenchmarkConsumerCRCValidation(b *testing.B) {
+	const batches, records = 10, 100
+	fetchResponse := &FetchResponse{Version: 4}
+	value := ByteEncoder(make([]byte, 1024))
+	for i := 0; i < batches; i++ {
+		fetchResponse.AddRecordBatch("my_topic", 0, nil, value, int64(i*records), 0, false)
+		batch := fetchResponse.Blocks["my_topic"][0].RecordsSet[i].RecordBatch
+		for j := 1; j < records; j++ {
+			batch.addRecord(&Record{OffsetDelta: int64(j), Value: value})
+		}
+		batch.LastOffsetDelta = records - 1
+	}
+	raw, err := encode(fetchResponse, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprintf("SkipCRCValidation=%t", skip), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(raw)))
+			for i := 0; i < b.N; i++ {
+				response := &FetchResponse{skipCRCValidation: skip}
+				if err := versionedDecode(raw, response, 4, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkConsumerMessageValue contrasts handing out message values that
+// reference the fetch response buffer with copying each value out of it.
+func BenchmarkConsumerMessageValue(b *testing.B) {
+	for _, size := range []int{100, 10 * 1024} {
+		b.Run(fmt.Sprintf("zero-copy/%d", size), func(b *testing.B) {
+			benchmarkConsumerMessageValue(b, size, false)
+		})
+		b.Run(fmt.Sprintf("copy/%d", size), func(b *testing.B) {
+			benchmarkConsumerMessageValue(b, size, true)
+		})
+	}
+}
+
+func benchmarkConsumerMessageValue(b *testing.B, size int, copyValue bool) {
+	const records = 100
+	fetchResponse := &FetchResponse{Version: 4}
+	value := ByteEncoder(make([]byte, size))
+	for i := 0; i < records; i++ {
+		fetchResponse.AddRecord("my_topic", 0, nil, value, int64(i))
+	}
+	raw, err := encode(fetchResponse, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	child := &partitionConsumer{
+		broker:    &brokerConsumer{broker: &Broker{}},
+		conf:      NewTestConfig(),
+		topic:     "my_topic",
+		partition: 0,
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(records * size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		response := new(FetchResponse)
+		if err := versionedDecode(raw, response, 4, nil); err != nil {
+			b.Fatal(err)
+		}
+		child.offset = 0
+		msgs, err := child.parseResponse(response)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(msgs) != records {
+			b.Fatalf("expected %d messages, got %d", records, len(msgs))
+		}
+		if copyValue {
+			for _, msg := range msgs {
+				msg.Value = append([]byte(nil), msg.Value...)
+			}
+		}
+	}
+}
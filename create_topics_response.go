@@ -50,6 +50,9 @@ func (c *CreateTopicsResponse) decode(pd packetDecoder, version int16) (err erro
 	if err != nil {
 		return err
 	}
+	if n < 0 {
+		return errInvalidArrayLength
+	}
 
 	c.TopicErrors = make(map[string]*TopicError, n)
 	for i := 0; i < n; i++ {
@@ -19,6 +19,12 @@ var (
 
 	gzipReaderPool sync.Pool
 
+	bytesReaderPool = sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Reader)
+		},
+	}
+
 	bufferPool = sync.Pool{
 		New: func() interface{} {
 			return new(bytes.Buffer)
@@ -33,17 +39,23 @@ var (
 	}
 )
 
+// decompress returns the decompressed data in a newly allocated slice of the exact
+// length. The scratch space used while decompressing is pooled and reused across
+// batches, so the returned slice (and the records decoded from it) never alias it.
 func decompress(cc CompressionCodec, data []byte) ([]byte, error) {
 	switch cc {
 	case CompressionNone:
 		return data, nil
 	case CompressionGZIP:
 		var err error
+		source := getBytesReader(data)
+		defer putBytesReader(source)
+
 		reader, ok := gzipReaderPool.Get().(*gzip.Reader)
 		if !ok {
-			reader, err = gzip.NewReader(bytes.NewReader(data))
+			reader, err = gzip.NewReader(source)
 		} else {
-			err = reader.Reset(bytes.NewReader(data))
+			err = reader.Reset(source)
 		}
 
 		if err != nil {
@@ -52,47 +64,64 @@ func decompress(cc CompressionCodec, data []byte) ([]byte, error) {
 
 		buffer := bufferPool.Get().(*bytes.Buffer)
 		_, err = buffer.ReadFrom(reader)
-		// copy the buffer to a new slice with the correct length
 		// reuse gzipReader and buffer
 		gzipReaderPool.Put(reader)
-		res := make([]byte, buffer.Len())
-		copy(res, buffer.Bytes())
-		buffer.Reset()
-		bufferPool.Put(buffer)
 
-		return res, err
+		return pooledBufferBytes(buffer), err
 	case CompressionSnappy:
+		// the decoded length is known upfront so this already allocates exactly once
 		return snappy.Decode(data)
 	case CompressionLZ4:
-		reader, ok := lz4ReaderPool.Get().(*lz4.Reader)
-		if !ok {
-			reader = lz4.NewReader(bytes.NewReader(data))
-		} else {
-			reader.Reset(bytes.NewReader(data))
-		}
+		source := getBytesReader(data)
+		defer putBytesReader(source)
+
+		reader := lz4ReaderPool.Get().(*lz4.Reader)
+		reader.Reset(source)
+
 		buffer := bufferPool.Get().(*bytes.Buffer)
 		_, err := buffer.ReadFrom(reader)
-		// copy the buffer to a new slice with the correct length
 		// reuse lz4Reader and buffer
 		lz4ReaderPool.Put(reader)
-		res := make([]byte, buffer.Len())
-		copy(res, buffer.Bytes())
-		buffer.Reset()
-		bufferPool.Put(buffer)
 
-		return res, err
+		return pooledBufferBytes(buffer), err
 	case CompressionZSTD:
-		buffer := *bytesPool.Get().(*[]byte)
-		var err error
-		buffer, err = zstdDecompress(ZstdDecoderParams{}, buffer, data)
+		bufferPtr := bytesPool.Get().(*[]byte)
+		buffer, err := zstdDecompress(ZstdDecoderParams{}, *bufferPtr, data)
 		// copy the buffer to a new slice with the correct length and reuse buffer
 		res := make([]byte, len(buffer))
 		copy(res, buffer)
-		buffer = buffer[:0]
-		bytesPool.Put(&buffer)
+		*bufferPtr = buffer[:0]
+		bytesPool.Put(bufferPtr)
 
 		return res, err
 	default:
 		return nil, PacketDecodingError{fmt.Sprintf("invalid compression specified (%d)", cc)}
 	}
 }
+
+func getBytesReader(data []byte) *bytes.Reader {
+	source := bytesReaderPool.Get().(*bytes.Reader)
+	source.Reset(data)
+	return source
+}
+
+func putBytesReader(source *bytes.Reader) {
+	// do not hold on to the data while pooled
+	source.Reset(nil)
+	bytesReaderPool.Put(source)
+}
+
+// pooledBufferBytes copies the content of the pooled buffer into a slice of the
+// correct length and returns the buffer to the pool.
+func pooledBufferBytes(buffer *bytes.Buffer) []byte {
+	res := make([]byte, buffer.Len())
+	copy(res, buffer.Bytes())
+	putBuffer(buffer)
+	return res
+}
+
+// putBuffer empties the pooled buffer and returns it to the pool.
+func putBuffer(buffer *bytes.Buffer) {
+	buffer.Reset()
+	bufferPool.Put(buffer)
+}
@@ -76,6 +76,9 @@ func (r *DeleteOffsetsResponse) decode(pd packetDecoder, version int16) error {
 		if err != nil {
 			return err
 		}
+		if numErrors < 0 {
+			return errInvalidArrayLength
+		}
 
 		r.Errors[name] = make(map[int32]KError, numErrors)
 
@@ -40,6 +40,9 @@ func (r *DescribeLogDirsResponse) decode(pd packetDecoder, version int16) error
 	if err != nil {
 		return err
 	}
+	if n < 0 {
+		return errInvalidArrayLength
+	}
 
 	r.LogDirs = make([]DescribeLogDirsResponseDirMetadata, n)
 	for i := 0; i < n; i++ {
@@ -125,6 +128,9 @@ func (r *DescribeLogDirsResponseDirMetadata) decode(pd packetDecoder, version in
 	if err != nil {
 		return err
 	}
+	if n < 0 {
+		return errInvalidArrayLength
+	}
 
 	r.Topics = make([]DescribeLogDirsResponseTopic, n)
 	for i := 0; i < n; i++ {
@@ -174,6 +180,9 @@ func (r *DescribeLogDirsResponseTopic) decode(pd packetDecoder, version int16) e
 	if err != nil {
 		return err
 	}
+	if n < 0 {
+		return errInvalidArrayLength
+	}
 	r.Partitions = make([]DescribeLogDirsResponsePartition, n)
 	for i := 0; i < n; i++ {
 		p := DescribeLogDirsResponsePartition{}
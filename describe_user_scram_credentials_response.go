@@ -30,7 +30,8 @@ type DescribeUserScramCredentialsResponse struct {
 	ErrorCode    KError
 	ErrorMessage *string
 
-	Results []*DescribeUserScramCredentialsResult
+	Results             []*DescribeUserScramCredentialsResult
+	unknownTaggedFields taggedFields
 }
 
 type DescribeUserScramCredentialsResult struct {
@@ -75,7 +76,9 @@ func (r *DescribeUserScramCredentialsResponse) encode(pe packetEncoder) error {
 		pe.putEmptyTaggedFieldArray()
 	}
 
-	pe.putEmptyTaggedFieldArray()
+	if err := pe.putTaggedFieldArray(r.unknownTaggedFields); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -145,7 +148,7 @@ func (r *DescribeUserScramCredentialsResponse) decode(pd packetDecoder, version
 		}
 	}
 
-	if _, err = pd.getEmptyTaggedFieldArray(); err != nil {
+	if r.unknownTaggedFields, err = pd.getTaggedFieldArray(); err != nil {
 		return err
 	}
 	return nil
@@ -4,6 +4,7 @@ package sarama
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 )
 
@@ -63,3 +64,142 @@ func FuzzDecodeEncodeFetchRequest(f *testing.F) {
 		}
 	})
 }
+
+func FuzzDecodeEncodeResponseTaggedFields(f *testing.F) {
+	f.Add(uint64(0), []byte{})
+	f.Add(uint64(1), []byte{0x01, 0x02, 0x03})
+	f.Add(uint64(1<<20), bytes.Repeat([]byte{0xff}, 200))
+	f.Fuzz(func(t *testing.T, tag uint64, data []byte) {
+		for _, tc := range []struct {
+			version  int16
+			response versionedDecoder
+			empty    encoder
+		}{
+			{3, &ApiVersionsResponse{}, &ApiVersionsResponse{
+				Version: 3,
+				ApiKeys: []ApiVersionsResponseKey{{Version: 3, ApiKey: 18, MaxVersion: 3}},
+			}},
+			{2, &InitProducerIDResponse{}, &InitProducerIDResponse{Version: 2, ProducerID: 8000}},
+			{4, &ListGroupsResponse{}, &ListGroupsResponse{
+				Version:    4,
+				Groups:     map[string]string{"foo": "consumer"},
+				GroupsData: map[string]GroupData{"foo": {GroupState: "Empty"}},
+			}},
+		} {
+			base, err := encode(tc.empty, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// replace the trailing empty top-level tagged field array with one carrying an unknown field
+			fields := &realEncoder{raw: make([]byte, 3*binary.MaxVarintLen64+len(data))}
+			if err := fields.putTaggedFieldArray(taggedFields{{tag: tag, data: data}}); err != nil {
+				t.Fatal(err)
+			}
+			in := append(base[:len(base)-1:len(base)-1], fields.raw[:fields.off]...)
+
+			if err := versionedDecode(in, tc.response, tc.version, nil); err != nil {
+				t.Fatalf("%T: decode with tagged field %d: %v", tc.response, tag, err)
+			}
+			out, err := encode(tc.response.(encoder), nil)
+			if err != nil {
+				t.Fatalf("%T: encode: %v", tc.response, err)
+			}
+			if !bytes.Equal(in, out) {
+				t.Fatalf("%T: tagged field %d not preserved on round trip:\n%v\n%v", tc.response, tag, in, out)
+			}
+		}
+	})
+}
+
+type responseDecoderFuzzCase struct {
+	name     string
+	seeds    [][]byte
+	versions []int16
+	response func() versionedDecoder
+}
+
+var responseDecoderFuzzCases = []responseDecoderFuzzCase{
+	{
+		name: "metadata",
+		seeds: [][]byte{
+			emptyMetadataResponseV0,
+			brokersNoTopicsMetadataResponseV0,
+			topicsNoBrokersMetadataResponseV0,
+			brokersNoTopicsMetadataResponseV1,
+			topicsNoBrokersMetadataResponseV1,
+			noBrokersNoTopicsWithThrottleTimeAndClusterIDV3,
+			noBrokersOneTopicWithOfflineReplicasV5,
+			OneTopicV6,
+			OneTopicV7,
+			OneTopicV8,
+			OneTopicV9,
+			OneTopicV10,
+		},
+		versions: []int16{0, 1, 3, 5, 6, 7, 8, 9, 10},
+		response: func() versionedDecoder { return new(MetadataResponse) },
+	},
+	{
+		name: "fetch",
+		seeds: [][]byte{
+			emptyFetchResponse,
+			oneMessageFetchResponse,
+			overflowMessageFetchResponse,
+			oneRecordFetchResponse,
+			partialFetchResponse,
+			emptyRecordsFetchResponsev11,
+			oneMessageFetchResponseV4,
+			preferredReplicaFetchResponseV11,
+		},
+		versions: []int16{0, 4, 11},
+		response: func() versionedDecoder { return new(FetchResponse) },
+	},
+	{
+		name:     "api versions",
+		seeds:    [][]byte{apiVersionResponse, apiVersionResponseV3},
+		versions: []int16{0, 3},
+		response: func() versionedDecoder { return new(ApiVersionsResponse) },
+	},
+}
+
+// TestDecodeTruncatedResponses checks that every truncation of a valid
+// response is reported as a decoding error rather than a panic.
+func TestDecodeTruncatedResponses(t *testing.T) {
+	for _, tc := range responseDecoderFuzzCases {
+		for _, seed := range tc.seeds {
+			for _, version := range tc.versions {
+				if versionedDecode(seed, tc.response(), version, nil) != nil {
+					continue
+				}
+				for n := 0; n < len(seed); n++ {
+					if err := versionedDecode(seed[:n], tc.response(), version, nil); err == nil {
+						t.Errorf("%s v%d: expected an error decoding %d of %d bytes", tc.name, version, n, len(seed))
+					}
+				}
+			}
+		}
+	}
+}
+
+func fuzzResponseDecoder(f *testing.F, tc responseDecoderFuzzCase) {
+	for _, seed := range tc.seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		for _, version := range tc.versions {
+			// any error is acceptable, a panic is not
+			_ = versionedDecode(in, tc.response(), version, nil)
+		}
+	})
+}
+
+func FuzzDecodeMetadataResponse(f *testing.F) {
+	fuzzResponseDecoder(f, responseDecoderFuzzCases[0])
+}
+
+func FuzzDecodeFetchResponse(f *testing.F) {
+	fuzzResponseDecoder(f, responseDecoderFuzzCases[1])
+}
+
+func FuzzDecodeApiVersionsResponse(f *testing.F) {
+	fuzzResponseDecoder(f, responseDecoderFuzzCases[2])
+}
@@ -32,6 +32,18 @@ var ErrAlreadyConnected = errors.New("kafka: broker connection already initiated
 // ErrNotConnected is the error returned when trying to send or call Close() on a Broker that is not connected.
 var ErrNotConnected = errors.New("kafka: broker not connected")
 
+// ErrTooManyInFlight is the error returned when sending a request to a Broker which already has
+// as many outstanding requests as allowed by Net.MaxOpenRequests and Net.InFlightOverflowPolicy.
+var ErrTooManyInFlight = errors.New("kafka: too many requests in flight to broker")
+
+// ErrBrokerCircuitOpen is the error returned when sending a request to, or connecting to, a Broker
+// whose circuit breaker is open, see Config.Net.CircuitBreaker.
+var ErrBrokerCircuitOpen = errors.New("kafka: broker circuit breaker is open")
+
+// ErrMaxConnectionGoroutines is the error returned when connecting to a Broker while the clients
+// sharing its Config already run Net.MaxConnectionGoroutines connections.
+var ErrMaxConnectionGoroutines = errors.New("kafka: too many broker connection goroutines")
+
 // ErrInsufficientData is returned when decoding and the packet is truncated. This can be expected
 // when requesting messages, since as an optimization the server is allowed to return a partial message at the end
 // of the message set.
@@ -58,12 +70,53 @@ var ErrNoTopicsToUpdateMetadata = errors.New("kafka: no specific topics to updat
 // ErrUnknownScramMechanism is returned when user tries to AlterUserScramCredentials with unknown SCRAM mechanism
 var ErrUnknownScramMechanism = errors.New("kafka: unknown SCRAM mechanism provided")
 
+// ErrInvalidScramIterations is returned when user tries to AlterUserScramCredentials with an iteration count
+// outside of the bounds accepted by the broker for the SCRAM mechanism
+var ErrInvalidScramIterations = errors.New("kafka: SCRAM iterations out of range for the mechanism")
+
 // ErrReassignPartitions is returned when altering partition assignments for a topic fails
 var ErrReassignPartitions = errors.New("failed to reassign partitions for topic")
 
 // ErrDeleteRecords is the type of error returned when fail to delete the required records
 var ErrDeleteRecords = errors.New("kafka server: failed to delete records")
 
+// ErrDeleteConsumerGroupOffsets is the type of error returned when deleting some of a consumer group's offsets fails
+var ErrDeleteConsumerGroupOffsets = errors.New("kafka server: failed to delete one or more consumer group offsets")
+
+// ErrImportConsumerGroupOffsets is the type of error returned when some of the offsets of an OffsetSnapshot could not be imported
+var ErrImportConsumerGroupOffsets = errors.New("kafka server: failed to import one or more consumer group offsets")
+
+// ErrResetConsumerGroupOffsets is the type of error returned when resetting some of a consumer group's offsets fails
+var ErrResetConsumerGroupOffsets = errors.New("kafka server: failed to reset one or more consumer group offsets")
+
+// ErrMaxProcessingTimeExceeded is returned when a consumer group handler took longer than Consumer.Group.MaxProcessingTime to take the next message of a claim
+var ErrMaxProcessingTimeExceeded = errors.New("kafka: consumer group handler exceeded Consumer.Group.MaxProcessingTime")
+
+// ErrInvalidBalanceStrategyPlan is returned by PlanAssignment when a BalanceStrategy plans an assignment the group could not apply
+var ErrInvalidBalanceStrategyPlan = errors.New("kafka: balance strategy planned an invalid assignment")
+
+// ErrBatchNotHandled is returned by the ConsumerGroupHandler of NewBatchConsumerGroupHandler when ConsumeClaimBatch
+// handled fewer messages than it was handed without returning an error
+var ErrBatchNotHandled = errors.New("kafka: batch consumer group handler did not handle the whole batch")
+
+// ErrKerberosEncTypeNotPermitted is returned when the Kerberos service ticket uses an encryption type which is not in Net.SASL.GSSAPI.PermittedEncTypes
+var ErrKerberosEncTypeNotPermitted = errors.New("kafka: Kerberos encryption type not permitted by Net.SASL.GSSAPI.PermittedEncTypes")
+
+// ErrKerberosLogin is the Kind of GSSAPIError returned when the Kerberos client could not be created or failed to log in,
+// e.g. because of a wrong password or an outdated keytab
+var ErrKerberosLogin = errors.New("kafka: Kerberos login failed")
+
+// ErrKerberosClockSkew is the Kind of GSSAPIError returned when the broker rejected the Kerberos service ticket because
+// of clock skew (KRB_AP_ERR_SKEW), after Net.SASL.GSSAPI.ClockSkewRetries reconnections
+var ErrKerberosClockSkew = errors.New("kafka: Kerberos clock skew too great")
+
+// ErrKerberosServiceTicket is the Kind of GSSAPIError returned when no acceptable Kerberos service ticket could be obtained for the broker
+var ErrKerberosServiceTicket = errors.New("kafka: failed to get a Kerberos service ticket")
+
+// ErrGSSAPIHandshake is the Kind of GSSAPIError returned when the GSS-API token exchange with the broker failed,
+// including network errors
+var ErrGSSAPIHandshake = errors.New("kafka: GSSAPI handshake failed")
+
 // ErrCreateACLs is the type of error returned when ACL creation failed
 var ErrCreateACLs = errors.New("kafka server: failed to create one or more ACL rules")
 
@@ -159,6 +212,31 @@ func (err PacketDecodingError) Error() string {
 	return fmt.Sprintf("kafka: error decoding packet: %s", err.Info)
 }
 
+// GSSAPIError is returned when the GSSAPI (Kerberos) authentication with a broker fails. It matches its Kind with errors.Is,
+// and unwraps to the underlying error, whose message it keeps.
+type GSSAPIError struct {
+	// Kind is one of ErrKerberosLogin, ErrKerberosServiceTicket, ErrGSSAPIHandshake and ErrKerberosClockSkew.
+	Kind error
+	// Addr is the address of the broker.
+	Addr string
+	// Step is the handshake step that failed (GSS_API_INITIAL, GSS_API_VERIFY or GSS_API_FINISH), or 0 for
+	// failures before the handshake.
+	Step int
+	Err  error
+}
+
+func (err GSSAPIError) Error() string {
+	return err.Err.Error()
+}
+
+func (err GSSAPIError) Is(target error) bool {
+	return target == err.Kind
+}
+
+func (err GSSAPIError) Unwrap() error {
+	return err.Err
+}
+
 // ConfigurationError is the type of error returned from a constructor (e.g. NewClient, or NewConsumer)
 // when the specified configuration is invalid.
 type ConfigurationError string
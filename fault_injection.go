@@ -0,0 +1,104 @@
+package sarama
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Fault describes how the requests of an API key are disrupted by a
+// FaultInjector.
+type Fault struct {
+	// APIKey is the Kafka protocol API key of the requests to disrupt, e.g. 0
+	// for Produce, 1 for Fetch or 3 for Metadata.
+	APIKey int16
+	// Probability, between 0 and 1, that a request is disrupted.
+	Probability float64
+	// Err, unless it is ErrNoError, is returned for the disrupted requests
+	// instead of sending them to the broker. Produce and fetch requests are
+	// answered with a response carrying Err for each of their partitions,
+	// as a broker would, the other requests fail with Err.
+	Err KError
+	// Latency delays the responses to the disrupted requests, whether they
+	// come from the broker or carry Err, as a slow broker would: the
+	// connection is free to send other requests meanwhile, and the delay is
+	// part of the latency of the request reported to the interceptors and the
+	// metrics. Requests expecting no response, like produce requests with
+	// NoResponse, are not delayed.
+	Latency time.Duration
+}
+
+// FaultInjector is a BrokerInterceptor failing or delaying requests as
+// described by its faults, so that tests can check how an application copes
+// with broker errors like ErrNotLeaderForPartition or throttling without a
+// faulty cluster. It is enabled by adding it to Config.Net.Interceptors.
+//
+// The faults are drawn from a pseudo-random source seeded with the given seed:
+// the same requests sent in the same order see the same faults.
+//
+// FaultInjector is meant for tests and must never be enabled in production.
+type FaultInjector struct {
+	lock   sync.Mutex
+	random *rand.Rand
+	faults []Fault
+}
+
+// NewFaultInjector creates a FaultInjector drawing the given faults from a
+// source seeded with seed.
+func NewFaultInjector(seed int64, faults ...Fault) *FaultInjector {
+	return &FaultInjector{
+		random: rand.New(rand.NewSource(seed)),
+		faults: faults,
+	}
+}
+
+// BeforeRequest implements BrokerInterceptor.
+func (f *FaultInjector) BeforeRequest(apiKey, version int16, broker *Broker) {}
+
+// AfterResponse implements BrokerInterceptor.
+func (f *FaultInjector) AfterResponse(apiKey, version int16, broker *Broker, err error, latency time.Duration) {
+}
+
+// respond implements requestResponder, delaying the response to the request
+// or answering it with the error of the fault disrupting it, if any.
+func (f *FaultInjector) respond(broker *Broker, req protocolBody) (protocolBody, time.Duration, error) {
+	latency, kerr := f.fault(req.key())
+	if kerr == ErrNoError {
+		return nil, latency, nil
+	}
+
+	switch req := req.(type) {
+	case *ProduceRequest:
+		res := &ProduceResponse{Version: req.Version}
+		for topic, partitions := range req.records {
+			for partition := range partitions {
+				res.AddTopicPartition(topic, partition, kerr)
+			}
+		}
+		return res, latency, nil
+	case *FetchRequest:
+		res := &FetchResponse{Version: req.Version}
+		for topic, partitions := range req.blocks {
+			for partition := range partitions {
+				res.AddError(topic, partition, kerr)
+			}
+		}
+		return res, latency, nil
+	}
+	return nil, latency, kerr
+}
+
+// fault draws the faults of the API key in order and returns the latency and
+// error of the first one disrupting the request.
+func (f *FaultInjector) fault(apiKey int16) (time.Duration, KError) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, fault := range f.faults {
+		if fault.APIKey != apiKey || f.random.Float64() >= fault.Probability {
+			continue
+		}
+		return fault.Latency, fault.Err
+	}
+	return 0, ErrNoError
+}
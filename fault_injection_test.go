@@ -0,0 +1,227 @@
+package sarama
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFaultInjectorIsDeterministic(t *testing.T) {
+	draw := func() []KError {
+		injector := NewFaultInjector(42, Fault{APIKey: 0, Probability: 0.5, Err: ErrNotLeaderForPartition})
+		errs := make([]KError, 20)
+		for i := range errs {
+			_, errs[i] = injector.fault(0)
+		}
+		return errs
+	}
+
+	first := draw()
+	if !reflect.DeepEqual(first, draw()) {
+		t.Error("expected the same seed to inject the same faults")
+	}
+	failed := 0
+	for _, err := range first {
+		if err != ErrNoError {
+			failed++
+		}
+	}
+	if failed == 0 || failed == len(first) {
+		t.Errorf("expected some of the requests to fail, got %d out of %d", failed, len(first))
+	}
+}
+
+func TestFaultInjectorFailsRequests(t *testing.T) {
+	mb := NewMockBroker(t, 0)
+	defer mb.Close()
+	mb.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).SetBroker(mb.Addr(), mb.BrokerID()),
+	})
+
+	conf := NewTestConfig()
+	conf.Version = V1_0_0_0
+	conf.ApiVersionsRequest = false
+	conf.Net.Interceptors = []BrokerInterceptor{
+		NewFaultInjector(0,
+			Fault{APIKey: 0, Probability: 1, Err: ErrNotLeaderForPartition},
+			Fault{APIKey: 16, Probability: 1, Err: ErrBrokerNotAvailable}),
+	}
+	broker := NewBroker(mb.Addr())
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	// produce requests are answered with an error for each partition
+	request := &ProduceRequest{RequiredAcks: WaitForLocal}
+	request.AddMessage("my_topic", 0, &Message{Value: []byte(TestMessage)})
+	response, err := broker.Produce(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block := response.GetBlock("my_topic", 0); block == nil || !errors.Is(block.Err, ErrNotLeaderForPartition) {
+		t.Errorf("expected ErrNotLeaderForPartition for my_topic/0, got %+v", block)
+	}
+	// the other requests fail
+	if _, err := broker.ListGroups(&ListGroupsRequest{}); !errors.Is(err, ErrBrokerNotAvailable) {
+		t.Errorf("expected ErrBrokerNotAvailable, got %v", err)
+	}
+	if _, err := broker.GetMetadata(&MetadataRequest{}); err != nil {
+		t.Errorf("expected the requests of other API keys to succeed, got %v", err)
+	}
+	if len(mb.History()) != 1 {
+		t.Errorf("expected only the metadata request to reach the broker, got %d requests", len(mb.History()))
+	}
+}
+
+// countingDialer counts the connections opened through it.
+type countingDialer struct {
+	dials int32
+}
+
+func (d *countingDialer) Dial(network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	return net.Dial(network, addr)
+}
+
+func TestFaultInjectorProducerRetries(t *testing.T) {
+	mb := NewMockBroker(t, 1)
+	defer mb.Close()
+	mb.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(mb.Addr(), mb.BrokerID()).
+			SetLeader("my_topic", 0, mb.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t),
+	})
+
+	dialer := &countingDialer{}
+	conf := NewTestConfig()
+	conf.Net.Proxy.Enable = true
+	conf.Net.Proxy.Dialer = dialer
+	conf.Producer.Return.Successes = true
+	// the seed fails the first produce request only
+	conf.Net.Interceptors = []BrokerInterceptor{
+		NewFaultInjector(6, Fault{APIKey: 0, Probability: 0.5, Err: ErrNotLeaderForPartition}),
+	}
+	producer, err := NewAsyncProducer([]string{mb.Addr()}, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
+	expectResults(t, producer, 1, 0)
+	closeProducer(t, producer)
+
+	produces := 0
+	for _, rr := range mb.History() {
+		if _, ok := rr.Request.(*ProduceRequest); ok {
+			produces++
+		}
+	}
+	if produces != 1 {
+		t.Errorf("expected the retry only to reach the broker, got %d produce requests", produces)
+	}
+	// one connection for the seed broker, one for the leader
+	if dials := atomic.LoadInt32(&dialer.dials); dials != 2 {
+		t.Errorf("expected the retry to reuse the connection to the leader, got %d connections", dials)
+	}
+}
+
+func TestFaultInjectorDelaysRequests(t *testing.T) {
+	mb := NewMockBroker(t, 0)
+	defer mb.Close()
+	mb.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).SetBroker(mb.Addr(), mb.BrokerID()),
+	})
+
+	clock := newFakeClock()
+	conf := NewTestConfig()
+	conf.ApiVersionsRequest = false
+	conf.clock = clock
+	conf.Net.Interceptors = []BrokerInterceptor{
+		NewFaultInjector(0, Fault{APIKey: 3, Probability: 1, Latency: time.Minute}),
+	}
+	broker := NewBroker(mb.Addr())
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := broker.GetMetadata(&MetadataRequest{})
+		done <- err
+	}()
+
+	clock.BlockUntil(t, 1)
+	select {
+	case err := <-done:
+		t.Fatalf("expected the request to be delayed, got %v", err)
+	default:
+	}
+	clock.Advance(time.Minute)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+// latencyInterceptor reports the latency of the requests of apiKey.
+type latencyInterceptor struct {
+	apiKey    int16
+	latencies chan time.Duration
+}
+
+func (i *latencyInterceptor) BeforeRequest(apiKey, version int16, broker *Broker) {}
+
+func (i *latencyInterceptor) AfterResponse(apiKey, version int16, broker *Broker, err error, latency time.Duration) {
+	if apiKey == i.apiKey {
+		i.latencies <- latency
+	}
+}
+
+func TestFaultInjectorDelaysResponsesWithoutBlocking(t *testing.T) {
+	mb := NewMockBroker(t, 0)
+	defer mb.Close()
+	mb.SetHandlerByMap(map[string]MockResponse{
+		"ProduceRequest": NewMockProduceResponse(t),
+	})
+
+	latencies := &latencyInterceptor{apiKey: 0, latencies: make(chan time.Duration, 1)}
+	conf := NewTestConfig()
+	conf.ApiVersionsRequest = false
+	conf.Net.Interceptors = []BrokerInterceptor{
+		NewFaultInjector(0, Fault{APIKey: 0, Probability: 1, Latency: 300 * time.Millisecond}),
+		latencies,
+	}
+	broker := NewBroker(mb.Addr())
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	request := &ProduceRequest{RequiredAcks: WaitForLocal}
+	request.AddMessage("my_topic", 0, &Message{Value: []byte(TestMessage)})
+	start := time.Now()
+	done := make(chan error, 1)
+	err := broker.AsyncProduce(request, func(_ *ProduceResponse, err error) { done <- err })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the delayed response does not hold the connection
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("expected the request to be sent right away, took %v", elapsed)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("expected the response to be delayed by 300ms, got it after %v", elapsed)
+	}
+	if latency := <-latencies.latencies; latency < 300*time.Millisecond {
+		t.Errorf("expected the delay to be part of the latency, got %v", latency)
+	}
+}
@@ -87,6 +87,12 @@ type FetchRequest struct {
 	forgotten map[string][]int32
 	// RackID contains a Rack ID of the consumer making this request
 	RackID string
+
+	// skipCorruptBatches and skipCRCValidation are set by the consumer from
+	// Consumer.SkipCorruptBatches and Consumer.SkipCRCValidation, and passed
+	// on to the response by Broker.Fetch
+	skipCorruptBatches bool
+	skipCRCValidation  bool
 }
 
 type IsolationLevel int8
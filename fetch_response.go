@@ -62,6 +62,15 @@ type FetchResponseBlock struct {
 
 	Partial bool
 	Records *Records // deprecated: use FetchResponseBlock.RecordsSet
+
+	// recordsSize is the size in bytes of the record data as received
+	recordsSize int32
+	// corruptBatches are the record batches which failed their CRC check or
+	// decompression, skipped rather than failing the decoding when
+	// skipCorruptBatches is set
+	corruptBatches     []corruptBatchError
+	skipCorruptBatches bool
+	skipCRCValidation  bool
 }
 
 func (b *FetchResponseBlock) decode(pd packetDecoder, version int16) (err error) {
@@ -129,6 +138,7 @@ func (b *FetchResponseBlock) decode(pd packetDecoder, version int16) (err error)
 	if sizeMetric != nil {
 		sizeMetric.Update(int64(recordsSize))
 	}
+	b.recordsSize = recordsSize
 
 	recordsDecoder, err := pd.getSubset(int(recordsSize))
 	if err != nil {
@@ -138,7 +148,7 @@ func (b *FetchResponseBlock) decode(pd packetDecoder, version int16) (err error)
 	b.RecordsSet = []*Records{}
 
 	for recordsDecoder.remaining() > 0 {
-		records := &Records{}
+		records := &Records{skipCRCValidation: b.skipCRCValidation}
 		if err := records.decode(recordsDecoder); err != nil {
 			// If we have at least one decoded records, this is not an error
 			if errors.Is(err, ErrInsufficientData) {
@@ -147,6 +157,11 @@ func (b *FetchResponseBlock) decode(pd packetDecoder, version int16) (err error)
 				}
 				break
 			}
+			var corrupt corruptBatchError
+			if b.skipCorruptBatches && errors.As(err, &corrupt) {
+				b.corruptBatches = append(b.corruptBatches, corrupt)
+				continue
+			}
 			return err
 		}
 
@@ -276,6 +291,11 @@ type FetchResponse struct {
 
 	LogAppendTime bool
 	Timestamp     time.Time
+
+	// skipCorruptBatches and skipCRCValidation are copied from the request
+	// by Broker.Fetch before decoding the response
+	skipCorruptBatches bool
+	skipCRCValidation  bool
 }
 
 func (r *FetchResponse) decode(pd packetDecoder, version int16) (err error) {
@@ -304,6 +324,9 @@ func (r *FetchResponse) decode(pd packetDecoder, version int16) (err error) {
 	if err != nil {
 		return err
 	}
+	if numTopics < 0 {
+		return errInvalidArrayLength
+	}
 
 	r.Blocks = make(map[string]map[int32]*FetchResponseBlock, numTopics)
 	for i := 0; i < numTopics; i++ {
@@ -316,6 +339,9 @@ func (r *FetchResponse) decode(pd packetDecoder, version int16) (err error) {
 		if err != nil {
 			return err
 		}
+		if numBlocks < 0 {
+			return errInvalidArrayLength
+		}
 
 		r.Blocks[name] = make(map[int32]*FetchResponseBlock, numBlocks)
 
@@ -325,7 +351,10 @@ func (r *FetchResponse) decode(pd packetDecoder, version int16) (err error) {
 				return err
 			}
 
-			block := new(FetchResponseBlock)
+			block := &FetchResponseBlock{
+				skipCorruptBatches: r.skipCorruptBatches,
+				skipCRCValidation:  r.skipCRCValidation,
+			}
 			err = block.decode(pd, version)
 			if err != nil {
 				return err
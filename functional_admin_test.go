@@ -43,7 +43,7 @@ func TestFuncAdminQuotas(t *testing.T) {
 		Key:   "producer_byte_rate",
 		Value: 1024000,
 	}
-	if err = adminClient.AlterClientQuotas(defaultUser, produceOp, false); err != nil {
+	if err = adminClient.AlterClientQuotas(defaultUser, []ClientQuotasOp{produceOp}, false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -77,7 +77,7 @@ func TestFuncAdminQuotas(t *testing.T) {
 		Key:   "consumer_byte_rate",
 		Value: 2048000,
 	}
-	if err = adminClient.AlterClientQuotas(specificUserClientID, consumeOp, false); err != nil {
+	if err = adminClient.AlterClientQuotas(specificUserClientID, []ClientQuotasOp{consumeOp}, false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -111,7 +111,7 @@ func TestFuncAdminQuotas(t *testing.T) {
 		Key:    produceOp.Key,
 		Remove: true,
 	}
-	if err = adminClient.AlterClientQuotas(defaultUser, deleteProduceOp, false); err != nil {
+	if err = adminClient.AlterClientQuotas(defaultUser, []ClientQuotasOp{deleteProduceOp}, false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -119,7 +119,7 @@ func TestFuncAdminQuotas(t *testing.T) {
 		Key:    consumeOp.Key,
 		Remove: true,
 	}
-	if err = adminClient.AlterClientQuotas(specificUserClientID, deleteConsumeOp, false); err != nil {
+	if err = adminClient.AlterClientQuotas(specificUserClientID, []ClientQuotasOp{deleteConsumeOp}, false); err != nil {
 		t.Fatal(err)
 	}
 }
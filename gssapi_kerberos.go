@@ -1,21 +1,36 @@
 package sarama
 
 import (
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jcmturner/gofork/encoding/asn1"
 	"github.com/max444ks1m777/gokrb5/v8/asn1tools"
+	krb5config "github.com/max444ks1m777/gokrb5/v8/config"
+	krbcrypto "github.com/max444ks1m777/gokrb5/v8/crypto"
 	"github.com/max444ks1m777/gokrb5/v8/gssapi"
+	"github.com/max444ks1m777/gokrb5/v8/iana"
+	"github.com/max444ks1m777/gokrb5/v8/iana/asnAppTag"
 	"github.com/max444ks1m777/gokrb5/v8/iana/chksumtype"
+	"github.com/max444ks1m777/gokrb5/v8/iana/errorcode"
+	"github.com/max444ks1m777/gokrb5/v8/iana/etypeID"
 	"github.com/max444ks1m777/gokrb5/v8/iana/keyusage"
+	"github.com/max444ks1m777/gokrb5/v8/iana/msgtype"
 	"github.com/max444ks1m777/gokrb5/v8/messages"
 	"github.com/max444ks1m777/gokrb5/v8/types"
+	"github.com/rcrowley/go-metrics"
 )
 
 const (
@@ -27,19 +42,90 @@ const (
 	GSS_API_INITIAL     = 1
 	GSS_API_VERIFY      = 2
 	GSS_API_FINISH      = 3
+	TOK_ID_KRB_ERROR    = 0x0300
 )
 
+// GSSAPIConfig configures the GSSAPI (Kerberos) SASL mechanism. The GSS-API
+// tokens are exchanged in SaslAuthenticate requests whenever Net.SASL.Version
+// is SASLHandshakeV1 and Version is at least V1_0_0_0, which lets the broker
+// return a session lifetime to re-authenticate before it expires (KIP-368).
+// They are sent as raw packets otherwise.
 type GSSAPIConfig struct {
-	AuthType           int
+	AuthType int
+	// FallbackAuthTypes are tried in order when the credentials of AuthType
+	// fail to load, e.g. []int{KRB5_CCACHE_AUTH} to use CCachePath while
+	// the keytab of KRB5_KEYTAB_AUTH is unavailable during a volume
+	// remount. Failing to log in with the KDC does not fall back.
+	FallbackAuthTypes  []int
 	KeyTabPath         string
 	CCachePath         string
 	KerberosConfigPath string
-	ServiceName        string
-	Username           string
-	Password           string
-	Realm              string
-	DisablePAFXFAST    bool
-	BuildSpn           BuildSpnFunc
+	// KerberosConfig is the Kerberos configuration to use instead of loading
+	// KerberosConfigPath, e.g. one built with krb5config.NewFromString when
+	// it is generated at runtime. It is not modified.
+	KerberosConfig  *krb5config.Config
+	ServiceName     string
+	Username        string
+	Password        string
+	Realm           string
+	DisablePAFXFAST bool
+	BuildSpn        BuildSpnFunc
+	// ServiceRealm is the realm of the brokers when it differs from Realm,
+	// appended to the SPN as in kafka/broker01.example.com@FOREIGN.REALM
+	// unless BuildSpn already names a realm. The service ticket is then
+	// requested from the KDC of ServiceRealm with a cross-realm TGT. This
+	// requires a trust between the realms, i.e. the principal
+	// krbtgt/SERVICE.REALM@CLIENT.REALM in both KDCs (or a path of them in
+	// capaths), and the KDC of ServiceRealm to be found from the Kerberos
+	// configuration ([realms] or DNS SRV records).
+	ServiceRealm string
+	// EnableRDNS reverse resolves a broker addressed by IP to its canonical
+	// hostname to build the SPN, as krb5 does unless rdns = false, at the
+	// cost of a DNS lookup per authentication. Hostnames are never resolved.
+	// BuildSpn is given the resolved host (default false, the SPN is built
+	// with the broker host as addressed).
+	EnableRDNS bool
+	// ContextFlags are the gssapi.ContextFlag* values requested in the
+	// authenticator checksum, e.g. to add gssapi.ContextFlagMutual for
+	// brokers or gateways requiring it. Defaults to ContextFlagInteg and
+	// ContextFlagConf when empty. No credentials are delegated with
+	// ContextFlagDeleg.
+	ContextFlags []int
+	// DelegateCredentials delegates a TGT of the client to the broker, in the
+	// authenticator checksum as described in RFC 4121 section 4.1.1, so that
+	// it can authenticate as the client to downstream services. It requests
+	// a forwardable TGT, which the KDC must be allowed to issue to the client,
+	// and a TGT with the FORWARDED option from it to delegate, which requires
+	// a KerberosClient implementing GetForwardedTGT like the default one.
+	DelegateCredentials bool
+	// SpnHostLowercase lowercases the broker host before building the SPN,
+	// e.g. for KDCs which only know kafka/broker01.example.com when the
+	// broker is addressed as Broker01.EXAMPLE.COM (default false).
+	SpnHostLowercase bool
+	// NewKerberosClientFunc creates the Kerberos client used to obtain the
+	// service tickets, NewKerberosClient if nil. It can return a
+	// MockKerberosClient to test without a KDC, in which case neither
+	// KerberosConfigPath nor KerberosConfig is required. It is called for
+	// each handshake, concurrently with Net.MaxConcurrentConnects, so any
+	// client it shares between calls must be safe for concurrent use.
+	NewKerberosClientFunc func(config *GSSAPIConfig) (KerberosClient, error)
+	// ChannelBinding binds the authentication to the TLS channel when
+	// Net.TLS is enabled, using the tls-server-end-point channel binding of
+	// RFC 5929, to defend against relaying the authentication to another
+	// connection. The broker must support channel bindings.
+	ChannelBinding bool
+	// ClockSkewRetries is how many times the broker reconnects to restart the
+	// handshake with a fresh service ticket when it is rejected because of
+	// clock skew (KRB_AP_ERR_SKEW), e.g. while the clocks are being
+	// resynchronized, waiting Metadata.Retry.Backoff before each attempt.
+	// Any other failure is not retried (default 0).
+	ClockSkewRetries int
+	// PermittedEncTypes restricts the Kerberos encryption types requested
+	// from the KDC and accepted for the service ticket, by their krb5.conf
+	// names, e.g. "aes256-cts-hmac-sha1-96". The handshake fails with
+	// ErrKerberosEncTypeNotPermitted if the ticket uses another one. If
+	// empty, the encryption types of the Kerberos configuration are used.
+	PermittedEncTypes []string
 }
 
 type GSSAPIKerberosAuth struct {
@@ -48,6 +134,14 @@ type GSSAPIKerberosAuth struct {
 	encKey                types.EncryptionKey
 	NewKerberosClientFunc func(config *GSSAPIConfig) (KerberosClient, error)
 	step                  int
+	// lookupAddr reverse resolves the broker IP, net.LookupAddr if nil
+	lookupAddr func(addr string) ([]string, error)
+	// tlsState is the state of the TLS channel to bind the authentication
+	// to, only set if GSSAPIConfig.ChannelBinding is enabled
+	tlsState *tls.ConnectionState
+	// delegation is the KRB_CRED delegating the TGT to the broker, only set
+	// if GSSAPIConfig.DelegateCredentials is enabled
+	delegation []byte
 }
 
 type KerberosClient interface {
@@ -55,11 +149,32 @@ type KerberosClient interface {
 	GetServiceTicket(spn string) (messages.Ticket, types.EncryptionKey, error)
 	Domain() string
 	CName() types.PrincipalName
+	// TGTExpiry returns the end time of the ticket-granting ticket obtained
+	// by Login, so that it can be renewed before it expires, or the zero time
+	// if it is not known.
+	TGTExpiry() time.Time
 	Destroy()
 }
 
 type BuildSpnFunc func(serviceName, host string) string
 
+// tgtForwarder is implemented by the KerberosClients that can get a TGT
+// issued with the FORWARDED option, to be delegated to the broker with
+// GSSAPIConfig.DelegateCredentials. The decrypted part of the KDC reply holds
+// its session key, flags and times.
+type tgtForwarder interface {
+	GetForwardedTGT() (messages.Ticket, messages.EncKDCRepPart, error)
+}
+
+// gssapiPackagePool holds the buffers writePackage frames the tokens into, as
+// they are only needed for the duration of the write.
+var gssapiPackagePool = sync.Pool{
+	New: func() interface{} {
+		res := make([]byte, 0, 4096)
+		return &res
+	},
+}
+
 // writePackage appends length in big endian before the payload, and sends it to kafka
 func (krbAuth *GSSAPIKerberosAuth) writePackage(broker *Broker, payload []byte) (int, error) {
 	length := uint64(len(payload))
@@ -67,7 +182,15 @@ func (krbAuth *GSSAPIKerberosAuth) writePackage(broker *Broker, payload []byte)
 	if size > math.MaxInt32 {
 		return 0, errors.New("payload too large, will overflow int32")
 	}
-	finalPackage := make([]byte, size)
+	bufferPtr := gssapiPackagePool.Get().(*[]byte)
+	defer func() {
+		*bufferPtr = (*bufferPtr)[:0]
+		gssapiPackagePool.Put(bufferPtr)
+	}()
+	if uint64(cap(*bufferPtr)) < size {
+		*bufferPtr = make([]byte, 0, size)
+	}
+	finalPackage := (*bufferPtr)[:size]
 	copy(finalPackage[4:], payload)
 	binary.BigEndian.PutUint32(finalPackage, uint32(length))
 	bytes, err := broker.conn.Write(finalPackage)
@@ -96,10 +219,28 @@ func (krbAuth *GSSAPIKerberosAuth) readPackage(broker *Broker) ([]byte, int, err
 	return payloadBytes, bytesRead, nil
 }
 
-func (krbAuth *GSSAPIKerberosAuth) newAuthenticatorChecksum() []byte {
-	a := make([]byte, 24)
+// newAuthenticatorChecksum builds the authenticator checksum of RFC 4121
+// section 4.1.1. If tlsState is set, the Bnd field carries the MD5 hash of the
+// channel bindings derived from it, otherwise it is left empty. If delegation
+// is set, the KRB_CRED it holds is delegated in the Deleg field.
+func (krbAuth *GSSAPIKerberosAuth) newAuthenticatorChecksum(tlsState *tls.ConnectionState, delegation []byte) []byte {
+	a := make([]byte, 24, 28+len(delegation))
 	flags := []int{gssapi.ContextFlagInteg, gssapi.ContextFlagConf}
+	if krbAuth.Config != nil && len(krbAuth.Config.ContextFlags) > 0 {
+		flags = krbAuth.Config.ContextFlags
+	}
+	if delegation != nil {
+		flags = append(flags[:len(flags):len(flags)], gssapi.ContextFlagDeleg)
+		// DlgOpt 1 and Dlgth, followed by Deleg
+		a = binary.LittleEndian.AppendUint16(a, 1)
+		a = binary.LittleEndian.AppendUint16(a, uint16(len(delegation)))
+		a = append(a, delegation...)
+	}
 	binary.LittleEndian.PutUint32(a[:4], 16)
+	if tlsState != nil && len(tlsState.PeerCertificates) > 0 {
+		bnd := md5.Sum(channelBindings(tlsState.PeerCertificates[0]))
+		copy(a[4:20], bnd[:])
+	}
 	for _, i := range flags {
 		f := binary.LittleEndian.Uint32(a[20:24])
 		f |= uint32(i)
@@ -124,7 +265,7 @@ func (krbAuth *GSSAPIKerberosAuth) createKrb5Token(
 	}
 	auth.Cksum = types.Checksum{
 		CksumType: chksumtype.GSSAPI,
-		Checksum:  krbAuth.newAuthenticatorChecksum(),
+		Checksum:  krbAuth.newAuthenticatorChecksum(krbAuth.tlsState, krbAuth.delegation),
 	}
 	APReq, err := messages.NewAPReq(
 		ticket,
@@ -144,6 +285,87 @@ func (krbAuth *GSSAPIKerberosAuth) createKrb5Token(
 	return aprBytes, nil
 }
 
+// marshalKRBCred is the KRB_CRED message of RFC 4120 section 5.8.1.
+type marshalKRBCred struct {
+	PVNO    int                 `asn1:"explicit,tag:0"`
+	MsgType int                 `asn1:"explicit,tag:1"`
+	Tickets asn1.RawValue       `asn1:"explicit,tag:2"`
+	EncPart types.EncryptedData `asn1:"explicit,tag:3"`
+}
+
+// delegatedCredential returns a KRB_CRED forwarding a TGT of the client,
+// encrypted with the session key of the service ticket.
+func delegatedCredential(kerberosClient KerberosClient, sessionKey types.EncryptionKey) ([]byte, error) {
+	forwarder, ok := kerberosClient.(tgtForwarder)
+	if !ok {
+		return nil, errors.New("the KerberosClient cannot get a forwarded TGT")
+	}
+	tgt, tgtPart, err := forwarder.GetForwardedTGT()
+	if err != nil {
+		return nil, err
+	}
+
+	credPart, err := asn1.Marshal(messages.EncKrbCredPart{
+		TicketInfo: []messages.KrbCredInfo{{
+			Key:       tgtPart.Key,
+			PRealm:    kerberosClient.Domain(),
+			PName:     kerberosClient.CName(),
+			Flags:     tgtPart.Flags,
+			AuthTime:  tgtPart.AuthTime,
+			StartTime: tgtPart.StartTime,
+			EndTime:   tgtPart.EndTime,
+			RenewTill: tgtPart.RenewTill,
+			SRealm:    tgt.Realm,
+			SName:     tgt.SName,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encPart, err := krbcrypto.GetEncryptedData(asn1tools.AddASNAppTag(credPart, asnAppTag.EncKrbCredPart), sessionKey, keyusage.KRB_CRED_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+	tickets, err := messages.MarshalTicketSequence([]messages.Ticket{tgt})
+	if err != nil {
+		return nil, err
+	}
+	tickets.Tag = 2
+	cred, err := asn1.Marshal(marshalKRBCred{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_CRED,
+		Tickets: tickets,
+		EncPart: encPart,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1tools.AddASNAppTag(cred, asnAppTag.KRBCred), nil
+}
+
+// channelBindings returns the gss_channel_bindings_struct of RFC 2744 in the
+// wire format hashed into the authenticator checksum, with no addresses and
+// the tls-server-end-point channel binding of RFC 5929 as application data.
+func channelBindings(cert *x509.Certificate) []byte {
+	// the hash of the certificate signature, SHA-256 for MD5 and SHA-1 or
+	// algorithms without a hash of their own
+	hash := crypto.SHA256
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write(cert.Raw)
+	appData := append([]byte("tls-server-end-point:"), h.Sum(nil)...)
+
+	// initiator and acceptor address types and lengths are all 0
+	b := make([]byte, 20, 20+len(appData))
+	binary.LittleEndian.PutUint32(b[16:20], uint32(len(appData)))
+	return append(b, appData...)
+}
+
 /*
 *
 *	Append the GSS-API header to the payload, conforming to RFC-2743
@@ -180,6 +402,9 @@ func (krbAuth *GSSAPIKerberosAuth) initSecContext(bytes []byte, kerberosClient K
 		krbAuth.step = GSS_API_VERIFY
 		return krbAuth.appendGSSAPIHeader(aprBytes)
 	case GSS_API_VERIFY:
+		if krbErr, ok := krbErrorToken(bytes); ok {
+			return nil, krbErr
+		}
 		// Check for 0x60 as the first byte
 		// As per RFC 4121 § 4.4, these Token ID - 0x60 0x00 to 0x60 0xFF
 		// are reserved to indicate 'Generic GSS-API token framing' that was used by
@@ -227,63 +452,285 @@ func (krbAuth *GSSAPIKerberosAuth) initSecContext(bytes []byte, kerberosClient K
 	return nil, nil
 }
 
+// krbErrorToken returns the KRB_ERROR carried by a token of the acceptor, as
+// described in RFC 4121 section 4.1, if it is one.
+func krbErrorToken(b []byte) (messages.KRBError, bool) {
+	var krbErr messages.KRBError
+	if len(b) > 0 && b[0] == GSS_API_GENERIC_TAG {
+		// skip the GSS-API header: tag, length and mechanism OID
+		var raw asn1.RawValue
+		if _, err := asn1.Unmarshal(b, &raw); err != nil {
+			return krbErr, false
+		}
+		var oid asn1.ObjectIdentifier
+		rest, err := asn1.Unmarshal(raw.Bytes, &oid)
+		if err != nil {
+			return krbErr, false
+		}
+		b = rest
+	}
+	if len(b) < 2 || binary.BigEndian.Uint16(b) != TOK_ID_KRB_ERROR {
+		return krbErr, false
+	}
+	if err := krbErr.Unmarshal(b[2:]); err != nil {
+		return krbErr, false
+	}
+	return krbErr, true
+}
+
+// encTypePermitted reports whether etype is one of the PermittedEncTypes, or
+// whether they are not restricted.
+func (krbAuth *GSSAPIKerberosAuth) encTypePermitted(etype int32) bool {
+	if len(krbAuth.Config.PermittedEncTypes) == 0 {
+		return true
+	}
+	for _, name := range krbAuth.Config.PermittedEncTypes {
+		if etypeID.ETypesByName[name] == etype {
+			return true
+		}
+	}
+	return false
+}
+
+// isClockSkew reports whether err is a KRB_ERROR caused by clock skew.
+func isClockSkew(err error) bool {
+	var krbErr messages.KRBError
+	return errors.As(err, &krbErr) && krbErr.ErrorCode == errorcode.KRB_AP_ERR_SKEW
+}
+
 /* This does the handshake for authorization */
 func (krbAuth *GSSAPIKerberosAuth) Authorize(broker *Broker) error {
+	return krbAuth.AuthorizeContext(context.Background(), broker)
+}
+
+// AuthorizeContext is like Authorize, but abandons the calls to the KDC and
+// interrupts the handshake I/O once ctx is done.
+func (krbAuth *GSSAPIKerberosAuth) AuthorizeContext(ctx context.Context, broker *Broker) error {
+	return krbAuth.authorize(ctx, broker, func(packBytes []byte) ([]byte, error) {
+		requestTime := time.Now()
+		bytesWritten, err := krbAuth.writePackage(broker, packBytes)
+		if err != nil {
+			return nil, err
+		}
+		broker.updateOutgoingCommunicationMetrics(bytesWritten)
+		if krbAuth.step != GSS_API_VERIFY {
+			return nil, nil
+		}
+		receivedBytes, bytesRead, err := krbAuth.readPackage(broker)
+		requestLatency := time.Since(requestTime)
+		broker.updateIncomingCommunicationMetrics(bytesRead, requestLatency)
+		return receivedBytes, err
+	})
+}
+
+// AuthorizeV2 does the handshake for authorization exchanging the GSS-API
+// tokens in SaslAuthenticate requests, as sent by authSendReceiver.
+func (krbAuth *GSSAPIKerberosAuth) AuthorizeV2(broker *Broker, authSendReceiver func(authBytes []byte) (*SaslAuthenticateResponse, error)) error {
+	return krbAuth.AuthorizeV2Context(context.Background(), broker, authSendReceiver)
+}
+
+// AuthorizeV2Context is like AuthorizeV2, but abandons the calls to the KDC
+// and interrupts the handshake I/O once ctx is done.
+func (krbAuth *GSSAPIKerberosAuth) AuthorizeV2Context(ctx context.Context, broker *Broker, authSendReceiver func(authBytes []byte) (*SaslAuthenticateResponse, error)) error {
+	return krbAuth.authorize(ctx, broker, func(packBytes []byte) ([]byte, error) {
+		res, err := authSendReceiver(packBytes)
+		if err != nil {
+			return nil, err
+		}
+		return res.SaslAuthBytes, nil
+	})
+}
+
+// authorize runs the GSS-API handshake, sendReceive sending each token to the
+// broker and returning its reply.
+func (krbAuth *GSSAPIKerberosAuth) authorize(ctx context.Context, broker *Broker, sendReceive func(packBytes []byte) ([]byte, error)) error {
+	var roundTrips, tokenBytes int
+	defer func() { broker.updateGSSAPIHandshakeMetrics(roundTrips, tokenBytes) }()
+	exchange := sendReceive
+	sendReceive = func(packBytes []byte) ([]byte, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		roundTrips++
+		receivedBytes, err := exchange(packBytes)
+		tokenBytes += len(packBytes) + len(receivedBytes)
+		if err != nil && ctx.Err() != nil {
+			// the connection deadline was set to interrupt the exchange
+			err = ctx.Err()
+		}
+		return receivedBytes, err
+	}
+	if ctx.Done() != nil && broker.conn != nil {
+		stop := make(chan none)
+		defer close(stop)
+		goWithRecover(broker.conf.MetricRegistry, func() {
+			select {
+			case <-ctx.Done():
+				_ = broker.conn.SetDeadline(time.Now())
+			case <-stop:
+			}
+		})
+	}
+	kdc := &kdcCalls{ctx: ctx, registry: broker.conf.MetricRegistry}
+
 	kerberosClient, err := krbAuth.NewKerberosClientFunc(krbAuth.Config)
 	if err != nil {
 		Logger.Printf("Kerberos client error: %s", err)
-		return err
+		return GSSAPIError{Kind: ErrKerberosLogin, Addr: broker.addr, Err: err}
 	}
 
-	err = kerberosClient.Login()
+	defer kdc.destroy(kerberosClient)
+	err = kdc.run(kerberosClient.Login)
 	if err != nil {
 		Logger.Printf("Kerberos client error: %s", err)
-		return err
+		return GSSAPIError{Kind: ErrKerberosLogin, Addr: broker.addr, Err: err}
 	}
 	// Construct SPN using serviceName and host
 	// default SPN format: <SERVICE>/<FQDN>
 
-	host := strings.SplitN(broker.addr, ":", 2)[0] // Strip port part
+	host := krbAuth.spnHost(broker.addr)
+	if krbAuth.Config.SpnHostLowercase {
+		host = strings.ToLower(host)
+	}
 	var spn string
 	if krbAuth.Config.BuildSpn != nil {
 		spn = krbAuth.Config.BuildSpn(broker.conf.Net.SASL.GSSAPI.ServiceName, host)
 	} else {
 		spn = fmt.Sprintf("%s/%s", broker.conf.Net.SASL.GSSAPI.ServiceName, host)
 	}
+	if krbAuth.Config.ServiceRealm != "" && !strings.Contains(spn, "@") {
+		spn += "@" + krbAuth.Config.ServiceRealm
+	}
 
-	ticket, encKey, err := kerberosClient.GetServiceTicket(spn)
+	err = krbAuth.handshake(broker, kerberosClient, kdc, spn, sendReceive)
+	var gssapiErr GSSAPIError
+	if isClockSkew(err) && errors.As(err, &gssapiErr) {
+		// brokers close the connection once the handshake failed, the broker
+		// reconnects to retry with a fresh service ticket
+		gssapiErr.Kind = ErrKerberosClockSkew
+		return gssapiErr
+	}
+	return err
+}
+
+// kdcCalls runs the calls of a KerberosClient to the KDC, which cannot be
+// cancelled, so that they are abandoned once ctx is done.
+type kdcCalls struct {
+	ctx      context.Context
+	registry metrics.Registry
+	pending  sync.WaitGroup
+}
+
+func (kdc *kdcCalls) run(call func() error) error {
+	if kdc.ctx.Done() == nil {
+		return call()
+	}
+	if err := kdc.ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	kdc.pending.Add(1)
+	goWithRecover(kdc.registry, func() {
+		defer kdc.pending.Done()
+		done <- call()
+	})
+	select {
+	case err := <-done:
+		return err
+	case <-kdc.ctx.Done():
+		return kdc.ctx.Err()
+	}
+}
+
+// destroy destroys kerberosClient once the abandoned calls return.
+func (kdc *kdcCalls) destroy(kerberosClient KerberosClient) {
+	if kdc.ctx.Err() == nil {
+		kerberosClient.Destroy()
+		return
+	}
+	goWithRecover(kdc.registry, func() {
+		kdc.pending.Wait()
+		kerberosClient.Destroy()
+	})
+}
+
+// spnHost returns the host of addr to build the SPN with, reverse resolving
+// it if it is an IP and GSSAPIConfig.EnableRDNS is set.
+func (krbAuth *GSSAPIKerberosAuth) spnHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		Logger.Printf("Error getting Kerberos service ticket : %s", err)
+		host = strings.SplitN(addr, ":", 2)[0] // Strip port part
+	}
+	if !krbAuth.Config.EnableRDNS || net.ParseIP(host) == nil {
+		return host
+	}
+
+	lookupAddr := krbAuth.lookupAddr
+	if lookupAddr == nil {
+		lookupAddr = net.LookupAddr
+	}
+	names, err := lookupAddr(host)
+	if err != nil || len(names) == 0 {
+		Logger.Printf("Failed to reverse resolve %s for the Kerberos SPN, using the IP: %v", host, err)
+		return host
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// handshake exchanges the GSS-API tokens with the broker, using a service
+// ticket for spn.
+func (krbAuth *GSSAPIKerberosAuth) handshake(broker *Broker, kerberosClient KerberosClient, kdc *kdcCalls, spn string, sendReceive func(packBytes []byte) ([]byte, error)) error {
+	var ticket messages.Ticket
+	var encKey types.EncryptionKey
+	err := kdc.run(func() (err error) {
+		ticket, encKey, err = kerberosClient.GetServiceTicket(spn)
 		return err
+	})
+	if err != nil {
+		Logger.Printf("Error getting Kerberos service ticket : %s", err)
+		return GSSAPIError{Kind: ErrKerberosServiceTicket, Addr: broker.addr, Err: err}
+	}
+	for _, etype := range []int32{ticket.EncPart.EType, encKey.KeyType} {
+		if !krbAuth.encTypePermitted(etype) {
+			err = fmt.Errorf("%w: encryption type %d of the service ticket for %s", ErrKerberosEncTypeNotPermitted, etype, spn)
+			Logger.Printf("Error getting Kerberos service ticket : %s", err)
+			return GSSAPIError{Kind: ErrKerberosServiceTicket, Addr: broker.addr, Err: err}
+		}
 	}
 	krbAuth.ticket = ticket
 	krbAuth.encKey = encKey
 	krbAuth.step = GSS_API_INITIAL
+	krbAuth.tlsState = nil
+	if krbAuth.Config.ChannelBinding {
+		if state, ok := broker.tlsConnectionState(); ok {
+			krbAuth.tlsState = &state
+		}
+	}
+	krbAuth.delegation = nil
+	if krbAuth.Config.DelegateCredentials {
+		err = kdc.run(func() (err error) {
+			krbAuth.delegation, err = delegatedCredential(kerberosClient, encKey)
+			return err
+		})
+		if err != nil {
+			Logger.Printf("Error getting a Kerberos TGT to delegate : %s", err)
+			return GSSAPIError{Kind: ErrKerberosServiceTicket, Addr: broker.addr, Err: err}
+		}
+	}
 	var receivedBytes []byte = nil
-	defer kerberosClient.Destroy()
 	for {
+		step := krbAuth.step
 		packBytes, err := krbAuth.initSecContext(receivedBytes, kerberosClient)
 		if err != nil {
 			Logger.Printf("Error while performing GSSAPI Kerberos Authentication: %s\n", err)
-			return err
+			return GSSAPIError{Kind: ErrGSSAPIHandshake, Addr: broker.addr, Step: step, Err: err}
 		}
-		requestTime := time.Now()
-		bytesWritten, err := krbAuth.writePackage(broker, packBytes)
+		receivedBytes, err = sendReceive(packBytes)
 		if err != nil {
 			Logger.Printf("Error while performing GSSAPI Kerberos Authentication: %s\n", err)
-			return err
+			return GSSAPIError{Kind: ErrGSSAPIHandshake, Addr: broker.addr, Step: step, Err: err}
 		}
-		broker.updateOutgoingCommunicationMetrics(bytesWritten)
-		if krbAuth.step == GSS_API_VERIFY {
-			bytesRead := 0
-			receivedBytes, bytesRead, err = krbAuth.readPackage(broker)
-			requestLatency := time.Since(requestTime)
-			broker.updateIncomingCommunicationMetrics(bytesRead, requestLatency)
-			if err != nil {
-				Logger.Printf("Error while performing GSSAPI Kerberos Authentication: %s\n", err)
-				return err
-			}
-		} else if krbAuth.step == GSS_API_FINISH {
+		if krbAuth.step == GSS_API_FINISH {
 			return nil
 		}
 	}
@@ -0,0 +1,502 @@
+package sarama
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	krb5client "github.com/max444ks1m777/gokrb5/v8/client"
+	krbcfg "github.com/max444ks1m777/gokrb5/v8/config"
+	"github.com/max444ks1m777/gokrb5/v8/credentials"
+	"github.com/max444ks1m777/gokrb5/v8/gssapi"
+	"github.com/max444ks1m777/gokrb5/v8/iana/etypeID"
+	"github.com/max444ks1m777/gokrb5/v8/iana/flags"
+	"github.com/max444ks1m777/gokrb5/v8/iana/nametype"
+	"github.com/max444ks1m777/gokrb5/v8/messages"
+	"github.com/max444ks1m777/gokrb5/v8/test/testdata"
+	"github.com/max444ks1m777/gokrb5/v8/types"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestGSSAPIAuthenticatorChecksumChannelBinding(t *testing.T) {
+	krbAuth := &GSSAPIKerberosAuth{}
+
+	unbound := krbAuth.newAuthenticatorChecksum(nil, nil)
+	if len(unbound) != 24 {
+		t.Fatalf("expected a checksum of 24 bytes, got %d", len(unbound))
+	}
+	if !bytes.Equal(unbound[4:20], make([]byte, 16)) {
+		t.Errorf("expected empty channel bindings, got %x", unbound[4:20])
+	}
+
+	cert := &x509.Certificate{Raw: []byte("server certificate"), SignatureAlgorithm: x509.SHA256WithRSA}
+	state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	bound := krbAuth.newAuthenticatorChecksum(state, nil)
+	if bytes.Equal(bound, unbound) {
+		t.Fatal("expected the channel bindings to change the checksum")
+	}
+	if !bytes.Equal(bound[:4], unbound[:4]) || !bytes.Equal(bound[20:], unbound[20:]) {
+		t.Errorf("expected only the Bnd field to change, got %x and %x", bound, unbound)
+	}
+
+	certHash := sha256.Sum256(cert.Raw)
+	appData := append([]byte("tls-server-end-point:"), certHash[:]...)
+	bindings := make([]byte, 20)
+	binary.LittleEndian.PutUint32(bindings[16:], uint32(len(appData)))
+	expected := md5.Sum(append(bindings, appData...))
+	if !bytes.Equal(bound[4:20], expected[:]) {
+		t.Errorf("expected channel bindings %x, got %x", expected, bound[4:20])
+	}
+
+	cert.SignatureAlgorithm = x509.SHA512WithRSA
+	if bytes.Equal(krbAuth.newAuthenticatorChecksum(state, nil), bound) {
+		t.Error("expected the certificate signature hash to be used for the channel bindings")
+	}
+}
+
+func TestGSSAPIAuthenticatorChecksumContextFlags(t *testing.T) {
+	krbAuth := &GSSAPIKerberosAuth{Config: &GSSAPIConfig{}}
+	if flags := binary.LittleEndian.Uint32(krbAuth.newAuthenticatorChecksum(nil, nil)[20:]); flags != gssapi.ContextFlagInteg|gssapi.ContextFlagConf {
+		t.Errorf("expected the integrity and confidentiality flags by default, got %#x", flags)
+	}
+
+	krbAuth.Config.ContextFlags = []int{gssapi.ContextFlagInteg, gssapi.ContextFlagConf, gssapi.ContextFlagMutual}
+	checksum := krbAuth.newAuthenticatorChecksum(nil, nil)
+	expected := []byte{16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x32, 0, 0, 0}
+	if !bytes.Equal(checksum, expected) {
+		t.Errorf("expected checksum %x, got %x", expected, checksum)
+	}
+}
+
+// sentAPReq returns the AP-REQ sent to the broker by a handshake with the
+// service tickets of client, with its authenticator decrypted.
+func sentAPReq(t *testing.T, config *GSSAPIConfig, client *MockKerberosClient) messages.APReq {
+	t.Helper()
+	errSent := errors.New("token sent")
+	krbAuth := &GSSAPIKerberosAuth{
+		Config: config,
+		NewKerberosClientFunc: func(*GSSAPIConfig) (KerberosClient, error) {
+			return client, nil
+		},
+	}
+	broker := &Broker{addr: "localhost:9092", conf: NewTestConfig()}
+	broker.conf.Net.SASL.GSSAPI = *config
+	var apReq messages.APReq
+	err := krbAuth.AuthorizeV2(broker, func(b []byte) (*SaslAuthenticateResponse, error) {
+		// skip the GSS-API header, the mech OID and the token ID
+		var token asn1.RawValue
+		if _, err := asn1.Unmarshal(b, &token); err != nil {
+			t.Fatal(err)
+		}
+		if err := apReq.Unmarshal(token.Bytes[13:]); err != nil {
+			t.Fatal(err)
+		}
+		return nil, errSent
+	})
+	if !errors.Is(err, errSent) {
+		t.Fatalf("expected the AP-REQ to be sent, got %v", err)
+	}
+	if err := apReq.DecryptAuthenticator(client.sessionKey()); err != nil {
+		t.Fatal(err)
+	}
+	return apReq
+}
+
+func TestGSSAPIDelegateCredentials(t *testing.T) {
+	handshake := func(delegate bool) types.Authenticator {
+		config := &GSSAPIConfig{ServiceName: "kafka", DelegateCredentials: delegate}
+		return sentAPReq(t, config, NewMockKerberosClient()).Authenticator
+	}
+
+	checksum := handshake(false).Cksum.Checksum
+	if len(checksum) != 24 || binary.LittleEndian.Uint32(checksum[20:24])&gssapi.ContextFlagDeleg != 0 {
+		t.Fatalf("expected no delegation by default, got checksum %x", checksum)
+	}
+
+	checksum = handshake(true).Cksum.Checksum
+	if binary.LittleEndian.Uint32(checksum[20:24])&gssapi.ContextFlagDeleg == 0 {
+		t.Errorf("expected the Deleg flag to be set, got %#x", checksum[20:24])
+	}
+	if dlgOpt := binary.LittleEndian.Uint16(checksum[24:26]); dlgOpt != 1 {
+		t.Errorf("expected DlgOpt 1, got %d", dlgOpt)
+	}
+	if dlgth := int(binary.LittleEndian.Uint16(checksum[26:28])); dlgth != len(checksum)-28 {
+		t.Errorf("expected Dlgth %d, got %d", len(checksum)-28, dlgth)
+	}
+	var cred messages.KRBCred
+	if err := cred.Unmarshal(checksum[28:]); err != nil {
+		t.Fatal(err)
+	}
+	client := NewMockKerberosClient()
+	if err := client.login(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cred.DecryptEncPart(client.sessionKey()); err != nil {
+		t.Fatal(err)
+	}
+	if len(cred.Tickets) != 1 || len(cred.DecryptedEncPart.TicketInfo) != 1 {
+		t.Fatalf("expected a single delegated ticket, got %d", len(cred.Tickets))
+	}
+	info := cred.DecryptedEncPart.TicketInfo[0]
+	if !bytes.Equal(info.Key.KeyValue, client.sessionKey().KeyValue) || !info.PName.Equal(client.CName()) || info.PRealm != "EXAMPLE.COM" {
+		t.Errorf("expected the TGT of kafka/kafka@EXAMPLE.COM to be delegated, got %+v", info)
+	}
+	if !types.IsFlagSet(&info.Flags, flags.Forwarded) || !types.IsFlagSet(&info.Flags, flags.Forwardable) {
+		t.Errorf("expected a forwarded and forwardable TGT to be delegated, got flags %x", info.Flags.Bytes)
+	}
+}
+
+func TestGSSAPIServiceRealm(t *testing.T) {
+	spn := func(buildSpn BuildSpnFunc) string {
+		return requestedSpn(&GSSAPIKerberosAuth{Config: &GSSAPIConfig{
+			ServiceName:  "kafka",
+			ServiceRealm: "FOREIGN.REALM",
+			BuildSpn:     buildSpn,
+		}}, "broker01.example.com:9092")
+	}
+	if actual := spn(nil); actual != "kafka/broker01.example.com@FOREIGN.REALM" {
+		t.Errorf("expected a cross-realm SPN, got %s", actual)
+	}
+	buildSpn := func(serviceName, host string) string {
+		return serviceName + "/" + host + "@OTHER.REALM"
+	}
+	if actual := spn(buildSpn); actual != "kafka/broker01.example.com@OTHER.REALM" {
+		t.Errorf("expected the realm of BuildSpn to be kept, got SPN %s", actual)
+	}
+
+	// the KDC of the foreign realm issues the service ticket
+	client := NewMockKerberosClient()
+	if err := client.Login(); err != nil {
+		t.Fatal(err)
+	}
+	ticket, key, _ := client.GetServiceTicket("")
+	ticket.Realm = "FOREIGN.REALM"
+	ticket.SName = types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "kafka/broker01.example.com")
+	client.SetServiceTicket(ticket, key)
+	apReq := sentAPReq(t, &GSSAPIConfig{ServiceName: "kafka", ServiceRealm: "FOREIGN.REALM"}, client)
+	if apReq.Ticket.Realm != "FOREIGN.REALM" || !apReq.Ticket.SName.Equal(ticket.SName) {
+		t.Errorf("expected the cross-realm ticket to be sent, got %s@%s", apReq.Ticket.SName.PrincipalNameString(), apReq.Ticket.Realm)
+	}
+	if apReq.Authenticator.CRealm != "EXAMPLE.COM" {
+		t.Errorf("expected the client to authenticate from its own realm, got %s", apReq.Authenticator.CRealm)
+	}
+}
+
+// rc4KerberosClient issues service tickets encrypted with RC4 only.
+type rc4KerberosClient struct {
+	MockKerberosClient
+}
+
+func (c *rc4KerberosClient) GetServiceTicket(spn string) (messages.Ticket, types.EncryptionKey, error) {
+	ticket, key, err := c.MockKerberosClient.GetServiceTicket(spn)
+	ticket.EncPart.EType = etypeID.RC4_HMAC
+	key.KeyType = etypeID.RC4_HMAC
+	return ticket, key, err
+}
+
+func TestGSSAPIPermittedEncTypes(t *testing.T) {
+	errSent := errors.New("token sent")
+	authorize := func(permitted []string, client KerberosClient) error {
+		conf := NewTestConfig()
+		conf.Net.SASL.GSSAPI.ServiceName = "kafka"
+		conf.Net.SASL.GSSAPI.PermittedEncTypes = permitted
+		krbAuth := &GSSAPIKerberosAuth{
+			Config: &conf.Net.SASL.GSSAPI,
+			NewKerberosClientFunc: func(*GSSAPIConfig) (KerberosClient, error) {
+				return client, nil
+			},
+		}
+		broker := &Broker{addr: "localhost:9092", conf: conf}
+		return krbAuth.AuthorizeV2(broker, func([]byte) (*SaslAuthenticateResponse, error) {
+			return nil, errSent
+		})
+	}
+
+	if err := authorize([]string{"aes256-cts-hmac-sha1-96"}, &rc4KerberosClient{}); !errors.Is(err, ErrKerberosEncTypeNotPermitted) {
+		t.Errorf("expected an RC4 ticket to be rejected with ErrKerberosEncTypeNotPermitted, got %v", err)
+	}
+	if err := authorize([]string{"aes256-cts-hmac-sha1-96", "rc4-hmac"}, &rc4KerberosClient{}); !errors.Is(err, errSent) {
+		t.Errorf("expected a permitted RC4 ticket to be used, got %v", err)
+	}
+	if err := authorize([]string{"aes256-cts-hmac-sha1-96"}, &MockKerberosClient{}); !errors.Is(err, errSent) {
+		t.Errorf("expected an AES256 ticket to be used, got %v", err)
+	}
+	if err := authorize(nil, &rc4KerberosClient{}); !errors.Is(err, errSent) {
+		t.Errorf("expected any encryption type to be used when not restricted, got %v", err)
+	}
+}
+
+// spnRecordingKerberosClient records the SPN of the service tickets requested.
+type spnRecordingKerberosClient struct {
+	MockKerberosClient
+	spn string
+}
+
+func (c *spnRecordingKerberosClient) GetServiceTicket(spn string) (messages.Ticket, types.EncryptionKey, error) {
+	c.spn = spn
+	return c.MockKerberosClient.GetServiceTicket(spn)
+}
+
+// requestedSpn returns the SPN of the service ticket requested to
+// authenticate with the broker at addr.
+func requestedSpn(krbAuth *GSSAPIKerberosAuth, addr string) string {
+	client := &spnRecordingKerberosClient{}
+	krbAuth.NewKerberosClientFunc = func(*GSSAPIConfig) (KerberosClient, error) {
+		return client, nil
+	}
+	broker := &Broker{addr: addr, conf: NewTestConfig()}
+	broker.conf.Net.SASL.GSSAPI = *krbAuth.Config
+	_ = krbAuth.AuthorizeV2(broker, func([]byte) (*SaslAuthenticateResponse, error) {
+		return nil, errors.New("token sent")
+	})
+	return client.spn
+}
+
+func TestGSSAPISpnHostLowercase(t *testing.T) {
+	spn := func(lowercase bool, buildSpn BuildSpnFunc) string {
+		return requestedSpn(&GSSAPIKerberosAuth{Config: &GSSAPIConfig{
+			ServiceName:      "kafka",
+			SpnHostLowercase: lowercase,
+			BuildSpn:         buildSpn,
+		}}, "Broker01.EXAMPLE.COM:9092")
+	}
+
+	if actual := spn(false, nil); actual != "kafka/Broker01.EXAMPLE.COM" {
+		t.Errorf("expected the host to be kept by default, got SPN %s", actual)
+	}
+	if actual := spn(true, nil); actual != "kafka/broker01.example.com" {
+		t.Errorf("expected the host to be lowercased, got SPN %s", actual)
+	}
+	buildSpn := func(serviceName, host string) string {
+		return serviceName + "/" + host + "@EXAMPLE.COM"
+	}
+	if actual := spn(true, buildSpn); actual != "kafka/broker01.example.com@EXAMPLE.COM" {
+		t.Errorf("expected BuildSpn to be given the lowercased host, got SPN %s", actual)
+	}
+}
+
+func TestGSSAPIEnableRDNS(t *testing.T) {
+	var lookups []string
+	spn := func(enableRDNS bool, addr string) string {
+		lookups = nil
+		return requestedSpn(&GSSAPIKerberosAuth{
+			Config: &GSSAPIConfig{ServiceName: "kafka", EnableRDNS: enableRDNS},
+			lookupAddr: func(addr string) ([]string, error) {
+				lookups = append(lookups, addr)
+				return []string{"broker01.example.com."}, nil
+			},
+		}, addr)
+	}
+
+	if actual := spn(false, "192.0.2.10:9092"); actual != "kafka/192.0.2.10" || len(lookups) > 0 {
+		t.Errorf("expected no reverse lookup by default, got SPN %s after looking up %v", actual, lookups)
+	}
+	if actual := spn(true, "192.0.2.10:9092"); actual != "kafka/broker01.example.com" {
+		t.Errorf("expected the IP to be reverse resolved, got SPN %s", actual)
+	}
+	if actual := spn(true, "[2001:db8::10]:9092"); actual != "kafka/broker01.example.com" {
+		t.Errorf("expected the IPv6 address to be reverse resolved, got SPN %s", actual)
+	}
+	if actual := spn(true, "broker.example.com:9092"); actual != "kafka/broker.example.com" || len(lookups) > 0 {
+		t.Errorf("expected a hostname not to be resolved, got SPN %s after looking up %v", actual, lookups)
+	}
+}
+
+// discardConn is a net.Conn discarding everything written to it.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func BenchmarkGSSAPIWritePackage(b *testing.B) {
+	krbAuth := &GSSAPIKerberosAuth{}
+	broker := &Broker{conn: discardConn{}}
+	// about the size of an AP-REQ with an AES256 service ticket
+	payload := make([]byte, 1500)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := krbAuth.writePackage(broker, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// blockingKerberosClient blocks logging in until unblock is closed.
+type blockingKerberosClient struct {
+	MockKerberosClient
+	unblock   chan struct{}
+	destroyed chan struct{}
+}
+
+func (c *blockingKerberosClient) Login() error {
+	<-c.unblock
+	return c.MockKerberosClient.Login()
+}
+
+func (c *blockingKerberosClient) Destroy() {
+	close(c.destroyed)
+}
+
+func TestGSSAPIAuthorizeContext(t *testing.T) {
+	authorize := func(client KerberosClient, conn net.Conn) error {
+		conf := NewTestConfig()
+		conf.Net.SASL.GSSAPI.ServiceName = "kafka"
+		krbAuth := &GSSAPIKerberosAuth{
+			Config: &conf.Net.SASL.GSSAPI,
+			NewKerberosClientFunc: func(*GSSAPIConfig) (KerberosClient, error) {
+				return client, nil
+			},
+		}
+		broker := &Broker{
+			addr:             "localhost:9092",
+			conf:             conf,
+			conn:             conn,
+			requestRate:      metrics.NilMeter{},
+			outgoingByteRate: metrics.NilMeter{},
+			requestSize:      metrics.NilHistogram{},
+			requestLatency:   metrics.NilHistogram{},
+			requestsInFlight: metrics.NilCounter{},
+			responseRate:     metrics.NilMeter{},
+			incomingByteRate: metrics.NilMeter{},
+			responseSize:     metrics.NilHistogram{},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		errs := make(chan error, 1)
+		go func() { errs <- krbAuth.AuthorizeContext(ctx, broker) }()
+		select {
+		case err := <-errs:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the authentication to be cancelled")
+			return nil
+		}
+	}
+
+	client := &blockingKerberosClient{unblock: make(chan struct{}), destroyed: make(chan struct{})}
+	err := authorize(client, nil)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrKerberosLogin) {
+		t.Errorf("expected the login to be abandoned, got %v", err)
+	}
+	select {
+	case <-client.destroyed:
+		t.Error("expected the client not to be destroyed while logging in")
+	default:
+	}
+	close(client.unblock)
+	select {
+	case <-client.destroyed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the client to be destroyed once logged in")
+	}
+
+	// the broker never replies to the AP-REQ
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+	err = authorize(NewMockKerberosClient(), conn)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrGSSAPIHandshake) {
+		t.Errorf("expected the handshake to be interrupted, got %v", err)
+	}
+}
+
+func TestGSSAPIClockSkewRetryGoKrb5Client(t *testing.T) {
+	kerberosConfig, err := krbcfg.NewFromString(krb5cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccacheBytes, err := hex.DecodeString(testdata.CCACHE_TEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// newClient logs in from the credentials cache without a KDC, with
+	// the cached tickets valid for now
+	var clients int
+	newClient := func(*GSSAPIConfig) (KerberosClient, error) {
+		clients++
+		ccache := new(credentials.CCache)
+		if err := ccache.Unmarshal(ccacheBytes); err != nil {
+			return nil, err
+		}
+		for _, cred := range ccache.Credentials {
+			cred.StartTime = time.Now().Add(-time.Hour)
+			cred.EndTime = time.Now().Add(time.Hour)
+		}
+		client, err := krb5client.NewFromCCache(ccache, kerberosConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &KerberosGoKrb5Client{*client}, nil
+	}
+
+	// the broker accepts the cached service ticket of HTTP/host.test.gokrb5
+	ccache := new(credentials.CCache)
+	if err := ccache.Unmarshal(ccacheBytes); err != nil {
+		t.Fatal(err)
+	}
+	cred, ok := ccache.GetEntry(types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "HTTP/host.test.gokrb5"))
+	if !ok {
+		t.Fatal("expected a service ticket in the credentials cache")
+	}
+	var ticket messages.Ticket
+	if err := ticket.Unmarshal(cred.Ticket); err != nil {
+		t.Fatal(err)
+	}
+	gssapiHandler := KafkaGSSAPIHandler{
+		client:          NewMockKerberosClient().SetServiceTicket(ticket, cred.Key),
+		clockSkewErrors: 1,
+	}
+	mockBroker := NewMockBroker(t, 0)
+	defer mockBroker.Close()
+	mockBroker.SetHandlerByMap(map[string]MockResponse{
+		"SaslHandshakeRequest": NewMockSaslHandshakeResponse(t).
+			SetEnabledMechanisms([]string{SASLTypeGSSAPI}),
+		"SaslAuthenticateRequest": NewMockSaslAuthenticateResponse(t).
+			SetGSSAPIHandler(gssapiHandler.MockKafkaGSSAPI),
+	})
+
+	conf := NewTestConfig()
+	conf.Version = V1_0_0_0
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.Mechanism = SASLTypeGSSAPI
+	conf.Net.SASL.Version = SASLHandshakeV1
+	conf.Net.SASL.GSSAPI.ServiceName = "HTTP"
+	conf.Net.SASL.GSSAPI.AuthType = KRB5_CCACHE_AUTH
+	conf.Net.SASL.GSSAPI.CCachePath = "krb5.ccache"
+	conf.Net.SASL.GSSAPI.KerberosConfig = kerberosConfig
+	conf.Net.SASL.GSSAPI.Username = "testuser1"
+	conf.Net.SASL.GSSAPI.Realm = "TEST.GOKRB5"
+	conf.Net.SASL.GSSAPI.ClockSkewRetries = 1
+	conf.Net.SASL.GSSAPI.BuildSpn = func(serviceName, host string) string {
+		return serviceName + "/host.test.gokrb5"
+	}
+	broker := NewBroker(mockBroker.Addr())
+	broker.kerberosAuthenticator.NewKerberosClientFunc = newClient
+	if err := broker.Open(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, broker)
+
+	if _, err := broker.Connected(); err != nil {
+		t.Fatalf("expected the handshake to succeed once retried, got %v", err)
+	}
+	if clients != 2 {
+		t.Errorf("expected the retry to log in with a new client, got %d clients", clients)
+	}
+}
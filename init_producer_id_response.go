@@ -3,11 +3,12 @@ package sarama
 import "time"
 
 type InitProducerIDResponse struct {
-	ThrottleTime  time.Duration
-	Err           KError
-	Version       int16
-	ProducerID    int64
-	ProducerEpoch int16
+	ThrottleTime        time.Duration
+	Err                 KError
+	Version             int16
+	ProducerID          int64
+	ProducerEpoch       int16
+	unknownTaggedFields taggedFields
 }
 
 func (i *InitProducerIDResponse) encode(pe packetEncoder) error {
@@ -17,7 +18,9 @@ func (i *InitProducerIDResponse) encode(pe packetEncoder) error {
 	pe.putInt16(i.ProducerEpoch)
 
 	if i.Version >= 2 {
-		pe.putEmptyTaggedFieldArray()
+		if err := pe.putTaggedFieldArray(i.unknownTaggedFields); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -46,7 +49,7 @@ func (i *InitProducerIDResponse) decode(pd packetDecoder, version int16) (err er
 	}
 
 	if i.Version >= 2 {
-		if _, err := pd.getEmptyTaggedFieldArray(); err != nil {
+		if i.unknownTaggedFields, err = pd.getTaggedFieldArray(); err != nil {
 			return err
 		}
 	}
@@ -1,5 +1,7 @@
 package sarama
 
+import "time"
+
 // ProducerInterceptor allows you to intercept (and possibly mutate) the records
 // received by the producer before they are published to the Kafka cluster.
 // https://cwiki.apache.org/confluence/display/KAFKA/KIP-42%3A+Add+Producer+and+Consumer+Interceptors#KIP42:AddProducerandConsumerInterceptors-Motivation
@@ -7,7 +9,8 @@ type ProducerInterceptor interface {
 
 	// OnSend is called when the producer message is intercepted. Please avoid
 	// modifying the message until it's safe to do so, as this is _not_ a copy
-	// of the message.
+	// of the message. The Context of the message, if set, carries the values
+	// of the operation producing it, e.g. its trace context.
 	OnSend(*ProducerMessage)
 }
 
@@ -22,6 +25,37 @@ type ConsumerInterceptor interface {
 	OnConsume(*ConsumerMessage)
 }
 
+// BrokerInterceptor allows you to observe every protocol request sent to a
+// broker and its response, e.g. to record metrics or log. It cannot fail,
+// delay or answer requests: use the FaultInjector to inject faults.
+type BrokerInterceptor interface {
+
+	// BeforeRequest is called before a request of the given API key and
+	// version is written to the broker. It is called with the broker lock
+	// held, so it must not block nor call the broker. The request is sent
+	// whatever it does.
+	BeforeRequest(apiKey, version int16, broker *Broker)
+
+	// AfterResponse is called once the response to the request was received
+	// or the request failed, with the error if any and the time elapsed since
+	// the request was written. It is called from the goroutine reading the
+	// responses of the broker, so it must not block. Requests expecting no
+	// response, like produce requests with NoResponse, are reported once
+	// written.
+	AfterResponse(apiKey, version int16, broker *Broker, err error, latency time.Duration)
+}
+
+// requestResponder is implemented by the BrokerInterceptors which may answer
+// requests themselves instead of letting them reach the broker, like the
+// FaultInjector.
+type requestResponder interface {
+	// respond is called after BeforeRequest with the request about to be
+	// sent. It returns the response to hand over instead, nil to send the
+	// request, or an error failing it, along with a delay to add before the
+	// response is handed over.
+	respond(broker *Broker, req protocolBody) (protocolBody, time.Duration, error)
+}
+
 func (msg *ProducerMessage) safelyApplyInterceptor(interceptor ProducerInterceptor) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -41,3 +75,23 @@ func (msg *ConsumerMessage) safelyApplyInterceptor(interceptor ConsumerIntercept
 
 	interceptor.OnConsume(msg)
 }
+
+func (b *Broker) safelyApplyBeforeRequest(interceptor BrokerInterceptor, apiKey, version int16) {
+	defer func() {
+		if r := recover(); r != nil {
+			Logger.Printf("Error when calling broker interceptor: %v, %v", interceptor, r)
+		}
+	}()
+
+	interceptor.BeforeRequest(apiKey, version, b)
+}
+
+func (b *Broker) safelyApplyAfterResponse(interceptor BrokerInterceptor, apiKey, version int16, err error, latency time.Duration) {
+	defer func() {
+		if r := recover(); r != nil {
+			Logger.Printf("Error when calling broker interceptor: %v, %v", interceptor, r)
+		}
+	}()
+
+	interceptor.AfterResponse(apiKey, version, b, err, latency)
+}
@@ -1,10 +1,20 @@
 package sarama
 
 import (
+	"strings"
+	"time"
+
 	krb5client "github.com/max444ks1m777/gokrb5/v8/client"
 	krb5config "github.com/max444ks1m777/gokrb5/v8/config"
 	"github.com/max444ks1m777/gokrb5/v8/credentials"
+	krbcrypto "github.com/max444ks1m777/gokrb5/v8/crypto"
+	"github.com/max444ks1m777/gokrb5/v8/iana/etypeID"
+	"github.com/max444ks1m777/gokrb5/v8/iana/flags"
+	"github.com/max444ks1m777/gokrb5/v8/iana/keyusage"
+	"github.com/max444ks1m777/gokrb5/v8/iana/nametype"
+	"github.com/max444ks1m777/gokrb5/v8/iana/patype"
 	"github.com/max444ks1m777/gokrb5/v8/keytab"
+	"github.com/max444ks1m777/gokrb5/v8/messages"
 	"github.com/max444ks1m777/gokrb5/v8/types"
 )
 
@@ -12,6 +22,12 @@ type KerberosGoKrb5Client struct {
 	krb5client.Client
 }
 
+// sessionTimer is implemented by the gokrb5 clients exporting the times of
+// their TGT sessions.
+type sessionTimer interface {
+	SessionTimes(realm string) (authTime, endTime, renewTime, sessionExp time.Time, err error)
+}
+
 func (c *KerberosGoKrb5Client) Domain() string {
 	return c.Credentials.Domain()
 }
@@ -20,10 +36,119 @@ func (c *KerberosGoKrb5Client) CName() types.PrincipalName {
 	return c.Credentials.CName()
 }
 
+// TGTExpiry returns the end time of the ticket-granting ticket of the
+// client's realm, or the zero time if it is not known. It is read from the
+// TGT session when gokrb5 exports its times, and is otherwise only known for
+// the TGT loaded from a credentials cache, as the credentials valid until.
+func (c *KerberosGoKrb5Client) TGTExpiry() time.Time {
+	if st, ok := interface{}(&c.Client).(sessionTimer); ok {
+		_, endTime, _, _, err := st.SessionTimes(c.Credentials.Domain())
+		if err != nil {
+			return time.Time{}
+		}
+		return endTime
+	}
+	return c.Credentials.ValidUntil()
+}
+
+// GetServiceTicket gets a service ticket for spn, which can name the realm of
+// the service as in kafka/broker01.example.com@FOREIGN.REALM. The ticket is
+// then requested from the KDC of that realm with a cross-realm TGT, following
+// any further referrals.
+func (c *KerberosGoKrb5Client) GetServiceTicket(spn string) (messages.Ticket, types.EncryptionKey, error) {
+	i := strings.LastIndex(spn, "@")
+	if i < 0 {
+		return c.Client.GetServiceTicket(spn)
+	}
+	name, realm := spn[:i], spn[i+1:]
+	if realm == c.Credentials.Domain() {
+		return c.Client.GetServiceTicket(name)
+	}
+	if ticket, key, ok := c.GetCachedTicket(name); ok && ticket.Realm == realm {
+		return ticket, key, nil
+	}
+
+	tgt, tgtKey, err := c.Client.GetServiceTicket("krbtgt/" + realm)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+	_, tgsRep, err := c.TGSREQGenerateAndExchange(types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, name), realm, tgt, tgtKey, false)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+	return tgsRep.Ticket, tgsRep.DecryptedEncPart.Key, nil
+}
+
+// GetForwardedTGT gets a TGT of the client's realm issued with the FORWARDED
+// option, to be delegated to the broker, from a forwardable TGT.
+func (c *KerberosGoKrb5Client) GetForwardedTGT() (messages.Ticket, messages.EncKDCRepPart, error) {
+	realm := c.Credentials.Domain()
+	tgt, tgtKey, err := c.Client.GetServiceTicket("krbtgt/" + realm)
+	if err != nil {
+		return messages.Ticket{}, messages.EncKDCRepPart{}, err
+	}
+	tgsReq, err := newForwardedTGTReq(c.Credentials.CName(), realm, c.Config, tgt, tgtKey)
+	if err != nil {
+		return messages.Ticket{}, messages.EncKDCRepPart{}, err
+	}
+	_, tgsRep, err := c.TGSExchange(tgsReq, realm, tgt, tgtKey, 0)
+	if err != nil {
+		return messages.Ticket{}, messages.EncKDCRepPart{}, err
+	}
+	return tgsRep.Ticket, tgsRep.DecryptedEncPart, nil
+}
+
+// newForwardedTGTReq returns a TGS-REQ for a TGT of realm with the FORWARDABLE
+// and FORWARDED options, authenticated with tgt. gokrb5 has no way to set the
+// FORWARDED option, so the PA-TGS-REQ is built again once it is set, as its
+// checksum covers the request body.
+func newForwardedTGTReq(cname types.PrincipalName, realm string, cfg *krb5config.Config, tgt messages.Ticket, sessionKey types.EncryptionKey) (messages.TGSReq, error) {
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+realm)
+	tgsReq, err := messages.NewTGSReq(cname, realm, cfg, tgt, sessionKey, sname, false)
+	if err != nil {
+		return tgsReq, err
+	}
+	types.SetFlag(&tgsReq.ReqBody.KDCOptions, flags.Forwardable)
+	types.SetFlag(&tgsReq.ReqBody.KDCOptions, flags.Forwarded)
+
+	body, err := tgsReq.ReqBody.Marshal()
+	if err != nil {
+		return tgsReq, err
+	}
+	etype, err := krbcrypto.GetEtype(sessionKey.KeyType)
+	if err != nil {
+		return tgsReq, err
+	}
+	checksum, err := etype.GetChecksumHash(sessionKey.KeyValue, body, keyusage.TGS_REQ_PA_TGS_REQ_AP_REQ_AUTHENTICATOR_CHKSUM)
+	if err != nil {
+		return tgsReq, err
+	}
+	auth, err := types.NewAuthenticator(tgt.Realm, cname)
+	if err != nil {
+		return tgsReq, err
+	}
+	auth.Cksum = types.Checksum{CksumType: etype.GetHashID(), Checksum: checksum}
+	apReq, err := messages.NewAPReq(tgt, sessionKey, auth)
+	if err != nil {
+		return tgsReq, err
+	}
+	apReqBytes, err := apReq.Marshal()
+	if err != nil {
+		return tgsReq, err
+	}
+	tgsReq.PAData = types.PADataSequence{{PADataType: patype.PA_TGS_REQ, PADataValue: apReqBytes}}
+	return tgsReq, nil
+}
+
 // NewKerberosClient creates kerberos client used to obtain TGT and TGS tokens.
 // It uses pure go Kerberos 5 solution (RFC-4121 and RFC-4120).
 // uses gokrb5 library underlying which is a pure go kerberos client with some GSS-API capabilities.
 func NewKerberosClient(config *GSSAPIConfig) (KerberosClient, error) {
+	if config.KerberosConfig != nil {
+		// copy it, as createClient may override its encryption types
+		cfg := *config.KerberosConfig
+		return createClient(config, &cfg)
+	}
 	cfg, err := krb5config.Load(config.KerberosConfigPath)
 	if err != nil {
 		return nil, err
@@ -32,8 +157,46 @@ func NewKerberosClient(config *GSSAPIConfig) (KerberosClient, error) {
 }
 
 func createClient(config *GSSAPIConfig, cfg *krb5config.Config) (KerberosClient, error) {
+	if len(config.PermittedEncTypes) > 0 {
+		// only request and accept the permitted encryption types
+		ids := make([]int32, 0, len(config.PermittedEncTypes))
+		for _, name := range config.PermittedEncTypes {
+			ids = append(ids, etypeID.ETypesByName[name])
+		}
+		cfg.LibDefaults.DefaultTktEnctypes = config.PermittedEncTypes
+		cfg.LibDefaults.DefaultTktEnctypeIDs = ids
+		cfg.LibDefaults.DefaultTGSEnctypes = config.PermittedEncTypes
+		cfg.LibDefaults.DefaultTGSEnctypeIDs = ids
+		cfg.LibDefaults.PermittedEnctypes = config.PermittedEncTypes
+		cfg.LibDefaults.PermittedEnctypeIDs = ids
+	}
+
+	if config.DelegateCredentials {
+		// the delegated TGT is requested from the forwardable TGT
+		cfg.LibDefaults.Forwardable = true
+	}
+
+	authTypes := append([]int{config.AuthType}, config.FallbackAuthTypes...)
+	var firstErr error
+	for i, authType := range authTypes {
+		client, err := newGoKrb5Client(config, authType, cfg)
+		if err == nil {
+			return &KerberosGoKrb5Client{*client}, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if i+1 < len(authTypes) {
+			Logger.Printf("Failed to load the Kerberos credentials of auth type %d, falling back to auth type %d: %s", authType, authTypes[i+1], err)
+		}
+	}
+	return nil, firstErr
+}
+
+// newGoKrb5Client creates a gokrb5 client loading the credentials of authType.
+func newGoKrb5Client(config *GSSAPIConfig, authType int, cfg *krb5config.Config) (*krb5client.Client, error) {
 	var client *krb5client.Client
-	switch config.AuthType {
+	switch authType {
 	case KRB5_KEYTAB_AUTH:
 		kt, err := keytab.Load(config.KeyTabPath)
 		if err != nil {
@@ -49,9 +212,13 @@ func createClient(config *GSSAPIConfig, cfg *krb5config.Config) (KerberosClient,
 		if err != nil {
 			return nil, err
 		}
+		tgtName := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+cc.DefaultPrincipal.Realm)
+		if tgt, ok := cc.GetEntry(tgtName); ok {
+			client.Credentials.SetValidUntil(tgt.EndTime)
+		}
 	default:
 		client = krb5client.NewWithPassword(config.Username,
 			config.Realm, config.Password, cfg, krb5client.DisablePAFXFAST(config.DisablePAFXFAST))
 	}
-	return &KerberosGoKrb5Client{*client}, nil
+	return client, nil
 }
@@ -1,10 +1,24 @@
 package sarama
 
 import (
+	"encoding/hex"
 	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	krbcfg "github.com/max444ks1m777/gokrb5/v8/config"
+	"github.com/max444ks1m777/gokrb5/v8/credentials"
+	"github.com/max444ks1m777/gokrb5/v8/crypto"
+	"github.com/max444ks1m777/gokrb5/v8/iana/etypeID"
+	"github.com/max444ks1m777/gokrb5/v8/iana/flags"
+	"github.com/max444ks1m777/gokrb5/v8/iana/keyusage"
+	"github.com/max444ks1m777/gokrb5/v8/iana/nametype"
+	"github.com/max444ks1m777/gokrb5/v8/iana/patype"
+	"github.com/max444ks1m777/gokrb5/v8/messages"
+	"github.com/max444ks1m777/gokrb5/v8/test/testdata"
+	"github.com/max444ks1m777/gokrb5/v8/types"
 )
 
 /*
@@ -127,6 +141,44 @@ func TestCreateWithKeyTab(t *testing.T) {
 	}
 }
 
+func TestCreateWithKeyTabFallbackToCredentialsCache(t *testing.T) {
+	kerberosConfig, err := krbcfg.NewFromString(krb5cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccacheBytes, err := hex.DecodeString(testdata.CCACHE_TEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccachePath := filepath.Join(t.TempDir(), "krb5.ccache")
+	if err := os.WriteFile(ccachePath, ccacheBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	clientConfig := NewTestConfig()
+	clientConfig.Net.SASL.GSSAPI.ServiceName = "kafka"
+	clientConfig.Net.SASL.GSSAPI.Realm = "TEST.GOKRB5"
+	clientConfig.Net.SASL.GSSAPI.Username = "client"
+	clientConfig.Net.SASL.GSSAPI.AuthType = KRB5_KEYTAB_AUTH
+	clientConfig.Net.SASL.GSSAPI.KeyTabPath = "nonexist.keytab"
+	clientConfig.Net.SASL.GSSAPI.CCachePath = ccachePath
+	clientConfig.Net.SASL.GSSAPI.FallbackAuthTypes = []int{KRB5_CCACHE_AUTH}
+	client, err := createClient(&clientConfig.Net.SASL.GSSAPI, kerberosConfig)
+	if err != nil {
+		t.Fatalf("expected to fall back to the credentials cache, got %v", err)
+	}
+	if client.TGTExpiry().IsZero() {
+		t.Error("expected the TGT of the credentials cache to be loaded")
+	}
+
+	// the error of AuthType is returned when no fallback succeeds
+	clientConfig.Net.SASL.GSSAPI.CCachePath = "nonexist.ccache"
+	_, err = createClient(&clientConfig.Net.SASL.GSSAPI, kerberosConfig)
+	if err == nil || err.Error() != "open nonexist.keytab: no such file or directory" {
+		t.Errorf("expected the keytab error, got %v", err)
+	}
+}
+
 func TestCreateWithCredentialsCache(t *testing.T) {
 	kerberosConfig, err := krbcfg.NewFromString(krb5cfg)
 	if err != nil {
@@ -170,3 +222,160 @@ func TestCreateWithDisablePAFXFAST(t *testing.T) {
 		t.Errorf("Expected error:%s, got:%s.", err, expectedErr)
 	}
 }
+
+func TestCreateWithPermittedEncTypes(t *testing.T) {
+	kerberosConfig, err := krbcfg.NewFromString(krb5cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := NewTestConfig()
+	clientConfig.Net.SASL.GSSAPI.Realm = "EXAMPLE.COM"
+	clientConfig.Net.SASL.GSSAPI.Username = "client"
+	clientConfig.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+	clientConfig.Net.SASL.GSSAPI.Password = "qwerty"
+	clientConfig.Net.SASL.GSSAPI.PermittedEncTypes = []string{"aes256-cts-hmac-sha1-96", "aes128-cts-hmac-sha1-96"}
+
+	client, err := createClient(&clientConfig.Net.SASL.GSSAPI, kerberosConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	libDefaults := client.(*KerberosGoKrb5Client).Config.LibDefaults
+	expected := []int32{etypeID.AES256_CTS_HMAC_SHA1_96, etypeID.AES128_CTS_HMAC_SHA1_96}
+	for name, ids := range map[string][]int32{
+		"default_tkt_enctypes": libDefaults.DefaultTktEnctypeIDs,
+		"default_tgs_enctypes": libDefaults.DefaultTGSEnctypeIDs,
+		"permitted_enctypes":   libDefaults.PermittedEnctypeIDs,
+	} {
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("expected %s %v, got %v", name, expected, ids)
+		}
+	}
+}
+
+func TestCreateWithKerberosConfig(t *testing.T) {
+	kerberosConfig, err := krbcfg.NewFromString(krb5cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := NewTestConfig()
+	clientConfig.Net.SASL.Mechanism = SASLTypeGSSAPI
+	clientConfig.Net.SASL.Enable = true
+	clientConfig.Net.SASL.GSSAPI.ServiceName = "kafka"
+	clientConfig.Net.SASL.GSSAPI.Realm = "EXAMPLE.COM"
+	clientConfig.Net.SASL.GSSAPI.Username = "client"
+	clientConfig.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+	clientConfig.Net.SASL.GSSAPI.Password = "qwerty"
+	clientConfig.Net.SASL.GSSAPI.KerberosConfig = kerberosConfig
+	clientConfig.Net.SASL.GSSAPI.PermittedEncTypes = []string{"aes128-cts-hmac-sha1-96"}
+	if err := clientConfig.Validate(); err != nil {
+		t.Fatalf("expected an in-memory Kerberos configuration to be valid, got %v", err)
+	}
+
+	// the in-memory configuration is used rather than loading KerberosConfigPath
+	client, err := NewKerberosClient(&clientConfig.Net.SASL.GSSAPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if realm := client.(*KerberosGoKrb5Client).Config.LibDefaults.DefaultRealm; realm != "TEST.GOKRB5" {
+		t.Errorf("expected the default realm of the in-memory configuration, got %s", realm)
+	}
+	if client.CName().NameString[0] != "client" {
+		t.Errorf("Client cname: client, got: %s", client.CName().NameString[0])
+	}
+	expected := []int32{etypeID.AES256_CTS_HMAC_SHA1_96}
+	if ids := kerberosConfig.LibDefaults.DefaultTktEnctypeIDs; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected the in-memory configuration not to be modified, got default_tkt_enctypes %v", ids)
+	}
+}
+
+func TestKerberosClientTGTExpiry(t *testing.T) {
+	kerberosConfig, err := krbcfg.NewFromString(krb5cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := NewTestConfig()
+	clientConfig.Net.SASL.GSSAPI.Realm = "TEST.GOKRB5"
+	clientConfig.Net.SASL.GSSAPI.Username = "client"
+	clientConfig.Net.SASL.GSSAPI.AuthType = KRB5_USER_AUTH
+	clientConfig.Net.SASL.GSSAPI.Password = "qwerty"
+	client, err := createClient(&clientConfig.Net.SASL.GSSAPI, kerberosConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiry := client.TGTExpiry(); !expiry.IsZero() {
+		t.Errorf("expected no TGT expiry before login, got %s", expiry)
+	}
+
+	ccacheBytes, err := hex.DecodeString(testdata.CCACHE_TEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccachePath := filepath.Join(t.TempDir(), "krb5.ccache")
+	if err := os.WriteFile(ccachePath, ccacheBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ccache, err := credentials.LoadCCache(ccachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt, ok := ccache.GetEntry(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/TEST.GOKRB5"))
+	if !ok {
+		t.Fatal("expected a TGT in the credentials cache")
+	}
+
+	clientConfig.Net.SASL.GSSAPI.AuthType = KRB5_CCACHE_AUTH
+	clientConfig.Net.SASL.GSSAPI.CCachePath = ccachePath
+	client, err = createClient(&clientConfig.Net.SASL.GSSAPI, kerberosConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiry := client.TGTExpiry(); !expiry.Equal(tgt.EndTime) {
+		t.Errorf("expected the TGT expiry %s, got %s", tgt.EndTime, expiry)
+	}
+}
+
+func TestKerberosClientForwardedTGTReq(t *testing.T) {
+	kerberosConfig, err := krbcfg.NewFromString(krb5cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewMockKerberosClient()
+	if err := client.login(); err != nil {
+		t.Fatal(err)
+	}
+	tgt, tgtKey, _ := client.GetServiceTicket("krbtgt/TEST.GOKRB5")
+
+	tgsReq, err := newForwardedTGTReq(client.CName(), "TEST.GOKRB5", kerberosConfig, tgt, tgtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !types.IsFlagSet(&tgsReq.ReqBody.KDCOptions, flags.Forwarded) || !types.IsFlagSet(&tgsReq.ReqBody.KDCOptions, flags.Forwardable) {
+		t.Errorf("expected the FORWARDED and FORWARDABLE options, got %x", tgsReq.ReqBody.KDCOptions.Bytes)
+	}
+	if name := tgsReq.ReqBody.SName.PrincipalNameString(); name != "krbtgt/TEST.GOKRB5" {
+		t.Errorf("expected a TGT to be requested, got %s", name)
+	}
+
+	// the authenticator checksum covers the body with the options set
+	if len(tgsReq.PAData) != 1 || tgsReq.PAData[0].PADataType != patype.PA_TGS_REQ {
+		t.Fatalf("expected a PA-TGS-REQ, got %+v", tgsReq.PAData)
+	}
+	var apReq messages.APReq
+	if err := apReq.Unmarshal(tgsReq.PAData[0].PADataValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := apReq.DecryptAuthenticator(tgtKey); err != nil {
+		t.Fatal(err)
+	}
+	body, err := tgsReq.ReqBody.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	etype, err := crypto.GetEtype(tgtKey.KeyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !etype.VerifyChecksum(tgtKey.KeyValue, body, apReq.Authenticator.Cksum.Checksum, keyusage.TGS_REQ_PA_TGS_REQ_AP_REQ_AUTHENTICATOR_CHKSUM) {
+		t.Error("expected the authenticator checksum to cover the request body")
+	}
+}
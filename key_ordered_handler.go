@@ -0,0 +1,303 @@
+package sarama
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// KeyOrderedHandler handles the messages of a consumer group session one at a
+// time, in timestamp order across the claimed partitions, see
+// NewKeyOrderedHandler.
+type KeyOrderedHandler interface {
+	// Setup is run at the beginning of a new session, before any message is
+	// handled.
+	Setup(ConsumerGroupSession) error
+
+	// Cleanup is run at the end of a session, once the messages still buffered
+	// have been handled but before the offsets are committed for the very
+	// last time.
+	Cleanup(ConsumerGroupSession) error
+
+	// ConsumeMessage handles a message. Marking it, e.g. with
+	// ConsumerGroupSession.MarkMessage, is left to the handler. An error stops
+	// the consumption of the partition of the message for the rest of the
+	// session, dropping its buffered messages, and is reported like the errors
+	// returned by ConsumerGroupHandler.ConsumeClaim.
+	ConsumeMessage(ConsumerGroupSession, *ConsumerMessage) error
+}
+
+// NewKeyOrderedHandler returns a ConsumerGroupHandler handing the messages of
+// all the claims of a session to handler in timestamp order, so that the
+// messages of a key are handled in order even when they are spread across
+// partitions, e.g. after partitions were added to a topic. The messages of a
+// partition are always handled in offset order, and messages without a
+// timestamp are ordered by the time they were received.
+//
+// Each message is held back for at least window after it was received, so
+// that a message of another partition received within window is handled first
+// if it has an earlier timestamp: window must cover how far apart the
+// partitions are consumed, and delays every message by as much. At most
+// maxBuffered messages are held back, which bounds the memory used: once it is
+// reached, the earliest message is handled right away, possibly out of order,
+// and the claims are not read until there is room again. As the messages are
+// handled one at a time from a single goroutine, the throughput of the
+// session is that of handler.
+func NewKeyOrderedHandler(handler KeyOrderedHandler, window time.Duration, maxBuffered int) ConsumerGroupHandler {
+	if maxBuffered < 1 {
+		maxBuffered = 1
+	}
+	return &keyOrderedHandler{
+		handler:     handler,
+		window:      window,
+		maxBuffered: maxBuffered,
+		sessions:    make(map[ConsumerGroupSession]*keyOrderedSession),
+	}
+}
+
+type keyOrderedHandler struct {
+	handler     KeyOrderedHandler
+	window      time.Duration
+	maxBuffered int
+
+	lock     sync.Mutex
+	sessions map[ConsumerGroupSession]*keyOrderedSession
+}
+
+func (h *keyOrderedHandler) Setup(sess ConsumerGroupSession) error {
+	s := &keyOrderedSession{
+		parent:     h,
+		sess:       sess,
+		clock:      sessionClock(sess),
+		partitions: make(map[string]map[int32]*keyOrderedPartition),
+		wake:       make(chan none, 1),
+		done:       make(chan none),
+	}
+	s.space = sync.NewCond(&s.lock)
+
+	h.lock.Lock()
+	h.sessions[sess] = s
+	h.lock.Unlock()
+
+	goWithRecover(sessionMetricRegistry(sess), s.dispatch)
+	return h.handler.Setup(sess)
+}
+
+func (h *keyOrderedHandler) Cleanup(sess ConsumerGroupSession) error {
+	h.lock.Lock()
+	s := h.sessions[sess]
+	delete(h.sessions, sess)
+	h.lock.Unlock()
+
+	if s != nil {
+		s.flush()
+	}
+	return h.handler.Cleanup(sess)
+}
+
+func (h *keyOrderedHandler) ConsumeClaim(sess ConsumerGroupSession, claim ConsumerGroupClaim) error {
+	h.lock.Lock()
+	s := h.sessions[sess]
+	h.lock.Unlock()
+
+	p := s.partition(claim.Topic(), claim.Partition())
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			if err := s.push(p, msg); err != nil {
+				return err
+			}
+		case <-p.failed:
+			return p.error()
+		}
+	}
+}
+
+// keyOrderedSession buffers the messages of a session until they are due.
+type keyOrderedSession struct {
+	parent *keyOrderedHandler
+	sess   ConsumerGroupSession
+	clock  clock
+
+	lock       sync.Mutex
+	space      *sync.Cond // signalled when messages leave the buffer
+	pending    keyOrderedQueue
+	seq        uint64
+	flushing   bool
+	partitions map[string]map[int32]*keyOrderedPartition
+
+	wake chan none // signals the dispatcher that the buffer changed
+	done chan none // closed once the dispatcher exited
+}
+
+// keyOrderedPartition is the state of a claimed partition.
+type keyOrderedPartition struct {
+	last   time.Time // the timestamp the last message was ordered by
+	err    error
+	failed chan none // closed once err is set
+}
+
+func (p *keyOrderedPartition) error() error {
+	<-p.failed
+	return p.err
+}
+
+type keyOrderedMessage struct {
+	msg       *ConsumerMessage
+	partition *keyOrderedPartition
+	timestamp time.Time
+	due       time.Time
+	seq       uint64
+}
+
+// keyOrderedQueue is a heap of the buffered messages, by timestamp and then
+// by order of arrival.
+type keyOrderedQueue []*keyOrderedMessage
+
+func (q keyOrderedQueue) Len() int { return len(q) }
+
+func (q keyOrderedQueue) Less(i, j int) bool {
+	if !q[i].timestamp.Equal(q[j].timestamp) {
+		return q[i].timestamp.Before(q[j].timestamp)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q keyOrderedQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *keyOrderedQueue) Push(x interface{}) { *q = append(*q, x.(*keyOrderedMessage)) }
+
+func (q *keyOrderedQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	m := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return m
+}
+
+func (s *keyOrderedSession) partition(topic string, partition int32) *keyOrderedPartition {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.partitions[topic] == nil {
+		s.partitions[topic] = make(map[int32]*keyOrderedPartition)
+	}
+	p := s.partitions[topic][partition]
+	if p == nil {
+		p = &keyOrderedPartition{failed: make(chan none)}
+		s.partitions[topic][partition] = p
+	}
+	return p
+}
+
+// push buffers the message, waiting for room if the buffer is full.
+func (s *keyOrderedSession) push(p *keyOrderedPartition, msg *ConsumerMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.pending) >= s.parent.maxBuffered && p.err == nil {
+		s.space.Wait()
+	}
+	if p.err != nil {
+		return p.err
+	}
+
+	now := s.clock.Now()
+	timestamp := msg.Timestamp
+	if timestamp.IsZero() {
+		timestamp = now
+	}
+	// never order a message before an earlier one of the same partition
+	if timestamp.Before(p.last) {
+		timestamp = p.last
+	}
+	p.last = timestamp
+
+	s.seq++
+	heap.Push(&s.pending, &keyOrderedMessage{
+		msg:       msg,
+		partition: p,
+		timestamp: timestamp,
+		due:       now.Add(s.parent.window),
+		seq:       s.seq,
+	})
+	s.signal()
+	return nil
+}
+
+func (s *keyOrderedSession) signal() {
+	select {
+	case s.wake <- none{}:
+	default:
+	}
+}
+
+// flush hands the buffered messages over without waiting for them to be due,
+// and stops the dispatcher.
+func (s *keyOrderedSession) flush() {
+	s.lock.Lock()
+	s.flushing = true
+	s.lock.Unlock()
+	s.signal()
+	<-s.done
+}
+
+// next waits for the earliest message to be due, or returns nil once the
+// buffer has been flushed.
+func (s *keyOrderedSession) next() *keyOrderedMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for {
+		if len(s.pending) == 0 {
+			if s.flushing {
+				return nil
+			}
+			s.lock.Unlock()
+			<-s.wake
+			s.lock.Lock()
+			continue
+		}
+
+		wait := s.pending[0].due.Sub(s.clock.Now())
+		if s.flushing || len(s.pending) >= s.parent.maxBuffered || wait <= 0 {
+			m := heap.Pop(&s.pending).(*keyOrderedMessage)
+			s.space.Broadcast()
+			return m
+		}
+
+		s.lock.Unlock()
+		timer := s.clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-s.wake:
+			timer.Stop()
+		}
+		s.lock.Lock()
+	}
+}
+
+func (s *keyOrderedSession) dispatch() {
+	defer close(s.done)
+
+	for m := s.next(); m != nil; m = s.next() {
+		s.lock.Lock()
+		failed := m.partition.err != nil
+		s.lock.Unlock()
+		if failed {
+			continue
+		}
+
+		if err := s.parent.handler.ConsumeMessage(s.sess, m.msg); err != nil {
+			s.lock.Lock()
+			m.partition.err = err
+			close(m.partition.failed)
+			s.space.Broadcast()
+			s.lock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package sarama
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeGroupSession struct {
+	lock   sync.Mutex
+	marked map[int32]int64 // the marked offset by partition
+	clock  clock           // the real clock if nil
+}
+
+func (s *fakeGroupSession) Claims() map[string][]int32               { return nil }
+func (s *fakeGroupSession) MemberID() string                         { return "" }
+func (s *fakeGroupSession) GenerationID() int32                      { return 0 }
+func (s *fakeGroupSession) Commit()                                  {}
+func (s *fakeGroupSession) ResetOffset(string, int32, int64, string) {}
+func (s *fakeGroupSession) Context() context.Context                 { return context.Background() }
+func (s *fakeGroupSession) Lag() map[string]map[int32]int64          { return nil }
+
+func (s *fakeGroupSession) getClock() clock {
+	if s.clock == nil {
+		return realClock{}
+	}
+	return s.clock
+}
+
+func (s *fakeGroupSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.marked == nil {
+		s.marked = make(map[int32]int64)
+	}
+	if offset > s.marked[partition] {
+		s.marked[partition] = offset
+	}
+}
+
+func (s *fakeGroupSession) MarkMessage(msg *ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+type fakeGroupClaim struct {
+	partition int32
+	messages  chan *ConsumerMessage
+}
+
+func (c *fakeGroupClaim) Topic() string                       { return "my_topic" }
+func (c *fakeGroupClaim) Partition() int32                    { return c.partition }
+func (c *fakeGroupClaim) InitialOffset() int64                { return 0 }
+func (c *fakeGroupClaim) HighWaterMarkOffset() int64          { return 0 }
+func (c *fakeGroupClaim) Lag() int64                          { return 0 }
+func (c *fakeGroupClaim) Messages() <-chan *ConsumerMessage   { return c.messages }
+func (c *fakeGroupClaim) DecodeErrors() <-chan *ConsumerError { return nil }
+func (c *fakeGroupClaim) send(offset int64, key string, ts int) {
+	c.messages <- &ConsumerMessage{
+		Topic:     "my_topic",
+		Partition: c.partition,
+		Offset:    offset,
+		Key:       []byte(key),
+		Timestamp: time.Unix(int64(ts), 0),
+	}
+}
+
+type recordingKeyOrderedHandler struct {
+	lock    sync.Mutex
+	handled []string
+	failOn  string
+}
+
+func (h *recordingKeyOrderedHandler) Setup(ConsumerGroupSession) error   { return nil }
+func (h *recordingKeyOrderedHandler) Cleanup(ConsumerGroupSession) error { return nil }
+
+func (h *recordingKeyOrderedHandler) ConsumeMessage(_ ConsumerGroupSession, msg *ConsumerMessage) error {
+	handled := fmt.Sprintf("%s@%d/%d", msg.Key, msg.Partition, msg.Offset)
+	if handled == h.failOn {
+		return errors.New("failed " + handled)
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.handled = append(h.handled, handled)
+	return nil
+}
+
+// runFakeGroupSession runs a session of handler over the claims, feeding them
+// with feed, and returns the session along with the errors of each claim.
+func runFakeGroupSession(t *testing.T, handler ConsumerGroupHandler, claims []*fakeGroupClaim, feed func()) (*fakeGroupSession, []error) {
+	t.Helper()
+	sess := &fakeGroupSession{}
+	if err := handler.Setup(sess); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make([]error, len(claims))
+	var wg sync.WaitGroup
+	for i, claim := range claims {
+		wg.Add(1)
+		go func(i int, claim *fakeGroupClaim) {
+			defer wg.Done()
+			errs[i] = handler.ConsumeClaim(sess, claim)
+		}(i, claim)
+	}
+
+	feed()
+	for _, claim := range claims {
+		close(claim.messages)
+	}
+	wg.Wait()
+
+	if err := handler.Cleanup(sess); err != nil {
+		t.Fatal(err)
+	}
+	return sess, errs
+}
+
+func newFakeGroupClaims(n int) []*fakeGroupClaim {
+	claims := make([]*fakeGroupClaim, n)
+	for i := range claims {
+		claims[i] = &fakeGroupClaim{partition: int32(i), messages: make(chan *ConsumerMessage, 10)}
+	}
+	return claims
+}
+
+func TestKeyOrderedHandlerInterleavedKeys(t *testing.T) {
+	recorder := &recordingKeyOrderedHandler{}
+	claims := newFakeGroupClaims(2)
+	handler := NewKeyOrderedHandler(recorder, 200*time.Millisecond, 100)
+
+	runFakeGroupSession(t, handler, claims, func() {
+		// the old partition of the keys is consumed ahead of the new one
+		claims[0].send(0, "a", 1)
+		claims[0].send(1, "b", 3)
+		claims[0].send(2, "a", 5)
+		time.Sleep(20 * time.Millisecond)
+		claims[1].send(0, "a", 2)
+		claims[1].send(1, "b", 4)
+		claims[1].send(2, "a", 6)
+		time.Sleep(400 * time.Millisecond)
+	})
+
+	expected := []string{"a@0/0", "a@1/0", "b@0/1", "b@1/1", "a@0/2", "a@1/2"}
+	if !reflect.DeepEqual(recorder.handled, expected) {
+		t.Errorf("expected the messages to be handled in timestamp order %v, got %v", expected, recorder.handled)
+	}
+}
+
+func TestKeyOrderedHandlerKeepsPartitionOrder(t *testing.T) {
+	recorder := &recordingKeyOrderedHandler{}
+	claims := newFakeGroupClaims(2)
+	handler := NewKeyOrderedHandler(recorder, time.Hour, 100)
+
+	runFakeGroupSession(t, handler, claims, func() {
+		claims[0].send(0, "a", 5)
+		claims[0].send(1, "a", 3) // an earlier timestamp than the previous offset
+		claims[1].send(0, "b", 4)
+	})
+
+	// the buffered messages are flushed by Cleanup without waiting an hour
+	expected := []string{"b@1/0", "a@0/0", "a@0/1"}
+	if !reflect.DeepEqual(recorder.handled, expected) {
+		t.Errorf("expected the messages to be handled in order %v, got %v", expected, recorder.handled)
+	}
+}
+
+func TestKeyOrderedHandlerWindowFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	recorder := &recordingKeyOrderedHandler{}
+	claims := newFakeGroupClaims(1)
+	handler := NewKeyOrderedHandler(recorder, time.Hour, 100)
+
+	sess := &fakeGroupSession{clock: clock}
+	if err := handler.Setup(sess); err != nil {
+		t.Fatal(err)
+	}
+	consumed := make(chan error)
+	go func() { consumed <- handler.ConsumeClaim(sess, claims[0]) }()
+
+	claims[0].send(0, "a", 1)
+	clock.BlockUntil(t, 1)
+	time.Sleep(20 * time.Millisecond)
+	recorder.lock.Lock()
+	handled := len(recorder.handled)
+	recorder.lock.Unlock()
+	if handled != 0 {
+		t.Fatalf("expected the message to wait for its window, got %v", recorder.handled)
+	}
+
+	clock.Advance(time.Hour)
+	for start := time.Now(); handled == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected the message to be handled once its window elapsed")
+		}
+		recorder.lock.Lock()
+		handled = len(recorder.handled)
+		recorder.lock.Unlock()
+	}
+
+	close(claims[0].messages)
+	if err := <-consumed; err != nil {
+		t.Error(err)
+	}
+	if err := handler.Cleanup(sess); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeyOrderedHandlerMaxBuffered(t *testing.T) {
+	recorder := &recordingKeyOrderedHandler{}
+	claims := newFakeGroupClaims(1)
+	handler := NewKeyOrderedHandler(recorder, time.Hour, 2)
+
+	runFakeGroupSession(t, handler, claims, func() {
+		for offset := 0; offset < 4; offset++ {
+			claims[0].send(int64(offset), "a", offset)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			recorder.lock.Lock()
+			handled := len(recorder.handled)
+			recorder.lock.Unlock()
+			// a message is released each time the buffer fills up
+			if handled == 3 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Error("expected the messages beyond maxBuffered to be handled before their window elapsed")
+	})
+
+	if len(recorder.handled) != 4 {
+		t.Errorf("expected all the messages to be handled, got %v", recorder.handled)
+	}
+}
+
+func TestKeyOrderedHandlerError(t *testing.T) {
+	recorder := &recordingKeyOrderedHandler{failOn: "a@0/0"}
+	claims := newFakeGroupClaims(2)
+	handler := NewKeyOrderedHandler(recorder, 0, 100)
+
+	_, errs := runFakeGroupSession(t, handler, claims, func() {
+		claims[0].send(0, "a", 1)
+		time.Sleep(50 * time.Millisecond)
+		claims[0].send(1, "a", 2)
+		claims[1].send(0, "b", 3)
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	if errs[0] == nil || errs[0].Error() != "failed a@0/0" {
+		t.Errorf("expected the error of the handler to end the claim of partition 0, got %v", errs[0])
+	}
+	if errs[1] != nil {
+		t.Errorf("expected the claim of partition 1 to succeed, got %v", errs[1])
+	}
+	expected := []string{"b@1/0"}
+	if !reflect.DeepEqual(recorder.handled, expected) {
+		t.Errorf("expected only %v to be handled, got %v", expected, recorder.handled)
+	}
+}
@@ -0,0 +1,370 @@
+/*
+Package kmsenvelope encrypts the values of produced records with envelope
+encryption backed by a key management service.
+
+Each value is encrypted with AES-GCM under a data key generated by the KMS.
+The data key, wrapped by the master key of the KMS, and the ID of that master
+key travel in the record headers, so consumers holding permission to decrypt
+with the master key can unwrap the data key and decrypt the value. Data keys
+are cached for Config.DataKeyTTL, so that the KMS is only called once per TTL
+to encrypt, and once per data key and TTL to decrypt.
+
+The KMS is plugged in through the KeyProvider interface, which adapters for
+AWS KMS, GCP KMS or Vault transit implement.
+
+NOTE: this package currently does not fall under the API stability
+guarantee of Sarama as it is still considered experimental.
+*/
+package kmsenvelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/max444ks1m777/sarama"
+)
+
+const (
+	// HeaderDataKey is the header carrying the wrapped data key of a record.
+	HeaderDataKey = "kms-envelope-data-key"
+	// HeaderKeyID is the header carrying the ID of the master key the data
+	// key is wrapped with.
+	HeaderKeyID = "kms-envelope-key-id"
+
+	// version prefixes the encrypted values, followed by the nonce and the
+	// sealed value
+	version byte = 1
+)
+
+// ErrInvalidEnvelope is returned when decrypting a value that was not
+// encrypted by a ProducerInterceptor, or whose headers are missing.
+var ErrInvalidEnvelope = errors.New("kms envelope: invalid encrypted value")
+
+// ErrTypedValue fails the records with a TypedValue produced through a
+// ProducerInterceptor without Config.ValueSerializer, as the producer would
+// only serialize their value after the interceptors ran, unencrypted.
+var ErrTypedValue = errors.New("kms envelope: records with a TypedValue require Config.ValueSerializer")
+
+// KeyProvider generates and decrypts data keys with a KMS.
+type KeyProvider interface {
+	// GenerateDataKey returns a new AES data key of 16, 24 or 32 bytes, both
+	// in plaintext and wrapped by the master key, and the ID of that master
+	// key.
+	GenerateDataKey(ctx context.Context) (plaintext, wrapped []byte, keyID string, err error)
+
+	// DecryptDataKey returns the plaintext of a data key wrapped by the
+	// master key keyID.
+	DecryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Config configures the interceptors.
+type Config struct {
+	// KeyProvider generates and decrypts the data keys.
+	KeyProvider KeyProvider
+	// DataKeyTTL is how long a data key encrypts values before a new one is
+	// generated, and how long unwrapped data keys are cached to decrypt
+	// (defaults to 1 hour).
+	DataKeyTTL time.Duration
+	// Timeout bounds each call to the KeyProvider (defaults to 10 seconds).
+	Timeout time.Duration
+	// ValueSerializer serializes the TypedValue of produced records before
+	// they are encrypted, in place of Producer.ValueSerializer (default nil,
+	// records with a TypedValue fail with ErrTypedValue).
+	ValueSerializer sarama.Serializer
+	// ValueDeserializer fills in the TypedValue of consumed records once they
+	// are decrypted, in place of Consumer.ValueDeserializer which only sees
+	// the encrypted value (default nil, the TypedValue of decrypted records
+	// is left nil).
+	ValueDeserializer sarama.Deserializer
+}
+
+func (conf *Config) validate() error {
+	switch {
+	case conf.KeyProvider == nil:
+		return sarama.ConfigurationError("kmsenvelope.Config.KeyProvider must not be nil")
+	case conf.DataKeyTTL < 0:
+		return sarama.ConfigurationError("kmsenvelope.Config.DataKeyTTL must be >= 0")
+	case conf.Timeout < 0:
+		return sarama.ConfigurationError("kmsenvelope.Config.Timeout must be >= 0")
+	}
+	if conf.DataKeyTTL == 0 {
+		conf.DataKeyTTL = time.Hour
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// dataKey is a data key with the AEAD it encrypts with.
+type dataKey struct {
+	aead    cipher.AEAD
+	wrapped []byte
+	keyID   string
+	created time.Time
+}
+
+func newDataKey(plaintext, wrapped []byte, keyID string, created time.Time) (*dataKey, error) {
+	block, err := aes.NewCipher(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("kms envelope: invalid data key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{aead: aead, wrapped: wrapped, keyID: keyID, created: created}, nil
+}
+
+// ProducerInterceptor encrypts the values of the records it intercepts. Set
+// it in Producer.Interceptors.
+//
+// The producer serializes TypedValue after the interceptors run, so typed
+// values are serialized with Config.ValueSerializer before being encrypted
+// instead. If a value cannot be serialized or encrypted, the record fails
+// with the error on the Errors channel of the producer rather than being
+// sent in plaintext.
+type ProducerInterceptor struct {
+	conf Config
+	now  func() time.Time
+
+	lock sync.Mutex
+	key  *dataKey
+}
+
+// NewProducerInterceptor returns a ProducerInterceptor generating data keys
+// with conf.KeyProvider.
+func NewProducerInterceptor(conf Config) (*ProducerInterceptor, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return &ProducerInterceptor{conf: conf, now: time.Now}, nil
+}
+
+// OnSend implements sarama.ProducerInterceptor.
+func (p *ProducerInterceptor) OnSend(msg *sarama.ProducerMessage) {
+	if msg.TypedValue != nil {
+		typed := msg.TypedValue
+		// never leave the value to the serializers of the producer
+		msg.TypedValue = nil
+		if p.conf.ValueSerializer == nil {
+			msg.Value = failedEncoder{ErrTypedValue}
+			return
+		}
+		value, err := p.conf.ValueSerializer.Serialize(msg.Topic, typed)
+		if err != nil {
+			msg.Value = failedEncoder{fmt.Errorf("kafka: failed to serialize message value: %w", err)}
+			return
+		}
+		msg.Value = sarama.ByteEncoder(value)
+	}
+	if msg.Value == nil {
+		return
+	}
+	if _, ok := msg.Value.(sealedEncoder); ok {
+		// already encrypted before the record was retried
+		return
+	}
+	value, err := msg.Value.Encode()
+	if err != nil {
+		return
+	}
+
+	key, err := p.dataKey()
+	if err != nil {
+		msg.Value = failedEncoder{err}
+		return
+	}
+	nonce := make([]byte, key.aead.NonceSize(), 1+key.aead.NonceSize()+len(value)+key.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		msg.Value = failedEncoder{err}
+		return
+	}
+	sealed := key.aead.Seal(append([]byte{version}, nonce...), nonce, value, nil)
+
+	msg.Value = sealedEncoder(sealed)
+	// drop the envelope of a record forwarded from an encrypted topic, which
+	// no longer applies
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+2)
+	for _, h := range msg.Headers {
+		if string(h.Key) != HeaderDataKey && string(h.Key) != HeaderKeyID {
+			headers = append(headers, h)
+		}
+	}
+	msg.Headers = append(headers,
+		sarama.RecordHeader{Key: []byte(HeaderDataKey), Value: key.wrapped},
+		sarama.RecordHeader{Key: []byte(HeaderKeyID), Value: []byte(key.keyID)},
+	)
+}
+
+// dataKey returns the current data key, generating a new one once it has
+// been used for DataKeyTTL.
+func (p *ProducerInterceptor) dataKey() (*dataKey, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := p.now()
+	if p.key != nil && now.Sub(p.key.created) < p.conf.DataKeyTTL {
+		return p.key, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.conf.Timeout)
+	defer cancel()
+	plaintext, wrapped, keyID, err := p.conf.KeyProvider.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("kms envelope: failed to generate a data key: %w", err)
+	}
+	key, err := newDataKey(plaintext, wrapped, keyID, now)
+	if err != nil {
+		return nil, err
+	}
+	p.key = key
+	return key, nil
+}
+
+// ConsumerInterceptor decrypts the values of the records it intercepts that
+// were encrypted by a ProducerInterceptor, leaving other records untouched.
+// Set it in Consumer.Interceptors.
+//
+// The consumer deserializes records before the interceptors run, so the
+// TypedValue of decrypted records is filled in with Config.ValueDeserializer
+// instead. As interceptors cannot fail records, values which cannot be
+// decrypted are left encrypted, and the failure logged. Call Decrypt instead
+// to handle them.
+type ConsumerInterceptor struct {
+	conf Config
+	now  func() time.Time
+
+	lock sync.Mutex
+	keys map[string]*dataKey // by key ID and wrapped data key
+}
+
+// NewConsumerInterceptor returns a ConsumerInterceptor decrypting data keys
+// with conf.KeyProvider.
+func NewConsumerInterceptor(conf Config) (*ConsumerInterceptor, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return &ConsumerInterceptor{conf: conf, now: time.Now, keys: make(map[string]*dataKey)}, nil
+}
+
+// OnConsume implements sarama.ConsumerInterceptor.
+func (c *ConsumerInterceptor) OnConsume(msg *sarama.ConsumerMessage) {
+	if err := c.Decrypt(msg); err != nil {
+		sarama.Logger.Printf("kms envelope: failed to decrypt the record at offset %d of %s/%d: %v", msg.Offset, msg.Topic, msg.Partition, err)
+	}
+}
+
+// Decrypt decrypts the value of msg in place if it was encrypted by a
+// ProducerInterceptor, removing the headers of the envelope, and deserializes
+// it with Config.ValueDeserializer.
+func (c *ConsumerInterceptor) Decrypt(msg *sarama.ConsumerMessage) error {
+	keyID, wrapped := header(msg.Headers, HeaderKeyID), header(msg.Headers, HeaderDataKey)
+	if keyID == nil && wrapped == nil {
+		return nil
+	}
+	if keyID == nil || wrapped == nil {
+		return ErrInvalidEnvelope
+	}
+
+	key, err := c.dataKey(string(keyID.Value), wrapped.Value)
+	if err != nil {
+		return err
+	}
+	nonceSize := key.aead.NonceSize()
+	if len(msg.Value) < 1+nonceSize || msg.Value[0] != version {
+		return ErrInvalidEnvelope
+	}
+	value, err := key.aead.Open(nil, msg.Value[1:1+nonceSize], msg.Value[1+nonceSize:], nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+
+	msg.Value = value
+	headers := msg.Headers[:0]
+	for _, h := range msg.Headers {
+		if h != keyID && h != wrapped {
+			headers = append(headers, h)
+		}
+	}
+	msg.Headers = headers
+
+	// anything deserialized so far was deserialized from the encrypted value
+	msg.TypedValue = nil
+	if c.conf.ValueDeserializer != nil {
+		if msg.TypedValue, err = c.conf.ValueDeserializer.Deserialize(msg.Topic, value); err != nil {
+			return fmt.Errorf("kafka: failed to deserialize value of message at offset %d: %w", msg.Offset, err)
+		}
+	}
+	return nil
+}
+
+// dataKey returns the data key wrapped as wrapped by the master key keyID,
+// decrypting it unless it was within DataKeyTTL.
+func (c *ConsumerInterceptor) dataKey(keyID string, wrapped []byte) (*dataKey, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	cacheKey := keyID + "\x00" + string(wrapped)
+	if key, ok := c.keys[cacheKey]; ok && now.Sub(key.created) < c.conf.DataKeyTTL {
+		return key, nil
+	}
+	for k, key := range c.keys {
+		if now.Sub(key.created) >= c.conf.DataKeyTTL {
+			delete(c.keys, k)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.conf.Timeout)
+	defer cancel()
+	plaintext, err := c.conf.KeyProvider.DecryptDataKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("kms envelope: failed to decrypt the data key: %w", err)
+	}
+	key, err := newDataKey(plaintext, wrapped, keyID, now)
+	if err != nil {
+		return nil, err
+	}
+	c.keys[cacheKey] = key
+	return key, nil
+}
+
+func header(headers []*sarama.RecordHeader, key string) *sarama.RecordHeader {
+	for _, h := range headers {
+		if h != nil && string(h.Key) == key {
+			return h
+		}
+	}
+	return nil
+}
+
+// sealedEncoder is a value encrypted by a ProducerInterceptor, which is not
+// encrypted again when the record is retried.
+type sealedEncoder []byte
+
+func (e sealedEncoder) Encode() ([]byte, error) {
+	return e, nil
+}
+
+func (e sealedEncoder) Length() int {
+	return len(e)
+}
+
+// failedEncoder fails the record it is the value of with err.
+type failedEncoder struct {
+	err error
+}
+
+func (e failedEncoder) Encode() ([]byte, error) {
+	return nil, e.err
+}
+
+func (e failedEncoder) Length() int {
+	return 0
+}
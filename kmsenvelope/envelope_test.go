@@ -0,0 +1,367 @@
+package kmsenvelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/max444ks1m777/sarama"
+)
+
+// fakeKMS wraps data keys with AES-GCM under an in-memory master key,
+// counting the calls it serves.
+type fakeKMS struct {
+	lock      sync.Mutex
+	master    cipher.AEAD
+	generated int
+	decrypted int
+	err       error
+}
+
+func newFakeKMS(t *testing.T) *fakeKMS {
+	master := make([]byte, 32)
+	if _, err := rand.Read(master); err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeKMS{master: aead}
+}
+
+func (k *fakeKMS) GenerateDataKey(ctx context.Context) ([]byte, []byte, string, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.err != nil {
+		return nil, nil, "", k.err
+	}
+	k.generated++
+	plaintext := make([]byte, 32)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, nil, "", err
+	}
+	nonce := make([]byte, k.master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, "", err
+	}
+	return plaintext, k.master.Seal(nonce, nonce, plaintext, nil), "master-" + strconv.Itoa(k.generated), nil
+}
+
+func (k *fakeKMS) DecryptDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.decrypted++
+	size := k.master.NonceSize()
+	if len(wrapped) < size {
+		return nil, errors.New("invalid wrapped key")
+	}
+	return k.master.Open(nil, wrapped[:size], wrapped[size:], nil)
+}
+
+// consumed returns the message a consumer receives for msg.
+func consumed(t *testing.T, msg *sarama.ProducerMessage) *sarama.ConsumerMessage {
+	t.Helper()
+	value, err := msg.Value.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &sarama.ConsumerMessage{Topic: msg.Topic, Value: value}
+	for i := range msg.Headers {
+		res.Headers = append(res.Headers, &msg.Headers[i])
+	}
+	return res
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	kms := newFakeKMS(t)
+	producer, err := NewProducerInterceptor(Config{KeyProvider: kms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, err := NewConsumerInterceptor(Config{KeyProvider: kms})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		msg := &sarama.ProducerMessage{
+			Topic:   "orders",
+			Value:   sarama.StringEncoder("order " + strconv.Itoa(i)),
+			Headers: []sarama.RecordHeader{{Key: []byte("trace"), Value: []byte("abc")}},
+		}
+		producer.OnSend(msg)
+		encrypted, _ := msg.Value.Encode()
+		if bytes.Contains(encrypted, []byte("order")) {
+			t.Fatalf("expected the value to be encrypted, got %q", encrypted)
+		}
+
+		// a retried record is not encrypted again
+		producer.OnSend(msg)
+		if retried, _ := msg.Value.Encode(); !bytes.Equal(retried, encrypted) || len(msg.Headers) != 3 {
+			t.Fatalf("expected a retried record to be left as is, got %d headers", len(msg.Headers))
+		}
+
+		res := consumed(t, msg)
+		consumer.OnConsume(res)
+		if string(res.Value) != "order "+strconv.Itoa(i) {
+			t.Errorf("expected the value to be decrypted, got %q", res.Value)
+		}
+		if len(res.Headers) != 1 || string(res.Headers[0].Key) != "trace" {
+			t.Errorf("expected only the headers of the record to be left, got %d", len(res.Headers))
+		}
+	}
+	if kms.generated != 1 || kms.decrypted != 1 {
+		t.Errorf("expected the data key to be generated and decrypted once, got %d and %d", kms.generated, kms.decrypted)
+	}
+
+	plain := &sarama.ConsumerMessage{Value: []byte("plaintext")}
+	if err := consumer.Decrypt(plain); err != nil || string(plain.Value) != "plaintext" {
+		t.Errorf("expected a record without envelope to be left as is, got %q (%v)", plain.Value, err)
+	}
+}
+
+func TestEnvelopeStaleKeyIDHeader(t *testing.T) {
+	kms := newFakeKMS(t)
+	producer, err := NewProducerInterceptor(Config{KeyProvider: kms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, err := NewConsumerInterceptor(Config{KeyProvider: kms})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a record forwarded from an encrypted topic, or whose producer set the
+	// header, is still encrypted
+	msg := &sarama.ProducerMessage{
+		Topic: "orders",
+		Value: sarama.StringEncoder("order 1"),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(HeaderKeyID), Value: []byte("stale")},
+			{Key: []byte(HeaderDataKey), Value: []byte("stale")},
+		},
+	}
+	producer.OnSend(msg)
+	encrypted, _ := msg.Value.Encode()
+	if bytes.Contains(encrypted, []byte("order")) {
+		t.Fatalf("expected the value to be encrypted, got %q", encrypted)
+	}
+	if len(msg.Headers) != 2 || string(msg.Headers[1].Value) != "master-1" {
+		t.Fatalf("expected the stale envelope headers to be replaced, got %v", msg.Headers)
+	}
+
+	res := consumed(t, msg)
+	if err := consumer.Decrypt(res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Value) != "order 1" {
+		t.Errorf("expected the value to be decrypted, got %q", res.Value)
+	}
+}
+
+func TestEnvelopeDataKeyTTL(t *testing.T) {
+	kms := newFakeKMS(t)
+	now := time.Now()
+	producer, _ := NewProducerInterceptor(Config{KeyProvider: kms, DataKeyTTL: time.Minute})
+	producer.now = func() time.Time { return now }
+	consumer, _ := NewConsumerInterceptor(Config{KeyProvider: kms, DataKeyTTL: time.Minute})
+	consumer.now = func() time.Time { return now }
+
+	send := func() *sarama.ConsumerMessage {
+		msg := &sarama.ProducerMessage{Topic: "orders", Value: sarama.StringEncoder("order")}
+		producer.OnSend(msg)
+		res := consumed(t, msg)
+		if err := consumer.Decrypt(res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	send()
+	now = now.Add(59 * time.Second)
+	send()
+	if kms.generated != 1 || kms.decrypted != 1 {
+		t.Fatalf("expected the data key to be cached within its TTL, got %d generated and %d decrypted", kms.generated, kms.decrypted)
+	}
+	now = now.Add(time.Second)
+	send()
+	if kms.generated != 2 || kms.decrypted != 2 {
+		t.Errorf("expected the data key to be rotated after its TTL, got %d generated and %d decrypted", kms.generated, kms.decrypted)
+	}
+	if len(consumer.keys) != 1 {
+		t.Errorf("expected the expired data key to be evicted, got %d cached", len(consumer.keys))
+	}
+}
+
+func TestEnvelopeFailures(t *testing.T) {
+	kms := newFakeKMS(t)
+	kms.err = errors.New("kms unavailable")
+	producer, _ := NewProducerInterceptor(Config{KeyProvider: kms})
+	msg := &sarama.ProducerMessage{Topic: "orders", Value: sarama.StringEncoder("order")}
+	producer.OnSend(msg)
+	if _, err := msg.Value.Encode(); !errors.Is(err, kms.err) {
+		t.Errorf("expected the record to fail rather than be sent in plaintext, got %v", err)
+	}
+
+	kms.err = nil
+	msg = &sarama.ProducerMessage{Topic: "orders", Value: sarama.StringEncoder("order")}
+	producer.OnSend(msg)
+	res := consumed(t, msg)
+	res.Value[len(res.Value)-1] ^= 1
+	consumer, _ := NewConsumerInterceptor(Config{KeyProvider: kms})
+	if err := consumer.Decrypt(res); !errors.Is(err, ErrInvalidEnvelope) {
+		t.Errorf("expected a tampered value to be rejected, got %v", err)
+	}
+
+	res = consumed(t, msg)
+	res.Headers = res.Headers[:1]
+	if err := consumer.Decrypt(res); !errors.Is(err, ErrInvalidEnvelope) {
+		t.Errorf("expected a missing header to be rejected, got %v", err)
+	}
+
+	if _, err := NewProducerInterceptor(Config{}); err == nil {
+		t.Error("expected a KeyProvider to be required")
+	}
+}
+
+// jsonSerde serializes and deserializes values as JSON.
+type jsonSerde struct{}
+
+func (jsonSerde) Serialize(topic string, data interface{}) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+func (jsonSerde) Deserialize(topic string, data []byte) (interface{}, error) {
+	var v map[string]string
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// recordingProxy forwards connections to addr, recording what the clients
+// send.
+type recordingProxy struct {
+	net.Listener
+	lock sync.Mutex
+	sent bytes.Buffer
+}
+
+func newRecordingProxy(t *testing.T, addr string) *recordingProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &recordingProxy{Listener: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.MultiWriter(upstream, p), conn)
+				_ = upstream.Close()
+			}()
+			go func() {
+				_, _ = io.Copy(conn, upstream)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return p
+}
+
+func (p *recordingProxy) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.sent.Write(b)
+}
+
+func (p *recordingProxy) contains(b []byte) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return bytes.Contains(p.sent.Bytes(), b)
+}
+
+func TestEnvelopeTypedValue(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 0)
+	defer broker.Close()
+	proxy := newRecordingProxy(t, broker.Addr())
+	defer proxy.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(proxy.Addr().String(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+
+	kms := newFakeKMS(t)
+	interceptor, _ := NewProducerInterceptor(Config{KeyProvider: kms})
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_1_0_0
+	config.Producer.Return.Successes = true
+	config.Producer.Retry.Max = 0
+	config.Producer.ValueSerializer = jsonSerde{}
+	config.Producer.Interceptors = []sarama.ProducerInterceptor{interceptor}
+	producer, err := sarama.NewAsyncProducer([]string{proxy.Addr().String()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without its own serializer, the interceptor fails typed values
+	producer.Input() <- &sarama.ProducerMessage{Topic: "orders", TypedValue: map[string]string{"order": "plaintext-1"}}
+	select {
+	case perr := <-producer.Errors():
+		if !errors.Is(perr.Err, ErrTypedValue) {
+			t.Errorf("expected ErrTypedValue, got %v", perr.Err)
+		}
+	case <-producer.Successes():
+		t.Error("expected a typed value to fail without Config.ValueSerializer")
+	}
+
+	interceptor.conf.ValueSerializer = jsonSerde{}
+	producer.Input() <- &sarama.ProducerMessage{Topic: "orders", TypedValue: map[string]string{"order": "plaintext-2"}}
+	var msg *sarama.ProducerMessage
+	select {
+	case perr := <-producer.Errors():
+		t.Fatal(perr.Err)
+	case msg = <-producer.Successes():
+	}
+	if err := producer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, plaintext := range []string{"plaintext-1", "plaintext-2"} {
+		if proxy.contains([]byte(plaintext)) {
+			t.Errorf("expected %s never to reach the broker in clear", plaintext)
+		}
+	}
+	consumer, _ := NewConsumerInterceptor(Config{KeyProvider: kms, ValueDeserializer: jsonSerde{}})
+	res := consumed(t, msg)
+	res.TypedValue = "deserialized from the encrypted value"
+	if err := consumer.Decrypt(res); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := res.TypedValue.(map[string]string); !ok || v["order"] != "plaintext-2" {
+		t.Errorf("expected the decrypted value to be deserialized, got %v", res.TypedValue)
+	}
+}
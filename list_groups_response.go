@@ -1,17 +1,38 @@
 package sarama
 
 type ListGroupsResponse struct {
-	Version      int16
-	ThrottleTime int32
-	Err          KError
-	Groups       map[string]string
-	GroupsData   map[string]GroupData // version 4 or later
+	Version             int16
+	ThrottleTime        int32
+	Err                 KError
+	Groups              map[string]string
+	GroupsData          map[string]GroupData // version 4 or later
+	unknownTaggedFields taggedFields
 }
 
 type GroupData struct {
 	GroupState string // version 4 or later
 }
 
+// ConsumerGroupState is the state of a consumer group as reported by the
+// group coordinator.
+type ConsumerGroupState string
+
+const (
+	ConsumerGroupStatePreparingRebalance  ConsumerGroupState = "PreparingRebalance"
+	ConsumerGroupStateCompletingRebalance ConsumerGroupState = "CompletingRebalance"
+	ConsumerGroupStateStable              ConsumerGroupState = "Stable"
+	ConsumerGroupStateDead                ConsumerGroupState = "Dead"
+	ConsumerGroupStateEmpty               ConsumerGroupState = "Empty"
+)
+
+// ConsumerGroupListing is a group returned by ClusterAdmin.ListConsumerGroupListings.
+type ConsumerGroupListing struct {
+	ProtocolType string
+	// State is only set by brokers supporting ListGroups v4 (Kafka 2.6+),
+	// or when the listing was filtered by state.
+	State ConsumerGroupState
+}
+
 func (r *ListGroupsResponse) encode(pe packetEncoder) error {
 	if r.Version >= 1 {
 		pe.putInt32(r.ThrottleTime)
@@ -47,6 +68,12 @@ func (r *ListGroupsResponse) encode(pe packetEncoder) error {
 					return err
 				}
 			}
+
+			pe.putEmptyTaggedFieldArray()
+		}
+
+		if err := pe.putTaggedFieldArray(r.unknownTaggedFields); err != nil {
+			return err
 		}
 	}
 
@@ -128,7 +155,7 @@ func (r *ListGroupsResponse) decode(pd packetDecoder, version int16) error {
 	}
 
 	if r.Version >= 3 {
-		if _, err = pd.getEmptyTaggedFieldArray(); err != nil {
+		if r.unknownTaggedFields, err = pd.getTaggedFieldArray(); err != nil {
 			return err
 		}
 	}
@@ -83,3 +83,12 @@ func TestListGroupsResponse(t *testing.T) {
 		t.Error("Expected foo grup to have empty state")
 	}
 }
+
+func TestListGroupsResponseEncodeV4(t *testing.T) {
+	response := &ListGroupsResponse{
+		Version:    4,
+		Groups:     map[string]string{"foo": "consumer"},
+		GroupsData: map[string]GroupData{"foo": {GroupState: "Empty"}},
+	}
+	testEncodable(t, "v4", response, listGroupResponseV4)
+}
@@ -45,11 +45,12 @@ func (b *PartitionReplicaReassignmentsStatus) decode(pd packetDecoder) (err erro
 }
 
 type ListPartitionReassignmentsResponse struct {
-	Version        int16
-	ThrottleTimeMs int32
-	ErrorCode      KError
-	ErrorMessage   *string
-	TopicStatus    map[string]map[int32]*PartitionReplicaReassignmentsStatus
+	Version             int16
+	ThrottleTimeMs      int32
+	ErrorCode           KError
+	ErrorMessage        *string
+	TopicStatus         map[string]map[int32]*PartitionReplicaReassignmentsStatus
+	unknownTaggedFields taggedFields
 }
 
 func (r *ListPartitionReassignmentsResponse) AddBlock(topic string, partition int32, replicas, addingReplicas, removingReplicas []int32) {
@@ -88,7 +89,9 @@ func (r *ListPartitionReassignmentsResponse) encode(pe packetEncoder) error {
 		pe.putEmptyTaggedFieldArray()
 	}
 
-	pe.putEmptyTaggedFieldArray()
+	if err := pe.putTaggedFieldArray(r.unknownTaggedFields); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -147,7 +150,7 @@ func (r *ListPartitionReassignmentsResponse) decode(pd packetDecoder, version in
 			return err
 		}
 	}
-	if _, err := pd.getEmptyTaggedFieldArray(); err != nil {
+	if r.unknownTaggedFields, err = pd.getTaggedFieldArray(); err != nil {
 		return err
 	}
 
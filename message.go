@@ -64,6 +64,32 @@ func (cc CompressionCodec) MarshalText() ([]byte, error) {
 	return []byte(cc.String()), nil
 }
 
+// TimestampType describes where the timestamp of a message comes from.
+type TimestampType int8
+
+const (
+	// TimestampTypeNone is used for messages without a timestamp (before Kafka 0.10)
+	TimestampTypeNone TimestampType = -1
+	// TimestampTypeCreateTime is used when the timestamp was set by the producer
+	TimestampTypeCreateTime TimestampType = 0
+	// TimestampTypeLogAppendTime is used when the timestamp was assigned by the
+	// broker, for topics configured with `message.timestamp.type=LogAppendTime`
+	TimestampTypeLogAppendTime TimestampType = 1
+)
+
+func (t TimestampType) String() string {
+	switch t {
+	case TimestampTypeNone:
+		return "NoTimestampType"
+	case TimestampTypeCreateTime:
+		return "CreateTime"
+	case TimestampTypeLogAppendTime:
+		return "LogAppendTime"
+	default:
+		return fmt.Sprintf("TimestampType(%d)", int8(t))
+	}
+}
+
 // Message is a kafka message type
 type Message struct {
 	Codec            CompressionCodec // codec used to compress the message contents
@@ -190,6 +190,8 @@ func (t *TopicMetadata) decode(pd packetDecoder, version int16) (err error) {
 	}
 	if err != nil {
 		return err
+	} else if n < 0 {
+		return errInvalidArrayLength
 	} else {
 		t.Partitions = make([]*PartitionMetadata, n)
 		for i := 0; i < n; i++ {
@@ -281,6 +283,7 @@ type MetadataResponse struct {
 	// Topics contains each topic in the response.
 	Topics                      []*TopicMetadata
 	ClusterAuthorizedOperations int32 // Only valid for Version >= 8
+	unknownTaggedFields         taggedFields
 }
 
 func (r *MetadataResponse) decode(pd packetDecoder, version int16) (err error) {
@@ -300,6 +303,9 @@ func (r *MetadataResponse) decode(pd packetDecoder, version int16) (err error) {
 	if err != nil {
 		return err
 	}
+	if brokerArrayLen < 0 {
+		return errInvalidArrayLength
+	}
 
 	r.Brokers = make([]*Broker, brokerArrayLen)
 	for i := 0; i < brokerArrayLen; i++ {
@@ -336,6 +342,9 @@ func (r *MetadataResponse) decode(pd packetDecoder, version int16) (err error) {
 	if err != nil {
 		return err
 	}
+	if topicArrayLen < 0 {
+		return errInvalidArrayLength
+	}
 
 	r.Topics = make([]*TopicMetadata, topicArrayLen)
 	for i := 0; i < topicArrayLen; i++ {
@@ -354,7 +363,7 @@ func (r *MetadataResponse) decode(pd packetDecoder, version int16) (err error) {
 	}
 
 	if r.Version >= 9 {
-		_, err := pd.getEmptyTaggedFieldArray()
+		r.unknownTaggedFields, err = pd.getTaggedFieldArray()
 		if err != nil {
 			return err
 		}
@@ -421,7 +430,9 @@ func (r *MetadataResponse) encode(pe packetEncoder) (err error) {
 	}
 
 	if r.Version >= 9 {
-		pe.putEmptyTaggedFieldArray()
+		if err := pe.putTaggedFieldArray(r.unknownTaggedFields); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -40,7 +41,9 @@ type RequestNotifierFunc func(bytesRead, bytesWritten int)
 // localhost port that can accept many connections. It reads Kafka requests
 // from that connection and returns responses programmed by the SetHandlerByMap
 // function. If a MockBroker receives a request that it has no programmed
-// response for, then it returns nothing and the request times out.
+// response for, then it returns nothing and the request times out. The one
+// exception is ApiVersionsRequest, which is answered with the versions of
+// NewMockApiVersionsResponse unless the test programs a response for it.
 //
 // A set of MockRequest builders to define mappings used by MockBroker is
 // provided by Sarama. But users can develop MockRequests of their own and use
@@ -58,6 +61,7 @@ type MockBroker struct {
 	closing       chan none
 	stopper       chan none
 	expectations  chan encoderWithHeader
+	apiVersions   int32 // set once an ApiVersionsResponse may be expected
 	listener      net.Listener
 	t             TestReporter
 	latency       time.Duration
@@ -231,6 +235,16 @@ func (b *MockBroker) readToBytes(r io.Reader) ([]byte, error) {
 	return fullBytes, nil
 }
 
+// saslFailed reports whether the SASL exchange failed with kerr, or with a
+// KRB_ERROR token rejecting the GSS-API token of the client.
+func saslFailed(kerr KError, token []byte) bool {
+	if kerr != ErrNoError {
+		return true
+	}
+	_, ok := krbErrorToken(token)
+	return ok
+}
+
 func (b *MockBroker) isGSSAPI(buffer []byte) bool {
 	return buffer[4] == 0x60 || bytes.Equal(buffer[4:6], []byte{0x05, 0x04})
 }
@@ -285,6 +299,9 @@ func (b *MockBroker) handleRequests(conn io.ReadWriteCloser, idx int, wg *sync.W
 
 			b.lock.Lock()
 			res := b.handler(req)
+			if _, ok := req.body.(*ApiVersionsRequest); ok && res == nil {
+				res = NewMockApiVersionsResponse(b.t).For(req.body)
+			}
 			b.history = append(b.history, RequestResponse{req.body, res})
 			b.lock.Unlock()
 
@@ -323,9 +340,17 @@ func (b *MockBroker) handleRequests(conn io.ReadWriteCloser, idx int, wg *sync.W
 				break
 			}
 			bytesWritten = len(resHeader) + len(encodedRes)
+			if res, ok := res.(*SaslAuthenticateResponse); ok && saslFailed(res.Err, res.SaslAuthBytes) {
+				// brokers close the connection once the authentication failed
+				break
+			}
 		} else {
 			// GSSAPI is not part of kafka protocol, but is supported for authentication proposes.
 			// Don't support history for this kind of request as is only used for test GSSAPI authentication mechanism
+			if bytes.Equal(buffer[4:6], []byte{0x05, 0x04}) {
+				// Kafka does not reply to the final wrap token of the client
+				continue
+			}
 			b.lock.Lock()
 			res := b.gssApiHandler(buffer)
 			b.lock.Unlock()
@@ -338,6 +363,10 @@ func (b *MockBroker) handleRequests(conn io.ReadWriteCloser, idx int, wg *sync.W
 				break
 			}
 			bytesWritten = len(res)
+			if len(res) >= 4 && saslFailed(ErrNoError, res[4:]) {
+				// brokers close the connection once the authentication failed
+				break
+			}
 		}
 
 		b.lock.Lock()
@@ -368,6 +397,10 @@ func (b *MockBroker) encodeHeader(headerVersion int16, correlationId int32, payl
 }
 
 func (b *MockBroker) defaultRequestHandler(req *request) (res encoderWithHeader) {
+	if _, ok := req.body.(*ApiVersionsRequest); ok && atomic.LoadInt32(&b.apiVersions) == 0 {
+		// leave the expectations to the other requests
+		return nil
+	}
 	select {
 	case res, ok := <-b.expectations:
 		if !ok {
@@ -468,5 +501,9 @@ func NewMockBrokerListener(t TestReporter, brokerID int32, listener net.Listener
 }
 
 func (b *MockBroker) Returns(e encoderWithHeader) {
+	// raw encoders may be answering anything, ApiVersionsRequest included
+	if res, ok := e.(interface{ key() int16 }); !ok || res.key() == apiKeyApiVersions {
+		atomic.StoreInt32(&b.apiVersions, 1)
+	}
 	b.expectations <- e
 }
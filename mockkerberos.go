@@ -3,9 +3,13 @@ package sarama
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"sync"
+	"time"
 
 	"github.com/max444ks1m777/gokrb5/v8/credentials"
 	"github.com/max444ks1m777/gokrb5/v8/gssapi"
+	"github.com/max444ks1m777/gokrb5/v8/iana/errorcode"
+	"github.com/max444ks1m777/gokrb5/v8/iana/flags"
 	"github.com/max444ks1m777/gokrb5/v8/iana/keyusage"
 	"github.com/max444ks1m777/gokrb5/v8/messages"
 	"github.com/max444ks1m777/gokrb5/v8/types"
@@ -15,17 +19,32 @@ type KafkaGSSAPIHandler struct {
 	client         *MockKerberosClient
 	badResponse    bool
 	badKeyChecksum bool
+	// clockSkewErrors is the number of AP_REQ to reject with KRB_AP_ERR_SKEW
+	clockSkewErrors int
+}
+
+// NewMockGSSAPIHandler returns a MockBroker GSS-API handler completing the
+// handshake for the service tickets issued by client. It answers the raw
+// packets, set it with MockSaslAuthenticateResponse.SetGSSAPIHandler to answer
+// the tokens sent with v1 of the SASL handshake.
+func NewMockGSSAPIHandler(client *MockKerberosClient) GSSApiHandlerFunc {
+	h := &KafkaGSSAPIHandler{client: client}
+	return h.MockKafkaGSSAPI
 }
 
 func (h *KafkaGSSAPIHandler) MockKafkaGSSAPI(buffer []byte) []byte {
 	// Default payload used for verify
-	err := h.client.Login() // Mock client construct keys when login
+	err := h.client.login() // Mock client construct keys when login
 	if err != nil {
 		return nil
 	}
 	if h.badResponse { // Returns trash
 		return []byte{0x00, 0x00, 0x00, 0x01, 0xAD}
 	}
+	if h.clockSkewErrors > 0 && buffer[4] == GSS_API_GENERIC_TAG {
+		h.clockSkewErrors--
+		return h.clockSkewError()
+	}
 
 	pack := gssapi.WrapToken{
 		Flags:     KRB5_USER_AUTH,
@@ -38,7 +57,7 @@ func (h *KafkaGSSAPIHandler) MockKafkaGSSAPI(buffer []byte) []byte {
 	if h.badKeyChecksum {
 		pack.CheckSum = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
 	} else {
-		err = pack.SetCheckSum(h.client.ASRep.DecryptedEncPart.Key, keyusage.GSSAPI_ACCEPTOR_SEAL)
+		err = pack.SetCheckSum(h.client.sessionKey(), keyusage.GSSAPI_ACCEPTOR_SEAL)
 		if err != nil {
 			return nil
 		}
@@ -55,18 +74,80 @@ func (h *KafkaGSSAPIHandler) MockKafkaGSSAPI(buffer []byte) []byte {
 	return response
 }
 
+// clockSkewError returns a KRB_ERROR token rejecting an AP_REQ because of
+// clock skew, as described in RFC 4121 section 4.1.
+func (h *KafkaGSSAPIHandler) clockSkewError() []byte {
+	krbErr := messages.NewKRBError(h.client.CName(), h.client.Domain(), errorcode.KRB_AP_ERR_SKEW, "clock skew too great")
+	krbErrBytes, err := krbErr.Marshal()
+	if err != nil {
+		return nil
+	}
+	token := make([]byte, 2, 2+len(krbErrBytes))
+	binary.BigEndian.PutUint16(token, TOK_ID_KRB_ERROR)
+	token, err = (&GSSAPIKerberosAuth{}).appendGSSAPIHeader(append(token, krbErrBytes...))
+	if err != nil {
+		return nil
+	}
+	response := make([]byte, len(token)+4)
+	copy(response[4:], token)
+	binary.BigEndian.PutUint32(response, uint32(len(token)))
+	return response
+}
+
+// MockKerberosClient is a KerberosClient logging in and issuing service
+// tickets without a KDC, for the principal kafka/kafka@EXAMPLE.COM. Return it
+// from GSSAPIConfig.NewKerberosClientFunc to test GSSAPI authentication
+// against a MockBroker answering with NewMockGSSAPIHandler.
 type MockKerberosClient struct {
 	asRepBytes  string
 	ASRep       messages.ASRep
 	credentials *credentials.Credentials
 	mockError   error
 	errorStage  string
+	// ticket and key override the service ticket issued from ASRep
+	ticket *messages.Ticket
+	key    types.EncryptionKey
+	// lock guards ASRep, as concurrent handshakes may share the client
+	lock sync.Mutex
+}
+
+// NewMockKerberosClient returns a MockKerberosClient issuing a valid
+// service ticket for any service.
+func NewMockKerberosClient() *MockKerberosClient {
+	return &MockKerberosClient{}
+}
+
+// SetServiceTicket makes the client issue ticket with the session key key.
+func (c *MockKerberosClient) SetServiceTicket(ticket messages.Ticket, key types.EncryptionKey) *MockKerberosClient {
+	c.ticket = &ticket
+	c.key = key
+	return c
+}
+
+// SetLoginError makes Login fail with err.
+func (c *MockKerberosClient) SetLoginError(err error) *MockKerberosClient {
+	c.mockError = err
+	c.errorStage = "login"
+	return c
+}
+
+// SetServiceTicketError makes GetServiceTicket fail with err.
+func (c *MockKerberosClient) SetServiceTicketError(err error) *MockKerberosClient {
+	c.mockError = err
+	c.errorStage = "service_ticket"
+	return c
 }
 
 func (c *MockKerberosClient) Login() error {
 	if c.errorStage == "login" && c.mockError != nil {
 		return c.mockError
 	}
+	return c.login()
+}
+
+func (c *MockKerberosClient) login() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.asRepBytes = "6b8202e9308202e5a003020105a10302010ba22b30293027a103020113a220041e301c301aa003020112a1131b114" +
 		"558414d504c452e434f4d636c69656e74a30d1b0b4558414d504c452e434f4da4133011a003020101a10a30081b06636c69656e7" +
 		"4a5820156618201523082014ea003020105a10d1b0b4558414d504c452e434f4da220301ea003020102a11730151b066b7262746" +
@@ -102,9 +183,37 @@ func (c *MockKerberosClient) GetServiceTicket(spn string) (messages.Ticket, type
 	if c.errorStage == "service_ticket" && c.mockError != nil {
 		return messages.Ticket{}, types.EncryptionKey{}, c.mockError
 	}
+	if c.ticket != nil {
+		return *c.ticket, c.key, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.ASRep.Ticket, c.ASRep.DecryptedEncPart.Key, nil
 }
 
+// GetForwardedTGT returns the ticket issued from ASRep, flagged as a
+// forwarded TGT.
+func (c *MockKerberosClient) GetForwardedTGT() (messages.Ticket, messages.EncKDCRepPart, error) {
+	ticket, key, err := c.GetServiceTicket("krbtgt/" + c.Domain())
+	if err != nil {
+		return messages.Ticket{}, messages.EncKDCRepPart{}, err
+	}
+	encPart := messages.EncKDCRepPart{Key: key, Flags: types.NewKrbFlags(), SRealm: ticket.Realm, SName: ticket.SName}
+	types.SetFlag(&encPart.Flags, flags.Forwardable)
+	types.SetFlag(&encPart.Flags, flags.Forwarded)
+	return ticket, encPart, nil
+}
+
+// sessionKey returns the session key of the service tickets issued.
+func (c *MockKerberosClient) sessionKey() types.EncryptionKey {
+	if c.ticket != nil {
+		return c.key
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ASRep.DecryptedEncPart.Key
+}
+
 func (c *MockKerberosClient) Domain() string {
 	return "EXAMPLE.COM"
 }
@@ -120,6 +229,12 @@ func (c *MockKerberosClient) CName() types.PrincipalName {
 	return p
 }
 
+func (c *MockKerberosClient) TGTExpiry() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ASRep.DecryptedEncPart.EndTime
+}
+
 func (c *MockKerberosClient) Destroy() {
 	// Do nothing.
 }
@@ -1,9 +1,11 @@
 package sarama
 
 import (
+	"encoding/binary"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 )
 
 // TestReporter has methods matching go's testing.T to avoid importing
@@ -71,12 +73,14 @@ func (mc *MockSequence) For(reqBody versionedDecoder) (res encoderWithHeader) {
 
 type MockListGroupsResponse struct {
 	groups map[string]string
+	states map[string]string
 	t      TestReporter
 }
 
 func NewMockListGroupsResponse(t TestReporter) *MockListGroupsResponse {
 	return &MockListGroupsResponse{
 		groups: make(map[string]string),
+		states: make(map[string]string),
 		t:      t,
 	}
 }
@@ -87,6 +91,21 @@ func (m *MockListGroupsResponse) For(reqBody versionedDecoder) encoderWithHeader
 		Version: request.Version,
 		Groups:  m.groups,
 	}
+	if request.Version >= 4 {
+		filter := make(map[string]bool, len(request.StatesFilter))
+		for _, state := range request.StatesFilter {
+			filter[state] = true
+		}
+		response.Groups = make(map[string]string, len(m.groups))
+		response.GroupsData = make(map[string]GroupData, len(m.groups))
+		for groupID, protocolType := range m.groups {
+			if len(filter) > 0 && !filter[m.states[groupID]] {
+				continue
+			}
+			response.Groups[groupID] = protocolType
+			response.GroupsData[groupID] = GroupData{GroupState: m.states[groupID]}
+		}
+	}
 	return response
 }
 
@@ -95,6 +114,12 @@ func (m *MockListGroupsResponse) AddGroup(groupID, protocolType string) *MockLis
 	return m
 }
 
+func (m *MockListGroupsResponse) AddGroupWithState(groupID, protocolType, state string) *MockListGroupsResponse {
+	m.groups[groupID] = protocolType
+	m.states[groupID] = state
+	return m
+}
+
 type MockDescribeGroupsResponse struct {
 	groups map[string]*GroupDescription
 	t      TestReporter
@@ -276,6 +301,53 @@ func (mor *MockOffsetResponse) getOffset(topic string, partition int32, time int
 	return offset
 }
 
+// MockOffsetForLeaderEpochResponse is an `OffsetForLeaderEpochResponse` builder.
+type MockOffsetForLeaderEpochResponse struct {
+	endOffsets map[string]map[int32]map[int32]*OffsetForLeaderEpochResponseBlock
+	t          TestReporter
+}
+
+func NewMockOffsetForLeaderEpochResponse(t TestReporter) *MockOffsetForLeaderEpochResponse {
+	return &MockOffsetForLeaderEpochResponse{
+		endOffsets: make(map[string]map[int32]map[int32]*OffsetForLeaderEpochResponseBlock),
+		t:          t,
+	}
+}
+
+// SetEndOffset sets the end offset returned for leaderEpoch, and the epoch it
+// belongs to.
+func (mor *MockOffsetForLeaderEpochResponse) SetEndOffset(topic string, partition int32, leaderEpoch int32, endOffset int64, epoch int32) *MockOffsetForLeaderEpochResponse {
+	partitions := mor.endOffsets[topic]
+	if partitions == nil {
+		partitions = make(map[int32]map[int32]*OffsetForLeaderEpochResponseBlock)
+		mor.endOffsets[topic] = partitions
+	}
+	epochs := partitions[partition]
+	if epochs == nil {
+		epochs = make(map[int32]*OffsetForLeaderEpochResponseBlock)
+		partitions[partition] = epochs
+	}
+	epochs[leaderEpoch] = &OffsetForLeaderEpochResponseBlock{LeaderEpoch: epoch, EndOffset: endOffset}
+	return mor
+}
+
+func (mor *MockOffsetForLeaderEpochResponse) For(reqBody versionedDecoder) encoderWithHeader {
+	request := reqBody.(*OffsetForLeaderEpochRequest)
+	response := &OffsetForLeaderEpochResponse{Version: request.Version}
+	for topic, partitions := range request.blocks {
+		for partition, block := range partitions {
+			result, ok := mor.endOffsets[topic][partition][block.leaderEpoch]
+			if !ok {
+				mor.t.Errorf("missing end offset: %s/%d epoch %d", topic, partition, block.leaderEpoch)
+				response.AddBlock(topic, partition, -1, -1, ErrUnknownLeaderEpoch)
+				continue
+			}
+			response.AddBlock(topic, partition, result.LeaderEpoch, result.EndOffset, ErrNoError)
+		}
+	}
+	return response
+}
+
 // mockMessage is a message that used to be mocked for `FetchResponse`
 type mockMessage struct {
 	key Encoder
@@ -553,9 +625,11 @@ func (mr *MockOffsetCommitResponse) getError(group, topic string, partition int3
 
 // MockProduceResponse is a `ProduceResponse` builder.
 type MockProduceResponse struct {
-	version int16
-	errors  map[string]map[int32]KError
-	t       TestReporter
+	version        int16
+	errors         map[string]map[int32]KError
+	logAppendTimes map[string]map[int32]time.Time
+	startOffsets   map[string]map[int32]int64
+	t              TestReporter
 }
 
 func NewMockProduceResponse(t TestReporter) *MockProduceResponse {
@@ -580,6 +654,36 @@ func (mr *MockProduceResponse) SetError(topic string, partition int32, kerror KE
 	return mr
 }
 
+// SetLogAppendTime makes the response carry the timestamp the broker assigned
+// to the records of a LogAppendTime topic (version 2+).
+func (mr *MockProduceResponse) SetLogAppendTime(topic string, partition int32, timestamp time.Time) *MockProduceResponse {
+	if mr.logAppendTimes == nil {
+		mr.logAppendTimes = make(map[string]map[int32]time.Time)
+	}
+	partitions := mr.logAppendTimes[topic]
+	if partitions == nil {
+		partitions = make(map[int32]time.Time)
+		mr.logAppendTimes[topic] = partitions
+	}
+	partitions[partition] = timestamp
+	return mr
+}
+
+// SetLogStartOffset makes the response carry the log start offset of the
+// partition (version 5+).
+func (mr *MockProduceResponse) SetLogStartOffset(topic string, partition int32, offset int64) *MockProduceResponse {
+	if mr.startOffsets == nil {
+		mr.startOffsets = make(map[string]map[int32]int64)
+	}
+	partitions := mr.startOffsets[topic]
+	if partitions == nil {
+		partitions = make(map[int32]int64)
+		mr.startOffsets[topic] = partitions
+	}
+	partitions[partition] = offset
+	return mr
+}
+
 func (mr *MockProduceResponse) For(reqBody versionedDecoder) encoderWithHeader {
 	req := reqBody.(*ProduceRequest)
 	res := &ProduceResponse{
@@ -591,6 +695,12 @@ func (mr *MockProduceResponse) For(reqBody versionedDecoder) encoderWithHeader {
 	for topic, partitions := range req.records {
 		for partition := range partitions {
 			res.AddTopicPartition(topic, partition, mr.getError(topic, partition))
+			if timestamp, ok := mr.logAppendTimes[topic][partition]; ok {
+				res.Blocks[topic][partition].Timestamp = timestamp
+			}
+			if offset, ok := mr.startOffsets[topic][partition]; ok {
+				res.Blocks[topic][partition].StartOffset = offset
+			}
 		}
 	}
 	return res
@@ -620,6 +730,10 @@ func NewMockOffsetFetchResponse(t TestReporter) *MockOffsetFetchResponse {
 }
 
 func (mr *MockOffsetFetchResponse) SetOffset(group, topic string, partition int32, offset int64, metadata string, kerror KError) *MockOffsetFetchResponse {
+	return mr.SetOffsetWithLeaderEpoch(group, topic, partition, offset, 0, metadata, kerror)
+}
+
+func (mr *MockOffsetFetchResponse) SetOffsetWithLeaderEpoch(group, topic string, partition int32, offset int64, leaderEpoch int32, metadata string, kerror KError) *MockOffsetFetchResponse {
 	if mr.offsets == nil {
 		mr.offsets = make(map[string]map[string]map[int32]*OffsetFetchResponseBlock)
 	}
@@ -633,7 +747,7 @@ func (mr *MockOffsetFetchResponse) SetOffset(group, topic string, partition int3
 		partitions = make(map[int32]*OffsetFetchResponseBlock)
 		topics[topic] = partitions
 	}
-	partitions[partition] = &OffsetFetchResponseBlock{offset, 0, metadata, kerror}
+	partitions[partition] = &OffsetFetchResponseBlock{offset, leaderEpoch, metadata, kerror}
 	return mr
 }
 
@@ -1095,6 +1209,7 @@ type MockSaslAuthenticateResponse struct {
 	kerror            KError
 	saslAuthBytes     []byte
 	sessionLifetimeMs int64
+	gssAPIHandler     GSSApiHandlerFunc
 }
 
 func NewMockSaslAuthenticateResponse(t TestReporter) *MockSaslAuthenticateResponse {
@@ -1109,6 +1224,16 @@ func (msar *MockSaslAuthenticateResponse) For(reqBody versionedDecoder) encoderW
 		SaslAuthBytes:     msar.saslAuthBytes,
 		SessionLifetimeMs: msar.sessionLifetimeMs,
 	}
+	if msar.gssAPIHandler != nil && len(req.SaslAuthBytes) > 0 && req.SaslAuthBytes[0] == GSS_API_GENERIC_TAG {
+		// reply to the AP_REQ as the handler does to the raw packet, without
+		// its length prefix
+		packet := make([]byte, 4+len(req.SaslAuthBytes))
+		binary.BigEndian.PutUint32(packet, uint32(len(req.SaslAuthBytes)))
+		copy(packet[4:], req.SaslAuthBytes)
+		if reply := msar.gssAPIHandler(packet); len(reply) >= 4 {
+			res.SaslAuthBytes = reply[4:]
+		}
+	}
 	return res
 }
 
@@ -1122,6 +1247,14 @@ func (msar *MockSaslAuthenticateResponse) SetAuthBytes(saslAuthBytes []byte) *Mo
 	return msar
 }
 
+// SetGSSAPIHandler makes the response carry the reply of handler to GSS-API
+// tokens exchanged in SaslAuthenticate requests, as handled for raw packets
+// by MockBroker.SetGSSAPIHandler.
+func (msar *MockSaslAuthenticateResponse) SetGSSAPIHandler(handler GSSApiHandlerFunc) *MockSaslAuthenticateResponse {
+	msar.gssAPIHandler = handler
+	return msar
+}
+
 func (msar *MockSaslAuthenticateResponse) SetSessionLifetimeMs(sessionLifetimeMs int64) *MockSaslAuthenticateResponse {
 	msar.sessionLifetimeMs = sessionLifetimeMs
 	return msar
@@ -1202,21 +1335,24 @@ func (m *MockDeleteGroupsResponse) For(reqBody versionedDecoder) encoderWithHead
 }
 
 type MockDeleteOffsetResponse struct {
-	errorCode      KError
-	topic          string
-	partition      int32
-	errorPartition KError
+	errorCode KError
+	errors    map[string]map[int32]KError
 }
 
 func NewMockDeleteOffsetRequest(t TestReporter) *MockDeleteOffsetResponse {
-	return &MockDeleteOffsetResponse{}
+	return &MockDeleteOffsetResponse{
+		errors: make(map[string]map[int32]KError),
+	}
 }
 
+// SetDeletedOffset sets the top-level error code and the error returned for
+// the given partition. Other requested partitions are deleted without error.
 func (m *MockDeleteOffsetResponse) SetDeletedOffset(errorCode KError, topic string, partition int32, errorPartition KError) *MockDeleteOffsetResponse {
 	m.errorCode = errorCode
-	m.topic = topic
-	m.partition = partition
-	m.errorPartition = errorPartition
+	if m.errors[topic] == nil {
+		m.errors[topic] = make(map[int32]KError)
+	}
+	m.errors[topic][partition] = errorPartition
 	return m
 }
 
@@ -1225,9 +1361,11 @@ func (m *MockDeleteOffsetResponse) For(reqBody versionedDecoder) encoderWithHead
 	resp := &DeleteOffsetsResponse{
 		Version:   req.version(),
 		ErrorCode: m.errorCode,
-		Errors: map[string]map[int32]KError{
-			m.topic: {m.partition: m.errorPartition},
-		},
+	}
+	for topic, partitions := range req.partitions {
+		for _, partition := range partitions {
+			resp.AddError(topic, partition, m.errors[topic][partition])
+		}
 	}
 	return resp
 }
@@ -1378,6 +1516,7 @@ func (m *MockHeartbeatResponse) For(reqBody versionedDecoder) encoderWithHeader
 	req := reqBody.(*HeartbeatRequest)
 	resp := &HeartbeatResponse{
 		Version: req.version(),
+		Err:     m.Err,
 	}
 	return resp
 }
@@ -1461,6 +1600,15 @@ func (m *MockApiVersionsResponse) SetApiKeys(apiKeys []ApiVersionsResponseKey) *
 
 func (m *MockApiVersionsResponse) For(reqBody versionedDecoder) encoderWithHeader {
 	req := reqBody.(*ApiVersionsRequest)
+	for _, key := range m.apiKeys {
+		if key.ApiKey == apiKeyApiVersions && req.Version > key.MaxVersion {
+			// like a real broker, reject the request in the v0 format
+			return &ApiVersionsResponse{
+				ErrorCode: int16(ErrUnsupportedVersion),
+				ApiKeys:   []ApiVersionsResponseKey{key},
+			}
+		}
+	}
 	res := &ApiVersionsResponse{
 		Version: req.Version,
 		ApiKeys: m.apiKeys,
@@ -1507,3 +1655,119 @@ func (m *MockInitProducerIDResponse) For(reqBody versionedDecoder) encoderWithHe
 	}
 	return res
 }
+
+// MockDescribeUserScramCredentialsResponse is a `DescribeUserScramCredentialsResponse` builder.
+type MockDescribeUserScramCredentialsResponse struct {
+	credentials map[string][]*UserScramCredentialsResponseInfo
+	t           TestReporter
+}
+
+func NewMockDescribeUserScramCredentialsResponse(t TestReporter) *MockDescribeUserScramCredentialsResponse {
+	return &MockDescribeUserScramCredentialsResponse{
+		credentials: make(map[string][]*UserScramCredentialsResponseInfo),
+		t:           t,
+	}
+}
+
+func (m *MockDescribeUserScramCredentialsResponse) SetCredential(user string, mechanism ScramMechanismType, iterations int32) *MockDescribeUserScramCredentialsResponse {
+	m.credentials[user] = append(m.credentials[user], &UserScramCredentialsResponseInfo{
+		Mechanism:  mechanism,
+		Iterations: iterations,
+	})
+	return m
+}
+
+func (m *MockDescribeUserScramCredentialsResponse) For(reqBody versionedDecoder) encoderWithHeader {
+	req := reqBody.(*DescribeUserScramCredentialsRequest)
+	res := &DescribeUserScramCredentialsResponse{Version: req.Version}
+	for _, u := range req.DescribeUsers {
+		res.Results = append(res.Results, &DescribeUserScramCredentialsResult{
+			User:            u.Name,
+			CredentialInfos: m.credentials[u.Name],
+		})
+	}
+	return res
+}
+
+// MockAlterUserScramCredentialsResponse is an `AlterUserScramCredentialsResponse` builder.
+type MockAlterUserScramCredentialsResponse struct {
+	errors map[string]KError
+	t      TestReporter
+}
+
+func NewMockAlterUserScramCredentialsResponse(t TestReporter) *MockAlterUserScramCredentialsResponse {
+	return &MockAlterUserScramCredentialsResponse{
+		errors: make(map[string]KError),
+		t:      t,
+	}
+}
+
+func (m *MockAlterUserScramCredentialsResponse) SetError(user string, kerror KError) *MockAlterUserScramCredentialsResponse {
+	m.errors[user] = kerror
+	return m
+}
+
+func (m *MockAlterUserScramCredentialsResponse) For(reqBody versionedDecoder) encoderWithHeader {
+	req := reqBody.(*AlterUserScramCredentialsRequest)
+	res := &AlterUserScramCredentialsResponse{Version: req.Version}
+	for _, d := range req.Deletions {
+		res.Results = append(res.Results, &AlterUserScramCredentialsResult{User: d.Name, ErrorCode: m.errors[d.Name]})
+	}
+	for _, u := range req.Upsertions {
+		res.Results = append(res.Results, &AlterUserScramCredentialsResult{User: u.Name, ErrorCode: m.errors[u.Name]})
+	}
+	return res
+}
+
+// MockDescribeClientQuotasResponse is a `DescribeClientQuotasResponse` builder.
+type MockDescribeClientQuotasResponse struct {
+	entries []DescribeClientQuotasEntry
+	t       TestReporter
+}
+
+func NewMockDescribeClientQuotasResponse(t TestReporter) *MockDescribeClientQuotasResponse {
+	return &MockDescribeClientQuotasResponse{t: t}
+}
+
+func (m *MockDescribeClientQuotasResponse) SetQuota(entity []QuotaEntityComponent, key string, value float64) *MockDescribeClientQuotasResponse {
+	m.entries = append(m.entries, DescribeClientQuotasEntry{
+		Entity: entity,
+		Values: map[string]float64{key: value},
+	})
+	return m
+}
+
+func (m *MockDescribeClientQuotasResponse) For(reqBody versionedDecoder) encoderWithHeader {
+	req := reqBody.(*DescribeClientQuotasRequest)
+	return &DescribeClientQuotasResponse{
+		Version: req.Version,
+		Entries: m.entries,
+	}
+}
+
+// MockAlterClientQuotasResponse is an `AlterClientQuotasResponse` builder.
+type MockAlterClientQuotasResponse struct {
+	err KError
+	t   TestReporter
+}
+
+func NewMockAlterClientQuotasResponse(t TestReporter) *MockAlterClientQuotasResponse {
+	return &MockAlterClientQuotasResponse{t: t}
+}
+
+func (m *MockAlterClientQuotasResponse) SetError(kerror KError) *MockAlterClientQuotasResponse {
+	m.err = kerror
+	return m
+}
+
+func (m *MockAlterClientQuotasResponse) For(reqBody versionedDecoder) encoderWithHeader {
+	req := reqBody.(*AlterClientQuotasRequest)
+	res := &AlterClientQuotasResponse{Version: req.Version}
+	for _, e := range req.Entries {
+		res.Entries = append(res.Entries, AlterClientQuotasEntryResponse{
+			ErrorCode: m.err,
+			Entity:    e.Entity,
+		})
+	}
+	return res
+}
@@ -2,6 +2,7 @@ package mocks
 
 import (
 	"errors"
+	"reflect"
 	"sync"
 
 	"github.com/max444ks1m777/sarama"
@@ -25,6 +26,9 @@ type AsyncProducer struct {
 	txnLock         sync.Mutex
 	txnStatus       sarama.ProducerTxnStatusFlag
 	lastOffset      int64
+	futuresLock     sync.Mutex
+	futures         map[*sarama.ProducerMessage]*producerFuture
+	config          sarama.Config
 	*TopicConfig
 }
 
@@ -48,6 +52,8 @@ func NewAsyncProducer(t ErrorReporter, config *sarama.Config) *AsyncProducer {
 		errors:          make(chan *sarama.ProducerError, config.ChannelBufferSize),
 		isTransactional: config.Producer.Transaction.ID != "",
 		txnStatus:       sarama.ProducerTxnFlagReady,
+		futures:         make(map[*sarama.ProducerMessage]*producerFuture),
+		config:          *config,
 		TopicConfig:     NewTopicConfig(),
 	}
 
@@ -64,7 +70,10 @@ func NewAsyncProducer(t ErrorReporter, config *sarama.Config) *AsyncProducer {
 			mp.txnLock.Lock()
 			if mp.IsTransactional() && mp.txnStatus&sarama.ProducerTxnFlagInTransaction == 0 {
 				mp.t.Errorf("attempt to send message when transaction is not started or is in ending state.")
-				mp.errors <- &sarama.ProducerError{Err: errors.New("attempt to send message when transaction is not started or is in ending state"), Msg: msg}
+				err := errors.New("attempt to send message when transaction is not started or is in ending state")
+				if !mp.resolveFuture(msg, err) {
+					mp.errors <- &sarama.ProducerError{Err: err, Msg: msg}
+				}
 				continue
 			}
 			mp.txnLock.Unlock()
@@ -84,23 +93,28 @@ func NewAsyncProducer(t ErrorReporter, config *sarama.Config) *AsyncProducer {
 				partition, err := partitioner.Partition(msg, mp.partitions(msg.Topic))
 				if err != nil {
 					mp.t.Errorf("Partitioner returned an error: %s", err.Error())
-					mp.errors <- &sarama.ProducerError{Err: err, Msg: msg}
+					if !mp.resolveFuture(msg, err) {
+						mp.errors <- &sarama.ProducerError{Err: err, Msg: msg}
+					}
 				} else {
 					msg.Partition = partition
+					resolved := false
 					if expectation.CheckFunction != nil {
 						err := expectation.CheckFunction(msg)
 						if err != nil {
 							mp.t.Errorf("Check function returned an error: %s", err.Error())
-							mp.errors <- &sarama.ProducerError{Err: err, Msg: msg}
+							if resolved = mp.resolveFuture(msg, err); !resolved {
+								mp.errors <- &sarama.ProducerError{Err: err, Msg: msg}
+							}
 						}
 					}
 					if errors.Is(expectation.Result, errProduceSuccess) {
 						mp.lastOffset++
-						if config.Producer.Return.Successes {
-							msg.Offset = mp.lastOffset
+						msg.Offset = mp.lastOffset
+						if !resolved && !mp.resolveFuture(msg, nil) && config.Producer.Return.Successes {
 							mp.successes <- msg
 						}
-					} else if config.Producer.Return.Errors {
+					} else if !resolved && !mp.resolveFuture(msg, expectation.Result) && config.Producer.Return.Errors {
 						mp.errors <- &sarama.ProducerError{Err: expectation.Result, Msg: msg}
 					}
 				}
@@ -147,6 +161,50 @@ func (mp *AsyncProducer) Input() chan<- *sarama.ProducerMessage {
 	return mp.input
 }
 
+// Enqueue corresponds with the Enqueue method of sarama's Producer implementation.
+// Enqueued messages are handled like those written to the Input channel, except
+// that their result is only reported through the returned Future.
+func (mp *AsyncProducer) Enqueue(msg *sarama.ProducerMessage) sarama.Future {
+	future := &producerFuture{msg: msg, done: make(chan struct{})}
+	mp.futuresLock.Lock()
+	mp.futures[msg] = future
+	mp.futuresLock.Unlock()
+	mp.input <- msg
+	return future
+}
+
+// resolveFuture completes the future of a message sent with Enqueue, if any,
+// and reports whether there was one.
+func (mp *AsyncProducer) resolveFuture(msg *sarama.ProducerMessage, err error) bool {
+	mp.futuresLock.Lock()
+	future, ok := mp.futures[msg]
+	delete(mp.futures, msg)
+	mp.futuresLock.Unlock()
+	if ok {
+		future.err = err
+		close(future.done)
+	}
+	return ok
+}
+
+type producerFuture struct {
+	msg  *sarama.ProducerMessage
+	err  error
+	done chan struct{}
+}
+
+func (f *producerFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *producerFuture) Result() (partition int32, offset int64, err error) {
+	<-f.done
+	if f.err != nil {
+		return -1, -1, f.err
+	}
+	return f.msg.Partition, f.msg.Offset, nil
+}
+
 // Successes corresponds with the Successes method of sarama's Producer implementation.
 func (mp *AsyncProducer) Successes() <-chan *sarama.ProducerMessage {
 	return mp.successes
@@ -200,6 +258,47 @@ func (mp *AsyncProducer) AddMessageToTxn(msg *sarama.ConsumerMessage, groupId st
 	return nil
 }
 
+// Reconfigure calls fn with a copy of the configuration of the mock, and
+// rejects the changes the real producer rejects. The accepted changes are
+// recorded, but do not change how the mock handles the messages.
+func (mp *AsyncProducer) Reconfigure(fn func(*sarama.Config)) error {
+	mp.l.Lock()
+	defer mp.l.Unlock()
+
+	conf := mp.config
+	conf.Producer.TopicFlush = make(map[string]sarama.FlushConfig, len(mp.config.Producer.TopicFlush))
+	for topic, flush := range mp.config.Producer.TopicFlush {
+		conf.Producer.TopicFlush[topic] = flush
+	}
+	conf.Producer.TopicPriorities = make(map[string]int, len(mp.config.Producer.TopicPriorities))
+	for topic, priority := range mp.config.Producer.TopicPriorities {
+		conf.Producer.TopicPriorities[topic] = priority
+	}
+	fn(&conf)
+
+	switch {
+	case conf.Producer.Idempotent != mp.config.Producer.Idempotent:
+		return sarama.ConfigurationError("Producer.Idempotent cannot be reconfigured")
+	case conf.Producer.Transaction.ID != mp.config.Producer.Transaction.ID:
+		return sarama.ConfigurationError("Producer.Transaction.ID cannot be reconfigured")
+	case len(conf.Producer.TopicFlush)+len(mp.config.Producer.TopicFlush) > 0 &&
+		!reflect.DeepEqual(conf.Producer.TopicFlush, mp.config.Producer.TopicFlush):
+		return sarama.ConfigurationError("Producer.TopicFlush cannot be reconfigured")
+	case len(conf.Producer.TopicPriorities)+len(mp.config.Producer.TopicPriorities) > 0 &&
+		!reflect.DeepEqual(conf.Producer.TopicPriorities, mp.config.Producer.TopicPriorities):
+		return sarama.ConfigurationError("Producer.TopicPriorities cannot be reconfigured")
+	}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	mp.config.Producer.RequiredAcks = conf.Producer.RequiredAcks
+	mp.config.Producer.Compression = conf.Producer.Compression
+	mp.config.Producer.CompressionLevel = conf.Producer.CompressionLevel
+	mp.config.Producer.Flush = conf.Producer.Flush
+	return nil
+}
+
 ////////////////////////////////////////////////
 // Setting expectations
 ////////////////////////////////////////////////
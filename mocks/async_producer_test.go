@@ -75,6 +75,31 @@ func TestProducerReturnsExpectationsToChannels(t *testing.T) {
 	}
 }
 
+func TestProducerEnqueue(t *testing.T) {
+	config := NewTestConfig()
+	config.Producer.Return.Successes = true
+	mp := NewAsyncProducer(t, config).
+		ExpectInputAndSucceed().
+		ExpectInputAndFail(sarama.ErrOutOfBrokers)
+
+	succeeding := mp.Enqueue(&sarama.ProducerMessage{Topic: "test 1"})
+	failing := mp.Enqueue(&sarama.ProducerMessage{Topic: "test 2"})
+
+	if _, offset, err := succeeding.Result(); err != nil || offset != 1 {
+		t.Errorf("Expected message 1 to succeed at offset 1, got %d: %v", offset, err)
+	}
+	if _, _, err := failing.Result(); !errors.Is(err, sarama.ErrOutOfBrokers) {
+		t.Errorf("Expected message 2 to fail with ErrOutOfBrokers, got %v", err)
+	}
+
+	if err := mp.Close(); err != nil {
+		t.Error(err)
+	}
+	if msg, ok := <-mp.Successes(); ok {
+		t.Errorf("Expected enqueued messages not to be returned on Successes, got %v", msg)
+	}
+}
+
 func TestProducerWithTooFewExpectations(t *testing.T) {
 	trm := newTestReporterMock()
 	mp := NewAsyncProducer(trm, nil)
@@ -263,3 +288,33 @@ func TestProducerWithInvalidConfiguration(t *testing.T) {
 		t.Errorf("Unexpected error: %s", trm.errors[0])
 	}
 }
+
+func TestProducerReconfigure(t *testing.T) {
+	trm := newTestReporterMock()
+	mp := NewAsyncProducer(trm, NewTestConfig())
+
+	if err := mp.Reconfigure(func(conf *sarama.Config) { conf.Producer.Compression = sarama.CompressionGZIP }); err != nil {
+		t.Error(err)
+	}
+	if err := mp.Reconfigure(func(conf *sarama.Config) { conf.Producer.Idempotent = true }); err == nil {
+		t.Error("expected Producer.Idempotent not to be reconfigured")
+	}
+	if err := mp.Reconfigure(func(conf *sarama.Config) { conf.Producer.TopicPriorities["my_topic"] = 1 }); err == nil {
+		t.Error("expected Producer.TopicPriorities not to be reconfigured")
+	}
+	if err := mp.Reconfigure(func(conf *sarama.Config) { conf.Producer.Compression = sarama.CompressionZSTD }); err == nil {
+		t.Error("expected an invalid configuration to be rejected")
+	}
+	_ = mp.Reconfigure(func(conf *sarama.Config) {
+		if conf.Producer.Compression != sarama.CompressionGZIP {
+			t.Errorf("expected the accepted compression to be recorded, got %s", conf.Producer.Compression)
+		}
+	})
+
+	if err := mp.Close(); err != nil {
+		t.Error(err)
+	}
+	if len(trm.errors) != 0 {
+		t.Errorf("Expected no error, found: %v", trm.errors)
+	}
+}
@@ -67,6 +67,13 @@ func (c *Consumer) ConsumePartition(topic string, partition int32, offset int64)
 	return pc, nil
 }
 
+// ConsumePartitionRange implements the ConsumePartitionRange method from the sarama.Consumer
+// interface. It behaves like ConsumePartition with start as offset; the end of the range is
+// not enforced, so only yield the messages of the range and call AsyncClose once done.
+func (c *Consumer) ConsumePartitionRange(topic string, partition int32, start, end int64) (sarama.PartitionConsumer, error) {
+	return c.ConsumePartition(topic, partition, start)
+}
+
 // Topics returns a list of topics, as registered with SetTopicMetadata
 func (c *Consumer) Topics() ([]string, error) {
 	c.l.Lock()
@@ -231,6 +238,7 @@ func (c *Consumer) ExpectConsumePartition(topic string, partition int32, offset
 			messages:            make(chan *sarama.ConsumerMessage, c.config.ChannelBufferSize),
 			suppressedMessages:  make(chan *sarama.ConsumerMessage, c.config.ChannelBufferSize),
 			errors:              make(chan *sarama.ConsumerError, c.config.ChannelBufferSize),
+			decodeErrors:        make(chan *sarama.ConsumerError, c.config.ChannelBufferSize),
 		}
 	}
 
@@ -257,6 +265,7 @@ type PartitionConsumer struct {
 	suppressedMessages            chan *sarama.ConsumerMessage
 	suppressedHighWaterMarkOffset int64
 	errors                        chan *sarama.ConsumerError
+	decodeErrors                  chan *sarama.ConsumerError
 	singleClose                   sync.Once
 	consumed                      bool
 	errorsShouldBeDrained         bool
@@ -274,6 +283,7 @@ func (pc *PartitionConsumer) AsyncClose() {
 		close(pc.suppressedMessages)
 		close(pc.messages)
 		close(pc.errors)
+		close(pc.decodeErrors)
 	})
 }
 
@@ -308,6 +318,9 @@ func (pc *PartitionConsumer) Close() error {
 		for err := range pc.errors {
 			errs = append(errs, err)
 		}
+		for err := range pc.decodeErrors {
+			errs = append(errs, err)
+		}
 
 		if len(errs) > 0 {
 			closeErr = errs
@@ -339,6 +352,13 @@ func (pc *PartitionConsumer) Errors() <-chan *sarama.ConsumerError {
 	return pc.errors
 }
 
+// DecodeErrors implements the DecodeErrors method from the sarama.PartitionConsumer
+// interface. The mock never decodes the messages it yields, so nothing is
+// returned on this channel.
+func (pc *PartitionConsumer) DecodeErrors() <-chan *sarama.ConsumerError {
+	return pc.decodeErrors
+}
+
 // Messages implements the Messages method from the sarama.PartitionConsumer interface.
 func (pc *PartitionConsumer) Messages() <-chan *sarama.ConsumerMessage {
 	return pc.messages
@@ -348,6 +368,12 @@ func (pc *PartitionConsumer) HighWaterMarkOffset() int64 {
 	return atomic.LoadInt64(&pc.highWaterMarkOffset)
 }
 
+// Lag implements the Lag method from the sarama.PartitionConsumer interface. It
+// returns the number of yielded messages that have not been read yet.
+func (pc *PartitionConsumer) Lag() int64 {
+	return int64(len(pc.messages))
+}
+
 // Pause implements the Pause method from the sarama.PartitionConsumer interface.
 func (pc *PartitionConsumer) Pause() {
 	pc.l.Lock()
@@ -68,6 +68,9 @@ func (r *OffsetCommitResponse) decode(pd packetDecoder, version int16) (err erro
 		if err != nil {
 			return err
 		}
+		if numErrors < 0 {
+			return errInvalidArrayLength
+		}
 
 		r.Errors[name] = make(map[int32]KError, numErrors)
 
@@ -76,10 +76,11 @@ func (b *OffsetFetchResponseBlock) encode(pe packetEncoder, version int16) (err
 }
 
 type OffsetFetchResponse struct {
-	Version        int16
-	ThrottleTimeMs int32
-	Blocks         map[string]map[int32]*OffsetFetchResponseBlock
-	Err            KError
+	Version             int16
+	ThrottleTimeMs      int32
+	Blocks              map[string]map[int32]*OffsetFetchResponseBlock
+	Err                 KError
+	unknownTaggedFields taggedFields
 }
 
 func (r *OffsetFetchResponse) encode(pe packetEncoder) (err error) {
@@ -129,7 +130,9 @@ func (r *OffsetFetchResponse) encode(pe packetEncoder) (err error) {
 		pe.putInt16(int16(r.Err))
 	}
 	if isFlexible {
-		pe.putEmptyTaggedFieldArray()
+		if err := pe.putTaggedFieldArray(r.unknownTaggedFields); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -214,7 +217,7 @@ func (r *OffsetFetchResponse) decode(pd packetDecoder, version int16) (err error
 	}
 
 	if isFlexible {
-		if _, err := pd.getEmptyTaggedFieldArray(); err != nil {
+		if r.unknownTaggedFields, err = pd.getTaggedFieldArray(); err != nil {
 			return err
 		}
 	}
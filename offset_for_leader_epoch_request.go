@@ -0,0 +1,170 @@
+package sarama
+
+type offsetForLeaderEpochRequestBlock struct {
+	// currentLeaderEpoch contains the current leader epoch known to the client,
+	// used to fence requests to a stale leader (used in version 2+).
+	currentLeaderEpoch int32
+	// leaderEpoch contains the epoch to look up the end offset for.
+	leaderEpoch int32
+}
+
+func (b *offsetForLeaderEpochRequestBlock) encode(pe packetEncoder, version int16) error {
+	if version >= 2 {
+		pe.putInt32(b.currentLeaderEpoch)
+	}
+	pe.putInt32(b.leaderEpoch)
+	return nil
+}
+
+func (b *offsetForLeaderEpochRequestBlock) decode(pd packetDecoder, version int16) (err error) {
+	b.currentLeaderEpoch = -1
+	if version >= 2 {
+		if b.currentLeaderEpoch, err = pd.getInt32(); err != nil {
+			return err
+		}
+	}
+	b.leaderEpoch, err = pd.getInt32()
+	return err
+}
+
+// OffsetForLeaderEpochRequest asks the leaders of partitions for the end
+// offset of a leader epoch, as described in KIP-101 and KIP-320.
+type OffsetForLeaderEpochRequest struct {
+	Version        int16
+	replicaID      int32
+	isReplicaIDSet bool
+	blocks         map[string]map[int32]*offsetForLeaderEpochRequestBlock
+}
+
+func (r *OffsetForLeaderEpochRequest) encode(pe packetEncoder) error {
+	if r.Version >= 3 {
+		// default replica ID is always -1 for clients
+		pe.putInt32(r.ReplicaID())
+	}
+
+	if err := pe.putArrayLength(len(r.blocks)); err != nil {
+		return err
+	}
+	for topic, partitions := range r.blocks {
+		if err := pe.putString(topic); err != nil {
+			return err
+		}
+		if err := pe.putArrayLength(len(partitions)); err != nil {
+			return err
+		}
+		for partition, block := range partitions {
+			pe.putInt32(partition)
+			if err := block.encode(pe, r.Version); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *OffsetForLeaderEpochRequest) decode(pd packetDecoder, version int16) error {
+	r.Version = version
+
+	if version >= 3 {
+		replicaID, err := pd.getInt32()
+		if err != nil {
+			return err
+		}
+		if replicaID >= 0 {
+			r.SetReplicaID(replicaID)
+		}
+	}
+
+	topicCount, err := pd.getArrayLength()
+	if err != nil {
+		return err
+	}
+	if topicCount == 0 {
+		return nil
+	}
+	r.blocks = make(map[string]map[int32]*offsetForLeaderEpochRequestBlock, topicCount)
+	for i := 0; i < topicCount; i++ {
+		topic, err := pd.getString()
+		if err != nil {
+			return err
+		}
+		partitionCount, err := pd.getArrayLength()
+		if err != nil {
+			return err
+		}
+		r.blocks[topic] = make(map[int32]*offsetForLeaderEpochRequestBlock, partitionCount)
+		for j := 0; j < partitionCount; j++ {
+			partition, err := pd.getInt32()
+			if err != nil {
+				return err
+			}
+			block := new(offsetForLeaderEpochRequestBlock)
+			if err := block.decode(pd, version); err != nil {
+				return err
+			}
+			r.blocks[topic][partition] = block
+		}
+	}
+	return nil
+}
+
+func (r *OffsetForLeaderEpochRequest) key() int16 {
+	return 23
+}
+
+func (r *OffsetForLeaderEpochRequest) version() int16 {
+	return r.Version
+}
+
+func (r *OffsetForLeaderEpochRequest) headerVersion() int16 {
+	return 1
+}
+
+func (r *OffsetForLeaderEpochRequest) isValidVersion() bool {
+	return r.Version >= 0 && r.Version <= 3
+}
+
+func (r *OffsetForLeaderEpochRequest) requiredVersion() KafkaVersion {
+	switch r.Version {
+	case 3:
+		return V2_3_0_0
+	case 2:
+		return V2_1_0_0
+	case 1:
+		return V2_0_0_0
+	case 0:
+		return V0_11_0_0
+	default:
+		return V2_3_0_0
+	}
+}
+
+func (r *OffsetForLeaderEpochRequest) SetReplicaID(id int32) {
+	r.replicaID = id
+	r.isReplicaIDSet = true
+}
+
+func (r *OffsetForLeaderEpochRequest) ReplicaID() int32 {
+	if r.isReplicaIDSet {
+		return r.replicaID
+	}
+	return -1
+}
+
+// AddBlock asks for the end offset of leaderEpoch on the given partition.
+// currentLeaderEpoch is the leader epoch known to the client, or -1 to skip
+// fencing.
+func (r *OffsetForLeaderEpochRequest) AddBlock(topic string, partitionID int32, currentLeaderEpoch, leaderEpoch int32) {
+	if r.blocks == nil {
+		r.blocks = make(map[string]map[int32]*offsetForLeaderEpochRequestBlock)
+	}
+
+	if r.blocks[topic] == nil {
+		r.blocks[topic] = make(map[int32]*offsetForLeaderEpochRequestBlock)
+	}
+
+	r.blocks[topic][partitionID] = &offsetForLeaderEpochRequestBlock{
+		currentLeaderEpoch: currentLeaderEpoch,
+		leaderEpoch:        leaderEpoch,
+	}
+}
@@ -0,0 +1,41 @@
+package sarama
+
+import "testing"
+
+var (
+	offsetForLeaderEpochRequestV0 = []byte{
+		0x00, 0x00, 0x00, 0x01, // 1 topic
+		0x00, 0x03, 'f', 'o', 'o', // topic name: foo
+		0x00, 0x00, 0x00, 0x01, // 1 partition
+		0x00, 0x00, 0x00, 0x04, // partition 4
+		0x00, 0x00, 0x00, 0x02, // leader epoch 2
+	}
+
+	offsetForLeaderEpochRequestV3 = []byte{
+		0xff, 0xff, 0xff, 0xff, // replica ID -1
+		0x00, 0x00, 0x00, 0x01, // 1 topic
+		0x00, 0x03, 'f', 'o', 'o', // topic name: foo
+		0x00, 0x00, 0x00, 0x01, // 1 partition
+		0x00, 0x00, 0x00, 0x04, // partition 4
+		0x00, 0x00, 0x00, 0x05, // current leader epoch 5
+		0x00, 0x00, 0x00, 0x02, // leader epoch 2
+	}
+)
+
+func TestOffsetForLeaderEpochRequest(t *testing.T) {
+	request := &OffsetForLeaderEpochRequest{}
+	request.AddBlock("foo", 4, -1, 2)
+	testRequest(t, "V0", request, offsetForLeaderEpochRequestV0)
+
+	request = &OffsetForLeaderEpochRequest{Version: 3}
+	request.AddBlock("foo", 4, 5, 2)
+	testRequest(t, "V3", request, offsetForLeaderEpochRequestV3)
+
+	request = &OffsetForLeaderEpochRequest{Version: 3}
+	request.SetReplicaID(1)
+	request.AddBlock("foo", 4, 5, 2)
+	request.AddBlock("bar", 0, 5, 3)
+	// The encoded form cannot be checked for it varies due to unpredictable
+	// map traversal order.
+	testRequest(t, "V3 with replica ID", request, nil)
+}
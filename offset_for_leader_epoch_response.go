@@ -0,0 +1,179 @@
+package sarama
+
+import "time"
+
+type OffsetForLeaderEpochResponseBlock struct {
+	Err KError
+	// LeaderEpoch contains the epoch the end offset belongs to, which is the
+	// largest epoch not greater than the requested one (version 1+).
+	LeaderEpoch int32
+	// EndOffset contains the end offset of the epoch, or -1 if it is unknown.
+	EndOffset int64
+}
+
+// encode writes the block after the partition ID. Unlike in most responses
+// the error code precedes the partition ID, so it is written by the response.
+func (b *OffsetForLeaderEpochResponseBlock) encode(pe packetEncoder, version int16) {
+	if version >= 1 {
+		pe.putInt32(b.LeaderEpoch)
+	}
+	pe.putInt64(b.EndOffset)
+}
+
+func (b *OffsetForLeaderEpochResponseBlock) decode(pd packetDecoder, version int16) (err error) {
+	b.LeaderEpoch = -1
+	if version >= 1 {
+		if b.LeaderEpoch, err = pd.getInt32(); err != nil {
+			return err
+		}
+	}
+	b.EndOffset, err = pd.getInt64()
+	return err
+}
+
+// OffsetForLeaderEpochResponse holds the end offsets of the leader epochs
+// requested by an OffsetForLeaderEpochRequest.
+type OffsetForLeaderEpochResponse struct {
+	Version      int16
+	ThrottleTime time.Duration
+	Blocks       map[string]map[int32]*OffsetForLeaderEpochResponseBlock
+}
+
+func (r *OffsetForLeaderEpochResponse) encode(pe packetEncoder) error {
+	if r.Version >= 2 {
+		pe.putInt32(int32(r.ThrottleTime / time.Millisecond))
+	}
+
+	if err := pe.putArrayLength(len(r.Blocks)); err != nil {
+		return err
+	}
+	for topic, partitions := range r.Blocks {
+		if err := pe.putString(topic); err != nil {
+			return err
+		}
+		if err := pe.putArrayLength(len(partitions)); err != nil {
+			return err
+		}
+		for partition, block := range partitions {
+			pe.putInt16(int16(block.Err))
+			pe.putInt32(partition)
+			block.encode(pe, r.Version)
+		}
+	}
+	return nil
+}
+
+func (r *OffsetForLeaderEpochResponse) decode(pd packetDecoder, version int16) error {
+	r.Version = version
+
+	if version >= 2 {
+		throttleTime, err := pd.getInt32()
+		if err != nil {
+			return err
+		}
+		r.ThrottleTime = time.Duration(throttleTime) * time.Millisecond
+	}
+
+	numTopics, err := pd.getArrayLength()
+	if err != nil {
+		return err
+	}
+	if numTopics < 0 {
+		return errInvalidArrayLength
+	}
+
+	r.Blocks = make(map[string]map[int32]*OffsetForLeaderEpochResponseBlock, numTopics)
+	for i := 0; i < numTopics; i++ {
+		name, err := pd.getString()
+		if err != nil {
+			return err
+		}
+
+		numBlocks, err := pd.getArrayLength()
+		if err != nil {
+			return err
+		}
+		if numBlocks < 0 {
+			return errInvalidArrayLength
+		}
+
+		r.Blocks[name] = make(map[int32]*OffsetForLeaderEpochResponseBlock, numBlocks)
+		for j := 0; j < numBlocks; j++ {
+			kerr, err := pd.getInt16()
+			if err != nil {
+				return err
+			}
+			id, err := pd.getInt32()
+			if err != nil {
+				return err
+			}
+
+			block := &OffsetForLeaderEpochResponseBlock{Err: KError(kerr)}
+			if err := block.decode(pd, version); err != nil {
+				return err
+			}
+			r.Blocks[name][id] = block
+		}
+	}
+
+	return nil
+}
+
+func (r *OffsetForLeaderEpochResponse) GetBlock(topic string, partition int32) *OffsetForLeaderEpochResponseBlock {
+	if r.Blocks == nil {
+		return nil
+	}
+
+	if r.Blocks[topic] == nil {
+		return nil
+	}
+
+	return r.Blocks[topic][partition]
+}
+
+func (r *OffsetForLeaderEpochResponse) key() int16 {
+	return 23
+}
+
+func (r *OffsetForLeaderEpochResponse) version() int16 {
+	return r.Version
+}
+
+func (r *OffsetForLeaderEpochResponse) headerVersion() int16 {
+	return 0
+}
+
+func (r *OffsetForLeaderEpochResponse) isValidVersion() bool {
+	return r.Version >= 0 && r.Version <= 3
+}
+
+func (r *OffsetForLeaderEpochResponse) requiredVersion() KafkaVersion {
+	switch r.Version {
+	case 3:
+		return V2_3_0_0
+	case 2:
+		return V2_1_0_0
+	case 1:
+		return V2_0_0_0
+	case 0:
+		return V0_11_0_0
+	default:
+		return V2_3_0_0
+	}
+}
+
+func (r *OffsetForLeaderEpochResponse) throttleTime() time.Duration {
+	return r.ThrottleTime
+}
+
+// testing API
+
+func (r *OffsetForLeaderEpochResponse) AddBlock(topic string, partition int32, leaderEpoch int32, endOffset int64, kerr KError) {
+	if r.Blocks == nil {
+		r.Blocks = make(map[string]map[int32]*OffsetForLeaderEpochResponseBlock)
+	}
+	if r.Blocks[topic] == nil {
+		r.Blocks[topic] = make(map[int32]*OffsetForLeaderEpochResponseBlock)
+	}
+	r.Blocks[topic][partition] = &OffsetForLeaderEpochResponseBlock{Err: kerr, LeaderEpoch: leaderEpoch, EndOffset: endOffset}
+}
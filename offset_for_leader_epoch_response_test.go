@@ -0,0 +1,50 @@
+package sarama
+
+import (
+	"testing"
+	"time"
+)
+
+var (
+	offsetForLeaderEpochResponseV0 = []byte{
+		0x00, 0x00, 0x00, 0x01, // 1 topic
+		0x00, 0x03, 'f', 'o', 'o', // topic name: foo
+		0x00, 0x00, 0x00, 0x01, // 1 partition
+		0x00, 0x00, // no error
+		0x00, 0x00, 0x00, 0x04, // partition 4
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2a, // end offset 42
+	}
+
+	offsetForLeaderEpochResponseV2 = []byte{
+		0x00, 0x00, 0x00, 0x64, // throttle time 100ms
+		0x00, 0x00, 0x00, 0x01, // 1 topic
+		0x00, 0x03, 'f', 'o', 'o', // topic name: foo
+		0x00, 0x00, 0x00, 0x01, // 1 partition
+		0x00, 0x4a, // ErrFencedLeaderEpoch
+		0x00, 0x00, 0x00, 0x04, // partition 4
+		0xff, 0xff, 0xff, 0xff, // leader epoch -1
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // end offset -1
+	}
+)
+
+func TestOffsetForLeaderEpochResponse(t *testing.T) {
+	response := &OffsetForLeaderEpochResponse{}
+	response.AddBlock("foo", 4, -1, 42, ErrNoError)
+	testResponse(t, "V0", response, offsetForLeaderEpochResponseV0)
+
+	response = &OffsetForLeaderEpochResponse{Version: 2, ThrottleTime: 100 * time.Millisecond}
+	response.AddBlock("foo", 4, -1, -1, ErrFencedLeaderEpoch)
+	testResponse(t, "V2", response, offsetForLeaderEpochResponseV2)
+
+	response = &OffsetForLeaderEpochResponse{Version: 3}
+	response.AddBlock("foo", 4, 7, 42, ErrNoError)
+	response.AddBlock("bar", 0, 3, 10, ErrNoError)
+	testResponse(t, "V3", response, nil)
+
+	if block := response.GetBlock("foo", 4); block == nil || block.EndOffset != 42 || block.LeaderEpoch != 7 {
+		t.Errorf("unexpected block %+v", block)
+	}
+	if block := response.GetBlock("foo", 5); block != nil {
+		t.Errorf("expected no block for an unknown partition, got %+v", block)
+	}
+}
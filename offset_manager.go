@@ -1,13 +1,14 @@
 package sarama
 
 import (
+	"errors"
 	"sync"
-	"time"
 )
 
 // Offset Manager
 
-// OffsetManager uses Kafka to store and fetch consumed partition offsets.
+// OffsetManager uses Kafka, or the OffsetStore set in Consumer.Offsets.Store,
+// to store and fetch consumed partition offsets.
 type OffsetManager interface {
 	// ManagePartition creates a PartitionOffsetManager on the given topic/partition.
 	// It will return an error if this OffsetManager is already managing the given
@@ -29,16 +30,14 @@ type offsetManager struct {
 	client          Client
 	conf            *Config
 	group           string
-	ticker          *time.Ticker
+	store           OffsetStore
+	ticker          clockTicker
 	sessionCanceler func()
 
 	memberID        string
-	groupInstanceId *string
+	groupInstanceId string
 	generation      int32
 
-	broker     *Broker
-	brokerLock sync.RWMutex
-
 	poms     map[string]map[int32]*partitionOffsetManager
 	pomsLock sync.RWMutex
 
@@ -67,18 +66,17 @@ func newOffsetManagerFromClient(group, memberID string, generation int32, client
 		poms:            make(map[string]map[int32]*partitionOffsetManager),
 		sessionCanceler: sessionCanceler,
 
-		memberID:   memberID,
-		generation: generation,
+		memberID:        memberID,
+		groupInstanceId: conf.Consumer.Group.InstanceId,
+		generation:      generation,
 
 		closing: make(chan none),
 		closed:  make(chan none),
 	}
-	if conf.Consumer.Group.InstanceId != "" {
-		om.groupInstanceId = &conf.Consumer.Group.InstanceId
-	}
+	om.store = offsetStore(client, om.closing)
 	if conf.Consumer.Offsets.AutoCommit.Enable {
-		om.ticker = time.NewTicker(conf.Consumer.Offsets.AutoCommit.Interval)
-		go withRecover(om.mainLoop)
+		om.ticker = conf.getClock().NewTicker(conf.Consumer.Offsets.AutoCommit.Interval)
+		goWithRecover(conf.MetricRegistry, om.mainLoop)
 	}
 
 	return om, nil
@@ -120,115 +118,77 @@ func (om *offsetManager) Close() error {
 
 		// flush one last time
 		if om.conf.Consumer.Offsets.AutoCommit.Enable {
-			for attempt := 0; attempt <= om.conf.Consumer.Offsets.Retry.Max; attempt++ {
-				om.flushToBroker()
-				if om.releasePOMs(false) == 0 {
-					break
-				}
-			}
+			om.flushToStore(nil)
 		}
 
 		om.releasePOMs(true)
-		om.brokerLock.Lock()
-		om.broker = nil
-		om.brokerLock.Unlock()
 	})
 	return nil
 }
 
-func (om *offsetManager) computeBackoff(retries int) time.Duration {
-	if om.conf.Metadata.Retry.BackoffFunc != nil {
-		return om.conf.Metadata.Retry.BackoffFunc(retries, om.conf.Metadata.Retry.Max)
-	} else {
-		return om.conf.Metadata.Retry.Backoff
+// offsetStore returns the OffsetStore configured for client, or the Kafka
+// store whose fetches are aborted once closing is closed.
+func offsetStore(client Client, closing <-chan none) OffsetStore {
+	if store := client.Config().Consumer.Offsets.Store; store != nil {
+		return store
 	}
+	return newKafkaOffsetStore(client, closing)
 }
 
-func (om *offsetManager) fetchInitialOffset(topic string, partition int32, retries int) (int64, int32, string, error) {
-	broker, err := om.coordinator()
-	if err != nil {
-		if retries <= 0 {
-			return 0, 0, "", err
-		}
-		return om.fetchInitialOffset(topic, partition, retries-1)
+// ResolveStartingOffset returns a safe offset for a member of group to resume
+// consuming the given topic/partition from. The offset committed by the group
+// is validated against the log of the partition: if it was committed along
+// with the leader epoch of the last consumed record (KIP-320) and the log has
+// since been truncated, e.g. by an unclean leader election, it is moved back
+// to the end offset of that epoch. Offsets which are no longer within the log
+// are reset to Consumer.Offsets.Initial if Consumer.Group.ResetInvalidOffsets
+// is set, or fail with ErrOffsetOutOfRange otherwise. Partitions without a
+// committed offset start from Consumer.Offsets.Initial.
+func ResolveStartingOffset(client Client, group, topic string, partition int32) (int64, error) {
+	if client.Closed() {
+		return -1, ErrClosedClient
 	}
 
-	partitions := map[string][]int32{topic: {partition}}
-	req := NewOffsetFetchRequest(om.conf.Version, om.group, partitions)
-	resp, err := broker.FetchOffset(req)
+	conf := client.Config()
+	offset, leaderEpoch, _, err := offsetStore(client, nil).FetchOffset(group, topic, partition)
 	if err != nil {
-		if retries <= 0 {
-			return 0, 0, "", err
-		}
-		om.releaseCoordinator(broker)
-		return om.fetchInitialOffset(topic, partition, retries-1)
+		return -1, err
 	}
-
-	block := resp.GetBlock(topic, partition)
-	if block == nil {
-		return 0, 0, "", ErrIncompleteResponse
+	if offset < 0 {
+		return client.GetOffset(topic, partition, conf.Consumer.Offsets.Initial)
 	}
 
-	switch block.Err {
-	case ErrNoError:
-		return block.Offset, block.LeaderEpoch, block.Metadata, nil
-	case ErrNotCoordinatorForConsumer:
-		if retries <= 0 {
-			return 0, 0, "", block.Err
-		}
-		om.releaseCoordinator(broker)
-		return om.fetchInitialOffset(topic, partition, retries-1)
-	case ErrOffsetsLoadInProgress:
-		if retries <= 0 {
-			return 0, 0, "", block.Err
+	if leaderEpoch >= 0 && conf.Version.IsAtLeast(V2_1_0_0) {
+		endOffset, _, err := client.OffsetForLeaderEpoch(topic, partition, leaderEpoch)
+		if err != nil {
+			return -1, err
 		}
-		backoff := om.computeBackoff(retries)
-		select {
-		case <-om.closing:
-			return 0, 0, "", block.Err
-		case <-time.After(backoff):
+		if endOffset >= 0 && endOffset < offset {
+			Logger.Printf("offset/%s/%s/%d committed offset %d was truncated to %d (epoch %d)\n",
+				group, topic, partition, offset, endOffset, leaderEpoch)
+			offset = endOffset
 		}
-		return om.fetchInitialOffset(topic, partition, retries-1)
-	default:
-		return 0, 0, "", block.Err
-	}
-}
-
-func (om *offsetManager) coordinator() (*Broker, error) {
-	om.brokerLock.RLock()
-	broker := om.broker
-	om.brokerLock.RUnlock()
-
-	if broker != nil {
-		return broker, nil
 	}
 
-	om.brokerLock.Lock()
-	defer om.brokerLock.Unlock()
-
-	if broker := om.broker; broker != nil {
-		return broker, nil
-	}
-
-	if err := om.client.RefreshCoordinator(om.group); err != nil {
-		return nil, err
+	oldestOffset, err := client.GetOffset(topic, partition, OffsetOldest)
+	if err != nil {
+		return -1, err
 	}
-
-	broker, err := om.client.Coordinator(om.group)
+	newestOffset, err := client.GetOffset(topic, partition, OffsetNewest)
 	if err != nil {
-		return nil, err
+		return -1, err
 	}
 
-	om.broker = broker
-	return broker, nil
-}
-
-func (om *offsetManager) releaseCoordinator(b *Broker) {
-	om.brokerLock.Lock()
-	if om.broker == b {
-		om.broker = nil
+	switch {
+	case offset >= oldestOffset && offset <= newestOffset:
+		return offset, nil
+	case !conf.Consumer.Group.ResetInvalidOffsets:
+		return -1, ErrOffsetOutOfRange
+	case conf.Consumer.Offsets.Initial == OffsetOldest:
+		return oldestOffset, nil
+	default:
+		return newestOffset, nil
 	}
-	om.brokerLock.Unlock()
 }
 
 func (om *offsetManager) mainLoop() {
@@ -237,7 +197,7 @@ func (om *offsetManager) mainLoop() {
 
 	for {
 		select {
-		case <-om.ticker.C:
+		case <-om.ticker.C():
 			om.Commit()
 		case <-om.closing:
 			return
@@ -246,82 +206,88 @@ func (om *offsetManager) mainLoop() {
 }
 
 func (om *offsetManager) Commit() {
-	om.flushToBroker()
+	om.flushToStore(om.closing)
 	om.releasePOMs(false)
 }
 
-func (om *offsetManager) flushToBroker() {
-	req := om.constructRequest()
-	if req == nil {
-		return
-	}
+// flushToStore commits the dirty offsets, retrying the partitions whose
+// commit failed with a retriable error up to Consumer.Offsets.Retry.Max
+// times. The retries are abandoned once abort is closed.
+func (om *offsetManager) flushToStore(abort <-chan none) {
+	var retry map[string]map[int32]error
+	for attempt := 0; ; attempt++ {
+		commit := om.constructCommit(retry)
+		if commit == nil {
+			return
+		}
 
-	broker, err := om.coordinator()
-	if err != nil {
-		om.handleError(err)
-		return
+		errs, err := om.store.CommitOffsets(commit)
+		if err == nil {
+			retry = om.handleCommitErrors(commit, errs)
+			if len(retry) == 0 {
+				return
+			}
+		}
+
+		if attempt >= om.conf.Consumer.Offsets.Retry.Max {
+			om.handleCommitFailure(err, retry)
+			return
+		}
+		if err != nil {
+			Logger.Printf("offset/%s commit failed: %v, retrying (%d attempts remaining)\n",
+				om.group, err, om.conf.Consumer.Offsets.Retry.Max-attempt)
+			retry = nil
+		} else {
+			Logger.Printf("offset/%s commit of %d partitions failed, retrying (%d attempts remaining)\n",
+				om.group, countPartitions(retry), om.conf.Consumer.Offsets.Retry.Max-attempt)
+		}
+
+		select {
+		case <-om.conf.getClock().After(om.conf.Consumer.Offsets.Retry.Backoff):
+		case <-abort:
+			return
+		}
 	}
+}
 
-	resp, err := broker.CommitOffset(req)
+// handleCommitFailure reports a commit which failed as a whole with err, or
+// whose partitions in failed were not committed, once retries are exhausted.
+func (om *offsetManager) handleCommitFailure(err error, failed map[string]map[int32]error) {
 	if err != nil {
 		om.handleError(err)
-		om.releaseCoordinator(broker)
-		_ = broker.Close()
-		return
+	} else {
+		om.pomsLock.RLock()
+		for topic, partitions := range failed {
+			for partition, perr := range partitions {
+				if pom := om.poms[topic][partition]; pom != nil {
+					pom.handleError(perr)
+				}
+				err = perr
+			}
+		}
+		om.pomsLock.RUnlock()
 	}
 
-	om.handleResponse(broker, req, resp)
+	if onCommitError := om.conf.Consumer.Offsets.OnCommitError; onCommitError != nil {
+		onCommitError(err)
+	}
 }
 
-func (om *offsetManager) constructRequest() *OffsetCommitRequest {
-	r := &OffsetCommitRequest{
-		Version:                 1,
-		ConsumerGroup:           om.group,
-		ConsumerID:              om.memberID,
-		ConsumerGroupGeneration: om.generation,
-	}
-	// Version 1 adds timestamp and group membership information, as well as the commit timestamp.
-	//
-	// Version 2 adds retention time.  It removes the commit timestamp added in version 1.
-	if om.conf.Version.IsAtLeast(V0_9_0_0) {
-		r.Version = 2
-	}
-	// Version 3 and 4 are the same as version 2.
-	if om.conf.Version.IsAtLeast(V0_11_0_0) {
-		r.Version = 3
-	}
-	if om.conf.Version.IsAtLeast(V2_0_0_0) {
-		r.Version = 4
+func countPartitions(partitions map[string]map[int32]error) (n int) {
+	for _, p := range partitions {
+		n += len(p)
 	}
-	// Version 5 removes the retention time, which is now controlled only by a broker configuration.
-	//
-	// Version 6 adds the leader epoch for fencing.
-	if om.conf.Version.IsAtLeast(V2_1_0_0) {
-		r.Version = 6
-	}
-	// version 7 adds a new field called groupInstanceId to indicate member identity across restarts.
-	if om.conf.Version.IsAtLeast(V2_3_0_0) {
-		r.Version = 7
-		r.GroupInstanceId = om.groupInstanceId
-	}
-
-	// commit timestamp was only briefly supported in V1 where we set it to
-	// ReceiveTime (-1) to tell the broker to set it to the time when the commit
-	// request was received
-	var commitTimestamp int64
-	if r.Version == 1 {
-		commitTimestamp = ReceiveTime
-	}
-
-	// request controlled retention was only supported from V2-V4 (it became
-	// broker-only after that) so if the user has set the config options then
-	// flow those through as retention time on the commit request.
-	if r.Version >= 2 && r.Version < 5 {
-		// Map Sarama's default of 0 to Kafka's default of -1
-		r.RetentionTime = -1
-		if om.conf.Consumer.Offsets.Retention > 0 {
-			r.RetentionTime = int64(om.conf.Consumer.Offsets.Retention / time.Millisecond)
-		}
+	return n
+}
+
+// constructCommit returns a commit of the dirty offsets, restricted to the
+// partitions in only unless it is nil, or nil if there are none.
+func (om *offsetManager) constructCommit(only map[string]map[int32]error) *OffsetCommit {
+	commit := &OffsetCommit{
+		Group:           om.group,
+		MemberID:        om.memberID,
+		GenerationID:    om.generation,
+		GroupInstanceID: om.groupInstanceId,
 	}
 
 	om.pomsLock.RLock()
@@ -329,73 +295,68 @@ func (om *offsetManager) constructRequest() *OffsetCommitRequest {
 
 	for _, topicManagers := range om.poms {
 		for _, pom := range topicManagers {
+			if only != nil {
+				if _, ok := only[pom.topic][pom.partition]; !ok {
+					continue
+				}
+			}
 			pom.lock.Lock()
 			if pom.dirty {
-				r.AddBlockWithLeaderEpoch(pom.topic, pom.partition, pom.offset, pom.leaderEpoch, commitTimestamp, pom.metadata)
+				commit.add(pom.topic, pom.partition, StoredOffset{Offset: pom.offset, LeaderEpoch: pom.leaderEpoch, Metadata: pom.metadata})
 			}
 			pom.lock.Unlock()
 		}
 	}
 
-	if len(r.blocks) > 0 {
-		return r
+	if len(commit.Offsets) > 0 {
+		return commit
 	}
 
 	return nil
 }
 
-func (om *offsetManager) handleResponse(broker *Broker, req *OffsetCommitRequest, resp *OffsetCommitResponse) {
+// handleCommitErrors handles the outcome of a commit, and returns the
+// partitions whose commit failed with a retriable error.
+func (om *offsetManager) handleCommitErrors(commit *OffsetCommit, errs map[string]map[int32]error) (retry map[string]map[int32]error) {
 	om.pomsLock.RLock()
 	defer om.pomsLock.RUnlock()
 
 	for _, topicManagers := range om.poms {
 		for _, pom := range topicManagers {
-			if req.blocks[pom.topic] == nil || req.blocks[pom.topic][pom.partition] == nil {
+			offset, ok := commit.Offsets[pom.topic][pom.partition]
+			if !ok {
 				continue
 			}
 
-			var err KError
-			var ok bool
-
-			if resp.Errors[pom.topic] == nil {
-				pom.handleError(ErrIncompleteResponse)
-				continue
-			}
-			if err, ok = resp.Errors[pom.topic][pom.partition]; !ok {
-				pom.handleError(ErrIncompleteResponse)
-				continue
-			}
-
-			switch err {
-			case ErrNoError:
-				block := req.blocks[pom.topic][pom.partition]
-				pom.updateCommitted(block.offset, block.metadata)
-			case ErrNotLeaderForPartition, ErrLeaderNotAvailable,
-				ErrConsumerCoordinatorNotAvailable, ErrNotCoordinatorForConsumer:
-				// not a critical error, we just need to redispatch
-				om.releaseCoordinator(broker)
-			case ErrOffsetMetadataTooLarge, ErrInvalidCommitOffsetSize:
-				// nothing we can do about this, just tell the user and carry on
-				pom.handleError(err)
-			case ErrOffsetsLoadInProgress:
-				// nothing wrong but we didn't commit, we'll get it next time round
-			case ErrFencedInstancedId:
+			err := errs[pom.topic][pom.partition]
+			switch {
+			case err == nil:
+				pom.updateCommitted(offset.Offset, offset.Metadata)
+			case errors.Is(err, ErrNotLeaderForPartition), errors.Is(err, ErrLeaderNotAvailable),
+				errors.Is(err, ErrConsumerCoordinatorNotAvailable), errors.Is(err, ErrNotCoordinatorForConsumer),
+				errors.Is(err, ErrOffsetsLoadInProgress):
+				// not a critical error, we didn't commit but we'll retry
+				if retry == nil {
+					retry = make(map[string]map[int32]error)
+				}
+				if retry[pom.topic] == nil {
+					retry[pom.topic] = make(map[int32]error)
+				}
+				retry[pom.topic][pom.partition] = err
+			case errors.Is(err, ErrFencedInstancedId):
 				pom.handleError(err)
 				// TODO close the whole consumer for instance fenced....
 				om.tryCancelSession()
-			case ErrUnknownTopicOrPartition:
-				// let the user know *and* try redispatching - if topic-auto-create is
-				// enabled, redispatching should trigger a metadata req and create the
-				// topic; if not then re-dispatching won't help, but we've let the user
-				// know and it shouldn't hurt either (see https://github.com/IBM/sarama/issues/706)
-				fallthrough
 			default:
-				// dunno, tell the user and try redispatching
+				// dunno, tell the user and carry on - if the topic is unknown
+				// and topic-auto-create is enabled, retrying should create the
+				// topic; if not then it won't help, but we've let the user
+				// know and it shouldn't hurt either (see https://github.com/IBM/sarama/issues/706)
 				pom.handleError(err)
-				om.releaseCoordinator(broker)
 			}
 		}
 	}
+	return retry
 }
 
 func (om *offsetManager) handleError(err error) {
@@ -535,7 +496,7 @@ type partitionOffsetManager struct {
 }
 
 func (om *offsetManager) newPartitionOffsetManager(topic string, partition int32) (*partitionOffsetManager, error) {
-	offset, leaderEpoch, metadata, err := om.fetchInitialOffset(topic, partition, om.conf.Metadata.Retry.Max)
+	offset, leaderEpoch, metadata, err := om.store.FetchOffset(om.group, topic, partition)
 	if err != nil {
 		return nil, err
 	}
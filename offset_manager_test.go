@@ -277,14 +277,17 @@ func TestOffsetManagerFetchInitialFail(t *testing.T) {
 	safeClose(t, testClient)
 }
 
-// Test fetchInitialOffset retry on ErrOffsetsLoadInProgress
+// Test fetchInitialOffset retry on ErrOffsetsLoadInProgress once the
+// coordinator retry timeout has elapsed
 func TestOffsetManagerFetchInitialLoadInProgress(t *testing.T) {
 	retryCount := int32(0)
 	backoff := func(retries, maxRetries int) time.Duration {
 		atomic.AddInt32(&retryCount, 1)
 		return 0
 	}
-	om, testClient, broker, coordinator := initOffsetManagerWithBackoffFunc(t, 0, backoff, NewTestConfig())
+	config := NewTestConfig()
+	config.Consumer.Group.Coordinator.Retry.Timeout = 0
+	om, testClient, broker, coordinator := initOffsetManagerWithBackoffFunc(t, 0, backoff, config)
 	defer broker.Close()
 	defer coordinator.Close()
 
@@ -320,6 +323,151 @@ func TestOffsetManagerFetchInitialLoadInProgress(t *testing.T) {
 	}
 }
 
+// Test fetchInitialOffset waits for a loading coordinator without using up
+// Metadata.Retry.Max
+func TestOffsetManagerFetchInitialCoordinatorLoading(t *testing.T) {
+	om, testClient, broker, coordinator := initOffsetManager(t, 0)
+	defer broker.Close()
+	defer coordinator.Close()
+
+	// more errors than Metadata.Retry.Max allows for
+	for i := 0; i < 3; i++ {
+		fetchResponse := new(OffsetFetchResponse)
+		fetchResponse.AddBlock("my_topic", 0, &OffsetFetchResponseBlock{Err: ErrOffsetsLoadInProgress})
+		coordinator.Returns(fetchResponse)
+	}
+	fetchResponse := new(OffsetFetchResponse)
+	fetchResponse.AddBlock("my_topic", 0, &OffsetFetchResponseBlock{Offset: 5, Metadata: "test_meta"})
+	coordinator.Returns(fetchResponse)
+
+	pom, err := om.ManagePartition("my_topic", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, metadata := pom.NextOffset(); offset != 5 || metadata != "test_meta" {
+		t.Errorf("Expected offset 5 with metadata test_meta, got %d %q", offset, metadata)
+	}
+
+	safeClose(t, pom)
+	safeClose(t, om)
+	safeClose(t, testClient)
+}
+
+// Test fetchInitialOffset backs off a loading coordinator with the config clock
+func TestOffsetManagerFetchInitialCoordinatorLoadingClock(t *testing.T) {
+	clock := newFakeClock()
+	config := NewTestConfig()
+	config.clock = clock
+	config.Metadata.RefreshFrequency = 0
+	config.Consumer.Group.Coordinator.Retry.Backoff = time.Hour
+	om, testClient, broker, coordinator := initOffsetManagerWithBackoffFunc(t, 0, nil, config)
+	defer broker.Close()
+	defer coordinator.Close()
+
+	loading := new(OffsetFetchResponse)
+	loading.AddBlock("my_topic", 0, &OffsetFetchResponseBlock{Err: ErrOffsetsLoadInProgress})
+	coordinator.Returns(loading)
+	fetchResponse := new(OffsetFetchResponse)
+	fetchResponse.AddBlock("my_topic", 0, &OffsetFetchResponseBlock{Offset: 5, Metadata: "test_meta"})
+	coordinator.Returns(fetchResponse)
+
+	managed := make(chan PartitionOffsetManager)
+	go func() {
+		pom, err := om.ManagePartition("my_topic", 0)
+		if err != nil {
+			t.Error(err)
+		}
+		managed <- pom
+	}()
+
+	// keep the clock moving, for the backoff and then the commits on close
+	stop := make(chan none)
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				clock.Advance(time.Hour)
+			}
+		}
+	}()
+
+	var pom PartitionOffsetManager
+	select {
+	case pom = <-managed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the backoff to follow the config clock")
+	}
+	if offset, metadata := pom.NextOffset(); offset != 5 || metadata != "test_meta" {
+		t.Errorf("Expected offset 5 with metadata test_meta, got %d %q", offset, metadata)
+	}
+
+	safeClose(t, pom)
+	safeClose(t, om)
+	safeClose(t, testClient)
+}
+
+func TestResolveStartingOffset(t *testing.T) {
+	tests := []struct {
+		name          string
+		committed     int64
+		leaderEpoch   int32
+		epochEnd      int64
+		initial       int64
+		resetInvalid  bool
+		expected      int64
+		expectedError error
+	}{
+		{name: "valid", committed: 10, leaderEpoch: 3, epochEnd: 15, initial: OffsetNewest, expected: 10},
+		{name: "truncated", committed: 10, leaderEpoch: 3, epochEnd: 7, initial: OffsetNewest, expected: 7},
+		{name: "not committed", committed: -1, leaderEpoch: -1, initial: OffsetNewest, expected: 20},
+		{name: "out of range reset", committed: 50, leaderEpoch: -1, initial: OffsetOldest, resetInvalid: true, expected: 2},
+		{name: "out of range", committed: 50, leaderEpoch: -1, initial: OffsetOldest, expectedError: ErrOffsetOutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := NewMockBroker(t, 1)
+			defer broker.Close()
+
+			broker.SetHandlerByMap(map[string]MockResponse{
+				"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+				"MetadataRequest": NewMockMetadataResponse(t).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetLeader("my_topic", 0, broker.BrokerID()),
+				"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+					SetCoordinator(CoordinatorGroup, "group", broker),
+				"OffsetFetchRequest": NewMockOffsetFetchResponse(t).
+					SetOffsetWithLeaderEpoch("group", "my_topic", 0, tt.committed, tt.leaderEpoch, "", ErrNoError),
+				"OffsetForLeaderEpochRequest": NewMockOffsetForLeaderEpochResponse(t).
+					SetEndOffset("my_topic", 0, 3, tt.epochEnd, 3),
+				"OffsetRequest": NewMockOffsetResponse(t).
+					SetOffset("my_topic", 0, OffsetOldest, 2).
+					SetOffset("my_topic", 0, OffsetNewest, 20),
+			})
+
+			config := NewTestConfig()
+			config.Version = V2_1_0_0
+			config.Consumer.Offsets.Initial = tt.initial
+			config.Consumer.Group.ResetInvalidOffsets = tt.resetInvalid
+			client, err := NewClient([]string{broker.Addr()}, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer safeClose(t, client)
+
+			offset, err := ResolveStartingOffset(client, "group", "my_topic", 0)
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("expected error %v, got %v", tt.expectedError, err)
+			}
+			if err == nil && offset != tt.expected {
+				t.Errorf("expected offset %d, got %d", tt.expected, offset)
+			}
+		})
+	}
+}
+
 func TestPartitionOffsetManagerInitialOffset(t *testing.T) {
 	om, testClient, broker, coordinator := initOffsetManager(t, 0)
 	defer broker.Close()
@@ -617,13 +765,15 @@ func TestConstructRequestRetentionTime(t *testing.T) {
 					poms: map[string]map[int32]*partitionOffsetManager{
 						"topic": {
 							0: {
+								topic: "topic",
 								dirty: true,
 							},
 						},
 					},
 				}
+				store := &kafkaOffsetStore{conf: conf}
 
-				req := om.constructRequest()
+				req := store.constructRequest(om.constructCommit(nil))
 
 				expectedRetention := expectedRetention(version, retention)
 				if req.RetentionTime != expectedRetention {
@@ -633,3 +783,73 @@ func TestConstructRequestRetentionTime(t *testing.T) {
 		}
 	}
 }
+
+func TestOffsetManagerCommitRetries(t *testing.T) {
+	config := NewTestConfig()
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	config.Consumer.Offsets.Retry.Max = 2
+	config.Consumer.Return.Errors = true
+	commitErrs := make(chan error, 10)
+	config.Consumer.Offsets.OnCommitError = func(err error) { commitErrs <- err }
+	om, testClient, broker, coordinator := initOffsetManagerWithBackoffFunc(t, 0, nil, config)
+	defer broker.Close()
+	defer coordinator.Close()
+	pom := initPartitionOffsetManager(t, om, coordinator, 5, "")
+
+	countCommits := func() (n int) {
+		for _, rr := range coordinator.History() {
+			if _, ok := rr.Request.(*OffsetCommitRequest); ok {
+				n++
+			}
+		}
+		return n
+	}
+	loading := new(OffsetCommitResponse)
+	loading.AddError("my_topic", 0, ErrOffsetsLoadInProgress)
+	committed := new(OffsetCommitResponse)
+	committed.AddError("my_topic", 0, ErrNoError)
+
+	// a commit failing once is retried
+	coordinator.Returns(loading)
+	coordinator.Returns(committed)
+	pom.MarkOffset(10, "")
+	om.Commit()
+	if n := countCommits(); n != 2 {
+		t.Errorf("expected the commit to be retried once, got %d commits", n)
+	}
+	select {
+	case err := <-commitErrs:
+		t.Errorf("expected the retried commit to succeed, got %v", err)
+	default:
+	}
+
+	// a commit failing persistently is retried Retry.Max times and reported
+	for i := 0; i < 3; i++ {
+		coordinator.Returns(loading)
+	}
+	pom.MarkOffset(20, "")
+	om.Commit()
+	if n := countCommits(); n != 5 {
+		t.Errorf("expected the commit to be retried twice, got %d commits", n-2)
+	}
+	select {
+	case err := <-commitErrs:
+		if !errors.Is(err, ErrOffsetsLoadInProgress) {
+			t.Errorf("expected OnCommitError to be called with %v, got %v", ErrOffsetsLoadInProgress, err)
+		}
+	default:
+		t.Error("expected OnCommitError to be called")
+	}
+	select {
+	case err := <-pom.Errors():
+		if !errors.Is(err.Err, ErrOffsetsLoadInProgress) {
+			t.Errorf("expected %v on the errors channel, got %v", ErrOffsetsLoadInProgress, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the commit failure on the errors channel")
+	}
+
+	safeClose(t, om)
+	safeClose(t, pom)
+	safeClose(t, testClient)
+}
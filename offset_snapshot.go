@@ -0,0 +1,30 @@
+package sarama
+
+// OffsetSnapshot holds the committed offsets of a consumer group, as exported
+// by ClusterAdmin.ExportConsumerGroupOffsets. It can be serialized, e.g. to
+// JSON, and imported into a group of another cluster with
+// ClusterAdmin.ImportConsumerGroupOffsets.
+type OffsetSnapshot struct {
+	// Group is the consumer group the offsets were exported from.
+	Group string `json:"group"`
+	// Offsets holds the committed offsets by topic and partition.
+	Offsets map[string]map[int32]SnapshotOffset `json:"offsets"`
+}
+
+// SnapshotOffset is a committed offset held by an OffsetSnapshot. The leader
+// epoch is left out as it has no meaning on another cluster.
+type SnapshotOffset struct {
+	Offset   int64  `json:"offset"`
+	Metadata string `json:"metadata,omitempty"`
+}
+
+// AddOffset adds a committed offset to the snapshot.
+func (s *OffsetSnapshot) AddOffset(topic string, partition int32, offset int64, metadata string) {
+	if s.Offsets == nil {
+		s.Offsets = make(map[string]map[int32]SnapshotOffset)
+	}
+	if s.Offsets[topic] == nil {
+		s.Offsets[topic] = make(map[int32]SnapshotOffset)
+	}
+	s.Offsets[topic][partition] = SnapshotOffset{Offset: offset, Metadata: metadata}
+}
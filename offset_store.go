@@ -0,0 +1,353 @@
+package sarama
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OffsetStore stores the offsets committed by consumer groups. The
+// OffsetManager, and therefore consumer groups, store them in Kafka through
+// the group coordinator unless Consumer.Offsets.Store is set, e.g. to store
+// them in a database. Wrap the store returned by NewKafkaOffsetStore to store
+// them in Kafka alongside another system.
+type OffsetStore interface {
+	// FetchOffset returns the offset committed by group for the
+	// topic/partition, with the leader epoch of the last consumed record (-1
+	// if unknown) and the metadata committed along. The offset is -1 if none
+	// was committed.
+	FetchOffset(group, topic string, partition int32) (offset int64, leaderEpoch int32, metadata string, err error)
+
+	// CommitOffsets commits a batch of offsets. It returns the errors of the
+	// partitions whose offset could not be committed, or an error if the
+	// whole batch failed.
+	CommitOffsets(commit *OffsetCommit) (map[string]map[int32]error, error)
+
+	// DeleteOffsets deletes the offsets committed by group for the given
+	// topic/partitions.
+	DeleteOffsets(group string, topicPartitions map[string][]int32) error
+}
+
+// OffsetCommit is a batch of offsets committed to an OffsetStore.
+type OffsetCommit struct {
+	Group string
+	// MemberID, GenerationID and GroupInstanceID identify the member of the
+	// group committing the offsets within a consumer group session. They are
+	// empty, GroupGenerationUndefined and empty otherwise.
+	MemberID        string
+	GenerationID    int32
+	GroupInstanceID string
+	// Offsets are the offsets committed by topic and partition.
+	Offsets map[string]map[int32]StoredOffset
+}
+
+// StoredOffset is an offset stored by an OffsetStore.
+type StoredOffset struct {
+	Offset int64
+	// LeaderEpoch is the leader epoch of the last consumed record, -1 if
+	// unknown.
+	LeaderEpoch int32
+	Metadata    string
+}
+
+func (c *OffsetCommit) add(topic string, partition int32, offset StoredOffset) {
+	if c.Offsets == nil {
+		c.Offsets = make(map[string]map[int32]StoredOffset)
+	}
+	if c.Offsets[topic] == nil {
+		c.Offsets[topic] = make(map[int32]StoredOffset)
+	}
+	c.Offsets[topic][partition] = offset
+}
+
+// NewKafkaOffsetStore returns the OffsetStore storing offsets in Kafka
+// through the group coordinator, which the OffsetManager uses by default.
+func NewKafkaOffsetStore(client Client) (OffsetStore, error) {
+	if client.Closed() {
+		return nil, ErrClosedClient
+	}
+	return newKafkaOffsetStore(client, nil), nil
+}
+
+type kafkaOffsetStore struct {
+	client Client
+	conf   *Config
+
+	// closing aborts fetches waiting for the coordinator to load offsets
+	closing <-chan none
+
+	brokers    map[string]*Broker // coordinators by group
+	brokerLock sync.RWMutex
+}
+
+func newKafkaOffsetStore(client Client, closing <-chan none) *kafkaOffsetStore {
+	return &kafkaOffsetStore{
+		client:  client,
+		conf:    client.Config(),
+		closing: closing,
+		brokers: make(map[string]*Broker),
+	}
+}
+
+func (s *kafkaOffsetStore) FetchOffset(group, topic string, partition int32) (int64, int32, string, error) {
+	return s.fetchOffset(group, topic, partition, s.conf.Metadata.Retry.Max, time.Time{})
+}
+
+func (s *kafkaOffsetStore) computeBackoff(retries int) time.Duration {
+	if s.conf.Metadata.Retry.BackoffFunc != nil {
+		return s.conf.Metadata.Retry.BackoffFunc(retries, s.conf.Metadata.Retry.Max)
+	} else {
+		return s.conf.Metadata.Retry.Backoff
+	}
+}
+
+// fetchOffset fetches the committed offset of a partition. While the
+// coordinator is loading or unavailable it is retried without using up retries
+// until loadDeadline, which is set on the first such error if it is zero.
+func (s *kafkaOffsetStore) fetchOffset(group, topic string, partition int32, retries int, loadDeadline time.Time) (int64, int32, string, error) {
+	broker, err := s.coordinator(group)
+	if err != nil {
+		if retries <= 0 {
+			return 0, 0, "", err
+		}
+		return s.fetchOffset(group, topic, partition, retries-1, loadDeadline)
+	}
+
+	partitions := map[string][]int32{topic: {partition}}
+	req := NewOffsetFetchRequest(s.conf.Version, group, partitions)
+	resp, err := broker.FetchOffset(req)
+	if err != nil {
+		if retries <= 0 {
+			return 0, 0, "", err
+		}
+		s.releaseCoordinator(group, broker)
+		return s.fetchOffset(group, topic, partition, retries-1, loadDeadline)
+	}
+
+	block := resp.GetBlock(topic, partition)
+	if block == nil {
+		return 0, 0, "", ErrIncompleteResponse
+	}
+
+	switch block.Err {
+	case ErrNoError:
+		return block.Offset, block.LeaderEpoch, block.Metadata, nil
+	case ErrNotCoordinatorForConsumer:
+		if retries <= 0 {
+			return 0, 0, "", block.Err
+		}
+		s.releaseCoordinator(group, broker)
+		return s.fetchOffset(group, topic, partition, retries-1, loadDeadline)
+	case ErrOffsetsLoadInProgress, ErrConsumerCoordinatorNotAvailable:
+		if errors.Is(block.Err, ErrConsumerCoordinatorNotAvailable) {
+			s.releaseCoordinator(group, broker)
+		}
+		if loadDeadline.IsZero() {
+			loadDeadline = s.conf.getClock().Now().Add(s.conf.Consumer.Group.Coordinator.Retry.Timeout)
+		}
+		backoff := s.conf.Consumer.Group.Coordinator.Retry.Backoff
+		if !s.conf.getClock().Now().Before(loadDeadline) {
+			if retries <= 0 {
+				return 0, 0, "", block.Err
+			}
+			backoff = s.computeBackoff(retries)
+			retries--
+		}
+		select {
+		case <-s.closing:
+			return 0, 0, "", block.Err
+		case <-s.conf.getClock().After(backoff):
+		}
+		return s.fetchOffset(group, topic, partition, retries, loadDeadline)
+	default:
+		return 0, 0, "", block.Err
+	}
+}
+
+func (s *kafkaOffsetStore) CommitOffsets(commit *OffsetCommit) (map[string]map[int32]error, error) {
+	broker, err := s.coordinator(commit.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	req := s.constructRequest(commit)
+	resp, err := broker.CommitOffset(req)
+	if err != nil {
+		s.releaseCoordinator(commit.Group, broker)
+		_ = broker.Close()
+		return nil, err
+	}
+
+	var errs map[string]map[int32]error
+	for topic, partitions := range commit.Offsets {
+		for partition := range partitions {
+			var err error = ErrIncompleteResponse
+			if kerr, ok := resp.Errors[topic][partition]; ok {
+				err = kerr
+			}
+
+			switch err {
+			case ErrNoError:
+				continue
+			case ErrIncompleteResponse, ErrOffsetMetadataTooLarge, ErrInvalidCommitOffsetSize,
+				ErrOffsetsLoadInProgress, ErrFencedInstancedId:
+			default:
+				// redispatch to the coordinator, which might have moved
+				s.releaseCoordinator(commit.Group, broker)
+			}
+			if errs == nil {
+				errs = make(map[string]map[int32]error)
+			}
+			if errs[topic] == nil {
+				errs[topic] = make(map[int32]error)
+			}
+			errs[topic][partition] = err
+		}
+	}
+	return errs, nil
+}
+
+func (s *kafkaOffsetStore) constructRequest(commit *OffsetCommit) *OffsetCommitRequest {
+	r := &OffsetCommitRequest{
+		Version:                 1,
+		ConsumerGroup:           commit.Group,
+		ConsumerID:              commit.MemberID,
+		ConsumerGroupGeneration: commit.GenerationID,
+	}
+	// Version 1 adds timestamp and group membership information, as well as the commit timestamp.
+	//
+	// Version 2 adds retention time.  It removes the commit timestamp added in version 1.
+	if s.conf.Version.IsAtLeast(V0_9_0_0) {
+		r.Version = 2
+	}
+	// Version 3 and 4 are the same as version 2.
+	if s.conf.Version.IsAtLeast(V0_11_0_0) {
+		r.Version = 3
+	}
+	if s.conf.Version.IsAtLeast(V2_0_0_0) {
+		r.Version = 4
+	}
+	// Version 5 removes the retention time, which is now controlled only by a broker configuration.
+	//
+	// Version 6 adds the leader epoch for fencing.
+	if s.conf.Version.IsAtLeast(V2_1_0_0) {
+		r.Version = 6
+	}
+	// version 7 adds a new field called groupInstanceId to indicate member identity across restarts.
+	if s.conf.Version.IsAtLeast(V2_3_0_0) {
+		r.Version = 7
+		if commit.GroupInstanceID != "" {
+			groupInstanceID := commit.GroupInstanceID
+			r.GroupInstanceId = &groupInstanceID
+		}
+	}
+
+	// commit timestamp was only briefly supported in V1 where we set it to
+	// ReceiveTime (-1) to tell the broker to set it to the time when the commit
+	// request was received
+	var commitTimestamp int64
+	if r.Version == 1 {
+		commitTimestamp = ReceiveTime
+	}
+
+	// request controlled retention was only supported from V2-V4 (it became
+	// broker-only after that) so if the user has set the config options then
+	// flow those through as retention time on the commit request.
+	if r.Version >= 2 && r.Version < 5 {
+		// Map Sarama's default of 0 to Kafka's default of -1
+		r.RetentionTime = -1
+		if s.conf.Consumer.Offsets.Retention > 0 {
+			r.RetentionTime = int64(s.conf.Consumer.Offsets.Retention / time.Millisecond)
+		}
+	}
+
+	for topic, partitions := range commit.Offsets {
+		for partition, offset := range partitions {
+			r.AddBlockWithLeaderEpoch(topic, partition, offset.Offset, offset.LeaderEpoch, commitTimestamp, offset.Metadata)
+		}
+	}
+	return r
+}
+
+func (s *kafkaOffsetStore) DeleteOffsets(group string, topicPartitions map[string][]int32) error {
+	coordinator, err := s.coordinator(group)
+	if err != nil {
+		return err
+	}
+	return deleteOffsets(coordinator, group, topicPartitions)
+}
+
+// deleteOffsets deletes the offsets of group for topicPartitions from its
+// coordinator, reporting the partitions which failed in an error wrapping
+// ErrDeleteConsumerGroupOffsets.
+func deleteOffsets(coordinator *Broker, group string, topicPartitions map[string][]int32) error {
+	request := &DeleteOffsetsRequest{Group: group}
+	for topic, partitions := range topicPartitions {
+		for _, partition := range partitions {
+			request.AddPartition(topic, partition)
+		}
+	}
+
+	resp, err := coordinator.DeleteOffsets(request)
+	if err != nil {
+		return err
+	}
+
+	if !errors.Is(resp.ErrorCode, ErrNoError) {
+		return resp.ErrorCode
+	}
+
+	var errs []error
+	for topic, partitions := range topicPartitions {
+		for _, partition := range partitions {
+			partitionErr, ok := resp.Errors[topic][partition]
+			if !ok {
+				errs = append(errs, fmt.Errorf("[%s-%d]: %w", topic, partition, ErrIncompleteResponse))
+			} else if !errors.Is(partitionErr, ErrNoError) {
+				errs = append(errs, fmt.Errorf("[%s-%d]: %w", topic, partition, partitionErr))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return Wrap(ErrDeleteConsumerGroupOffsets, errs...)
+	}
+	return nil
+}
+
+func (s *kafkaOffsetStore) coordinator(group string) (*Broker, error) {
+	s.brokerLock.RLock()
+	broker := s.brokers[group]
+	s.brokerLock.RUnlock()
+
+	if broker != nil {
+		return broker, nil
+	}
+
+	s.brokerLock.Lock()
+	defer s.brokerLock.Unlock()
+
+	if broker := s.brokers[group]; broker != nil {
+		return broker, nil
+	}
+
+	if err := s.client.RefreshCoordinator(group); err != nil {
+		return nil, err
+	}
+
+	broker, err := s.client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+
+	s.brokers[group] = broker
+	return broker, nil
+}
+
+func (s *kafkaOffsetStore) releaseCoordinator(group string, b *Broker) {
+	s.brokerLock.Lock()
+	if s.brokers[group] == b {
+		delete(s.brokers, group)
+	}
+	s.brokerLock.Unlock()
+}
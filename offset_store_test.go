@@ -0,0 +1,197 @@
+package sarama
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryOffsetStore stores offsets in memory, failing the commits of the
+// partitions set in errs.
+type memoryOffsetStore struct {
+	lock    sync.Mutex
+	offsets map[string]StoredOffset
+	errs    map[string]map[int32]error
+}
+
+func newMemoryOffsetStore() *memoryOffsetStore {
+	return &memoryOffsetStore{offsets: make(map[string]StoredOffset)}
+}
+
+func memoryOffsetKey(group, topic string, partition int32) string {
+	return fmt.Sprintf("%s/%s/%d", group, topic, partition)
+}
+
+func (s *memoryOffsetStore) FetchOffset(group, topic string, partition int32) (int64, int32, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	offset, ok := s.offsets[memoryOffsetKey(group, topic, partition)]
+	if !ok {
+		return -1, -1, "", nil
+	}
+	return offset.Offset, offset.LeaderEpoch, offset.Metadata, nil
+}
+
+func (s *memoryOffsetStore) CommitOffsets(commit *OffsetCommit) (map[string]map[int32]error, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for topic, partitions := range commit.Offsets {
+		for partition, offset := range partitions {
+			if s.errs[topic][partition] == nil {
+				s.offsets[memoryOffsetKey(commit.Group, topic, partition)] = offset
+			}
+		}
+	}
+	return s.errs, nil
+}
+
+func (s *memoryOffsetStore) DeleteOffsets(group string, topicPartitions map[string][]int32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for topic, partitions := range topicPartitions {
+		for _, partition := range partitions {
+			delete(s.offsets, memoryOffsetKey(group, topic, partition))
+		}
+	}
+	return nil
+}
+
+func (s *memoryOffsetStore) committed(group, topic string, partition int32) StoredOffset {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.offsets[memoryOffsetKey(group, topic, partition)]
+}
+
+func TestOffsetManagerOffsetStore(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("my_topic", 0, broker.BrokerID()),
+	})
+
+	store := newMemoryOffsetStore()
+	store.offsets[memoryOffsetKey("group", "my_topic", 0)] = StoredOffset{Offset: 10, LeaderEpoch: -1, Metadata: "resumed"}
+
+	config := NewTestConfig()
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.AutoCommit.Interval = 10 * time.Millisecond
+	config.Consumer.Offsets.Store = store
+	client, err := NewClient([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, client)
+
+	om, err := NewOffsetManagerFromClient("group", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pom, err := om.ManagePartition("my_topic", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset, metadata := pom.NextOffset(); offset != 10 || metadata != "resumed" {
+		t.Errorf("expected the offset fetched from the store, got %d %q", offset, metadata)
+	}
+
+	// the auto-commit loop commits to the store
+	pom.MarkOffset(12, "marked")
+	deadline := time.Now().Add(5 * time.Second)
+	for store.committed("group", "my_topic", 0).Offset != 12 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the marked offset to be committed to the store")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if committed := store.committed("group", "my_topic", 0); committed.Metadata != "marked" {
+		t.Errorf("expected the marked metadata to be committed, got %q", committed.Metadata)
+	}
+
+	// failed partitions are reported
+	store.lock.Lock()
+	store.errs = map[string]map[int32]error{"my_topic": {0: ErrOffsetMetadataTooLarge}}
+	store.lock.Unlock()
+	pom.MarkOffset(13, "too large")
+	select {
+	case err := <-pom.Errors():
+		if !errors.Is(err, ErrOffsetMetadataTooLarge) {
+			t.Errorf("expected ErrOffsetMetadataTooLarge, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the failed commit to be reported")
+	}
+	store.lock.Lock()
+	store.errs = nil
+	store.lock.Unlock()
+
+	safeClose(t, pom)
+	safeClose(t, om)
+	if committed := store.committed("group", "my_topic", 0); committed.Offset != 13 {
+		t.Errorf("expected the offset to be committed on close, got %d", committed.Offset)
+	}
+
+	for _, req := range broker.History() {
+		if _, ok := req.Request.(*MetadataRequest); !ok {
+			t.Errorf("expected no offset requests to Kafka, got %T", req.Request)
+		}
+	}
+}
+
+func TestKafkaOffsetStore(t *testing.T) {
+	coordinator := NewMockBroker(t, 1)
+	defer coordinator.Close()
+	coordinator.SetHandlerByMap(map[string]MockResponse{
+		"ApiVersionsRequest": NewMockApiVersionsResponse(t),
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(coordinator.Addr(), coordinator.BrokerID()),
+		"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+			SetCoordinator(CoordinatorGroup, "group", coordinator),
+		"OffsetFetchRequest": NewMockOffsetFetchResponse(t).
+			SetOffset("group", "my_topic", 0, 5, "fetched", ErrNoError),
+		"OffsetCommitRequest": NewMockOffsetCommitResponse(t).
+			SetError("group", "my_topic", 1, ErrOffsetMetadataTooLarge),
+		"DeleteOffsetsRequest": NewMockDeleteOffsetRequest(t).
+			SetDeletedOffset(ErrNoError, "my_topic", 1, ErrGroupSubscribedToTopic),
+	})
+
+	config := NewTestConfig()
+	config.Version = V2_4_0_0
+	client, err := NewClient([]string{coordinator.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, client)
+
+	store, err := NewKafkaOffsetStore(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset, _, metadata, err := store.FetchOffset("group", "my_topic", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 5 || metadata != "fetched" {
+		t.Errorf("expected offset 5 with its metadata, got %d %q", offset, metadata)
+	}
+
+	commit := &OffsetCommit{Group: "group", GenerationID: GroupGenerationUndefined}
+	commit.add("my_topic", 0, StoredOffset{Offset: 6, LeaderEpoch: -1})
+	commit.add("my_topic", 1, StoredOffset{Offset: 7, LeaderEpoch: -1})
+	errs, err := store.CommitOffsets(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs["my_topic"]) != 1 || !errors.Is(errs["my_topic"][1], ErrOffsetMetadataTooLarge) {
+		t.Errorf("expected only partition 1 to fail, got %v", errs)
+	}
+
+	err = store.DeleteOffsets("group", map[string][]int32{"my_topic": {0, 1}})
+	if !errors.Is(err, ErrDeleteConsumerGroupOffsets) || !errors.Is(err, ErrGroupSubscribedToTopic) {
+		t.Errorf("expected the deletion of partition 1 to fail, got %v", err)
+	}
+}
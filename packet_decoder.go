@@ -18,6 +18,7 @@ type packetDecoder interface {
 	getCompactArrayLength() (int, error)
 	getBool() (bool, error)
 	getEmptyTaggedFieldArray() (int, error)
+	getTaggedFieldArray() (taggedFields, error)
 
 	// Collections
 	getBytes() ([]byte, error)
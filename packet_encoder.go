@@ -33,6 +33,7 @@ type packetEncoder interface {
 	putInt32Array(in []int32) error
 	putInt64Array(in []int64) error
 	putEmptyTaggedFieldArray()
+	putTaggedFieldArray(in taggedFields) error
 
 	// Provide the current offset to record the batch size metric
 	offset() int
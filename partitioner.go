@@ -1,6 +1,7 @@
 package sarama
 
 import (
+	"fmt"
 	"hash"
 	"hash/crc32"
 	"hash/fnv"
@@ -78,12 +79,21 @@ func WithCustomFallbackPartitioner(randomHP Partitioner) HashPartitionerOption {
 }
 
 // NewManualPartitioner returns a Partitioner which uses the partition manually set in the provided
-// ProducerMessage's Partition field as the partition to produce to.
+// ProducerMessage's Partition field as the partition to produce to. Messages naming a partition
+// the topic does not have fail with an error wrapping ErrInvalidPartition.
+//
+// As the partition is never chosen by Sarama, messages for a partition whose leader is unavailable
+// are retried rather than redirected to another partition. Combine it with RequiredAcks set to
+// WaitForAll to make sure an acknowledged message survives the loss of that leader.
 func NewManualPartitioner(topic string) Partitioner {
 	return new(manualPartitioner)
 }
 
 func (p *manualPartitioner) Partition(message *ProducerMessage, numPartitions int32) (int32, error) {
+	if message.Partition < 0 || message.Partition >= numPartitions {
+		return -1, fmt.Errorf("%w: partition %d of topic %s is out of range, the topic has %d partitions",
+			ErrInvalidPartition, message.Partition, message.Topic, numPartitions)
+	}
 	return message.Partition, nil
 }
 
@@ -2,6 +2,7 @@ package sarama
 
 import (
 	"crypto/rand"
+	"errors"
 	"hash/crc32"
 	"hash/fnv"
 	"log"
@@ -284,6 +285,13 @@ func TestManualPartitioner(t *testing.T) {
 			t.Error("Returned partition not the same as the input partition")
 		}
 	}
+
+	for _, partition := range []int32{-1, 50} {
+		_, err := partitioner.Partition(&ProducerMessage{Topic: "mytopic", Partition: partition}, 50)
+		if !errors.Is(err, ErrInvalidPartition) {
+			t.Errorf("expected ErrInvalidPartition for partition %d, got %v", partition, err)
+		}
+	}
 }
 
 func TestWithCustomFallbackPartitioner(t *testing.T) {
@@ -351,6 +359,9 @@ func ExamplePartitioner_manual() {
 
 	// First, we tell the producer that we are going to partition ourselves.
 	config.Producer.Partitioner = NewManualPartitioner
+	// As messages are never moved to another partition, wait for all in-sync
+	// replicas to acknowledge them so that they survive a leader failure.
+	config.Producer.RequiredAcks = WaitForAll
 
 	producer, err := NewSyncProducer([]string{"localhost:9092"}, config)
 	if err != nil {
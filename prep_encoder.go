@@ -183,6 +183,18 @@ func (pe *prepEncoder) putEmptyTaggedFieldArray() {
 	pe.putUVarint(0)
 }
 
+func (pe *prepEncoder) putTaggedFieldArray(in taggedFields) error {
+	pe.putUVarint(uint64(len(in)))
+	for _, field := range in {
+		pe.putUVarint(field.tag)
+		pe.putUVarint(uint64(len(field.data)))
+		if err := pe.putRawBytes(field.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (pe *prepEncoder) offset() int {
 	return pe.length
 }
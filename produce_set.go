@@ -3,6 +3,7 @@ package sarama
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"time"
 )
 
@@ -17,6 +18,16 @@ type produceSet struct {
 	msgs          map[string]map[int32]*partitionSet
 	producerID    int64
 	producerEpoch int16
+	priority      int   // see Producer.TopicPriorities
+	maxVersion    int16 // of the produce request supported by the broker, -1 if unknown
+
+	// flush decides when the set is sent: Producer.Flush, or the FlushConfig
+	// of flushTopic in Producer.TopicFlush if set
+	flush      *FlushConfig
+	flushTopic string
+	// settings are those of the producer when the set was created, nil if
+	// it was never reconfigured
+	settings *producerSettings
 
 	bufferBytes int
 	bufferCount int
@@ -29,10 +40,48 @@ func newProduceSet(parent *asyncProducer) *produceSet {
 		parent:        parent,
 		producerID:    pid,
 		producerEpoch: epoch,
+		maxVersion:    -1,
+		flush:         &parent.conf.Producer.Flush,
+		settings:      parent.settings.Load(),
+	}
+}
+
+// version returns the version of the produce request, which decides the
+// record format: the one of Config.Version capped to maxVersion.
+func (ps *produceSet) version() int16 {
+	version := produceRequestVersion(ps.parent.conf.Version)
+	if ps.maxVersion >= 0 && ps.maxVersion < version {
+		return ps.maxVersion
+	}
+	return version
+}
+
+// produceRequestVersion returns the highest version of the produce request
+// supported by version.
+func produceRequestVersion(version KafkaVersion) int16 {
+	switch {
+	case version.IsAtLeast(V2_1_0_0):
+		return 7
+	case version.IsAtLeast(V2_0_0_0):
+		return 6
+	case version.IsAtLeast(V1_0_0_0):
+		return 5
+	case version.IsAtLeast(V0_11_0_0):
+		return 3
+	case version.IsAtLeast(V0_10_0_0):
+		return 2
+	default:
+		return 0
 	}
 }
 
 func (ps *produceSet) add(msg *ProducerMessage) error {
+	if version := ps.version(); version < 3 && (ps.parent.conf.Producer.Idempotent || len(msg.Headers) > 0) {
+		// the legacy message sets would silently drop them
+		return fmt.Errorf("%w: the broker only supports produce requests up to v%d, without headers nor idempotent or transactional records",
+			ErrUnsupportedVersion, version)
+	}
+
 	var err error
 	var key, val []byte
 
@@ -64,12 +113,13 @@ func (ps *produceSet) add(msg *ProducerMessage) error {
 
 	set := partitions[msg.Partition]
 	if set == nil {
-		if ps.parent.conf.Version.IsAtLeast(V0_11_0_0) {
+		if ps.version() >= 3 {
+			codec, level := ps.compression()
 			batch := &RecordBatch{
 				FirstTimestamp:   timestamp,
 				Version:          2,
-				Codec:            ps.parent.conf.Producer.Compression,
-				CompressionLevel: ps.parent.conf.Producer.CompressionLevel,
+				Codec:            codec,
+				CompressionLevel: level,
 				ProducerID:       ps.producerID,
 				ProducerEpoch:    ps.producerEpoch,
 			}
@@ -84,7 +134,7 @@ func (ps *produceSet) add(msg *ProducerMessage) error {
 		partitions[msg.Partition] = set
 	}
 
-	if ps.parent.conf.Version.IsAtLeast(V0_11_0_0) {
+	if ps.version() >= 3 {
 		if ps.parent.conf.Producer.Idempotent && msg.sequenceNumber < set.recordsToSend.RecordBatch.FirstSequence {
 			return errors.New("assertion failed: message out of sequence added to a batch")
 		}
@@ -93,7 +143,7 @@ func (ps *produceSet) add(msg *ProducerMessage) error {
 	// Past this point we can't return an error, because we've already added the message to the set.
 	set.msgs = append(set.msgs, msg)
 
-	if ps.parent.conf.Version.IsAtLeast(V0_11_0_0) {
+	if ps.version() >= 3 {
 		// We are being conservative here to avoid having to prep encode the record
 		size += maximumRecordOverhead
 		rec := &Record{
@@ -112,7 +162,7 @@ func (ps *produceSet) add(msg *ProducerMessage) error {
 		set.recordsToSend.RecordBatch.addRecord(rec)
 	} else {
 		msgToSend := &Message{Codec: CompressionNone, Key: key, Value: val}
-		if ps.parent.conf.Version.IsAtLeast(V0_10_0_0) {
+		if ps.version() >= 2 {
 			msgToSend.Timestamp = timestamp
 			msgToSend.Version = 1
 		}
@@ -129,27 +179,14 @@ func (ps *produceSet) add(msg *ProducerMessage) error {
 
 func (ps *produceSet) buildRequest() *ProduceRequest {
 	req := &ProduceRequest{
-		RequiredAcks: ps.parent.conf.Producer.RequiredAcks,
+		Version:      ps.version(),
+		RequiredAcks: ps.requiredAcks(),
 		Timeout:      int32(ps.parent.conf.Producer.Timeout / time.Millisecond),
 	}
-	if ps.parent.conf.Version.IsAtLeast(V0_10_0_0) {
-		req.Version = 2
-	}
-	if ps.parent.conf.Version.IsAtLeast(V0_11_0_0) {
-		req.Version = 3
-		if ps.parent.IsTransactional() {
-			req.TransactionalID = &ps.parent.conf.Producer.Transaction.ID
-		}
-	}
-	if ps.parent.conf.Version.IsAtLeast(V1_0_0_0) {
-		req.Version = 5
-	}
-	if ps.parent.conf.Version.IsAtLeast(V2_0_0_0) {
-		req.Version = 6
-	}
-	if ps.parent.conf.Version.IsAtLeast(V2_1_0_0) {
-		req.Version = 7
+	if req.Version >= 3 && ps.parent.IsTransactional() {
+		req.TransactionalID = &ps.parent.conf.Producer.Transaction.ID
 	}
+	codec, level := ps.compression()
 
 	for topic, partitionSets := range ps.msgs {
 		for partition, set := range partitionSets {
@@ -175,7 +212,7 @@ func (ps *produceSet) buildRequest() *ProduceRequest {
 				req.AddBatch(topic, partition, rb)
 				continue
 			}
-			if ps.parent.conf.Producer.Compression == CompressionNone {
+			if codec == CompressionNone {
 				req.AddSet(topic, partition, set.recordsToSend.MsgSet)
 			} else {
 				// When compression is enabled, the entire set for each partition is compressed
@@ -183,7 +220,7 @@ func (ps *produceSet) buildRequest() *ProduceRequest {
 				// set and no key. When the server sees a message with a compression codec, it
 				// decompresses the payload and treats the result as its message set.
 
-				if ps.parent.conf.Version.IsAtLeast(V0_10_0_0) {
+				if ps.version() >= 2 {
 					// If our version is 0.10 or later, assign relative offsets
 					// to the inner messages. This lets the broker avoid
 					// recompressing the message set.
@@ -199,13 +236,13 @@ func (ps *produceSet) buildRequest() *ProduceRequest {
 					panic(err)
 				}
 				compMsg := &Message{
-					Codec:            ps.parent.conf.Producer.Compression,
-					CompressionLevel: ps.parent.conf.Producer.CompressionLevel,
+					Codec:            codec,
+					CompressionLevel: level,
 					Key:              nil,
 					Value:            payload,
 					Set:              set.recordsToSend.MsgSet, // Provide the underlying message set for accurate metrics
 				}
-				if ps.parent.conf.Version.IsAtLeast(V0_10_0_0) {
+				if ps.version() >= 2 {
 					compMsg.Version = 1
 					compMsg.Timestamp = set.recordsToSend.MsgSet.Messages[0].Msg.Timestamp
 				}
@@ -239,9 +276,25 @@ func (ps *produceSet) dropPartition(topic string, partition int32) []*ProducerMe
 	return set.msgs
 }
 
+// compression returns the codec and level the set is compressed with.
+func (ps *produceSet) compression() (CompressionCodec, int) {
+	if ps.settings != nil {
+		return ps.settings.compression, ps.settings.compressionLevel
+	}
+	return ps.parent.conf.Producer.Compression, ps.parent.conf.Producer.CompressionLevel
+}
+
+// requiredAcks returns the acks the set is sent with.
+func (ps *produceSet) requiredAcks() RequiredAcks {
+	if ps.settings != nil {
+		return ps.settings.requiredAcks
+	}
+	return ps.parent.conf.Producer.RequiredAcks
+}
+
 func (ps *produceSet) wouldOverflow(msg *ProducerMessage) bool {
 	version := 1
-	if ps.parent.conf.Version.IsAtLeast(V0_11_0_0) {
+	if ps.version() >= 3 {
 		version = 2
 	}
 
@@ -254,7 +307,7 @@ func (ps *produceSet) wouldOverflow(msg *ProducerMessage) bool {
 		ps.msgs[msg.Topic][msg.Partition].bufferBytes+msg.ByteSize(version) >= ps.parent.conf.Producer.MaxMessageBytes:
 		return true
 	// Would we overflow simply in number of messages?
-	case ps.parent.conf.Producer.Flush.MaxMessages > 0 && ps.bufferCount >= ps.parent.conf.Producer.Flush.MaxMessages:
+	case ps.flush.MaxMessages > 0 && ps.bufferCount >= ps.flush.MaxMessages:
 		return true
 	default:
 		return false
@@ -267,13 +320,13 @@ func (ps *produceSet) readyToFlush() bool {
 	case ps.empty():
 		return false
 	// If all three config values are 0, we always flush as-fast-as-possible
-	case ps.parent.conf.Producer.Flush.Frequency == 0 && ps.parent.conf.Producer.Flush.Bytes == 0 && ps.parent.conf.Producer.Flush.Messages == 0:
+	case ps.flush.Frequency == 0 && ps.flush.Bytes == 0 && ps.flush.Messages == 0:
 		return true
 	// If we've passed the message trigger-point
-	case ps.parent.conf.Producer.Flush.Messages > 0 && ps.bufferCount >= ps.parent.conf.Producer.Flush.Messages:
+	case ps.flush.Messages > 0 && ps.bufferCount >= ps.flush.Messages:
 		return true
 	// If we've passed the byte trigger-point
-	case ps.parent.conf.Producer.Flush.Bytes > 0 && ps.bufferBytes >= ps.parent.conf.Producer.Flush.Bytes:
+	case ps.flush.Bytes > 0 && ps.bufferBytes >= ps.flush.Bytes:
 		return true
 	default:
 		return false
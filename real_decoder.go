@@ -115,7 +115,7 @@ func (rd *realDecoder) getArrayLength() (int, error) {
 	if tmp > rd.remaining() {
 		rd.off = len(rd.raw)
 		return -1, ErrInsufficientData
-	} else if tmp > 2*math.MaxUint16 {
+	} else if tmp > 2*math.MaxUint16 || tmp < -1 {
 		return -1, errInvalidArrayLength
 	}
 	return tmp, nil
@@ -131,6 +131,13 @@ func (rd *realDecoder) getCompactArrayLength() (int, error) {
 		return 0, nil
 	}
 
+	if n-1 > uint64(rd.remaining()) {
+		rd.off = len(rd.raw)
+		return -1, ErrInsufficientData
+	} else if n-1 > 2*math.MaxUint16 {
+		return -1, errInvalidArrayLength
+	}
+
 	return int(n) - 1, nil
 }
 
@@ -171,6 +178,41 @@ func (rd *realDecoder) getEmptyTaggedFieldArray() (int, error) {
 	return 0, nil
 }
 
+func (rd *realDecoder) getTaggedFieldArray() (taggedFields, error) {
+	tagCount, err := rd.getUVarint()
+	if err != nil {
+		return nil, err
+	}
+	if tagCount == 0 {
+		return nil, nil
+	}
+	// every tagged field takes at least two bytes (tag and length)
+	if tagCount > uint64(rd.remaining()/2) {
+		rd.off = len(rd.raw)
+		return nil, ErrInsufficientData
+	}
+
+	fields := make(taggedFields, tagCount)
+	for i := range fields {
+		if fields[i].tag, err = rd.getUVarint(); err != nil {
+			return nil, err
+		}
+		length, err := rd.getUVarint()
+		if err != nil {
+			return nil, err
+		}
+		if length > uint64(rd.remaining()) {
+			rd.off = len(rd.raw)
+			return nil, ErrInsufficientData
+		}
+		if fields[i].data, err = rd.getRawBytes(int(length)); err != nil {
+			return nil, err
+		}
+	}
+
+	return fields, nil
+}
+
 // collections
 
 func (rd *realDecoder) getBytes() ([]byte, error) {
@@ -257,6 +299,9 @@ func (rd *realDecoder) getCompactString() (string, error) {
 	length := int(n - 1)
 	if length < 0 {
 		return "", errInvalidByteSliceLength
+	} else if length > rd.remaining() {
+		rd.off = len(rd.raw)
+		return "", ErrInsufficientData
 	}
 	tmpStr := string(rd.raw[rd.off : rd.off+length])
 	rd.off += length
@@ -273,6 +318,9 @@ func (rd *realDecoder) getCompactNullableString() (*string, error) {
 
 	if length < 0 {
 		return nil, err
+	} else if length > rd.remaining() {
+		rd.off = len(rd.raw)
+		return nil, ErrInsufficientData
 	}
 
 	tmpStr := string(rd.raw[rd.off : rd.off+length])
@@ -290,6 +338,11 @@ func (rd *realDecoder) getCompactInt32Array() ([]int32, error) {
 		return nil, nil
 	}
 
+	if n-1 > uint64(rd.remaining()/4) {
+		rd.off = len(rd.raw)
+		return nil, ErrInsufficientData
+	}
+
 	arrayLength := int(n) - 1
 
 	ret := make([]int32, arrayLength)
@@ -375,6 +428,12 @@ func (rd *realDecoder) getStringArray() ([]string, error) {
 		return nil, errInvalidArrayLength
 	}
 
+	// every string takes at least its two byte length
+	if rd.remaining() < 2*n {
+		rd.off = len(rd.raw)
+		return nil, ErrInsufficientData
+	}
+
 	ret := make([]string, n)
 	for i := range ret {
 		str, err := rd.getString()
@@ -193,6 +193,18 @@ func (re *realEncoder) putEmptyTaggedFieldArray() {
 	re.putUVarint(0)
 }
 
+func (re *realEncoder) putTaggedFieldArray(in taggedFields) error {
+	re.putUVarint(uint64(len(in)))
+	for _, field := range in {
+		re.putUVarint(field.tag)
+		re.putUVarint(uint64(len(field.data)))
+		if err := re.putRawBytes(field.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (re *realEncoder) offset() int {
 	return re.off
 }
@@ -2,6 +2,7 @@ package sarama
 
 import (
 	"encoding/binary"
+	"fmt"
 	"time"
 )
 
@@ -101,6 +102,12 @@ func (r *Record) decode(pd packetDecoder) (err error) {
 		return err
 	}
 
+	// every header takes at least two bytes (the varint lengths of its key and
+	// value), so a larger count can only come from a corrupt or hostile batch
+	if numHeaders > int64(pd.remaining()/2) {
+		return PacketDecodingError{fmt.Sprintf("invalid record header count %d", numHeaders)}
+	}
+
 	if numHeaders >= 0 {
 		r.Headers = make([]*RecordHeader, numHeaders)
 	}
@@ -30,6 +30,22 @@ func (e recordsArray) decode(pd packetDecoder) error {
 	return nil
 }
 
+// corruptBatchError is returned when decoding a record batch failing its CRC
+// check or decompression. The batch has been read entirely, so that decoding
+// can go on with the next one, see Consumer.SkipCorruptBatches.
+type corruptBatchError struct {
+	batch *RecordBatch
+	err   error
+}
+
+func (e corruptBatchError) Error() string {
+	return e.err.Error()
+}
+
+func (e corruptBatchError) Unwrap() error {
+	return e.err
+}
+
 type RecordBatch struct {
 	FirstOffset           int64
 	PartitionLeaderEpoch  int32
@@ -49,7 +65,8 @@ type RecordBatch struct {
 	IsTransactional       bool
 
 	compressedRecords []byte
-	recordsLen        int // uncompressed records size
+	recordsLen        int  // uncompressed records size
+	skipCRCValidation bool // decode without checking the CRC, see Consumer.SkipCRCValidation
 }
 
 func (b *RecordBatch) LastOffset() int64 {
@@ -117,11 +134,18 @@ func (b *RecordBatch) decode(pd packetDecoder) (err error) {
 		return err
 	}
 
-	crc32Decoder := acquireCrc32Field(crcCastagnoli)
-	defer releaseCrc32Field(crc32Decoder)
+	if b.skipCRCValidation {
+		// read the CRC without ever computing it
+		if _, err = pd.getInt32(); err != nil {
+			return err
+		}
+	} else {
+		crc32Decoder := acquireCrc32Field(crcCastagnoli)
+		defer releaseCrc32Field(crc32Decoder)
 
-	if err = pd.push(crc32Decoder); err != nil {
-		return err
+		if err = pd.push(crc32Decoder); err != nil {
+			return err
+		}
 	}
 
 	attributes, err := pd.getInt16()
@@ -176,13 +200,15 @@ func (b *RecordBatch) decode(pd packetDecoder) (err error) {
 		return err
 	}
 
-	if err = pd.pop(); err != nil {
-		return err
+	if !b.skipCRCValidation {
+		if err = pd.pop(); err != nil {
+			return corruptBatchError{batch: b, err: err}
+		}
 	}
 
 	recBuffer, err = decompress(b.Codec, recBuffer)
 	if err != nil {
-		return err
+		return corruptBatchError{batch: b, err: err}
 	}
 
 	b.recordsLen = len(recBuffer)
@@ -1,6 +1,7 @@
 package sarama
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 	"time"
@@ -252,3 +253,26 @@ func TestRecordBatchDecoding(t *testing.T) {
 		}
 	}
 }
+
+func TestRecordDecodingRejectsHugeHeaderCount(t *testing.T) {
+	encoded := []byte{
+		46,                                             // Length (23)
+		0,                                              // Attributes
+		0,                                              // Timestamp Delta
+		0,                                              // Offset Delta
+		1,                                              // Key (null)
+		1,                                              // Value (null)
+		254, 255, 255, 255, 255, 255, 255, 255, 255, 1, // Number of Headers (math.MaxInt64)
+		0, 0, 0, 0, 0, 0, 0, 0,
+	}
+
+	var record Record
+	err := decode(encoded, &record, nil)
+	var perr PacketDecodingError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected a PacketDecodingError for a huge header count, got %v", err)
+	}
+	if record.Headers != nil {
+		t.Errorf("expected no headers to be allocated, got %d", len(record.Headers))
+	}
+}
@@ -15,6 +15,9 @@ type Records struct {
 	recordsType int
 	MsgSet      *MessageSet
 	RecordBatch *RecordBatch
+
+	// skipCRCValidation is passed on to the decoded RecordBatch
+	skipCRCValidation bool
 }
 
 func newLegacyRecords(msgSet *MessageSet) Records {
@@ -91,7 +94,7 @@ func (r *Records) decode(pd packetDecoder) error {
 		r.MsgSet = &MessageSet{}
 		return r.MsgSet.decode(pd)
 	case defaultRecords:
-		r.RecordBatch = &RecordBatch{}
+		r.RecordBatch = &RecordBatch{skipCRCValidation: r.skipCRCValidation}
 		return r.RecordBatch.decode(pd)
 	}
 	return fmt.Errorf("unknown records type: %v", r.recordsType)
@@ -161,7 +161,8 @@ func allocateBody(key, version int16) protocolBody {
 		return &DeleteRecordsRequest{Version: version}
 	case 22:
 		return &InitProducerIDRequest{Version: version}
-	// 23: OffsetForLeaderEpochRequest
+	case 23:
+		return &OffsetForLeaderEpochRequest{Version: version}
 	case 24:
 		return &AddPartitionsToTxnRequest{Version: version}
 	case 25:
@@ -128,6 +128,8 @@ func allocateResponseBody(req protocolBody) protocolBody {
 		return &DeleteRecordsResponse{Version: version}
 	case 22:
 		return &InitProducerIDResponse{Version: version}
+	case 23:
+		return &OffsetForLeaderEpochResponse{Version: version}
 	case 24:
 		return &AddPartitionsToTxnResponse{Version: version}
 	case 25:
@@ -47,6 +47,25 @@ Broker related metrics:
 	|                                                         |            | https://kafka.apache.org/protocol.html#protocol_api_keys      |                                        |
 	| protocol-requests-rate-<api-key>-for-broker-<broker-id> | meter      | Number of packets sent to the brokers by api-key for a given  |
 	|                                                         |            | broker                                                        |
+	| gssapi-handshake-round-trips                            | histogram  | Distribution of the number of GSS-API tokens sent per         |
+	|                                                         |            | authentication for all brokers                                |
+	| gssapi-handshake-round-trips-for-broker-<broker-id>     | histogram  | Distribution of the number of GSS-API tokens sent per         |
+	|                                                         |            | authentication for a given broker                             |
+	| gssapi-handshake-bytes                                  | histogram  | Distribution of the GSS-API token bytes exchanged per         |
+	|                                                         |            | authentication for all brokers                                |
+	| gssapi-handshake-bytes-for-broker-<broker-id>           | histogram  | Distribution of the GSS-API token bytes exchanged per         |
+	|                                                         |            | authentication for a given broker                             |
+	| sasl-reauthentication-total-<mechanism>                 | counter    | Total count of SASL re-authentications (KIP-368)              |
+	| sasl-reauthentication-failed-<mechanism>                | counter    | Total count of SASL re-authentication failures                |
+	| sasl-token-refresh-total-<mechanism>                    | counter    | Total count of access tokens requested from the               |
+	|                                                         |            | Net.SASL.TokenProvider                                        |
+	| sasl-token-refresh-failed-<mechanism>                   | counter    | Total count of access tokens the Net.SASL.TokenProvider       |
+	|                                                         |            | failed to return                                              |
+	| goroutines                                              | counter    | The current number of goroutines run by the clients,          |
+	|                                                         |            | producers, consumers, consumer groups and cluster admins      |
+	|                                                         |            | sharing the registry, one per broker connection handling all  |
+	|                                                         |            | of its responses, see Net.MaxConnectionGoroutines, and a few  |
+	|                                                         |            | per producer, partition consumer and consumer group claim     |
 	+---------------------------------------------------------+------------+---------------------------------------------------------------+
 
 Note that we do not gather specific metrics for seed brokers but they are part of the "all brokers" metrics.
@@ -76,6 +95,7 @@ Consumer related metrics:
 	| consumer-fetch-rate-for-broker-<broker>   | meter      | Fetch requests/second sent to a given broker                                         |
 	| consumer-fetch-rate-for-topic-<topic>     | meter      | Fetch requests/second sent for a given topic                                         |
 	| consumer-fetch-response-size              | histogram  | Distribution of the fetch response size in bytes                                     |
+	| consumer-skipped-corrupt-batches          | counter    | Total count of the corrupt record batches skipped with Consumer.SkipCorruptBatches   |
 	| consumer-group-join-total-<GroupID>       | counter    | Total count of consumer group join attempts                                          |
 	| consumer-group-join-failed-<GroupID>      | counter    | Total count of consumer group join failures                                          |
 	| consumer-group-sync-total-<GroupID>       | counter    | Total count of consumer group sync attempts                                          |
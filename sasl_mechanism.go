@@ -0,0 +1,52 @@
+package sarama
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SASLClient performs the client side of a custom SASL mechanism, as
+// registered with RegisterSASLMechanism. A new SASLClient is created for
+// every authentication, so implementations need not be safe for concurrent
+// use.
+type SASLClient interface {
+	// Start returns the initial response sent to the broker.
+	Start() ([]byte, error)
+	// Step handles a challenge sent by the broker and returns the response to
+	// send back. It is called for every challenge until it errors or reports
+	// the exchange as done, in which case response is not sent.
+	Step(challenge []byte) (response []byte, done bool, err error)
+}
+
+var (
+	saslMechanismsLock sync.RWMutex
+	saslMechanisms     = make(map[SASLMechanism]func(*Config) SASLClient)
+)
+
+// RegisterSASLMechanism makes a custom SASL mechanism available as
+// Net.SASL.Mechanism, e.g. to support a mechanism provided by a broker plugin.
+// The factory is called with the configuration of the client for every
+// connection to authenticate. Custom mechanisms are exchanged in
+// SaslAuthenticate requests, so they require Net.SASL.Version to be
+// SASLHandshakeV1. Registering a name again replaces its factory.
+// It panics if name is one of the built-in mechanisms or factory is nil.
+func RegisterSASLMechanism(name SASLMechanism, factory func(*Config) SASLClient) {
+	switch name {
+	case SASLTypeOAuth, SASLTypePlaintext, SASLTypeSCRAMSHA256, SASLTypeSCRAMSHA512, SASLTypeGSSAPI:
+		panic(fmt.Sprintf("sarama: cannot register built-in SASL mechanism %s", name))
+	}
+	if factory == nil {
+		panic("sarama: RegisterSASLMechanism factory is nil")
+	}
+
+	saslMechanismsLock.Lock()
+	defer saslMechanismsLock.Unlock()
+	saslMechanisms[name] = factory
+}
+
+// registeredSASLMechanism returns the factory registered for name, or nil.
+func registeredSASLMechanism(name SASLMechanism) func(*Config) SASLClient {
+	saslMechanismsLock.RLock()
+	defer saslMechanismsLock.RUnlock()
+	return saslMechanisms[name]
+}
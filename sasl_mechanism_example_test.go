@@ -0,0 +1,82 @@
+package sarama
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// exampleTokenSASLClient implements a trivial custom mechanism: the client
+// sends its token, the broker answers with a nonce which the client echoes
+// back and the broker acknowledges with an empty challenge.
+type exampleTokenSASLClient struct {
+	token string
+	nonce []byte
+}
+
+func (c *exampleTokenSASLClient) Start() ([]byte, error) {
+	return []byte(c.token), nil
+}
+
+func (c *exampleTokenSASLClient) Step(challenge []byte) ([]byte, bool, error) {
+	if c.nonce == nil {
+		if len(challenge) == 0 {
+			return nil, false, errors.New("expected a nonce")
+		}
+		c.nonce = challenge
+		return challenge, false, nil
+	}
+	if len(challenge) != 0 {
+		return nil, false, fmt.Errorf("unexpected challenge %q", challenge)
+	}
+	return nil, true, nil
+}
+
+func ExampleRegisterSASLMechanism() {
+	RegisterSASLMechanism("EXAMPLE-TOKEN", func(conf *Config) SASLClient {
+		return &exampleTokenSASLClient{token: conf.Net.SASL.Password}
+	})
+
+	// a broker supporting the mechanism, played by a mock broker
+	mockBroker := NewMockBroker(nil, 0)
+	defer mockBroker.Close()
+	mockBroker.SetHandlerFuncByMap(map[string]requestHandlerFunc{
+		"SaslHandshakeRequest": func(req *request) encoderWithHeader {
+			return &SaslHandshakeResponse{EnabledMechanisms: []string{"EXAMPLE-TOKEN"}}
+		},
+		"SaslAuthenticateRequest": func(req *request) encoderWithHeader {
+			authReq := req.body.(*SaslAuthenticateRequest)
+			res := &SaslAuthenticateResponse{Version: authReq.Version}
+			switch {
+			case bytes.Equal(authReq.SaslAuthBytes, []byte("secret")):
+				res.SaslAuthBytes = []byte("nonce")
+			case bytes.Equal(authReq.SaslAuthBytes, []byte("nonce")):
+				fmt.Println("broker: client authenticated")
+			default:
+				res.Err = ErrSASLAuthenticationFailed
+			}
+			return res
+		},
+	})
+
+	config := NewConfig()
+	config.Version = V2_2_0_0
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Mechanism = "EXAMPLE-TOKEN"
+	config.Net.SASL.Password = "secret"
+
+	broker := NewBroker(mockBroker.Addr())
+	if err := broker.Open(config); err != nil {
+		panic(err)
+	}
+	defer func() { _ = broker.Close() }()
+
+	if connected, err := broker.Connected(); err != nil || !connected {
+		panic(err)
+	}
+	fmt.Println("client: connected")
+
+	// Output:
+	// broker: client authenticated
+	// client: connected
+}
@@ -0,0 +1,42 @@
+package sarama
+
+import (
+	"errors"
+	"testing"
+)
+
+type staticSASLClient struct{}
+
+func (staticSASLClient) Start() ([]byte, error) { return []byte("static"), nil }
+
+func (staticSASLClient) Step(challenge []byte) ([]byte, bool, error) { return nil, true, nil }
+
+func TestRegisterSASLMechanism(t *testing.T) {
+	RegisterSASLMechanism("TEST-STATIC", func(*Config) SASLClient { return staticSASLClient{} })
+
+	config := NewTestConfig()
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Mechanism = "TEST-STATIC"
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected a registered mechanism to be valid, got %v", err)
+	}
+
+	config.Net.SASL.Version = SASLHandshakeV0
+	var target ConfigurationError
+	if err := config.Validate(); !errors.As(err, &target) {
+		t.Errorf("expected a ConfigurationError for a custom mechanism with SASLHandshakeV0, got %v", err)
+	}
+
+	config.Net.SASL.Mechanism = "TEST-UNREGISTERED"
+	config.Net.SASL.Version = SASLHandshakeV1
+	if err := config.Validate(); !errors.As(err, &target) {
+		t.Errorf("expected a ConfigurationError for an unregistered mechanism, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a built-in mechanism to panic")
+		}
+	}()
+	RegisterSASLMechanism(SASLTypePlaintext, func(*Config) SASLClient { return staticSASLClient{} })
+}
@@ -0,0 +1,220 @@
+/*
+Package schemaregistry integrates Sarama with a Confluent Schema Registry.
+
+It provides a caching Client for the registry REST API as well as a Serializer
+and a Deserializer that plug into Sarama's Producer.ValueSerializer and
+Consumer.ValueDeserializer (or their key counterparts). They frame payloads in
+the registry wire format: a zero magic byte followed by the 4-byte big-endian
+schema ID, and for Protobuf the indexes of the message type within the schema.
+
+The encoding of the payload itself is delegated to a Codec. A JSONCodec is
+included; Avro and Protobuf values are supported by wrapping the library of
+your choice in a Codec.
+
+NOTE: this package currently does not fall under the API stability
+guarantee of Sarama as it is still considered experimental.
+*/
+package schemaregistry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SchemaType identifies the format of a schema, as named by the registry.
+type SchemaType string
+
+const (
+	// Avro schemas, the default of the registry
+	Avro SchemaType = "AVRO"
+	// Protobuf schemas
+	Protobuf SchemaType = "PROTOBUF"
+	// JSON schemas
+	JSON SchemaType = "JSON"
+)
+
+// Reference is a reference from a schema to another schema registered under
+// Subject with the given Version.
+type Reference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+// Schema is a schema known to the registry.
+type Schema struct {
+	ID         int         `json:"id,omitempty"`
+	Subject    string      `json:"subject,omitempty"`
+	Version    int         `json:"version,omitempty"`
+	Type       SchemaType  `json:"schemaType,omitempty"`
+	Schema     string      `json:"schema"`
+	References []Reference `json:"references,omitempty"`
+}
+
+// schemaType returns the type of the schema, which the registry omits for Avro.
+func (s *Schema) schemaType() SchemaType {
+	if s.Type == "" {
+		return Avro
+	}
+	return s.Type
+}
+
+// Error is returned when the registry rejects a request.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       int    `json:"error_code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("schema registry: %s (status %d, code %d)", e.Message, e.StatusCode, e.Code)
+}
+
+// Client is a client for the Schema Registry REST API. Schemas are cached by
+// ID and schema IDs by subject, so that a schema is only fetched or registered
+// once per Client. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+
+	username, password string
+
+	lock    sync.RWMutex
+	schemas map[int]*Schema
+	ids     map[string]map[string]int // subject -> schema -> id
+}
+
+// NewClient creates a new Client for the registry at baseURL. If httpClient is
+// nil, http.DefaultClient is used.
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: httpClient,
+		schemas:    make(map[int]*Schema),
+		ids:        make(map[string]map[string]int),
+	}
+}
+
+// SetBasicAuth makes the Client authenticate with the given credentials.
+func (c *Client) SetBasicAuth(username, password string) {
+	c.username, c.password = username, password
+}
+
+// SchemaByID returns the schema with the given ID.
+func (c *Client) SchemaByID(id int) (*Schema, error) {
+	c.lock.RLock()
+	schema, ok := c.schemas[id]
+	c.lock.RUnlock()
+	if ok {
+		return schema, nil
+	}
+
+	schema = new(Schema)
+	if err := c.do(http.MethodGet, "/schemas/ids/"+strconv.Itoa(id), nil, schema); err != nil {
+		return nil, err
+	}
+	schema.ID = id
+
+	c.lock.Lock()
+	c.schemas[id] = schema
+	c.lock.Unlock()
+	return schema, nil
+}
+
+// Register registers schema under subject, unless it already is, and returns
+// its ID.
+func (c *Client) Register(subject string, schema *Schema) (int, error) {
+	return c.schemaID(subject, schema, "/subjects/"+url.PathEscape(subject)+"/versions")
+}
+
+// Lookup returns the ID of schema, which must already be registered under
+// subject.
+func (c *Client) Lookup(subject string, schema *Schema) (int, error) {
+	return c.schemaID(subject, schema, "/subjects/"+url.PathEscape(subject))
+}
+
+// LatestSchema returns the latest version of the schema registered under
+// subject. It is never cached.
+func (c *Client) LatestSchema(subject string) (*Schema, error) {
+	schema := new(Schema)
+	if err := c.do(http.MethodGet, "/subjects/"+url.PathEscape(subject)+"/versions/latest", nil, schema); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func (c *Client) schemaID(subject string, schema *Schema, path string) (int, error) {
+	c.lock.RLock()
+	id, ok := c.ids[subject][schema.Schema]
+	c.lock.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	request := &Schema{Schema: schema.Schema, References: schema.References}
+	if schema.schemaType() != Avro {
+		request.Type = schema.Type
+	}
+	var response struct {
+		ID int `json:"id"`
+	}
+	if err := c.do(http.MethodPost, path, request, &response); err != nil {
+		return 0, err
+	}
+
+	c.lock.Lock()
+	if c.ids[subject] == nil {
+		c.ids[subject] = make(map[string]int)
+	}
+	c.ids[subject][schema.Schema] = response.ID
+	c.lock.Unlock()
+	return response.ID, nil
+}
+
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		rerr := &Error{StatusCode: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(rerr); err != nil {
+			rerr.Message = http.StatusText(resp.StatusCode)
+		}
+		return rerr
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
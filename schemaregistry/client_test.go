@@ -0,0 +1,139 @@
+package schemaregistry
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry implements the subset of the Schema Registry REST API used by
+// the Client, counting the requests it serves.
+type fakeRegistry struct {
+	lock     sync.Mutex
+	requests int
+	schemas  []*Schema // by id - 1
+}
+
+func newFakeRegistry(t *testing.T) (*fakeRegistry, *Client) {
+	registry := &fakeRegistry{}
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+	return registry, NewClient(server.URL, nil)
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests++
+
+	path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case req.Method == http.MethodGet && len(path) == 3 && path[0] == "schemas" && path[1] == "ids":
+		id, _ := strconv.Atoi(path[2])
+		if id < 1 || id > len(r.schemas) {
+			r.fail(w, http.StatusNotFound, 40403, "Schema not found")
+			return
+		}
+		schema := r.schemas[id-1]
+		_ = json.NewEncoder(w).Encode(&Schema{Type: schema.Type, Schema: schema.Schema})
+	case req.Method == http.MethodPost && path[0] == "subjects":
+		var schema Schema
+		if err := json.NewDecoder(req.Body).Decode(&schema); err != nil {
+			r.fail(w, http.StatusUnprocessableEntity, 42201, "Invalid schema")
+			return
+		}
+		for _, registered := range r.schemas {
+			if registered.Subject == path[1] && registered.Schema == schema.Schema {
+				_ = json.NewEncoder(w).Encode(map[string]int{"id": registered.ID})
+				return
+			}
+		}
+		if len(path) == 2 {
+			r.fail(w, http.StatusNotFound, 40403, "Schema not found")
+			return
+		}
+		schema.ID = len(r.schemas) + 1
+		schema.Subject = path[1]
+		r.schemas = append(r.schemas, &schema)
+		_ = json.NewEncoder(w).Encode(map[string]int{"id": schema.ID})
+	default:
+		r.fail(w, http.StatusNotFound, 40401, "Subject not found")
+	}
+}
+
+func (r *fakeRegistry) fail(w http.ResponseWriter, status, code int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&Error{Code: code, Message: message})
+}
+
+func (r *fakeRegistry) requestCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requests
+}
+
+func TestClientRegisterAndLookup(t *testing.T) {
+	registry, client := newFakeRegistry(t)
+	schema := &Schema{Type: JSON, Schema: `{"type":"object"}`}
+
+	if _, err := client.Lookup("events-value", schema); err == nil {
+		t.Fatal("expected lookup of an unregistered schema to fail")
+	} else {
+		var rerr *Error
+		if !errors.As(err, &rerr) || rerr.StatusCode != http.StatusNotFound || rerr.Code != 40403 {
+			t.Fatalf("expected a registry not found error, got %v", err)
+		}
+	}
+
+	id, err := client.Register("events-value", schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Errorf("expected schema id 1, got %d", id)
+	}
+
+	// both are served from the cache from now on
+	requests := registry.requestCount()
+	if again, err := client.Register("events-value", schema); err != nil || again != id {
+		t.Errorf("expected cached id %d, got %d: %v", id, again, err)
+	}
+	if looked, err := client.Lookup("events-value", schema); err != nil || looked != id {
+		t.Errorf("expected cached id %d, got %d: %v", id, looked, err)
+	}
+	if registry.requestCount() != requests {
+		t.Errorf("expected no further requests, got %d", registry.requestCount()-requests)
+	}
+}
+
+func TestClientSchemaByID(t *testing.T) {
+	registry, client := newFakeRegistry(t)
+	id, err := client.Register("events-value", &Schema{Type: Protobuf, Schema: `message Event {}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a separate client so that the schema is not already cached
+	reader := NewClient(client.baseURL, nil)
+	for i := 0; i < 2; i++ {
+		schema, err := reader.SchemaByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if schema.ID != id || schema.Type != Protobuf || schema.Schema != `message Event {}` {
+			t.Errorf("unexpected schema %+v", schema)
+		}
+	}
+	if registry.requestCount() != 2 {
+		t.Errorf("expected the schema to be fetched once, got %d requests in total", registry.requestCount())
+	}
+
+	if _, err := reader.SchemaByID(42); err == nil {
+		t.Error("expected an error for an unknown schema id")
+	}
+}
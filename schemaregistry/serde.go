@@ -0,0 +1,214 @@
+package schemaregistry
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/max444ks1m777/sarama"
+)
+
+const magicByte byte = 0
+
+// ErrInvalidEnvelope is returned when deserializing data that is not framed
+// in the Schema Registry wire format.
+var ErrInvalidEnvelope = errors.New("schema registry: invalid wire format envelope")
+
+// Codec encodes and decodes the payload of messages for a schema. It is the
+// extension point for the Avro and Protobuf libraries of your choice.
+type Codec interface {
+	// Marshal encodes v according to schema.
+	Marshal(schema *Schema, v interface{}) ([]byte, error)
+
+	// Unmarshal decodes data that was encoded according to schema.
+	Unmarshal(schema *Schema, data []byte) (interface{}, error)
+}
+
+// JSONCodec is a Codec for JSON schemas backed by encoding/json. Payloads are
+// not validated against the schema.
+type JSONCodec struct {
+	// New returns a pointer to the value to decode a payload into. When nil,
+	// payloads are decoded into a map[string]interface{}.
+	New func() interface{}
+}
+
+// Marshal implements Codec.
+func (c JSONCodec) Marshal(schema *Schema, v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements Codec.
+func (c JSONCodec) Unmarshal(schema *Schema, data []byte) (interface{}, error) {
+	if c.New == nil {
+		var v map[string]interface{}
+		err := json.Unmarshal(data, &v)
+		return v, err
+	}
+	v := c.New()
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// TopicNameStrategy is the default subject name strategy of the registry,
+// using `<topic>-key` and `<topic>-value` subjects.
+func TopicNameStrategy(topic string, isKey bool) string {
+	if isKey {
+		return topic + "-key"
+	}
+	return topic + "-value"
+}
+
+// SerializerConfig configures a Serializer.
+type SerializerConfig struct {
+	// Schema is the schema messages are serialized with. Its Type defaults to
+	// Avro.
+	Schema *Schema
+	// Codec encodes the values of messages according to Schema.
+	Codec Codec
+	// IsKey selects the key subject of the topic rather than the value one.
+	IsKey bool
+	// AutoRegister registers Schema with the registry if needed, otherwise it
+	// must already be registered under the subject.
+	AutoRegister bool
+	// SubjectNameStrategy returns the subject for a topic (defaults to
+	// TopicNameStrategy).
+	SubjectNameStrategy func(topic string, isKey bool) string
+	// MessageIndexes locates the message type of Protobuf schemas, as the path
+	// of indexes through nested message declarations (defaults to the first
+	// message of the schema). Ignored for other schema types.
+	MessageIndexes []int
+}
+
+type serializer struct {
+	client *Client
+	conf   SerializerConfig
+}
+
+// NewSerializer returns a sarama.Serializer framing values in the Schema
+// Registry wire format.
+func NewSerializer(client *Client, conf SerializerConfig) (sarama.Serializer, error) {
+	switch {
+	case client == nil:
+		return nil, sarama.ConfigurationError("schema registry client must not be nil")
+	case conf.Schema == nil:
+		return nil, sarama.ConfigurationError("SerializerConfig.Schema must not be nil")
+	case conf.Codec == nil:
+		return nil, sarama.ConfigurationError("SerializerConfig.Codec must not be nil")
+	}
+	if conf.SubjectNameStrategy == nil {
+		conf.SubjectNameStrategy = TopicNameStrategy
+	}
+	return &serializer{client: client, conf: conf}, nil
+}
+
+// Serialize implements sarama.Serializer.
+func (s *serializer) Serialize(topic string, data interface{}) ([]byte, error) {
+	subject := s.conf.SubjectNameStrategy(topic, s.conf.IsKey)
+
+	var id int
+	var err error
+	if s.conf.AutoRegister {
+		id, err = s.client.Register(subject, s.conf.Schema)
+	} else {
+		id, err = s.client.Lookup(subject, s.conf.Schema)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := s.conf.Codec.Marshal(s.conf.Schema, data)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = magicByte
+	binary.BigEndian.PutUint32(buf[1:], uint32(id))
+	if s.conf.Schema.schemaType() == Protobuf {
+		buf = appendMessageIndexes(buf, s.conf.MessageIndexes)
+	}
+	return append(buf, payload...), nil
+}
+
+// DeserializerConfig configures a Deserializer.
+type DeserializerConfig struct {
+	// Codec decodes the payload of messages according to the schema they
+	// were produced with.
+	Codec Codec
+}
+
+type deserializer struct {
+	client *Client
+	conf   DeserializerConfig
+}
+
+// NewDeserializer returns a sarama.Deserializer for values framed in the
+// Schema Registry wire format, looking up (and caching) the schema each was
+// serialized with.
+func NewDeserializer(client *Client, conf DeserializerConfig) (sarama.Deserializer, error) {
+	switch {
+	case client == nil:
+		return nil, sarama.ConfigurationError("schema registry client must not be nil")
+	case conf.Codec == nil:
+		return nil, sarama.ConfigurationError("DeserializerConfig.Codec must not be nil")
+	}
+	return &deserializer{client: client, conf: conf}, nil
+}
+
+// Deserialize implements sarama.Deserializer.
+func (d *deserializer) Deserialize(topic string, data []byte) (interface{}, error) {
+	if len(data) < 5 || data[0] != magicByte {
+		return nil, ErrInvalidEnvelope
+	}
+	schema, err := d.client.SchemaByID(int(binary.BigEndian.Uint32(data[1:5])))
+	if err != nil {
+		return nil, err
+	}
+
+	payload := data[5:]
+	if schema.schemaType() == Protobuf {
+		if _, payload, err = readMessageIndexes(payload); err != nil {
+			return nil, err
+		}
+	}
+	return d.conf.Codec.Unmarshal(schema, payload)
+}
+
+// appendMessageIndexes appends the Protobuf message indexes to buf as a
+// zig-zag varint count followed by the indexes. The common case of the first
+// message, [0], is encoded as a single zero.
+func appendMessageIndexes(buf []byte, indexes []int) []byte {
+	if len(indexes) == 0 || (len(indexes) == 1 && indexes[0] == 0) {
+		return append(buf, 0)
+	}
+	buf = binary.AppendVarint(buf, int64(len(indexes)))
+	for _, index := range indexes {
+		buf = binary.AppendVarint(buf, int64(index))
+	}
+	return buf
+}
+
+func readMessageIndexes(data []byte) ([]int, []byte, error) {
+	count, n := binary.Varint(data)
+	if n <= 0 || count < 0 || count > int64(len(data)) {
+		return nil, nil, ErrInvalidEnvelope
+	}
+	data = data[n:]
+	if count == 0 {
+		return []int{0}, data, nil
+	}
+
+	indexes := make([]int, count)
+	for i := range indexes {
+		index, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, nil, fmt.Errorf("%w: truncated message indexes", ErrInvalidEnvelope)
+		}
+		indexes[i] = int(index)
+		data = data[n:]
+	}
+	return indexes, data, nil
+}
@@ -0,0 +1,132 @@
+package schemaregistry
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type event struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func TestSerializerRoundTrip(t *testing.T) {
+	_, client := newFakeRegistry(t)
+	schema := &Schema{Type: JSON, Schema: `{"type":"object","properties":{"id":{"type":"integer"},"name":{"type":"string"}}}`}
+
+	serializer, err := NewSerializer(client, SerializerConfig{Schema: schema, Codec: JSONCodec{}, AutoRegister: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := serializer.Serialize("events", event{ID: 1, Name: "created"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte{0, 0, 0, 0, 1}, `{"id":1,"name":"created"}`...)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+
+	deserializer, err := NewDeserializer(NewClient(client.baseURL, nil), DeserializerConfig{
+		Codec: JSONCodec{New: func() interface{} { return new(event) }},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := deserializer.Deserialize("events", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(value, &event{ID: 1, Name: "created"}) {
+		t.Errorf("unexpected deserialized value %+v", value)
+	}
+}
+
+func TestSerializerWithoutAutoRegister(t *testing.T) {
+	_, client := newFakeRegistry(t)
+	schema := &Schema{Type: JSON, Schema: `{"type":"object"}`}
+
+	serializer, err := NewSerializer(client, SerializerConfig{Schema: schema, Codec: JSONCodec{}, IsKey: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rerr *Error
+	if _, err := serializer.Serialize("events", map[string]int{}); !errors.As(err, &rerr) {
+		t.Fatalf("expected a registry error for an unregistered schema, got %v", err)
+	}
+
+	if _, err := client.Register("events-key", schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serializer.Serialize("events", map[string]int{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProtobufMessageIndexes(t *testing.T) {
+	for _, indexes := range [][]int{nil, {0}, {1}, {2, 0, 3}} {
+		buf := appendMessageIndexes(nil, indexes)
+		buf = append(buf, 0xff)
+		decoded, rest, err := readMessageIndexes(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := indexes
+		if len(expected) == 0 {
+			expected = []int{0}
+		}
+		if !reflect.DeepEqual(decoded, expected) || !bytes.Equal(rest, []byte{0xff}) {
+			t.Errorf("indexes %v: decoded %v with remaining %v", indexes, decoded, rest)
+		}
+	}
+
+	_, client := newFakeRegistry(t)
+	schema := &Schema{Type: Protobuf, Schema: `message Outer { message Inner {} }`}
+	serializer, err := NewSerializer(client, SerializerConfig{Schema: schema, Codec: JSONCodec{}, AutoRegister: true, MessageIndexes: []int{0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := serializer.Serialize("events", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[5:8], []byte{4, 0, 0}) {
+		t.Errorf("expected message indexes [0 0] after the schema id, got %v", data[5:8])
+	}
+
+	deserializer, _ := NewDeserializer(client, DeserializerConfig{Codec: JSONCodec{}})
+	if value, err := deserializer.Deserialize("events", data); err != nil || !reflect.DeepEqual(value, map[string]interface{}{}) {
+		t.Errorf("unexpected deserialized value %v: %v", value, err)
+	}
+}
+
+func TestDeserializerInvalidEnvelope(t *testing.T) {
+	_, client := newFakeRegistry(t)
+	deserializer, err := NewDeserializer(client, DeserializerConfig{Codec: JSONCodec{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{nil, {0, 0, 0}, []byte(`{"id":1}`)} {
+		if _, err := deserializer.Deserialize("events", data); !errors.Is(err, ErrInvalidEnvelope) {
+			t.Errorf("expected ErrInvalidEnvelope for %q, got %v", data, err)
+		}
+	}
+}
+
+func TestNewSerializerValidates(t *testing.T) {
+	_, client := newFakeRegistry(t)
+	if _, err := NewSerializer(nil, SerializerConfig{Schema: &Schema{}, Codec: JSONCodec{}}); err == nil {
+		t.Error("expected an error without a client")
+	}
+	if _, err := NewSerializer(client, SerializerConfig{Codec: JSONCodec{}}); err == nil {
+		t.Error("expected an error without a schema")
+	}
+	if _, err := NewSerializer(client, SerializerConfig{Schema: &Schema{}}); err == nil {
+		t.Error("expected an error without a codec")
+	}
+	if _, err := NewDeserializer(client, DeserializerConfig{}); err == nil {
+		t.Error("expected an error without a codec")
+	}
+}
@@ -2,11 +2,19 @@ package sarama
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
 	"hash"
 )
 
+// Iteration bounds enforced by the broker for both SHA-256 and SHA-512
+// @see: https://github.com/apache/kafka/blob/99b9b3e84f4e98c3f07714e1de6a139a004cbc5b/clients/src/main/java/org/apache/kafka/common/security/scram/internals/ScramMechanism.java
+const (
+	scramMinIterations = 4096
+	scramMaxIterations = 16384
+)
+
 // ScramFormatter implementation
 // @see: https://github.com/apache/kafka/blob/99b9b3e84f4e98c3f07714e1de6a139a004cbc5b/clients/src/main/java/org/apache/kafka/common/security/scram/internals/ScramFormatter.java#L93
 type scramFormatter struct {
@@ -29,6 +37,25 @@ func (s scramFormatter) mac(key []byte) (hash.Hash, error) {
 	return m, nil
 }
 
+// validIterations reports whether the broker accepts the given iteration count for the mechanism
+func (s scramFormatter) validIterations(iterations int32) bool {
+	return iterations >= scramMinIterations && iterations <= scramMaxIterations
+}
+
+// salt returns a random salt as long as the digest produced by the mechanism
+func (s scramFormatter) salt() ([]byte, error) {
+	mac, err := s.mac(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, mac.Size())
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
 func (s scramFormatter) hmac(key []byte, extra []byte) ([]byte, error) {
 	mac, err := s.mac(key)
 	if err != nil {
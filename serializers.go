@@ -0,0 +1,68 @@
+package sarama
+
+import "fmt"
+
+// Serializer converts the typed key or value of a ProducerMessage into the
+// bytes sent to Kafka. It is configured with Producer.KeySerializer and
+// Producer.ValueSerializer.
+type Serializer interface {
+	// Serialize encodes data, the TypedKey or TypedValue of a message to be
+	// produced to the given topic.
+	Serialize(topic string, data interface{}) ([]byte, error)
+}
+
+// Deserializer converts the key or value bytes of a consumed message into a
+// typed representation. It is configured with Consumer.KeyDeserializer and
+// Consumer.ValueDeserializer.
+type Deserializer interface {
+	// Deserialize decodes data, the raw Key or Value of a message consumed from
+	// the given topic. It is not called for nil keys or values.
+	Deserialize(topic string, data []byte) (interface{}, error)
+}
+
+// serialize fills in the Key and Value of msg from its TypedKey and TypedValue
+// using the configured serializers.
+func (msg *ProducerMessage) serialize(conf *Config) error {
+	if msg.TypedKey != nil {
+		if conf.Producer.KeySerializer == nil {
+			return ConfigurationError("Producer.KeySerializer must be set to produce messages with a TypedKey")
+		}
+		key, err := conf.Producer.KeySerializer.Serialize(msg.Topic, msg.TypedKey)
+		if err != nil {
+			return fmt.Errorf("kafka: failed to serialize message key: %w", err)
+		}
+		msg.Key = ByteEncoder(key)
+	}
+	if msg.TypedValue != nil {
+		if conf.Producer.ValueSerializer == nil {
+			return ConfigurationError("Producer.ValueSerializer must be set to produce messages with a TypedValue")
+		}
+		value, err := conf.Producer.ValueSerializer.Serialize(msg.Topic, msg.TypedValue)
+		if err != nil {
+			return fmt.Errorf("kafka: failed to serialize message value: %w", err)
+		}
+		msg.Value = ByteEncoder(value)
+	}
+	return nil
+}
+
+// deserialize fills in the TypedKey and TypedValue of msg from its Key and
+// Value using the configured deserializers, if any.
+func (msg *ConsumerMessage) deserialize(conf *Config) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("kafka: deserializer panicked on message at offset %d: %v", msg.Offset, r)
+		}
+	}()
+	if conf.Consumer.KeyDeserializer != nil && msg.Key != nil {
+		if msg.TypedKey, err = conf.Consumer.KeyDeserializer.Deserialize(msg.Topic, msg.Key); err != nil {
+			return fmt.Errorf("kafka: failed to deserialize key of message at offset %d: %w", msg.Offset, err)
+		}
+	}
+	if conf.Consumer.ValueDeserializer != nil && msg.Value != nil {
+		if msg.TypedValue, err = conf.Consumer.ValueDeserializer.Deserialize(msg.Topic, msg.Value); err != nil {
+			return fmt.Errorf("kafka: failed to deserialize value of message at offset %d: %w", msg.Offset, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package sarama
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// jsonSerde serializes any value to JSON and deserializes JSON into a testEvent
+type jsonSerde struct{}
+
+func (jsonSerde) Serialize(topic string, data interface{}) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+func (jsonSerde) Deserialize(topic string, data []byte) (interface{}, error) {
+	var event testEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+func TestProducerMessageSerialize(t *testing.T) {
+	config := NewTestConfig()
+	config.Producer.KeySerializer = jsonSerde{}
+	config.Producer.ValueSerializer = jsonSerde{}
+
+	msg := &ProducerMessage{Topic: "my_topic", TypedKey: "key", TypedValue: testEvent{ID: 1, Name: "created"}}
+	if err := msg.serialize(config); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := msg.Key.Encode(); string(key) != `"key"` {
+		t.Errorf("unexpected serialized key %q", key)
+	}
+	if value, _ := msg.Value.Encode(); string(value) != `{"id":1,"name":"created"}` {
+		t.Errorf("unexpected serialized value %q", value)
+	}
+
+	// messages without typed key or value are left untouched
+	msg = &ProducerMessage{Topic: "my_topic", Value: StringEncoder("raw")}
+	if err := msg.serialize(config); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Key != nil || msg.Value != StringEncoder("raw") {
+		t.Errorf("expected raw message to be left as is, got key %v and value %v", msg.Key, msg.Value)
+	}
+
+	msg = &ProducerMessage{Topic: "my_topic", TypedValue: func() {}}
+	if err := msg.serialize(config); err == nil {
+		t.Error("expected an error serializing an unsupported value")
+	}
+
+	var cerr ConfigurationError
+	msg = &ProducerMessage{Topic: "my_topic", TypedValue: testEvent{}}
+	if err := msg.serialize(NewTestConfig()); !errors.As(err, &cerr) {
+		t.Errorf("expected a ConfigurationError without a ValueSerializer, got %v", err)
+	}
+}
+
+func TestAsyncProducerSerializers(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+	leader := NewMockBroker(t, 2)
+	defer leader.Close()
+
+	metadataResponse := new(MetadataResponse)
+	metadataResponse.AddBroker(leader.Addr(), leader.BrokerID())
+	metadataResponse.AddTopicPartition("my_topic", 0, leader.BrokerID(), nil, nil, nil, ErrNoError)
+	seedBroker.Returns(metadataResponse)
+
+	prodSuccess := new(ProduceResponse)
+	prodSuccess.AddTopicPartition("my_topic", 0, ErrNoError)
+	leader.Returns(prodSuccess)
+
+	config := NewTestConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.ValueSerializer = jsonSerde{}
+	producer, err := NewAsyncProducer([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", TypedKey: "key"}
+	select {
+	case perr := <-producer.Errors():
+		var cerr ConfigurationError
+		if !errors.As(perr.Err, &cerr) {
+			t.Errorf("expected a ConfigurationError for a TypedKey without KeySerializer, got %v", perr.Err)
+		}
+	case msg := <-producer.Successes():
+		t.Fatalf("unexpected success for %v", msg.TypedKey)
+	}
+
+	producer.Input() <- &ProducerMessage{Topic: "my_topic", TypedValue: testEvent{ID: 2, Name: "updated"}}
+	msg := <-producer.Successes()
+	if value, _ := msg.Value.Encode(); string(value) != `{"id":2,"name":"updated"}` {
+		t.Errorf("unexpected serialized value %q", value)
+	}
+
+	closeProducer(t, producer)
+}
+
+func TestConsumerDeserializers(t *testing.T) {
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my_topic", 0, OffsetOldest, 0).
+			SetOffset("my_topic", 0, OffsetNewest, 2),
+		"FetchRequest": NewMockFetchResponse(t, 1).
+			SetMessage("my_topic", 0, 0, StringEncoder(`{"id":3,"name":"deleted"}`)).
+			SetMessage("my_topic", 0, 1, StringEncoder("not json")),
+	})
+
+	config := NewTestConfig()
+	config.Consumer.Return.Errors = true
+	config.Consumer.ValueDeserializer = jsonSerde{}
+	master, err := NewConsumer([]string{broker0.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, master)
+
+	consumer, err := master.ConsumePartition("my_topic", 0, OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, consumer)
+
+	msg := <-consumer.Messages()
+	if !reflect.DeepEqual(msg.TypedValue, testEvent{ID: 3, Name: "deleted"}) {
+		t.Errorf("unexpected deserialized value %v", msg.TypedValue)
+	}
+	if msg.TypedKey != nil {
+		t.Errorf("expected no typed key for a nil key, got %v", msg.TypedKey)
+	}
+
+	// a message that fails to deserialize is reported, and delivered raw
+	cerr := <-consumer.Errors()
+	var jerr *json.SyntaxError
+	if !errors.As(cerr, &jerr) {
+		t.Errorf("expected a JSON syntax error, got %v", cerr)
+	}
+	msg = <-consumer.Messages()
+	if string(msg.Value) != "not json" || msg.TypedValue != nil {
+		t.Errorf("expected the raw message to be delivered, got %q and %v", msg.Value, msg.TypedValue)
+	}
+}
+
+// panickySerde panics on values that are not JSON
+type panickySerde struct{}
+
+func (panickySerde) Deserialize(topic string, data []byte) (interface{}, error) {
+	event, err := jsonSerde{}.Deserialize(topic, data)
+	if err != nil {
+		panic(err)
+	}
+	return event, nil
+}
+
+func TestConsumerDecodeErrors(t *testing.T) {
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my_topic", 0, OffsetOldest, 0).
+			SetOffset("my_topic", 0, OffsetNewest, 3),
+		"FetchRequest": NewMockFetchResponse(t, 1).
+			SetMessage("my_topic", 0, 0, StringEncoder("not json")).
+			SetMessage("my_topic", 0, 1, StringEncoder(`{"id":3,"name":"deleted"}`)),
+	})
+
+	config := NewTestConfig()
+	config.Consumer.Return.DecodeErrors = true
+	config.Consumer.ValueDeserializer = panickySerde{}
+	master, err := NewConsumer([]string{broker0.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, master)
+
+	consumer, err := master.ConsumePartition("my_topic", 0, OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, consumer)
+
+	// the undecodable record is reported with its raw bytes, and skipped
+	cerr := <-consumer.DecodeErrors()
+	if cerr.Topic != "my_topic" || cerr.Partition != 0 || cerr.Err == nil {
+		t.Errorf("unexpected decode error %v", cerr)
+	}
+	if cerr.Message == nil || cerr.Message.Offset != 0 || string(cerr.Message.Value) != "not json" {
+		t.Errorf("expected the raw record at offset 0, got %+v", cerr.Message)
+	}
+	msg := <-consumer.Messages()
+	if msg.Offset != 1 || !reflect.DeepEqual(msg.TypedValue, testEvent{ID: 3, Name: "deleted"}) {
+		t.Errorf("expected the next record to be delivered, got %d and %v", msg.Offset, msg.TypedValue)
+	}
+}
+
+func TestConsumerDecodeErrorsUnread(t *testing.T) {
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my_topic", 0, OffsetOldest, 0).
+			SetOffset("my_topic", 0, OffsetNewest, 2),
+		"FetchRequest": NewMockFetchResponse(t, 1).
+			SetMessage("my_topic", 0, 0, StringEncoder("not json")).
+			SetMessage("my_topic", 0, 1, StringEncoder(`{"id":3,"name":"deleted"}`)),
+	})
+
+	config := NewTestConfig()
+	config.Consumer.Return.Errors = true
+	config.Consumer.Return.DecodeErrors = true
+	config.Consumer.MaxProcessingTime = 10 * time.Millisecond
+	config.ChannelBufferSize = 0
+	config.Consumer.ValueDeserializer = jsonSerde{}
+	master, err := NewConsumer([]string{broker0.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, master)
+
+	consumer, err := master.ConsumePartition("my_topic", 0, OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, consumer)
+
+	// nobody reads DecodeErrors, so the record falls back to Errors
+	select {
+	case cerr := <-consumer.Errors():
+		if cerr.Message == nil || cerr.Message.Offset != 0 || string(cerr.Message.Value) != "not json" {
+			t.Errorf("expected the raw record at offset 0, got %+v", cerr.Message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the unread decode error was never returned on Errors")
+	}
+	select {
+	case msg := <-consumer.Messages():
+		if msg.Offset != 1 {
+			t.Errorf("expected offset 1, got %d", msg.Offset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("an unread decode error stalled the partition")
+	}
+}
@@ -39,6 +39,9 @@ func (m *StickyAssignorUserDataV0) decode(pd packetDecoder) (err error) {
 	if topicLen, err = pd.getArrayLength(); err != nil {
 		return
 	}
+	if topicLen < 0 {
+		return errInvalidArrayLength
+	}
 
 	m.Topics = make(map[string][]int32, topicLen)
 	for i := 0; i < topicLen; i++ {
@@ -89,6 +92,9 @@ func (m *StickyAssignorUserDataV1) decode(pd packetDecoder) (err error) {
 	if topicLen, err = pd.getArrayLength(); err != nil {
 		return
 	}
+	if topicLen < 0 {
+		return errInvalidArrayLength
+	}
 
 	m.Topics = make(map[string][]int32, topicLen)
 	for i := 0; i < topicLen; i++ {
@@ -93,8 +93,8 @@ func newSyncProducerFromAsyncProducer(p *asyncProducer) *syncProducer {
 	sp := &syncProducer{producer: p}
 
 	sp.wg.Add(2)
-	go withRecover(sp.handleSuccesses)
-	go withRecover(sp.handleErrors)
+	goWithRecover(p.conf.MetricRegistry, sp.handleSuccesses)
+	goWithRecover(p.conf.MetricRegistry, sp.handleErrors)
 
 	return sp
 }
@@ -123,7 +123,7 @@ func (sp *syncProducer) SendMessage(msg *ProducerMessage) (partition int32, offs
 
 func (sp *syncProducer) SendMessages(msgs []*ProducerMessage) error {
 	expectations := make(chan chan *ProducerError, len(msgs))
-	go func() {
+	goWithRecover(sp.producer.conf.MetricRegistry, func() {
 		for _, msg := range msgs {
 			expectation := make(chan *ProducerError, 1)
 			msg.expectation = expectation
@@ -131,7 +131,7 @@ func (sp *syncProducer) SendMessages(msgs []*ProducerMessage) error {
 			expectations <- expectation
 		}
 		close(expectations)
-	}()
+	})
 
 	var errors ProducerErrors
 	for expectation := range expectations {
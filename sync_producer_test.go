@@ -5,6 +5,7 @@ import (
 	"log"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestSyncProducer(t *testing.T) {
@@ -57,6 +58,37 @@ func TestSyncProducer(t *testing.T) {
 	seedBroker.Close()
 }
 
+func TestSyncProducerLogAppendTime(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+
+	logAppendTime := time.Unix(1700000000, 123*int64(time.Millisecond))
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("my_topic", 0, broker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t).
+			SetLogAppendTime("my_topic", 0, logAppendTime),
+	})
+
+	config := NewTestConfig()
+	config.Version = V0_10_0_0
+	config.Producer.Return.Successes = true
+	producer, err := NewSyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, producer)
+
+	msg := &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage), Timestamp: logAppendTime.Add(-time.Hour)}
+	if _, _, err := producer.SendMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Timestamp.Equal(logAppendTime) {
+		t.Errorf("Expected the broker assigned timestamp %s, got %s", logAppendTime, msg.Timestamp)
+	}
+}
+
 func TestSyncProducerTransactional(t *testing.T) {
 	seedBroker := NewMockBroker(t, 1)
 	defer seedBroker.Close()
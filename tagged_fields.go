@@ -0,0 +1,12 @@
+package sarama
+
+// taggedField is a single KIP-482 tagged field whose contents Sarama does not
+// interpret. The raw data is kept so the field can be re-emitted unchanged.
+type taggedField struct {
+	tag  uint64
+	data []byte
+}
+
+// taggedFields holds the tagged fields of a flexible version structure in the
+// order they were decoded (which the protocol requires to be ascending by tag).
+type taggedFields []taggedField
@@ -0,0 +1,98 @@
+package sarama
+
+import (
+	"container/list"
+	"sync"
+)
+
+// topicLRU orders the topics whose metadata the client caches by recency of
+// access, to evict the least recently accessed ones beyond
+// Metadata.MaxCachedTopics. A nil topicLRU tracks nothing and evicts nothing.
+type topicLRU struct {
+	max int
+
+	// lock protects order and elements. It may be acquired while holding the
+	// lock of the client, even its read lock as accesses reorder the topics.
+	lock     sync.Mutex
+	order    *list.List // of topic names, the most recently accessed first
+	elements map[string]*list.Element
+}
+
+func newTopicLRU(max int) *topicLRU {
+	return &topicLRU{
+		max:      max,
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// touch records an access to topic, if it is tracked.
+func (l *topicLRU) touch(topic string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if elem, ok := l.elements[topic]; ok {
+		l.order.MoveToFront(elem)
+	}
+}
+
+// add tracks topic, as the most recently accessed one if it was not tracked
+// yet. Refreshing the metadata of a tracked topic is not an access.
+func (l *topicLRU) add(topic string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.elements[topic]; !ok {
+		l.elements[topic] = l.order.PushFront(topic)
+	}
+}
+
+// remove stops tracking topic.
+func (l *topicLRU) remove(topic string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if elem, ok := l.elements[topic]; ok {
+		l.order.Remove(elem)
+		delete(l.elements, topic)
+	}
+}
+
+// retain stops tracking the topics for which keep returns false, leaving the
+// others in place.
+func (l *topicLRU) retain(keep func(topic string) bool) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for topic, elem := range l.elements {
+		if !keep(topic) {
+			l.order.Remove(elem)
+			delete(l.elements, topic)
+		}
+	}
+}
+
+// evict stops tracking the least recently accessed topics beyond max and
+// returns them.
+func (l *topicLRU) evict() []string {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var evicted []string
+	for l.order.Len() > l.max {
+		topic := l.order.Remove(l.order.Back()).(string)
+		delete(l.elements, topic)
+		evicted = append(evicted, topic)
+	}
+	return evicted
+}
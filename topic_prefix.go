@@ -0,0 +1,68 @@
+package sarama
+
+import "strings"
+
+// physicalTopic returns the name of the topic in the cluster for the logical
+// topic name used by the application.
+func (c *Config) physicalTopic(topic string) string {
+	return c.TopicPrefix + topic
+}
+
+// logicalTopic returns the logical name of the topic named topic in the
+// cluster, and false if it is out of the namespace of Config.TopicPrefix.
+func (c *Config) logicalTopic(topic string) (string, bool) {
+	if !strings.HasPrefix(topic, c.TopicPrefix) {
+		return topic, false
+	}
+	return topic[len(c.TopicPrefix):], true
+}
+
+func (c *Config) physicalTopics(topics []string) []string {
+	if c.TopicPrefix == "" {
+		return topics
+	}
+	physical := make([]string, len(topics))
+	for i, topic := range topics {
+		physical[i] = c.physicalTopic(topic)
+	}
+	return physical
+}
+
+// logicalTopics drops the topics out of the namespace.
+func (c *Config) logicalTopics(topics []string) []string {
+	if c.TopicPrefix == "" {
+		return topics
+	}
+	logical := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if name, ok := c.logicalTopic(topic); ok {
+			logical = append(logical, name)
+		}
+	}
+	return logical
+}
+
+func (c *Config) physicalTopicPartitions(topicPartitions map[string][]int32) map[string][]int32 {
+	if c.TopicPrefix == "" || topicPartitions == nil {
+		return topicPartitions
+	}
+	physical := make(map[string][]int32, len(topicPartitions))
+	for topic, partitions := range topicPartitions {
+		physical[c.physicalTopic(topic)] = partitions
+	}
+	return physical
+}
+
+// logicalTopicPartitions drops the topics out of the namespace.
+func (c *Config) logicalTopicPartitions(topicPartitions map[string][]int32) map[string][]int32 {
+	if c.TopicPrefix == "" || topicPartitions == nil {
+		return topicPartitions
+	}
+	logical := make(map[string][]int32, len(topicPartitions))
+	for topic, partitions := range topicPartitions {
+		if name, ok := c.logicalTopic(topic); ok {
+			logical[name] = partitions
+		}
+	}
+	return logical
+}
@@ -0,0 +1,230 @@
+package sarama
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestTopicPrefixProducer(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("tenant.my_topic", 0, broker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t),
+	})
+
+	config := NewTestConfig()
+	config.TopicPrefix = "tenant."
+	config.Producer.Return.Successes = true
+	producer, err := NewSyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, producer)
+
+	msg := &ProducerMessage{Topic: "my_topic", Value: StringEncoder(TestMessage)}
+	if _, _, err := producer.SendMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != "my_topic" {
+		t.Errorf("expected the logical topic on the acknowledged message, got %q", msg.Topic)
+	}
+
+	produced := false
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*ProduceRequest); ok {
+			if _, ok := req.records["tenant.my_topic"]; !ok {
+				t.Errorf("expected the record to be produced to the prefixed topic, got %v", req.records)
+			}
+			produced = true
+		}
+	}
+	if !produced {
+		t.Error("expected a produce request")
+	}
+}
+
+// prefixHandler records the claims of the session and the topics of the
+// messages consumed, marking them.
+type prefixHandler struct {
+	cancel context.CancelFunc
+
+	lock       sync.Mutex
+	claims     map[string][]int32
+	claimTopic string
+	msgTopics  []string
+}
+
+func (h *prefixHandler) Setup(sess ConsumerGroupSession) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.claims = sess.Claims()
+	return nil
+}
+
+func (h *prefixHandler) Cleanup(sess ConsumerGroupSession) error { return nil }
+
+func (h *prefixHandler) ConsumeClaim(sess ConsumerGroupSession, claim ConsumerGroupClaim) error {
+	h.lock.Lock()
+	h.claimTopic = claim.Topic()
+	h.lock.Unlock()
+
+	msg := <-claim.Messages()
+	h.lock.Lock()
+	h.msgTopics = append(h.msgTopics, msg.Topic)
+	h.lock.Unlock()
+	sess.MarkMessage(msg, "")
+	sess.Commit()
+	h.cancel()
+	return nil
+}
+
+func TestTopicPrefixConsumerGroup(t *testing.T) {
+	config := NewTestConfig()
+	config.ClientID = t.Name()
+	config.Version = V2_0_0_0
+	config.TopicPrefix = "tenant."
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.AutoCommit.Enable = false
+
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("tenant.my-topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("tenant.my-topic", 0, OffsetOldest, 0).
+			SetOffset("tenant.my-topic", 0, OffsetNewest, 1),
+		"FindCoordinatorRequest": NewMockFindCoordinatorResponse(t).
+			SetCoordinator(CoordinatorGroup, "my-group", broker0),
+		"HeartbeatRequest": NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": NewMockJoinGroupResponse(t).SetGroupProtocol(RangeBalanceStrategyName),
+		"SyncGroupRequest": NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&ConsumerGroupMemberAssignment{
+				Version: 0,
+				Topics: map[string][]int32{
+					"tenant.my-topic": {0},
+				},
+			}),
+		"OffsetFetchRequest": NewMockOffsetFetchResponse(t).SetOffset(
+			"my-group", "tenant.my-topic", 0, 0, "", ErrNoError,
+		).SetError(ErrNoError),
+		"OffsetCommitRequest": NewMockOffsetCommitResponse(t),
+		"FetchRequest": NewMockFetchResponse(t, 1).
+			SetMessage("tenant.my-topic", 0, 0, StringEncoder("foo")),
+	})
+
+	group, err := NewConsumerGroup([]string{broker0.Addr()}, "my-group", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = group.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &prefixHandler{cancel: cancel}
+	if err := group.Consume(ctx, []string{"my-topic"}, h); err != nil {
+		t.Fatal(err)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !reflect.DeepEqual(h.claims, map[string][]int32{"my-topic": {0}}) {
+		t.Errorf("expected the claims of the logical topic, got %v", h.claims)
+	}
+	if h.claimTopic != "my-topic" || !reflect.DeepEqual(h.msgTopics, []string{"my-topic"}) {
+		t.Errorf("expected the claim and its messages on the logical topic, got %q %v", h.claimTopic, h.msgTopics)
+	}
+
+	committed := false
+	for _, rr := range broker0.History() {
+		switch req := rr.Request.(type) {
+		case *JoinGroupRequest:
+			meta := new(ConsumerGroupMemberMetadata)
+			if err := decode(req.OrderedGroupProtocols[0].Metadata, meta, nil); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(meta.Topics, []string{"tenant.my-topic"}) {
+				t.Errorf("expected the group to subscribe to the prefixed topic, got %v", meta.Topics)
+			}
+		case *OffsetCommitRequest:
+			if block := req.blocks["tenant.my-topic"][0]; block == nil || block.offset != 1 {
+				t.Errorf("expected the offset of the prefixed topic to be committed, got %v", req.blocks)
+			}
+			committed = true
+		}
+	}
+	if !committed {
+		t.Error("expected an offset commit")
+	}
+}
+
+func TestTopicPrefixAdmin(t *testing.T) {
+	seedBroker := NewMockBroker(t, 1)
+	defer seedBroker.Close()
+
+	seedBroker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetController(seedBroker.BrokerID()).
+			SetBroker(seedBroker.Addr(), seedBroker.BrokerID()).
+			SetLeader("tenant.my_topic", 0, seedBroker.BrokerID()).
+			SetLeader("other.my_topic", 0, seedBroker.BrokerID()),
+		"DescribeConfigsRequest": NewMockDescribeConfigsResponse(t),
+		"CreateTopicsRequest":    NewMockCreateTopicsResponse(t),
+		"DeleteTopicsRequest":    NewMockDeleteTopicsResponse(t),
+	})
+
+	config := NewTestConfig()
+	config.Version = V1_1_0_0
+	config.TopicPrefix = "tenant."
+	admin, err := NewClusterAdmin([]string{seedBroker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, admin)
+
+	topics, err := admin.ListTopics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := topics["my_topic"]; !ok || len(topics) != 1 {
+		t.Errorf("expected only the logical topics of the namespace, got %v", topics)
+	}
+
+	metadata, err := admin.DescribeTopics([]string{"my_topic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata) != 1 || metadata[0].Name != "my_topic" {
+		t.Errorf("expected the metadata of the logical topic, got %v", metadata)
+	}
+
+	if err := admin.CreateTopic("new_topic", &TopicDetail{NumPartitions: 1, ReplicationFactor: 1}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.DeleteTopic("my_topic"); err != nil {
+		t.Fatal(err)
+	}
+
+	var created, deleted []string
+	for _, rr := range seedBroker.History() {
+		switch req := rr.Request.(type) {
+		case *CreateTopicsRequest:
+			for topic := range req.TopicDetails {
+				created = append(created, topic)
+			}
+		case *DeleteTopicsRequest:
+			deleted = append(deleted, req.Topics...)
+		}
+	}
+	sort.Strings(created)
+	if !reflect.DeepEqual(created, []string{"tenant.new_topic"}) || !reflect.DeepEqual(deleted, []string{"tenant.my_topic"}) {
+		t.Errorf("expected the prefixed topics to be created and deleted, got %v and %v", created, deleted)
+	}
+}
@@ -0,0 +1,117 @@
+package sarama
+
+import "context"
+
+// TraceParentHeader is the record header propagating the W3C trace context
+// (https://www.w3.org/TR/trace-context/) of the span which produced a record.
+const TraceParentHeader = "traceparent"
+
+// Tracer starts the spans tracing the records produced and consumed. Set it
+// in Config.Tracer to adapt a tracing library, e.g. OpenTelemetry, which
+// sarama itself does not depend on.
+type Tracer interface {
+	// StartProducerSpan starts the span of msg being produced, as a child of
+	// the span in msg.Context if any. It is called once, when the producer
+	// reads msg from its input and before the interceptors run. The span ends
+	// once msg was acknowledged, with its Partition and Offset set, or failed.
+	StartProducerSpan(msg *ProducerMessage) Span
+
+	// StartConsumerSpan starts the span of msg being consumed, after the
+	// interceptors ran. parent is the traceparent propagated in the
+	// TraceParentHeader of msg, empty if it has none or it is malformed. The
+	// span ends once msg was delivered on the Messages channel, or with
+	// context.Canceled if the partition consumer closed before.
+	StartConsumerSpan(msg *ConsumerMessage, parent string) Span
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// TraceParent returns the W3C traceparent of the span, which the producer
+	// sets as the TraceParentHeader of the record from Kafka 0.11 on, or "" not
+	// to propagate it.
+	TraceParent() string
+
+	// End ends the span, err being the reason the record could not be produced
+	// or delivered, nil otherwise.
+	End(err error)
+}
+
+func (m *ProducerMessage) startSpan(conf *Config) {
+	if conf.Tracer == nil {
+		return
+	}
+	m.span = conf.Tracer.StartProducerSpan(m)
+	traceParent := m.span.TraceParent()
+	if traceParent == "" || !conf.Version.IsAtLeast(V0_11_0_0) {
+		// record headers require Kafka 0.11
+		return
+	}
+	for i := range m.Headers {
+		if string(m.Headers[i].Key) == TraceParentHeader {
+			m.Headers[i].Value = []byte(traceParent)
+			return
+		}
+	}
+	m.Headers = append(m.Headers, RecordHeader{Key: []byte(TraceParentHeader), Value: []byte(traceParent)})
+}
+
+func (m *ProducerMessage) endSpan(err error) {
+	if m.span != nil {
+		m.span.End(err)
+		m.span = nil
+	}
+}
+
+func (m *ConsumerMessage) startSpan(tracer Tracer) {
+	if tracer == nil || m.span != nil {
+		return
+	}
+	var parent string
+	for _, h := range m.Headers {
+		if h != nil && string(h.Key) == TraceParentHeader && validTraceParent(h.Value) {
+			parent = string(h.Value)
+		}
+	}
+	m.span = tracer.StartConsumerSpan(m, parent)
+}
+
+// detachSpan takes the span of m before m is sent on the Messages channel, as
+// the user may read m concurrently as soon as it is received.
+func (m *ConsumerMessage) detachSpan() Span {
+	span := m.span
+	m.span = nil
+	return span
+}
+
+func endConsumerSpan(span Span, delivered bool) {
+	if span == nil {
+		return
+	}
+	if delivered {
+		span.End(nil)
+	} else {
+		span.End(context.Canceled)
+	}
+}
+
+// validTraceParent reports whether traceParent is formatted as
+// version-traceid-parentid-flags, in lowercase hex.
+func validTraceParent(traceParent []byte) bool {
+	// the lengths of the fields of version 00, which later versions extend
+	if len(traceParent) < 55 || (len(traceParent) > 55 && traceParent[55] != '-') {
+		return false
+	}
+	for i, c := range traceParent[:55] {
+		switch i {
+		case 2, 35, 52:
+			if c != '-' {
+				return false
+			}
+		default:
+			if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+				return false
+			}
+		}
+	}
+	return string(traceParent[:2]) != "ff"
+}
@@ -0,0 +1,197 @@
+package sarama
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type testSpan struct {
+	tracer      *testTracer
+	parent      string
+	traceParent string
+	topic       string
+	partition   int32
+	offset      int64
+	consumer    bool
+	ended       bool
+	err         error
+}
+
+func (s *testSpan) TraceParent() string { return s.traceParent }
+
+func (s *testSpan) End(err error) {
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	if s.ended {
+		s.tracer.t.Error("span ended twice")
+	}
+	s.ended, s.err = true, err
+}
+
+// testTracer records the spans it starts, reading the partition and offset
+// of produced records once acknowledged through msg.
+type testTracer struct {
+	t     *testing.T
+	lock  sync.Mutex
+	spans []*testSpan
+}
+
+func (tr *testTracer) StartProducerSpan(msg *ProducerMessage) Span {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	span := &testSpan{
+		tracer:      tr,
+		topic:       msg.Topic,
+		traceParent: fmt.Sprintf("00-4bf92f3577b34da6a3ce929d0e0e4736-%016x-01", len(tr.spans)+1),
+	}
+	tr.spans = append(tr.spans, span)
+	return &producerTestSpan{span, msg}
+}
+
+func (tr *testTracer) StartConsumerSpan(msg *ConsumerMessage, parent string) Span {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	span := &testSpan{
+		tracer:    tr,
+		parent:    parent,
+		topic:     msg.Topic,
+		partition: msg.Partition,
+		offset:    msg.Offset,
+		consumer:  true,
+	}
+	tr.spans = append(tr.spans, span)
+	return span
+}
+
+type producerTestSpan struct {
+	*testSpan
+	msg *ProducerMessage
+}
+
+func (s *producerTestSpan) End(err error) {
+	s.partition, s.offset = s.msg.Partition, s.msg.Offset
+	s.testSpan.End(err)
+}
+
+func TestProducerTracing(t *testing.T) {
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("my_topic", 0, broker.BrokerID()).
+			SetLeader("invalid_topic", 0, broker.BrokerID()),
+		"ProduceRequest": NewMockProduceResponse(t).
+			SetError("invalid_topic", 0, ErrInvalidMessage),
+	})
+
+	tracer := &testTracer{t: t}
+	config := NewTestConfig()
+	config.Version = V0_11_0_0
+	config.Producer.Return.Successes = true
+	config.Tracer = tracer
+	producer, err := NewSyncProducer([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safeClose(t, producer)
+
+	msg := &ProducerMessage{
+		Topic:   "my_topic",
+		Value:   StringEncoder(TestMessage),
+		Headers: []RecordHeader{{Key: []byte(TraceParentHeader), Value: []byte("stale")}},
+	}
+	if _, _, err := producer.SendMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Headers) != 1 || string(msg.Headers[0].Value) != tracer.spans[0].traceParent {
+		t.Errorf("expected the traceparent of the span to be propagated, got %v", msg.Headers)
+	}
+	if span := tracer.spans[0]; !span.ended || span.err != nil || span.topic != "my_topic" || span.offset != 0 {
+		t.Errorf("expected the span to end with the acknowledged record, got %+v", span)
+	}
+
+	if _, _, err := producer.SendMessage(&ProducerMessage{Topic: "invalid_topic", Value: StringEncoder(TestMessage)}); err == nil {
+		t.Fatal("expected the record to fail")
+	}
+	if len(tracer.spans) != 2 {
+		t.Fatalf("expected a span per record, got %d", len(tracer.spans))
+	}
+	if span := tracer.spans[1]; !span.ended || !errors.Is(span.err, ErrInvalidMessage) {
+		t.Errorf("expected the span to end with the failure, got %+v", span)
+	}
+}
+
+func TestConsumerTracing(t *testing.T) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	fetchResponse := &FetchResponse{Version: 5}
+	fetchResponse.AddRecord("my_topic", 0, nil, testMsg, 0)
+	fetchResponse.AddRecord("my_topic", 0, nil, testMsg, 1)
+	records := fetchResponse.Blocks["my_topic"][0].RecordsSet[0].RecordBatch.Records
+	records[0].Headers = []*RecordHeader{{Key: []byte(TraceParentHeader), Value: []byte(traceParent)}}
+	records[1].Headers = []*RecordHeader{{Key: []byte(TraceParentHeader), Value: []byte("malformed")}}
+
+	broker0 := NewMockBroker(t, 0)
+	defer broker0.Close()
+	broker0.SetHandlerByMap(map[string]MockResponse{
+		"MetadataRequest": NewMockMetadataResponse(t).
+			SetBroker(broker0.Addr(), broker0.BrokerID()).
+			SetLeader("my_topic", 0, broker0.BrokerID()),
+		"OffsetRequest": NewMockOffsetResponse(t).
+			SetOffset("my_topic", 0, OffsetOldest, 0).
+			SetOffset("my_topic", 0, OffsetNewest, 2),
+		"FetchRequest": NewMockSequence(fetchResponse, &FetchResponse{Version: 5}),
+	})
+
+	tracer := &testTracer{t: t}
+	config := NewTestConfig()
+	config.Version = V0_11_0_0
+	config.Tracer = tracer
+	master, err := NewConsumer([]string{broker0.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, err := master.ConsumePartition("my_topic", 0, OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, parent := range []string{traceParent, ""} {
+		msg := <-consumer.Messages()
+		tracer.lock.Lock()
+		span := tracer.spans[msg.Offset]
+		tracer.lock.Unlock()
+		if span.parent != parent || span.offset != msg.Offset || !span.consumer {
+			t.Errorf("expected the span of offset %d to have parent %q, got %+v", msg.Offset, parent, span)
+		}
+	}
+
+	safeClose(t, consumer)
+	safeClose(t, master)
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	for _, span := range tracer.spans {
+		if !span.ended || span.err != nil {
+			t.Errorf("expected the span of offset %d to end once delivered, got %+v", span.offset, span)
+		}
+	}
+}
+
+func TestValidTraceParent(t *testing.T) {
+	for traceParent, valid := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":        true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01x":       false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":        false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":        false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7-01":        false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":           false,
+	} {
+		if validTraceParent([]byte(traceParent)) != valid {
+			t.Errorf("expected %q to be valid: %v", traceParent, valid)
+		}
+	}
+}
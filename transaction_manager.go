@@ -307,7 +307,7 @@ func (t *transactionManager) publishOffsetsToTxn(offsets topicPartitionOffsets,
 			backoff := t.computeBackoff(attemptsRemaining)
 			Logger.Printf("txnmgr/add-offset-to-txn [%s] retrying after %dms... (%d attempts remaining) (%s)\n",
 				t.transactionalID, backoff/time.Millisecond, attemptsRemaining, err)
-			time.Sleep(backoff)
+			t.client.Config().getClock().Sleep(backoff)
 			attemptsRemaining--
 		}
 		return err
@@ -390,7 +390,7 @@ func (t *transactionManager) publishOffsetsToTxn(offsets topicPartitionOffsets,
 			backoff := t.computeBackoff(attemptsRemaining)
 			Logger.Printf("txnmgr/txn-offset-commit [%s] retrying after %dms... (%d attempts remaining) (%s)\n",
 				t.transactionalID, backoff/time.Millisecond, attemptsRemaining, err)
-			time.Sleep(backoff)
+			t.client.Config().getClock().Sleep(backoff)
 			attemptsRemaining--
 		}
 		return r, err
@@ -529,7 +529,7 @@ func (t *transactionManager) initProducerId() (int64, int16, error) {
 			backoff := t.computeBackoff(attemptsRemaining)
 			Logger.Printf("txnmgr/init-producer-id [%s] retrying after %dms... (%d attempts remaining) (%s)\n",
 				t.transactionalID, backoff/time.Millisecond, attemptsRemaining, err)
-			time.Sleep(backoff)
+			t.client.Config().getClock().Sleep(backoff)
 			attemptsRemaining--
 		}
 		return -1, -1, err
@@ -628,7 +628,7 @@ func (t *transactionManager) endTxn(commit bool) error {
 			backoff := t.computeBackoff(attemptsRemaining)
 			Logger.Printf("txnmgr/endtxn [%s] retrying after %dms... (%d attempts remaining) (%s)\n",
 				t.transactionalID, backoff/time.Millisecond, attemptsRemaining, err)
-			time.Sleep(backoff)
+			t.client.Config().getClock().Sleep(backoff)
 			attemptsRemaining--
 		}
 		return err
@@ -757,7 +757,10 @@ func (t *transactionManager) maybeAddPartitionToCurrentTxn(topic string, partiti
 	t.pendingPartitionsInCurrentTxn[tp] = struct{}{}
 }
 
-// Makes a request to kafka to add a list of partitions ot the current transaction.
+// Makes a request to kafka to add the pending partitions to the current transaction.
+// All the partitions produced to since the last call, whatever their topic, are
+// added by a single request to the transaction coordinator, and only those
+// which failed with a retriable error are sent again.
 func (t *transactionManager) publishTxnPartitions() error {
 	t.partitionInTxnLock.Lock()
 	defer t.partitionInTxnLock.Unlock()
@@ -805,7 +808,7 @@ func (t *transactionManager) publishTxnPartitions() error {
 			}
 			backoff := computeBackoff(attemptsRemaining)
 			Logger.Printf("txnmgr/add-partition-to-txn retrying after %dms... (%d attempts remaining) (%s)\n", backoff/time.Millisecond, attemptsRemaining, err)
-			time.Sleep(backoff)
+			t.client.Config().getClock().Sleep(backoff)
 			attemptsRemaining--
 		}
 		return err
@@ -839,8 +842,19 @@ func (t *transactionManager) publishTxnPartitions() error {
 			return true, ErrTxnUnableToParseResponse
 		}
 
-		// remove from the list partitions that have been successfully updated
-		var responseErrors []error
+		// remove from the list partitions that have been successfully updated,
+		// looking at the results of all the partitions before acting on their
+		// errors: when a partition is rejected, the broker does not attempt to
+		// add the others, and the error of the rejected one decides whether
+		// the whole batch is retried or the transaction fails.
+		var (
+			responseErrors     []error
+			refreshCoordinator bool
+			notAttemptedErr    error
+			abortableErr       error
+			producerIDErr      error
+			fatalErr           error
+		)
 		for topic, results := range addPartResponse.Errors {
 			for _, response := range results {
 				tp := topicPartition{topic: topic, partition: response.Partition}
@@ -853,9 +867,7 @@ func (t *transactionManager) publishTxnPartitions() error {
 				case ErrConsumerCoordinatorNotAvailable:
 					fallthrough
 				case ErrNotCoordinatorForConsumer:
-					_ = coordinator.Close()
-					_ = t.client.RefreshTransactionCoordinator(t.transactionalID)
-					fallthrough
+					refreshCoordinator = true
 				case ErrUnknownTopicOrPartition:
 					fallthrough
 				case ErrOffsetsLoadInProgress:
@@ -865,24 +877,43 @@ func (t *transactionManager) publishTxnPartitions() error {
 						retryBackoff = addPartitionsRetryBackoff
 					}
 				case ErrOperationNotAttempted:
-					fallthrough
+					// Retried along with the partitions which were rejected
+					notAttemptedErr = response.Err
+					continue
 				case ErrTopicAuthorizationFailed:
-					removeAllPartitionsOnFatalOrAbortedError()
-					return false, t.transitionTo(ProducerTxnFlagInError|ProducerTxnFlagAbortableError, response.Err)
+					abortableErr = response.Err
 				case ErrUnknownProducerID:
 					fallthrough
 				case ErrInvalidProducerIDMapping:
-					removeAllPartitionsOnFatalOrAbortedError()
-					return false, t.abortableErrorIfPossible(response.Err)
+					producerIDErr = response.Err
 				// Fatal errors
 				default:
-					removeAllPartitionsOnFatalOrAbortedError()
-					return false, t.transitionTo(ProducerTxnFlagInError|ProducerTxnFlagFatalError, response.Err)
+					fatalErr = response.Err
 				}
 				responseErrors = append(responseErrors, response.Err)
 			}
 		}
 
+		switch {
+		case fatalErr != nil:
+			removeAllPartitionsOnFatalOrAbortedError()
+			return false, t.transitionTo(ProducerTxnFlagInError|ProducerTxnFlagFatalError, fatalErr)
+		case producerIDErr != nil:
+			removeAllPartitionsOnFatalOrAbortedError()
+			return false, t.abortableErrorIfPossible(producerIDErr)
+		case abortableErr != nil:
+			removeAllPartitionsOnFatalOrAbortedError()
+			return false, t.transitionTo(ProducerTxnFlagInError|ProducerTxnFlagAbortableError, abortableErr)
+		case notAttemptedErr != nil && len(responseErrors) == 0:
+			// no partition was rejected with a retriable error
+			removeAllPartitionsOnFatalOrAbortedError()
+			return false, t.transitionTo(ProducerTxnFlagInError|ProducerTxnFlagAbortableError, notAttemptedErr)
+		}
+		if refreshCoordinator {
+			_ = coordinator.Close()
+			_ = t.client.RefreshTransactionCoordinator(t.transactionalID)
+		}
+
 		// handle end
 		if len(t.pendingPartitionsInCurrentTxn) == 0 {
 			DebugLogger.Printf("txnmgr/add-partition-to-txn [%s] successful to add partitions txn %+v\n",
@@ -1030,3 +1030,113 @@ func TestPublishPartitionToTxn(t *testing.T) {
 		}()
 	}
 }
+
+func TestPublishPartitionToTxnPartialErrors(t *testing.T) {
+	type testCase struct {
+		name                      string
+		errs                      map[string]KError
+		expectedFlags             ProducerTxnStatusFlag
+		expectedError             error
+		expectedPendingPartitions topicPartitionSet
+		expectedPartitionsInTxn   topicPartitionSet
+	}
+
+	testTopic := topicPartition{topic: "test-topic", partition: 0}
+	otherTopic := topicPartition{topic: "other-topic", partition: 0}
+
+	testCases := []testCase{
+		{
+			name:                      "retriable error and not attempted",
+			errs:                      map[string]KError{"test-topic": ErrUnknownTopicOrPartition, "other-topic": ErrOperationNotAttempted},
+			expectedFlags:             ProducerTxnFlagInTransaction,
+			expectedError:             Wrap(ErrAddPartitionsToTxn, ErrUnknownTopicOrPartition),
+			expectedPendingPartitions: topicPartitionSet{testTopic: struct{}{}, otherTopic: struct{}{}},
+			expectedPartitionsInTxn:   topicPartitionSet{},
+		},
+		{
+			name:                      "abortable error and not attempted",
+			errs:                      map[string]KError{"test-topic": ErrOperationNotAttempted, "other-topic": ErrTopicAuthorizationFailed},
+			expectedFlags:             ProducerTxnFlagAbortableError,
+			expectedError:             ErrTopicAuthorizationFailed,
+			expectedPendingPartitions: topicPartitionSet{},
+			expectedPartitionsInTxn:   topicPartitionSet{},
+		},
+		{
+			name:                      "retriable error and added",
+			errs:                      map[string]KError{"test-topic": ErrNoError, "other-topic": ErrOffsetsLoadInProgress},
+			expectedFlags:             ProducerTxnFlagInTransaction,
+			expectedError:             Wrap(ErrAddPartitionsToTxn, ErrOffsetsLoadInProgress),
+			expectedPendingPartitions: topicPartitionSet{otherTopic: struct{}{}},
+			expectedPartitionsInTxn:   topicPartitionSet{testTopic: struct{}{}},
+		},
+	}
+
+	broker := NewMockBroker(t, 1)
+	defer broker.Close()
+
+	metadataLeader := new(MetadataResponse)
+	metadataLeader.Version = 4
+	metadataLeader.ControllerID = broker.brokerID
+	metadataLeader.AddBroker(broker.Addr(), broker.BrokerID())
+	metadataLeader.AddTopic("test-topic", ErrNoError)
+	metadataLeader.AddTopicPartition("test-topic", 0, broker.BrokerID(), nil, nil, nil, ErrNoError)
+	metadataLeader.AddTopic("other-topic", ErrNoError)
+	metadataLeader.AddTopicPartition("other-topic", 0, broker.BrokerID(), nil, nil, nil, ErrNoError)
+
+	config := NewTestConfig()
+	config.Producer.Idempotent = true
+	config.Producer.Transaction.ID = "test"
+	config.Version = V0_11_0_0
+	config.Producer.RequiredAcks = WaitForAll
+	config.Net.MaxOpenRequests = 1
+	config.Producer.Transaction.Retry.Max = 0
+	config.Producer.Transaction.Retry.Backoff = 0
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			broker.Returns(metadataLeader)
+
+			client, err := NewClient([]string{broker.Addr()}, config)
+			require.NoError(t, err)
+			defer client.Close()
+
+			broker.Returns(&FindCoordinatorResponse{
+				Coordinator: client.Brokers()[0],
+				Err:         ErrNoError,
+				Version:     1,
+			})
+			broker.Returns(&InitProducerIDResponse{
+				Err:           ErrNoError,
+				ProducerID:    1,
+				ProducerEpoch: 0,
+			})
+
+			txmng, err := newTransactionManager(config, client)
+			require.NoError(t, err)
+
+			txmng.status = ProducerTxnFlagInTransaction
+			txmng.pendingPartitionsInCurrentTxn = topicPartitionSet{testTopic: struct{}{}, otherTopic: struct{}{}}
+			response := &AddPartitionsToTxnResponse{Errors: map[string][]*PartitionError{}}
+			for topic, kerr := range tc.errs {
+				response.Errors[topic] = []*PartitionError{{Partition: 0, Err: kerr}}
+			}
+			broker.Returns(response)
+
+			seen := len(broker.History())
+			err = txmng.publishTxnPartitions()
+			require.Equal(t, tc.expectedError.Error(), err.Error())
+			require.True(t, txmng.status&tc.expectedFlags != 0)
+			require.Equal(t, tc.expectedPartitionsInTxn, txmng.partitionsInCurrentTxn)
+			require.Equal(t, tc.expectedPendingPartitions, txmng.pendingPartitionsInCurrentTxn)
+
+			var requests int
+			for _, exchange := range broker.History()[seen:] {
+				if request, ok := exchange.Request.(*AddPartitionsToTxnRequest); ok {
+					requests++
+					require.Len(t, request.TopicPartitions, 2)
+				}
+			}
+			require.Equal(t, 1, requests)
+		})
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
 )
 
 type none struct{}
@@ -43,9 +46,50 @@ func withRecover(fn func()) {
 	fn()
 }
 
-func safeAsyncClose(b *Broker) {
-	tmp := b // local var prevents clobbering in goroutine
+// goroutinesLock serialises the updates of the goroutines counters, which are
+// unregistered once no goroutine runs, like the other metrics of a closed
+// client.
+var goroutinesLock sync.Mutex
+
+// goWithRecover runs fn in a new goroutine with withRecover, counting it in
+// the goroutines counter of registry while it runs.
+func goWithRecover(registry metrics.Registry, fn func()) {
+	if registry == nil {
+		go withRecover(fn)
+		return
+	}
+	goroutinesLock.Lock()
+	goroutines := metrics.GetOrRegisterCounter("goroutines", registry)
+	goroutines.Inc(1)
+	goroutinesLock.Unlock()
+
 	go withRecover(func() {
+		defer func() {
+			goroutinesLock.Lock()
+			defer goroutinesLock.Unlock()
+			goroutines.Dec(1)
+			if goroutines.Count() == 0 && registry.Get("goroutines") == goroutines {
+				registry.Unregister("goroutines")
+			}
+		}()
+		fn()
+	})
+}
+
+// sessionMetricRegistry returns the metric registry of the consumer group
+// running sess, or nil for other ConsumerGroupSession implementations.
+func sessionMetricRegistry(sess ConsumerGroupSession) metrics.Registry {
+	if s, ok := sess.(interface{ getMetricRegistry() metrics.Registry }); ok {
+		return s.getMetricRegistry()
+	}
+	return nil
+}
+
+// safeAsyncClose closes b, if connected, in a goroutine counted in the
+// goroutines counter of registry.
+func safeAsyncClose(b *Broker, registry metrics.Registry) {
+	tmp := b // local var prevents clobbering in goroutine
+	goWithRecover(registry, func() {
 		if connected, _ := tmp.Connected(); connected {
 			if err := tmp.Close(); err != nil {
 				Logger.Println("Error closing broker", tmp.ID(), ":", err)